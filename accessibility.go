@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The outline gives clients what they need to describe the layout to
+// assistive technology without loading every list: where each server and
+// channel sits among its siblings (aria-posinset / aria-setsize), how many
+// members and messages there are, and where the unread messages start.
+type accessibilityOutline struct {
+	Servers  []serverOutline  `json:"servers"`
+	Channels []channelOutline `json:"channels"`
+}
+
+type serverOutline struct {
+	ServerID    int64   `json:"serverId"`
+	Position    int     `json:"position"`
+	SetSize     int     `json:"setSize"`
+	MemberCount int     `json:"memberCount"`
+	ChannelIDs  []int64 `json:"channelIds"`
+}
+
+// channelOutline describes one channel or DM. ServerID is 0 for DMs, which
+// are positioned among the user's DMs in conversation order. Messages the
+// user wrote are never unread.
+type channelOutline struct {
+	ChannelID     int64 `json:"channelId"`
+	ServerID      int64 `json:"serverId,omitempty"`
+	Position      int   `json:"position,omitempty"`
+	SetSize       int   `json:"setSize,omitempty"`
+	MessageCount  int64 `json:"messageCount"`
+	UnreadCount   int64 `json:"unreadCount"`
+	LastReadID    int64 `json:"lastReadId,omitempty"`
+	FirstUnreadID int64 `json:"firstUnreadId,omitempty"`
+}
+
+const channelOutlineSelect = `
+        SELECT c.id, COALESCE(rd.last_read_message_id, 0),
+            (SELECT COUNT(*) FROM channel_messages m
+             WHERE m.channel_id = c.id AND (m.expires_at IS NULL OR m.expires_at > ?)),
+            (SELECT COUNT(*) FROM channel_messages m
+             WHERE m.channel_id = c.id AND m.id > COALESCE(rd.last_read_message_id, 0) AND m.author_id != ?
+               AND (m.expires_at IS NULL OR m.expires_at > ?)),
+            (SELECT MIN(m.id) FROM channel_messages m
+             WHERE m.channel_id = c.id AND m.id > COALESCE(rd.last_read_message_id, 0) AND m.author_id != ?
+               AND (m.expires_at IS NULL OR m.expires_at > ?))
+        FROM channels c
+        LEFT JOIN channel_reads rd ON rd.channel_id = c.id AND rd.user_id = ?
+`
+
+func scanChannelOutline(row interface{ Scan(...any) error }) (channelOutline, error) {
+	var co channelOutline
+	var firstUnread sql.NullInt64
+	if err := row.Scan(&co.ChannelID, &co.LastReadID, &co.MessageCount, &co.UnreadCount, &firstUnread); err != nil {
+		return channelOutline{}, err
+	}
+	co.FirstUnreadID = firstUnread.Int64
+	return co, nil
+}
+
+func channelOutlineArgs(u user) []any {
+	now := time.Now().UTC()
+	return []any{now, u.ID, now, u.ID, now, u.ID}
+}
+
+// channelOutlines returns the counts for every channel and DM u can read.
+func (s *serverState) channelOutlines(ctx context.Context, u user) (map[int64]channelOutline, error) {
+	rows, err := s.readDB.QueryContext(ctx, channelOutlineSelect+`
+        WHERE (c.kind = 'dm' AND EXISTS (SELECT 1 FROM dm_participants p WHERE p.channel_id = c.id AND p.user_email = ?))
+           OR (c.kind != 'dm' AND c.server_id IN (SELECT server_id FROM server_members WHERE user_id = ?)
+               AND `+channelVisibleTo("?")+`)
+    `, append(channelOutlineArgs(u), u.Email, u.ID, u.ID)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[int64]channelOutline)
+	for rows.Next() {
+		co, err := scanChannelOutline(rows)
+		if err != nil {
+			return nil, err
+		}
+		result[co.ChannelID] = co
+	}
+	return result, rows.Err()
+}
+
+func (s *serverState) channelOutlineFor(ctx context.Context, u user, ch channelInfo) (channelOutline, error) {
+	co, err := scanChannelOutline(s.readDB.QueryRowContext(ctx, channelOutlineSelect+`
+        WHERE c.id = ?
+    `, append(channelOutlineArgs(u), ch.ID)...))
+	if err != nil {
+		return channelOutline{}, err
+	}
+	if ch.Kind != "dm" {
+		co.ServerID = ch.ServerID
+	}
+	return co, nil
+}
+
+func (s *serverState) serverMemberCounts(ctx context.Context, userID int64) (map[int64]int, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT server_id, COUNT(*) FROM server_members
+        WHERE server_id IN (SELECT server_id FROM server_members WHERE user_id = ?)
+        GROUP BY server_id
+    `, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[int64]int)
+	for rows.Next() {
+		var serverID int64
+		var count int
+		if err := rows.Scan(&serverID, &count); err != nil {
+			return nil, err
+		}
+		counts[serverID] = count
+	}
+	return counts, rows.Err()
+}
+
+// accessibilityOutline follows the order bootstrap lists servers and
+// channels in, and the conversation order for DMs.
+func (s *serverState) accessibilityOutline(ctx context.Context, u user, servers []serverPayload, conversations []conversationHint) (accessibilityOutline, error) {
+	stats, err := s.channelOutlines(ctx, u)
+	if err != nil {
+		return accessibilityOutline{}, err
+	}
+	memberCounts, err := s.serverMemberCounts(ctx, u.ID)
+	if err != nil {
+		return accessibilityOutline{}, err
+	}
+
+	outline := accessibilityOutline{
+		Servers:  make([]serverOutline, 0, len(servers)),
+		Channels: make([]channelOutline, 0, len(stats)),
+	}
+	for i, srv := range servers {
+		ids := make([]int64, 0, len(srv.Channels))
+		for j, ch := range srv.Channels {
+			ids = append(ids, ch.ID)
+			co := stats[ch.ID]
+			co.ChannelID, co.ServerID = ch.ID, srv.ID
+			co.Position, co.SetSize = j+1, len(srv.Channels)
+			outline.Channels = append(outline.Channels, co)
+		}
+		outline.Servers = append(outline.Servers, serverOutline{
+			ServerID:    srv.ID,
+			Position:    i + 1,
+			SetSize:     len(servers),
+			MemberCount: memberCounts[srv.ID],
+			ChannelIDs:  ids,
+		})
+	}
+
+	var dms []int64
+	for _, hint := range conversations {
+		if hint.Kind == "dm" {
+			dms = append(dms, hint.ChannelID)
+		}
+	}
+	for i, id := range dms {
+		co := stats[id]
+		co.ChannelID = id
+		co.Position, co.SetSize = i+1, len(dms)
+		outline.Channels = append(outline.Channels, co)
+	}
+	return outline, nil
+}
+
+// markChannelRead moves the user's read marker for the channel up to
+// messageID. It never moves back, so a stale device cannot undo a newer read.
+func (s *serverState) markChannelRead(ctx context.Context, userID, channelID, messageID int64) error {
+	_, err := s.db.ExecContext(ctx, `
+        INSERT INTO channel_reads (user_id, channel_id, last_read_message_id, updated_at) VALUES (?, ?, ?, ?)
+        ON CONFLICT (user_id, channel_id) DO UPDATE SET
+            last_read_message_id = MAX(last_read_message_id, excluded.last_read_message_id),
+            updated_at = excluded.updated_at
+    `, userID, channelID, messageID, time.Now().UTC())
+	return err
+}
+
+// handleChannelRead serves /api/channels/{id}/read: GET returns the
+// channel's counts and read marker, and PUT { messageId } marks everything
+// up to that message as read.
+func (s *serverState) handleChannelRead(w http.ResponseWriter, r *http.Request, ch channelInfo, currentUser user) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		defer r.Body.Close()
+		var body struct {
+			MessageID int64 `json:"messageId" validate:"required,min=1"`
+		}
+		if !s.decodeJSON(w, r, &body) {
+			return
+		}
+		var exists bool
+		err := s.readDB.QueryRowContext(r.Context(), `SELECT EXISTS (SELECT 1 FROM channel_messages WHERE id = ? AND channel_id = ?)`, body.MessageID, ch.ID).Scan(&exists)
+		if err != nil {
+			log.Printf("check read message: %v", err)
+			httpError(w, "failed to update read marker", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			httpError(w, "message not found", http.StatusNotFound)
+			return
+		}
+		if err := s.markChannelRead(r.Context(), currentUser.ID, ch.ID, body.MessageID); err != nil {
+			log.Printf("mark channel %d read: %v", ch.ID, err)
+			httpError(w, "failed to update read marker", http.StatusInternalServerError)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	co, err := s.channelOutlineFor(r.Context(), currentUser, ch)
+	if err != nil {
+		log.Printf("load channel outline %d: %v", ch.ID, err)
+		httpError(w, "failed to load channel", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(co); err != nil {
+		log.Printf("encode channel outline: %v", err)
+	}
+}
+
+// readingEntry is one message's place in a channel's reading order.
+// Position counts from 1 at the oldest message still in the channel.
+type readingEntry struct {
+	MessageID  int64     `json:"messageId"`
+	Position   int64     `json:"position"`
+	AuthorID   int64     `json:"authorId"`
+	AuthorName string    `json:"authorName"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Unread     bool      `json:"unread,omitempty"`
+}
+
+type readingOrderDTO struct {
+	ChannelID     int64          `json:"channelId"`
+	SetSize       int64          `json:"setSize"`
+	FirstUnreadID int64          `json:"firstUnreadId,omitempty"`
+	Entries       []readingEntry `json:"entries"`
+	// HasMore is true when there are older entries; pass the first
+	// entry's messageId as before to get them.
+	HasMore bool `json:"hasMore"`
+}
+
+func (s *serverState) readingOrder(ctx context.Context, u user, ch channelInfo, before int64, limit int) (readingOrderDTO, error) {
+	co, err := s.channelOutlineFor(ctx, u, ch)
+	if err != nil {
+		return readingOrderDTO{}, err
+	}
+	order := readingOrderDTO{ChannelID: ch.ID, SetSize: co.MessageCount, FirstUnreadID: co.FirstUnreadID, Entries: []readingEntry{}}
+
+	now := time.Now().UTC()
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT m.id, m.author_id, u.display_name, m.created_at
+        FROM channel_messages m
+        JOIN users u ON u.id = m.author_id
+        WHERE m.channel_id = ? AND m.id < ? AND (m.expires_at IS NULL OR m.expires_at > ?)
+        ORDER BY m.id DESC
+        LIMIT ?
+    `, ch.ID, before, now, limit)
+	if err != nil {
+		return readingOrderDTO{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e readingEntry
+		if err := rows.Scan(&e.MessageID, &e.AuthorID, &e.AuthorName, &e.CreatedAt); err != nil {
+			return readingOrderDTO{}, err
+		}
+		e.Unread = e.MessageID > co.LastReadID && e.AuthorID != u.ID
+		order.Entries = append(order.Entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return readingOrderDTO{}, err
+	}
+	if len(order.Entries) == 0 {
+		return order, nil
+	}
+
+	for i, j := 0, len(order.Entries)-1; i < j; i, j = i+1, j-1 {
+		order.Entries[i], order.Entries[j] = order.Entries[j], order.Entries[i]
+	}
+	var older int64
+	err = s.readDB.QueryRowContext(ctx, `
+        SELECT COUNT(*) FROM channel_messages
+        WHERE channel_id = ? AND id < ? AND (expires_at IS NULL OR expires_at > ?)
+    `, ch.ID, order.Entries[0].MessageID, now).Scan(&older)
+	if err != nil {
+		return readingOrderDTO{}, err
+	}
+	for i := range order.Entries {
+		order.Entries[i].Position = older + int64(i) + 1
+	}
+	order.HasMore = older > 0
+	return order, nil
+}
+
+// handleChannelReadingOrder serves GET /api/channels/{id}/reading-order: the
+// channel's messages as positions in reading order, newest page first,
+// without their content.
+func (s *serverState) handleChannelReadingOrder(w http.ResponseWriter, r *http.Request, ch channelInfo, currentUser user) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := 200
+	if raw := strings.TrimSpace(r.URL.Query().Get("limit")); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			if n > 1000 {
+				n = 1000
+			}
+			limit = n
+		}
+	}
+	before := int64(math.MaxInt64)
+	if raw := strings.TrimSpace(r.URL.Query().Get("before")); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n <= 0 {
+			httpError(w, "before must be a message ID", http.StatusBadRequest)
+			return
+		}
+		before = n
+	}
+
+	order, err := s.readingOrder(r.Context(), currentUser, ch, before, limit)
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("reading order for channel %d: %v", ch.ID, err)
+		httpError(w, "failed to load messages", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(order); err != nil {
+		log.Printf("encode reading order: %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultActivityDays = 7
+	maxActivityDays     = 30
+	activityListLimit   = 20
+	activityTopChannels = 5
+	activityCacheTTL    = time.Minute
+	activityCacheSize   = 1000
+)
+
+type activityKey struct {
+	serverID int64
+	days     int
+}
+
+type activityJoin struct {
+	UserID      int64     `json:"userId"`
+	Handle      string    `json:"handle"`
+	DisplayName string    `json:"displayName"`
+	JoinedAt    time.Time `json:"joinedAt"`
+}
+
+type activityChannel struct {
+	ChannelID int64  `json:"channelId"`
+	Name      string `json:"name"`
+	Messages  int    `json:"messages"`
+	Authors   int    `json:"authors"`
+}
+
+// serverActivity summarises what happened in a server since Since, for a
+// "what's new" panel.
+type serverActivity struct {
+	ServerID    int64             `json:"serverId"`
+	Since       time.Time         `json:"since"`
+	GeneratedAt time.Time         `json:"generatedAt"`
+	JoinCount   int               `json:"joinCount"`
+	Joins       []activityJoin    `json:"joins"`
+	NewChannels []channelPayload  `json:"newChannels"`
+	TopChannels []activityChannel `json:"topChannels"`
+}
+
+// serverActivity is cached per server and window for activityCacheTTL; the
+// panel is a summary, so a minute-old answer is fine and keeps the
+// aggregation queries off the hot path.
+func (s *serverState) serverActivity(ctx context.Context, serverID int64, days int) (serverActivity, error) {
+	key := activityKey{serverID: serverID, days: days}
+	if cached, ok := s.activityCache.get(key); ok {
+		return cached, nil
+	}
+
+	now := time.Now().UTC()
+	activity := serverActivity{
+		ServerID:    serverID,
+		Since:       now.Add(-time.Duration(days) * 24 * time.Hour),
+		GeneratedAt: now,
+		Joins:       []activityJoin{},
+		NewChannels: []channelPayload{},
+		TopChannels: []activityChannel{},
+	}
+
+	if err := s.readDB.QueryRowContext(ctx, `SELECT COUNT(*) FROM server_members WHERE server_id = ? AND joined_at >= ?`,
+		serverID, activity.Since).Scan(&activity.JoinCount); err != nil {
+		return serverActivity{}, err
+	}
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT u.id, u.handle, u.display_name, sm.joined_at
+        FROM server_members sm
+        JOIN users u ON u.id = sm.user_id
+        WHERE sm.server_id = ? AND sm.joined_at >= ?
+        ORDER BY sm.joined_at DESC
+        LIMIT ?
+    `, serverID, activity.Since, activityListLimit)
+	if err != nil {
+		return serverActivity{}, err
+	}
+	for rows.Next() {
+		var join activityJoin
+		if err := rows.Scan(&join.UserID, &join.Handle, &join.DisplayName, &join.JoinedAt); err != nil {
+			rows.Close()
+			return serverActivity{}, err
+		}
+		activity.Joins = append(activity.Joins, join)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return serverActivity{}, err
+	}
+
+	rows, err = s.readDB.QueryContext(ctx, `
+        SELECT `+channelColumns+`
+        FROM channels
+        WHERE server_id = ? AND created_at >= ?
+        ORDER BY created_at DESC
+        LIMIT ?
+    `, serverID, activity.Since, activityListLimit)
+	if err != nil {
+		return serverActivity{}, err
+	}
+	for rows.Next() {
+		ch, err := scanChannel(rows)
+		if err != nil {
+			rows.Close()
+			return serverActivity{}, err
+		}
+		activity.NewChannels = append(activity.NewChannels, toChannelPayload(ch))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return serverActivity{}, err
+	}
+
+	// Self-destructing messages are left out so the counts do not drop as
+	// they expire.
+	rows, err = s.readDB.QueryContext(ctx, `
+        SELECT c.id, c.name, COUNT(*), COUNT(DISTINCT m.author_id)
+        FROM channel_messages m
+        JOIN channels c ON c.id = m.channel_id
+        WHERE c.server_id = ? AND m.created_at >= ? AND m.expires_at IS NULL
+        GROUP BY c.id
+        ORDER BY COUNT(*) DESC, c.id
+        LIMIT ?
+    `, serverID, activity.Since, activityTopChannels)
+	if err != nil {
+		return serverActivity{}, err
+	}
+	for rows.Next() {
+		var ch activityChannel
+		if err := rows.Scan(&ch.ChannelID, &ch.Name, &ch.Messages, &ch.Authors); err != nil {
+			rows.Close()
+			return serverActivity{}, err
+		}
+		activity.TopChannels = append(activity.TopChannels, ch)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return serverActivity{}, err
+	}
+
+	s.activityCache.set(key, activity)
+	return activity, nil
+}
+
+func (s *serverState) handleServerActivity(w http.ResponseWriter, r *http.Request, serverID int64) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	days := defaultActivityDays
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxActivityDays {
+			httpError(w, "days must be between 1 and 30", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	activity, err := s.serverActivity(r.Context(), serverID, days)
+	if err != nil {
+		log.Printf("load server activity: %v", err)
+		httpError(w, "failed to load activity", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, max-age=60")
+	if err := json.NewEncoder(w).Encode(activity); err != nil {
+		log.Printf("encode server activity: %v", err)
+	}
+}
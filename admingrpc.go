@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"echosphere/adminpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// wsCloseKicked ends connections an operator kicked through the admin API
+// without signing the user out.
+const wsCloseKicked = 4015
+
+// adminGRPC serves the admin API in adminpb/admin.proto to internal tooling.
+// It listens on ADMIN_GRPC_ADDR, apart from the HTTP server, and only over
+// mutual TLS: it presents ADMIN_GRPC_CERT_FILE and ADMIN_GRPC_KEY_FILE and
+// accepts clients whose certificates chain to ADMIN_GRPC_CLIENT_CA_FILE.
+// Holding such a certificate is operator access to every tenant; the
+// certificate's common name is the actor in logs and the audit log.
+type adminGRPC struct {
+	adminpb.UnimplementedAdminServer
+	s         *serverState
+	server    *grpc.Server
+	listener  net.Listener
+	startedAt time.Time
+}
+
+// adminGRPCFromEnv returns nil when ADMIN_GRPC_ADDR is unset. A listener
+// that is asked for but cannot be secured is an error rather than being
+// left out quietly.
+func adminGRPCFromEnv(s *serverState) (*adminGRPC, error) {
+	addr := strings.TrimSpace(os.Getenv("ADMIN_GRPC_ADDR"))
+	if addr == "" {
+		return nil, nil
+	}
+	certFile := os.Getenv("ADMIN_GRPC_CERT_FILE")
+	keyFile := os.Getenv("ADMIN_GRPC_KEY_FILE")
+	caFile := os.Getenv("ADMIN_GRPC_CLIENT_CA_FILE")
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, errors.New("ADMIN_GRPC_ADDR needs ADMIN_GRPC_CERT_FILE, ADMIN_GRPC_KEY_FILE and ADMIN_GRPC_CLIENT_CA_FILE")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load admin grpc certificate: %w", err)
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read admin grpc client CA: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen for admin grpc: %w", err)
+	}
+	a := &adminGRPC{s: s, listener: listener, startedAt: time.Now().UTC()}
+	a.server = grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(&tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientCAs,
+			MinVersion:   tls.VersionTLS12,
+		})),
+		grpc.UnaryInterceptor(a.intercept),
+	)
+	adminpb.RegisterAdminServer(a.server, a)
+	// So tools such as grpcurl can call it without a copy of the .proto.
+	reflection.Register(a.server)
+	return a, nil
+}
+
+func (a *adminGRPC) run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		a.server.GracefulStop()
+	}()
+	log.Printf("admin gRPC API listening on %s", a.listener.Addr())
+	if err := a.server.Serve(a.listener); err != nil {
+		log.Printf("admin grpc: %v", err)
+	}
+}
+
+type adminCallerKey struct{}
+
+// intercept logs every call with the name on the client certificate, which
+// it passes on for adminActor.
+func (a *adminGRPC) intercept(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	caller := "unknown"
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.VerifiedChains) > 0 {
+			caller = tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+		}
+	}
+	started := time.Now()
+	resp, err := handler(context.WithValue(ctx, adminCallerKey{}, caller), req)
+	log.Printf("admin grpc %s by %s: %s in %s", info.FullMethod, caller, status.Code(err), time.Since(started).Round(time.Millisecond))
+	return resp, err
+}
+
+// adminActor is how a call shows up in the audit log.
+func adminActor(ctx context.Context) string {
+	caller, _ := ctx.Value(adminCallerKey{}).(string)
+	return "grpc:" + caller
+}
+
+func (a *adminGRPC) userByID(ctx context.Context, id int64) (user, error) {
+	u, exists, err := a.s.getUserByID(ctx, id)
+	if err != nil {
+		log.Printf("admin grpc load user %d: %v", id, err)
+		return user{}, status.Error(codes.Internal, "failed to load user")
+	}
+	if !exists || u.Email == systemUserEmail {
+		return user{}, status.Error(codes.NotFound, "user not found")
+	}
+	return u, nil
+}
+
+func (a *adminGRPC) LookupUser(ctx context.Context, req *adminpb.LookupUserRequest) (*adminpb.User, error) {
+	var u user
+	switch key := req.Key.(type) {
+	case *adminpb.LookupUserRequest_Id:
+		var err error
+		if u, err = a.userByID(ctx, key.Id); err != nil {
+			return nil, err
+		}
+	case *adminpb.LookupUserRequest_Login:
+		login := strings.ToLower(strings.TrimSpace(key.Login))
+		found, exists, err := a.s.getUserByLogin(ctx, req.TenantId, login)
+		if err != nil {
+			log.Printf("admin grpc lookup %s: %v", login, err)
+			return nil, status.Error(codes.Internal, "failed to look up user")
+		}
+		if !exists || found.Email == systemUserEmail {
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
+		u = found
+	default:
+		return nil, status.Error(codes.InvalidArgument, "id or login is required")
+	}
+	return &adminpb.User{
+		Id:            u.ID,
+		TenantId:      u.TenantID,
+		Email:         u.Email,
+		Handle:        u.Handle,
+		DisplayName:   u.DisplayName,
+		Status:        u.Status,
+		InstanceAdmin: a.s.isInstanceAdmin(ctx, u.Email),
+		CreatedAt:     timestamppb.New(u.CreatedAt),
+		Connections:   int32(a.s.ws.connections(u.Email)),
+	}, nil
+}
+
+func (a *adminGRPC) KickUser(ctx context.Context, req *adminpb.KickUserRequest) (*adminpb.KickUserResponse, error) {
+	u, err := a.userByID(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	resp := &adminpb.KickUserResponse{ConnectionsClosed: int32(a.s.ws.connections(u.Email))}
+	if req.SignOut {
+		res, err := a.s.db.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = ?`, u.ID)
+		if err != nil {
+			log.Printf("admin grpc sign out user %d: %v", u.ID, err)
+			return nil, status.Error(codes.Internal, "failed to sign user out")
+		}
+		n, _ := res.RowsAffected()
+		resp.SessionsRevoked = int32(n)
+		a.s.ws.disconnectUser(u.Email, wsCloseSignedOut, "signed out by an operator")
+	} else {
+		a.s.ws.disconnectUser(u.Email, wsCloseKicked, "kicked by an operator")
+	}
+
+	action := "instance.user_kicked"
+	if req.SignOut {
+		action = "instance.user_signed_out"
+	}
+	a.s.recordAudit(ctx, 0, adminActor(ctx), action, "user", strconv.FormatInt(u.ID, 10), strings.TrimSpace(req.Reason))
+	return resp, nil
+}
+
+func (a *adminGRPC) GetStats(ctx context.Context, _ *adminpb.GetStatsRequest) (*adminpb.Stats, error) {
+	stats := &adminpb.Stats{StartedAt: timestamppb.New(a.startedAt)}
+	err := a.s.readDB.QueryRowContext(ctx, `
+        SELECT (SELECT COUNT(*) FROM users WHERE email != ?),
+               (SELECT COUNT(*) FROM tenants) + 1,
+               (SELECT COUNT(*) FROM servers),
+               (SELECT COUNT(*) FROM channels),
+               (SELECT COUNT(*) FROM channel_messages)
+    `, systemUserEmail).Scan(&stats.Users, &stats.Tenants, &stats.Servers, &stats.Channels, &stats.Messages)
+	if err != nil {
+		log.Printf("admin grpc stats: %v", err)
+		return nil, status.Error(codes.Internal, "failed to load stats")
+	}
+
+	a.s.ws.mu.RLock()
+	stats.Connections = int32(a.s.ws.clients)
+	stats.ConnectedUsers = int32(len(a.s.ws.userClients))
+	a.s.ws.mu.RUnlock()
+	a.s.voice.mu.RLock()
+	for _, room := range a.s.voice.rooms {
+		stats.VoiceParticipants += int32(len(room.participants))
+	}
+	a.s.voice.mu.RUnlock()
+	return stats, nil
+}
+
+func (a *adminGRPC) Broadcast(ctx context.Context, req *adminpb.BroadcastRequest) (*adminpb.BroadcastResponse, error) {
+	// The same rules as POST /api/admin/announcements.
+	body := struct {
+		Title          string `json:"title" validate:"trim,required,max=100"`
+		Body           string `json:"body" validate:"trim,max=2000"`
+		Level          string `json:"level" validate:"trim,lower,oneof=info|warning|critical"`
+		ExpiresInHours int    `json:"expires_in_hours" validate:"min=0"`
+	}{req.Title, req.Body, req.Level, int(req.ExpiresInHours)}
+	if errs := validateStruct(&body); len(errs) > 0 {
+		return nil, status.Error(codes.InvalidArgument, errs[0].Field+" "+errs[0].Message)
+	}
+	if _, exists, err := a.s.tenantByID(ctx, req.TenantId); err != nil {
+		log.Printf("admin grpc load tenant %d: %v", req.TenantId, err)
+		return nil, status.Error(codes.Internal, "failed to load tenant")
+	} else if !exists {
+		return nil, status.Error(codes.NotFound, "tenant not found")
+	}
+
+	ann, err := a.s.createAnnouncement(ctx, req.TenantId, adminActor(ctx), nil, body.Title, body.Body, body.Level, body.ExpiresInHours)
+	if err != nil {
+		log.Printf("admin grpc broadcast: %v", err)
+		return nil, status.Error(codes.Internal, "failed to create announcement")
+	}
+	return &adminpb.BroadcastResponse{
+		AnnouncementId: ann.ID,
+		Delivered:      int32(ann.Reach.Delivered),
+		Recipients:     int32(ann.Reach.Recipients),
+	}, nil
+}
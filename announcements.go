@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// announcementDTO is an instance-wide notice from an admin. Clients show
+// the ones in bootstrap as a banner until the user acknowledges them. The
+// sender is named by ID and handle; announcements sent through the admin
+// API have none.
+type announcementDTO struct {
+	ID              int64      `json:"id"`
+	Title           string     `json:"title"`
+	Body            string     `json:"body"`
+	Level           string     `json:"level"`
+	CreatedByID     int64      `json:"createdById,omitempty"`
+	CreatedByHandle string     `json:"createdByHandle,omitempty"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	ExpiresAt       *time.Time `json:"expiresAt,omitempty"`
+	// The rest is for admins only.
+	WithdrawnAt *time.Time         `json:"withdrawnAt,omitempty"`
+	Reach       *announcementReach `json:"reach,omitempty"`
+}
+
+// announcementReach is how far an announcement got: the users connected
+// when it went out, those who have acknowledged it, and the active accounts
+// of the tenant that could.
+type announcementReach struct {
+	Delivered  int `json:"delivered"`
+	Acked      int `json:"acked"`
+	Recipients int `json:"recipients"`
+}
+
+func scanAnnouncement(row interface{ Scan(...any) error }) (announcementDTO, error) {
+	var a announcementDTO
+	var expires sql.NullTime
+	var creatorID sql.NullInt64
+	var creatorHandle sql.NullString
+	if err := row.Scan(&a.ID, &a.Title, &a.Body, &a.Level, &creatorID, &creatorHandle, &a.CreatedAt, &expires); err != nil {
+		return announcementDTO{}, err
+	}
+	a.CreatedByID, a.CreatedByHandle = creatorID.Int64, creatorHandle.String
+	if expires.Valid {
+		a.ExpiresAt = &expires.Time
+	}
+	return a, nil
+}
+
+// pendingAnnouncements returns the live announcements of u's tenant that u
+// has not acknowledged yet, oldest first.
+func (s *serverState) pendingAnnouncements(ctx context.Context, u user) ([]announcementDTO, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT a.id, a.title, a.body, a.level, u.id, u.handle, a.created_at, a.expires_at
+        FROM announcements a LEFT JOIN users u ON u.id = a.created_by_id
+        WHERE a.tenant_id = ? AND a.withdrawn_at IS NULL AND (a.expires_at IS NULL OR a.expires_at > ?)
+          AND NOT EXISTS (SELECT 1 FROM announcement_acks k WHERE k.announcement_id = a.id AND k.user_id = ?)
+        ORDER BY a.id
+    `, u.TenantID, time.Now().UTC(), u.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var announcements []announcementDTO
+	for rows.Next() {
+		a, err := scanAnnouncement(rows)
+		if err != nil {
+			return nil, err
+		}
+		announcements = append(announcements, a)
+	}
+	return announcements, rows.Err()
+}
+
+// broadcastToTenant pushes outbound to every connection of tenantID and
+// returns how many distinct users that reached.
+func (s *serverState) broadcastToTenant(tenantID int64, outbound wsOutbound) int {
+	frame, err := outboundFrame(outbound)
+	if err != nil {
+		log.Printf("ws marshal outbound: %v", err)
+		return 0
+	}
+	users := make(map[int64]struct{})
+	for _, c := range s.ws.snapshot() {
+		if c.currentUser().TenantID != tenantID {
+			continue
+		}
+		c.enqueue(frame)
+		users[c.userID] = struct{}{}
+	}
+	return len(users)
+}
+
+// handleAdminAnnouncements serves /api/admin/announcements: GET lists the
+// tenant's announcements with their reach, POST sends a new one to every
+// connected user and DELETE /{id} withdraws one. Admins announce to their
+// own tenant.
+func (s *serverState) handleAdminAnnouncements(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.requireInstanceAdmin(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+
+	if path := strings.Trim(r.URL.Path, "/"); path != "" {
+		announcementID, err := strconv.ParseInt(path, 10, 64)
+		if err != nil {
+			httpError(w, "not found", http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "DELETE")
+			httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		res, err := s.db.ExecContext(ctx, `UPDATE announcements SET withdrawn_at = ? WHERE id = ? AND tenant_id = ? AND withdrawn_at IS NULL`, time.Now().UTC(), announcementID, currentUser.TenantID)
+		if err != nil {
+			log.Printf("withdraw announcement: %v", err)
+			httpError(w, "failed to withdraw announcement", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			httpError(w, "not found", http.StatusNotFound)
+			return
+		}
+		s.broadcastToTenant(currentUser.TenantID, wsOutbound{Type: "announcement:withdrawn", AnnouncementID: announcementID})
+		s.recordAudit(ctx, 0, currentUser.Email, "instance.announcement_withdrawn", "announcement", path, "")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		announcements, err := s.announcementReport(ctx, currentUser.TenantID)
+		if err != nil {
+			log.Printf("list announcements: %v", err)
+			httpError(w, "failed to load announcements", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(announcements); err != nil {
+			log.Printf("encode announcements: %v", err)
+		}
+	case http.MethodPost:
+		var body struct {
+			Title          string `json:"title" validate:"trim,required,max=100"`
+			Body           string `json:"body" validate:"trim,max=2000"`
+			Level          string `json:"level" validate:"trim,lower,oneof=info|warning|critical"`
+			ExpiresInHours int    `json:"expiresInHours" validate:"min=0"`
+		}
+		if !s.decodeJSON(w, r, &body) {
+			return
+		}
+		a, err := s.createAnnouncement(ctx, currentUser.TenantID, currentUser.Email, &currentUser, body.Title, body.Body, body.Level, body.ExpiresInHours)
+		if err != nil {
+			log.Printf("create announcement: %v", err)
+			httpError(w, "failed to create announcement", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(a); err != nil {
+			log.Printf("encode announcement: %v", err)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createAnnouncement stores an announcement, sends it to the tenant's
+// connected users and records it in the audit log under actor. creator is
+// the sending user, or nil when it comes from the admin API. The result
+// carries its reach so far.
+func (s *serverState) createAnnouncement(ctx context.Context, tenantID int64, actor string, creator *user, title, body, level string, expiresInHours int) (announcementDTO, error) {
+	a := announcementDTO{
+		Title:     title,
+		Body:      body,
+		Level:     level,
+		CreatedAt: time.Now().UTC(),
+	}
+	var creatorID sql.NullInt64
+	if creator != nil {
+		a.CreatedByID, a.CreatedByHandle = creator.ID, creator.Handle
+		creatorID = sql.NullInt64{Int64: creator.ID, Valid: true}
+	}
+	if a.Level == "" {
+		a.Level = "info"
+	}
+	var expires sql.NullTime
+	if expiresInHours > 0 {
+		t := a.CreatedAt.Add(time.Duration(expiresInHours) * time.Hour)
+		a.ExpiresAt = &t
+		expires = sql.NullTime{Time: t, Valid: true}
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO announcements (tenant_id, title, body, level, created_by_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		tenantID, a.Title, a.Body, a.Level, creatorID, a.CreatedAt, expires)
+	if err != nil {
+		return announcementDTO{}, err
+	}
+	if a.ID, err = res.LastInsertId(); err != nil {
+		return announcementDTO{}, err
+	}
+
+	// Connected users get it now; the rest find it in their next bootstrap.
+	sent := a
+	delivered := s.broadcastToTenant(tenantID, wsOutbound{Type: "announcement", Announcement: &sent})
+	if _, err := s.db.ExecContext(ctx, `UPDATE announcements SET delivered = ? WHERE id = ?`, delivered, a.ID); err != nil {
+		log.Printf("record announcement delivery: %v", err)
+	}
+	a.Reach = &announcementReach{Delivered: delivered}
+	if a.Reach.Recipients, err = s.announcementRecipients(ctx, tenantID); err != nil {
+		log.Printf("count announcement recipients: %v", err)
+	}
+	s.recordAudit(ctx, 0, actor, "instance.announcement_sent", "announcement", strconv.FormatInt(a.ID, 10), a.Title)
+	return a, nil
+}
+
+// announcementRecipients counts the accounts of tenantID an announcement
+// is meant for.
+func (s *serverState) announcementRecipients(ctx context.Context, tenantID int64) (int, error) {
+	var n int
+	err := s.readDB.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE tenant_id = ? AND status = ? AND email != ?`,
+		tenantID, userStatusActive, systemUserEmail).Scan(&n)
+	return n, err
+}
+
+// announcementReport lists every announcement of tenantID, newest first,
+// with its reach.
+func (s *serverState) announcementReport(ctx context.Context, tenantID int64) ([]announcementDTO, error) {
+	recipients, err := s.announcementRecipients(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT a.id, a.title, a.body, a.level, u.id, u.handle, a.created_at, a.expires_at, a.withdrawn_at, a.delivered,
+               (SELECT COUNT(*) FROM announcement_acks k WHERE k.announcement_id = a.id)
+        FROM announcements a LEFT JOIN users u ON u.id = a.created_by_id
+        WHERE a.tenant_id = ?
+        ORDER BY a.id DESC
+    `, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	announcements := []announcementDTO{}
+	for rows.Next() {
+		var a announcementDTO
+		var expires, withdrawn sql.NullTime
+		var creatorID sql.NullInt64
+		var creatorHandle sql.NullString
+		reach := announcementReach{Recipients: recipients}
+		if err := rows.Scan(&a.ID, &a.Title, &a.Body, &a.Level, &creatorID, &creatorHandle, &a.CreatedAt, &expires, &withdrawn, &reach.Delivered, &reach.Acked); err != nil {
+			return nil, err
+		}
+		a.CreatedByID, a.CreatedByHandle = creatorID.Int64, creatorHandle.String
+		if expires.Valid {
+			a.ExpiresAt = &expires.Time
+		}
+		if withdrawn.Valid {
+			a.WithdrawnAt = &withdrawn.Time
+		}
+		a.Reach = &reach
+		announcements = append(announcements, a)
+	}
+	return announcements, rows.Err()
+}
+
+// handleAnnouncementAck serves POST /api/announcements/{id}/ack, which
+// dismisses an announcement for the current user on all their devices.
+// Acknowledging twice is fine.
+func (s *serverState) handleAnnouncementAck(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	rest, found := strings.CutSuffix(strings.Trim(r.URL.Path, "/"), "/ack")
+	announcementID, err := strconv.ParseInt(rest, 10, 64)
+	if !found || err != nil {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	var exists int
+	err = s.readDB.QueryRowContext(ctx, `SELECT 1 FROM announcements WHERE id = ? AND tenant_id = ?`, announcementID, currentUser.TenantID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		_, err = s.db.ExecContext(ctx, `INSERT OR IGNORE INTO announcement_acks (announcement_id, user_id, acked_at) VALUES (?, ?, ?)`,
+			announcementID, currentUser.ID, time.Now().UTC())
+	}
+	if err != nil {
+		log.Printf("ack announcement: %v", err)
+		httpError(w, "failed to acknowledge announcement", http.StatusInternalServerError)
+		return
+	}
+	s.ws.sendToUser(currentUser.Email, wsOutbound{Type: "announcement:acked", AnnouncementID: announcementID})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	requestIDHeader    = "X-Request-ID"
+	maxRequestIDLength = 64
+)
+
+// apiError is the body of every error response from /api routes. Code uses
+// the same vocabulary as WebSocket error frames.
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Details   any    `json:"details,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusGone:                  "gone",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusUnprocessableEntity:   "validation_failed",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal",
+	http.StatusBadGateway:            "upstream_failed",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+func errorCodeForStatus(status int) string {
+	if code, ok := errorCodes[status]; ok {
+		return code
+	}
+	if status >= 500 {
+		return "internal"
+	}
+	return "invalid_request"
+}
+
+// httpError replies to an API request with an apiError whose code follows
+// from status. It takes the same arguments as http.Error.
+func httpError(w http.ResponseWriter, message string, status int) {
+	writeAPIError(w, status, apiError{Code: errorCodeForStatus(status), Message: message})
+}
+
+// writeAPIError sends body with status, filling in the request ID and
+// translating the message into the response's language. A 405 lists the
+// allowed methods in details.
+func writeAPIError(w http.ResponseWriter, status int, body apiError) {
+	h := w.Header()
+	body.RequestID = h.Get(requestIDHeader)
+	body.Message = translateError(h.Get(contentLanguageHeader), body.Message)
+	if body.Details == nil && status == http.StatusMethodNotAllowed {
+		if allow := h.Get("Allow"); allow != "" {
+			body.Details = map[string][]string{"allow": strings.Split(allow, ", ")}
+		}
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("encode error response: %v", err)
+	}
+}
+
+// errorFor is for middleware shared by pages and the API: /api requests get
+// an apiError, everything else plain text.
+func errorFor(w http.ResponseWriter, r *http.Request, message string, status int) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		httpError(w, message, status)
+		return
+	}
+	http.Error(w, message, status)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDMiddleware tags every response with X-Request-ID, keeping one set
+// by a fronting proxy when it looks sane, so error reports can be matched to
+// log lines.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = generateSessionID()[:16]
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	grantPassword     = "password"
+	grantRefreshToken = "refresh_token"
+)
+
+// bearerToken returns the token in an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// sessionFromAccessToken returns the API session an access token was issued
+// for. The session has to still exist, so revoking it or changing the
+// password locks out its access tokens at once, not only when they expire.
+func (s *serverState) sessionFromAccessToken(ctx context.Context, token string) (sessionInfo, bool) {
+	claims, err := s.jwt.verify(token)
+	if err != nil {
+		return sessionInfo{}, false
+	}
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return sessionInfo{}, false
+	}
+	sess := sessionInfo{API: true}
+	var scopes string
+	row := s.stmts.QueryRowContext(ctx, `SELECT token_hash, user_id, device_id, remember, created_at, expires_at, scopes FROM sessions WHERE user_id = ? AND device_id = ? AND kind = 'api'`, userID, claims.SessionID)
+	if err := row.Scan(&sess.TokenHash, &sess.UserID, &sess.DeviceID, &sess.Remember, &sess.CreatedAt, &sess.ExpiresAt, &scopes); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("load api session: %v", err)
+		}
+		return sessionInfo{}, false
+	}
+	if time.Now().After(sess.ExpiresAt) {
+		return sessionInfo{}, false
+	}
+	sess.Scopes = parseScopes(scopes)
+	return sess, true
+}
+
+type tokenResponse struct {
+	AccessToken      string    `json:"accessToken"`
+	TokenType        string    `json:"tokenType"`
+	ExpiresIn        int       `json:"expiresIn"`
+	ExpiresAt        time.Time `json:"expiresAt"`
+	RefreshToken     string    `json:"refreshToken,omitempty"`
+	RefreshExpiresAt time.Time `json:"refreshExpiresAt"`
+	DeviceID         string    `json:"deviceId"`
+	// Scopes is left out for a token with full access.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// handleAuthToken serves POST /api/auth/token. grantType "password" signs in
+// with a login and password, starting an API session that shows up among
+// the user's devices, and returns its refresh token; "refresh_token"
+// exchanges that refresh token for a new access token and extends the
+// session. Either way the response carries an access token for the
+// Authorization header. A password grant may ask for scopes to limit what
+// the session can do; without them it has full access.
+func (s *serverState) handleAuthToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	defer r.Body.Close()
+	var body struct {
+		GrantType    string   `json:"grantType"`
+		Login        string   `json:"login"`
+		Password     string   `json:"password"`
+		CaptchaToken string   `json:"captchaToken"`
+		DeviceName   string   `json:"deviceName" validate:"trim,max=64"`
+		RefreshToken string   `json:"refreshToken"`
+		Scopes       []string `json:"scopes"`
+	}
+	if !s.decodeJSON(w, r, &body) {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	switch body.GrantType {
+	case grantPassword:
+		scopes, errs := validateScopes(body.Scopes)
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		s.passwordGrant(w, r, body.Login, body.Password, body.CaptchaToken, body.DeviceName, scopes)
+	case grantRefreshToken:
+		s.refreshGrant(w, r, body.RefreshToken)
+	default:
+		httpError(w, "grantType must be password or refresh_token", http.StatusBadRequest)
+	}
+}
+
+// passwordGrant signs in like the login form does, with the same lockouts
+// and CAPTCHA, and starts an API session limited to scopes, if any.
+func (s *serverState) passwordGrant(w http.ResponseWriter, r *http.Request, login, password, captchaToken, deviceName string, scopes []string) {
+	ctx := r.Context()
+	ip := clientIP(r)
+	login = strings.TrimSpace(strings.ToLower(login))
+	u, exists, err := s.getUserByLogin(ctx, requestTenantID(r), login)
+	if err != nil {
+		log.Printf("lookup user %s: %v", login, err)
+		httpError(w, "failed to sign in", http.StatusInternalServerError)
+		return
+	}
+
+	lockedUntil, err := s.loginLockedUntil(ctx, ip, u.ID)
+	if err != nil {
+		log.Printf("check login lockout: %v", err)
+		httpError(w, "failed to sign in", http.StatusInternalServerError)
+		return
+	}
+	if wait := time.Until(lockedUntil); wait > 0 {
+		s.recordLoginAttempt(ctx, r, login, u.ID, loginLocked)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		httpError(w, "too many failed sign-in attempts", http.StatusTooManyRequests)
+		return
+	}
+	if s.loginNeedsCaptcha(ctx, ip, u.ID) {
+		if err := s.captcha.verify(ctx, captchaToken, ip); err != nil {
+			if !errors.Is(err, errCaptchaMissing) && !errors.Is(err, errCaptchaRejected) {
+				log.Printf("verify token captcha: %v", err)
+			}
+			s.recordLoginAttempt(ctx, r, login, u.ID, loginCaptcha)
+			writeAPIError(w, http.StatusBadRequest, apiError{
+				Code:    "captcha_required",
+				Message: "captcha required",
+				Details: map[string]string{"provider": s.captcha.name(), "siteKey": s.captcha.widget().SiteKey},
+			})
+			return
+		}
+	}
+
+	var matched, stale bool
+	if exists {
+		matched, stale = s.passwords.verify(u.PasswordHash, password)
+	}
+	if !matched {
+		s.recordLoginFailure(ctx, r, login, u)
+		httpError(w, "invalid login or password", http.StatusUnauthorized)
+		return
+	}
+	s.clearLoginFailures(ctx, ip, u.ID)
+	if stale {
+		s.upgradePasswordHash(ctx, u, password)
+	}
+	if u.Status == userStatusPending {
+		s.recordLoginAttempt(ctx, r, login, u.ID, loginPending)
+		httpError(w, "account is awaiting approval", http.StatusForbidden)
+		return
+	}
+	if u.Status == userStatusDeactivated {
+		s.recordLoginAttempt(ctx, r, login, u.ID, loginDeactivated)
+		httpError(w, "account is deactivated", http.StatusForbidden)
+		return
+	}
+	if err := s.ensureMembership(ctx, u.Email, u.TenantID); err != nil {
+		log.Printf("ensure membership: %v", err)
+	}
+
+	refreshToken := generateSessionID()
+	now := time.Now().UTC()
+	sess := sessionInfo{
+		TokenHash: hashSessionToken(refreshToken),
+		UserID:    u.ID,
+		DeviceID:  generateDeviceID(),
+		Remember:  true,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.jwt.refreshTTL),
+		API:       true,
+		Scopes:    parseScopes(strings.Join(scopes, " ")),
+	}
+	if _, err := s.db.ExecContext(ctx, `
+        INSERT INTO sessions (token_hash, user_id, remember, created_at, expires_at, client_ip, device_id, device_name, user_agent, last_seen_at, unsigned_cookie, kind, scopes)
+        VALUES (?, ?, 1, ?, ?, ?, ?, ?, ?, ?, 0, 'api', ?)
+    `, sess.TokenHash, sess.UserID, sess.CreatedAt, sess.ExpiresAt, ip, sess.DeviceID, deviceName, truncateUserAgent(r.UserAgent()), now, strings.Join(scopes, " ")); err != nil {
+		log.Printf("create api session for user %d: %v", u.ID, err)
+		httpError(w, "failed to sign in", http.StatusInternalServerError)
+		return
+	}
+	s.recordLoginAttempt(ctx, r, login, u.ID, loginSuccess)
+	s.writeAccessToken(w, sess, refreshToken)
+}
+
+// refreshGrant issues a new access token for the API session refreshToken
+// belongs to and pushes the session's expiry forward. The session keeps
+// the scopes it was granted.
+func (s *serverState) refreshGrant(w http.ResponseWriter, r *http.Request, refreshToken string) {
+	ctx := r.Context()
+	var sess sessionInfo
+	var status, scopes string
+	err := s.readDB.QueryRowContext(ctx, `
+        SELECT s.token_hash, s.user_id, s.device_id, s.created_at, s.expires_at, s.scopes, u.status
+        FROM sessions s JOIN users u ON u.id = s.user_id
+        WHERE s.token_hash = ? AND s.kind = 'api'
+    `, hashSessionToken(refreshToken)).Scan(&sess.TokenHash, &sess.UserID, &sess.DeviceID, &sess.CreatedAt, &sess.ExpiresAt, &scopes, &status)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (time.Now().After(sess.ExpiresAt) || status != userStatusActive)) {
+		httpError(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("load api session: %v", err)
+		httpError(w, "failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	sess.ExpiresAt = now.Add(s.jwt.refreshTTL)
+	sess.API = true
+	sess.Scopes = parseScopes(scopes)
+	if _, err := s.db.ExecContext(ctx, `UPDATE sessions SET expires_at = ?, client_ip = ?, last_seen_at = ? WHERE token_hash = ?`, sess.ExpiresAt, clientIP(r), now, sess.TokenHash); err != nil {
+		log.Printf("renew api session: %v", err)
+		httpError(w, "failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+	s.writeAccessToken(w, sess, "")
+}
+
+func (s *serverState) writeAccessToken(w http.ResponseWriter, sess sessionInfo, refreshToken string) {
+	token, expires, err := s.jwt.issue(sess.UserID, sess.DeviceID)
+	if err != nil {
+		log.Printf("sign access token: %v", err)
+		httpError(w, "failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tokenResponse{
+		AccessToken:      token,
+		TokenType:        "Bearer",
+		ExpiresIn:        int(time.Until(expires).Seconds()),
+		ExpiresAt:        expires,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: sess.ExpiresAt,
+		DeviceID:         sess.DeviceID,
+		Scopes:           sess.Scopes.list(),
+	}); err != nil {
+		log.Printf("encode token response: %v", err)
+	}
+}
+
+// handleAuthRevoke serves POST /api/auth/revoke: it ends the API session a
+// refresh token belongs to and closes its WebSockets. Unknown tokens are not
+// an error, so a client can always revoke a token it is discarding.
+func (s *serverState) handleAuthRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	var body struct {
+		RefreshToken string `json:"refreshToken" validate:"required"`
+	}
+	if !s.decodeJSON(w, r, &body) {
+		return
+	}
+	tokenHash := hashSessionToken(body.RefreshToken)
+	res, err := s.db.ExecContext(r.Context(), `DELETE FROM sessions WHERE token_hash = ? AND kind = 'api'`, tokenHash)
+	if err != nil {
+		log.Printf("revoke api session: %v", err)
+		httpError(w, "failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		s.ws.disconnectSession(tokenHash, wsCloseAuthExpired, "signed out")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
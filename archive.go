@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With MESSAGE_ARCHIVE on, every version of every message is appended to
+// message_revisions: the original on insert, the new content on each change,
+// and the final content when the row is deleted. Like the sync
+// log it is fed by triggers, so expiry, cascading deletes and imports are
+// covered without each writer taking part. Revisions have no foreign keys,
+// so they outlive the message, channel and author, and they can never be
+// updated or deleted.
+var messageArchiveTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS archive_message_insert AFTER INSERT ON channel_messages BEGIN
+        INSERT INTO message_revisions (message_id, channel_id, author_id, author_email, revision, kind, content)
+        VALUES (NEW.id, NEW.channel_id, NEW.author_id, COALESCE((SELECT email FROM users WHERE id = NEW.author_id), ''),
+                1, 'create', NEW.content);
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS archive_message_edit AFTER UPDATE OF content ON channel_messages
+    WHEN OLD.content IS NOT NEW.content BEGIN
+        INSERT INTO message_revisions (message_id, channel_id, author_id, author_email, revision, kind, content)
+        VALUES (NEW.id, NEW.channel_id, NEW.author_id, COALESCE((SELECT email FROM users WHERE id = NEW.author_id), ''),
+                (SELECT COALESCE(MAX(revision), 0) + 1 FROM message_revisions WHERE message_id = NEW.id), 'edit', NEW.content);
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS archive_message_delete AFTER DELETE ON channel_messages BEGIN
+        INSERT INTO message_revisions (message_id, channel_id, author_id, author_email, revision, kind, content)
+        VALUES (OLD.id, OLD.channel_id, OLD.author_id, COALESCE((SELECT email FROM users WHERE id = OLD.author_id), ''),
+                (SELECT COALESCE(MAX(revision), 0) + 1 FROM message_revisions WHERE message_id = OLD.id), 'delete', OLD.content);
+    END`,
+}
+
+var messageArchiveTriggerNames = []string{"archive_message_insert", "archive_message_edit", "archive_message_delete"}
+
+// configureMessageArchive installs the archive triggers, or drops them when
+// the archive is off. Revisions recorded earlier are kept either way.
+func configureMessageArchive(ctx context.Context, db *sql.DB, enabled bool) error {
+	if !enabled {
+		for _, name := range messageArchiveTriggerNames {
+			if _, err := db.ExecContext(ctx, `DROP TRIGGER IF EXISTS `+name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, trigger := range messageArchiveTriggers {
+		if _, err := db.ExecContext(ctx, trigger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type messageRevisionDTO struct {
+	Revision    int       `json:"revision"`
+	Kind        string    `json:"kind"`
+	Content     string    `json:"content"`
+	AuthorID    int64     `json:"authorId"`
+	AuthorEmail string    `json:"authorEmail"`
+	RecordedAt  time.Time `json:"recordedAt"`
+}
+
+type messageHistoryDTO struct {
+	MessageID int64 `json:"messageId"`
+	ChannelID int64 `json:"channelId"`
+	// Deleted is true once the message is gone from its channel.
+	Deleted   bool                 `json:"deleted"`
+	Revisions []messageRevisionDTO `json:"revisions"`
+}
+
+func (s *serverState) messageHistory(ctx context.Context, messageID int64) (messageHistoryDTO, bool, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT channel_id, revision, kind, content, author_id, author_email, recorded_at
+        FROM message_revisions
+        WHERE message_id = ?
+        ORDER BY revision
+    `, messageID)
+	if err != nil {
+		return messageHistoryDTO{}, false, err
+	}
+	defer rows.Close()
+
+	history := messageHistoryDTO{MessageID: messageID, Revisions: []messageRevisionDTO{}}
+	for rows.Next() {
+		var rev messageRevisionDTO
+		if err := rows.Scan(&history.ChannelID, &rev.Revision, &rev.Kind, &rev.Content, &rev.AuthorID, &rev.AuthorEmail, &rev.RecordedAt); err != nil {
+			return messageHistoryDTO{}, false, err
+		}
+		history.Deleted = rev.Kind == "delete"
+		history.Revisions = append(history.Revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return messageHistoryDTO{}, false, err
+	}
+	return history, len(history.Revisions) > 0, nil
+}
+
+// handleAdminMessageRevisions serves GET /api/admin/messages/{id}/revisions
+// for operators. Each lookup is written to the audit log, since the
+// archive holds messages their authors deleted.
+func (s *serverState) handleAdminMessageRevisions(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.requireOperator(w, r)
+	if !ok {
+		return
+	}
+
+	rawID, rest, _ := strings.Cut(strings.Trim(r.URL.Path, "/"), "/")
+	messageID, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil || rest != "revisions" {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	history, found, err := s.messageHistory(r.Context(), messageID)
+	if err != nil {
+		log.Printf("load revisions of message %d: %v", messageID, err)
+		httpError(w, "failed to load message history", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		httpError(w, "message not found", http.StatusNotFound)
+		return
+	}
+	s.recordAudit(r.Context(), 0, admin.Email, "message.revisions_viewed", "message", rawID, "")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(history); err != nil {
+		log.Printf("encode message history: %v", err)
+	}
+}
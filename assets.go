@@ -0,0 +1,27 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"log"
+	"os"
+)
+
+// The templates and static files are compiled into the binary so a release
+// is a single file. Set WEB_DIR (e.g. WEB_DIR=web) to serve them from disk
+// instead, which picks up edits without rebuilding.
+//
+//go:embed web/templates web/static
+var embeddedWeb embed.FS
+
+func webAssets() fs.FS {
+	if dir := os.Getenv("WEB_DIR"); dir != "" {
+		log.Printf("serving web assets from %s", dir)
+		return os.DirFS(dir)
+	}
+	sub, err := fs.Sub(embeddedWeb, "web")
+	if err != nil {
+		log.Fatalf("embedded web assets: %v", err)
+	}
+	return sub
+}
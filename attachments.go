@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxMessageLength              = 2000
+	defaultMaxTextAttachmentBytes = 1 << 20
+	textAttachmentName            = "message.txt"
+	textAttachmentType            = "text/plain; charset=utf-8"
+)
+
+type attachmentDTO struct {
+	ID          int64  `json:"id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url,omitempty"`
+	// Width and Height are set for images, so clients can reserve space
+	// before the image loads.
+	Width      int                      `json:"width,omitempty"`
+	Height     int                      `json:"height,omitempty"`
+	Thumbnails []attachmentThumbnailDTO `json:"thumbnails,omitempty"`
+	// Status is "pending" while the upload scanner has yet to look at the
+	// attachment and "rejected" once it is quarantined; it is left out for
+	// attachments that can be downloaded.
+	Status string `json:"status,omitempty"`
+	// Voice marks a recorded voice message; DurationMS is its length as
+	// reported by the client that recorded it.
+	Voice      bool `json:"voice,omitempty"`
+	DurationMS int  `json:"durationMs,omitempty"`
+}
+
+type attachmentThumbnailDTO struct {
+	Size   int    `json:"size"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url,omitempty"`
+}
+
+type newAttachment struct {
+	filename    string
+	contentType string
+	data        []byte
+	// location is where the content is kept, from placeBlob.
+	location string
+	// image is set by prepareAttachment for images.
+	image *processedImage
+	// scanStatus is the status new contents are stored with.
+	scanStatus string
+	// voice and durationMS describe a recorded voice message. transcribe
+	// queues it for the transcriber.
+	voice      bool
+	durationMS sql.NullInt64
+	transcribe bool
+}
+
+// Attachment contents live in attachment_blobs, keyed by their SHA-256, and
+// message_attachments rows point at them. Posting the same file again adds a
+// row but no second copy. refs counts the rows using a blob; the triggers
+// keep it current and delete a blob once nothing refers to it, including
+// when messages are deleted or expire. Contents kept outside the database
+// are queued for runBlobSweeper.
+var attachmentBlobTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS attachment_blob_ref AFTER INSERT ON message_attachments BEGIN
+        UPDATE attachment_blobs SET refs = refs + 1 WHERE hash = NEW.blob_hash;
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS attachment_blob_unref AFTER DELETE ON message_attachments BEGIN
+        UPDATE attachment_blobs SET refs = refs - 1 WHERE hash = OLD.blob_hash;
+        DELETE FROM attachment_blobs WHERE hash = OLD.blob_hash AND refs <= 0;
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS attachment_blob_release AFTER DELETE ON attachment_blobs
+    WHEN OLD.location != 'database' BEGIN
+        INSERT INTO blob_deletions (hash, location) VALUES (OLD.hash, OLD.location)
+        ON CONFLICT (hash, location) DO UPDATE SET queued_at = excluded.queued_at;
+    END`,
+}
+
+func attachmentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// storeAttachment adds an attachment to a message, reusing the stored blob
+// when the same content is already there. att.location comes from
+// placeBlob; the row only holds the data itself when it is
+// databaseLocation. Thumbnails are kept in the database wherever the
+// content is.
+func storeAttachment(ctx context.Context, tx *sql.Tx, messageID int64, att newAttachment, createdAt time.Time) error {
+	hash := attachmentHash(att.data)
+	rowData := att.data
+	if att.location != databaseLocation {
+		rowData = []byte{}
+	}
+	var width, height sql.NullInt64
+	if att.image != nil {
+		width = sql.NullInt64{Int64: int64(att.image.width), Valid: true}
+		height = sql.NullInt64{Int64: int64(att.image.height), Valid: true}
+	}
+	res, err := tx.ExecContext(ctx, `
+        INSERT INTO attachment_blobs (hash, size, data, location, width, height, scan_status, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (hash) DO NOTHING
+    `, hash, len(att.data), rowData, att.location, width, height, cmp.Or(att.scanStatus, scanClean), createdAt)
+	if err != nil {
+		return err
+	}
+	if added, _ := res.RowsAffected(); added > 0 && att.image != nil {
+		for _, thumb := range att.image.thumbnails {
+			if _, err := tx.ExecContext(ctx, `
+                INSERT INTO attachment_thumbnails (blob_hash, size, width, height, content_type, data) VALUES (?, ?, ?, ?, ?, ?)
+            `, hash, thumb.size, thumb.width, thumb.height, thumb.contentType, thumb.data); err != nil {
+				return err
+			}
+		}
+	}
+	res, err = tx.ExecContext(ctx, `
+        INSERT INTO message_attachments (message_id, filename, content_type, size, blob_hash, voice, duration_ms, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+    `, messageID, att.filename, att.contentType, len(att.data), hash, att.voice, att.durationMS, createdAt)
+	if err != nil || !att.transcribe {
+		return err
+	}
+	attachmentID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO message_transcripts (message_id, attachment_id, created_at, updated_at) VALUES (?, ?, ?, ?)
+    `, messageID, attachmentID, createdAt, createdAt)
+	return err
+}
+
+// prepareAttachment runs images through the image pipeline, which removes
+// their metadata, measures them and makes thumbnails. Anything else is left
+// as it is. It has to run before placeBlob and the quota check, since
+// stripping changes the content.
+func (s *serverState) prepareAttachment(ctx context.Context, att *newAttachment) error {
+	att.scanStatus = s.newScanStatus()
+	if !isProcessableImage(http.DetectContentType(att.data)) {
+		return nil
+	}
+	img, err := s.images.process(ctx, att.data, attachmentThumbnailSizes)
+	if err != nil {
+		return err
+	}
+	att.data, att.contentType, att.image = img.data, img.contentType, img
+	return nil
+}
+
+// messageTooLong reports whether content has to be rejected. With
+// LONG_MESSAGE_ATTACHMENTS on, content over the length limit is accepted up to
+// MAX_TEXT_ATTACHMENT_BYTES and stored as a text file instead, the way people
+// paste long logs.
+func (s *serverState) messageTooLong(content string) bool {
+	if utf8.RuneCountInString(content) <= maxMessageLength {
+		return false
+	}
+	return !s.longMessageAttachments || len(content) > s.maxTextAttachmentBytes
+}
+
+// withLongContent moves content that is over the length limit into a text
+// attachment, leaving the message body empty.
+func (req messageInsert) withLongContent() messageInsert {
+	if utf8.RuneCountInString(req.content) > maxMessageLength {
+		req.attachment = &newAttachment{filename: textAttachmentName, contentType: textAttachmentType, data: []byte(req.content)}
+		req.content = ""
+	}
+	return req
+}
+
+// insertMessageWithAttachment stores a message and its attachment under a
+// savepoint, so a failure leaves neither behind and the rest of the batch
+// unaffected.
+func insertMessageWithAttachment(ctx context.Context, tx *sql.Tx, stmt *sql.Stmt, req messageInsert) (int64, error) {
+	if _, err := tx.ExecContext(ctx, `SAVEPOINT message_attachment`); err != nil {
+		return 0, err
+	}
+	id, err := func() (int64, error) {
+		res, err := stmt.ExecContext(ctx, req.channelID, req.author, req.content, req.createdAt, req.nonce, req.expiresAt, req.stickerID)
+		if err != nil {
+			return 0, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		return id, storeAttachment(ctx, tx, id, *req.attachment, req.createdAt)
+	}()
+	if err != nil {
+		if _, rbErr := tx.ExecContext(ctx, `ROLLBACK TO message_attachment`); rbErr != nil {
+			log.Printf("roll back message attachment: %v", rbErr)
+		}
+	}
+	if _, relErr := tx.ExecContext(ctx, `RELEASE message_attachment`); relErr != nil && err == nil {
+		err = relErr
+	}
+	return id, err
+}
+
+func attachmentURL(channelID, messageID, attachmentID int64) string {
+	return fmt.Sprintf("/api/channels/%d/messages/%d/attachments/%d", channelID, messageID, attachmentID)
+}
+
+// withURLs fills in the download links of an attachment and its thumbnails,
+// unless it cannot be downloaded yet.
+func (att attachmentDTO) withURLs(channelID, messageID int64) attachmentDTO {
+	if att.Status != "" {
+		att.Thumbnails = nil
+		return att
+	}
+	att.URL = attachmentURL(channelID, messageID, att.ID)
+	thumbnails := make([]attachmentThumbnailDTO, len(att.Thumbnails))
+	for i, thumb := range att.Thumbnails {
+		thumb.URL = att.URL + "?thumbnail=" + strconv.Itoa(thumb.Size)
+		thumbnails[i] = thumb
+	}
+	att.Thumbnails = thumbnails
+	return att
+}
+
+// handleMessageAttachment serves an attachment to members who can read the
+// channel it was posted in, or with ?thumbnail={size} one of its
+// thumbnails.
+func (s *serverState) handleMessageAttachment(w http.ResponseWriter, r *http.Request, ch channelInfo, rawMessageID, rawAttachmentID string) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	attachmentID, err := strconv.ParseInt(rawAttachmentID, 10, 64)
+	if err != nil {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	msg, found, err := s.loadChannelMessage(ctx, ch, rawMessageID)
+	if err != nil {
+		log.Printf("load attachment message: %v", err)
+		httpError(w, "failed to load attachment", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	var filename, contentType, hash, location, scanStatus string
+	var createdAt time.Time
+	var data []byte
+	err = s.readDB.QueryRowContext(ctx, `
+        SELECT a.filename, a.content_type, a.blob_hash, b.location, b.data, b.scan_status, a.created_at
+        FROM message_attachments a JOIN attachment_blobs b ON b.hash = a.blob_hash
+        WHERE a.id = ? AND a.message_id = ?
+    `, attachmentID, msg.ID).Scan(&filename, &contentType, &hash, &location, &data, &scanStatus, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("load attachment: %v", err)
+		httpError(w, "failed to load attachment", http.StatusInternalServerError)
+		return
+	}
+
+	if scanStatus != scanClean {
+		writeAttachmentUnavailable(w, scanStatus)
+		return
+	}
+	if rawSize := r.URL.Query().Get("thumbnail"); rawSize != "" {
+		s.serveAttachmentThumbnail(w, r, hash, rawSize, createdAt)
+		return
+	}
+	if store, ok := s.blobs.byLocation[location].(blobPresigner); ok && s.blobs.presignTTL > 0 {
+		link, err := store.presignGet(hash, filename, contentType, s.blobs.presignTTL)
+		if err != nil {
+			log.Printf("presign attachment %d: %v", attachmentID, err)
+			httpError(w, "failed to load attachment", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "private, no-store")
+		http.Redirect(w, r, link, http.StatusFound)
+		return
+	}
+	data, err = s.blobData(ctx, hash, location, data)
+	if err != nil {
+		log.Printf("load attachment %d from %s: %v", attachmentID, location, err)
+		httpError(w, "failed to load attachment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `inline; filename="`+filename+`"`)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("ETag", `"`+hash+`"`)
+	http.ServeContent(w, r, filename, createdAt, bytes.NewReader(data))
+}
+
+func (s *serverState) serveAttachmentThumbnail(w http.ResponseWriter, r *http.Request, hash, rawSize string, modified time.Time) {
+	size, err := strconv.Atoi(rawSize)
+	if err != nil {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	var contentType string
+	var data []byte
+	err = s.readDB.QueryRowContext(r.Context(), `
+        SELECT content_type, data FROM attachment_thumbnails WHERE blob_hash = ? AND size = ?
+    `, hash, size).Scan(&contentType, &data)
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("load attachment thumbnail: %v", err)
+		httpError(w, "failed to load attachment", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("ETag", `"`+hash+`-`+rawSize+`"`)
+	http.ServeContent(w, r, "", modified, bytes.NewReader(data))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditEntryDTO names a user actor by ID and handle. Actors that are not
+// users, such as scim, saml or automation:<id>, come through as Actor.
+type auditEntryDTO struct {
+	ID          int64     `json:"id"`
+	ServerID    int64     `json:"serverId,omitempty"`
+	ActorID     int64     `json:"actorId,omitempty"`
+	ActorHandle string    `json:"actorHandle,omitempty"`
+	Actor       string    `json:"actor,omitempty"`
+	Action      string    `json:"action"`
+	TargetType  string    `json:"targetType"`
+	TargetID    string    `json:"targetId"`
+	Details     string    `json:"details,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// recordAudit appends an entry to the audit log. Failures are logged rather
+// than returned so that auditing never blocks the action it describes.
+func (s *serverState) recordAudit(ctx context.Context, serverID int64, actor, action, targetType, targetID, details string) {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO audit_log (server_id, actor_email, action, target_type, target_id, details, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		sql.NullInt64{Int64: serverID, Valid: serverID != 0}, actor, action, targetType, targetID, details, time.Now().UTC())
+	if err != nil {
+		log.Printf("record audit %s: %v", action, err)
+	}
+}
+
+func (s *serverState) auditLogForServer(ctx context.Context, serverID int64, before int64, limit int) ([]auditEntryDTO, error) {
+	if before <= 0 {
+		before = 1<<63 - 1
+	}
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT a.id, a.server_id, a.actor_email, u.id, u.handle, a.action, a.target_type, a.target_id, a.details, a.created_at
+        FROM audit_log a LEFT JOIN users u ON u.email = a.actor_email
+        WHERE a.server_id = ? AND a.id < ?
+        ORDER BY a.id DESC
+        LIMIT ?
+    `, serverID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []auditEntryDTO
+	for rows.Next() {
+		var e auditEntryDTO
+		var sid, actorID sql.NullInt64
+		var actor string
+		var actorHandle sql.NullString
+		if err := rows.Scan(&e.ID, &sid, &actor, &actorID, &actorHandle, &e.Action, &e.TargetType, &e.TargetID, &e.Details, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.ServerID = sid.Int64
+		switch {
+		case actorID.Valid:
+			e.ActorID, e.ActorHandle = actorID.Int64, actorHandle.String
+		case !strings.Contains(actor, "@"):
+			e.Actor = actor
+		}
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
+
+func (s *serverState) handleServerAuditLog(w http.ResponseWriter, r *http.Request, serverID int64, currentUser user) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	canManage, err := s.canManageServer(r.Context(), currentUser.Email, serverID)
+	if err != nil {
+		log.Printf("check audit permission: %v", err)
+		httpError(w, "failed to load audit log", http.StatusInternalServerError)
+		return
+	}
+	if !canManage {
+		httpError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	limit := 50
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 && n <= 200 {
+		limit = n
+	}
+	before, _ := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64)
+
+	entries, err := s.auditLogForServer(r.Context(), serverID, before, limit)
+	if err != nil {
+		log.Printf("load audit log: %v", err)
+		httpError(w, "failed to load audit log", http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []auditEntryDTO{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		log.Printf("encode audit log: %v", err)
+	}
+}
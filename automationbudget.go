@@ -0,0 +1,429 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// A script's memory is bounded by an allocation budget per run. The Lua VM
+// builds strings for `..` and grows tables on its own, so scripts are
+// compiled with those operations rewritten into calls to hidden Go
+// functions that charge the budget first, and the library functions that
+// build strings or grow tables are replaced with ones that do the same.
+// The budget counts what a run allocates, not what it keeps, so garbage
+// counts too.
+const (
+	automationMaxAlloc = 8 << 20
+	// automationSlotBytes is what one new table entry or table is charged.
+	automationSlotBytes = 64
+
+	// The hidden names are not valid Lua identifiers, so scripts can
+	// neither refer to nor shadow them.
+	automationConcatName = "#concat"
+	automationSetName    = "#set"
+	automationTableName  = "#table"
+)
+
+// compileAutomation parses src and compiles it with its concatenations,
+// table stores and table constructors routed through the hidden functions.
+// The chunk returns a function taking them, in the order of the names
+// above, whose body is the script.
+func compileAutomation(src string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(src), "<string>")
+	if err != nil {
+		return nil, err
+	}
+	body := &ast.FunctionExpr{
+		ParList: &ast.ParList{HasVargs: true, Names: []string{automationConcatName, automationSetName, automationTableName}},
+		Stmts:   budgetStmts(chunk),
+	}
+	return lua.Compile([]ast.Stmt{&ast.ReturnStmt{Exprs: []ast.Expr{body}}}, "<string>")
+}
+
+func budgetStmts(stmts []ast.Stmt) []ast.Stmt {
+	for i, stmt := range stmts {
+		stmts[i] = budgetStmt(stmt)
+	}
+	return stmts
+}
+
+func budgetExprs(exprs []ast.Expr) []ast.Expr {
+	for i, expr := range exprs {
+		exprs[i] = budgetExpr(expr)
+	}
+	return exprs
+}
+
+func budgetStmt(stmt ast.Stmt) ast.Stmt {
+	switch s := stmt.(type) {
+	case *ast.AssignStmt:
+		return budgetAssign(s)
+	case *ast.LocalAssignStmt:
+		budgetExprs(s.Exprs)
+	case *ast.FuncCallStmt:
+		s.Expr = budgetExpr(s.Expr)
+	case *ast.DoBlockStmt:
+		budgetStmts(s.Stmts)
+	case *ast.WhileStmt:
+		s.Condition = budgetExpr(s.Condition)
+		budgetStmts(s.Stmts)
+	case *ast.RepeatStmt:
+		s.Condition = budgetExpr(s.Condition)
+		budgetStmts(s.Stmts)
+	case *ast.IfStmt:
+		s.Condition = budgetExpr(s.Condition)
+		budgetStmts(s.Then)
+		budgetStmts(s.Else)
+	case *ast.NumberForStmt:
+		s.Init, s.Limit = budgetExpr(s.Init), budgetExpr(s.Limit)
+		if s.Step != nil {
+			s.Step = budgetExpr(s.Step)
+		}
+		budgetStmts(s.Stmts)
+	case *ast.GenericForStmt:
+		budgetExprs(s.Exprs)
+		budgetStmts(s.Stmts)
+	case *ast.FuncDefStmt:
+		// Defining a function stores it under a name written in the
+		// source, so it cannot grow a table without bound.
+		budgetStmts(s.Func.Stmts)
+	case *ast.ReturnStmt:
+		budgetExprs(s.Exprs)
+	}
+	return stmt
+}
+
+// budgetAssign turns stores into table fields into #set calls. With several
+// targets, the values are put in hidden locals first, as Lua evaluates
+// every expression before it assigns anything.
+func budgetAssign(s *ast.AssignStmt) ast.Stmt {
+	budgetExprs(s.Rhs)
+	indexed := false
+	for i, lhs := range s.Lhs {
+		if attr, ok := lhs.(*ast.AttrGetExpr); ok {
+			attr.Object, attr.Key = budgetExpr(attr.Object), budgetExpr(attr.Key)
+			indexed = true
+		} else {
+			s.Lhs[i] = budgetExpr(lhs)
+		}
+	}
+	if !indexed {
+		return s
+	}
+	if attr, ok := s.Lhs[0].(*ast.AttrGetExpr); ok && len(s.Lhs) == 1 && len(s.Rhs) == 1 {
+		return budgetCallStmt(s, automationSetName, attr.Object, attr.Key, singleValue(s.Rhs[0]))
+	}
+
+	values := &ast.LocalAssignStmt{Exprs: s.Rhs}
+	values.SetLine(s.Line())
+	block := &ast.DoBlockStmt{Stmts: []ast.Stmt{values}}
+	block.SetLine(s.Line())
+	for i, lhs := range s.Lhs {
+		name := "#v" + strconv.Itoa(i)
+		values.Names = append(values.Names, name)
+		value := budgetIdent(s, name)
+		if attr, ok := lhs.(*ast.AttrGetExpr); ok {
+			block.Stmts = append(block.Stmts, budgetCallStmt(s, automationSetName, attr.Object, attr.Key, value))
+			continue
+		}
+		assign := &ast.AssignStmt{Lhs: []ast.Expr{lhs}, Rhs: []ast.Expr{value}}
+		assign.SetLine(s.Line())
+		block.Stmts = append(block.Stmts, assign)
+	}
+	return block
+}
+
+func budgetExpr(expr ast.Expr) ast.Expr {
+	switch e := expr.(type) {
+	case *ast.StringConcatOpExpr:
+		return budgetCall(e, automationConcatName, budgetExpr(e.Lhs), singleValue(budgetExpr(e.Rhs)))
+	case *ast.TableExpr:
+		for _, f := range e.Fields {
+			if f.Key != nil {
+				f.Key = budgetExpr(f.Key)
+			}
+			f.Value = budgetExpr(f.Value)
+		}
+		return budgetCall(e, automationTableName, e)
+	case *ast.AttrGetExpr:
+		e.Object, e.Key = budgetExpr(e.Object), budgetExpr(e.Key)
+	case *ast.FuncCallExpr:
+		if e.Func != nil {
+			e.Func = budgetExpr(e.Func)
+		}
+		if e.Receiver != nil {
+			e.Receiver = budgetExpr(e.Receiver)
+		}
+		budgetExprs(e.Args)
+	case *ast.LogicalOpExpr:
+		e.Lhs, e.Rhs = budgetExpr(e.Lhs), budgetExpr(e.Rhs)
+	case *ast.RelationalOpExpr:
+		e.Lhs, e.Rhs = budgetExpr(e.Lhs), budgetExpr(e.Rhs)
+	case *ast.ArithmeticOpExpr:
+		e.Lhs, e.Rhs = budgetExpr(e.Lhs), budgetExpr(e.Rhs)
+	case *ast.UnaryMinusOpExpr:
+		e.Expr = budgetExpr(e.Expr)
+	case *ast.UnaryNotOpExpr:
+		e.Expr = budgetExpr(e.Expr)
+	case *ast.UnaryLenOpExpr:
+		e.Expr = budgetExpr(e.Expr)
+	case *ast.FunctionExpr:
+		budgetStmts(e.Stmts)
+	}
+	return expr
+}
+
+// singleValue keeps a call or ... that ends an argument list to one value,
+// as it was where it appeared.
+func singleValue(expr ast.Expr) ast.Expr {
+	switch e := expr.(type) {
+	case *ast.FuncCallExpr:
+		e.AdjustRet = true
+	case *ast.Comma3Expr:
+		e.AdjustRet = true
+	}
+	return expr
+}
+
+func budgetIdent(at ast.PositionHolder, name string) *ast.IdentExpr {
+	ident := &ast.IdentExpr{Value: name}
+	ident.SetLine(at.Line())
+	ident.SetLastLine(at.LastLine())
+	return ident
+}
+
+// budgetCall is a call of the hidden function name, placed on the lines of
+// the expression it replaces so errors point at the script.
+func budgetCall(at ast.PositionHolder, name string, args ...ast.Expr) *ast.FuncCallExpr {
+	call := &ast.FuncCallExpr{Func: budgetIdent(at, name), Args: args, AdjustRet: true}
+	call.SetLine(at.Line())
+	call.SetLastLine(at.LastLine())
+	return call
+}
+
+func budgetCallStmt(at ast.PositionHolder, name string, args ...ast.Expr) *ast.FuncCallStmt {
+	stmt := &ast.FuncCallStmt{Expr: budgetCall(at, name, args...)}
+	stmt.SetLine(at.Line())
+	stmt.SetLastLine(at.LastLine())
+	return stmt
+}
+
+// charge counts n bytes against the run's budget.
+func (run *automationRun) charge(L *lua.LState, n int) {
+	run.allocated += n
+	if run.allocated > automationMaxAlloc {
+		L.RaiseError("script allocated more than %d bytes", automationMaxAlloc)
+	}
+}
+
+// chargeString charges a string of n bytes the script is about to build.
+func (run *automationRun) chargeString(L *lua.LState, n int) {
+	if n > automationMaxString {
+		L.RaiseError("string over %d bytes", automationMaxString)
+	}
+	run.charge(L, n)
+}
+
+// budgetFunctions are the hidden functions compileAutomation routes to, in
+// the order its chunk takes them.
+func (run *automationRun) budgetFunctions(L *lua.LState) []lua.LValue {
+	return []lua.LValue{L.NewFunction(run.luaConcat), L.NewFunction(run.luaSet), L.NewFunction(run.luaTable)}
+}
+
+// luaConcat is a .. b.
+func (run *automationRun) luaConcat(L *lua.LState) int {
+	a, b := L.Get(1), L.Get(2)
+	if lua.LVCanConvToString(a) && lua.LVCanConvToString(b) {
+		sa, sb := lua.LVAsString(a), lua.LVAsString(b)
+		run.chargeString(L, len(sa)+len(sb))
+		L.Push(lua.LString(sa + sb))
+		return 1
+	}
+	mm := L.GetMetaField(a, "__concat")
+	if mm == lua.LNil {
+		mm = L.GetMetaField(b, "__concat")
+	}
+	if mm == lua.LNil {
+		bad := a
+		if lua.LVCanConvToString(a) {
+			bad = b
+		}
+		L.RaiseError("attempt to concatenate a %s value", bad.Type())
+	}
+	L.Push(mm)
+	L.Push(a)
+	L.Push(b)
+	L.Call(2, 1)
+	return 1
+}
+
+// luaSet is obj[key] = value, charged when it adds an entry to a table.
+func (run *automationRun) luaSet(L *lua.LState) int {
+	obj, key, value := L.Get(1), L.Get(2), L.Get(3)
+	if tb, ok := obj.(*lua.LTable); ok && value != lua.LNil && tb.RawGet(key) == lua.LNil {
+		run.charge(L, automationSlotBytes)
+	}
+	L.SetTable(obj, key, value)
+	return 0
+}
+
+// luaTable charges a table built by a constructor for each of its entries.
+func (run *automationRun) luaTable(L *lua.LState) int {
+	tb := L.CheckTable(1)
+	entries := 1
+	tb.ForEach(func(lua.LValue, lua.LValue) { entries++ })
+	run.charge(L, entries*automationSlotBytes)
+	L.Push(tb)
+	return 1
+}
+
+// limitLibraries replaces the library functions that build strings or grow
+// tables with ones that charge the budget. Those that could build a string
+// over automationMaxString check before doing the work.
+func (run *automationRun) limitLibraries(L *lua.LState) {
+	str, _ := L.GetGlobal("string").(*lua.LTable)
+	tbl, _ := L.GetGlobal("table").(*lua.LTable)
+	if str == nil || tbl == nil {
+		return
+	}
+	wrap := func(lib *lua.LTable, name string, check func(L *lua.LState)) {
+		orig, ok := L.GetField(lib, name).(*lua.LFunction)
+		if !ok {
+			return
+		}
+		L.SetField(lib, name, L.NewFunction(func(L *lua.LState) int {
+			if check != nil {
+				check(L)
+			}
+			base := L.GetTop()
+			n := orig.GFunction(L)
+			if n > 0 {
+				if s, ok := L.Get(base + 1).(lua.LString); ok {
+					run.chargeString(L, len(s))
+				}
+			}
+			return n
+		}))
+	}
+
+	for _, name := range []string{"upper", "lower", "reverse", "char"} {
+		wrap(str, name, nil)
+	}
+	wrap(str, "rep", func(L *lua.LState) {
+		if s, n := L.CheckString(1), L.CheckInt(2); n > 0 && len(s)*n > automationMaxString {
+			L.RaiseError("string over %d bytes", automationMaxString)
+		}
+	})
+	wrap(str, "format", run.checkFormat)
+	wrap(str, "gsub", run.checkGsub)
+	wrap(tbl, "concat", func(L *lua.LState) {
+		t := L.CheckTable(1)
+		sep := L.OptString(2, "")
+		i, j := L.OptInt(3, 1), L.OptInt(4, t.Len())
+		size := 0
+		for k := i; k <= j; k++ {
+			size += len(lua.LVAsString(t.RawGetInt(k))) + len(sep)
+			if size > automationMaxString {
+				L.RaiseError("string over %d bytes", automationMaxString)
+			}
+		}
+	})
+	wrap(tbl, "insert", func(L *lua.LState) {
+		run.charge(L, automationSlotBytes)
+	})
+	L.SetGlobal("rawset", L.NewFunction(func(L *lua.LState) int {
+		tb, key, value := L.CheckTable(1), L.CheckAny(2), L.CheckAny(3)
+		if value != lua.LNil && tb.RawGet(key) == lua.LNil {
+			run.charge(L, automationSlotBytes)
+		}
+		tb.RawSet(key, value)
+		L.Push(tb)
+		return 1
+	}))
+}
+
+// checkFormat holds string.format to Lua's own rule of at most two digits
+// of width and precision, and refuses arguments that could add up to a
+// string over automationMaxString.
+func (run *automationRun) checkFormat(L *lua.LState) {
+	format := L.CheckString(1)
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		for _, part := range []bool{true, false} {
+			if !part {
+				if i >= len(format) || format[i] != '.' {
+					break
+				}
+				i++
+			}
+			digits := 0
+			for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+				i++
+				digits++
+			}
+			if digits > 2 {
+				L.RaiseError("invalid format (width or precision too long)")
+			}
+		}
+	}
+	size := len(format)
+	for n := 2; n <= L.GetTop(); n++ {
+		// %q can double a string; 99 is the widest any other value gets.
+		size += 2*len(lua.LVAsString(L.Get(n))) + 99
+	}
+	if size > 2*automationMaxString {
+		L.RaiseError("string over %d bytes", automationMaxString)
+	}
+}
+
+// checkGsub refuses a replacement string that could expand past
+// automationMaxString, and has replacements from a table or function
+// counted as they are made.
+func (run *automationRun) checkGsub(L *lua.LState) {
+	s := L.CheckString(1)
+	limit := L.OptInt(4, -1)
+	matches := len(s) + 1
+	if limit >= 0 && limit < matches {
+		matches = limit
+	}
+	switch repl := L.Get(3).(type) {
+	case lua.LString:
+		// Each %0-%9 in the replacement is at most the whole subject.
+		captures := strings.Count(string(repl), "%")
+		if len(s)+matches*(len(repl)+captures*len(s)) > automationMaxString {
+			L.RaiseError("string.gsub result could be over %d bytes", automationMaxString)
+		}
+	case *lua.LTable, *lua.LFunction:
+		size := len(s)
+		L.Replace(3, L.NewFunction(func(L *lua.LState) int {
+			var value lua.LValue
+			if t, ok := repl.(*lua.LTable); ok {
+				value = L.GetTable(t, L.Get(1))
+			} else {
+				args := make([]lua.LValue, L.GetTop())
+				for i := range args {
+					args[i] = L.Get(i + 1)
+				}
+				L.CallByParam(lua.P{Fn: repl, NRet: 1}, args...)
+				value = L.Get(-1)
+				L.Pop(1)
+			}
+			if lua.LVCanConvToString(value) {
+				size += len(lua.LVAsString(value))
+				run.chargeString(L, size)
+			}
+			L.Push(value)
+			return 1
+		}))
+	}
+}
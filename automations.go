@@ -0,0 +1,683 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// automationTimeLimit is how long one run of a script may take, the
+	// database writes of send and set_role included.
+	automationTimeLimit = 250 * time.Millisecond
+	// The Lua call stack and value stack limits bound a script's stack;
+	// everything else it allocates comes out of automationMaxAlloc.
+	automationCallStack    = 64
+	automationRegistry     = 1024
+	automationRegistryMax  = 64 * 1024
+	automationMaxString    = 64 << 10
+	automationMaxSource    = 16 << 10
+	automationMaxActions   = 5
+	automationMaxLogLines  = 20
+	automationQueueSize    = 256
+	automationRunsKept     = 50
+	automationScheduleTick = time.Minute
+)
+
+// automationDTO names the member who created the automation by ID and
+// handle.
+type automationDTO struct {
+	ID      int64  `json:"id"`
+	Name    string `json:"name"`
+	Trigger string `json:"trigger"`
+	// IntervalMinutes is how often a schedule automation runs.
+	IntervalMinutes int        `json:"intervalMinutes,omitempty"`
+	Source          string     `json:"source"`
+	Enabled         bool       `json:"enabled"`
+	CreatedByID     int64      `json:"createdById,omitempty"`
+	CreatedByHandle string     `json:"createdByHandle,omitempty"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	UpdatedAt       time.Time  `json:"updatedAt"`
+	LastRunAt       *time.Time `json:"lastRunAt,omitempty"`
+	LastError       string     `json:"lastError,omitempty"`
+}
+
+// automationRunDTO records one run: what set it off, what the script did
+// and how it ended.
+type automationRunDTO struct {
+	ID         int64     `json:"id"`
+	Trigger    string    `json:"trigger"`
+	StartedAt  time.Time `json:"startedAt"`
+	DurationMs int64     `json:"durationMs"`
+	Actions    []string  `json:"actions"`
+	Error      string    `json:"error,omitempty"`
+}
+
+const automationColumns = `id, name, trigger, interval_minutes, source, enabled, created_by_id,
+    (SELECT handle FROM users WHERE users.id = server_automations.created_by_id), created_at, updated_at, last_run_at, last_error`
+
+func scanAutomation(row interface{ Scan(...any) error }) (automationDTO, error) {
+	var a automationDTO
+	var lastRun sql.NullTime
+	var creatorID sql.NullInt64
+	var creatorHandle sql.NullString
+	err := row.Scan(&a.ID, &a.Name, &a.Trigger, &a.IntervalMinutes, &a.Source, &a.Enabled, &creatorID, &creatorHandle, &a.CreatedAt, &a.UpdatedAt, &lastRun, &a.LastError)
+	a.CreatedByID, a.CreatedByHandle = creatorID.Int64, creatorHandle.String
+	if lastRun.Valid {
+		a.LastRunAt = &lastRun.Time
+	}
+	return a, err
+}
+
+// automationEvent is something that sets off a server's automations of
+// one trigger, or a single automation when only is set.
+type automationEvent struct {
+	serverID  int64
+	trigger   string
+	only      int64
+	channelID int64 // where reply posts, for messages
+	fields    map[string]any
+}
+
+// automationRunner runs server automations one at a time on its own
+// goroutine, so a busy script never holds up whatever set it off.
+type automationRunner struct {
+	s     *serverState
+	queue chan automationEvent
+}
+
+func newAutomationRunner(s *serverState) *automationRunner {
+	return &automationRunner{s: s, queue: make(chan automationEvent, automationQueueSize)}
+}
+
+// enqueue hands ev to the runner. Events are dropped rather than blocking
+// the caller when the queue is full.
+func (r *automationRunner) enqueue(ev automationEvent) {
+	if r == nil {
+		return
+	}
+	select {
+	case r.queue <- ev:
+	default:
+		log.Printf("automation queue full, %s event for server %d dropped", ev.trigger, ev.serverID)
+	}
+}
+
+// memberJoined sets off the join automations of serverID.
+func (r *automationRunner) memberJoined(serverID int64, email string) {
+	r.enqueue(automationEvent{serverID: serverID, trigger: "join", fields: map[string]any{"email": email}})
+}
+
+// messagePosted sets off the message automations of msg's server. The
+// server and author are looked up on the runner's goroutine.
+func (r *automationRunner) messagePosted(msg messageDTO) {
+	if msg.Content == "" {
+		return
+	}
+	r.enqueue(automationEvent{trigger: "message", channelID: msg.ChannelID, fields: map[string]any{
+		"messageId": msg.ID,
+		"channelId": msg.ChannelID,
+		"content":   msg.Content,
+		"authorId":  msg.AuthorID,
+	}})
+}
+
+func (r *automationRunner) run(ctx context.Context) {
+	ticker := time.NewTicker(automationScheduleTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-r.queue:
+			r.dispatch(ctx, ev)
+		case <-ticker.C:
+			r.runSchedules(ctx)
+		}
+	}
+}
+
+// dispatch fills in what ev needs and runs the automations it sets off.
+func (r *automationRunner) dispatch(ctx context.Context, ev automationEvent) {
+	s := r.s
+	switch ev.trigger {
+	case "message":
+		ch, found, err := s.channelByID(ctx, ev.channelID)
+		if err != nil || !found || ch.ServerID == s.directServerID {
+			return
+		}
+		ev.serverID = ch.ServerID
+		author, found, err := s.getUserByID(ctx, ev.fields["authorId"].(int64))
+		// Automations post as the system account; answering those would loop.
+		if err != nil || !found || author.Email == systemUserEmail {
+			return
+		}
+		ev.fields["author"] = automationUser(author)
+		delete(ev.fields, "authorId")
+	case "join":
+		u, found, err := s.getUserByEmail(ctx, ev.fields["email"].(string))
+		if err != nil || !found {
+			return
+		}
+		ev.fields = map[string]any{"user": automationUser(u)}
+	}
+	ev.fields["type"] = ev.trigger
+	ev.fields["serverId"] = ev.serverID
+
+	query := `SELECT ` + automationColumns + ` FROM server_automations WHERE server_id = ? AND trigger = ? AND enabled = 1`
+	args := []any{ev.serverID, ev.trigger}
+	if ev.only != 0 {
+		query += ` AND id = ?`
+		args = append(args, ev.only)
+	}
+	rows, err := s.readDB.QueryContext(ctx, query+` ORDER BY id`, args...)
+	if err != nil {
+		log.Printf("load automations: %v", err)
+		return
+	}
+	var automations []automationDTO
+	for rows.Next() {
+		a, err := scanAutomation(rows)
+		if err != nil {
+			log.Printf("scan automation: %v", err)
+			continue
+		}
+		automations = append(automations, a)
+	}
+	rows.Close()
+	for _, a := range automations {
+		s.runAutomation(ctx, ev, a)
+	}
+}
+
+func automationUser(u user) map[string]any {
+	return map[string]any{"id": u.ID, "handle": u.Handle, "displayName": u.DisplayName}
+}
+
+// runSchedules queues the schedule automations whose interval has passed.
+func (r *automationRunner) runSchedules(ctx context.Context) {
+	rows, err := r.s.readDB.QueryContext(ctx, `
+        SELECT id, server_id, interval_minutes, last_run_at FROM server_automations
+        WHERE trigger = 'schedule' AND enabled = 1
+    `)
+	if err != nil {
+		log.Printf("load scheduled automations: %v", err)
+		return
+	}
+	defer rows.Close()
+	now := time.Now()
+	for rows.Next() {
+		var id, serverID int64
+		var interval int
+		var lastRun sql.NullTime
+		if err := rows.Scan(&id, &serverID, &interval, &lastRun); err != nil {
+			log.Printf("scan scheduled automation: %v", err)
+			return
+		}
+		if lastRun.Valid && now.Sub(lastRun.Time) < time.Duration(interval)*time.Minute-automationScheduleTick/2 {
+			continue
+		}
+		r.enqueue(automationEvent{serverID: serverID, trigger: "schedule", only: id, fields: map[string]any{}})
+	}
+}
+
+// automationRun is the state of one script run that its Go functions see.
+type automationRun struct {
+	s         *serverState
+	ctx       context.Context
+	a         automationDTO
+	ev        automationEvent
+	actions   []string
+	performed int
+	logged    int
+	allocated int // bytes charged; see automationbudget.go
+}
+
+// runAutomation runs a's script for ev in a fresh sandbox and records the
+// run.
+func (s *serverState) runAutomation(ctx context.Context, ev automationEvent, a automationDTO) {
+	started := time.Now()
+	run := &automationRun{s: s, ctx: ctx, a: a, ev: ev, actions: []string{}}
+	err := run.execute()
+	errText := ""
+	if err != nil {
+		errText = err.Error()
+	}
+	encoded, _ := json.Marshal(run.actions)
+	if err := s.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `UPDATE server_automations SET last_run_at = ?, last_error = ? WHERE id = ?`, started.UTC(), errText, a.ID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO automation_runs (automation_id, trigger, started_at, duration_ms, actions, error) VALUES (?, ?, ?, ?, ?, ?)`,
+			a.ID, ev.trigger, started.UTC(), time.Since(started).Milliseconds(), string(encoded), errText); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+            DELETE FROM automation_runs WHERE automation_id = ? AND id NOT IN (
+                SELECT id FROM automation_runs WHERE automation_id = ? ORDER BY id DESC LIMIT ?)
+        `, a.ID, a.ID, automationRunsKept)
+		return err
+	}); err != nil {
+		log.Printf("record automation run: %v", err)
+	}
+}
+
+func newAutomationState() *lua.LState {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:        true,
+		CallStackSize:       automationCallStack,
+		RegistrySize:        automationRegistry,
+		RegistryMaxSize:     automationRegistryMax,
+		MinimizeStackMemory: true,
+	})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// Nothing that reaches outside the sandbox or loads more code.
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "collectgarbage", "getfenv", "setfenv", "print", "_printregs", "newproxy"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	return L
+}
+
+// checkAutomationSource reports whether src compiles.
+func checkAutomationSource(src string) error {
+	_, err := compileAutomation(src)
+	return err
+}
+
+func (run *automationRun) execute() (err error) {
+	L := newAutomationState()
+	defer L.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), automationTimeLimit)
+	defer cancel()
+	L.SetContext(ctx)
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("script failed: %v", r)
+		}
+	}()
+
+	L.SetGlobal("event", automationValue(L, run.ev.fields))
+	L.SetGlobal("send", L.NewFunction(run.luaSend))
+	L.SetGlobal("reply", L.NewFunction(run.luaReply))
+	L.SetGlobal("set_role", L.NewFunction(run.luaSetRole))
+	L.SetGlobal("log", L.NewFunction(run.luaLog))
+	run.limitLibraries(L)
+
+	proto, err := compileAutomation(run.a.Source)
+	if err != nil {
+		return err
+	}
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 1, nil); err != nil {
+		return err
+	}
+	body := L.Get(-1)
+	L.Pop(1)
+	if err := L.CallByParam(lua.P{Fn: body, Protect: true}, run.budgetFunctions(L)...); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("script ran longer than %s", automationTimeLimit)
+		}
+		return err
+	}
+	return nil
+}
+
+// automationValue converts event fields to Lua values.
+func automationValue(L *lua.LState, v any) lua.LValue {
+	switch v := v.(type) {
+	case string:
+		return lua.LString(v)
+	case int64:
+		return lua.LNumber(v)
+	case bool:
+		return lua.LBool(v)
+	case map[string]any:
+		t := L.NewTable()
+		for key, value := range v {
+			t.RawSetString(key, automationValue(L, value))
+		}
+		return t
+	}
+	return lua.LNil
+}
+
+// act counts an action against the run's limit and records it.
+func (run *automationRun) act(L *lua.LState, description string) {
+	if run.performed >= automationMaxActions {
+		L.RaiseError("more than %d actions in one run", automationMaxActions)
+	}
+	run.performed++
+	run.actions = append(run.actions, description)
+}
+
+// luaSend is send(channelId, text): post text as the system account in a
+// text channel of the automation's server.
+func (run *automationRun) luaSend(L *lua.LState) int {
+	run.post(L, L.CheckInt64(1), L.CheckString(2))
+	return 0
+}
+
+// luaReply is reply(text): post text in the channel of the message that
+// set the automation off.
+func (run *automationRun) luaReply(L *lua.LState) int {
+	if run.ev.trigger != "message" {
+		L.RaiseError("reply only works for message automations")
+	}
+	run.post(L, run.ev.channelID, L.CheckString(1))
+	return 0
+}
+
+func (run *automationRun) post(L *lua.LState, channelID int64, text string) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		L.RaiseError("text is empty")
+	}
+	if utf8.RuneCountInString(text) > 2000 {
+		text = string([]rune(text)[:2000])
+	}
+	ch, found, err := run.s.channelByID(run.ctx, channelID)
+	if err != nil {
+		L.RaiseError("load channel: %v", err)
+	}
+	if !found || ch.ServerID != run.ev.serverID || ch.Kind == "voice" {
+		L.RaiseError("channel %d is not a text channel of this server", channelID)
+	}
+	run.act(L, fmt.Sprintf("send #%d: %s", channelID, text))
+	if _, err := run.s.saveMessage(run.ctx, channelID, systemUserEmail, text); err != nil {
+		L.RaiseError("post message: %v", err)
+	}
+}
+
+// luaSetRole is set_role(userId, role): make a member an admin or a plain
+// member. Owners are left alone.
+func (run *automationRun) luaSetRole(L *lua.LState) int {
+	userID := L.CheckInt64(1)
+	role := L.CheckString(2)
+	if role != "admin" && role != "member" {
+		L.ArgError(2, "role must be admin or member")
+	}
+	u, found, err := run.s.getUserByID(run.ctx, userID)
+	if err != nil {
+		L.RaiseError("load user: %v", err)
+	}
+	if !found {
+		L.ArgError(1, "no such user")
+	}
+	run.act(L, fmt.Sprintf("set_role %d %s", userID, role))
+	res, err := run.s.db.ExecContext(run.ctx, `UPDATE server_members SET role = ? WHERE server_id = ? AND user_id = ? AND role NOT IN ('owner', ?)`, role, run.ev.serverID, userID, role)
+	if err != nil {
+		L.RaiseError("set role: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		run.s.invalidateMembership(run.ev.serverID, u.Email)
+		run.s.recordAudit(run.ctx, run.ev.serverID, "automation:"+strconv.FormatInt(run.a.ID, 10), "member.role", "user", strconv.FormatInt(userID, 10), role)
+	}
+	return 0
+}
+
+// luaLog is log(...): add a line to the run's record.
+func (run *automationRun) luaLog(L *lua.LState) int {
+	if run.logged >= automationMaxLogLines {
+		return 0
+	}
+	run.logged++
+	parts := make([]string, L.GetTop())
+	for i := range parts {
+		parts[i] = L.ToStringMeta(L.Get(i + 1)).String()
+	}
+	line := strings.Join(parts, " ")
+	if len(line) > 500 {
+		line = line[:500]
+	}
+	run.actions = append(run.actions, "log: "+line)
+	return 0
+}
+
+// handleServerAutomations serves /api/servers/{id}/automations for server
+// owners and admins: GET lists the automations and POST adds one;
+// /{automationId} takes PATCH and DELETE, and /{automationId}/runs lists
+// recent runs.
+func (s *serverState) handleServerAutomations(w http.ResponseWriter, r *http.Request, serverID int64, currentUser user, rest []string) {
+	ctx := r.Context()
+	canManage, err := s.canManageServer(ctx, currentUser.Email, serverID)
+	if err != nil {
+		log.Printf("check automation permission: %v", err)
+		httpError(w, "failed to load automations", http.StatusInternalServerError)
+		return
+	}
+	if !canManage {
+		httpError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if len(rest) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.readDB.QueryContext(ctx, `SELECT `+automationColumns+` FROM server_automations WHERE server_id = ? ORDER BY id`, serverID)
+			if err != nil {
+				log.Printf("list automations: %v", err)
+				httpError(w, "failed to load automations", http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+			automations := []automationDTO{}
+			for rows.Next() {
+				a, err := scanAutomation(rows)
+				if err != nil {
+					log.Printf("scan automation: %v", err)
+					httpError(w, "failed to load automations", http.StatusInternalServerError)
+					return
+				}
+				automations = append(automations, a)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(automations); err != nil {
+				log.Printf("encode automations: %v", err)
+			}
+		case http.MethodPost:
+			var body struct {
+				Name            string `json:"name" validate:"trim,required,max=100"`
+				Trigger         string `json:"trigger" validate:"trim,lower,required,oneof=join|message|schedule"`
+				IntervalMinutes int    `json:"intervalMinutes" validate:"min=0"`
+				Source          string `json:"source" validate:"required"`
+				Enabled         *bool  `json:"enabled"`
+			}
+			if !s.decodeJSON(w, r, &body) {
+				return
+			}
+			now := time.Now().UTC()
+			a := automationDTO{
+				Name:            body.Name,
+				Trigger:         body.Trigger,
+				IntervalMinutes: body.IntervalMinutes,
+				Source:          body.Source,
+				Enabled:         body.Enabled == nil || *body.Enabled,
+				CreatedByID:     currentUser.ID,
+				CreatedByHandle: currentUser.Handle,
+				CreatedAt:       now,
+				UpdatedAt:       now,
+			}
+			if !validAutomation(w, a) {
+				return
+			}
+			res, err := s.db.ExecContext(ctx, `INSERT INTO server_automations (server_id, name, trigger, interval_minutes, source, enabled, created_by_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				serverID, a.Name, a.Trigger, a.IntervalMinutes, a.Source, a.Enabled, a.CreatedByID, a.CreatedAt, a.UpdatedAt)
+			if err == nil {
+				a.ID, err = res.LastInsertId()
+			}
+			if err != nil {
+				log.Printf("create automation: %v", err)
+				httpError(w, "failed to create automation", http.StatusInternalServerError)
+				return
+			}
+			s.recordAudit(ctx, serverID, currentUser.Email, "automation.create", "automation", strconv.FormatInt(a.ID, 10), a.Name)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			if err := json.NewEncoder(w).Encode(a); err != nil {
+				log.Printf("encode automation: %v", err)
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	automationID, err := strconv.ParseInt(rest[0], 10, 64)
+	if err != nil || len(rest) > 2 || (len(rest) == 2 && rest[1] != "runs") {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	a, err := scanAutomation(s.readDB.QueryRowContext(ctx, `SELECT `+automationColumns+` FROM server_automations WHERE id = ? AND server_id = ?`, automationID, serverID))
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("load automation: %v", err)
+		httpError(w, "failed to load automation", http.StatusInternalServerError)
+		return
+	}
+
+	if len(rest) == 2 {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		runs, err := s.automationRuns(ctx, a.ID)
+		if err != nil {
+			log.Printf("list automation runs: %v", err)
+			httpError(w, "failed to load runs", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(runs); err != nil {
+			log.Printf("encode automation runs: %v", err)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		var body struct {
+			Name            *string `json:"name" validate:"trim,required,max=100"`
+			Trigger         *string `json:"trigger" validate:"trim,lower,required,oneof=join|message|schedule"`
+			IntervalMinutes *int    `json:"intervalMinutes" validate:"min=0"`
+			Source          *string `json:"source" validate:"required"`
+			Enabled         *bool   `json:"enabled"`
+		}
+		if !s.decodeJSON(w, r, &body) {
+			return
+		}
+		var changed []string
+		if body.Name != nil {
+			a.Name = *body.Name
+			changed = append(changed, "name")
+		}
+		if body.Trigger != nil {
+			a.Trigger = *body.Trigger
+			changed = append(changed, "trigger")
+		}
+		if body.IntervalMinutes != nil {
+			a.IntervalMinutes = *body.IntervalMinutes
+			changed = append(changed, "intervalMinutes")
+		}
+		if body.Source != nil {
+			a.Source = *body.Source
+			changed = append(changed, "source")
+		}
+		if body.Enabled != nil {
+			a.Enabled = *body.Enabled
+			changed = append(changed, "enabled")
+		}
+		if !validAutomation(w, a) {
+			return
+		}
+		a.UpdatedAt = time.Now().UTC()
+		if _, err := s.db.ExecContext(ctx, `UPDATE server_automations SET name = ?, trigger = ?, interval_minutes = ?, source = ?, enabled = ?, updated_at = ? WHERE id = ?`,
+			a.Name, a.Trigger, a.IntervalMinutes, a.Source, a.Enabled, a.UpdatedAt, a.ID); err != nil {
+			log.Printf("update automation: %v", err)
+			httpError(w, "failed to update automation", http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit(ctx, serverID, currentUser.Email, "automation.update", "automation", rest[0], strings.Join(changed, ","))
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(a); err != nil {
+			log.Printf("encode automation: %v", err)
+		}
+	case http.MethodDelete:
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM server_automations WHERE id = ?`, a.ID); err != nil {
+			log.Printf("delete automation: %v", err)
+			httpError(w, "failed to delete automation", http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit(ctx, serverID, currentUser.Email, "automation.delete", "automation", rest[0], a.Name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "PATCH, DELETE")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// validAutomation checks what the field tags cannot, answering 400 when a
+// fails.
+func validAutomation(w http.ResponseWriter, a automationDTO) bool {
+	var errs []fieldError
+	if a.Trigger == "schedule" && a.IntervalMinutes < 1 {
+		errs = append(errs, fieldError{Field: "intervalMinutes", Message: "is required for schedule automations"})
+	}
+	if len(a.Source) > automationMaxSource {
+		errs = append(errs, fieldError{Field: "source", Message: fmt.Sprintf("must be at most %d bytes", automationMaxSource)})
+	} else if err := checkAutomationSource(a.Source); err != nil {
+		errs = append(errs, fieldError{Field: "source", Message: err.Error()})
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return false
+	}
+	return true
+}
+
+func (s *serverState) automationRuns(ctx context.Context, automationID int64) ([]automationRunDTO, error) {
+	rows, err := s.readDB.QueryContext(ctx, `SELECT id, trigger, started_at, duration_ms, actions, error FROM automation_runs WHERE automation_id = ? ORDER BY id DESC`, automationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	runs := []automationRunDTO{}
+	for rows.Next() {
+		var run automationRunDTO
+		var actions string
+		if err := rows.Scan(&run.ID, &run.Trigger, &run.StartedAt, &run.DurationMs, &actions, &run.Error); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(actions), &run.Actions); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
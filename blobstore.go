@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Attachment contents are kept in one of several places, recorded per blob
+// in attachment_blobs.location: in the database row itself
+// (databaseLocation), or in a blobStore outside it. ATTACHMENT_STORE picks
+// where new blobs go; blobs already stored elsewhere stay readable as long as
+// their store is still configured, and "echosphere move-attachments" copies
+// them over.
+const (
+	databaseLocation = "database"
+
+	blobSweepEvery = 10 * time.Minute
+	// blobSweepGrace is how long an unreferenced object is kept before it is
+	// deleted, so a send that found the blob just before its last reference
+	// went away does not end up pointing at a deleted object.
+	blobSweepGrace = time.Hour
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+// blobStore keeps attachment contents outside the database, keyed by their
+// SHA-256.
+type blobStore interface {
+	// location is the name recorded with each blob kept in this store.
+	location() string
+	put(ctx context.Context, hash string, data []byte) error
+	// get returns errBlobNotFound when there is no such object.
+	get(ctx context.Context, hash string) ([]byte, error)
+	// remove succeeds when the object is already gone.
+	remove(ctx context.Context, hash string) error
+}
+
+// blobPresigner is implemented by stores that can hand out time-limited
+// download links, so the server does not have to proxy the bytes.
+type blobPresigner interface {
+	presignGet(hash, filename, contentType string, expires time.Duration) (string, error)
+}
+
+// blobKey spreads objects over 256 prefixes, as ab/abcdef….
+func blobKey(hash string) string {
+	return hash[:2] + "/" + hash
+}
+
+// diskStore keeps blobs as files under a directory.
+type diskStore struct {
+	dir string
+}
+
+func (d *diskStore) location() string { return "disk" }
+
+func (d *diskStore) path(hash string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(blobKey(hash)))
+}
+
+func (d *diskStore) put(ctx context.Context, hash string, data []byte) error {
+	path := d.path(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash never leaves a truncated
+	// blob under its final name.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (d *diskStore) get(ctx context.Context, hash string) ([]byte, error) {
+	data, err := os.ReadFile(d.path(hash))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	return data, err
+}
+
+func (d *diskStore) remove(ctx context.Context, hash string) error {
+	if err := os.Remove(d.path(hash)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// blobStores holds every configured store by location, and the one new
+// blobs are written to (nil for the database).
+type blobStores struct {
+	byLocation map[string]blobStore
+	write      blobStore
+	// presignTTL is how long presigned download links last; 0 serves every
+	// attachment through the app.
+	presignTTL time.Duration
+}
+
+// blobStoresFromEnv configures ATTACHMENT_STORE (database, disk or s3). The
+// disk store, under ATTACHMENT_DIR (default data/attachments), is always
+// available for reading; S3 is available whenever S3_BUCKET is set.
+func blobStoresFromEnv(dataDir string) (*blobStores, error) {
+	stores := &blobStores{byLocation: make(map[string]blobStore)}
+	disk := &diskStore{dir: envOrDefault("ATTACHMENT_DIR", filepath.Join(dataDir, "attachments"))}
+	stores.byLocation[disk.location()] = disk
+
+	var s3 *s3Store
+	if os.Getenv("S3_BUCKET") != "" {
+		var err error
+		if s3, err = s3StoreFromEnv(); err != nil {
+			return nil, err
+		}
+		stores.byLocation[s3.location()] = s3
+		if boolFromEnv("S3_PRESIGN_DOWNLOADS", false) {
+			stores.presignTTL = durationFromEnv("S3_PRESIGN_TTL", defaultS3PresignTTL)
+		}
+	}
+
+	switch mode := strings.ToLower(strings.TrimSpace(envOrDefault("ATTACHMENT_STORE", databaseLocation))); mode {
+	case databaseLocation:
+	case "disk":
+		stores.write = disk
+	case "s3":
+		if s3 == nil {
+			return nil, errors.New("ATTACHMENT_STORE=s3 needs S3_BUCKET")
+		}
+		stores.write = s3
+	default:
+		return nil, fmt.Errorf("ATTACHMENT_STORE=%q is not one of database, disk, s3", mode)
+	}
+	return stores, nil
+}
+
+func (b *blobStores) writeLocation() string {
+	if b.write == nil {
+		return databaseLocation
+	}
+	return b.write.location()
+}
+
+func (b *blobStores) store(location string) (blobStore, error) {
+	store, ok := b.byLocation[location]
+	if !ok {
+		return nil, fmt.Errorf("attachment store %q is not configured", location)
+	}
+	return store, nil
+}
+
+// placeBlob makes sure data is kept somewhere and returns the location to
+// pass to storeAttachment. Content that is already stored is not written
+// again; new content goes to the configured store, or stays with the row
+// when that is the database. It runs before the message is queued, so slow
+// uploads never hold up the message writer.
+func (s *serverState) placeBlob(ctx context.Context, data []byte) (string, error) {
+	hash := attachmentHash(data)
+	var location string
+	err := s.readDB.QueryRowContext(ctx, `SELECT location FROM attachment_blobs WHERE hash = ?`, hash).Scan(&location)
+	if err == nil {
+		return location, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	if s.blobs.write == nil {
+		return databaseLocation, nil
+	}
+	if err := s.blobs.write.put(ctx, hash, data); err != nil {
+		return "", fmt.Errorf("store attachment in %s: %w", s.blobs.write.location(), err)
+	}
+	return s.blobs.write.location(), nil
+}
+
+// blobData returns a blob's contents, given the row's location and data.
+func (s *serverState) blobData(ctx context.Context, hash, location string, rowData []byte) ([]byte, error) {
+	if location == databaseLocation {
+		return rowData, nil
+	}
+	store, err := s.blobs.store(location)
+	if err != nil {
+		return nil, err
+	}
+	return store.get(ctx, hash)
+}
+
+// runBlobSweeper deletes objects whose blob rows are gone. The
+// attachment_blob_release trigger queues them in blob_deletions.
+func (s *serverState) runBlobSweeper(ctx context.Context) {
+	ticker := time.NewTicker(blobSweepEvery)
+	defer ticker.Stop()
+
+	for {
+		if err := s.sweepBlobs(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("sweep attachment blobs: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *serverState) sweepBlobs(ctx context.Context) error {
+	cutoff := time.Now().UTC().Add(-blobSweepGrace).Format(syncTimeFormat)
+	rows, err := s.readDB.QueryContext(ctx, `SELECT hash, location FROM blob_deletions WHERE queued_at < ? LIMIT 500`, cutoff)
+	if err != nil {
+		return err
+	}
+	type pending struct{ hash, location string }
+	var queue []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.hash, &p.location); err != nil {
+			rows.Close()
+			return err
+		}
+		queue = append(queue, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range queue {
+		// The same content may have been stored there again since.
+		var inUse bool
+		if err := s.readDB.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM attachment_blobs WHERE hash = ? AND location = ?)`, p.hash, p.location).Scan(&inUse); err != nil {
+			return err
+		}
+		if !inUse {
+			store, err := s.blobs.store(p.location)
+			if err != nil {
+				log.Printf("sweep attachment blob %s: %v", p.hash, err)
+				continue
+			}
+			if err := store.remove(ctx, p.hash); err != nil {
+				log.Printf("delete attachment blob %s from %s: %v", p.hash, p.location, err)
+				continue
+			}
+		}
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM blob_deletions WHERE hash = ? AND location = ?`, p.hash, p.location); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveBlob copies one blob to the configured store and points its row
+// there. The old copy is queued for deletion like any other unused object.
+func (s *serverState) moveBlob(ctx context.Context, hash, location string, rowData []byte) error {
+	data, err := s.blobData(ctx, hash, location, rowData)
+	if err != nil {
+		return err
+	}
+	target := s.blobs.writeLocation()
+	rowData = data
+	if s.blobs.write != nil {
+		if err := s.blobs.write.put(ctx, hash, data); err != nil {
+			return err
+		}
+		rowData = []byte{}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `UPDATE attachment_blobs SET location = ?, data = ? WHERE hash = ? AND location = ?`, target, rowData, hash, location); err != nil {
+		return err
+	}
+	if location != databaseLocation {
+		if _, err := tx.ExecContext(ctx, `
+            INSERT INTO blob_deletions (hash, location) VALUES (?, ?)
+            ON CONFLICT (hash, location) DO UPDATE SET queued_at = excluded.queued_at
+        `, hash, location); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func runMoveAttachments(args []string) error {
+	flags := flag.NewFlagSet("move-attachments", flag.ExitOnError)
+	flags.Parse(args)
+
+	ctx := context.Background()
+	srv, err := openServerState(ctx)
+	if err != nil {
+		return err
+	}
+	defer srv.close()
+
+	target := srv.blobs.writeLocation()
+	rows, err := srv.readDB.QueryContext(ctx, `SELECT hash, location FROM attachment_blobs WHERE location != ?`, target)
+	if err != nil {
+		return err
+	}
+	type blob struct{ hash, location string }
+	var blobs []blob
+	for rows.Next() {
+		var b blob
+		if err := rows.Scan(&b.hash, &b.location); err != nil {
+			rows.Close()
+			return err
+		}
+		blobs = append(blobs, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	moved := 0
+	for _, b := range blobs {
+		var rowData []byte
+		if err := srv.readDB.QueryRowContext(ctx, `SELECT data FROM attachment_blobs WHERE hash = ?`, b.hash).Scan(&rowData); err != nil {
+			return err
+		}
+		if err := srv.moveBlob(ctx, b.hash, b.location, rowData); err != nil {
+			return fmt.Errorf("move attachment blob %s from %s: %w", b.hash, b.location, err)
+		}
+		moved++
+	}
+	fmt.Printf("moved %d attachment blobs to %s\n", moved, target)
+	return nil
+}
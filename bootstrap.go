@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// bootstrapMe is the signed-in user as served by /api/bootstrap/me.
+type bootstrapMe struct {
+	User        userDTO        `json:"user"`
+	Preferences preferencesDTO `json:"preferences"`
+	// Locales lists the values preferences.locale accepts.
+	Locales       []string          `json:"locales"`
+	Branding      brandingDTO       `json:"branding"`
+	Announcements []announcementDTO `json:"announcements,omitempty"`
+}
+
+// writeCacheableJSON writes v with an ETag derived from its encoding, so a
+// client that sends it back in If-None-Match gets 304 Not Modified while
+// nothing has changed. Responses are private and revalidated on every use.
+func writeCacheableJSON(w http.ResponseWriter, r *http.Request, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("encode %s: %v", r.URL.Path, err)
+		httpError(w, "failed to load data", http.StatusInternalServerError)
+		return
+	}
+	body = append(body, '\n')
+	sum := sha256.Sum256(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+// bootstrapV2 is /api/bootstrap/v2, the starting state for native clients:
+// no messages or member lists, which they page in themselves, but enough to
+// draw the conversation list with its unread badges and open the gateway.
+type bootstrapV2 struct {
+	Version        int                    `json:"version"`
+	User           userDTO                `json:"user"`
+	Preferences    preferencesDTO         `json:"preferences"`
+	Servers        []serverPayload        `json:"servers"`
+	DirectMessages []directChannelPayload `json:"directMessages"`
+	Conversations  []conversationHint     `json:"conversations"`
+	Unread         []unreadState          `json:"unread"`
+	// Presence lists the people the user follows who are not offline.
+	Presence      []presenceDTO     `json:"presence"`
+	Gateway       gatewayDTO        `json:"gateway"`
+	Features      map[string]bool   `json:"features"`
+	SyncSeq       int64             `json:"syncSeq"`
+	Branding      brandingDTO       `json:"branding"`
+	Announcements []announcementDTO `json:"announcements,omitempty"`
+}
+
+// unreadState is a channel's read marker and what has arrived since.
+type unreadState struct {
+	ChannelID     int64 `json:"channelId"`
+	UnreadCount   int64 `json:"unreadCount"`
+	LastReadID    int64 `json:"lastReadId,omitempty"`
+	FirstUnreadID int64 `json:"firstUnreadId,omitempty"`
+}
+
+// gatewayDTO tells a client where and how to open its event connection.
+type gatewayDTO struct {
+	URL             string            `json:"url"`
+	WebTransportURL string            `json:"webTransportUrl,omitempty"`
+	Protocols       []string          `json:"protocols"`
+	Reconnect       wsReconnectPolicy `json:"reconnect"`
+}
+
+// bootstrapFeatures lists the optional parts of the instance, so clients can
+// hide what is switched off instead of discovering it from errors.
+func (s *serverState) bootstrapFeatures() map[string]bool {
+	return map[string]bool{
+		"webTransport":       s.webTransport != nil,
+		"messageBatching":    s.wsBatchEvery > 0,
+		"voiceTranscription": s.transcriber != nil,
+		"uploadScanning":     s.scanner != nil,
+		"longMessages":       s.longMessageAttachments,
+		"emailNotifications": s.emailNotifications,
+	}
+}
+
+func (s *serverState) buildBootstrapV2(r *http.Request, currentUser user) (bootstrapV2, error) {
+	ctx := r.Context()
+	// As in buildBootstrapPayload, the checkpoint comes before the snapshot.
+	syncSeq, err := s.currentSyncSeq(ctx)
+	if err != nil {
+		return bootstrapV2{}, err
+	}
+	servers, err := s.serversForUser(ctx, currentUser.Email)
+	if err != nil {
+		return bootstrapV2{}, err
+	}
+	if len(servers) == 0 {
+		if err := s.ensureMembership(ctx, currentUser.Email, currentUser.TenantID); err != nil {
+			return bootstrapV2{}, err
+		}
+		if servers, err = s.serversForUser(ctx, currentUser.Email); err != nil {
+			return bootstrapV2{}, err
+		}
+	}
+	channels, err := s.channelsForUser(ctx, currentUser.Email)
+	if err != nil {
+		return bootstrapV2{}, err
+	}
+	channelsByServer := make(map[int64][]channelPayload, len(servers))
+	for _, ch := range channels {
+		channelsByServer[ch.ServerID] = append(channelsByServer[ch.ServerID], toChannelPayload(ch))
+	}
+	serverPayloads := make([]serverPayload, 0, len(servers))
+	for _, srv := range servers {
+		serverPayloads = append(serverPayloads, toServerPayload(srv, channelsByServer[srv.ID]))
+	}
+
+	direct, err := s.directChannelsForUser(ctx, currentUser.Email)
+	if err != nil {
+		return bootstrapV2{}, err
+	}
+	if direct == nil {
+		direct = []directChannelPayload{}
+	}
+	conversations, err := s.conversationOrder(ctx, currentUser)
+	if err != nil {
+		return bootstrapV2{}, err
+	}
+	outlines, err := s.channelOutlines(ctx, currentUser)
+	if err != nil {
+		return bootstrapV2{}, err
+	}
+	unread := make([]unreadState, 0, len(outlines))
+	for _, o := range outlines {
+		unread = append(unread, unreadState{
+			ChannelID:     o.ChannelID,
+			UnreadCount:   o.UnreadCount,
+			LastReadID:    o.LastReadID,
+			FirstUnreadID: o.FirstUnreadID,
+		})
+	}
+	sort.Slice(unread, func(i, j int) bool { return unread[i].ChannelID < unread[j].ChannelID })
+	presence, err := s.presenceSnapshot(ctx, currentUser)
+	if err != nil {
+		return bootstrapV2{}, err
+	}
+	prefs, err := s.preferencesFor(ctx, currentUser)
+	if err != nil {
+		return bootstrapV2{}, err
+	}
+	announcements, err := s.pendingAnnouncements(ctx, currentUser)
+	if err != nil {
+		return bootstrapV2{}, err
+	}
+
+	scheme := "ws"
+	if requestIsHTTPS(r) {
+		scheme = "wss"
+	}
+	gateway := gatewayDTO{
+		URL:       scheme + "://" + r.Host + tenantScopeFrom(ctx).basePath + "/ws",
+		Protocols: []string{wsProtocolMsgpack, wsProtocolJSON},
+		Reconnect: s.wsReconnect,
+	}
+	if s.webTransport != nil {
+		gateway.WebTransportURL = s.webTransport.urlFor(r)
+	}
+
+	return bootstrapV2{
+		Version: 2,
+		User: userDTO{
+			ID:          currentUser.ID,
+			Email:       currentUser.Email,
+			Handle:      currentUser.Handle,
+			DisplayName: currentUser.DisplayName,
+		},
+		Preferences:    prefs,
+		Servers:        serverPayloads,
+		DirectMessages: direct,
+		Conversations:  conversations,
+		Unread:         unread,
+		Presence:       presence,
+		Gateway:        gateway,
+		Features:       s.bootstrapFeatures(),
+		SyncSeq:        syncSeq,
+		Branding:       s.currentBranding(ctx, currentUser.TenantID).dto(),
+		Announcements:  announcements,
+	}, nil
+}
+
+// handleBootstrapResource serves the parts of /api/bootstrap that rarely
+// change, each on its own so clients can revalidate them separately:
+// /api/bootstrap/me, /api/bootstrap/servers (without their channels) and
+// /api/bootstrap/channels. It also serves /api/bootstrap/v2 for native
+// clients.
+func (s *serverState) handleBootstrapResource(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	switch r.URL.Path {
+	case "/me":
+		prefs, err := s.preferencesFor(ctx, currentUser)
+		if err != nil {
+			log.Printf("bootstrap me: %v", err)
+			httpError(w, "failed to load data", http.StatusInternalServerError)
+			return
+		}
+		announcements, err := s.pendingAnnouncements(ctx, currentUser)
+		if err != nil {
+			log.Printf("bootstrap me: %v", err)
+			httpError(w, "failed to load data", http.StatusInternalServerError)
+			return
+		}
+		writeCacheableJSON(w, r, bootstrapMe{
+			User: userDTO{
+				ID:          currentUser.ID,
+				Email:       currentUser.Email,
+				Handle:      currentUser.Handle,
+				DisplayName: currentUser.DisplayName,
+			},
+			Preferences:   prefs,
+			Locales:       supportedLocales(),
+			Branding:      s.currentBranding(ctx, currentUser.TenantID).dto(),
+			Announcements: announcements,
+		})
+	case "/servers":
+		servers, err := s.serversForUser(ctx, currentUser.Email)
+		if err != nil {
+			log.Printf("bootstrap servers: %v", err)
+			httpError(w, "failed to load data", http.StatusInternalServerError)
+			return
+		}
+		payloads := make([]serverPayload, 0, len(servers))
+		for _, srv := range servers {
+			payloads = append(payloads, toServerPayload(srv, nil))
+		}
+		writeCacheableJSON(w, r, payloads)
+	case "/channels":
+		channels, err := s.channelsForUser(ctx, currentUser.Email)
+		if err != nil {
+			log.Printf("bootstrap channels: %v", err)
+			httpError(w, "failed to load data", http.StatusInternalServerError)
+			return
+		}
+		payloads := make([]channelPayload, 0, len(channels))
+		for _, ch := range channels {
+			payloads = append(payloads, toChannelPayload(ch))
+		}
+		writeCacheableJSON(w, r, payloads)
+	case "/v2":
+		payload, err := s.buildBootstrapV2(r, currentUser)
+		if err != nil {
+			log.Printf("bootstrap v2: %v", err)
+			httpError(w, "failed to load data", http.StatusInternalServerError)
+			return
+		}
+		writeCacheableJSON(w, r, payload)
+	default:
+		httpError(w, "not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	settingBrandLogo         = "brand_logo"
+	settingBrandAccentColor  = "brand_accent_color"
+	settingBrandLoginHeading = "brand_login_heading"
+	settingBrandLoginMessage = "brand_login_message"
+
+	maxBrandLogoBytes = 1 << 20
+	brandLogoPath     = "/branding/logo"
+)
+
+// instanceBranding is how the instance, or a tenant of it, presents itself:
+// its name, logo and accent color everywhere, and the copy on the login
+// page. Empty fields fall back to the defaults.
+type instanceBranding struct {
+	Name         string
+	LogoPath     string
+	AccentColor  string
+	LoginHeading string
+	LoginMessage string
+	// BasePath is the tenant's path-mode prefix, which its logo URL needs.
+	BasePath string
+}
+
+type brandingDTO struct {
+	Name         string `json:"name"`
+	LogoURL      string `json:"logoUrl,omitempty"`
+	AccentColor  string `json:"accentColor,omitempty"`
+	LoginHeading string `json:"loginHeading,omitempty"`
+	LoginMessage string `json:"loginMessage,omitempty"`
+}
+
+func (b instanceBranding) dto() brandingDTO {
+	dto := brandingDTO{Name: b.Name, AccentColor: b.AccentColor, LoginHeading: b.LoginHeading, LoginMessage: b.LoginMessage}
+	if b.LogoPath != "" {
+		// The stored name carries a content hash, so a new logo gets a new
+		// URL past any cache.
+		base := filepath.Base(b.LogoPath)
+		dto.LogoURL = b.BasePath + brandLogoPath + "?v=" + strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	return dto
+}
+
+// loadBranding reads a tenant's branding from the instance settings, where
+// each tenant has its own keys. A tenant's name defaults to the one it was
+// created with.
+func (s *serverState) loadBranding(ctx context.Context, tenantID int64) (instanceBranding, error) {
+	t, ok, err := s.tenantByID(ctx, tenantID)
+	if err != nil {
+		return instanceBranding{}, err
+	}
+	if !ok {
+		return instanceBranding{}, fmt.Errorf("tenant %d not found", tenantID)
+	}
+	b := instanceBranding{Name: t.Name, BasePath: s.tenantBasePath(t)}
+	for key, field := range map[string]*string{
+		settingInstanceName:      &b.Name,
+		settingBrandLogo:         &b.LogoPath,
+		settingBrandAccentColor:  &b.AccentColor,
+		settingBrandLoginHeading: &b.LoginHeading,
+		settingBrandLoginMessage: &b.LoginMessage,
+	} {
+		value, ok, err := s.getSetting(ctx, tenantSettingKey(tenantID, key))
+		if err != nil {
+			return instanceBranding{}, err
+		}
+		if ok {
+			*field = value
+		}
+	}
+	s.branding.set(tenantID, b)
+	return b, nil
+}
+
+func (s *serverState) currentBranding(ctx context.Context, tenantID int64) instanceBranding {
+	if b, ok := s.branding.get(tenantID); ok {
+		return b
+	}
+	b, err := s.loadBranding(ctx, tenantID)
+	if err != nil {
+		log.Printf("load branding: %v", err)
+		return instanceBranding{Name: defaultInstanceName}
+	}
+	return b
+}
+
+func (s *serverState) currentInstanceName(ctx context.Context, tenantID int64) string {
+	return s.currentBranding(ctx, tenantID).Name
+}
+
+// handleBrandLogo serves GET /branding/logo, the instance or tenant logo, to
+// anyone: the login page shows it before there is a session.
+func (s *serverState) handleBrandLogo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b := s.currentBranding(r.Context(), requestTenantID(r))
+	if b.LogoPath == "" {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, s.mediaFile(r, b.LogoPath))
+}
+
+// handleAdminBranding serves /api/admin/branding: GET returns the branding
+// and PATCH changes the fields it names. The logo travels as a data URL;
+// an empty string removes it, and empty strings reset the other fields to
+// their defaults. Admins brand their own tenant.
+func (s *serverState) handleAdminBranding(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.requireInstanceAdmin(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var body struct {
+			Name         *string `json:"name" validate:"trim,max=100"`
+			Logo         *string `json:"logo"`
+			AccentColor  *string `json:"accentColor" validate:"trim,lower"`
+			LoginHeading *string `json:"loginHeading" validate:"trim,max=100"`
+			LoginMessage *string `json:"loginMessage" validate:"trim,max=500"`
+		}
+		if !decodeJSONLimit(w, r, &body, 2*maxBrandLogoBytes) {
+			return
+		}
+		tenantID := currentUser.TenantID
+		b := s.currentBranding(ctx, tenantID)
+		oldLogo := b.LogoPath
+		var changed []string
+		if body.Name != nil {
+			b.Name = *body.Name
+			if b.Name == "" {
+				b.Name = defaultInstanceName
+				if tenantID != rootTenantID {
+					t, _, err := s.tenantByID(ctx, tenantID)
+					if err != nil {
+						log.Printf("load tenant: %v", err)
+						httpError(w, "failed to update branding", http.StatusInternalServerError)
+						return
+					}
+					b.Name = t.Name
+				}
+			}
+			changed = append(changed, "name")
+		}
+		if body.AccentColor != nil {
+			if *body.AccentColor != "" && !roleColorPattern.MatchString(*body.AccentColor) {
+				httpError(w, "accentColor must be a hex color like #38bdf8", http.StatusBadRequest)
+				return
+			}
+			b.AccentColor = *body.AccentColor
+			changed = append(changed, "accentColor")
+		}
+		if body.LoginHeading != nil {
+			b.LoginHeading = *body.LoginHeading
+			changed = append(changed, "loginHeading")
+		}
+		if body.LoginMessage != nil {
+			b.LoginMessage = *body.LoginMessage
+			changed = append(changed, "loginMessage")
+		}
+		if body.Logo != nil {
+			b.LogoPath = ""
+			if *body.Logo != "" {
+				raw, err := decodeImageDataURL(*body.Logo, "logo", maxBrandLogoBytes)
+				if err != nil {
+					httpError(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				var imgErr *imageError
+				if b.LogoPath, _, err = s.storeMediaImage(ctx, "branding", "logo", raw, iconThumbnailSizes); errors.As(err, &imgErr) {
+					httpError(w, "logo: "+err.Error(), http.StatusBadRequest)
+					return
+				} else if err != nil {
+					log.Printf("store logo: %v", err)
+					httpError(w, "failed to store logo", http.StatusInternalServerError)
+					return
+				}
+			}
+			changed = append(changed, "logo")
+		}
+
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			log.Printf("update branding: %v", err)
+			httpError(w, "failed to update branding", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		for key, value := range map[string]string{
+			settingInstanceName:      b.Name,
+			settingBrandLogo:         b.LogoPath,
+			settingBrandAccentColor:  b.AccentColor,
+			settingBrandLoginHeading: b.LoginHeading,
+			settingBrandLoginMessage: b.LoginMessage,
+		} {
+			if err := setSetting(ctx, tx, tenantSettingKey(tenantID, key), value); err != nil {
+				log.Printf("update branding: %v", err)
+				httpError(w, "failed to update branding", http.StatusInternalServerError)
+				return
+			}
+		}
+		// The system account that sends notices carries the instance name;
+		// tenants share it, so only the root tenant's name is used.
+		if tenantID == rootTenantID {
+			if _, err := tx.ExecContext(ctx, `UPDATE users SET display_name = ? WHERE email = ?`, b.Name, systemUserEmail); err != nil {
+				log.Printf("rename system user: %v", err)
+				httpError(w, "failed to update branding", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("update branding: %v", err)
+			httpError(w, "failed to update branding", http.StatusInternalServerError)
+			return
+		}
+		s.branding.set(tenantID, b)
+		if oldLogo != "" && oldLogo != b.LogoPath {
+			s.removeMediaImage(oldLogo)
+		}
+		s.recordAudit(ctx, 0, currentUser.Email, "instance.branding", "instance", "", strings.Join(changed, ","))
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.currentBranding(ctx, currentUser.TenantID).dto()); err != nil {
+		log.Printf("encode branding: %v", err)
+	}
+}
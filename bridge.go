@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// userStatusBridged marks ghost accounts that stand in for people on a
+	// bridged network. They have no password and cannot sign in.
+	userStatusBridged = "bridged"
+
+	bridgeQueueSize = 256
+)
+
+// errInvalidRemote is wrapped by bridge.link when the remote room cannot be
+// linked; the message is shown to the caller.
+var errInvalidRemote = errors.New("invalid remote room")
+
+// bridge connects channels to rooms on another chat network. Outgoing
+// messages arrive through relay; incoming ones are handed to
+// serverState.receiveBridged from whatever routes the bridge registers.
+type bridge interface {
+	// name identifies the bridge in links and ghost accounts, e.g. "matrix".
+	name() string
+	// link checks that remoteID names a room the bridge can reach, joins it
+	// and returns the room's canonical ID.
+	link(ctx context.Context, remoteID string) (string, error)
+	// relay posts msg, written by author, to the remote room.
+	relay(ctx context.Context, remoteID string, author user, msg messageDTO) error
+	// routes registers the callbacks the remote network delivers to.
+	routes(mux *http.ServeMux)
+}
+
+// bridgeSender describes the remote author of an incoming message.
+type bridgeSender struct {
+	RemoteID    string
+	HandleHint  string
+	DisplayName string
+}
+
+// bridgeLinkDTO names the member who linked the channel by ID and handle.
+type bridgeLinkDTO struct {
+	Bridge          string    `json:"bridge"`
+	ChannelID       int64     `json:"channelId"`
+	RemoteID        string    `json:"remoteId"`
+	CreatedByID     int64     `json:"createdById,omitempty"`
+	CreatedByHandle string    `json:"createdByHandle,omitempty"`
+	CreatedAt       time.Time `json:"createdAt"`
+}
+
+// bridgeHub owns the configured bridges and relays new messages to them
+// from one goroutine, so a slow remote never holds up a broadcast.
+type bridgeHub struct {
+	s       *serverState
+	bridges map[string]bridge
+	queue   chan messageDTO
+}
+
+func newBridgeHub(s *serverState, bridges ...bridge) *bridgeHub {
+	h := &bridgeHub{s: s, bridges: make(map[string]bridge), queue: make(chan messageDTO, bridgeQueueSize)}
+	for _, b := range bridges {
+		if b != nil {
+			h.bridges[b.name()] = b
+			log.Printf("bridge %s enabled", b.name())
+		}
+	}
+	return h
+}
+
+func (h *bridgeHub) get(name string) (bridge, bool) {
+	if h == nil {
+		return nil, false
+	}
+	b, ok := h.bridges[name]
+	return b, ok
+}
+
+func (h *bridgeHub) routes(mux *http.ServeMux) {
+	for _, b := range h.bridges {
+		b.routes(mux)
+	}
+}
+
+// enqueue hands msg to the relay goroutine. Messages are dropped rather than
+// blocking the caller when the queue is full.
+func (h *bridgeHub) enqueue(msg messageDTO) {
+	// Remote networks cannot be made to forget a self-destructing message,
+	// and long messages stored as attachments have no text to relay.
+	if h == nil || len(h.bridges) == 0 || msg.ExpiresAt != nil || msg.Content == "" {
+		return
+	}
+	select {
+	case h.queue <- msg:
+	default:
+		log.Printf("bridge queue full, message %d not relayed", msg.ID)
+	}
+}
+
+func (h *bridgeHub) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-h.queue:
+			h.deliver(ctx, msg)
+		}
+	}
+}
+
+func (h *bridgeHub) deliver(ctx context.Context, msg messageDTO) {
+	links, err := h.s.bridgeLinks(ctx, msg.ChannelID)
+	if err != nil {
+		log.Printf("load bridge links for channel %d: %v", msg.ChannelID, err)
+		return
+	}
+	if len(links) == 0 {
+		return
+	}
+	author, exists, err := h.s.getUserByID(ctx, msg.AuthorID)
+	if err != nil {
+		log.Printf("load bridged message author %d: %v", msg.AuthorID, err)
+		return
+	}
+	// Join and leave notices stay local.
+	if !exists || author.Email == systemUserEmail {
+		return
+	}
+	origin, err := h.s.ghostBridge(ctx, author.ID)
+	if err != nil {
+		log.Printf("load bridge ghost %d: %v", author.ID, err)
+		return
+	}
+
+	for _, link := range links {
+		b, ok := h.bridges[link.Bridge]
+		// A message that came in over a bridge is not echoed back to it.
+		if !ok || link.Bridge == origin {
+			continue
+		}
+		if err := b.relay(ctx, link.RemoteID, author, msg); err != nil {
+			log.Printf("relay message %d to %s %s: %v", msg.ID, link.Bridge, link.RemoteID, err)
+		}
+	}
+}
+
+func (s *serverState) bridgeLinks(ctx context.Context, channelID int64) ([]bridgeLinkDTO, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT l.bridge, l.channel_id, l.remote_id, u.id, u.handle, l.created_at
+        FROM bridge_links l LEFT JOIN users u ON u.id = l.created_by_id
+        WHERE l.channel_id = ?
+        ORDER BY l.bridge
+    `, channelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []bridgeLinkDTO
+	for rows.Next() {
+		var l bridgeLinkDTO
+		var creatorID sql.NullInt64
+		var creatorHandle sql.NullString
+		if err := rows.Scan(&l.Bridge, &l.ChannelID, &l.RemoteID, &creatorID, &creatorHandle, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		l.CreatedByID, l.CreatedByHandle = creatorID.Int64, creatorHandle.String
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+// ghostBridge returns the bridge userID is a ghost for, or "" for a regular
+// account.
+func (s *serverState) ghostBridge(ctx context.Context, userID int64) (string, error) {
+	var name string
+	err := s.stmts.QueryRowContext(ctx, `SELECT bridge FROM bridge_users WHERE user_id = ?`, userID).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return name, err
+}
+
+// bridgeGhost returns the local account standing in for sender on the named
+// bridge, creating it the first time the sender is seen and keeping its
+// display name current.
+func (s *serverState) bridgeGhost(ctx context.Context, bridgeName string, sender bridgeSender) (user, error) {
+	u, err := scanUser(s.db.QueryRowContext(ctx, `
+        SELECT `+userColumns+` FROM users
+        WHERE id = (SELECT user_id FROM bridge_users WHERE bridge = ? AND remote_id = ?)
+    `, bridgeName, sender.RemoteID))
+	if err == nil {
+		if sender.DisplayName != "" && sender.DisplayName != u.DisplayName {
+			if _, err := s.db.ExecContext(ctx, `UPDATE users SET display_name = ? WHERE id = ?`, sender.DisplayName, u.ID); err != nil {
+				return user{}, err
+			}
+			u.DisplayName = sender.DisplayName
+		}
+		return u, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return user{}, err
+	}
+
+	// The address only has to be unique; .invalid guarantees nobody can
+	// receive mail at it or sign up with it.
+	sum := sha256.Sum256([]byte(sender.RemoteID))
+	u = user{
+		Email:        hex.EncodeToString(sum[:8]) + "@" + bridgeName + ".bridge.invalid",
+		DisplayName:  sender.DisplayName,
+		PasswordHash: []byte{},
+		CreatedAt:    time.Now().UTC(),
+		Status:       userStatusBridged,
+	}
+	if u.DisplayName == "" {
+		u.DisplayName = sender.HandleHint
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return user{}, err
+	}
+	defer tx.Rollback()
+
+	// Ghosts cannot sign in, so they all live in the root tenant whichever
+	// tenant's channel they post to.
+	if u.Handle, err = uniqueHandle(ctx, tx, rootTenantID, handleFromEmail(sender.HandleHint)); err != nil {
+		return user{}, err
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO users (email, handle, display_name, password_hash, created_at, status) VALUES (?, ?, ?, ?, ?, ?)`,
+		u.Email, u.Handle, u.DisplayName, u.PasswordHash, u.CreatedAt, u.Status)
+	if err != nil {
+		return user{}, err
+	}
+	if u.ID, err = res.LastInsertId(); err != nil {
+		return user{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO bridge_users (bridge, remote_id, user_id) VALUES (?, ?, ?)`, bridgeName, sender.RemoteID, u.ID); err != nil {
+		return user{}, err
+	}
+	return u, tx.Commit()
+}
+
+// receiveBridged stores a message that arrived over the named bridge in the
+// channel linked to remoteRoom and broadcasts it. remoteMessageID doubles as
+// the message nonce, so an event the remote side delivers twice is stored
+// once. Messages for unlinked rooms and read-only channels are ignored.
+func (s *serverState) receiveBridged(ctx context.Context, bridgeName, remoteRoom, remoteMessageID string, sender bridgeSender, content string) error {
+	var channelID int64
+	err := s.readDB.QueryRowContext(ctx, `SELECT channel_id FROM bridge_links WHERE bridge = ? AND remote_id = ?`, bridgeName, remoteRoom).Scan(&channelID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ch, exists, err := s.channelByID(ctx, channelID)
+	if err != nil || !exists || ch.PostRoles != "" {
+		return err
+	}
+
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return nil
+	}
+	if utf8.RuneCountInString(content) > 2000 {
+		content = string([]rune(content)[:2000])
+	}
+
+	ghost, err := s.bridgeGhost(ctx, bridgeName, sender)
+	if err != nil {
+		return fmt.Errorf("bridge ghost: %w", err)
+	}
+	_, _, err = s.saveClientMessage(ctx, ch.ID, ghost.Email, content, remoteMessageID, 0, 0)
+	return err
+}
+
+func (s *serverState) handleChannelBridges(w http.ResponseWriter, r *http.Request, ch channelInfo, currentUser user, bridgeName string) {
+	ctx := r.Context()
+
+	if bridgeName != "" {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "DELETE")
+			httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		canManage, err := s.canManageChannel(ctx, currentUser.Email, ch)
+		if err != nil {
+			log.Printf("check bridge permission: %v", err)
+			httpError(w, "failed to unlink channel", http.StatusInternalServerError)
+			return
+		}
+		if !canManage {
+			httpError(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		res, err := s.db.ExecContext(ctx, `DELETE FROM bridge_links WHERE bridge = ? AND channel_id = ?`, bridgeName, ch.ID)
+		if err != nil {
+			log.Printf("delete bridge link: %v", err)
+			httpError(w, "failed to unlink channel", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			httpError(w, "not found", http.StatusNotFound)
+			return
+		}
+		s.recordAudit(ctx, ch.ServerID, currentUser.Email, "channel.bridge_unlink", "channel", strconv.FormatInt(ch.ID, 10), bridgeName)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		links, err := s.bridgeLinks(ctx, ch.ID)
+		if err != nil {
+			log.Printf("list bridge links: %v", err)
+			httpError(w, "failed to list bridges", http.StatusInternalServerError)
+			return
+		}
+		if links == nil {
+			links = []bridgeLinkDTO{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(links); err != nil {
+			log.Printf("encode bridge links: %v", err)
+		}
+	case http.MethodPost:
+		var body struct {
+			Bridge   string `json:"bridge" validate:"trim,required"`
+			RemoteID string `json:"remoteId" validate:"trim,required"`
+		}
+		if !s.decodeJSON(w, r, &body) {
+			return
+		}
+		if ch.Kind == "voice" || ch.Kind == "dm" {
+			httpError(w, "only text channels can be bridged", http.StatusBadRequest)
+			return
+		}
+		canManage, err := s.canManageChannel(ctx, currentUser.Email, ch)
+		if err != nil {
+			log.Printf("check bridge permission: %v", err)
+			httpError(w, "failed to link channel", http.StatusInternalServerError)
+			return
+		}
+		if !canManage {
+			httpError(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		b, ok := s.bridges.get(body.Bridge)
+		if !ok {
+			httpError(w, "unknown bridge", http.StatusBadRequest)
+			return
+		}
+
+		remoteID, err := b.link(ctx, body.RemoteID)
+		if errors.Is(err, errInvalidRemote) {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("link %s room %s: %v", b.name(), body.RemoteID, err)
+			httpError(w, "failed to reach the bridged network", http.StatusBadGateway)
+			return
+		}
+
+		var owner int64
+		err = s.readDB.QueryRowContext(ctx, `SELECT channel_id FROM bridge_links WHERE bridge = ? AND remote_id = ?`, b.name(), remoteID).Scan(&owner)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("check bridge link: %v", err)
+			httpError(w, "failed to link channel", http.StatusInternalServerError)
+			return
+		}
+		if err == nil && owner != ch.ID {
+			httpError(w, "that room is already linked to another channel", http.StatusConflict)
+			return
+		}
+
+		link := bridgeLinkDTO{
+			Bridge:          b.name(),
+			ChannelID:       ch.ID,
+			RemoteID:        remoteID,
+			CreatedByID:     currentUser.ID,
+			CreatedByHandle: currentUser.Handle,
+			CreatedAt:       time.Now().UTC(),
+		}
+		if _, err := s.db.ExecContext(ctx, `
+            INSERT INTO bridge_links (bridge, channel_id, remote_id, created_by_id, created_at) VALUES (?, ?, ?, ?, ?)
+            ON CONFLICT(bridge, channel_id) DO UPDATE SET remote_id = excluded.remote_id, created_by_id = excluded.created_by_id, created_at = excluded.created_at
+        `, link.Bridge, link.ChannelID, link.RemoteID, link.CreatedByID, link.CreatedAt); err != nil {
+			log.Printf("create bridge link: %v", err)
+			httpError(w, "failed to link channel", http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit(ctx, ch.ServerID, currentUser.Email, "channel.bridge_link", "channel", strconv.FormatInt(ch.ID, 10), link.Bridge+" "+link.RemoteID)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(link); err != nil {
+			log.Printf("encode bridge link: %v", err)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	lookupCacheTTL  = 30 * time.Second
+	lookupCacheSize = 10000
+)
+
+type cacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// ttlCache is a small map-backed cache for hot lookups. Entries expire after
+// ttl as a safety net; writers are expected to invalidate explicitly.
+type ttlCache[K comparable, V any] struct {
+	mu      sync.RWMutex
+	ttl     time.Duration
+	max     int
+	entries map[K]cacheEntry[V]
+}
+
+func newTTLCache[K comparable, V any](ttl time.Duration, max int) *ttlCache[K, V] {
+	return &ttlCache[K, V]{ttl: ttl, max: max, entries: make(map[K]cacheEntry[V])}
+}
+
+func (c *ttlCache[K, V]) get(key K) (V, bool) {
+	c.mu.RLock()
+	entry, ok := c.entries[key]
+	c.mu.RUnlock()
+	if !ok || time.Now().After(entry.expires) {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+func (c *ttlCache[K, V]) set(key K, value V) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.max {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// Still full of live entries: start over rather than track recency.
+		if len(c.entries) >= c.max {
+			c.entries = make(map[K]cacheEntry[V])
+		}
+	}
+	c.entries[key] = cacheEntry[V]{value: value, expires: now.Add(c.ttl)}
+}
+
+func (c *ttlCache[K, V]) delete(key K) {
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
+}
+
+func (c *ttlCache[K, V]) deleteWhere(match func(K) bool) {
+	c.mu.Lock()
+	for k := range c.entries {
+		if match(k) {
+			delete(c.entries, k)
+		}
+	}
+	c.mu.Unlock()
+}
+
+type membershipKey struct {
+	serverID int64
+	email    string
+}
+
+// membershipEntry caches both members (with their role) and non-members.
+type membershipEntry struct {
+	role     string
+	isMember bool
+}
+
+func (s *serverState) invalidateMembership(serverID int64, email string) {
+	s.memberCache.delete(membershipKey{serverID: serverID, email: email})
+}
+
+func (s *serverState) invalidateServerMemberships(serverID int64) {
+	s.memberCache.deleteWhere(func(k membershipKey) bool { return k.serverID == serverID })
+}
+
+func (s *serverState) invalidateChannel(channelID int64) {
+	s.channelCache.delete(channelID)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCaptchaTimeout       = 10 * time.Second
+	defaultCaptchaLoginFailures = 3
+)
+
+var (
+	errCaptchaMissing  = errors.New("captcha response missing")
+	errCaptchaRejected = errors.New("captcha rejected")
+)
+
+// captchaVerifier checks the token a CAPTCHA widget adds to a form with the
+// provider that issued it.
+type captchaVerifier interface {
+	name() string
+	widget() captchaWidget
+	// responseField is the form field the widget fills in.
+	responseField() string
+	verify(ctx context.Context, token, remoteIP string) error
+}
+
+// captchaWidget is what the login and signup templates need to render the
+// provider's widget.
+type captchaWidget struct {
+	Class   string
+	SiteKey string
+	Script  string
+}
+
+func captchaFromEnv() (captchaVerifier, error) {
+	switch name := strings.ToLower(strings.TrimSpace(os.Getenv("CAPTCHA_PROVIDER"))); name {
+	case "", "none":
+		return nil, nil
+	case "hcaptcha":
+		return siteverifyCaptchaFromEnv(name, siteverifyCaptcha{
+			verifyURL: "https://api.hcaptcha.com/siteverify",
+			script:    "https://js.hcaptcha.com/1/api.js",
+			class:     "h-captcha",
+			field:     "h-captcha-response",
+		})
+	case "turnstile":
+		return siteverifyCaptchaFromEnv(name, siteverifyCaptcha{
+			verifyURL: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+			script:    "https://challenges.cloudflare.com/turnstile/v0/api.js",
+			class:     "cf-turnstile",
+			field:     "cf-turnstile-response",
+		})
+	default:
+		return nil, fmt.Errorf("CAPTCHA_PROVIDER=%q is not one of none, hcaptcha, turnstile", name)
+	}
+}
+
+// siteverifyCaptcha speaks the siteverify protocol hCaptcha and Turnstile
+// share: the secret, token and client address are posted as a form and the
+// answer is JSON with a success flag.
+type siteverifyCaptcha struct {
+	provider  string
+	siteKey   string
+	secret    string
+	verifyURL string
+	script    string
+	class     string
+	field     string
+	client    *http.Client
+}
+
+func siteverifyCaptchaFromEnv(provider string, c siteverifyCaptcha) (*siteverifyCaptcha, error) {
+	c.provider = provider
+	c.siteKey = os.Getenv("CAPTCHA_SITE_KEY")
+	c.secret = os.Getenv("CAPTCHA_SECRET_KEY")
+	c.verifyURL = envOrDefault("CAPTCHA_VERIFY_URL", c.verifyURL)
+	c.client = &http.Client{Timeout: durationFromEnv("CAPTCHA_TIMEOUT", defaultCaptchaTimeout)}
+	if c.siteKey == "" || c.secret == "" {
+		return nil, fmt.Errorf("CAPTCHA_PROVIDER=%s needs CAPTCHA_SITE_KEY and CAPTCHA_SECRET_KEY", provider)
+	}
+	return &c, nil
+}
+
+func (c *siteverifyCaptcha) name() string { return c.provider }
+
+func (c *siteverifyCaptcha) widget() captchaWidget {
+	return captchaWidget{Class: c.class, SiteKey: c.siteKey, Script: c.script}
+}
+
+func (c *siteverifyCaptcha) responseField() string { return c.field }
+
+func (c *siteverifyCaptcha) verify(ctx context.Context, token, remoteIP string) error {
+	if token == "" {
+		return errCaptchaMissing
+	}
+	form := url.Values{"secret": {c.secret}, "response": {token}}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(raw)))
+	}
+	var out struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+	if !out.Success {
+		return fmt.Errorf("%w: %s", errCaptchaRejected, strings.Join(out.ErrorCodes, ", "))
+	}
+	return nil
+}
+
+// checkCaptcha verifies the CAPTCHA answer posted with a form. It returns
+// nil when no provider is configured.
+func (s *serverState) checkCaptcha(r *http.Request) error {
+	if s.captcha == nil {
+		return nil
+	}
+	return s.captcha.verify(r.Context(), r.FormValue(s.captcha.responseField()), clientIP(r))
+}
+
+// captchaWidget returns the widget for a page to render, or nil when the
+// page does not need one.
+func (s *serverState) captchaWidget(needed bool) *captchaWidget {
+	if s.captcha == nil || !needed {
+		return nil
+	}
+	widget := s.captcha.widget()
+	return &widget
+}
+
+func (s *serverState) loginPageData(ctx context.Context, ip string, userID int64) templateData {
+	return templateData{"Captcha": s.captchaWidget(s.loginNeedsCaptcha(ctx, ip, userID)), "SSO": s.saml != nil && tenantScopeFrom(ctx).id == rootTenantID}
+}
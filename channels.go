@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxChannelTopicLength = 1024
+
+var knownRoles = []string{"owner", "admin", "member"}
+
+func splitRoles(raw string) []string {
+	var roles []string
+	for _, role := range strings.Split(raw, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// canPostInChannel reports whether email may send messages to ch. Channels
+// with post roles configured are read-only for everybody else, subject to
+// the channel's overrides; see channelPermissions. DMs follow DM_POLICY and
+// blocks; see canPostInDirect.
+func (s *serverState) canPostInChannel(ctx context.Context, email string, ch channelInfo) (bool, error) {
+	if ch.Kind == "dm" {
+		return s.canPostInDirect(ctx, email, ch.ID)
+	}
+	perms, err := s.channelPermissions(ctx, email, ch)
+	return perms&permPost != 0, err
+}
+
+func (s *serverState) handleChannelSettings(w http.ResponseWriter, r *http.Request, ch channelInfo, currentUser user) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(toChannelPayload(ch)); err != nil {
+			log.Printf("encode channel: %v", err)
+		}
+	case http.MethodPatch:
+		if ch.Kind == "dm" {
+			httpError(w, "direct messages have no settings", http.StatusBadRequest)
+			return
+		}
+		canManage, err := s.canManageChannel(r.Context(), currentUser.Email, ch)
+		if err != nil {
+			log.Printf("check channel manage permission: %v", err)
+			httpError(w, "failed to update channel", http.StatusInternalServerError)
+			return
+		}
+		if !canManage {
+			httpError(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		var body struct {
+			Name      *string   `json:"name" validate:"trim,required"`
+			ReadOnly  *bool     `json:"readOnly"`
+			PostRoles *[]string `json:"postRoles"`
+			Topic     *string   `json:"topic"`
+			// Emoji and EmojiImage, a data URL, set the emoji shown before
+			// the name; setting one clears the other, "" clears both.
+			Emoji      *string `json:"emoji" validate:"trim"`
+			EmojiImage *string `json:"emojiImage"`
+			// AnnounceTopic posts a system message in the channel when the
+			// topic changes.
+			AnnounceTopic bool `json:"announceTopic"`
+		}
+		if !s.decodeJSON(w, r, &body) {
+			return
+		}
+
+		if body.Name != nil {
+			ch.Name = *body.Name
+		}
+		if body.ReadOnly != nil {
+			if *body.ReadOnly && ch.PostRoles == "" {
+				ch.PostRoles = "owner,admin"
+			} else if !*body.ReadOnly {
+				ch.PostRoles = ""
+			}
+		}
+		if body.PostRoles != nil {
+			roles := make([]string, 0, len(*body.PostRoles))
+			for _, role := range *body.PostRoles {
+				role = strings.ToLower(strings.TrimSpace(role))
+				valid := false
+				for _, known := range knownRoles {
+					if role == known {
+						valid = true
+						break
+					}
+				}
+				if !valid {
+					httpError(w, "unknown role "+role, http.StatusBadRequest)
+					return
+				}
+				roles = append(roles, role)
+			}
+			ch.PostRoles = strings.Join(roles, ",")
+		}
+		topicChanged := false
+		if body.Topic != nil {
+			topic := strings.TrimSpace(*body.Topic)
+			if utf8.RuneCountInString(topic) > maxChannelTopicLength {
+				httpError(w, "topic must be 1024 characters or fewer", http.StatusBadRequest)
+				return
+			}
+			topicChanged = topic != ch.Topic
+			ch.Topic = topic
+		}
+
+		oldEmoji := ch.EmojiPath
+		if body.Emoji != nil {
+			if err := checkChannelEmoji(*body.Emoji); err != nil {
+				httpError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ch.Emoji, ch.EmojiPath = *body.Emoji, ""
+		}
+		if body.EmojiImage != nil {
+			ch.Emoji, ch.EmojiPath = "", ""
+			if *body.EmojiImage != "" {
+				raw, err := decodeImageDataURL(*body.EmojiImage, "emojiImage", maxChannelEmojiBytes)
+				if err != nil {
+					httpError(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				var imgErr *imageError
+				if ch.EmojiPath, err = s.storeChannelEmoji(r.Context(), ch.ID, raw); errors.As(err, &imgErr) {
+					httpError(w, "emojiImage: "+err.Error(), http.StatusBadRequest)
+					return
+				} else if err != nil {
+					log.Printf("store channel emoji: %v", err)
+					httpError(w, "failed to store emoji", http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
+		if _, err := s.db.ExecContext(r.Context(), `UPDATE channels SET name = ?, post_roles = ?, topic = ?, emoji = ?, emoji_path = ? WHERE id = ?`, ch.Name, ch.PostRoles, ch.Topic, ch.Emoji, ch.EmojiPath, ch.ID); err != nil {
+			log.Printf("update channel: %v", err)
+			httpError(w, "failed to update channel", http.StatusInternalServerError)
+			return
+		}
+		s.invalidateChannel(ch.ID)
+		if oldEmoji != "" && oldEmoji != ch.EmojiPath {
+			s.removeMediaImage(oldEmoji)
+		}
+
+		s.recordAudit(r.Context(), ch.ServerID, currentUser.Email, "channel.update", "channel", strconv.FormatInt(ch.ID, 10), "postRoles="+ch.PostRoles)
+
+		payload := toChannelPayload(ch)
+		s.broadcastChannelUpdate(payload)
+		if topicChanged {
+			s.recordAudit(r.Context(), ch.ServerID, currentUser.Email, "channel.topic", "channel", strconv.FormatInt(ch.ID, 10), ch.Topic)
+			s.broadcastChannelTopic(payload)
+			if body.AnnounceTopic {
+				s.announceTopic(r.Context(), ch, currentUser)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(payload); err != nil {
+			log.Printf("encode channel: %v", err)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// announceTopic posts a system message in ch saying who changed its topic.
+func (s *serverState) announceTopic(ctx context.Context, ch channelInfo, changedBy user) {
+	l := s.defaultLocalizer()
+	content := l.T("system.topic_changed", changedBy.DisplayName, ch.Topic)
+	if ch.Topic == "" {
+		content = l.T("system.topic_cleared", changedBy.DisplayName)
+	}
+	if _, err := s.saveMessage(ctx, ch.ID, systemUserEmail, content); err != nil {
+		log.Printf("save topic announcement: %v", err)
+	}
+}
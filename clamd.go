@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	defaultClamdAddress = "localhost:3310"
+	defaultScanTimeout  = time.Minute
+	clamdChunkSize      = 64 << 10
+)
+
+// clamdScanner sends files to a ClamAV daemon with the INSTREAM command.
+// CLAMD_ADDRESS is host:port, or a socket path such as
+// /var/run/clamav/clamd.ctl.
+type clamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+func clamdScannerFromEnv() *clamdScanner {
+	address := envOrDefault("CLAMD_ADDRESS", defaultClamdAddress)
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") || strings.HasPrefix(address, "/") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+	return &clamdScanner{network: network, address: address, timeout: durationFromEnv("SCAN_TIMEOUT", defaultScanTimeout)}
+}
+
+func (c *clamdScanner) name() string { return "clamd" }
+
+// command sends a null-terminated command, then body, and returns clamd's
+// reply.
+func (c *clamdScanner) command(ctx context.Context, cmd string, body func(io.Writer) error) (string, error) {
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(conn, "z"+cmd+"\x00"); err != nil {
+		return "", err
+	}
+	if body != nil {
+		if err := body(conn); err != nil {
+			return "", err
+		}
+	}
+	reply, err := io.ReadAll(io.LimitReader(conn, 4096))
+	if err != nil {
+		return "", err
+	}
+	if len(reply) == 0 {
+		return "", errors.New("connection closed without a reply")
+	}
+	return strings.TrimSpace(strings.TrimRight(string(reply), "\x00")), nil
+}
+
+func (c *clamdScanner) ping(ctx context.Context) error {
+	reply, err := c.command(ctx, "PING", nil)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("clamd answered %q to PING", reply)
+	}
+	return nil
+}
+
+func (c *clamdScanner) scan(ctx context.Context, data []byte) (scanVerdict, error) {
+	reply, err := c.command(ctx, "INSTREAM", func(w io.Writer) error {
+		for rest := data; len(rest) > 0; {
+			chunk := rest[:min(clamdChunkSize, len(rest))]
+			rest = rest[len(chunk):]
+			var size [4]byte
+			binary.BigEndian.PutUint32(size[:], uint32(len(chunk)))
+			if _, err := w.Write(size[:]); err != nil {
+				return err
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+		}
+		_, err := w.Write([]byte{0, 0, 0, 0})
+		return err
+	})
+	if err != nil {
+		return scanVerdict{}, err
+	}
+	// Replies look like "stream: OK", "stream: Eicar-Signature FOUND" or
+	// "INSTREAM size limit exceeded. ERROR".
+	switch result := strings.TrimPrefix(reply, "stream: "); {
+	case result == "OK":
+		return scanVerdict{clean: true}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return scanVerdict{signature: strings.TrimSuffix(result, " FOUND")}, nil
+	case strings.Contains(result, "size limit exceeded"):
+		// A file clamd will not look at is not let through.
+		return scanVerdict{signature: "too large to scan"}, nil
+	default:
+		return scanVerdict{}, fmt.Errorf("unexpected reply %q", reply)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const minPasswordLength = 8
+
+var commands = map[string]func(args []string) error{
+	"serve":            runServe,
+	"migrate":          runMigrate,
+	"backup":           runBackup,
+	"create-admin":     runCreateAdmin,
+	"reset-password":   runResetPassword,
+	"export":           runExport,
+	"doctor":           runDoctor,
+	"move-attachments": runMoveAttachments,
+	"tenant":           runTenant,
+	"help": func([]string) error {
+		printUsage()
+		return nil
+	},
+}
+
+func printUsage() {
+	fmt.Fprint(os.Stderr, `usage: echosphere [command] [flags]
+
+commands:
+  serve           run the HTTP server (default)
+  migrate         create or upgrade the database schema and exit
+  backup [dest]   write a consistent copy of the database
+  create-admin    create an instance admin, or promote an existing user
+  reset-password  set a new password and sign the user out everywhere
+  export          write a server archive (same format as the export API)
+  doctor          check configuration and database health
+  move-attachments
+                  copy attachments into the configured ATTACHMENT_STORE
+  tenant create|list
+                  add an organization or list them (see TENANT_MODE)
+
+Run "echosphere <command> -h" for a command's flags.
+`)
+}
+
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.Parse(args)
+
+	srv, err := openServerState(context.Background())
+	if err != nil {
+		return err
+	}
+	srv.close()
+	fmt.Println("database schema is up to date")
+	return nil
+}
+
+func runBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	flags.Parse(args)
+
+	ctx := context.Background()
+	srv, err := openServerState(ctx)
+	if err != nil {
+		return err
+	}
+	defer srv.close()
+
+	dest := defaultBackupPath(srv.dataDir)
+	if flags.NArg() > 0 {
+		dest = flags.Arg(0)
+	}
+	if err := backupDatabase(ctx, srv.db, dest); err != nil {
+		return err
+	}
+	fmt.Printf("database backed up to %s\n", dest)
+	return nil
+}
+
+// readPassword returns the -password flag value, falling back to the first
+// line of stdin so passwords need not appear in shell history. The password
+// has to meet the instance's policy.
+func readPassword(policy passwordPolicy, flagValue string, personal ...string) (string, error) {
+	password := flagValue
+	if password == "" {
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("read password: %w", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if err := policy.check(password, personal...); err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+func runCreateAdmin(args []string) error {
+	flags := flag.NewFlagSet("create-admin", flag.ExitOnError)
+	email := flags.String("email", "", "account email (required)")
+	name := flags.String("name", "", "display name for a new account")
+	handle := flags.String("handle", "", "username for a new account (derived from the email when omitted)")
+	password := flags.String("password", "", "password for a new account (read from stdin when omitted)")
+	tenantSlug := flags.String("tenant", "", "tenant slug, to make an admin of that tenant instead of the root one")
+	flags.Parse(args)
+
+	*email = strings.TrimSpace(strings.ToLower(*email))
+	if *email == "" || *email == systemUserEmail {
+		return errors.New("a valid -email is required")
+	}
+	*handle = normalizeHandle(*handle)
+	if *handle != "" && (!validHandle(*handle) || *handle == systemUserHandle) {
+		return errors.New(handleRules)
+	}
+
+	ctx := context.Background()
+	srv, err := openServerState(ctx)
+	if err != nil {
+		return err
+	}
+	defer srv.close()
+
+	tenantID := int64(rootTenantID)
+	if *tenantSlug != "" {
+		t, ok, err := srv.tenantBySlug(ctx, strings.ToLower(*tenantSlug))
+		if err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("no tenant %s", *tenantSlug)
+		}
+		tenantID = t.ID
+	}
+
+	existing, exists, err := srv.getUserByEmail(ctx, *email)
+	if err != nil {
+		return err
+	}
+	if exists && existing.TenantID != tenantID {
+		return fmt.Errorf("%s belongs to another tenant", *email)
+	}
+	if !exists || len(existing.PasswordHash) == 0 {
+		pw, err := readPassword(srv.passwords, *password, *email, *handle)
+		if err != nil {
+			return err
+		}
+		hash, err := srv.passwords.hash(pw)
+		if err != nil {
+			return err
+		}
+		displayName := strings.TrimSpace(*name)
+		if displayName == "" {
+			displayName = strings.Split(*email, "@")[0]
+		}
+		if *handle != "" {
+			if taken, err := handleTaken(ctx, srv.readDB, tenantID, *handle); err != nil {
+				return err
+			} else if taken {
+				return fmt.Errorf("username %s is taken", *handle)
+			}
+		}
+		u := user{Email: *email, Handle: *handle, DisplayName: displayName, PasswordHash: hash, CreatedAt: time.Now().UTC(), TenantID: tenantID}
+		err = srv.withTx(ctx, func(tx *sql.Tx) error {
+			var err error
+			if exists {
+				_, err = srv.claimUser(ctx, tx, u)
+			} else {
+				_, _, err = srv.insertUser(ctx, tx, u)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := srv.setInstanceAdmin(ctx, *email, true); err != nil {
+		return err
+	}
+	srv.recordAudit(ctx, 0, *email, "instance.admin_granted", "user", *email, "cli")
+	fmt.Printf("%s is now an instance admin\n", *email)
+	return nil
+}
+
+func runResetPassword(args []string) error {
+	flags := flag.NewFlagSet("reset-password", flag.ExitOnError)
+	email := flags.String("email", "", "account email (required)")
+	password := flags.String("password", "", "new password (read from stdin when omitted)")
+	flags.Parse(args)
+
+	*email = strings.TrimSpace(strings.ToLower(*email))
+	if *email == "" || *email == systemUserEmail {
+		return errors.New("a valid -email is required")
+	}
+
+	ctx := context.Background()
+	srv, err := openServerState(ctx)
+	if err != nil {
+		return err
+	}
+	defer srv.close()
+
+	u, exists, err := srv.getUserByEmail(ctx, *email)
+	if err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("no account for %s", *email)
+	}
+
+	pw, err := readPassword(srv.passwords, *password, u.Email, u.Handle)
+	if err != nil {
+		return err
+	}
+	hash, err := srv.passwords.hash(pw)
+	if err != nil {
+		return err
+	}
+	if err := srv.resetPassword(ctx, *email, hash); err != nil {
+		return err
+	}
+	srv.recordAudit(ctx, 0, *email, "user.password_reset", "user", *email, "cli")
+	fmt.Printf("password updated for %s; existing sessions were signed out\n", *email)
+	return nil
+}
+
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	server := flags.String("server", "", "server id or slug (required)")
+	out := flags.String("out", "", "output file (default <slug>-<timestamp>.zip or .json)")
+	format := flags.String("format", "zip", "archive format: zip or json")
+	flags.Parse(args)
+
+	if *server == "" {
+		return errors.New("-server is required")
+	}
+	if *format != "zip" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	ctx := context.Background()
+	srv, err := openServerState(ctx)
+	if err != nil {
+		return err
+	}
+	defer srv.close()
+
+	var info serverInfo
+	var exists bool
+	if id, convErr := strconv.ParseInt(*server, 10, 64); convErr == nil {
+		info, exists, err = srv.serverByID(ctx, id)
+	} else {
+		info, exists, err = srv.serverBySlug(ctx, *server)
+	}
+	if err != nil {
+		return err
+	}
+	if !exists || info.ID == srv.directServerID {
+		return fmt.Errorf("server %q not found", *server)
+	}
+
+	archive, err := srv.buildServerExport(ctx, info)
+	if err != nil {
+		return err
+	}
+	dest := *out
+	if dest == "" {
+		dest = fmt.Sprintf("%s-%s.%s", info.Slug, archive.ExportedAt.Format("20060102-150405"), *format)
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := writeServerExport(f, archive, *format); err != nil {
+		f.Close()
+		os.Remove(dest)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	srv.recordAudit(ctx, info.ID, systemUserEmail, "server.export", "server", strconv.FormatInt(info.ID, 10), "cli")
+	fmt.Printf("exported %s to %s\n", info.Slug, dest)
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// conversationHint tells clients where a channel or DM belongs in the
+// user's conversation list. Bootstrap returns them already in order.
+type conversationHint struct {
+	ChannelID      int64     `json:"channelId"`
+	Kind           string    `json:"kind"`
+	LastActivityAt time.Time `json:"lastActivityAt"`
+	Pinned         bool      `json:"pinned,omitempty"`
+}
+
+// conversationOrder lists every channel and DM the user can read: pinned
+// ones first in the order they were pinned, then the rest by their latest
+// message (or creation, for conversations with none), newest first.
+func (s *serverState) conversationOrder(ctx context.Context, u user) ([]conversationHint, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT c.id, c.kind, c.created_at, m.created_at, pin.position
+        FROM channels c
+        LEFT JOIN channel_messages m ON m.id = (
+            SELECT MAX(id) FROM channel_messages
+            WHERE channel_id = c.id AND (expires_at IS NULL OR expires_at > ?)
+        )
+        LEFT JOIN conversation_pins pin ON pin.channel_id = c.id AND pin.user_id = ?
+        WHERE (c.kind = 'dm' AND EXISTS (SELECT 1 FROM dm_participants p WHERE p.channel_id = c.id AND p.user_email = ?))
+           OR (c.kind != 'dm' AND c.server_id IN (SELECT server_id FROM server_members WHERE user_id = ?)
+               AND `+channelVisibleTo("?")+`)
+    `, time.Now().UTC(), u.ID, u.Email, u.ID, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hints := []conversationHint{}
+	positions := make(map[int64]int64)
+	for rows.Next() {
+		var hint conversationHint
+		var lastMessage sql.NullTime
+		var position sql.NullInt64
+		if err := rows.Scan(&hint.ChannelID, &hint.Kind, &hint.LastActivityAt, &lastMessage, &position); err != nil {
+			return nil, err
+		}
+		if lastMessage.Valid {
+			hint.LastActivityAt = lastMessage.Time
+		}
+		if position.Valid {
+			hint.Pinned = true
+			positions[hint.ChannelID] = position.Int64
+		}
+		hints = append(hints, hint)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(hints, func(i, j int) bool {
+		a, b := hints[i], hints[j]
+		switch {
+		case a.Pinned != b.Pinned:
+			return a.Pinned
+		case a.Pinned:
+			return positions[a.ChannelID] < positions[b.ChannelID]
+		case !a.LastActivityAt.Equal(b.LastActivityAt):
+			return a.LastActivityAt.After(b.LastActivityAt)
+		default:
+			return a.ChannelID > b.ChannelID
+		}
+	})
+	return hints, nil
+}
+
+func (s *serverState) pinnedConversations(ctx context.Context, userID int64) ([]int64, error) {
+	rows, err := s.readDB.QueryContext(ctx, `SELECT channel_id FROM conversation_pins WHERE user_id = ? ORDER BY position`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// setPinnedConversations replaces the user's pins with ids, in that order,
+// as part of tx.
+func setPinnedConversations(ctx context.Context, tx *sql.Tx, userID int64, ids []int64) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM conversation_pins WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for i, id := range ids {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO conversation_pins (user_id, channel_id, position, pinned_at) VALUES (?, ?, ?, ?)`, userID, id, i, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPinnedConversations drops repeated IDs from ids and reports those
+// that are not a conversation the user can read.
+func (s *serverState) checkPinnedConversations(ctx context.Context, u user, ids []int64) ([]int64, []fieldError, error) {
+	seen := make(map[int64]bool, len(ids))
+	unique := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	allowed, err := s.accessibleChannelIDs(ctx, u.Email, unique)
+	if err != nil {
+		return nil, nil, err
+	}
+	var errs []fieldError
+	for i, id := range ids {
+		if !allowed[id] {
+			errs = append(errs, fieldError{Field: "pinnedConversations[" + strconv.Itoa(i) + "]", Message: "is not a conversation you can read"})
+		}
+	}
+	return unique, errs, nil
+}
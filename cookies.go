@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultSessionKeyFile = "session.key"
+	sessionKeyBytes       = 32
+)
+
+// sessionKeys signs session cookies so a token is only accepted together
+// with an HMAC made with the server's key. The first key signs; the others
+// still verify, so keys can be rotated without signing everyone out.
+type sessionKeys struct {
+	current string
+	keys    map[string][]byte
+}
+
+// sessionKeysFromEnv reads SESSION_KEYS, a comma-separated list of id:secret
+// pairs with base64 secrets, newest first. Without it a key is generated
+// once and kept in SESSION_KEY_FILE (default data/session.key), outside the
+// database.
+func sessionKeysFromEnv(dataDir string) (*sessionKeys, error) {
+	raw := strings.TrimSpace(os.Getenv("SESSION_KEYS"))
+	if raw == "" {
+		path := envOrDefault("SESSION_KEY_FILE", filepath.Join(dataDir, defaultSessionKeyFile))
+		content, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			secret := make([]byte, sessionKeyBytes)
+			if _, err := rand.Read(secret); err != nil {
+				return nil, err
+			}
+			content = []byte("local:" + base64.StdEncoding.EncodeToString(secret) + "\n")
+			if err := os.WriteFile(path, content, 0o600); err != nil {
+				return nil, fmt.Errorf("write session key: %w", err)
+			}
+		} else if err != nil {
+			return nil, fmt.Errorf("read session key: %w", err)
+		}
+		raw = strings.TrimSpace(string(content))
+	}
+	return parseSessionKeys(raw)
+}
+
+func parseSessionKeys(raw string) (*sessionKeys, error) {
+	k := &sessionKeys{keys: make(map[string][]byte)}
+	for _, entry := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == '\n' }) {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || id == "" || strings.Contains(id, ".") {
+			return nil, fmt.Errorf("session key %q is not id:base64-secret", id)
+		}
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(secret) < 16 {
+			return nil, fmt.Errorf("session key %s needs a base64 secret of at least 16 bytes", id)
+		}
+		if _, dup := k.keys[id]; dup {
+			return nil, fmt.Errorf("session key %s is listed twice", id)
+		}
+		k.keys[id] = secret
+		if k.current == "" {
+			k.current = id
+		}
+	}
+	if k.current == "" {
+		return nil, errors.New("no session keys configured")
+	}
+	return k, nil
+}
+
+func (k *sessionKeys) mac(id, token string) string {
+	h := hmac.New(sha256.New, k.keys[id])
+	h.Write([]byte(id + "." + token))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// sign returns the cookie value for token: token.keyID.mac.
+func (k *sessionKeys) sign(token string) string {
+	return token + "." + k.current + "." + k.mac(k.current, token)
+}
+
+// verify returns the token a signed cookie value carries. stale is set when
+// it was signed with a key other than the current one.
+func (k *sessionKeys) verify(value string) (token string, stale, ok bool) {
+	token, rest, found := strings.Cut(value, ".")
+	if !found {
+		return "", false, false
+	}
+	id, mac, found := strings.Cut(rest, ".")
+	if !found {
+		return "", false, false
+	}
+	if _, known := k.keys[id]; !known || !hmac.Equal([]byte(mac), []byte(k.mac(id, token))) {
+		return "", false, false
+	}
+	return token, id != k.current, true
+}
+
+// cookieSettings are the attributes of the session cookie, from
+// SESSION_COOKIE_NAME, _DOMAIN, _PATH, _SAMESITE and _SECURE.
+type cookieSettings struct {
+	name     string
+	domain   string
+	path     string
+	sameSite http.SameSite
+	// secure is "auto" (when the request came over HTTPS), "true" or
+	// "false".
+	secure string
+}
+
+func cookieSettingsFromEnv() (cookieSettings, error) {
+	c := cookieSettings{
+		name:   envOrDefault("SESSION_COOKIE_NAME", "echosphere_session"),
+		domain: os.Getenv("SESSION_COOKIE_DOMAIN"),
+		path:   envOrDefault("SESSION_COOKIE_PATH", "/"),
+		secure: strings.ToLower(envOrDefault("SESSION_COOKIE_SECURE", "auto")),
+	}
+	switch sameSite := strings.ToLower(envOrDefault("SESSION_COOKIE_SAMESITE", "lax")); sameSite {
+	case "lax":
+		c.sameSite = http.SameSiteLaxMode
+	case "strict":
+		c.sameSite = http.SameSiteStrictMode
+	case "none":
+		// Browsers drop SameSite=None cookies that are not Secure.
+		c.sameSite = http.SameSiteNoneMode
+		c.secure = "true"
+	default:
+		return cookieSettings{}, fmt.Errorf("SESSION_COOKIE_SAMESITE=%q is not one of lax, strict, none", sameSite)
+	}
+	if c.secure != "auto" && c.secure != "true" && c.secure != "false" {
+		return cookieSettings{}, fmt.Errorf("SESSION_COOKIE_SECURE=%q is not one of auto, true, false", c.secure)
+	}
+	if !strings.HasPrefix(c.path, "/") {
+		return cookieSettings{}, fmt.Errorf("SESSION_COOKIE_PATH=%q must start with /", c.path)
+	}
+	return c, nil
+}
+
+// sessionCookie returns the session cookie carrying value; an empty value
+// with MaxAge -1 clears it.
+func (s *serverState) sessionCookie(r *http.Request, value string) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     s.cookies.name,
+		Value:    value,
+		Domain:   s.cookies.domain,
+		Path:     s.cookies.path,
+		HttpOnly: true,
+		Secure:   s.cookies.secure == "true" || (s.cookies.secure == "auto" && requestIsHTTPS(r)),
+		SameSite: s.cookies.sameSite,
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
+
+func (s *serverState) clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, s.sessionCookie(r, ""))
+}
+
+// sessionCookieToken returns the session token in the request's cookie.
+// unsigned is set for a cookie issued before cookies were signed, which
+// only sessions from back then accept; resign is set when the cookie should
+// be issued again with the current key.
+func (s *serverState) sessionCookieToken(r *http.Request) (token string, unsigned, resign, ok bool) {
+	cookie, err := r.Cookie(s.cookies.name)
+	if err != nil || cookie.Value == "" {
+		return "", false, false, false
+	}
+	if !strings.Contains(cookie.Value, ".") {
+		return cookie.Value, true, true, true
+	}
+	token, stale, ok := s.sessionKeys.verify(cookie.Value)
+	return token, false, stale, ok
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	writePragmas = "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)"
+	readPragmas  = "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=query_only(1)"
+
+	messageWriteBatch = 64
+)
+
+// openDatabase opens two pools on the same SQLite file. SQLite allows a
+// single writer at a time, so the write pool holds one connection; in WAL
+// mode readers never wait on it and get a pool of their own.
+func openDatabase(ctx context.Context, path string) (write, read *sql.DB, err error) {
+	write, err = sql.Open("sqlite", path+writePragmas)
+	if err != nil {
+		return nil, nil, err
+	}
+	write.SetMaxOpenConns(1)
+	if err := write.PingContext(ctx); err != nil {
+		write.Close()
+		return nil, nil, err
+	}
+
+	read, err = sql.Open("sqlite", path+readPragmas)
+	if err != nil {
+		write.Close()
+		return nil, nil, err
+	}
+	conns := runtime.NumCPU()
+	if conns < 4 {
+		conns = 4
+	}
+	read.SetMaxOpenConns(conns)
+	read.SetMaxIdleConns(conns)
+	if err := read.PingContext(ctx); err != nil {
+		write.Close()
+		read.Close()
+		return nil, nil, err
+	}
+	return write, read, nil
+}
+
+// withTx runs fn in a write transaction, committing if it returns nil and
+// rolling back otherwise. fn must do all its writes through tx: the write
+// pool has a single connection, so s.db would wait on the transaction
+// forever.
+func (s *serverState) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// stmtCache lazily prepares and keeps statements for the hottest lookups.
+type stmtCache struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStmtCache(db *sql.DB) *stmtCache {
+	return &stmtCache{db: db, stmts: make(map[string]*sql.Stmt)}
+}
+
+func (c *stmtCache) stmt(ctx context.Context, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if st, ok := c.stmts[query]; ok {
+		return st, nil
+	}
+	st, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = st
+	return st, nil
+}
+
+func (c *stmtCache) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	st, err := c.stmt(ctx, query)
+	if err != nil {
+		// Fall back to an unprepared query; sql.Row carries any error to Scan.
+		return c.db.QueryRowContext(ctx, query, args...)
+	}
+	return st.QueryRowContext(ctx, args...)
+}
+
+func (c *stmtCache) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for query, st := range c.stmts {
+		st.Close()
+		delete(c.stmts, query)
+	}
+}
+
+type messageInsert struct {
+	channelID int64
+	author    string
+	content   string
+	nonce     string
+	createdAt time.Time
+	expiresAt sql.NullTime
+	stickerID int64
+	// attachment is stored alongside the message, in the same transaction.
+	attachment *newAttachment
+	// clearDraft deletes the author's saved draft for the channel once the
+	// message is stored.
+	clearDraft bool
+	result     chan messageInsertResult
+}
+
+type messageInsertResult struct {
+	id  int64
+	err error
+}
+
+// messageWriter funnels message inserts through one goroutine that commits
+// whatever has queued up in a single transaction, so a burst of chat traffic
+// costs one fsync instead of one per message.
+type messageWriter struct {
+	db    *sql.DB
+	queue chan messageInsert
+	// committed is called after a batch with stored messages commits.
+	committed func()
+}
+
+func newMessageWriter(db *sql.DB) *messageWriter {
+	return &messageWriter{db: db, queue: make(chan messageInsert, 256)}
+}
+
+// insert queues a message for the next batch and waits for its id.
+func (mw *messageWriter) insert(ctx context.Context, req messageInsert) (int64, error) {
+	req.result = make(chan messageInsertResult, 1)
+	select {
+	case mw.queue <- req:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	select {
+	case res := <-req.result:
+		return res.id, res.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (mw *messageWriter) run(ctx context.Context) {
+	batch := make([]messageInsert, 0, messageWriteBatch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-mw.queue:
+			batch = append(batch[:0], req)
+		}
+	drain:
+		for len(batch) < messageWriteBatch {
+			select {
+			case req := <-mw.queue:
+				batch = append(batch, req)
+			default:
+				break drain
+			}
+		}
+		mw.commit(ctx, batch)
+	}
+}
+
+func (mw *messageWriter) commit(ctx context.Context, batch []messageInsert) {
+	fail := func(err error) {
+		for _, req := range batch {
+			req.result <- messageInsertResult{err: err}
+		}
+	}
+
+	tx, err := mw.db.BeginTx(ctx, nil)
+	if err != nil {
+		fail(err)
+		return
+	}
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO channel_messages (channel_id, author_id, content, created_at, client_nonce, expires_at, sticker_id) VALUES (?, `+userIDForEmail+`, ?, ?, NULLIF(?, ''), ?, NULLIF(?, 0))`)
+	if err != nil {
+		_ = tx.Rollback()
+		fail(err)
+		return
+	}
+	defer stmt.Close()
+
+	results := make([]messageInsertResult, len(batch))
+	stored := false
+	for i, req := range batch {
+		results[i].id, results[i].err = insertQueuedMessage(ctx, tx, stmt, req)
+		stored = stored || results[i].err == nil
+	}
+	if err := tx.Commit(); err != nil {
+		fail(err)
+		return
+	}
+	if stored && mw.committed != nil {
+		mw.committed()
+	}
+	for i, req := range batch {
+		req.result <- results[i]
+	}
+}
+
+// insertQueuedMessage stores one message of a batch along with its outbox
+// event. A bad row (e.g. a channel deleted meanwhile) only fails itself;
+// its savepoint is rolled back and the rest of the transaction is intact.
+func insertQueuedMessage(ctx context.Context, tx *sql.Tx, stmt *sql.Stmt, req messageInsert) (int64, error) {
+	if _, err := tx.ExecContext(ctx, `SAVEPOINT message_insert`); err != nil {
+		return 0, err
+	}
+	id, err := func() (int64, error) {
+		var id int64
+		var err error
+		if req.attachment != nil {
+			id, err = insertMessageWithAttachment(ctx, tx, stmt, req)
+		} else {
+			var res sql.Result
+			res, err = stmt.ExecContext(ctx, req.channelID, req.author, req.content, req.createdAt, req.nonce, req.expiresAt, req.stickerID)
+			if err == nil {
+				id, err = res.LastInsertId()
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+		return id, queueMessageEvent(ctx, tx, req.channelID, id, req.createdAt)
+	}()
+	if err != nil {
+		if _, rbErr := tx.ExecContext(ctx, `ROLLBACK TO message_insert`); rbErr != nil {
+			log.Printf("roll back message insert: %v", rbErr)
+		}
+	}
+	if _, relErr := tx.ExecContext(ctx, `RELEASE message_insert`); relErr != nil && err == nil {
+		err = relErr
+	}
+	if err == nil && req.clearDraft {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM message_drafts WHERE user_id = `+userIDForEmail+` AND channel_id = ?`, req.author, req.channelID); err != nil {
+			log.Printf("clear draft: %v", err)
+		}
+	}
+	return id, err
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A device is one browser or app install. Its ID lives in a long-lived
+// cookie, so signing out and back in on the same device keeps the ID, and
+// every session and WebSocket connection carries the ID of the device that
+// opened it. Events meant for one device, such as E2EE key requests between
+// a user's own devices, are routed by it.
+const (
+	deviceCookieName   = "echosphere_device"
+	deviceCookieMaxAge = 400 * 24 * time.Hour
+	deviceIDBytes      = 12
+	maxUserAgentLength = 256
+)
+
+func generateDeviceID() string {
+	buf := make([]byte, deviceIDBytes)
+	if _, err := rand.Read(buf); err != nil {
+		panic("failed to generate device id")
+	}
+	return hex.EncodeToString(buf)
+}
+
+func validDeviceID(id string) bool {
+	if len(id) != 2*deviceIDBytes {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil && strings.ToLower(id) == id
+}
+
+// deviceIDFor returns the requesting device's ID, issuing a new one when the
+// device cookie is missing or malformed. The cookie is refreshed either way.
+func (s *serverState) deviceIDFor(w http.ResponseWriter, r *http.Request) string {
+	id := ""
+	if cookie, err := r.Cookie(deviceCookieName); err == nil && validDeviceID(cookie.Value) {
+		id = cookie.Value
+	} else {
+		id = generateDeviceID()
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     deviceCookieName,
+		Value:    id,
+		Path:     "/",
+		Expires:  time.Now().Add(deviceCookieMaxAge),
+		HttpOnly: true,
+		Secure:   requestIsHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
+
+func truncateUserAgent(ua string) string {
+	if len(ua) <= maxUserAgentLength {
+		return ua
+	}
+	return strings.ToValidUTF8(ua[:maxUserAgentLength], "")
+}
+
+// deviceDTO is one device the user is signed in on.
+type deviceDTO struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	UserAgent   string     `json:"userAgent"`
+	ClientIP    string     `json:"clientIp"`
+	SignedInAt  time.Time  `json:"signedInAt"`
+	LastSeenAt  *time.Time `json:"lastSeenAt"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+	Current     bool       `json:"current"`
+	Connections int        `json:"connections"`
+	// API is set for a session an API client started with
+	// POST /api/auth/token.
+	API bool `json:"api"`
+	// Scopes are those of an API session limited to some; see scopes.go.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// userDevices lists the user's signed-in devices, most recently seen first.
+// Connections counts the device's open WebSockets on this instance.
+func (s *serverState) userDevices(ctx context.Context, email string, userID int64, currentDevice string) ([]deviceDTO, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT device_id, device_name, user_agent, client_ip, created_at, last_seen_at, expires_at, kind = 'api', scopes
+        FROM sessions
+        WHERE user_id = ? AND expires_at > ?
+    `, userID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	connections := s.ws.deviceConnections(email)
+	devices := []deviceDTO{}
+	for rows.Next() {
+		var d deviceDTO
+		var lastSeen sql.NullTime
+		var scopes string
+		if err := rows.Scan(&d.ID, &d.Name, &d.UserAgent, &d.ClientIP, &d.SignedInAt, &lastSeen, &d.ExpiresAt, &d.API, &scopes); err != nil {
+			return nil, err
+		}
+		d.Scopes = parseScopes(scopes).list()
+		if lastSeen.Valid {
+			d.LastSeenAt = &lastSeen.Time
+		}
+		d.Current = d.ID == currentDevice
+		d.Connections = connections[d.ID]
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	seen := func(d deviceDTO) time.Time {
+		if d.LastSeenAt != nil {
+			return *d.LastSeenAt
+		}
+		return d.SignedInAt
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		a, b := devices[i], devices[j]
+		if a.Current != b.Current {
+			return a.Current
+		}
+		return seen(a).After(seen(b))
+	})
+	return devices, nil
+}
+
+// revokeDevices deletes the user's sessions on the given device, or on every
+// device except keepDevice when deviceID is empty, and returns the token
+// hashes of the sessions removed.
+func (s *serverState) revokeDevices(ctx context.Context, userID int64, deviceID, keepDevice string) ([]string, error) {
+	query := `DELETE FROM sessions WHERE user_id = ? AND device_id = ? RETURNING token_hash`
+	arg := deviceID
+	if deviceID == "" {
+		query = `DELETE FROM sessions WHERE user_id = ? AND device_id != ? RETURNING token_hash`
+		arg = keepDevice
+	}
+	rows, err := s.db.QueryContext(ctx, query, userID, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+// handleAccountDevices serves /api/account/devices. GET lists the caller's
+// devices and DELETE signs out every device but the current one;
+// /api/account/devices/{id} accepts PATCH to rename a device and DELETE to
+// sign it out. Signed-out devices have their WebSockets closed with
+// wsCloseSignedOut, and the user's remaining connections get
+// device:revoked.
+func (s *serverState) handleAccountDevices(w http.ResponseWriter, r *http.Request) {
+	sess, _, ok := s.sessionFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+
+	deviceID := strings.Trim(r.URL.Path, "/")
+	if deviceID == "" {
+		switch r.Method {
+		case http.MethodGet:
+			s.writeDevices(w, r, currentUser, sess.DeviceID)
+		case http.MethodDelete:
+			hashes, err := s.revokeDevices(ctx, currentUser.ID, "", sess.DeviceID)
+			if err != nil {
+				log.Printf("revoke devices of user %d: %v", currentUser.ID, err)
+				httpError(w, "failed to sign out devices", http.StatusInternalServerError)
+				return
+			}
+			s.afterDevicesRevoked(ctx, currentUser, "", hashes)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	if !validDeviceID(deviceID) {
+		httpError(w, "device not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		defer r.Body.Close()
+		var body struct {
+			Name *string `json:"name" validate:"trim,max=64"`
+		}
+		if !s.decodeJSON(w, r, &body) {
+			return
+		}
+		if body.Name != nil {
+			res, err := s.db.ExecContext(ctx, `UPDATE sessions SET device_name = ? WHERE user_id = ? AND device_id = ?`, *body.Name, currentUser.ID, deviceID)
+			if err != nil {
+				log.Printf("rename device: %v", err)
+				httpError(w, "failed to rename device", http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				httpError(w, "device not found", http.StatusNotFound)
+				return
+			}
+			s.ws.sendToUser(currentUser.Email, wsOutbound{Type: "device:update", DeviceID: deviceID})
+		}
+		s.writeDevices(w, r, currentUser, sess.DeviceID)
+	case http.MethodDelete:
+		hashes, err := s.revokeDevices(ctx, currentUser.ID, deviceID, "")
+		if err != nil {
+			log.Printf("revoke device of user %d: %v", currentUser.ID, err)
+			httpError(w, "failed to sign out device", http.StatusInternalServerError)
+			return
+		}
+		if len(hashes) == 0 {
+			httpError(w, "device not found", http.StatusNotFound)
+			return
+		}
+		s.afterDevicesRevoked(ctx, currentUser, deviceID, hashes)
+		if deviceID == sess.DeviceID {
+			s.clearSessionCookie(w, r)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "PATCH, DELETE")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *serverState) writeDevices(w http.ResponseWriter, r *http.Request, u user, currentDevice string) {
+	devices, err := s.userDevices(r.Context(), u.Email, u.ID, currentDevice)
+	if err != nil {
+		log.Printf("list devices of user %d: %v", u.ID, err)
+		httpError(w, "failed to load devices", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(devices); err != nil {
+		log.Printf("encode devices: %v", err)
+	}
+}
+
+// afterDevicesRevoked disconnects the revoked sessions and tells the user's
+// other connections. deviceID is empty when every other device was revoked.
+func (s *serverState) afterDevicesRevoked(ctx context.Context, u user, deviceID string, hashes []string) {
+	for _, hash := range hashes {
+		s.ws.disconnectSession(hash, wsCloseSignedOut, "session revoked")
+	}
+	if len(hashes) == 0 {
+		return
+	}
+	s.ws.sendToUser(u.Email, wsOutbound{Type: "device:revoked", DeviceID: deviceID})
+	details := deviceID
+	if details == "" {
+		details = "all other devices"
+	}
+	s.recordAudit(ctx, 0, u.Email, "user.device_revoked", "user", strconv.FormatInt(u.ID, 10), details)
+}
+
+// touchDevice records that the session's device was just seen.
+func (s *serverState) touchDevice(ctx context.Context, tokenHash string) {
+	if _, err := s.db.ExecContext(ctx, `UPDATE sessions SET last_seen_at = ? WHERE token_hash = ?`, time.Now().UTC(), tokenHash); err != nil {
+		log.Printf("touch device: %v", err)
+	}
+}
+
+// deviceConnections counts email's open connections by device.
+func (h *wsHub) deviceConnections(email string) map[string]int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	counts := make(map[string]int)
+	for client := range h.userClients[email] {
+		counts[client.deviceID]++
+	}
+	return counts
+}
+
+// sendToUserWhere sends outbound to email's connections for which filter
+// returns true and reports how many there were.
+func (h *wsHub) sendToUserWhere(email string, filter func(*wsClient) bool, outbound wsOutbound) int {
+	frame, err := outboundFrame(outbound)
+	if err != nil {
+		log.Printf("marshal user event: %v", err)
+		return 0
+	}
+
+	h.mu.RLock()
+	clients := make([]*wsClient, 0, len(h.userClients[email]))
+	for client := range h.userClients[email] {
+		if filter(client) {
+			clients = append(clients, client)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, client := range clients {
+		client.enqueue(frame)
+	}
+	return len(clients)
+}
+
+// sendToDevice sends outbound to every connection of one of email's devices.
+func (h *wsHub) sendToDevice(email, deviceID string, outbound wsOutbound) int {
+	return h.sendToUserWhere(email, func(c *wsClient) bool { return c.deviceID == deviceID }, outbound)
+}
+
+// handleDeviceSignal relays an opaque payload, such as an E2EE key request
+// or reply, to another of the user's own devices, or to all of them when no
+// target is given. Recipients see it as device:signal with the sender's
+// deviceId.
+func (c *wsClient) handleDeviceSignal(target string, payload json.RawMessage) {
+	if len(payload) == 0 {
+		c.sendError("device_invalid", "signal requires payload")
+		return
+	}
+	if target == c.deviceID {
+		c.sendError("device_invalid", "cannot signal your own device")
+		return
+	}
+	outbound := wsOutbound{Type: "device:signal", DeviceID: c.deviceID, Payload: payload}
+	var delivered int
+	if target == "" {
+		delivered = c.hub.sendToUserWhere(c.email, func(other *wsClient) bool { return other.deviceID != c.deviceID }, outbound)
+	} else {
+		delivered = c.hub.sendToDevice(c.email, target, outbound)
+	}
+	if delivered == 0 {
+		c.sendError("device_offline", "no matching device is connected")
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	directServerSlug = "@direct"
+	systemUserEmail  = "system@echosphere.local"
+	systemUserName   = "EchoSphere"
+)
+
+func (s *serverState) ensureDirectWorkspace(ctx context.Context) error {
+	row := s.db.QueryRowContext(ctx, `SELECT id FROM servers WHERE slug = ?`, directServerSlug)
+	if err := row.Scan(&s.directServerID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		res, err := s.db.ExecContext(ctx, `INSERT INTO servers (slug, name, created_at) VALUES (?, ?, ?)`, directServerSlug, "Direct Messages", time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		if s.directServerID, err = res.LastInsertId(); err != nil {
+			return err
+		}
+	}
+
+	// The system user authors server-generated messages. Its empty password
+	// hash never matches, so the account cannot be signed into.
+	_, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO users (email, handle, display_name, password_hash, created_at) VALUES (?, ?, ?, ?, ?)`, systemUserEmail, systemUserHandle, systemUserName, []byte{}, time.Now().UTC())
+	return err
+}
+
+func directChannelSlug(emails []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(emails, "\x00")))
+	return "dm-" + hex.EncodeToString(sum[:8])
+}
+
+func (s *serverState) directChannel(ctx context.Context, a, b string) (channelInfo, error) {
+	emails := []string{a}
+	if b != a {
+		emails = append(emails, b)
+	}
+	sort.Strings(emails)
+	slug := directChannelSlug(emails)
+
+	ch, err := scanChannel(s.db.QueryRowContext(ctx, `SELECT `+channelColumns+` FROM channels WHERE server_id = ? AND slug = ?`, s.directServerID, slug))
+	if err == nil {
+		return ch, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return channelInfo{}, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return channelInfo{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	now := time.Now().UTC()
+	res, err := tx.ExecContext(ctx, `INSERT INTO channels (server_id, slug, name, kind, created_at) VALUES (?, ?, ?, 'dm', ?)`, s.directServerID, slug, "direct", now)
+	if err != nil {
+		return channelInfo{}, err
+	}
+	channelID, err := res.LastInsertId()
+	if err != nil {
+		return channelInfo{}, err
+	}
+	for _, email := range emails {
+		if _, err = tx.ExecContext(ctx, `INSERT INTO dm_participants (channel_id, user_email) VALUES (?, ?)`, channelID, email); err != nil {
+			return channelInfo{}, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return channelInfo{}, err
+	}
+
+	return channelInfo{ID: channelID, ServerID: s.directServerID, Slug: slug, Name: "direct", Kind: "dm", CreatedAt: now}, nil
+}
+
+func (s *serverState) isDirectParticipant(ctx context.Context, channelID int64, email string) (bool, error) {
+	row := s.stmts.QueryRowContext(ctx, `SELECT 1 FROM dm_participants WHERE channel_id = ? AND user_email = ?`, channelID, email)
+	var dummy int
+	if err := row.Scan(&dummy); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *serverState) userHasChannelAccess(ctx context.Context, email string, ch channelInfo) (bool, error) {
+	perms, err := s.channelPermissions(ctx, email, ch)
+	return perms&permView != 0, err
+}
+
+// accessibleChannelIDs applies the userHasChannelAccess rules to a batch of
+// channel IDs in a single query and returns the ones the user may read.
+func (s *serverState) accessibleChannelIDs(ctx context.Context, email string, ids []int64) (map[int64]bool, error) {
+	allowed := make(map[int64]bool, len(ids))
+	if len(ids) == 0 {
+		return allowed, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]any, 0, len(ids)+2)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	args = append(args, email, email, email)
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT c.id FROM channels c
+        WHERE c.id IN (`+placeholders+`)
+          AND (
+            (c.kind = 'dm' AND EXISTS (SELECT 1 FROM dm_participants p WHERE p.channel_id = c.id AND p.user_email = ?))
+            OR (c.kind != 'dm' AND c.server_id IN (SELECT server_id FROM server_members WHERE user_id = `+userIDForEmail+`)
+                AND `+channelVisibleTo(userIDForEmail)+`)
+          )
+    `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		allowed[id] = true
+	}
+	return allowed, rows.Err()
+}
+
+type directChannelPayload struct {
+	channelPayload
+	Participants []userDTO `json:"participants"`
+}
+
+func (s *serverState) directChannelsForUser(ctx context.Context, email string) ([]directChannelPayload, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT c.id, c.server_id, c.slug, c.name, c.kind, c.created_at, c.post_roles, c.topic, u.id, u.handle, u.display_name
+        FROM dm_participants mine
+        JOIN channels c ON c.id = mine.channel_id
+        JOIN dm_participants p ON p.channel_id = c.id
+        JOIN users u ON u.email = p.user_email
+        WHERE mine.user_email = ?
+        ORDER BY c.created_at, c.id
+    `, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []directChannelPayload
+	for rows.Next() {
+		var ch channelInfo
+		var participant userDTO
+		if err := rows.Scan(&ch.ID, &ch.ServerID, &ch.Slug, &ch.Name, &ch.Kind, &ch.CreatedAt, &ch.PostRoles, &ch.Topic, &participant.ID, &participant.Handle, &participant.DisplayName); err != nil {
+			return nil, err
+		}
+		if n := len(result); n == 0 || result[n-1].ID != ch.ID {
+			result = append(result, directChannelPayload{channelPayload: toChannelPayload(ch)})
+		}
+		last := &result[len(result)-1]
+		last.Participants = append(last.Participants, participant)
+	}
+	return result, rows.Err()
+}
+
+func (s *serverState) handleDirectChannels(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		channels, err := s.directChannelsForUser(r.Context(), currentUser.Email)
+		if err != nil {
+			log.Printf("list direct channels: %v", err)
+			httpError(w, "failed to list direct messages", http.StatusInternalServerError)
+			return
+		}
+		if channels == nil {
+			channels = []directChannelPayload{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(channels); err != nil {
+			log.Printf("encode direct channels: %v", err)
+		}
+	case http.MethodPost:
+		var body struct {
+			Handle string `json:"handle" validate:"trim"`
+			Email  string `json:"email" validate:"trim"`
+		}
+		if !s.decodeJSON(w, r, &body) {
+			return
+		}
+		if body.Handle == "" && body.Email == "" {
+			httpError(w, "handle or email is required", http.StatusBadRequest)
+			return
+		}
+		recipient, exists, err := s.lookupRecipient(r.Context(), currentUser.TenantID, body.Handle, body.Email)
+		if err != nil {
+			log.Printf("lookup dm recipient: %v", err)
+			httpError(w, "failed to open conversation", http.StatusInternalServerError)
+			return
+		} else if !exists {
+			httpError(w, "user not found", http.StatusNotFound)
+			return
+		}
+
+		refusal, err := s.dmRefusal(r.Context(), currentUser.ID, recipient.ID)
+		if err != nil {
+			log.Printf("check dm policy: %v", err)
+			httpError(w, "failed to open conversation", http.StatusInternalServerError)
+			return
+		}
+		if refusal != "" {
+			httpError(w, refusal, http.StatusForbidden)
+			return
+		}
+
+		ch, err := s.directChannel(r.Context(), currentUser.Email, recipient.Email)
+		if err != nil {
+			log.Printf("open direct channel: %v", err)
+			httpError(w, "failed to open conversation", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(toChannelPayload(ch)); err != nil {
+			log.Printf("encode direct channel: %v", err)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
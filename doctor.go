@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// doctor prints one line per check and fails if any check failed. Warnings
+// point at settings that work but are probably not what the operator meant.
+type doctor struct {
+	failed bool
+}
+
+func (d *doctor) ok(format string, args ...any) {
+	fmt.Printf("ok    "+format+"\n", args...)
+}
+
+func (d *doctor) warn(format string, args ...any) {
+	fmt.Printf("warn  "+format+"\n", args...)
+}
+
+func (d *doctor) fail(format string, args ...any) {
+	d.failed = true
+	fmt.Printf("FAIL  "+format+"\n", args...)
+}
+
+func runDoctor(args []string) error {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	flags.Parse(args)
+
+	d := &doctor{}
+	d.checkConfig()
+	d.checkAssets()
+	d.checkDatabase(context.Background(), filepath.Join("data", "echosphere.db"))
+	if d.failed {
+		return errors.New("one or more checks failed")
+	}
+	return nil
+}
+
+func (d *doctor) checkConfig() {
+	port := envOrDefault("PORT", "8080")
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		d.fail("PORT=%q is not a valid port", port)
+	} else {
+		d.ok("PORT=%d", n)
+	}
+
+	for _, key := range []string{"SESSION_TTL", "SESSION_REMEMBER_TTL", "DB_MAINTENANCE_INTERVAL", "WS_IDLE_TIMEOUT", "STATS_INTERVAL", "WS_LATENCY_INTERVAL", "WS_LAG_THRESHOLD", "WS_BATCH_INTERVAL", "WS_RECONNECT_MIN", "WS_RECONNECT_MAX", "S3_PRESIGN_TTL", "SCAN_TIMEOUT", "TRANSCRIBE_TIMEOUT", "EMAIL_NOTIFICATION_COOLDOWN", "CAPTCHA_TIMEOUT", "LOGIN_LOCKOUT_BASE", "LOGIN_LOCKOUT_MAX", "LOGIN_HISTORY_RETENTION", "JWT_ACCESS_TTL", "JWT_REFRESH_TTL", "JOB_RETENTION"} {
+		raw := os.Getenv(key)
+		if raw == "" {
+			continue
+		}
+		if dur, err := time.ParseDuration(raw); err != nil || dur <= 0 {
+			d.fail("%s=%q is not a positive duration", key, raw)
+		} else {
+			d.ok("%s=%s", key, dur)
+		}
+	}
+
+	for _, key := range []string{"WS_MAX_CONNECTIONS_PER_USER", "WS_MAX_CONNECTIONS", "ATTACHMENT_QUOTA_PER_USER", "ATTACHMENT_QUOTA_PER_SERVER", "IMAGE_WORKERS", "IMAGE_MAX_PIXELS", "VOICE_MESSAGE_MAX_BYTES", "VOICE_RECORDING_MAX_BYTES", "CAPTCHA_LOGIN_FAILURES", "LOGIN_LOCKOUT_ATTEMPTS", "LOGIN_LOCKOUT_IP_ATTEMPTS", "PASSWORD_MIN_LENGTH", "PASSWORD_MIN_CLASSES", "ARGON2_MEMORY_KIB", "ARGON2_TIME", "ARGON2_THREADS", "JOB_WORKERS"} {
+		raw := os.Getenv(key)
+		if raw == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(raw); err != nil || n < 0 {
+			d.fail("%s=%q is not a non-negative integer", key, raw)
+		} else {
+			d.ok("%s=%d", key, n)
+		}
+	}
+
+	switch mode := strings.ToLower(strings.TrimSpace(os.Getenv("REGISTRATION_MODE"))); mode {
+	case "", registrationOpen, registrationInvite, registrationApproval, registrationClosed:
+		if mode == "" {
+			mode = registrationOpen
+		}
+		d.ok("REGISTRATION_MODE=%s", mode)
+	default:
+		d.fail("REGISTRATION_MODE=%q is not one of open, invite, approval, closed", mode)
+	}
+	if raw := os.Getenv("SESSION_KEYS"); raw != "" {
+		if keys, err := parseSessionKeys(raw); err != nil {
+			d.fail("SESSION_KEYS: %v", err)
+		} else {
+			d.ok("session cookies are signed with key %s (%d keys accepted)", keys.current, len(keys.keys))
+		}
+	}
+	if _, err := cookieSettingsFromEnv(); err != nil {
+		d.fail("%v", err)
+	}
+	// A missing key file is generated on first start.
+	jwtKeyFile := envOrDefault("JWT_KEY_FILE", filepath.Join("data", defaultJWTKeyFile))
+	if content, err := os.ReadFile(jwtKeyFile); err == nil {
+		if keys, err := parseJWTKeys(content); err != nil {
+			d.fail("%s: %v", jwtKeyFile, err)
+		} else {
+			d.ok("access tokens are signed with key %s (%d keys published)", keys[0].id, len(keys))
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		d.fail("read %s: %v", jwtKeyFile, err)
+	}
+	if saml, err := samlFromEnv(); err != nil {
+		d.fail("%v", err)
+	} else if saml != nil {
+		d.ok("single sign-on through %s (%d signing certificates)", saml.idpEntityID, len(saml.idpCerts))
+		for _, cert := range saml.idpCerts {
+			if time.Now().After(cert.NotAfter) {
+				d.warn("IdP certificate %s expired on %s", cert.Subject.CommonName, cert.NotAfter.Format(time.DateOnly))
+			}
+		}
+	}
+	if tenancy, err := tenancyFromEnv(); err != nil {
+		d.fail("%v", err)
+	} else if tenancy.mode == tenantModeSubdomain {
+		d.ok("tenants are reached at <slug>.%s", tenancy.domain)
+	} else if tenancy.mode == tenantModePath {
+		d.ok("tenants are reached under %s<slug>/", tenantPathPrefix)
+	}
+	if captcha, err := captchaFromEnv(); err != nil {
+		d.fail("%v", err)
+	} else if captcha != nil {
+		d.ok("signups are protected by %s", captcha.name())
+	}
+
+	for _, key := range []string{"CORS_ALLOW_CREDENTIALS", "LONG_MESSAGE_ATTACHMENTS", "MESSAGE_ARCHIVE", "S3_PRESIGN_DOWNLOADS", "PASSWORD_BLOCK_COMMON", "SAML_JIT"} {
+		if raw := os.Getenv(key); raw != "" {
+			if _, err := strconv.ParseBool(raw); err != nil {
+				d.fail("%s=%q is not a boolean", key, raw)
+			}
+		}
+	}
+	if stores, err := blobStoresFromEnv("data"); err != nil {
+		d.fail("attachment store: %v", err)
+	} else {
+		d.ok("attachments are stored in %s", stores.writeLocation())
+	}
+	if scanner, err := uploadScannerFromEnv(); err != nil {
+		d.fail("%v", err)
+	} else if clamd, ok := scanner.(*clamdScanner); ok {
+		if err := clamd.ping(context.Background()); err != nil {
+			d.fail("clamd at %s: %v", clamd.address, err)
+		} else {
+			d.ok("uploads are scanned by clamd at %s", clamd.address)
+		}
+	}
+	if t, err := transcriberFromEnv(); err != nil {
+		d.fail("%v", err)
+	} else {
+		switch t := t.(type) {
+		case *whisperCPP:
+			d.checkWhisperCPP(t)
+		case *httpTranscriber:
+			d.ok("voice messages are transcribed by %s", t.url)
+		}
+	}
+	for _, origin := range strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		if origin == "*" {
+			d.warn("ALLOWED_ORIGINS contains *: any site may open WebSockets with a user's cookies")
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			d.fail("ALLOWED_ORIGINS entry %q is not an origin like https://chat.example.com", origin)
+		}
+	}
+
+	matrixSet := 0
+	for _, key := range []string{"MATRIX_HOMESERVER", "MATRIX_SERVER_NAME", "MATRIX_AS_TOKEN", "MATRIX_HS_TOKEN"} {
+		if os.Getenv(key) != "" {
+			matrixSet++
+		}
+	}
+	switch {
+	case matrixSet == 4:
+		if u, err := url.Parse(os.Getenv("MATRIX_HOMESERVER")); err != nil || u.Scheme == "" || u.Host == "" {
+			d.fail("MATRIX_HOMESERVER=%q is not a URL like https://matrix.example.org", os.Getenv("MATRIX_HOMESERVER"))
+		} else {
+			d.ok("matrix bridge configured for %s", os.Getenv("MATRIX_SERVER_NAME"))
+		}
+	case matrixSet > 0:
+		d.warn("matrix bridge is off: MATRIX_HOMESERVER, MATRIX_SERVER_NAME, MATRIX_AS_TOKEN and MATRIX_HS_TOKEN must all be set")
+	}
+
+	if path := os.Getenv("PROFANITY_WORDS_FILE"); path != "" {
+		if words, err := readWordList(path); err != nil {
+			d.fail("PROFANITY_WORDS_FILE: %v", err)
+		} else {
+			d.ok("PROFANITY_WORDS_FILE lists %d words", len(words))
+		}
+	}
+
+	if raw := strings.TrimSpace(os.Getenv("VOICE_ICE_SERVERS")); raw != "" {
+		if servers, err := parseICEServers(raw); err != nil {
+			d.fail("VOICE_ICE_SERVERS: %v", err)
+		} else {
+			d.ok("VOICE_ICE_SERVERS lists %d servers", len(servers))
+		}
+	}
+
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if len(parseTrustedProxies(entry)) == 0 {
+			d.fail("TRUSTED_PROXIES entry %q is not an IP or CIDR", entry)
+		}
+	}
+}
+
+func (d *doctor) checkWhisperCPP(w *whisperCPP) {
+	failed := false
+	for _, tool := range []string{w.binary, w.ffmpeg} {
+		if _, err := exec.LookPath(tool); err != nil {
+			d.fail("transcription: %v", err)
+			failed = true
+		}
+	}
+	if _, err := os.Stat(w.model); err != nil {
+		d.fail("WHISPER_MODEL: %v", err)
+		failed = true
+	}
+	if !failed {
+		d.ok("voice messages are transcribed by whisper.cpp with %s", filepath.Base(w.model))
+	}
+}
+
+func (d *doctor) checkAssets() {
+	web := webAssets()
+	if _, err := template.ParseFS(web, "templates/*.html"); err != nil {
+		d.fail("templates: %v", err)
+		return
+	}
+	d.ok("templates parse")
+}
+
+func (d *doctor) checkDatabase(ctx context.Context, dbPath string) {
+	if _, err := os.Stat(dbPath); err != nil {
+		d.fail("database %s: %v (run \"echosphere migrate\" to create it)", dbPath, err)
+		return
+	}
+	probe := filepath.Join(filepath.Dir(dbPath), ".doctor-write-test")
+	if err := os.WriteFile(probe, nil, 0o600); err != nil {
+		d.fail("data directory is not writable: %v", err)
+	} else {
+		os.Remove(probe)
+		d.ok("data directory is writable")
+	}
+
+	db, readDB, err := openDatabase(ctx, dbPath)
+	if err != nil {
+		d.fail("open database: %v", err)
+		return
+	}
+	defer db.Close()
+	defer readDB.Close()
+
+	var integrity string
+	if err := readDB.QueryRowContext(ctx, `PRAGMA integrity_check`).Scan(&integrity); err != nil || integrity != "ok" {
+		d.fail("integrity check: %s %v", integrity, err)
+	} else {
+		d.ok("integrity check passed")
+	}
+
+	var journal string
+	if err := db.QueryRowContext(ctx, `PRAGMA journal_mode`).Scan(&journal); err != nil {
+		d.fail("journal mode: %v", err)
+	} else if journal != "wal" {
+		d.warn("journal mode is %s, expected wal", journal)
+	} else {
+		d.ok("journal mode is wal")
+	}
+
+	rows, err := readDB.QueryContext(ctx, `PRAGMA foreign_key_check`)
+	if err != nil {
+		d.fail("foreign key check: %v", err)
+	} else {
+		violations := 0
+		for rows.Next() {
+			violations++
+		}
+		rows.Close()
+		if violations > 0 {
+			d.fail("%d foreign key violations", violations)
+		} else {
+			d.ok("no foreign key violations")
+		}
+	}
+
+	var users int
+	if err := readDB.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE email != ?`, systemUserEmail).Scan(&users); err != nil {
+		d.fail("schema: %v (run \"echosphere migrate\")", err)
+		return
+	}
+	d.ok("%d user accounts", users)
+
+	admins := 0
+	for email := range parseAdminEmails(os.Getenv("ADMIN_EMAILS")) {
+		var exists bool
+		if err := readDB.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)`, email).Scan(&exists); err != nil {
+			d.fail("check admin %s: %v", email, err)
+		} else if !exists {
+			d.warn("ADMIN_EMAILS lists %s, which has no account", email)
+		} else {
+			admins++
+		}
+	}
+	var promoted int
+	if err := readDB.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE is_admin = 1`).Scan(&promoted); err != nil {
+		d.fail("count admins: %v (run \"echosphere migrate\")", err)
+		return
+	}
+	if admins+promoted == 0 {
+		d.warn("no instance admins; set ADMIN_EMAILS or run \"echosphere create-admin\"")
+	} else {
+		d.ok("%d instance admins", admins+promoted)
+	}
+
+	rows, err = readDB.QueryContext(ctx, `
+        SELECT t.slug FROM tenants t
+        WHERE NOT EXISTS (SELECT 1 FROM users u WHERE u.tenant_id = t.id AND u.is_admin = 1)
+        ORDER BY t.slug
+    `)
+	if err != nil {
+		d.fail("check tenants: %v (run \"echosphere migrate\")", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			d.fail("check tenants: %v", err)
+			return
+		}
+		d.warn("tenant %s has no admin; run \"echosphere create-admin -tenant %s\"", slug, slug)
+	}
+	if err := rows.Err(); err != nil {
+		d.fail("check tenants: %v", err)
+		return
+	}
+
+	var failedJobs int
+	if err := readDB.QueryRowContext(ctx, `SELECT COUNT(*) FROM jobs WHERE status = ?`, jobFailed).Scan(&failedJobs); err != nil {
+		d.fail("count failed jobs: %v (run \"echosphere migrate\")", err)
+	} else if failedJobs > 0 {
+		d.warn("%d background jobs failed; see GET /api/admin/jobs?status=failed", failedJobs)
+	}
+}
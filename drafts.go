@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// draftDTO is a user's unsent message for one channel or DM. UpdatedAt is
+// nil when there is no draft.
+type draftDTO struct {
+	ChannelID int64      `json:"channelId"`
+	Content   string     `json:"content"`
+	UpdatedAt *time.Time `json:"updatedAt"`
+}
+
+func (s *serverState) messageDraft(ctx context.Context, userID, channelID int64) (draftDTO, error) {
+	draft := draftDTO{ChannelID: channelID}
+	var updatedAt time.Time
+	err := s.readDB.QueryRowContext(ctx, `SELECT content, updated_at FROM message_drafts WHERE user_id = ? AND channel_id = ?`, userID, channelID).Scan(&draft.Content, &updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return draft, nil
+	}
+	if err != nil {
+		return draftDTO{}, err
+	}
+	draft.UpdatedAt = &updatedAt
+	return draft, nil
+}
+
+// saveMessageDraft stores content as the user's draft for the channel, or
+// deletes the draft when content is empty. Drafts are also deleted when the
+// user sends a message to the channel (see messageInsert.clearDraft).
+func (s *serverState) saveMessageDraft(ctx context.Context, userID, channelID int64, content string) (draftDTO, error) {
+	draft := draftDTO{ChannelID: channelID, Content: content}
+	if content == "" {
+		_, err := s.db.ExecContext(ctx, `DELETE FROM message_drafts WHERE user_id = ? AND channel_id = ?`, userID, channelID)
+		return draft, err
+	}
+	now := time.Now().UTC()
+	_, err := s.db.ExecContext(ctx, `
+        INSERT INTO message_drafts (user_id, channel_id, content, updated_at) VALUES (?, ?, ?, ?)
+        ON CONFLICT (user_id, channel_id) DO UPDATE SET content = excluded.content, updated_at = excluded.updated_at
+    `, userID, channelID, content, now)
+	if err != nil {
+		return draftDTO{}, err
+	}
+	draft.UpdatedAt = &now
+	return draft, nil
+}
+
+// handleChannelDraft reads (GET) or replaces (PUT) the caller's draft for a
+// channel they can read. Putting empty content clears it.
+func (s *serverState) handleChannelDraft(w http.ResponseWriter, r *http.Request, ch channelInfo, currentUser user) {
+	var draft draftDTO
+	var err error
+	failure := "failed to load draft"
+	switch r.Method {
+	case http.MethodGet:
+		draft, err = s.messageDraft(r.Context(), currentUser.ID, ch.ID)
+	case http.MethodPut:
+		if ch.Kind == "voice" {
+			httpError(w, "voice channels have no drafts", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+		var body struct {
+			Content string `json:"content"`
+		}
+		// Drafts may grow as long as the longest message that can be sent.
+		if !decodeJSONLimit(w, r, &body, s.maxJSONBody+2*int64(s.maxTextAttachmentBytes)) {
+			return
+		}
+		failure = "failed to save draft"
+		draft, err = s.saveMessageDraft(r.Context(), currentUser.ID, ch.ID, body.Content)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		log.Printf("draft for channel %d: %v", ch.ID, err)
+		httpError(w, failure, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(draft); err != nil {
+		log.Printf("encode draft: %v", err)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const emailChangeLifetime = 24 * time.Hour
+
+// errEmailTaken is returned when the requested address belongs to another
+// account by the time the change is applied.
+var errEmailTaken = errors.New("email already registered")
+
+type emailChangeDTO struct {
+	NewEmail  string    `json:"newEmail"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// emailKeyedColumns lists the columns that still store a user's email rather
+// than their id; an email change rewrites them together with users.email.
+var emailKeyedColumns = []struct{ table, column string }{
+	{"dm_participants", "user_email"},
+	{"reminders", "user_email"},
+	{"reports", "reporter_email"},
+	{"reports", "target_email"},
+	{"reports", "resolved_by"},
+	{"audit_log", "actor_email"},
+	{"registration_invites", "created_by"},
+}
+
+func (s *serverState) emailRegistered(ctx context.Context, email string) (bool, error) {
+	var taken bool
+	err := s.readDB.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)`, email).Scan(&taken)
+	return taken, err
+}
+
+// handleAccountEmail serves /api/account/email: GET shows the pending email
+// change, POST starts one (replacing any earlier request) and DELETE cancels it.
+func (s *serverState) handleAccountEmail(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+
+	switch r.Method {
+	case http.MethodGet:
+		var change emailChangeDTO
+		err := s.readDB.QueryRowContext(ctx, `SELECT new_email, created_at, expires_at FROM email_changes WHERE user_id = ? AND expires_at > ?`,
+			currentUser.ID, time.Now().UTC()).Scan(&change.NewEmail, &change.CreatedAt, &change.ExpiresAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			httpError(w, "no pending email change", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("load email change: %v", err)
+			httpError(w, "failed to load email change", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(change); err != nil {
+			log.Printf("encode email change: %v", err)
+		}
+	case http.MethodPost:
+		var body struct {
+			NewEmail string `json:"newEmail" validate:"trim,lower,required"`
+			Password string `json:"password" validate:"required"`
+		}
+		if !s.decodeJSON(w, r, &body) {
+			return
+		}
+		newEmail := body.NewEmail
+		if newEmail == systemUserEmail || !strings.Contains(newEmail, "@") || strings.ContainsAny(newEmail, " \r\n") {
+			httpError(w, "enter a valid email address", http.StatusBadRequest)
+			return
+		}
+		if newEmail == currentUser.Email {
+			httpError(w, "that is already your email address", http.StatusBadRequest)
+			return
+		}
+		if ok, _ := s.passwords.verify(currentUser.PasswordHash, body.Password); !ok {
+			httpError(w, "incorrect password", http.StatusForbidden)
+			return
+		}
+		taken, err := s.emailRegistered(ctx, newEmail)
+		if err != nil {
+			log.Printf("check email %s: %v", newEmail, err)
+			httpError(w, "failed to start email change", http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			httpError(w, "email already registered", http.StatusConflict)
+			return
+		}
+
+		newToken, oldToken := generateSessionID(), generateSessionID()
+		change := emailChangeDTO{NewEmail: newEmail, CreatedAt: time.Now().UTC()}
+		change.ExpiresAt = change.CreatedAt.Add(emailChangeLifetime)
+		if _, err := s.db.ExecContext(ctx, `
+            INSERT INTO email_changes (user_id, new_email, new_token_hash, old_token_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)
+            ON CONFLICT(user_id) DO UPDATE SET new_email = excluded.new_email, new_token_hash = excluded.new_token_hash,
+                old_token_hash = excluded.old_token_hash, created_at = excluded.created_at, expires_at = excluded.expires_at,
+                new_confirmed_at = NULL, old_confirmed_at = NULL
+        `, currentUser.ID, newEmail, hashSessionToken(newToken), hashSessionToken(oldToken), change.CreatedAt, change.ExpiresAt); err != nil {
+			log.Printf("store email change: %v", err)
+			httpError(w, "failed to start email change", http.StatusInternalServerError)
+			return
+		}
+
+		instance := s.currentInstanceName(ctx, currentUser.TenantID)
+		link := func(token string) string {
+			return absoluteURL(r, "/account/email/confirm?token="+url.QueryEscape(token))
+		}
+		l := s.localizerFor(currentUser)
+		if err := s.mail.send(newEmail, l.T("email.confirm_new.subject", instance),
+			l.T("email.confirm_new.body", instance, currentUser.Handle, link(newToken))); err != nil {
+			log.Printf("send email change to %s: %v", newEmail, err)
+			httpError(w, "failed to send confirmation email", http.StatusBadGateway)
+			return
+		}
+		if err := s.mail.send(currentUser.Email, l.T("email.approve_old.subject", instance),
+			l.T("email.approve_old.body", instance, currentUser.Handle, newEmail, link(oldToken))); err != nil {
+			log.Printf("send email change to %s: %v", currentUser.Email, err)
+			httpError(w, "failed to send confirmation email", http.StatusBadGateway)
+			return
+		}
+		s.recordAudit(ctx, 0, currentUser.Email, "user.email_change_requested", "user", strconv.FormatInt(currentUser.ID, 10), newEmail)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(change); err != nil {
+			log.Printf("encode email change: %v", err)
+		}
+	case http.MethodDelete:
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM email_changes WHERE user_id = ?`, currentUser.ID); err != nil {
+			log.Printf("cancel email change: %v", err)
+			httpError(w, "failed to cancel email change", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleEmailChangeConfirm serves the links mailed to both addresses. GET
+// shows what is being confirmed; POST records the confirmation, or cancels
+// the change when the old address says it was not requested. The token is
+// the credential, so no session is needed.
+func (s *serverState) handleEmailChangeConfirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	token := r.FormValue("token")
+	tokenHash := hashSessionToken(token)
+	data := templateData{"Token": token}
+
+	var userID int64
+	var newEmail string
+	var fromOld bool
+	err := s.readDB.QueryRowContext(ctx, `SELECT user_id, new_email, old_token_hash = ? FROM email_changes WHERE (new_token_hash = ? OR old_token_hash = ?) AND expires_at > ?`,
+		tokenHash, tokenHash, tokenHash, time.Now().UTC()).Scan(&userID, &newEmail, &fromOld)
+	if token == "" || errors.Is(err, sql.ErrNoRows) {
+		data["Error"] = "This link is invalid or has expired."
+		s.renderTemplate(w, r, http.StatusNotFound, "email_confirm", data)
+		return
+	}
+	if err != nil {
+		log.Printf("load email change: %v", err)
+		http.Error(w, "failed to load email change", http.StatusInternalServerError)
+		return
+	}
+	data["NewEmail"] = newEmail
+	data["FromOld"] = fromOld
+
+	if r.Method == http.MethodGet {
+		s.renderTemplate(w, r, http.StatusOK, "email_confirm", data)
+		return
+	}
+
+	if fromOld && r.FormValue("action") == "cancel" {
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM email_changes WHERE user_id = ?`, userID); err != nil {
+			log.Printf("cancel email change: %v", err)
+			http.Error(w, "failed to cancel email change", http.StatusInternalServerError)
+			return
+		}
+		data["Cancelled"] = true
+		s.renderTemplate(w, r, http.StatusOK, "email_confirm", data)
+		return
+	}
+
+	column := "new_confirmed_at"
+	if fromOld {
+		column = "old_confirmed_at"
+	}
+	var complete bool
+	if err := s.db.QueryRowContext(ctx, `UPDATE email_changes SET `+column+` = COALESCE(`+column+`, ?) WHERE user_id = ? RETURNING new_confirmed_at IS NOT NULL AND old_confirmed_at IS NOT NULL`,
+		time.Now().UTC(), userID).Scan(&complete); err != nil {
+		log.Printf("confirm email change: %v", err)
+		http.Error(w, "failed to confirm email change", http.StatusInternalServerError)
+		return
+	}
+	if !complete {
+		data["Waiting"] = true
+		s.renderTemplate(w, r, http.StatusOK, "email_confirm", data)
+		return
+	}
+
+	oldEmail, err := s.applyEmailChange(ctx, userID)
+	if errors.Is(err, errEmailTaken) {
+		data["Error"] = "That address was registered by another account in the meantime, so the change was cancelled."
+		s.renderTemplate(w, r, http.StatusConflict, "email_confirm", data)
+		return
+	}
+	if err != nil {
+		log.Printf("apply email change for user %d: %v", userID, err)
+		http.Error(w, "failed to change email", http.StatusInternalServerError)
+		return
+	}
+
+	s.forgetEmail(oldEmail)
+	s.recordAudit(ctx, 0, newEmail, "user.email_changed", "user", strconv.FormatInt(userID, 10), oldEmail+" -> "+newEmail)
+	l := s.defaultLocalizer()
+	instance := s.currentInstanceName(ctx, rootTenantID)
+	if u, exists, err := s.getUserByID(ctx, userID); err == nil && exists {
+		l = s.localizerFor(u)
+		instance = s.currentInstanceName(ctx, u.TenantID)
+	}
+	if err := s.sendEmail(ctx, oldEmail, l.T("email.changed.subject", instance), l.T("email.changed.body", newEmail)); err != nil {
+		log.Printf("queue email change notice to %s: %v", oldEmail, err)
+	}
+
+	data["Done"] = true
+	s.renderTemplate(w, r, http.StatusOK, "email_confirm", data)
+}
+
+// applyEmailChange moves a user to their confirmed new address, rewriting the
+// columns still keyed by email and deleting all of their sessions. Messages,
+// memberships and other id-keyed rows are untouched. It returns the old
+// address.
+func (s *serverState) applyEmailChange(ctx context.Context, userID int64) (string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var oldEmail, newEmail string
+	if err := tx.QueryRowContext(ctx, `SELECT u.email, c.new_email FROM email_changes c JOIN users u ON u.id = c.user_id WHERE c.user_id = ?`, userID).Scan(&oldEmail, &newEmail); err != nil {
+		return "", err
+	}
+	var taken bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)`, newEmail).Scan(&taken); err != nil {
+		return "", err
+	}
+	if taken {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM email_changes WHERE user_id = ?`, userID); err != nil {
+			return "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return "", err
+		}
+		return "", errEmailTaken
+	}
+
+	if err := moveUserEmail(ctx, tx, userID, oldEmail, newEmail); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM email_changes WHERE user_id = ?`, userID); err != nil {
+		return "", err
+	}
+	return oldEmail, tx.Commit()
+}
+
+// moveUserEmail changes a user's address within tx, rewriting the columns
+// still keyed by email and deleting all of their sessions.
+func moveUserEmail(ctx context.Context, tx *sql.Tx, userID int64, oldEmail, newEmail string) error {
+	// Several tables reference users(email) without ON UPDATE; checking the
+	// constraints at commit lets them follow users.email in the same tx.
+	if _, err := tx.ExecContext(ctx, `PRAGMA defer_foreign_keys = ON`); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET email = ? WHERE id = ?`, newEmail, userID); err != nil {
+		return err
+	}
+	for _, c := range emailKeyedColumns {
+		if _, err := tx.ExecContext(ctx, `UPDATE `+c.table+` SET `+c.column+` = ? WHERE `+c.column+` = ?`, newEmail, oldEmail); err != nil {
+			return fmt.Errorf("update %s.%s: %w", c.table, c.column, err)
+		}
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = ?`, userID)
+	return err
+}
+
+// forgetEmail drops anything cached or connected under an address a user
+// has moved away from; every session was deleted with the move.
+func (s *serverState) forgetEmail(oldEmail string) {
+	s.memberCache.deleteWhere(func(k membershipKey) bool { return k.email == oldEmail })
+	s.overrideCache.deleteWhere(func(int64) bool { return true })
+	s.grantCache.deleteWhere(func(int64) bool { return true })
+	s.ws.disconnectUser(oldEmail, wsCloseSignedOut, "email changed")
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	defaultEphemeralTTL = 10 * time.Minute
+	ephemeralPruneEvery = time.Minute
+)
+
+// Ephemeral messages are shown to one user in a channel, such as the
+// confirmation a command sends back. They live in their own table, so they
+// never appear in channel history, sync, exports or search, and are deleted
+// as soon as one of the recipient's connections receives them. A recipient
+// who is not listening gets them on subscribing to the channel, until
+// EPHEMERAL_TTL runs out.
+
+const ephemeralSelect = `
+        SELECT e.id, e.channel_id, u.id, u.handle, u.display_name, e.content, e.created_at
+        FROM ephemeral_messages e
+        JOIN users u ON u.id = e.author_id
+`
+
+func scanEphemeral(row interface{ Scan(...any) error }) (messageDTO, error) {
+	dto := messageDTO{Ephemeral: true}
+	err := row.Scan(&dto.ID, &dto.ChannelID, &dto.AuthorID, &dto.AuthorHandle, &dto.AuthorDisplayName, &dto.Content, &dto.CreatedAt)
+	return dto, err
+}
+
+// sendEphemeral shows content, from the system user, to recipient alone in
+// channelID.
+func (s *serverState) sendEphemeral(ctx context.Context, channelID int64, recipient user, content string) error {
+	now := time.Now().UTC()
+	res, err := s.db.ExecContext(ctx, `
+        INSERT INTO ephemeral_messages (channel_id, recipient_id, author_id, content, created_at, expires_at)
+        VALUES (?, ?, `+userIDForEmail+`, ?, ?, ?)
+    `, channelID, recipient.ID, systemUserEmail, content, now, now.Add(s.ephemeralTTL))
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	dto, err := scanEphemeral(s.db.QueryRowContext(ctx, ephemeralSelect+`WHERE e.id = ?`, id))
+	if err != nil {
+		return err
+	}
+
+	frame, err := outboundFrame(wsOutbound{Type: "message", ChannelID: channelID, Message: &dto})
+	if err != nil {
+		return err
+	}
+	delivered := s.ws.broadcastTo(channelID, frame, func(c *wsClient) bool { return c.currentUser().ID == recipient.ID })
+	if delivered > 0 {
+		_, err = s.db.ExecContext(ctx, `DELETE FROM ephemeral_messages WHERE id = ?`, id)
+	}
+	return err
+}
+
+// deliverPendingEphemeral sends c the ephemeral messages waiting for its user
+// in the channels it just subscribed to, and forgets them.
+func (s *serverState) deliverPendingEphemeral(ctx context.Context, c *wsClient, channelIDs []int64) {
+	if len(channelIDs) == 0 {
+		return
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(channelIDs)), ",")
+	args := []any{c.currentUser().ID, time.Now().UTC()}
+	for _, id := range channelIDs {
+		args = append(args, id)
+	}
+	rows, err := s.readDB.QueryContext(ctx, ephemeralSelect+`
+        WHERE e.recipient_id = ? AND e.expires_at > ? AND e.channel_id IN (`+placeholders+`)
+        ORDER BY e.id
+    `, args...)
+	if err != nil {
+		log.Printf("load pending ephemeral messages: %v", err)
+		return
+	}
+	var pending []messageDTO
+	for rows.Next() {
+		dto, err := scanEphemeral(rows)
+		if err != nil {
+			log.Printf("scan ephemeral message: %v", err)
+			break
+		}
+		pending = append(pending, dto)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("load pending ephemeral messages: %v", err)
+	}
+	rows.Close()
+
+	for i := range pending {
+		c.enqueueJSON(wsOutbound{Type: "message", ChannelID: pending[i].ChannelID, Message: &pending[i]})
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM ephemeral_messages WHERE id = ?`, pending[i].ID); err != nil {
+			log.Printf("delete delivered ephemeral message: %v", err)
+		}
+	}
+}
+
+func (s *serverState) pruneEphemeralMessages(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM ephemeral_messages WHERE expires_at <= ?`, time.Now().UTC())
+	return err
+}
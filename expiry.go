@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	minMessageTTL      = 5 * time.Second
+	maxMessageTTL      = 7 * 24 * time.Hour
+	messageExpiryEvery = time.Second
+)
+
+var errInvalidTTL = errors.New("ttl must be between 5 seconds and 7 days")
+
+// messageTTL converts the ttl a sender asked for, in seconds, into a
+// duration. Zero means the message does not expire.
+func messageTTL(seconds int64) (time.Duration, error) {
+	if seconds == 0 {
+		return 0, nil
+	}
+	ttl := time.Duration(seconds) * time.Second
+	if seconds < 0 || ttl < minMessageTTL || ttl > maxMessageTTL {
+		return 0, errInvalidTTL
+	}
+	return ttl, nil
+}
+
+// runMessageExpiry deletes self-destructing messages as their timers run out
+// and tells subscribers to remove them. Reads already hide expired messages,
+// so a missed tick only delays the delete event.
+func (s *serverState) runMessageExpiry(ctx context.Context) {
+	ticker := time.NewTicker(messageExpiryEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.deleteExpiredMessages(ctx); err != nil {
+			log.Printf("delete expired messages: %v", err)
+		}
+	}
+}
+
+func (s *serverState) deleteExpiredMessages(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, `
+        DELETE FROM channel_messages
+        WHERE expires_at IS NOT NULL AND expires_at <= ?
+        RETURNING id, channel_id
+    `, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	type expiredMessage struct{ id, channelID int64 }
+	var expired []expiredMessage
+	for rows.Next() {
+		var m expiredMessage
+		if err := rows.Scan(&m.id, &m.channelID); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range expired {
+		s.broadcastMessageDelete(m.channelID, m.id)
+	}
+	return nil
+}
@@ -0,0 +1,753 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Version 1 archives named members and authors by email; version 2
+	// names them by handle. Both import the same way.
+	exportFormatVersion = 2
+	exportManifestName  = "server.json"
+	maxImportBytes      = 64 << 20
+
+	// userStatusImported marks ghost accounts that stand in for the members
+	// and authors of an imported archive. Like bridge ghosts, they have no
+	// password and cannot sign in.
+	userStatusImported = "imported"
+)
+
+type exportArchive struct {
+	Version    int             `json:"version"`
+	ExportedAt time.Time       `json:"exportedAt"`
+	Server     exportServer    `json:"server"`
+	Members    []exportMember  `json:"members"`
+	Channels   []exportChannel `json:"channels"`
+}
+
+type exportServer struct {
+	Slug                 string    `json:"slug"`
+	Name                 string    `json:"name"`
+	Description          string    `json:"description,omitempty"`
+	DefaultNotifications string    `json:"defaultNotifications"`
+	SystemChannelSlug    string    `json:"systemChannelSlug,omitempty"`
+	Icon                 string    `json:"icon,omitempty"` // data URL
+	Rules                string    `json:"rules,omitempty"`
+	CreatedAt            time.Time `json:"createdAt"`
+}
+
+type exportMember struct {
+	Handle string `json:"handle"`
+	// Email is only set in version 1 archives.
+	Email       string    `json:"email,omitempty"`
+	DisplayName string    `json:"displayName"`
+	Role        string    `json:"role"`
+	JoinedAt    time.Time `json:"joinedAt"`
+}
+
+type exportChannel struct {
+	Slug      string          `json:"slug"`
+	Name      string          `json:"name"`
+	Kind      string          `json:"kind"`
+	PostRoles []string        `json:"postRoles,omitempty"`
+	Topic     string          `json:"topic,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Messages  []exportMessage `json:"messages"`
+}
+
+type exportMessage struct {
+	AuthorHandle string `json:"authorHandle"`
+	// AuthorEmail is only set in version 1 archives.
+	AuthorEmail       string             `json:"authorEmail,omitempty"`
+	AuthorDisplayName string             `json:"authorDisplayName"`
+	Content           string             `json:"content"`
+	CreatedAt         time.Time          `json:"createdAt"`
+	Attachments       []exportAttachment `json:"attachments,omitempty"`
+}
+
+type exportAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Data        []byte `json:"data"`
+	Voice       bool   `json:"voice,omitempty"`
+	DurationMS  int64  `json:"durationMs,omitempty"`
+}
+
+func (s *serverState) buildServerExport(ctx context.Context, srv serverInfo) (exportArchive, error) {
+	archive := exportArchive{
+		Version:    exportFormatVersion,
+		ExportedAt: time.Now().UTC(),
+		Server: exportServer{
+			Slug:                 srv.Slug,
+			Name:                 srv.Name,
+			Description:          srv.Description,
+			DefaultNotifications: srv.DefaultNotifications,
+			Rules:                srv.Rules,
+			CreatedAt:            srv.CreatedAt,
+		},
+	}
+
+	if srv.IconPath != "" {
+		raw, err := os.ReadFile(filepath.Join(s.dataDir, srv.IconPath))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return exportArchive{}, err
+		}
+		if len(raw) > 0 {
+			archive.Server.Icon = "data:" + http.DetectContentType(raw) + ";base64," + base64.StdEncoding.EncodeToString(raw)
+		}
+	}
+
+	members, err := s.membersForServer(ctx, srv.ID)
+	if err != nil {
+		return exportArchive{}, err
+	}
+	for _, m := range members {
+		archive.Members = append(archive.Members, exportMember{Handle: m.Handle, DisplayName: m.DisplayName, Role: m.Role, JoinedAt: m.JoinedAt})
+	}
+
+	channels, err := s.channelsForServer(ctx, srv.ID)
+	if err != nil {
+		return exportArchive{}, err
+	}
+	for _, ch := range channels {
+		if srv.SystemChannelID.Valid && srv.SystemChannelID.Int64 == ch.ID {
+			archive.Server.SystemChannelSlug = ch.Slug
+		}
+		exported := exportChannel{Slug: ch.Slug, Name: ch.Name, Kind: ch.Kind, PostRoles: splitRoles(ch.PostRoles), Topic: ch.Topic, CreatedAt: ch.CreatedAt, Messages: []exportMessage{}}
+
+		// Self-destructing messages are never archived.
+		rows, err := s.readDB.QueryContext(ctx, messageSelect+`WHERE m.channel_id = ? AND m.expires_at IS NULL ORDER BY m.id`, ch.ID)
+		if err != nil {
+			return exportArchive{}, err
+		}
+		withAttachments := map[int]int64{}
+		for rows.Next() {
+			msg, err := scanMessage(rows)
+			if err != nil {
+				rows.Close()
+				return exportArchive{}, err
+			}
+			if len(msg.Attachments) > 0 {
+				withAttachments[len(exported.Messages)] = msg.ID
+			}
+			exported.Messages = append(exported.Messages, exportMessage{
+				AuthorHandle:      msg.AuthorHandle,
+				AuthorDisplayName: msg.AuthorDisplayName,
+				Content:           msg.Content,
+				CreatedAt:         msg.CreatedAt,
+			})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return exportArchive{}, err
+		}
+		for i, messageID := range withAttachments {
+			if exported.Messages[i].Attachments, err = s.exportAttachments(ctx, messageID); err != nil {
+				return exportArchive{}, err
+			}
+		}
+		archive.Channels = append(archive.Channels, exported)
+	}
+
+	return archive, nil
+}
+
+func (s *serverState) exportAttachments(ctx context.Context, messageID int64) ([]exportAttachment, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT a.filename, a.content_type, a.voice, COALESCE(a.duration_ms, 0), a.blob_hash, b.location, b.data
+        FROM message_attachments a JOIN attachment_blobs b ON b.hash = a.blob_hash
+        WHERE a.message_id = ? AND b.scan_status != 'rejected' ORDER BY a.id
+    `, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []exportAttachment
+	for rows.Next() {
+		var att exportAttachment
+		var hash, location string
+		if err := rows.Scan(&att.Filename, &att.ContentType, &att.Voice, &att.DurationMS, &hash, &location, &att.Data); err != nil {
+			return nil, err
+		}
+		if att.Data, err = s.blobData(ctx, hash, location, att.Data); err != nil {
+			return nil, err
+		}
+		result = append(result, att)
+	}
+	return result, rows.Err()
+}
+
+// handleServerExport serves /api/servers/{id}/export. GET downloads the
+// archive at once; POST queues an export job, whose status is at
+// /export/{job} and whose archive is at /export/{job}/download once done.
+func (s *serverState) handleServerExport(w http.ResponseWriter, r *http.Request, serverID int64, currentUser user, rest []string) {
+	ctx := r.Context()
+	canManage, err := s.canManageServer(ctx, currentUser.Email, serverID)
+	if err != nil {
+		log.Printf("check export permission: %v", err)
+		httpError(w, "failed to export server", http.StatusInternalServerError)
+		return
+	}
+	if !canManage || serverID == s.directServerID {
+		httpError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	srv, exists, err := s.serverByID(ctx, serverID)
+	if err != nil {
+		log.Printf("load server for export: %v", err)
+		httpError(w, "failed to export server", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if len(rest) > 0 {
+		s.handleExportJob(w, r, srv, currentUser, rest)
+		return
+	}
+
+	format := "zip"
+	if r.URL.Query().Get("format") == "json" {
+		format = "json"
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		payload := exportJob{ServerID: serverID, UserID: currentUser.ID, Format: format, File: generateSessionID()[:32] + "." + format}
+		id, err := s.jobs.enqueue(ctx, "export", payload)
+		if err != nil {
+			log.Printf("queue server export: %v", err)
+			httpError(w, "failed to export server", http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit(ctx, serverID, currentUser.Email, "server.export", "server", strconv.FormatInt(serverID, 10), "job="+strconv.FormatInt(id, 10))
+		j, _, err := s.jobByID(ctx, id)
+		if err != nil {
+			log.Printf("load export job: %v", err)
+			httpError(w, "failed to export server", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		basePath := tenantScopeFrom(ctx).basePath
+		w.Header().Set("Location", fmt.Sprintf("%s/api/servers/%d/export/%d", basePath, serverID, id))
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(toExportJobDTO(j, payload, basePath)); err != nil {
+			log.Printf("encode export job: %v", err)
+		}
+		return
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	archive, err := s.buildServerExport(ctx, srv)
+	if err != nil {
+		log.Printf("build server export: %v", err)
+		httpError(w, "failed to export server", http.StatusInternalServerError)
+		return
+	}
+	s.recordAudit(ctx, serverID, currentUser.Email, "server.export", "server", strconv.FormatInt(serverID, 10), "")
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "application/zip")
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+exportFilename(srv, archive.ExportedAt, format)+`"`)
+	if err := writeServerExport(w, archive, format); err != nil {
+		log.Printf("write server export: %v", err)
+	}
+}
+
+func exportFilename(srv serverInfo, at time.Time, format string) string {
+	return fmt.Sprintf("%s-%s.%s", srv.Slug, at.Format("20060102-150405"), format)
+}
+
+// exportJob is the payload of an export job. File names the archive under
+// data/exports, and is random so it cannot be guessed.
+type exportJob struct {
+	ServerID int64  `json:"serverId"`
+	UserID   int64  `json:"userId"`
+	Format   string `json:"format"`
+	File     string `json:"file"`
+}
+
+type exportJobDTO struct {
+	ID          int64      `json:"id"`
+	Status      string     `json:"status"`
+	Format      string     `json:"format"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+	DownloadURL string     `json:"downloadUrl,omitempty"`
+}
+
+func toExportJobDTO(j jobDTO, payload exportJob, basePath string) exportJobDTO {
+	dto := exportJobDTO{ID: j.ID, Status: j.Status, Format: payload.Format, CreatedAt: j.CreatedAt, FinishedAt: j.FinishedAt}
+	if j.Status == jobRunning {
+		// Clients only need to know it has not finished yet.
+		dto.Status = jobPending
+	}
+	if j.Status == jobDone {
+		dto.DownloadURL = fmt.Sprintf("%s/api/servers/%d/export/%d/download", basePath, payload.ServerID, j.ID)
+	}
+	return dto
+}
+
+func (s *serverState) exportPath(file string) string {
+	return filepath.Join(s.dataDir, "exports", filepath.Base(file))
+}
+
+func (s *serverState) removeExportFile(file string) {
+	if err := os.Remove(s.exportPath(file)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("remove export %s: %v", file, err)
+	}
+}
+
+// handleExportJob serves the status and archive of an export job. Only the
+// member who asked for it can see it.
+func (s *serverState) handleExportJob(w http.ResponseWriter, r *http.Request, srv serverInfo, currentUser user, rest []string) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(rest[0], 10, 64)
+	if err != nil || len(rest) > 2 || (len(rest) == 2 && rest[1] != "download") {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	j, exists, err := s.jobByID(r.Context(), id)
+	if err != nil {
+		log.Printf("load export job %d: %v", id, err)
+		httpError(w, "failed to load export", http.StatusInternalServerError)
+		return
+	}
+	var payload exportJob
+	if exists && j.Kind == "export" {
+		if err := json.Unmarshal(j.Payload, &payload); err != nil {
+			log.Printf("decode export job %d: %v", id, err)
+			httpError(w, "failed to load export", http.StatusInternalServerError)
+			return
+		}
+	}
+	if payload.ServerID != srv.ID || payload.UserID != currentUser.ID {
+		httpError(w, "export not found", http.StatusNotFound)
+		return
+	}
+
+	if len(rest) == 1 {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(toExportJobDTO(j, payload, tenantScopeFrom(r.Context()).basePath)); err != nil {
+			log.Printf("encode export job: %v", err)
+		}
+		return
+	}
+
+	if j.Status != jobDone {
+		httpError(w, "export is not ready", http.StatusConflict)
+		return
+	}
+	f, err := os.Open(s.exportPath(payload.File))
+	if errors.Is(err, os.ErrNotExist) {
+		httpError(w, "export has expired", http.StatusGone)
+		return
+	} else if err != nil {
+		log.Printf("open export %s: %v", payload.File, err)
+		httpError(w, "failed to load export", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	contentType := "application/zip"
+	if payload.Format == "json" {
+		contentType = "application/json"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+exportFilename(srv, *j.FinishedAt, payload.Format)+`"`)
+	http.ServeContent(w, r, "", *j.FinishedAt, f)
+}
+
+// runExportJob writes the archive of an export job to data/exports.
+func (s *serverState) runExportJob(ctx context.Context, raw json.RawMessage) error {
+	var payload exportJob
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return err
+	}
+	srv, exists, err := s.serverByID(ctx, payload.ServerID)
+	if err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("server %d no longer exists", payload.ServerID)
+	}
+	archive, err := s.buildServerExport(ctx, srv)
+	if err != nil {
+		return fmt.Errorf("build server export: %w", err)
+	}
+
+	path := s.exportPath(payload.File)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeServerExport(tmp, archive, payload.Format); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeServerExport writes archive as bare JSON or as a ZIP holding the
+// server.json manifest.
+func writeServerExport(w io.Writer, archive exportArchive, format string) error {
+	if format == "json" {
+		return json.NewEncoder(w).Encode(archive)
+	}
+	zw := zip.NewWriter(w)
+	entry, err := zw.Create(exportManifestName)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(entry).Encode(archive); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func readServerImport(r *http.Request, w http.ResponseWriter) (exportArchive, error) {
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		return exportArchive{}, errors.New("archive too large")
+	}
+
+	var archive exportArchive
+	if bytes.HasPrefix(raw, []byte("PK")) {
+		zr, err := zip.NewReader(bytes.NewReader(raw), int64(len(raw)))
+		if err != nil {
+			return exportArchive{}, errors.New("invalid zip archive")
+		}
+		var manifest *zip.File
+		for _, f := range zr.File {
+			if f.Name == exportManifestName {
+				manifest = f
+				break
+			}
+		}
+		if manifest == nil {
+			return exportArchive{}, errors.New("archive is missing " + exportManifestName)
+		}
+		rc, err := manifest.Open()
+		if err != nil {
+			return exportArchive{}, errors.New("invalid zip archive")
+		}
+		defer rc.Close()
+		if err := json.NewDecoder(io.LimitReader(rc, maxImportBytes)).Decode(&archive); err != nil {
+			return exportArchive{}, errors.New("invalid " + exportManifestName)
+		}
+	} else if err := json.Unmarshal(raw, &archive); err != nil {
+		return exportArchive{}, errors.New("invalid archive")
+	}
+
+	if archive.Version < 1 || archive.Version > exportFormatVersion {
+		return exportArchive{}, fmt.Errorf("unsupported archive version %d", archive.Version)
+	}
+	if strings.TrimSpace(archive.Server.Name) == "" {
+		return exportArchive{}, errors.New("archive has no server name")
+	}
+	return archive, nil
+}
+
+// importServer recreates archive as a new server owned by ownerEmail, in the
+// owner's tenant. Members and authors are never matched to accounts here,
+// whatever the archive calls them: each becomes a ghost account, which keeps
+// their name and role but cannot sign in.
+func (s *serverState) importServer(ctx context.Context, archive exportArchive, ownerEmail string, tenantID int64) (srv serverInfo, err error) {
+	// Attachments are prepared and placed first, so image processing and
+	// uploads to an external store happen outside the transaction.
+	prepared := make(map[string]newAttachment)
+	for _, ch := range archive.Channels {
+		for _, msg := range ch.Messages {
+			for _, att := range msg.Attachments {
+				hash := attachmentHash(att.Data)
+				if _, done := prepared[hash]; done {
+					continue
+				}
+				p := newAttachment{contentType: att.ContentType, data: att.Data}
+				if err := s.prepareAttachment(ctx, &p); err != nil {
+					return serverInfo{}, fmt.Errorf("attachment %s: %w", att.Filename, err)
+				}
+				if p.location, err = s.placeBlob(ctx, p.data); err != nil {
+					return serverInfo{}, err
+				}
+				prepared[hash] = p
+			}
+		}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return serverInfo{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	now := time.Now().UTC()
+	// Ghosts are keyed by the handle (or, in version 1, the email) the
+	// archive uses, so a member and their messages share one.
+	ghosts := make(map[string]int64)
+	ghostFor := func(name, displayName string) (int64, error) {
+		if id, ok := ghosts[name]; ok {
+			return id, nil
+		}
+		if displayName == "" {
+			displayName = name
+		}
+		handle, err := uniqueHandle(ctx, tx, tenantID, handleFromEmail(name))
+		if err != nil {
+			return 0, err
+		}
+		// As for bridge ghosts, .invalid keeps the address from ever
+		// receiving mail or being signed up with.
+		email := generateSessionID()[:16] + "@import.invalid"
+		res, err := tx.ExecContext(ctx, `INSERT INTO users (email, handle, display_name, password_hash, created_at, status, tenant_id) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			email, handle, displayName, []byte{}, now, userStatusImported, tenantID)
+		if err != nil {
+			return 0, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		ghosts[name] = id
+		return id, nil
+	}
+
+	slug := slugify(archive.Server.Slug)
+	var taken int
+	if err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM servers WHERE slug = ?`, slug).Scan(&taken); err != nil {
+		return serverInfo{}, err
+	}
+	if taken > 0 || slug == directServerSlug {
+		slug = slugify(archive.Server.Name) + "-" + generateSessionID()[:6]
+	}
+
+	notifications := archive.Server.DefaultNotifications
+	if notifications != "mentions" {
+		notifications = "all"
+	}
+	srv = serverInfo{Slug: slug, Name: strings.TrimSpace(archive.Server.Name), Description: archive.Server.Description, DefaultNotifications: notifications, Rules: archive.Server.Rules, CreatedAt: now}
+	res, err := tx.ExecContext(ctx, `INSERT INTO servers (slug, name, created_at, description, default_notifications, rules, tenant_id) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		srv.Slug, srv.Name, srv.CreatedAt, srv.Description, srv.DefaultNotifications, srv.Rules, tenantID)
+	if err != nil {
+		return serverInfo{}, err
+	}
+	if srv.ID, err = res.LastInsertId(); err != nil {
+		return serverInfo{}, err
+	}
+
+	if _, err = tx.ExecContext(ctx, `INSERT INTO server_members (server_id, user_id, role, joined_at) VALUES (?, `+userIDForEmail+`, 'owner', ?)`, srv.ID, ownerEmail, now); err != nil {
+		return serverInfo{}, err
+	}
+	for _, m := range archive.Members {
+		name := archiveName(m.Handle, m.Email)
+		if name == "" {
+			continue
+		}
+		role := m.Role
+		if role == "owner" {
+			role = "admin"
+		} else if role != "admin" {
+			role = "member"
+		}
+		ghostID, err := ghostFor(name, m.DisplayName)
+		if err != nil {
+			return serverInfo{}, err
+		}
+		if _, err = tx.ExecContext(ctx, `
+            INSERT OR IGNORE INTO server_members (server_id, user_id, role, joined_at, rules_accepted_at)
+            VALUES (?, ?, ?, ?, ?)
+        `, srv.ID, ghostID, role, m.JoinedAt, now); err != nil {
+			return serverInfo{}, err
+		}
+	}
+
+	for _, ch := range archive.Channels {
+		kind := ch.Kind
+		if kind != "voice" && kind != "announcement" {
+			kind = "text"
+		}
+		chSlug := slugify(ch.Slug)
+		res, err := tx.ExecContext(ctx, `INSERT INTO channels (server_id, slug, name, kind, created_at, post_roles, topic) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			srv.ID, chSlug, ch.Name, kind, ch.CreatedAt, strings.Join(ch.PostRoles, ","), ch.Topic)
+		if err != nil {
+			return serverInfo{}, fmt.Errorf("channel %s: %w", ch.Slug, err)
+		}
+		channelID, err := res.LastInsertId()
+		if err != nil {
+			return serverInfo{}, err
+		}
+		if chSlug == archive.Server.SystemChannelSlug {
+			srv.SystemChannelID = sql.NullInt64{Int64: channelID, Valid: true}
+		}
+
+		for _, msg := range ch.Messages {
+			author := archiveName(msg.AuthorHandle, msg.AuthorEmail)
+			if author == "" {
+				continue
+			}
+			authorID, err := ghostFor(author, msg.AuthorDisplayName)
+			if err != nil {
+				return serverInfo{}, err
+			}
+			res, err := tx.ExecContext(ctx, `INSERT INTO channel_messages (channel_id, author_id, content, created_at) VALUES (?, ?, ?, ?)`,
+				channelID, authorID, msg.Content, msg.CreatedAt)
+			if err != nil {
+				return serverInfo{}, err
+			}
+			if len(msg.Attachments) == 0 {
+				continue
+			}
+			messageID, err := res.LastInsertId()
+			if err != nil {
+				return serverInfo{}, err
+			}
+			for _, att := range msg.Attachments {
+				p := prepared[attachmentHash(att.Data)]
+				p.filename = att.Filename
+				if p.image == nil {
+					p.contentType = att.ContentType
+				}
+				// Imported voice messages are transcribed here again.
+				p.voice = att.Voice
+				p.durationMS = sql.NullInt64{Int64: att.DurationMS, Valid: att.DurationMS > 0}
+				p.transcribe = att.Voice && s.transcriber != nil
+				if err := storeAttachment(ctx, tx, messageID, p, msg.CreatedAt); err != nil {
+					return serverInfo{}, err
+				}
+			}
+		}
+	}
+
+	if len(archive.Channels) == 0 {
+		res, err = tx.ExecContext(ctx, `INSERT INTO channels (server_id, slug, name, kind, created_at) VALUES (?, 'general', 'general', 'text', ?)`, srv.ID, now)
+		if err != nil {
+			return serverInfo{}, err
+		}
+		channelID, err := res.LastInsertId()
+		if err != nil {
+			return serverInfo{}, err
+		}
+		srv.SystemChannelID = sql.NullInt64{Int64: channelID, Valid: true}
+	}
+
+	if srv.SystemChannelID.Valid {
+		if _, err = tx.ExecContext(ctx, `UPDATE servers SET system_channel_id = ? WHERE id = ?`, srv.SystemChannelID, srv.ID); err != nil {
+			return serverInfo{}, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return serverInfo{}, err
+	}
+	s.invalidateServerMemberships(srv.ID)
+	return srv, nil
+}
+
+// archiveName is how an archive refers to a member or author: their handle,
+// or their email in version 1 archives.
+func archiveName(handle, email string) string {
+	if name := strings.TrimSpace(strings.ToLower(handle)); name != "" {
+		return name
+	}
+	return strings.TrimSpace(strings.ToLower(email))
+}
+
+// handleServerImport serves /api/servers/import for instance admins.
+func (s *serverState) handleServerImport(w http.ResponseWriter, r *http.Request, currentUser user) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.isInstanceAdmin(r.Context(), currentUser.Email) {
+		httpError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	archive, err := readServerImport(r, w)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	srv, err := s.importServer(ctx, archive, currentUser.Email, currentUser.TenantID)
+	var imgErr *imageError
+	if errors.As(err, &imgErr) {
+		httpError(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		log.Printf("import server: %v", err)
+		httpError(w, "failed to import server", http.StatusInternalServerError)
+		return
+	}
+	s.wakeScanner()
+	s.wakeTranscriber()
+
+	if archive.Server.Icon != "" {
+		if raw, err := decodeServerIcon(archive.Server.Icon); err == nil {
+			if srv.IconPath, err = s.storeServerIcon(ctx, srv.ID, raw); err != nil {
+				log.Printf("store imported icon: %v", err)
+			} else if _, err := s.db.ExecContext(ctx, `UPDATE servers SET icon_path = ? WHERE id = ?`, srv.IconPath, srv.ID); err != nil {
+				log.Printf("save imported icon: %v", err)
+			}
+		}
+	}
+
+	s.recordAudit(ctx, srv.ID, currentUser.Email, "server.import", "server", strconv.FormatInt(srv.ID, 10),
+		fmt.Sprintf("channels=%d members=%d", len(archive.Channels), len(archive.Members)))
+
+	channels, err := s.channelsForServer(ctx, srv.ID)
+	if err != nil {
+		log.Printf("list imported channels: %v", err)
+	}
+	payload := make([]channelPayload, 0, len(channels))
+	for _, ch := range channels {
+		payload = append(payload, toChannelPayload(ch))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(toServerPayload(srv, payload)); err != nil {
+		log.Printf("encode imported server: %v", err)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type messageOriginDTO struct {
+	MessageID         int64  `json:"messageId"`
+	ChannelID         int64  `json:"channelId"`
+	AuthorID          int64  `json:"authorId"`
+	AuthorHandle      string `json:"authorHandle"`
+	AuthorDisplayName string `json:"authorDisplayName"`
+}
+
+// channelFollowDTO names the admin who set up the follow by ID and handle.
+type channelFollowDTO struct {
+	SourceChannelID int64     `json:"sourceChannelId"`
+	TargetChannelID int64     `json:"targetChannelId"`
+	TargetServerID  int64     `json:"targetServerId"`
+	CreatedByID     int64     `json:"createdById,omitempty"`
+	CreatedByHandle string    `json:"createdByHandle,omitempty"`
+	CreatedAt       time.Time `json:"createdAt"`
+}
+
+// saveCopiedMessage stores a copy of origin in channelID, keeping a pointer
+// back to the first message in the chain so attribution survives re-forwards.
+func (s *serverState) saveCopiedMessage(ctx context.Context, channelID int64, authorEmail string, origin chatMessage) (chatMessage, error) {
+	originID, originChannelID, originAuthor := origin.ID, origin.ChannelID, sql.NullInt64{Int64: origin.AuthorID, Valid: true}
+	if origin.OriginMessageID.Valid {
+		originID = origin.OriginMessageID.Int64
+		originChannelID = origin.OriginChannelID.Int64
+		originAuthor = origin.OriginAuthorID
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return chatMessage{}, err
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	res, err := tx.ExecContext(ctx, `
+        INSERT INTO channel_messages (channel_id, author_id, content, created_at, origin_message_id, origin_channel_id, origin_author_id)
+        VALUES (?, `+userIDForEmail+`, ?, ?, ?, ?, ?)
+    `, channelID, authorEmail, origin.Content, now, originID, originChannelID, originAuthor)
+	if err != nil {
+		return chatMessage{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return chatMessage{}, err
+	}
+	if err := queueMessageEvent(ctx, tx, channelID, id, now); err != nil {
+		return chatMessage{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return chatMessage{}, err
+	}
+	s.wakeOutbox()
+	return s.messageByID(ctx, id)
+}
+
+func (s *serverState) channelFollowers(ctx context.Context, sourceChannelID int64) ([]channelFollowDTO, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT f.source_channel_id, f.target_channel_id, c.server_id, u.id, u.handle, f.created_at
+        FROM channel_follows f
+        JOIN channels c ON c.id = f.target_channel_id
+        LEFT JOIN users u ON u.id = f.created_by_id
+        WHERE f.source_channel_id = ?
+        ORDER BY f.created_at
+    `, sourceChannelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []channelFollowDTO
+	for rows.Next() {
+		var f channelFollowDTO
+		var creatorID sql.NullInt64
+		var creatorHandle sql.NullString
+		if err := rows.Scan(&f.SourceChannelID, &f.TargetChannelID, &f.TargetServerID, &creatorID, &creatorHandle, &f.CreatedAt); err != nil {
+			return nil, err
+		}
+		f.CreatedByID, f.CreatedByHandle = creatorID.Int64, creatorHandle.String
+		result = append(result, f)
+	}
+	return result, rows.Err()
+}
+
+func (s *serverState) loadChannelMessage(ctx context.Context, ch channelInfo, rawID string) (chatMessage, bool, error) {
+	messageID, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		return chatMessage{}, false, nil
+	}
+	msg, err := s.messageByID(ctx, messageID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (msg.ChannelID != ch.ID || msg.expired(time.Now()))) {
+		return chatMessage{}, false, nil
+	}
+	if err != nil {
+		return chatMessage{}, false, err
+	}
+	return msg, true, nil
+}
+
+func (s *serverState) handleForwardMessage(w http.ResponseWriter, r *http.Request, ch channelInfo, currentUser user, rawMessageID string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		ChannelID int64  `json:"channelId"`
+		Handle    string `json:"handle" validate:"trim"`
+		Email     string `json:"email" validate:"trim"`
+	}
+	if !s.decodeJSON(w, r, &body) {
+		return
+	}
+
+	ctx := r.Context()
+	msg, found, err := s.loadChannelMessage(ctx, ch, rawMessageID)
+	if err != nil {
+		log.Printf("load forwarded message: %v", err)
+		httpError(w, "failed to forward message", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	var target channelInfo
+	switch {
+	case body.ChannelID != 0:
+		var exists bool
+		target, exists, err = s.channelByID(ctx, body.ChannelID)
+		if err != nil {
+			log.Printf("load forward target: %v", err)
+			httpError(w, "failed to forward message", http.StatusInternalServerError)
+			return
+		}
+		hasAccess := false
+		if exists {
+			if hasAccess, err = s.userHasChannelAccess(ctx, currentUser.Email, target); err != nil {
+				log.Printf("check forward target access: %v", err)
+				httpError(w, "failed to forward message", http.StatusInternalServerError)
+				return
+			}
+		}
+		if !hasAccess {
+			httpError(w, "target channel not found", http.StatusNotFound)
+			return
+		}
+	case body.Handle != "" || body.Email != "":
+		recipient, exists, err := s.lookupRecipient(ctx, currentUser.TenantID, body.Handle, body.Email)
+		if err != nil {
+			log.Printf("lookup forward recipient: %v", err)
+			httpError(w, "failed to forward message", http.StatusInternalServerError)
+			return
+		} else if !exists {
+			httpError(w, "user not found", http.StatusNotFound)
+			return
+		}
+		if target, err = s.directChannel(ctx, currentUser.Email, recipient.Email); err != nil {
+			log.Printf("open forward dm: %v", err)
+			httpError(w, "failed to forward message", http.StatusInternalServerError)
+			return
+		}
+	default:
+		httpError(w, "channelId, handle or email is required", http.StatusBadRequest)
+		return
+	}
+
+	if target.Kind == "voice" {
+		httpError(w, "cannot send messages to a voice channel", http.StatusBadRequest)
+		return
+	}
+	canPost, err := s.canPostInChannel(ctx, currentUser.Email, target)
+	if err != nil {
+		log.Printf("check forward post permission: %v", err)
+		httpError(w, "failed to forward message", http.StatusInternalServerError)
+		return
+	}
+	if !canPost {
+		httpError(w, "target channel is read-only", http.StatusForbidden)
+		return
+	}
+	if pending, err := s.rulesPending(ctx, currentUser.Email, target); err != nil {
+		log.Printf("check forward server rules: %v", err)
+		httpError(w, "failed to forward message", http.StatusInternalServerError)
+		return
+	} else if pending {
+		httpError(w, errRulesNotAccepted.Error(), http.StatusForbidden)
+		return
+	}
+
+	copied, err := s.saveCopiedMessage(ctx, target.ID, currentUser.Email, msg)
+	if err != nil {
+		log.Printf("save forwarded message: %v", err)
+		httpError(w, "failed to forward message", http.StatusInternalServerError)
+		return
+	}
+
+	dto := toMessageDTO(copied)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(s.maskFor(currentUser.MaskProfanity, dto)); err != nil {
+		log.Printf("encode forwarded message: %v", err)
+	}
+}
+
+func (s *serverState) handleCrosspostMessage(w http.ResponseWriter, r *http.Request, ch channelInfo, currentUser user, rawMessageID string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ch.Kind != "announcement" {
+		httpError(w, "only announcement channels can crosspost", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	msg, found, err := s.loadChannelMessage(ctx, ch, rawMessageID)
+	if err != nil {
+		log.Printf("load crosspost message: %v", err)
+		httpError(w, "failed to crosspost message", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if msg.AuthorEmail != currentUser.Email {
+		canManage, err := s.canManageServer(ctx, currentUser.Email, ch.ServerID)
+		if err != nil {
+			log.Printf("check crosspost permission: %v", err)
+			httpError(w, "failed to crosspost message", http.StatusInternalServerError)
+			return
+		}
+		if !canManage {
+			httpError(w, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	if msg.CrosspostedAt.Valid {
+		httpError(w, "message already crossposted", http.StatusConflict)
+		return
+	}
+
+	followers, err := s.channelFollowers(ctx, ch.ID)
+	if err != nil {
+		log.Printf("load channel followers: %v", err)
+		httpError(w, "failed to crosspost message", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := s.db.ExecContext(ctx, `UPDATE channel_messages SET crossposted_at = ? WHERE id = ? AND crossposted_at IS NULL`, time.Now().UTC(), msg.ID)
+	if err != nil {
+		log.Printf("mark crossposted: %v", err)
+		httpError(w, "failed to crosspost message", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		httpError(w, "message already crossposted", http.StatusConflict)
+		return
+	}
+
+	delivered := 0
+	for _, f := range followers {
+		if _, err := s.saveCopiedMessage(ctx, f.TargetChannelID, msg.AuthorEmail, msg); err != nil {
+			log.Printf("crosspost to channel %d: %v", f.TargetChannelID, err)
+			continue
+		}
+		delivered++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int{"delivered": delivered}); err != nil {
+		log.Printf("encode crosspost response: %v", err)
+	}
+}
+
+func (s *serverState) handleChannelFollowers(w http.ResponseWriter, r *http.Request, ch channelInfo, currentUser user, rawTargetID string) {
+	ctx := r.Context()
+	if ch.Kind != "announcement" {
+		httpError(w, "only announcement channels can be followed", http.StatusBadRequest)
+		return
+	}
+
+	if rawTargetID != "" {
+		targetID, err := strconv.ParseInt(rawTargetID, 10, 64)
+		if err != nil {
+			httpError(w, "invalid channel id", http.StatusBadRequest)
+			return
+		}
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "DELETE")
+			httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		target, exists, err := s.channelByID(ctx, targetID)
+		if err != nil {
+			log.Printf("load follow target: %v", err)
+			httpError(w, "failed to unfollow channel", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			httpError(w, "not found", http.StatusNotFound)
+			return
+		}
+		canManage, err := s.canManageServer(ctx, currentUser.Email, target.ServerID)
+		if err != nil {
+			log.Printf("check unfollow permission: %v", err)
+			httpError(w, "failed to unfollow channel", http.StatusInternalServerError)
+			return
+		}
+		if !canManage {
+			httpError(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM channel_follows WHERE source_channel_id = ? AND target_channel_id = ?`, ch.ID, targetID); err != nil {
+			log.Printf("delete channel follow: %v", err)
+			httpError(w, "failed to unfollow channel", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		followers, err := s.channelFollowers(ctx, ch.ID)
+		if err != nil {
+			log.Printf("list channel followers: %v", err)
+			httpError(w, "failed to list followers", http.StatusInternalServerError)
+			return
+		}
+		if followers == nil {
+			followers = []channelFollowDTO{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(followers); err != nil {
+			log.Printf("encode channel followers: %v", err)
+		}
+	case http.MethodPost:
+		var body struct {
+			ChannelID int64 `json:"channelId" validate:"required"`
+		}
+		if !s.decodeJSON(w, r, &body) {
+			return
+		}
+		target, exists, err := s.channelByID(ctx, body.ChannelID)
+		if err != nil {
+			log.Printf("load follow target: %v", err)
+			httpError(w, "failed to follow channel", http.StatusInternalServerError)
+			return
+		}
+		if !exists || target.Kind == "voice" || target.Kind == "dm" {
+			httpError(w, "target must be a text channel", http.StatusBadRequest)
+			return
+		}
+		if target.ID == ch.ID {
+			httpError(w, "a channel cannot follow itself", http.StatusBadRequest)
+			return
+		}
+		canManage, err := s.canManageServer(ctx, currentUser.Email, target.ServerID)
+		if err != nil {
+			log.Printf("check follow permission: %v", err)
+			httpError(w, "failed to follow channel", http.StatusInternalServerError)
+			return
+		}
+		if !canManage {
+			httpError(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		follow := channelFollowDTO{
+			SourceChannelID: ch.ID,
+			TargetChannelID: target.ID,
+			TargetServerID:  target.ServerID,
+			CreatedByID:     currentUser.ID,
+			CreatedByHandle: currentUser.Handle,
+			CreatedAt:       time.Now().UTC(),
+		}
+		if _, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO channel_follows (source_channel_id, target_channel_id, created_by_id, created_at) VALUES (?, ?, ?, ?)`,
+			follow.SourceChannelID, follow.TargetChannelID, follow.CreatedByID, follow.CreatedAt); err != nil {
+			log.Printf("create channel follow: %v", err)
+			httpError(w, "failed to follow channel", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(follow); err != nil {
+			log.Printf("encode channel follow: %v", err)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	friendPending  = "pending"
+	friendAccepted = "accepted"
+	friendBlocked  = "blocked"
+	friendNone     = "none"
+
+	dmPolicyOpen    = "open"
+	dmPolicyMutual  = "mutual"
+	dmPolicyFriends = "friends"
+
+	sharePresenceEveryone = "everyone"
+	sharePresenceFriends  = "friends"
+)
+
+// presenceHidden is true when subject keeps their presence from viewer:
+// they share it with friends only and viewer is not one, or either has
+// blocked the other. Queries alias the two users' rows as subject and
+// viewer.
+const presenceHidden = `(
+    (subject.share_presence = 'friends' AND NOT EXISTS (
+        SELECT 1 FROM friendships f WHERE f.user_id = subject.id AND f.friend_id = viewer.id AND f.status = 'accepted'))
+    OR EXISTS (
+        SELECT 1 FROM friendships b WHERE b.status = 'blocked'
+          AND ((b.user_id = subject.id AND b.friend_id = viewer.id) OR (b.user_id = viewer.id AND b.friend_id = subject.id)))
+)`
+
+// dmPolicyFromEnv reads DM_POLICY: who may open or keep writing to a direct
+// conversation with someone. Blocks apply whatever the policy.
+func dmPolicyFromEnv() string {
+	policy := strings.ToLower(strings.TrimSpace(envOrDefault("DM_POLICY", dmPolicyOpen)))
+	switch policy {
+	case dmPolicyOpen, dmPolicyMutual, dmPolicyFriends:
+		return policy
+	}
+	log.Printf("unknown DM_POLICY=%q, direct messages are limited to friends", os.Getenv("DM_POLICY"))
+	return dmPolicyFriends
+}
+
+// relationshipDTO is the signed-in user's view of their relationship with
+// User. Incoming marks a pending request User sent them. Status is none
+// once there is nothing left, including when User has blocked them.
+type relationshipDTO struct {
+	User     userDTO      `json:"user"`
+	Status   string       `json:"status"`
+	Incoming bool         `json:"incoming,omitempty"`
+	Since    *time.Time   `json:"since,omitempty"`
+	Presence *presenceDTO `json:"presence,omitempty"`
+}
+
+// relation holds the friendships rows between two users, one per direction.
+// Accepted friendships have both; requests and blocks only the sender's.
+type relation struct {
+	mine, theirs           string
+	mineSince, theirsSince time.Time
+}
+
+type sqlRowsQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func loadRelation(ctx context.Context, db sqlRowsQueryer, me, other int64) (relation, error) {
+	rows, err := db.QueryContext(ctx, `
+        SELECT user_id, status, created_at FROM friendships
+        WHERE (user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)
+    `, me, other, other, me)
+	if err != nil {
+		return relation{}, err
+	}
+	defer rows.Close()
+	var rel relation
+	for rows.Next() {
+		var userID int64
+		var status string
+		var since time.Time
+		if err := rows.Scan(&userID, &status, &since); err != nil {
+			return relation{}, err
+		}
+		if userID == me {
+			rel.mine, rel.mineSince = status, since
+		} else {
+			rel.theirs, rel.theirsSince = status, since
+		}
+	}
+	return rel, rows.Err()
+}
+
+func (rel relation) view(other user) relationshipDTO {
+	dto := relationshipDTO{User: userDTO{ID: other.ID, Handle: other.Handle, DisplayName: other.DisplayName}, Status: friendNone}
+	switch {
+	case rel.mine != "":
+		since := rel.mineSince.UTC()
+		dto.Status, dto.Since = rel.mine, &since
+	case rel.theirs == friendPending:
+		since := rel.theirsSince.UTC()
+		dto.Status, dto.Incoming, dto.Since = friendPending, true, &since
+	}
+	return dto
+}
+
+// dmRefusal explains why from may not message to, or returns "" when they
+// may.
+func (s *serverState) dmRefusal(ctx context.Context, from, to int64) (string, error) {
+	if from == to {
+		return "", nil
+	}
+	var blocked, friends, mutual bool
+	err := s.stmts.QueryRowContext(ctx, `
+        SELECT
+            EXISTS(SELECT 1 FROM friendships WHERE status = 'blocked' AND ((user_id = ?1 AND friend_id = ?2) OR (user_id = ?2 AND friend_id = ?1))),
+            EXISTS(SELECT 1 FROM friendships WHERE user_id = ?1 AND friend_id = ?2 AND status = 'accepted'),
+            EXISTS(SELECT 1 FROM server_members a JOIN server_members b ON b.server_id = a.server_id WHERE a.user_id = ?1 AND b.user_id = ?2)
+    `, from, to).Scan(&blocked, &friends, &mutual)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case blocked:
+		return "you cannot message this user", nil
+	case s.dmPolicy == dmPolicyFriends && !friends:
+		return "direct messages are limited to friends", nil
+	case s.dmPolicy == dmPolicyMutual && !friends && !mutual:
+		return "direct messages are limited to friends and members of a shared server", nil
+	}
+	return "", nil
+}
+
+// canPostInDirect applies dmRefusal to everyone else in the conversation,
+// so a block or an ended friendship also stops an existing one.
+func (s *serverState) canPostInDirect(ctx context.Context, email string, channelID int64) (bool, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT u.id, u.email FROM dm_participants p JOIN users u ON u.email = p.user_email WHERE p.channel_id = ?
+    `, channelID)
+	if err != nil {
+		return false, err
+	}
+	var senderID int64
+	var others []int64
+	for rows.Next() {
+		var id int64
+		var participant string
+		if err := rows.Scan(&id, &participant); err != nil {
+			rows.Close()
+			return false, err
+		}
+		if participant == email {
+			senderID = id
+		} else {
+			others = append(others, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	for _, other := range others {
+		refusal, err := s.dmRefusal(ctx, senderID, other)
+		if err != nil || refusal != "" {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// hidePresenceFrom turns the presence of members who keep it from viewer
+// into offline.
+func (s *serverState) hidePresenceFrom(ctx context.Context, viewerID, serverID int64, members []memberInfo) error {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT subject.id FROM server_members sm
+        JOIN users subject ON subject.id = sm.user_id
+        JOIN users viewer ON viewer.id = ?
+        WHERE sm.server_id = ? AND subject.id != viewer.id AND `+presenceHidden,
+		viewerID, serverID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	hidden := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		hidden[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for i := range members {
+		if hidden[members[i].ID] {
+			members[i].Presence = &presenceDTO{UserID: members[i].ID, Status: presenceOffline}
+		}
+	}
+	return nil
+}
+
+// presenceFor is subject's presence as viewer sees it.
+func (s *serverState) presenceFor(ctx context.Context, subject user, viewerID int64) (presenceDTO, error) {
+	var hidden bool
+	if err := s.readDB.QueryRowContext(ctx, `
+        SELECT `+presenceHidden+` FROM users subject JOIN users viewer ON viewer.id = ? WHERE subject.id = ?
+    `, viewerID, subject.ID).Scan(&hidden); err != nil {
+		return presenceDTO{}, err
+	}
+	if hidden {
+		return presenceDTO{UserID: subject.ID, Status: presenceOffline}, nil
+	}
+	settings, err := s.presenceSettings(ctx, subject.ID)
+	if err != nil {
+		return presenceDTO{}, err
+	}
+	return s.visiblePresence(subject.ID, subject.Email, settings), nil
+}
+
+func (s *serverState) relationshipsFor(ctx context.Context, u user) ([]relationshipDTO, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT o.id, o.email, o.handle, o.display_name, f.status, f.user_id != ?1, f.created_at,
+               o.presence, o.custom_status_text, o.custom_status_emoji, o.custom_status_expires_at
+        FROM friendships f
+        JOIN users o ON o.id = CASE WHEN f.user_id = ?1 THEN f.friend_id ELSE f.user_id END
+        WHERE f.user_id = ?1 OR (f.friend_id = ?1 AND f.status = 'pending')
+        ORDER BY f.status, o.display_name
+    `, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []relationshipDTO{}
+	for rows.Next() {
+		var rel relationshipDTO
+		var email, status, text, emoji string
+		var since time.Time
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&rel.User.ID, &email, &rel.User.Handle, &rel.User.DisplayName, &rel.Status, &rel.Incoming, &since,
+			&status, &text, &emoji, &expiresAt); err != nil {
+			return nil, err
+		}
+		since = since.UTC()
+		rel.Since = &since
+		if rel.Status == friendAccepted {
+			presence := s.visiblePresence(rel.User.ID, email, scanPresence(status, text, emoji, expiresAt))
+			rel.Presence = &presence
+		}
+		result = append(result, rel)
+	}
+	return result, rows.Err()
+}
+
+// announceRelationship sends friend:update to both users, each with their
+// own view, and the presence each may now see of the other.
+func (s *serverState) announceRelationship(ctx context.Context, a, b user) {
+	for _, pair := range [][2]user{{a, b}, {b, a}} {
+		viewer, other := pair[0], pair[1]
+		rel, err := loadRelation(ctx, s.readDB, viewer.ID, other.ID)
+		if err != nil {
+			log.Printf("load relationship: %v", err)
+			return
+		}
+		dto := rel.view(other)
+		presence, err := s.presenceFor(ctx, other, viewer.ID)
+		if err != nil {
+			log.Printf("load presence: %v", err)
+			return
+		}
+		if dto.Status == friendAccepted {
+			dto.Presence = &presence
+		}
+		s.ws.sendToUser(viewer.Email, wsOutbound{Type: "friend:update", Relationship: &dto})
+		s.ws.sendToUser(viewer.Email, wsOutbound{Type: "presence:update", Presence: &presence})
+	}
+}
+
+// handleFriends serves /api/friends: GET lists the signed-in user's friends,
+// requests in both directions and blocks; POST sends a friend request.
+// /api/friends/{userId} and its accept, decline and block actions are
+// handled by handleFriend.
+func (s *serverState) handleFriends(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if rest := strings.Trim(r.URL.Path, "/"); rest != "" {
+		s.handleFriend(w, r, currentUser, rest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		relationships, err := s.relationshipsFor(r.Context(), currentUser)
+		if err != nil {
+			log.Printf("list friends: %v", err)
+			httpError(w, "failed to list friends", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(relationships); err != nil {
+			log.Printf("encode friends: %v", err)
+		}
+	case http.MethodPost:
+		defer r.Body.Close()
+		var body struct {
+			Handle string `json:"handle" validate:"trim"`
+			Email  string `json:"email" validate:"trim"`
+		}
+		if !s.decodeJSON(w, r, &body) {
+			return
+		}
+		if body.Handle == "" && body.Email == "" {
+			httpError(w, "handle or email is required", http.StatusBadRequest)
+			return
+		}
+		other, exists, err := s.lookupRecipient(r.Context(), currentUser.TenantID, body.Handle, body.Email)
+		if err != nil {
+			log.Printf("lookup friend: %v", err)
+			httpError(w, "failed to send friend request", http.StatusInternalServerError)
+			return
+		} else if !exists {
+			httpError(w, "user not found", http.StatusNotFound)
+			return
+		}
+		if other.ID == currentUser.ID {
+			httpError(w, "you cannot befriend yourself", http.StatusBadRequest)
+			return
+		}
+		s.sendFriendRequest(w, r, currentUser, other)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// sendFriendRequest asks other to be friends, or accepts straight away when
+// they had already asked.
+func (s *serverState) sendFriendRequest(w http.ResponseWriter, r *http.Request, currentUser, other user) {
+	status := http.StatusCreated
+	err := s.changeRelation(r.Context(), currentUser.ID, other.ID, func(tx *sql.Tx, rel relation, now time.Time) error {
+		switch {
+		case rel.mine == friendBlocked || rel.theirs == friendBlocked:
+			return errFriendForbidden
+		case rel.mine == friendAccepted:
+			return errAlreadyFriends
+		case rel.mine == friendPending:
+			return errRequestPending
+		case rel.theirs == friendPending:
+			status = http.StatusOK
+			return acceptFriend(r.Context(), tx, currentUser.ID, other.ID, now)
+		}
+		_, err := tx.ExecContext(r.Context(), `INSERT INTO friendships (user_id, friend_id, status, created_at) VALUES (?, ?, 'pending', ?)`, currentUser.ID, other.ID, now)
+		return err
+	})
+	s.finishRelationChange(w, r, currentUser, other, status, err)
+}
+
+var (
+	errFriendForbidden = errors.New("you cannot send a friend request to this user")
+	errAlreadyFriends  = errors.New("you are already friends")
+	errRequestPending  = errors.New("friend request already sent")
+	errNoRelation      = errors.New("friendship not found")
+)
+
+func acceptFriend(ctx context.Context, tx *sql.Tx, me, other int64, now time.Time) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE friendships SET status = 'accepted', created_at = ? WHERE user_id = ? AND friend_id = ?`, now, other, me); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO friendships (user_id, friend_id, status, created_at) VALUES (?, ?, 'accepted', ?)`, me, other, now)
+	return err
+}
+
+// changeRelation runs change on the current rows between me and other in a
+// transaction.
+func (s *serverState) changeRelation(ctx context.Context, me, other int64, change func(tx *sql.Tx, rel relation, now time.Time) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rel, err := loadRelation(ctx, tx, me, other)
+	if err != nil {
+		return err
+	}
+	if err := change(tx, rel, time.Now().UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// finishRelationChange answers a change made with changeRelation: the new
+// relationship with status, or the error.
+func (s *serverState) finishRelationChange(w http.ResponseWriter, r *http.Request, currentUser, other user, status int, err error) {
+	switch {
+	case errors.Is(err, errFriendForbidden):
+		httpError(w, err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, errAlreadyFriends), errors.Is(err, errRequestPending):
+		httpError(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errNoRelation):
+		httpError(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("update friendship: %v", err)
+		httpError(w, "failed to update friendship", http.StatusInternalServerError)
+		return
+	}
+	s.announceRelationship(r.Context(), currentUser, other)
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	rel, err := loadRelation(r.Context(), s.readDB, currentUser.ID, other.ID)
+	if err != nil {
+		log.Printf("load relationship: %v", err)
+		httpError(w, "failed to update friendship", http.StatusInternalServerError)
+		return
+	}
+	dto := rel.view(other)
+	if dto.Status == friendAccepted {
+		if presence, err := s.presenceFor(r.Context(), other, currentUser.ID); err == nil {
+			dto.Presence = &presence
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(dto); err != nil {
+		log.Printf("encode relationship: %v", err)
+	}
+}
+
+// handleFriend serves the actions on one user, by ID:
+//
+//	POST   /api/friends/{id}/accept   accept their request
+//	POST   /api/friends/{id}/decline  decline their request
+//	DELETE /api/friends/{id}          unfriend, or cancel your request
+//	PUT    /api/friends/{id}/block    block them
+//	DELETE /api/friends/{id}/block    unblock them
+func (s *serverState) handleFriend(w http.ResponseWriter, r *http.Request, currentUser user, rest string) {
+	idPart, action, _ := strings.Cut(rest, "/")
+	otherID, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil || otherID <= 0 || otherID == currentUser.ID {
+		httpError(w, "user not found", http.StatusNotFound)
+		return
+	}
+	other, exists, err := s.getUserByID(r.Context(), otherID)
+	if err != nil {
+		log.Printf("load user %d: %v", otherID, err)
+		httpError(w, "failed to update friendship", http.StatusInternalServerError)
+		return
+	}
+	if !exists || other.Email == systemUserEmail {
+		httpError(w, "user not found", http.StatusNotFound)
+		return
+	}
+	ctx := r.Context()
+
+	var change func(tx *sql.Tx, rel relation, now time.Time) error
+	status := http.StatusOK
+	switch {
+	case action == "accept" && r.Method == http.MethodPost:
+		change = func(tx *sql.Tx, rel relation, now time.Time) error {
+			if rel.theirs != friendPending || rel.mine != "" {
+				return errNoRelation
+			}
+			return acceptFriend(ctx, tx, currentUser.ID, other.ID, now)
+		}
+	case action == "decline" && r.Method == http.MethodPost:
+		status = http.StatusNoContent
+		change = func(tx *sql.Tx, rel relation, now time.Time) error {
+			if rel.theirs != friendPending {
+				return errNoRelation
+			}
+			_, err := tx.ExecContext(ctx, `DELETE FROM friendships WHERE user_id = ? AND friend_id = ?`, other.ID, currentUser.ID)
+			return err
+		}
+	case action == "" && r.Method == http.MethodDelete:
+		status = http.StatusNoContent
+		change = func(tx *sql.Tx, rel relation, now time.Time) error {
+			switch rel.mine {
+			case friendAccepted:
+				_, err := tx.ExecContext(ctx, `DELETE FROM friendships WHERE (user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)`, currentUser.ID, other.ID, other.ID, currentUser.ID)
+				return err
+			case friendPending:
+				_, err := tx.ExecContext(ctx, `DELETE FROM friendships WHERE user_id = ? AND friend_id = ?`, currentUser.ID, other.ID)
+				return err
+			}
+			return errNoRelation
+		}
+	case action == "block" && r.Method == http.MethodPut:
+		// Blocking ends any friendship or request, but keeps a block the
+		// other user placed.
+		change = func(tx *sql.Tx, rel relation, now time.Time) error {
+			if rel.mine == friendBlocked {
+				return nil
+			}
+			if _, err := tx.ExecContext(ctx, `
+                DELETE FROM friendships
+                WHERE (user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ? AND status != 'blocked')
+            `, currentUser.ID, other.ID, other.ID, currentUser.ID); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `INSERT INTO friendships (user_id, friend_id, status, created_at) VALUES (?, ?, 'blocked', ?)`, currentUser.ID, other.ID, now)
+			return err
+		}
+	case action == "block" && r.Method == http.MethodDelete:
+		status = http.StatusNoContent
+		change = func(tx *sql.Tx, rel relation, now time.Time) error {
+			if rel.mine != friendBlocked {
+				return errNoRelation
+			}
+			_, err := tx.ExecContext(ctx, `DELETE FROM friendships WHERE user_id = ? AND friend_id = ?`, currentUser.ID, other.ID)
+			return err
+		}
+	case action == "accept", action == "decline":
+		w.Header().Set("Allow", "POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	case action == "":
+		w.Header().Set("Allow", "DELETE")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	case action == "block":
+		w.Header().Set("Allow", "PUT, DELETE")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	err = s.changeRelation(ctx, currentUser.ID, other.ID, change)
+	s.finishRelationChange(w, r, currentUser, other, status, err)
+}
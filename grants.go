@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxGrantDuration = 30 * 24 * time.Hour
+	grantExpiryEvery = 5 * time.Second
+)
+
+// channelGrant gives a member extra permissions in one channel until
+// ExpiresAt, on top of whatever their role and overrides allow.
+type channelGrant struct {
+	ID          int64
+	ChannelID   int64
+	UserID      int64
+	Email       string
+	Handle      string
+	DisplayName string
+	Allow       channelPermission
+	GrantedByID int64
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+type grantDTO struct {
+	ID          int64     `json:"id"`
+	ChannelID   int64     `json:"channelId"`
+	UserID      int64     `json:"userId"`
+	Handle      string    `json:"handle"`
+	DisplayName string    `json:"displayName"`
+	Allow       []string  `json:"allow"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+func toGrantDTO(g channelGrant) grantDTO {
+	return grantDTO{
+		ID:          g.ID,
+		ChannelID:   g.ChannelID,
+		UserID:      g.UserID,
+		Handle:      g.Handle,
+		DisplayName: g.DisplayName,
+		Allow:       g.Allow.names(),
+		CreatedAt:   g.CreatedAt,
+		ExpiresAt:   g.ExpiresAt,
+	}
+}
+
+// channelGrants lists a channel's grants, soonest to expire first. Expired
+// ones stay until runGrantExpiry deletes them, so callers check ExpiresAt.
+func (s *serverState) channelGrants(ctx context.Context, channelID int64) ([]channelGrant, error) {
+	if grants, ok := s.grantCache.get(channelID); ok {
+		return grants, nil
+	}
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT g.id, g.channel_id, u.id, u.email, u.handle, u.display_name, g.allow, g.granted_by_id, g.created_at, g.expires_at
+        FROM channel_access_grants g JOIN users u ON u.id = g.user_id
+        WHERE g.channel_id = ?
+        ORDER BY g.expires_at, g.id
+    `, channelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var grants []channelGrant
+	for rows.Next() {
+		var g channelGrant
+		var grantedBy sql.NullInt64
+		if err := rows.Scan(&g.ID, &g.ChannelID, &g.UserID, &g.Email, &g.Handle, &g.DisplayName, &g.Allow, &grantedBy, &g.CreatedAt, &g.ExpiresAt); err != nil {
+			return nil, err
+		}
+		g.GrantedByID = grantedBy.Int64
+		grants = append(grants, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	s.grantCache.set(channelID, grants)
+	return grants, nil
+}
+
+// handleChannelGrants serves /api/channels/{id}/grants to members who can
+// manage the channel: GET lists the active grants, POST gives a member
+// permissions until expiresAt, and DELETE /{grantId} revokes one early.
+func (s *serverState) handleChannelGrants(w http.ResponseWriter, r *http.Request, ch channelInfo, currentUser user, rest []string) {
+	ctx := r.Context()
+	if ch.Kind == "dm" {
+		httpError(w, "direct messages have no access grants", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case len(rest) == 0 && r.Method != http.MethodGet && r.Method != http.MethodPost:
+		w.Header().Set("Allow", "GET, POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	case len(rest) == 1 && r.Method != http.MethodDelete:
+		w.Header().Set("Allow", "DELETE")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	case len(rest) > 1:
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	canManage, err := s.canManageChannel(ctx, currentUser.Email, ch)
+	if err != nil {
+		log.Printf("check channel manage permission: %v", err)
+		httpError(w, "failed to load grants", http.StatusInternalServerError)
+		return
+	}
+	if !canManage {
+		httpError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case len(rest) == 1:
+		s.revokeChannelGrant(w, r, ch, currentUser, rest[0])
+	case r.Method == http.MethodPost:
+		s.createChannelGrant(w, r, ch, currentUser)
+	default:
+		grants, err := s.channelGrants(ctx, ch.ID)
+		if err != nil {
+			log.Printf("list channel grants: %v", err)
+			httpError(w, "failed to load grants", http.StatusInternalServerError)
+			return
+		}
+		now := time.Now()
+		result := make([]grantDTO, 0, len(grants))
+		for _, g := range grants {
+			if g.ExpiresAt.After(now) {
+				result = append(result, toGrantDTO(g))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.Printf("encode channel grants: %v", err)
+		}
+	}
+}
+
+func (s *serverState) createChannelGrant(w http.ResponseWriter, r *http.Request, ch channelInfo, currentUser user) {
+	ctx := r.Context()
+	var body struct {
+		UserID    int64     `json:"userId"`
+		Allow     []string  `json:"allow"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	if !s.decodeJSON(w, r, &body) {
+		return
+	}
+	var fieldErrs []fieldError
+	allow, ok := parsePermissions(body.Allow)
+	if !ok {
+		fieldErrs = append(fieldErrs, fieldError{Field: "allow", Message: "must only contain view, post and manage"})
+	} else if allow == 0 {
+		fieldErrs = append(fieldErrs, fieldError{Field: "allow", Message: "is required"})
+	}
+	now := time.Now().UTC()
+	if !body.ExpiresAt.After(now) {
+		fieldErrs = append(fieldErrs, fieldError{Field: "expiresAt", Message: "must be in the future"})
+	} else if body.ExpiresAt.Sub(now) > maxGrantDuration {
+		fieldErrs = append(fieldErrs, fieldError{Field: "expiresAt", Message: "must be within 30 days"})
+	}
+	if body.UserID <= 0 {
+		fieldErrs = append(fieldErrs, fieldError{Field: "userId", Message: "is required"})
+	}
+	if len(fieldErrs) > 0 {
+		writeValidationErrors(w, fieldErrs)
+		return
+	}
+
+	g := channelGrant{ChannelID: ch.ID, Allow: allow, GrantedByID: currentUser.ID, CreatedAt: now, ExpiresAt: body.ExpiresAt.UTC()}
+	err := s.readDB.QueryRowContext(ctx, `
+        SELECT u.id, u.email, u.handle, u.display_name
+        FROM server_members sm JOIN users u ON u.id = sm.user_id
+        WHERE sm.server_id = ? AND sm.user_id = ?
+    `, ch.ServerID, body.UserID).Scan(&g.UserID, &g.Email, &g.Handle, &g.DisplayName)
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, "member not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = s.db.QueryRowContext(ctx, `
+            INSERT INTO channel_access_grants (channel_id, user_id, allow, granted_by_id, created_at, expires_at)
+            VALUES (?, ?, ?, ?, ?, ?)
+            RETURNING id
+        `, g.ChannelID, g.UserID, g.Allow, g.GrantedByID, g.CreatedAt, g.ExpiresAt).Scan(&g.ID)
+	}
+	if err != nil {
+		log.Printf("create channel grant: %v", err)
+		httpError(w, "failed to create grant", http.StatusInternalServerError)
+		return
+	}
+	s.grantCache.delete(ch.ID)
+	s.recordAudit(ctx, ch.ServerID, currentUser.Email, "channel.grant", "channel", strconv.FormatInt(ch.ID, 10),
+		"grant="+strconv.FormatInt(g.ID, 10)+" member="+strconv.FormatInt(g.UserID, 10)+" allow="+strings.Join(g.Allow.names(), ",")+" until="+g.ExpiresAt.Format(time.RFC3339))
+	s.notifyChannelPermissionsTo(ctx, ch, g.Email)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(toGrantDTO(g)); err != nil {
+		log.Printf("encode channel grant: %v", err)
+	}
+}
+
+func (s *serverState) revokeChannelGrant(w http.ResponseWriter, r *http.Request, ch channelInfo, currentUser user, rawID string) {
+	ctx := r.Context()
+	grantID, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil || grantID <= 0 {
+		httpError(w, "invalid grant id", http.StatusBadRequest)
+		return
+	}
+	var email string
+	err = s.db.QueryRowContext(ctx, `
+        DELETE FROM channel_access_grants WHERE id = ? AND channel_id = ?
+        RETURNING (SELECT email FROM users WHERE id = user_id)
+    `, grantID, ch.ID).Scan(&email)
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, "grant not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("revoke channel grant: %v", err)
+		httpError(w, "failed to revoke grant", http.StatusInternalServerError)
+		return
+	}
+	s.grantCache.delete(ch.ID)
+	s.recordAudit(ctx, ch.ServerID, currentUser.Email, "channel.grant_revoke", "channel", strconv.FormatInt(ch.ID, 10), "grant="+rawID)
+	s.notifyChannelPermissionsTo(ctx, ch, email)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runGrantExpiry deletes access grants as they run out, records each in the
+// audit log and tells the member what they may still do. Permission checks
+// already ignore expired grants, so a missed tick only delays the event.
+func (s *serverState) runGrantExpiry(ctx context.Context) {
+	ticker := time.NewTicker(grantExpiryEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.deleteExpiredGrants(ctx); err != nil {
+			log.Printf("delete expired grants: %v", err)
+		}
+	}
+}
+
+func (s *serverState) deleteExpiredGrants(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, `
+        DELETE FROM channel_access_grants
+        WHERE expires_at <= ?
+        RETURNING id, channel_id, (SELECT email FROM users WHERE id = user_id)
+    `, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	type expiredGrant struct {
+		id, channelID int64
+		email         string
+	}
+	var expired []expiredGrant
+	for rows.Next() {
+		var g expiredGrant
+		if err := rows.Scan(&g.id, &g.channelID, &g.email); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, g := range expired {
+		s.grantCache.delete(g.channelID)
+		ch, ok, err := s.channelByID(ctx, g.channelID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		s.recordAudit(ctx, ch.ServerID, systemUserEmail, "channel.grant_expire", "channel", strconv.FormatInt(ch.ID, 10), "grant="+strconv.FormatInt(g.id, 10))
+		s.notifyChannelPermissionsTo(ctx, ch, g.email)
+	}
+	return nil
+}
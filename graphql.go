@@ -0,0 +1,640 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// /api/graphql is a read-only view of the same data as bootstrap and the
+// REST endpoints, for clients that want to pick what they load. Every field
+// applies the rules its REST counterpart does: servers are those the user
+// belongs to, channels those they can view, and a user's email is only
+// shown on their own record.
+const graphQLSchema = `
+# An RFC 3339 timestamp.
+scalar Time
+
+schema {
+	query: Query
+}
+
+type Query {
+	# The signed-in user.
+	me: User!
+	# The servers the user belongs to, by name.
+	servers: [Server!]!
+	# A server the user belongs to, or null.
+	server(id: ID!): Server
+	# A channel or DM the user can view, or null.
+	channel(id: ID!): Channel
+}
+
+type User {
+	id: ID!
+	handle: String!
+	displayName: String!
+	# Only on the signed-in user's own record.
+	email: String
+}
+
+type Server {
+	id: ID!
+	slug: String!
+	name: String!
+	description: String!
+	createdAt: Time!
+	# The signed-in user's role: owner, admin or member.
+	role: String!
+	memberCount: Int!
+	# The channels the user can view, oldest first.
+	channels: [Channel!]!
+	# Members in member list order: up to first (at most 100) after the
+	# member with ID after. query matches the start of a handle or display
+	# name.
+	members(first: Int = 50, after: ID, query: String): [Member!]!
+}
+
+type Member {
+	user: User!
+	role: String!
+	joinedAt: Time!
+	# online, idle, dnd or offline, as the signed-in user may see it.
+	status: String!
+}
+
+type Channel {
+	id: ID!
+	# Null for DMs.
+	server: Server
+	slug: String!
+	name: String!
+	# text, voice, announcement or dm.
+	type: String!
+	topic: String!
+	readOnly: Boolean!
+	createdAt: Time!
+	# The latest messages, oldest first: up to last (at most 100) before the
+	# message with ID before.
+	messages(last: Int = 50, before: ID): [Message!]!
+}
+
+type Message {
+	id: ID!
+	channel: Channel!
+	author: User!
+	content: String!
+	createdAt: Time!
+	expiresAt: Time
+}
+`
+
+const (
+	graphQLMaxDepth       = 10
+	graphQLMaxQueryLength = 16 << 10
+	graphQLMaxParallelism = 16
+	graphQLMaxPage        = 100
+)
+
+var errGraphQLInternal = errors.New("internal error")
+
+func newGraphQLSchema() *graphql.Schema {
+	return graphql.MustParseSchema(graphQLSchema, &graphQLQuery{},
+		graphql.MaxDepth(graphQLMaxDepth),
+		graphql.MaxQueryLength(graphQLMaxQueryLength),
+		graphql.MaxParallelism(graphQLMaxParallelism),
+	)
+}
+
+// handleGraphQL serves /api/graphql: POST a JSON body with query,
+// operationName and variables, or GET with the same as query parameters.
+func (s *serverState) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		Query         string         `json:"query" validate:"required"`
+		OperationName string         `json:"operationName"`
+		Variables     map[string]any `json:"variables"`
+	}
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		body.Query = q.Get("query")
+		body.OperationName = q.Get("operationName")
+		if raw := q.Get("variables"); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &body.Variables); err != nil {
+				httpError(w, "variables must be a JSON object", http.StatusBadRequest)
+				return
+			}
+		}
+		if body.Query == "" {
+			writeValidationErrors(w, []fieldError{{Field: "query", Message: "is required"}})
+			return
+		}
+	case http.MethodPost:
+		if !s.decodeJSON(w, r, &body) {
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), graphQLRequestKey{}, newGraphQLRequest(s, currentUser))
+	response := s.graphQL.Exec(ctx, body.Query, body.OperationName, body.Variables)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("encode graphql response: %v", err)
+	}
+}
+
+type graphQLRequestKey struct{}
+
+// graphQLRequest is what the resolvers of one request share: who is asking
+// and the loaders that batch their lookups.
+type graphQLRequest struct {
+	s      *serverState
+	viewer user
+
+	serverChannels *batchLoader[int64, []channelInfo]
+	servers        *batchLoader[int64, serverInfo]
+	memberCounts   *batchLoader[int64, int32]
+}
+
+func newGraphQLRequest(s *serverState, viewer user) *graphQLRequest {
+	req := &graphQLRequest{s: s, viewer: viewer}
+	req.serverChannels = newBatchLoader(req.loadServerChannels)
+	req.servers = newBatchLoader(req.loadServers)
+	req.memberCounts = newBatchLoader(req.loadMemberCounts)
+	return req
+}
+
+func graphQLFrom(ctx context.Context) *graphQLRequest {
+	return ctx.Value(graphQLRequestKey{}).(*graphQLRequest)
+}
+
+// loadServerChannels returns the channels of each server the viewer can
+// view, in two queries however many servers there are.
+func (q *graphQLRequest) loadServerChannels(ctx context.Context, serverIDs []int64) (map[int64][]channelInfo, error) {
+	args := make([]any, len(serverIDs))
+	for i, id := range serverIDs {
+		args[i] = id
+	}
+	rows, err := q.s.readDB.QueryContext(ctx, `
+        SELECT `+channelColumns+`
+        FROM channels
+        WHERE server_id IN (?`+strings.Repeat(", ?", len(serverIDs)-1)+`)
+        ORDER BY created_at
+    `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var channels []channelInfo
+	var channelIDs []int64
+	for rows.Next() {
+		ch, err := scanChannel(rows)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, ch)
+		channelIDs = append(channelIDs, ch.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	allowed, err := q.s.accessibleChannelIDs(ctx, q.viewer.Email, channelIDs)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[int64][]channelInfo, len(serverIDs))
+	for _, id := range serverIDs {
+		result[id] = []channelInfo{}
+	}
+	for _, ch := range channels {
+		if allowed[ch.ID] {
+			result[ch.ServerID] = append(result[ch.ServerID], ch)
+		}
+	}
+	return result, nil
+}
+
+func (q *graphQLRequest) loadServers(ctx context.Context, ids []int64) (map[int64]serverInfo, error) {
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := q.s.readDB.QueryContext(ctx, `SELECT `+serverColumns+` FROM servers srv WHERE srv.id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[int64]serverInfo, len(ids))
+	for rows.Next() {
+		srv, err := scanServer(rows)
+		if err != nil {
+			return nil, err
+		}
+		result[srv.ID] = srv
+	}
+	return result, rows.Err()
+}
+
+func (q *graphQLRequest) loadMemberCounts(ctx context.Context, serverIDs []int64) (map[int64]int32, error) {
+	args := make([]any, len(serverIDs))
+	for i, id := range serverIDs {
+		args[i] = id
+	}
+	rows, err := q.s.readDB.QueryContext(ctx, `
+        SELECT server_id, COUNT(*) FROM server_members
+        WHERE server_id IN (?`+strings.Repeat(", ?", len(serverIDs)-1)+`)
+        GROUP BY server_id
+    `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[int64]int32, len(serverIDs))
+	for rows.Next() {
+		var id int64
+		var n int32
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		result[id] = n
+	}
+	return result, rows.Err()
+}
+
+// batchLoader collects the keys the resolvers of one request ask for and
+// fetches them together, so listing N servers with their channels takes a
+// query for the servers and one for all their channels rather than N+1.
+// A resolver returning a list primes the loader with its items' keys
+// before they resolve; the first load then fetches every queued key at once.
+// Results are kept for the rest of the request.
+type batchLoader[K comparable, V any] struct {
+	fetch func(ctx context.Context, keys []K) (map[K]V, error)
+
+	mu      sync.Mutex
+	calls   map[K]*loaderCall[V]
+	pending map[K]*loaderCall[V]
+}
+
+type loaderCall[V any] struct {
+	done  chan struct{}
+	value V
+	found bool
+	err   error
+}
+
+func newBatchLoader[K comparable, V any](fetch func(ctx context.Context, keys []K) (map[K]V, error)) *batchLoader[K, V] {
+	return &batchLoader[K, V]{
+		fetch:   fetch,
+		calls:   make(map[K]*loaderCall[V]),
+		pending: make(map[K]*loaderCall[V]),
+	}
+}
+
+// prime queues keys for the next fetch.
+func (l *batchLoader[K, V]) prime(keys ...K) {
+	l.mu.Lock()
+	for _, key := range keys {
+		l.queueLocked(key)
+	}
+	l.mu.Unlock()
+}
+
+func (l *batchLoader[K, V]) queueLocked(key K) *loaderCall[V] {
+	if call, ok := l.calls[key]; ok {
+		return call
+	}
+	call := &loaderCall[V]{done: make(chan struct{})}
+	l.calls[key] = call
+	l.pending[key] = call
+	return call
+}
+
+// load returns the value for key, and false when the fetch did not find it.
+func (l *batchLoader[K, V]) load(ctx context.Context, key K) (V, bool, error) {
+	l.mu.Lock()
+	call := l.queueLocked(key)
+	var batch map[K]*loaderCall[V]
+	if _, queued := l.pending[key]; queued {
+		batch = l.pending
+		l.pending = make(map[K]*loaderCall[V])
+	}
+	l.mu.Unlock()
+
+	if batch != nil {
+		keys := make([]K, 0, len(batch))
+		for k := range batch {
+			keys = append(keys, k)
+		}
+		values, err := l.fetch(ctx, keys)
+		for k, c := range batch {
+			c.value, c.found = values[k]
+			c.err = err
+			close(c.done)
+		}
+	}
+	select {
+	case <-call.done:
+		return call.value, call.found, call.err
+	case <-ctx.Done():
+		var zero V
+		return zero, false, ctx.Err()
+	}
+}
+
+func parseGraphQLID(id graphql.ID) (int64, bool) {
+	n, err := strconv.ParseInt(string(id), 10, 64)
+	return n, err == nil && n > 0
+}
+
+func graphQLIDOf(id int64) graphql.ID {
+	return graphql.ID(strconv.FormatInt(id, 10))
+}
+
+// pageSize clamps a first or last argument.
+func pageSize(n int32) int {
+	if n <= 0 {
+		return 50
+	}
+	return min(int(n), graphQLMaxPage)
+}
+
+type graphQLQuery struct{}
+
+func (graphQLQuery) Me(ctx context.Context) *gqlUser {
+	q := graphQLFrom(ctx)
+	return &gqlUser{q: q, id: q.viewer.ID, handle: q.viewer.Handle, displayName: q.viewer.DisplayName, email: q.viewer.Email}
+}
+
+func (graphQLQuery) Servers(ctx context.Context) ([]*gqlServer, error) {
+	q := graphQLFrom(ctx)
+	servers, err := q.s.serversForUser(ctx, q.viewer.Email)
+	if err != nil {
+		log.Printf("graphql servers: %v", err)
+		return nil, errGraphQLInternal
+	}
+	result := make([]*gqlServer, 0, len(servers))
+	ids := make([]int64, 0, len(servers))
+	for _, srv := range servers {
+		result = append(result, &gqlServer{q: q, info: srv})
+		ids = append(ids, srv.ID)
+	}
+	q.serverChannels.prime(ids...)
+	q.memberCounts.prime(ids...)
+	return result, nil
+}
+
+func (graphQLQuery) Server(ctx context.Context, args struct{ ID graphql.ID }) (*gqlServer, error) {
+	q := graphQLFrom(ctx)
+	id, ok := parseGraphQLID(args.ID)
+	if !ok || id == q.s.directServerID {
+		return nil, nil
+	}
+	if isMember, err := q.s.userHasServerAccess(ctx, q.viewer.Email, id); err != nil {
+		log.Printf("graphql server access: %v", err)
+		return nil, errGraphQLInternal
+	} else if !isMember {
+		return nil, nil
+	}
+	srv, found, err := q.servers.load(ctx, id)
+	if err != nil {
+		log.Printf("graphql load server: %v", err)
+		return nil, errGraphQLInternal
+	}
+	if !found {
+		return nil, nil
+	}
+	return &gqlServer{q: q, info: srv}, nil
+}
+
+func (graphQLQuery) Channel(ctx context.Context, args struct{ ID graphql.ID }) (*gqlChannel, error) {
+	q := graphQLFrom(ctx)
+	id, ok := parseGraphQLID(args.ID)
+	if !ok {
+		return nil, nil
+	}
+	ch, exists, err := q.s.channelByID(ctx, id)
+	if err == nil && exists {
+		exists, err = q.s.userHasChannelAccess(ctx, q.viewer.Email, ch)
+	}
+	if err != nil {
+		log.Printf("graphql load channel: %v", err)
+		return nil, errGraphQLInternal
+	}
+	if !exists {
+		return nil, nil
+	}
+	return &gqlChannel{q: q, info: ch}, nil
+}
+
+type gqlUser struct {
+	q           *graphQLRequest
+	id          int64
+	handle      string
+	displayName string
+	email       string
+}
+
+func (u *gqlUser) ID() graphql.ID      { return graphQLIDOf(u.id) }
+func (u *gqlUser) Handle() string      { return u.handle }
+func (u *gqlUser) DisplayName() string { return u.displayName }
+func (u *gqlUser) Email() *string {
+	if u.id != u.q.viewer.ID || u.email == "" {
+		return nil
+	}
+	return &u.email
+}
+
+type gqlServer struct {
+	q    *graphQLRequest
+	info serverInfo
+}
+
+func (srv *gqlServer) ID() graphql.ID          { return graphQLIDOf(srv.info.ID) }
+func (srv *gqlServer) Slug() string            { return srv.info.Slug }
+func (srv *gqlServer) Name() string            { return srv.info.Name }
+func (srv *gqlServer) Description() string     { return srv.info.Description }
+func (srv *gqlServer) CreatedAt() graphql.Time { return graphql.Time{Time: srv.info.CreatedAt} }
+
+func (srv *gqlServer) Role(ctx context.Context) (string, error) {
+	role, _, err := srv.q.s.memberRole(ctx, srv.q.viewer.Email, srv.info.ID)
+	if err != nil {
+		log.Printf("graphql member role: %v", err)
+		return "", errGraphQLInternal
+	}
+	return role, nil
+}
+
+func (srv *gqlServer) MemberCount(ctx context.Context) (int32, error) {
+	n, _, err := srv.q.memberCounts.load(ctx, srv.info.ID)
+	if err != nil {
+		log.Printf("graphql member counts: %v", err)
+		return 0, errGraphQLInternal
+	}
+	return n, nil
+}
+
+func (srv *gqlServer) Channels(ctx context.Context) ([]*gqlChannel, error) {
+	channels, _, err := srv.q.serverChannels.load(ctx, srv.info.ID)
+	if err != nil {
+		log.Printf("graphql server channels: %v", err)
+		return nil, errGraphQLInternal
+	}
+	result := make([]*gqlChannel, 0, len(channels))
+	for _, ch := range channels {
+		result = append(result, &gqlChannel{q: srv.q, info: ch, server: srv})
+	}
+	return result, nil
+}
+
+func (srv *gqlServer) Members(ctx context.Context, args struct {
+	First int32
+	After *graphql.ID
+	Query *string
+}) ([]*gqlMember, error) {
+	f := memberFilter{Limit: pageSize(args.First)}
+	if args.After != nil {
+		after, ok := parseGraphQLID(*args.After)
+		if !ok {
+			return nil, errors.New("after is not a member ID")
+		}
+		f.After = after
+	}
+	if args.Query != nil {
+		f.Query = strings.TrimSpace(*args.Query)
+	}
+	members, _, err := srv.q.s.memberChunk(ctx, srv.q.viewer.ID, srv.info.ID, f)
+	if errors.Is(err, errUnknownCursor) {
+		return nil, errors.New("after is not a member of this server")
+	}
+	if err != nil {
+		log.Printf("graphql server members: %v", err)
+		return nil, errGraphQLInternal
+	}
+	result := make([]*gqlMember, 0, len(members))
+	for _, m := range members {
+		result = append(result, &gqlMember{q: srv.q, info: m})
+	}
+	return result, nil
+}
+
+type gqlMember struct {
+	q    *graphQLRequest
+	info memberInfo
+}
+
+func (m *gqlMember) User() *gqlUser {
+	return &gqlUser{q: m.q, id: m.info.ID, handle: m.info.Handle, displayName: m.info.DisplayName, email: m.info.Email}
+}
+func (m *gqlMember) Role() string           { return m.info.Role }
+func (m *gqlMember) JoinedAt() graphql.Time { return graphql.Time{Time: m.info.JoinedAt} }
+func (m *gqlMember) Status() string {
+	if m.info.Presence == nil {
+		return presenceOffline
+	}
+	return m.info.Presence.Status
+}
+
+type gqlChannel struct {
+	q      *graphQLRequest
+	info   channelInfo
+	server *gqlServer // when reached through its server
+}
+
+func (ch *gqlChannel) ID() graphql.ID          { return graphQLIDOf(ch.info.ID) }
+func (ch *gqlChannel) Slug() string            { return ch.info.Slug }
+func (ch *gqlChannel) Name() string            { return ch.info.Name }
+func (ch *gqlChannel) Type() string            { return ch.info.Kind }
+func (ch *gqlChannel) Topic() string           { return ch.info.Topic }
+func (ch *gqlChannel) ReadOnly() bool          { return ch.info.PostRoles != "" }
+func (ch *gqlChannel) CreatedAt() graphql.Time { return graphql.Time{Time: ch.info.CreatedAt} }
+
+func (ch *gqlChannel) Server(ctx context.Context) (*gqlServer, error) {
+	if ch.server != nil {
+		return ch.server, nil
+	}
+	if ch.info.ServerID == ch.q.s.directServerID {
+		return nil, nil
+	}
+	srv, found, err := ch.q.servers.load(ctx, ch.info.ServerID)
+	if err != nil {
+		log.Printf("graphql load server: %v", err)
+		return nil, errGraphQLInternal
+	}
+	if !found {
+		return nil, nil
+	}
+	ch.server = &gqlServer{q: ch.q, info: srv}
+	return ch.server, nil
+}
+
+func (ch *gqlChannel) Messages(ctx context.Context, args struct {
+	Last   int32
+	Before *graphql.ID
+}) ([]*gqlMessage, error) {
+	if ch.info.Kind == "voice" {
+		return []*gqlMessage{}, nil
+	}
+	limit := pageSize(args.Last)
+	var messages []chatMessage
+	var err error
+	if args.Before != nil {
+		before, ok := parseGraphQLID(*args.Before)
+		if !ok {
+			return nil, errors.New("before is not a message ID")
+		}
+		messages, err = ch.q.s.messagesBefore(ctx, ch.info.ID, before, limit)
+	} else {
+		messages, err = ch.q.s.recentMessages(ctx, ch.info.ID, limit)
+	}
+	if err != nil {
+		log.Printf("graphql channel messages: %v", err)
+		return nil, errGraphQLInternal
+	}
+	result := make([]*gqlMessage, 0, len(messages))
+	for _, msg := range messages {
+		result = append(result, &gqlMessage{channel: ch, msg: ch.q.s.messageDTOFor(ch.q.viewer, msg)})
+	}
+	return result, nil
+}
+
+type gqlMessage struct {
+	channel *gqlChannel
+	msg     messageDTO
+}
+
+func (m *gqlMessage) ID() graphql.ID          { return graphQLIDOf(m.msg.ID) }
+func (m *gqlMessage) Channel() *gqlChannel    { return m.channel }
+func (m *gqlMessage) Content() string         { return m.msg.Content }
+func (m *gqlMessage) CreatedAt() graphql.Time { return graphql.Time{Time: m.msg.CreatedAt} }
+func (m *gqlMessage) ExpiresAt() *graphql.Time {
+	if m.msg.ExpiresAt == nil {
+		return nil
+	}
+	return &graphql.Time{Time: *m.msg.ExpiresAt}
+}
+func (m *gqlMessage) Author() *gqlUser {
+	q := m.channel.q
+	u := &gqlUser{q: q, id: m.msg.AuthorID, handle: m.msg.AuthorHandle, displayName: m.msg.AuthorDisplayName}
+	if u.id == q.viewer.ID {
+		u.email = q.viewer.Email
+	}
+	return u
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	minHandleLength = 2
+	maxHandleLength = 32
+
+	systemUserHandle = "system"
+
+	handleRules = "usernames are 2-32 lowercase letters, digits, dots or underscores, starting with a letter or digit"
+)
+
+type sqlQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// validHandle reports whether h is an acceptable handle: 2-32 lowercase
+// letters, digits, dots or underscores, starting with a letter or digit.
+func validHandle(h string) bool {
+	if len(h) < minHandleLength || len(h) > maxHandleLength {
+		return false
+	}
+	for i, r := range h {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		case (r == '_' || r == '.') && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeHandle(h string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(h), "@"))
+}
+
+// handleFromEmail derives a handle candidate from the local part of email,
+// for accounts that never chose one (imports, the setup admin, old rows).
+func handleFromEmail(email string) string {
+	local, _, _ := strings.Cut(strings.ToLower(email), "@")
+	var b strings.Builder
+	for _, r := range local {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '.':
+			b.WriteRune(r)
+		case r == '-' || r == '+':
+			b.WriteByte('_')
+		}
+	}
+	h := strings.TrimLeft(b.String(), "._")
+	if len(h) > maxHandleLength-4 {
+		h = h[:maxHandleLength-4]
+	}
+	if len(h) < minHandleLength {
+		h = "user"
+	}
+	return h
+}
+
+// uniqueHandle returns base, or base followed by the lowest free number in
+// the tenant.
+func uniqueHandle(ctx context.Context, db sqlQueryer, tenantID int64, base string) (string, error) {
+	candidate := base
+	for n := 2; ; n++ {
+		taken, err := handleTaken(ctx, db, tenantID, candidate)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+		candidate = base + strconv.Itoa(n)
+	}
+}
+
+// handleTaken reports whether handle belongs to someone in the tenant. The
+// system user's handle is always taken.
+func handleTaken(ctx context.Context, db sqlQueryer, tenantID int64, handle string) (bool, error) {
+	if handle == systemUserHandle {
+		return true, nil
+	}
+	var taken bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE tenant_id = ? AND handle = ?)`, tenantID, handle).Scan(&taken)
+	return taken, err
+}
+
+func (s *serverState) getUserByHandle(ctx context.Context, tenantID int64, handle string) (user, bool, error) {
+	u, err := scanUser(s.stmts.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE tenant_id = ? AND handle = ?`, tenantID, normalizeHandle(handle)))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return user{}, false, nil
+		}
+		return user{}, false, err
+	}
+	return u, true, nil
+}
+
+// getUserByLogin looks up the account a sign-in names by email address or
+// handle, among the tenant's accounts.
+func (s *serverState) getUserByLogin(ctx context.Context, tenantID int64, login string) (user, bool, error) {
+	if strings.Contains(login, "@") {
+		return s.getTenantUserByEmail(ctx, tenantID, login)
+	}
+	return s.getUserByHandle(ctx, tenantID, login)
+}
+
+// getTenantUserByEmail is getUserByEmail for an address given by someone in
+// the tenant: accounts of other tenants are not found. Addresses are unique
+// across the deployment, so an address belongs to one tenant.
+func (s *serverState) getTenantUserByEmail(ctx context.Context, tenantID int64, email string) (user, bool, error) {
+	u, exists, err := s.getUserByEmail(ctx, email)
+	if err != nil || !exists || u.TenantID != tenantID {
+		return user{}, false, err
+	}
+	return u, true, nil
+}
+
+// lookupRecipient resolves a DM or forward recipient given by handle or
+// email, in the tenant. The system user and accounts that cannot sign in
+// are not found.
+func (s *serverState) lookupRecipient(ctx context.Context, tenantID int64, handle, email string) (user, bool, error) {
+	var u user
+	var exists bool
+	var err error
+	if handle = normalizeHandle(handle); handle != "" {
+		u, exists, err = s.getUserByHandle(ctx, tenantID, handle)
+	} else {
+		u, exists, err = s.getTenantUserByEmail(ctx, tenantID, strings.TrimSpace(strings.ToLower(email)))
+	}
+	if err != nil || !exists || u.Email == systemUserEmail || u.Status != userStatusActive {
+		return user{}, false, err
+	}
+	return u, true, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // timezones work without the host's zoneinfo
+)
+
+// Each locales/<code>.json is a flat map from message key to a fmt format.
+// Arguments are numbered (%[1]s) so translations can reorder them. A key
+// missing from a locale falls back to English. Keys starting with "error:"
+// are literal translations of API error messages instead (see
+// translateError).
+//
+//go:embed locales/*.json
+var embeddedLocales embed.FS
+
+const (
+	fallbackLocale        = "en"
+	contentLanguageHeader = "Content-Language"
+)
+
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[string]map[string]string {
+	files, err := embeddedLocales.ReadDir("locales")
+	if err != nil {
+		log.Fatalf("read locales: %v", err)
+	}
+	result := make(map[string]map[string]string, len(files))
+	for _, f := range files {
+		data, err := embeddedLocales.ReadFile("locales/" + f.Name())
+		if err != nil {
+			log.Fatalf("read locale %s: %v", f.Name(), err)
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			log.Fatalf("parse locale %s: %v", f.Name(), err)
+		}
+		result[strings.TrimSuffix(f.Name(), path.Ext(f.Name()))] = catalog
+	}
+	if result[fallbackLocale] == nil {
+		log.Fatalf("locales/%s.json is missing", fallbackLocale)
+	}
+	return result
+}
+
+func supportedLocales() []string {
+	codes := make([]string, 0, len(catalogs))
+	for code := range catalogs {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// matchLocale maps a language tag such as "es-MX" or "pt_BR" to the closest
+// locale with a catalog, trying the whole tag and then its language.
+func matchLocale(tag string) (string, bool) {
+	tag = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+	if _, ok := catalogs[tag]; ok {
+		return tag, true
+	}
+	if base, _, found := strings.Cut(tag, "-"); found {
+		if _, ok := catalogs[base]; ok {
+			return base, true
+		}
+	}
+	return "", false
+}
+
+// localizer renders text for one reader.
+type localizer struct {
+	locale string
+	tz     *time.Location
+}
+
+// T formats the message key in the localizer's locale.
+func (l localizer) T(key string, args ...any) string {
+	format, ok := catalogs[l.locale][key]
+	if !ok {
+		if format, ok = catalogs[fallbackLocale][key]; !ok {
+			log.Printf("i18n: no message %q", key)
+			return key
+		}
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// Lang is the locale code, for <html lang>.
+func (l localizer) Lang() string {
+	return l.locale
+}
+
+func (l localizer) formatTime(t time.Time) string {
+	return t.In(l.tz).Format(l.T("format.datetime"))
+}
+
+// localizerFor uses the user's locale and timezone, or the instance defaults
+// (DEFAULT_LOCALE and DEFAULT_TIMEZONE) where they have not chosen one.
+func (s *serverState) localizerFor(u user) localizer {
+	l := s.defaultLocalizer()
+	if u.Locale != "" {
+		l.locale = u.Locale
+	}
+	if u.Timezone != "" {
+		if tz, err := time.LoadLocation(u.Timezone); err == nil {
+			l.tz = tz
+		}
+	}
+	return l
+}
+
+// defaultLocalizer is for text many people read, such as announcements in
+// a channel.
+func (s *serverState) defaultLocalizer() localizer {
+	return localizer{locale: s.defaultLocale, tz: s.defaultTimezone}
+}
+
+// responseLocalizer renders a page or message in the response's language,
+// as chosen by localeMiddleware.
+func (s *serverState) responseLocalizer(w http.ResponseWriter) localizer {
+	l := s.defaultLocalizer()
+	if code := w.Header().Get(contentLanguageHeader); catalogs[code] != nil {
+		l.locale = code
+	}
+	return l
+}
+
+// translateError looks up the catalog's "error:<message>" entry. Messages
+// with no translation, including ones built with details such as a limit,
+// stay in English; clients should branch on the error code, not the text.
+func translateError(locale, message string) string {
+	if text, ok := catalogs[locale]["error:"+message]; ok {
+		return text
+	}
+	return message
+}
+
+type responseHeaderKey struct{}
+
+// localeMiddleware sets Content-Language to the best match for the
+// request's Accept-Language, or DEFAULT_LOCALE. userFromRequest replaces it
+// with the signed-in user's own locale when they have picked one. Pages and
+// API errors are then written in that language.
+func (s *serverState) localeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/static/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Set(contentLanguageHeader, negotiateLocale(r.Header.Get("Accept-Language"), s.defaultLocale))
+		h.Add("Vary", "Accept-Language")
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), responseHeaderKey{}, h)))
+	})
+}
+
+// applyUserLocale lets u's saved locale win over Accept-Language for the
+// rest of the request.
+func applyUserLocale(r *http.Request, u user) {
+	if u.Locale == "" {
+		return
+	}
+	if h, ok := r.Context().Value(responseHeaderKey{}).(http.Header); ok {
+		h.Set(contentLanguageHeader, u.Locale)
+	}
+}
+
+// negotiateLocale picks the supported locale with the highest q-value in an
+// Accept-Language header such as "fr-CH, fr;q=0.9, en;q=0.8".
+func negotiateLocale(header, fallback string) string {
+	type choice struct {
+		tag string
+		q   float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.TrimSpace(tag)
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if tag == "" || tag == "*" || q <= 0 {
+			continue
+		}
+		choices = append(choices, choice{tag: tag, q: q})
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	for _, c := range choices {
+		if code, ok := matchLocale(c.tag); ok {
+			return code
+		}
+	}
+	return fallback
+}
+
+// checkLocaleAndTimezone normalises a requested locale to its catalog code
+// and reports values that cannot be used. Empty values are allowed.
+func checkLocaleAndTimezone(locale, timezone *string) []fieldError {
+	var errs []fieldError
+	if locale != nil && *locale != "" {
+		if code, ok := matchLocale(*locale); ok {
+			*locale = code
+		} else {
+			errs = append(errs, fieldError{Field: "locale", Message: "must be one of " + strings.Join(supportedLocales(), ", ")})
+		}
+	}
+	if timezone != nil && *timezone != "" {
+		if _, err := time.LoadLocation(*timezone); err != nil || *timezone == "Local" {
+			errs = append(errs, fieldError{Field: "timezone", Message: "must be an IANA timezone such as Europe/Paris"})
+		}
+	}
+	return errs
+}
+
+func localeFromEnv() string {
+	raw := envOrDefault("DEFAULT_LOCALE", fallbackLocale)
+	locale, ok := matchLocale(raw)
+	if !ok {
+		log.Printf("DEFAULT_LOCALE %q has no catalog (have %s); using %s", raw, strings.Join(supportedLocales(), ", "), fallbackLocale)
+		return fallbackLocale
+	}
+	return locale
+}
+
+func timezoneFromEnv() *time.Location {
+	raw := envOrDefault("DEFAULT_TIMEZONE", "UTC")
+	tz, err := time.LoadLocation(raw)
+	if err != nil {
+		log.Printf("invalid DEFAULT_TIMEZONE %q, using UTC: %v", raw, err)
+		return time.UTC
+	}
+	return tz
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	maxIdempotencyKeyLength = 255
+	maxIdempotentBody       = 1 << 20
+	defaultIdempotencyTTL   = time.Hour
+	idempotencyPruneEvery   = 10 * time.Minute
+)
+
+// idempotencyRecorder passes a response through while keeping a copy for
+// replay.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// withIdempotency runs handle at most once per Idempotency-Key and user while
+// the key is remembered (IDEMPOTENCY_TTL). A retry with the same key and
+// request gets the stored response back with Idempotent-Replayed set; the same
+// key with a different request is rejected, as is a retry that arrives while
+// the first attempt is still running. Server errors are not stored, so those
+// requests can be retried for real. Requests without the header run as usual.
+func (s *serverState) withIdempotency(w http.ResponseWriter, r *http.Request, currentUser user, handle func(http.ResponseWriter, *http.Request)) {
+	key := strings.TrimSpace(r.Header.Get(idempotencyKeyHeader))
+	if key == "" {
+		handle(w, r)
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		httpError(w, "Idempotency-Key too long", http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBody+1))
+	if err != nil {
+		httpError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxIdempotentBody {
+		httpError(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256([]byte(r.Method + " " + r.URL.Path + "\n" + string(body)))
+	fingerprint := hex.EncodeToString(sum[:])
+
+	// Finishing the bookkeeping must not depend on the client still being
+	// connected, or an abandoned attempt would hold the key until it expires.
+	ctx := context.WithoutCancel(r.Context())
+	now := time.Now().UTC()
+	res, err := s.db.ExecContext(ctx, `
+        INSERT INTO idempotency_keys (user_id, key, fingerprint, created_at, expires_at) VALUES (?, ?, ?, ?, ?)
+        ON CONFLICT(user_id, key) DO UPDATE SET fingerprint = excluded.fingerprint, status = 0, content_type = '', body = NULL,
+            created_at = excluded.created_at, expires_at = excluded.expires_at
+        WHERE idempotency_keys.expires_at <= excluded.created_at
+    `, currentUser.ID, key, fingerprint, now, now.Add(s.idempotencyTTL))
+	if err != nil {
+		log.Printf("claim idempotency key: %v", err)
+		httpError(w, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		s.replayIdempotent(w, r, currentUser, key, fingerprint)
+		return
+	}
+
+	rec := &idempotencyRecorder{ResponseWriter: w, status: http.StatusOK}
+	handle(rec, r)
+
+	if rec.status >= http.StatusInternalServerError {
+		_, err = s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE user_id = ? AND key = ?`, currentUser.ID, key)
+	} else {
+		_, err = s.db.ExecContext(ctx, `UPDATE idempotency_keys SET status = ?, content_type = ?, body = ? WHERE user_id = ? AND key = ?`,
+			rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes(), currentUser.ID, key)
+	}
+	if err != nil {
+		log.Printf("store idempotent response: %v", err)
+	}
+}
+
+func (s *serverState) replayIdempotent(w http.ResponseWriter, r *http.Request, currentUser user, key, fingerprint string) {
+	var stored string
+	var status int
+	var contentType string
+	var body []byte
+	err := s.db.QueryRowContext(r.Context(), `SELECT fingerprint, status, content_type, body FROM idempotency_keys WHERE user_id = ? AND key = ?`,
+		currentUser.ID, key).Scan(&stored, &status, &contentType, &body)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Pruned between the claim and this lookup; ask for a retry.
+		httpError(w, "request with this Idempotency-Key is still in progress", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("load idempotent response: %v", err)
+		httpError(w, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+	if stored != fingerprint {
+		httpError(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+		return
+	}
+	if status == 0 {
+		httpError(w, "request with this Idempotency-Key is still in progress", http.StatusConflict)
+		return
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		log.Printf("write idempotent response: %v", err)
+	}
+}
+
+func (s *serverState) pruneIdempotencyKeys(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at < ?`, time.Now().UTC())
+	return err
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"runtime"
+	"sort"
+)
+
+const (
+	defaultImageMaxPixels = 50_000_000
+	thumbnailJPEGQuality  = 85
+	// orientedJPEGQuality is used when a photo has to be re-encoded to bake
+	// in its EXIF orientation.
+	orientedJPEGQuality = 92
+)
+
+// attachmentThumbnailSizes are the longest sides thumbnails of image
+// attachments are made at; iconThumbnailSizes and stickerThumbnailSizes the
+// same for server icons and stickers. An image gets no thumbnail at a size
+// it already fits in.
+var (
+	attachmentThumbnailSizes = []int{64, 256, 1024}
+	iconThumbnailSizes       = []int{64, 256}
+	stickerThumbnailSizes    = []int{64, 160}
+)
+
+// imageError is a reason an image was refused that can be shown to the
+// person who sent it.
+type imageError struct {
+	msg string
+}
+
+func (e *imageError) Error() string { return e.msg }
+
+var errImageUnreadable = &imageError{msg: "image could not be read"}
+
+// imagePipeline cleans up images before they are stored: it reads their
+// dimensions, refuses ones that would take too much memory to decode,
+// removes EXIF, GPS and other metadata, and makes thumbnails. Decoding is
+// expensive, so at most IMAGE_WORKERS images (default: one per CPU) are
+// processed at once; other callers wait their turn.
+type imagePipeline struct {
+	slots chan struct{}
+	// maxPixels is IMAGE_MAX_PIXELS: images whose header claims more
+	// pixels than this are refused before anything is decoded.
+	maxPixels int64
+}
+
+func imagePipelineFromEnv() *imagePipeline {
+	workers := intFromEnv("IMAGE_WORKERS", runtime.NumCPU())
+	if workers < 1 {
+		workers = 1
+	}
+	return &imagePipeline{
+		slots:     make(chan struct{}, workers),
+		maxPixels: int64(intFromEnv("IMAGE_MAX_PIXELS", defaultImageMaxPixels)),
+	}
+}
+
+type processedImage struct {
+	data          []byte
+	contentType   string
+	width, height int
+	thumbnails    []imageThumbnail
+}
+
+type imageThumbnail struct {
+	size          int
+	width, height int
+	contentType   string
+	data          []byte
+}
+
+// isProcessableImage reports whether the pipeline handles contentType, as
+// sniffed from the data.
+func isProcessableImage(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// process strips data's metadata and makes thumbnails at sizes. WebP images
+// are cleaned and measured, but get no thumbnails since the standard library
+// cannot decode them.
+func (p *imagePipeline) process(ctx context.Context, data []byte, sizes []int) (*processedImage, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-p.slots }()
+
+	contentType := http.DetectContentType(data)
+	if contentType == "image/webp" {
+		return p.processWebP(data)
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errImageUnreadable
+	}
+	if err := p.checkPixels(cfg.Width, cfg.Height); err != nil {
+		return nil, err
+	}
+	img := &processedImage{contentType: contentType, width: cfg.Width, height: cfg.Height}
+
+	orientation := 1
+	switch format {
+	case "jpeg":
+		orientation = jpegOrientation(data)
+		img.data, err = stripJPEG(data)
+	case "png":
+		img.data, err = stripPNG(data)
+	default:
+		// GIF has no EXIF.
+		img.data = data
+	}
+	if err != nil {
+		return nil, errImageUnreadable
+	}
+	if orientation == 1 && len(sizes) == 0 {
+		return img, nil
+	}
+
+	// For GIFs this is the first frame.
+	decoded, _, err := image.Decode(bytes.NewReader(img.data))
+	if err != nil {
+		return nil, errImageUnreadable
+	}
+	if orientation != 1 {
+		// Dropping the EXIF would lose the orientation, so turn the
+		// pixels instead.
+		decoded = orientImage(decoded, orientation)
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, decoded, &jpeg.Options{Quality: orientedJPEGQuality}); err != nil {
+			return nil, err
+		}
+		img.data = buf.Bytes()
+		img.width, img.height = decoded.Bounds().Dx(), decoded.Bounds().Dy()
+	}
+
+	// Largest first, each made from the one before, so the full image is
+	// only scaled once.
+	sizes = append([]int(nil), sizes...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+	opaque := false
+	if o, ok := decoded.(interface{ Opaque() bool }); ok {
+		opaque = o.Opaque()
+	}
+	source := decoded
+	for _, size := range sizes {
+		if size >= max(img.width, img.height) {
+			continue
+		}
+		thumb, scaled, err := makeThumbnail(source, size, opaque)
+		if err != nil {
+			return nil, err
+		}
+		img.thumbnails = append(img.thumbnails, thumb)
+		source = scaled
+	}
+	sort.Slice(img.thumbnails, func(i, j int) bool { return img.thumbnails[i].size < img.thumbnails[j].size })
+	return img, nil
+}
+
+func (p *imagePipeline) checkPixels(width, height int) error {
+	if width <= 0 || height <= 0 {
+		return errImageUnreadable
+	}
+	if p.maxPixels > 0 && int64(width)*int64(height) > p.maxPixels {
+		return &imageError{msg: fmt.Sprintf("image is %d×%d pixels, more than the %d allowed", width, height, p.maxPixels)}
+	}
+	return nil
+}
+
+func makeThumbnail(src image.Image, size int, opaque bool) (imageThumbnail, *image.RGBA, error) {
+	b := src.Bounds()
+	width, height := size, size
+	if b.Dx() >= b.Dy() {
+		height = max(1, b.Dy()*size/b.Dx())
+	} else {
+		width = max(1, b.Dx()*size/b.Dy())
+	}
+	scaled := scaleDown(src, width, height)
+
+	thumb := imageThumbnail{size: size, width: width, height: height}
+	var buf bytes.Buffer
+	var err error
+	if opaque {
+		thumb.contentType = "image/jpeg"
+		err = jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: thumbnailJPEGQuality})
+	} else {
+		thumb.contentType = "image/png"
+		err = png.Encode(&buf, scaled)
+	}
+	thumb.data = buf.Bytes()
+	return thumb, scaled, err
+}
+
+// scaleDown shrinks src to width×height by averaging the source pixels that
+// fall in each destination pixel.
+func scaleDown(src image.Image, width, height int) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := max(y0+1, b.Min.Y+(y+1)*b.Dy()/height)
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := max(x0+1, b.Min.X+(x+1)*b.Dx()/width)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+// orientImage applies an EXIF orientation (2-8) to src.
+func orientImage(src image.Image, orientation int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			default:
+				sx, sy = x, y
+			}
+			dst.Set(x, y, src.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// jpegOrientation reads the EXIF orientation of a JPEG, or 1 when it has
+// none.
+func jpegOrientation(data []byte) int {
+	segments, _, err := jpegSegments(data)
+	if err != nil {
+		return 1
+	}
+	for _, seg := range segments {
+		if seg.marker != 0xE1 || !bytes.HasPrefix(seg.payload, []byte("Exif\x00\x00")) {
+			continue
+		}
+		tiff := seg.payload[6:]
+		if len(tiff) < 8 {
+			return 1
+		}
+		var order binary.ByteOrder
+		switch string(tiff[:2]) {
+		case "II":
+			order = binary.LittleEndian
+		case "MM":
+			order = binary.BigEndian
+		default:
+			return 1
+		}
+		ifd := int(order.Uint32(tiff[4:8]))
+		if ifd+2 > len(tiff) {
+			return 1
+		}
+		entries := int(order.Uint16(tiff[ifd:]))
+		for i := 0; i < entries; i++ {
+			entry := ifd + 2 + i*12
+			if entry+12 > len(tiff) {
+				return 1
+			}
+			if order.Uint16(tiff[entry:]) == 0x0112 {
+				if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+					return o
+				}
+				return 1
+			}
+		}
+	}
+	return 1
+}
+
+type jpegSegment struct {
+	marker byte
+	// raw is the whole segment, marker included.
+	raw     []byte
+	payload []byte
+}
+
+// jpegSegments splits a JPEG into the marker segments before its image
+// data, and returns the offset the image data starts at.
+func jpegSegments(data []byte) ([]jpegSegment, int, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, 0, errors.New("malformed jpeg")
+	}
+	var segments []jpegSegment
+	i := 2
+	for {
+		if i+2 > len(data) || data[i] != 0xFF {
+			return nil, 0, errors.New("malformed jpeg")
+		}
+		marker := data[i+1]
+		if marker == 0xFF {
+			// Fill byte.
+			i++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			return segments, i, nil
+		}
+		if i+4 > len(data) {
+			return nil, 0, errors.New("malformed jpeg")
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, 0, errors.New("malformed jpeg")
+		}
+		segments = append(segments, jpegSegment{marker: marker, raw: data[i:end], payload: data[i+4 : end]})
+		i = end
+	}
+}
+
+// stripJPEG removes EXIF, XMP, IPTC and comment segments. JFIF, ICC
+// profiles and Adobe colour information stay, since they change how the
+// image looks. The compressed image data is copied untouched.
+func stripJPEG(data []byte) ([]byte, error) {
+	segments, scan, err := jpegSegments(data)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, 0xD8)
+	for _, seg := range segments {
+		switch {
+		case seg.marker == 0xE0, seg.marker == 0xE2, seg.marker == 0xEE:
+		case seg.marker >= 0xE1 && seg.marker <= 0xEF, seg.marker == 0xFE:
+			continue
+		}
+		out = append(out, seg.raw...)
+	}
+	return append(out, data[scan:]...), nil
+}
+
+// pngMetadataChunks are removed from PNGs.
+var pngMetadataChunks = map[string]bool{"tEXt": true, "zTXt": true, "iTXt": true, "eXIf": true, "tIME": true}
+
+func stripPNG(data []byte) ([]byte, error) {
+	const signatureLen = 8
+	if len(data) < signatureLen {
+		return nil, errors.New("malformed png")
+	}
+	out := append(make([]byte, 0, len(data)), data[:signatureLen]...)
+	for i := signatureLen; i < len(data); {
+		if i+12 > len(data) {
+			return nil, errors.New("malformed png")
+		}
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errors.New("malformed png")
+		}
+		if !pngMetadataChunks[string(data[i+4:i+8])] {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out, nil
+}
+
+// processWebP removes EXIF and XMP chunks from a WebP and reads its size
+// from the VP8X, VP8 or VP8L header.
+func (p *imagePipeline) processWebP(data []byte) (*processedImage, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errImageUnreadable
+	}
+	out := append(make([]byte, 0, len(data)), data[:12]...)
+	width, height := 0, 0
+	vp8x := -1
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errImageUnreadable
+		}
+		fourCC := string(data[i : i+4])
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size%2
+		if size < 0 || end > len(data) {
+			return nil, errImageUnreadable
+		}
+		chunk := data[i+8 : i+8+size]
+		switch fourCC {
+		case "EXIF", "XMP ":
+			i = end
+			continue
+		case "VP8X":
+			if len(chunk) >= 10 {
+				width = 1 + (int(chunk[4]) | int(chunk[5])<<8 | int(chunk[6])<<16)
+				height = 1 + (int(chunk[7]) | int(chunk[8])<<8 | int(chunk[9])<<16)
+				vp8x = len(out) + 8
+			}
+		case "VP8 ":
+			if width == 0 && len(chunk) >= 10 {
+				width = int(binary.LittleEndian.Uint16(chunk[6:])) & 0x3FFF
+				height = int(binary.LittleEndian.Uint16(chunk[8:])) & 0x3FFF
+			}
+		case "VP8L":
+			if width == 0 && len(chunk) >= 5 && chunk[0] == 0x2F {
+				bits := binary.LittleEndian.Uint32(chunk[1:])
+				width = 1 + int(bits&0x3FFF)
+				height = 1 + int(bits>>14&0x3FFF)
+			}
+		}
+		out = append(out, data[i:end]...)
+		i = end
+	}
+	if vp8x >= 0 {
+		// Clear the EXIF and XMP flags now that the chunks are gone.
+		out[vp8x] &^= 0x08 | 0x04
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	if err := p.checkPixels(width, height); err != nil {
+		return nil, err
+	}
+	return &processedImage{data: out, contentType: "image/webp", width: width, height: height}, nil
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Work that should survive a restart or be retried when it fails goes
+// through the jobs table rather than a bare goroutine: emails, DM
+// notifications, asynchronous exports and the periodic pruning of old rows.
+// Workers claim due jobs one at a time. A failed job waits with exponential
+// backoff and is given up on after its kind's maximum attempts. Recurring
+// jobs schedule their next run when they finish, so each has a single row
+// waiting at a time, and only their failures are kept.
+const (
+	jobPending = "pending"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+
+	defaultJobWorkers   = 2
+	defaultJobRetention = 7 * 24 * time.Hour
+	defaultJobAttempts  = 5
+
+	jobPollEvery  = 5 * time.Second
+	jobPruneEvery = time.Hour
+	// jobLease bounds how long one run may take; a job still running after
+	// it is treated as abandoned and run again.
+	jobLease     = 15 * time.Minute
+	jobRetryBase = 30 * time.Second
+	jobRetryMax  = time.Hour
+	maxJobList   = 100
+)
+
+type jobKind struct {
+	run         func(ctx context.Context, payload json.RawMessage) error
+	maxAttempts int
+	// every is the interval of a recurring job, zero for one-off ones.
+	every time.Duration
+}
+
+type jobQueue struct {
+	db      *sql.DB
+	readDB  *sql.DB
+	workers int
+	kinds   map[string]jobKind
+	wake    chan struct{}
+}
+
+func newJobQueue(db, readDB *sql.DB, workers int) *jobQueue {
+	return &jobQueue{db: db, readDB: readDB, workers: max(workers, 1), kinds: make(map[string]jobKind), wake: make(chan struct{}, 1)}
+}
+
+// handle registers a one-off job kind. Kinds are registered before run.
+func (q *jobQueue) handle(kind string, maxAttempts int, run func(ctx context.Context, payload json.RawMessage) error) {
+	q.kinds[kind] = jobKind{run: run, maxAttempts: maxAttempts}
+}
+
+// every registers a recurring job kind that runs once per interval.
+func (q *jobQueue) every(kind string, interval time.Duration, run func(ctx context.Context) error) {
+	q.kinds[kind] = jobKind{
+		run:         func(ctx context.Context, _ json.RawMessage) error { return run(ctx) },
+		maxAttempts: 1,
+		every:       interval,
+	}
+}
+
+// enqueue stores a job to run as soon as a worker is free.
+func (q *jobQueue) enqueue(ctx context.Context, kind string, payload any) (int64, error) {
+	id, err := q.enqueueAt(ctx, q.db, kind, payload, time.Now().UTC())
+	if err == nil {
+		q.signal()
+	}
+	return id, err
+}
+
+// enqueueAt stores a job due at runAt through db, which may be a
+// transaction, so the job only exists if the surrounding change commits.
+func (q *jobQueue) enqueueAt(ctx context.Context, db sqlExecer, kind string, payload any, runAt time.Time) (int64, error) {
+	k, ok := q.kinds[kind]
+	if !ok {
+		return 0, fmt.Errorf("unknown job kind %q", kind)
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	res, err := db.ExecContext(ctx, `
+        INSERT INTO jobs (kind, payload, status, max_attempts, run_at, created_at) VALUES (?, ?, ?, ?, ?, ?)
+    `, kind, string(raw), jobPending, k.maxAttempts, runAt.UTC(), time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (q *jobQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run starts the workers and blocks until ctx is done. Jobs left running by
+// a previous process are released first, and every recurring kind without
+// a waiting job gets one.
+func (q *jobQueue) run(ctx context.Context) {
+	if _, err := q.db.ExecContext(ctx, `UPDATE jobs SET status = ?, locked_until = NULL WHERE status = ?`, jobPending, jobRunning); err != nil {
+		log.Printf("release abandoned jobs: %v", err)
+	}
+	for kind, k := range q.kinds {
+		if k.every == 0 {
+			continue
+		}
+		if err := q.ensureScheduled(ctx, kind, k); err != nil {
+			log.Printf("schedule %s job: %v", kind, err)
+		}
+	}
+
+	done := make(chan struct{})
+	for i := 0; i < q.workers; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			q.work(ctx)
+		}()
+	}
+	for i := 0; i < q.workers; i++ {
+		<-done
+	}
+}
+
+func (q *jobQueue) ensureScheduled(ctx context.Context, kind string, k jobKind) error {
+	now := time.Now().UTC()
+	_, err := q.db.ExecContext(ctx, `
+        INSERT INTO jobs (kind, payload, status, max_attempts, run_at, created_at)
+        SELECT ?, '{}', ?, ?, ?, ?
+        WHERE NOT EXISTS (SELECT 1 FROM jobs WHERE kind = ? AND status IN (?, ?))
+    `, kind, jobPending, k.maxAttempts, now, now, kind, jobPending, jobRunning)
+	return err
+}
+
+func (q *jobQueue) work(ctx context.Context) {
+	ticker := time.NewTicker(jobPollEvery)
+	defer ticker.Stop()
+
+	for {
+		for ctx.Err() == nil {
+			ran, err := q.runNext(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("run job: %v", err)
+			}
+			if !ran || err != nil {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+type claimedJob struct {
+	id       int64
+	kind     string
+	payload  json.RawMessage
+	attempts int
+	max      int
+}
+
+// runNext claims the oldest due job and runs it, reporting whether there
+// was one.
+func (q *jobQueue) runNext(ctx context.Context) (bool, error) {
+	now := time.Now().UTC()
+	var j claimedJob
+	var payload string
+	err := q.db.QueryRowContext(ctx, `
+        UPDATE jobs SET status = ?, attempts = attempts + 1, locked_until = ?
+        WHERE id = (
+            SELECT id FROM jobs
+            WHERE (status = ? AND run_at <= ?) OR (status = ? AND locked_until < ?)
+            ORDER BY run_at, id LIMIT 1
+        )
+        RETURNING id, kind, payload, attempts, max_attempts
+    `, jobRunning, now.Add(jobLease), jobPending, now, jobRunning, now).Scan(&j.id, &j.kind, &payload, &j.attempts, &j.max)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	j.payload = json.RawMessage(payload)
+
+	k, ok := q.kinds[j.kind]
+	if !ok {
+		return true, q.finish(j, jobKind{}, fmt.Errorf("unknown job kind %q", j.kind))
+	}
+	runErr := q.call(ctx, k, j)
+	if runErr != nil && ctx.Err() != nil {
+		// Shutting down: hand the job back without counting the attempt.
+		_, err := q.db.ExecContext(context.Background(), `
+            UPDATE jobs SET status = ?, attempts = attempts - 1, locked_until = NULL WHERE id = ?
+        `, jobPending, j.id)
+		return true, err
+	}
+	return true, q.finish(j, k, runErr)
+}
+
+func (q *jobQueue) call(ctx context.Context, k jobKind, j claimedJob) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, jobLease)
+	defer cancel()
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return k.run(ctx, j.payload)
+}
+
+// finish records the outcome of a run: done, due again after a backoff, or
+// failed for good. A recurring job is scheduled again either way.
+func (q *jobQueue) finish(j claimedJob, k jobKind, runErr error) error {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	switch {
+	case runErr == nil && k.every > 0:
+		// Successful runs of recurring jobs are not worth keeping.
+		_, err = tx.ExecContext(ctx, `DELETE FROM jobs WHERE id = ?`, j.id)
+	case runErr == nil:
+		_, err = tx.ExecContext(ctx, `UPDATE jobs SET status = ?, locked_until = NULL, last_error = '', finished_at = ? WHERE id = ?`, jobDone, now, j.id)
+	case j.attempts < j.max:
+		log.Printf("job %d (%s) failed, attempt %d of %d: %v", j.id, j.kind, j.attempts, j.max, runErr)
+		_, err = tx.ExecContext(ctx, `UPDATE jobs SET status = ?, locked_until = NULL, last_error = ?, run_at = ? WHERE id = ?`,
+			jobPending, runErr.Error(), now.Add(jobBackoff(j.attempts)), j.id)
+	default:
+		log.Printf("job %d (%s) failed: %v", j.id, j.kind, runErr)
+		_, err = tx.ExecContext(ctx, `UPDATE jobs SET status = ?, locked_until = NULL, last_error = ?, finished_at = ? WHERE id = ?`,
+			jobFailed, runErr.Error(), now, j.id)
+	}
+	if err != nil {
+		return err
+	}
+	if k.every > 0 {
+		if _, err := q.enqueueAt(ctx, tx, j.kind, struct{}{}, now.Add(k.every)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// jobBackoff is the wait after the given failed attempt: 30s, 1m, 2m and
+// so on, up to an hour.
+func jobBackoff(attempt int) time.Duration {
+	wait := jobRetryBase
+	for i := 1; i < attempt && wait < jobRetryMax; i++ {
+		wait *= 2
+	}
+	return min(wait, jobRetryMax)
+}
+
+// registerJobs declares every job kind this process can run.
+func (s *serverState) registerJobs() {
+	s.jobs.handle("email", defaultJobAttempts, s.runEmailJob)
+	s.jobs.handle("notify.dm", 3, s.runNotifyJob)
+	s.jobs.handle("export", 3, s.runExportJob)
+
+	s.jobs.every("notify.digests", notificationDigestEvery, s.sendNotificationDigests)
+	s.jobs.every("prune.sessions", sessionPruneEvery, s.pruneSessions)
+	s.jobs.every("prune.login_attempts", loginAttemptPruneEvery, s.pruneLoginAttempts)
+	s.jobs.every("prune.idempotency", idempotencyPruneEvery, s.pruneIdempotencyKeys)
+	s.jobs.every("prune.sync", syncPruneEvery, s.pruneSyncEvents)
+	s.jobs.every("prune.ws_resumes", wsResumePruneEvery, s.pruneResumes)
+	s.jobs.every("prune.ephemeral", ephemeralPruneEvery, s.pruneEphemeralMessages)
+	s.jobs.every("prune.voice_rtt", voiceRTTPruneEvery, s.pruneVoiceRTTReports)
+	s.jobs.every("prune.jobs", jobPruneEvery, s.pruneJobs)
+}
+
+type emailJob struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// sendEmail queues a message for delivery, retried while SMTP is failing.
+func (s *serverState) sendEmail(ctx context.Context, to, subject, body string) error {
+	_, err := s.jobs.enqueue(ctx, "email", emailJob{To: to, Subject: subject, Body: body})
+	return err
+}
+
+func (s *serverState) runEmailJob(_ context.Context, payload json.RawMessage) error {
+	var m emailJob
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return err
+	}
+	return s.mail.send(m.To, m.Subject, m.Body)
+}
+
+// pruneJobs drops finished jobs older than JOB_RETENTION, along with the
+// archives of finished exports.
+func (s *serverState) pruneJobs(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, `
+        DELETE FROM jobs WHERE status IN (?, ?) AND finished_at < ?
+        RETURNING kind, payload
+    `, jobDone, jobFailed, time.Now().UTC().Add(-s.jobRetention))
+	if err != nil {
+		return err
+	}
+	var exports []string
+	for rows.Next() {
+		var kind, payload string
+		if err := rows.Scan(&kind, &payload); err != nil {
+			rows.Close()
+			return err
+		}
+		var export exportJob
+		if kind == "export" && json.Unmarshal([]byte(payload), &export) == nil && export.File != "" {
+			exports = append(exports, export.File)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, file := range exports {
+		s.removeExportFile(file)
+	}
+	return nil
+}
+
+type jobDTO struct {
+	ID          int64           `json:"id"`
+	Kind        string          `json:"kind"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"maxAttempts"`
+	RunAt       time.Time       `json:"runAt"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	FinishedAt  *time.Time      `json:"finishedAt,omitempty"`
+	LastError   string          `json:"lastError,omitempty"`
+	Payload     json.RawMessage `json:"-"`
+}
+
+const jobColumns = `id, kind, status, attempts, max_attempts, run_at, created_at, finished_at, last_error, payload`
+
+func scanJob(row interface{ Scan(...any) error }) (jobDTO, error) {
+	var j jobDTO
+	var finished sql.NullTime
+	var payload string
+	if err := row.Scan(&j.ID, &j.Kind, &j.Status, &j.Attempts, &j.MaxAttempts, &j.RunAt, &j.CreatedAt, &finished, &j.LastError, &payload); err != nil {
+		return jobDTO{}, err
+	}
+	if finished.Valid {
+		j.FinishedAt = &finished.Time
+	}
+	j.Payload = json.RawMessage(payload)
+	return j, nil
+}
+
+func (s *serverState) jobByID(ctx context.Context, id int64) (jobDTO, bool, error) {
+	j, err := scanJob(s.readDB.QueryRowContext(ctx, `SELECT `+jobColumns+` FROM jobs WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return jobDTO{}, false, nil
+	}
+	return j, err == nil, err
+}
+
+// handleAdminJobs serves GET /api/admin/jobs, the most recent jobs
+// optionally filtered by ?status= and ?kind=, and POST
+// /api/admin/jobs/{id}/retry, which runs a failed job again.
+func (s *serverState) handleAdminJobs(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.requireOperator(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	rawID, action, _ := strings.Cut(strings.Trim(r.URL.Path, "/"), "/")
+
+	if rawID == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := `SELECT ` + jobColumns + ` FROM jobs WHERE 1 = 1`
+		var args []any
+		if status := r.URL.Query().Get("status"); status != "" {
+			query += ` AND status = ?`
+			args = append(args, status)
+		}
+		if kind := r.URL.Query().Get("kind"); kind != "" {
+			query += ` AND kind = ?`
+			args = append(args, kind)
+		}
+		query += ` ORDER BY id DESC LIMIT ?`
+		args = append(args, maxJobList)
+		rows, err := s.readDB.QueryContext(ctx, query, args...)
+		if err != nil {
+			log.Printf("list jobs: %v", err)
+			httpError(w, "failed to load jobs", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		jobs := []jobDTO{}
+		for rows.Next() {
+			j, err := scanJob(rows)
+			if err != nil {
+				log.Printf("scan job: %v", err)
+				httpError(w, "failed to load jobs", http.StatusInternalServerError)
+				return
+			}
+			jobs = append(jobs, j)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("list jobs: %v", err)
+			httpError(w, "failed to load jobs", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(jobs); err != nil {
+			log.Printf("encode jobs: %v", err)
+		}
+		return
+	}
+
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil || action != "retry" {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	j, exists, err := s.jobByID(ctx, id)
+	if err != nil {
+		log.Printf("load job %d: %v", id, err)
+		httpError(w, "failed to retry job", http.StatusInternalServerError)
+		return
+	}
+	if !exists || j.Status != jobFailed {
+		httpError(w, "no failed job with that id", http.StatusNotFound)
+		return
+	}
+	if s.jobs.kinds[j.Kind].every > 0 {
+		// The next run is already scheduled.
+		httpError(w, "recurring jobs run again on their own", http.StatusConflict)
+		return
+	}
+	res, err := s.db.ExecContext(ctx, `
+        UPDATE jobs SET status = ?, attempts = 0, run_at = ?, finished_at = NULL WHERE id = ? AND status = ?
+    `, jobPending, time.Now().UTC(), id, jobFailed)
+	if err != nil {
+		log.Printf("retry job %d: %v", id, err)
+		httpError(w, "failed to retry job", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		httpError(w, "no failed job with that id", http.StatusNotFound)
+		return
+	}
+	s.jobs.signal()
+	s.recordAudit(ctx, 0, admin.Email, "job.retried", "job", rawID, "")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultJWTKeyFile  = "jwt.key"
+	defaultJWTIssuer   = "echosphere"
+	defaultJWTAudience = "echosphere"
+	defaultAccessTTL   = 15 * time.Minute
+	defaultRefreshTTL  = 30 * 24 * time.Hour
+	// jwtLeeway allows for clocks that drift between this server and the
+	// services that validate its tokens.
+	jwtLeeway  = 30 * time.Second
+	jwksMaxAge = 5 * time.Minute
+)
+
+var (
+	errJWTMalformed = errors.New("malformed token")
+	errJWTSignature = errors.New("invalid token signature")
+	errJWTExpired   = errors.New("token expired")
+	errJWTClaims    = errors.New("token not issued for this service")
+)
+
+// jwtKey is an ES256 signing key and the ID it is published under, the
+// key's RFC 7638 thumbprint.
+type jwtKey struct {
+	id  string
+	key *ecdsa.PrivateKey
+}
+
+// jwtIssuer signs access tokens for API clients. The first key signs; every
+// key is published at /.well-known/jwks.json so tokens signed before a
+// rotation keep validating until they expire.
+type jwtIssuer struct {
+	keys       []jwtKey
+	issuer     string
+	audience   string
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+// jwtIssuerFromEnv loads the PEM-encoded P-256 keys in JWT_KEY_FILE
+// (default data/jwt.key), newest first, generating one on first start.
+func jwtIssuerFromEnv(dataDir string) (*jwtIssuer, error) {
+	path := envOrDefault("JWT_KEY_FILE", filepath.Join(dataDir, defaultJWTKeyFile))
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if content, err = generateJWTKey(); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, content, 0o600); err != nil {
+			return nil, fmt.Errorf("write jwt key: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("read jwt key: %w", err)
+	}
+	keys, err := parseJWTKeys(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &jwtIssuer{
+		keys:       keys,
+		issuer:     envOrDefault("JWT_ISSUER", defaultJWTIssuer),
+		audience:   envOrDefault("JWT_AUDIENCE", defaultJWTAudience),
+		accessTTL:  durationFromEnv("JWT_ACCESS_TTL", defaultAccessTTL),
+		refreshTTL: durationFromEnv("JWT_REFRESH_TTL", defaultRefreshTTL),
+	}, nil
+}
+
+func generateJWTKey() ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// parseJWTKeys reads PKCS #8 ("PRIVATE KEY") and SEC 1 ("EC PRIVATE KEY")
+// blocks, as written by openssl genpkey and openssl ecparam.
+func parseJWTKeys(content []byte) ([]jwtKey, error) {
+	var keys []jwtKey
+	seen := make(map[string]bool)
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		var parsed any
+		var err error
+		switch block.Type {
+		case "PRIVATE KEY":
+			parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			parsed, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", len(keys)+1, err)
+		}
+		key, ok := parsed.(*ecdsa.PrivateKey)
+		if !ok || key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("key %d is not a P-256 key", len(keys)+1)
+		}
+		id, err := jwkThumbprint(&key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[id] {
+			seen[id] = true
+			keys = append(keys, jwtKey{id: id, key: key})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no P-256 private keys found")
+	}
+	return keys, nil
+}
+
+// jwk is a public key as published in the JWKS document.
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+}
+
+func publicJWK(pub *ecdsa.PublicKey) (jwk, error) {
+	point, err := pub.ECDH()
+	if err != nil {
+		return jwk{}, err
+	}
+	// An uncompressed P-256 point is 0x04 followed by X and Y.
+	raw := point.Bytes()
+	return jwk{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(raw[1:33]),
+		Y:   base64.RawURLEncoding.EncodeToString(raw[33:]),
+	}, nil
+}
+
+func jwkThumbprint(pub *ecdsa.PublicKey) (string, error) {
+	k, err := publicJWK(pub)
+	if err != nil {
+		return "", err
+	}
+	// RFC 7638: the required members in lexicographic order, no spaces.
+	sum := sha256.Sum256([]byte(`{"crv":"` + k.Crv + `","kty":"` + k.Kty + `","x":"` + k.X + `","y":"` + k.Y + `"}`))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// accessClaims are the claims of an access token. Subject is the user ID
+// and SessionID the API session's device ID.
+type accessClaims struct {
+	Issuer    string `json:"iss"`
+	Audience  string `json:"aud"`
+	Subject   string `json:"sub"`
+	SessionID string `json:"sid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid"`
+}
+
+// issue signs an access token for the user's API session on deviceID.
+func (j *jwtIssuer) issue(userID int64, deviceID string) (string, time.Time, error) {
+	now := time.Now().UTC()
+	expires := now.Add(j.accessTTL)
+	claims := accessClaims{
+		Issuer:    j.issuer,
+		Audience:  j.audience,
+		Subject:   strconv.FormatInt(userID, 10),
+		SessionID: deviceID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expires.Unix(),
+		ID:        generateDeviceID(),
+	}
+	key := j.keys[0]
+	header, err := json.Marshal(jwtHeader{Alg: "ES256", Typ: "JWT", Kid: key.id})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key.key, digest[:])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	// JWS wants R and S as fixed-size big-endian integers, not ASN.1.
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), expires, nil
+}
+
+// verify checks an access token's signature, expiry, issuer and audience
+// and returns its claims.
+func (j *jwtIssuer) verify(token string) (accessClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return accessClaims{}, errJWTMalformed
+	}
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return accessClaims{}, err
+	}
+	if header.Alg != "ES256" {
+		return accessClaims{}, errJWTSignature
+	}
+	var key *ecdsa.PrivateKey
+	for _, k := range j.keys {
+		if k.id == header.Kid {
+			key = k.key
+		}
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if key == nil || err != nil || len(sig) != 64 {
+		return accessClaims{}, errJWTSignature
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(&key.PublicKey, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return accessClaims{}, errJWTSignature
+	}
+	var claims accessClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return accessClaims{}, err
+	}
+	if claims.Issuer != j.issuer || claims.Audience != j.audience || claims.Subject == "" || claims.SessionID == "" {
+		return accessClaims{}, errJWTClaims
+	}
+	if time.Now().Add(-jwtLeeway).Unix() >= claims.ExpiresAt {
+		return accessClaims{}, errJWTExpired
+	}
+	return claims, nil
+}
+
+func decodeJWTSegment(segment string, dst any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errJWTMalformed
+	}
+	if err := json.Unmarshal(raw, dst); err != nil {
+		return errJWTMalformed
+	}
+	return nil
+}
+
+// handleJWKS serves GET /.well-known/jwks.json: the public keys access
+// tokens are signed with, for other services that validate them.
+func (s *serverState) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	keys := make([]jwk, 0, len(s.jwt.keys))
+	for _, k := range s.jwt.keys {
+		pub, err := publicJWK(&k.key.PublicKey)
+		if err != nil {
+			log.Printf("publish jwt key %s: %v", k.id, err)
+			continue
+		}
+		pub.Kid, pub.Use, pub.Alg = k.id, "sig", "ES256"
+		keys = append(keys, pub)
+	}
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	if err := json.NewEncoder(w).Encode(map[string][]jwk{"keys": keys}); err != nil {
+		log.Printf("encode jwks: %v", err)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultLockoutAttempts   = 5
+	defaultLockoutIPAttempts = 20
+	defaultLockoutBase       = time.Minute
+	defaultLockoutMax        = time.Hour
+	defaultLoginHistoryTTL   = 90 * 24 * time.Hour
+	// loginFailureWindow is how long failed attempts count towards a
+	// lockout or a CAPTCHA; lockoutDecay is how long after its last failure
+	// a subject's lockout level drops back to zero.
+	loginFailureWindow     = 15 * time.Minute
+	lockoutDecay           = 24 * time.Hour
+	loginHistoryLimit      = 50
+	loginAttemptPruneEvery = time.Hour
+)
+
+const (
+	loginSuccess = "success"
+	loginFailed  = "failed"
+	loginLocked  = "locked"
+	loginCaptcha = "captcha"
+	loginPending = "pending"
+	// loginDeactivated is a correct password for a deactivated account.
+	loginDeactivated = "deactivated"
+)
+
+// loginLockouts configures how failed logins lock out an account or a
+// client address. An attempts limit of 0 turns that lockout off.
+type loginLockouts struct {
+	attempts   int
+	ipAttempts int
+	base       time.Duration
+	max        time.Duration
+	historyTTL time.Duration
+}
+
+func loginLockoutsFromEnv() loginLockouts {
+	return loginLockouts{
+		attempts:   intFromEnv("LOGIN_LOCKOUT_ATTEMPTS", defaultLockoutAttempts),
+		ipAttempts: intFromEnv("LOGIN_LOCKOUT_IP_ATTEMPTS", defaultLockoutIPAttempts),
+		base:       durationFromEnv("LOGIN_LOCKOUT_BASE", defaultLockoutBase),
+		max:        durationFromEnv("LOGIN_LOCKOUT_MAX", defaultLockoutMax),
+		historyTTL: durationFromEnv("LOGIN_HISTORY_RETENTION", defaultLoginHistoryTTL),
+	}
+}
+
+// duration is how long the level-th lockout in a row lasts: base, doubling
+// each time, up to max.
+func (l loginLockouts) duration(level int) time.Duration {
+	d := l.base
+	for i := 1; i < level && d < l.max; i++ {
+		d *= 2
+	}
+	return min(d, l.max)
+}
+
+// loginSubject is what failed logins are counted against: an account or a
+// client address.
+type loginSubject string
+
+func accountSubject(userID int64) loginSubject {
+	return loginSubject("user:" + strconv.FormatInt(userID, 10))
+}
+
+func addressSubject(ip string) loginSubject {
+	return loginSubject("ip:" + ip)
+}
+
+func loginSubjects(ip string, userID int64) []loginSubject {
+	subjects := []loginSubject{addressSubject(ip)}
+	if userID > 0 {
+		subjects = append(subjects, accountSubject(userID))
+	}
+	return subjects
+}
+
+// loginFailureState is a subject's row in login_failures with stale counts
+// already dropped.
+type loginFailureState struct {
+	failures    int
+	level       int
+	lockedUntil time.Time
+}
+
+func loadLoginFailure(ctx context.Context, q sqlQueryer, subject loginSubject, now time.Time) (loginFailureState, error) {
+	var st loginFailureState
+	var lockedUntil sql.NullTime
+	var lastFailure time.Time
+	err := q.QueryRowContext(ctx, `
+        SELECT failures, level, locked_until, last_failure_at FROM login_failures WHERE subject = ?
+    `, string(subject)).Scan(&st.failures, &st.level, &lockedUntil, &lastFailure)
+	if errors.Is(err, sql.ErrNoRows) {
+		return loginFailureState{}, nil
+	}
+	if err != nil {
+		return loginFailureState{}, err
+	}
+	if now.Sub(lastFailure) >= loginFailureWindow {
+		st.failures = 0
+	}
+	if now.Sub(lastFailure) >= lockoutDecay {
+		st.level = 0
+	}
+	if lockedUntil.Valid {
+		st.lockedUntil = lockedUntil.Time
+	}
+	return st, nil
+}
+
+// loginLockedUntil returns when the address or the account may try to sign
+// in again, or the zero time when neither is locked out.
+func (s *serverState) loginLockedUntil(ctx context.Context, ip string, userID int64) (time.Time, error) {
+	now := time.Now().UTC()
+	var until time.Time
+	for _, subject := range loginSubjects(ip, userID) {
+		st, err := loadLoginFailure(ctx, s.readDB, subject, now)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if st.lockedUntil.After(now) && st.lockedUntil.After(until) {
+			until = st.lockedUntil
+		}
+	}
+	return until, nil
+}
+
+// loginNeedsCaptcha reports whether a login from ip, for userID when the
+// account is known, has to solve a CAPTCHA first: once either has failed
+// captchaLoginFailures times recently, or has been locked out before.
+func (s *serverState) loginNeedsCaptcha(ctx context.Context, ip string, userID int64) bool {
+	if s.captcha == nil {
+		return false
+	}
+	now := time.Now().UTC()
+	for _, subject := range loginSubjects(ip, userID) {
+		st, err := loadLoginFailure(ctx, s.readDB, subject, now)
+		if err != nil {
+			log.Printf("load login failures: %v", err)
+			return true
+		}
+		if st.failures >= s.captchaLoginFailures || st.level > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *serverState) recordLoginAttempt(ctx context.Context, r *http.Request, login string, userID int64, outcome string) {
+	var uid any
+	if userID > 0 {
+		uid = userID
+	}
+	if _, err := s.db.ExecContext(ctx, `
+        INSERT INTO login_attempts (user_id, login, client_ip, user_agent, outcome, created_at)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `, uid, login, clientIP(r), truncateUserAgent(r.UserAgent()), outcome, time.Now().UTC()); err != nil {
+		log.Printf("record login attempt: %v", err)
+	}
+}
+
+// recordLoginFailure records a failed login and counts it against the
+// address and, when the login named one, the account. Reaching the limit
+// locks the subject out, each lockout in a row twice as long as the last,
+// and a locked account's owner is told by email.
+func (s *serverState) recordLoginFailure(ctx context.Context, r *http.Request, login string, u user) {
+	s.recordLoginAttempt(ctx, r, login, u.ID, loginFailed)
+
+	ip := clientIP(r)
+	accountLocked, until, err := s.countLoginFailure(ctx, ip, u.ID)
+	if err != nil {
+		log.Printf("count login failure: %v", err)
+		return
+	}
+	if !accountLocked {
+		return
+	}
+	s.recordAudit(ctx, 0, u.Email, "user.login_locked", "user", strconv.FormatInt(u.ID, 10), "ip="+ip+" until="+until.Format(time.RFC3339))
+	l := s.localizerFor(u)
+	body := l.T("email.login_locked.body", s.lockouts.attempts, u.Handle, ip, l.formatTime(until))
+	if err := s.sendEmail(ctx, u.Email, l.T("email.login_locked.subject", s.currentInstanceName(ctx, u.TenantID)), body); err != nil {
+		log.Printf("queue lockout notice to %s: %v", u.Email, err)
+	}
+}
+
+func (s *serverState) countLoginFailure(ctx context.Context, ip string, userID int64) (accountLocked bool, until time.Time, err error) {
+	now := time.Now().UTC()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	defer tx.Rollback()
+	for _, subject := range loginSubjects(ip, userID) {
+		limit := s.lockouts.ipAttempts
+		if subject != addressSubject(ip) {
+			limit = s.lockouts.attempts
+		}
+		st, err := loadLoginFailure(ctx, tx, subject, now)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+		st.failures++
+		if limit > 0 && st.failures >= limit {
+			st.level++
+			st.failures = 0
+			st.lockedUntil = now.Add(s.lockouts.duration(st.level))
+			if subject != addressSubject(ip) {
+				accountLocked, until = true, st.lockedUntil
+			}
+		}
+		var lockedUntil any
+		if !st.lockedUntil.IsZero() {
+			lockedUntil = st.lockedUntil
+		}
+		if _, err := tx.ExecContext(ctx, `
+            INSERT INTO login_failures (subject, failures, level, locked_until, last_failure_at)
+            VALUES (?, ?, ?, ?, ?)
+            ON CONFLICT(subject) DO UPDATE SET
+                failures = excluded.failures, level = excluded.level,
+                locked_until = excluded.locked_until, last_failure_at = excluded.last_failure_at
+        `, string(subject), st.failures, st.level, lockedUntil, now); err != nil {
+			return false, time.Time{}, err
+		}
+	}
+	return accountLocked, until, tx.Commit()
+}
+
+// clearLoginFailures forgets the failures of an address and an account
+// after a successful login.
+func (s *serverState) clearLoginFailures(ctx context.Context, ip string, userID int64) {
+	for _, subject := range loginSubjects(ip, userID) {
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM login_failures WHERE subject = ?`, string(subject)); err != nil {
+			log.Printf("clear login failures: %v", err)
+		}
+	}
+}
+
+type loginAttemptDTO struct {
+	At        time.Time `json:"at"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Outcome   string    `json:"outcome"`
+}
+
+type accountSecurityDTO struct {
+	LockedUntil *time.Time        `json:"lockedUntil,omitempty"`
+	Attempts    []loginAttemptDTO `json:"attempts"`
+}
+
+// handleAccountSecurity serves GET /api/me/security: the signed-in user's
+// recent sign-in attempts, newest first, and whether the account is locked.
+func (s *serverState) handleAccountSecurity(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := s.accountSecurity(r.Context(), currentUser.ID)
+	if err != nil {
+		log.Printf("load login history of user %d: %v", currentUser.ID, err)
+		httpError(w, "failed to load login history", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("encode login history: %v", err)
+	}
+}
+
+func (s *serverState) accountSecurity(ctx context.Context, userID int64) (accountSecurityDTO, error) {
+	result := accountSecurityDTO{Attempts: []loginAttemptDTO{}}
+	now := time.Now().UTC()
+	st, err := loadLoginFailure(ctx, s.readDB, accountSubject(userID), now)
+	if err != nil {
+		return result, err
+	}
+	if st.lockedUntil.After(now) {
+		result.LockedUntil = &st.lockedUntil
+	}
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT created_at, client_ip, user_agent, outcome FROM login_attempts
+        WHERE user_id = ? ORDER BY created_at DESC, id DESC LIMIT ?
+    `, userID, loginHistoryLimit)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a loginAttemptDTO
+		if err := rows.Scan(&a.At, &a.IP, &a.UserAgent, &a.Outcome); err != nil {
+			return result, err
+		}
+		result.Attempts = append(result.Attempts, a)
+	}
+	return result, rows.Err()
+}
+
+// pruneLoginAttempts drops login history older than
+// LOGIN_HISTORY_RETENTION and failure counts nothing depends on any more.
+func (s *serverState) pruneLoginAttempts(ctx context.Context) error {
+	now := time.Now().UTC()
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM login_attempts WHERE created_at < ?`, now.Add(-s.lockouts.historyTTL)); err != nil {
+		return fmt.Errorf("prune login attempts: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, `
+        DELETE FROM login_failures
+        WHERE last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)
+    `, now.Add(-lockoutDecay), now); err != nil {
+		return fmt.Errorf("prune login failures: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// mailer delivers account email through SMTP_ADDR. Without it messages are
+// written to the log instead, which is enough for development.
+type mailer struct {
+	addr     string
+	from     string
+	username string
+	password string
+}
+
+func mailerFromEnv() *mailer {
+	return &mailer{
+		addr:     os.Getenv("SMTP_ADDR"),
+		from:     envOrDefault("SMTP_FROM", "echosphere@localhost"),
+		username: os.Getenv("SMTP_USERNAME"),
+		password: os.Getenv("SMTP_PASSWORD"),
+	}
+}
+
+func (m *mailer) send(to, subject, body string) error {
+	if m.addr == "" {
+		log.Printf("mail to %s (SMTP_ADDR unset): %s\n%s", to, subject, body)
+		return nil
+	}
+	var auth smtp.Auth
+	if m.username != "" {
+		host, _, err := net.SplitHostPort(m.addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.username, m.password, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		m.from, to, subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(body, "\n", "\r\n"))
+	return smtp.SendMail(m.addr, auth, m.from, []string{to}, []byte(msg))
+}
+
+// absoluteURL turns path into a link back to this instance, and the
+// request's tenant, as the request reached it.
+func absoluteURL(r *http.Request, path string) string {
+	scheme := "http"
+	if requestIsHTTPS(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + tenantScopeFrom(r.Context()).basePath + path
+}
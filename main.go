@@ -6,42 +6,87 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"html/template"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"unicode"
-	"unicode/utf8"
 
-	"golang.org/x/crypto/bcrypt"
+	graphql "github.com/graph-gophers/graphql-go"
 	_ "modernc.org/sqlite"
 )
 
 type user struct {
+	ID           int64
 	Email        string
+	Handle       string
 	DisplayName  string
 	PasswordHash []byte
 	CreatedAt    time.Time
+	Status       string
+	// MaskProfanity asks for listed words to be masked in delivered messages.
+	MaskProfanity bool
+	// VoiceMode is voiceModeVAD or voiceModePTT.
+	VoiceMode string
+	// Locale and Timezone are empty until the user picks them; see
+	// localizerFor.
+	Locale   string
+	Timezone string
+	// Theme, CompactMode and FontSize are only used by clients.
+	Theme       string
+	CompactMode bool
+	FontSize    string
+	// QuietHoursStart and QuietHoursEnd are HH:MM, or empty; see
+	// inQuietHours.
+	QuietHoursStart string
+	QuietHoursEnd   string
+	// SharePresence is sharePresenceEveryone or sharePresenceFriends.
+	SharePresence string
+	// TenantID is the tenant the account belongs to; see tenant.go.
+	TenantID int64
 }
 
 type templateData map[string]any
 
 type messageDTO struct {
-	ID                int64     `json:"id"`
-	ChannelID         int64     `json:"channelId"`
-	AuthorEmail       string    `json:"authorEmail"`
-	AuthorDisplayName string    `json:"authorDisplayName"`
-	Content           string    `json:"content"`
-	CreatedAt         time.Time `json:"createdAt"`
+	ID                int64             `json:"id"`
+	ChannelID         int64             `json:"channelId"`
+	AuthorID          int64             `json:"authorId"`
+	AuthorHandle      string            `json:"authorHandle"`
+	AuthorDisplayName string            `json:"authorDisplayName"`
+	AuthorColor       string            `json:"authorColor,omitempty"`
+	Content           string            `json:"content"`
+	CreatedAt         time.Time         `json:"createdAt"`
+	ForwardedFrom     *messageOriginDTO `json:"forwardedFrom,omitempty"`
+	Crossposted       bool              `json:"crossposted,omitempty"`
+	Nonce             string            `json:"nonce,omitempty"`
+	Starred           bool              `json:"starred,omitempty"`
+	StarCount         int               `json:"starCount,omitempty"`
+	Ephemeral         bool              `json:"ephemeral,omitempty"`
+	ExpiresAt         *time.Time        `json:"expiresAt,omitempty"`
+	Attachments       []attachmentDTO   `json:"attachments,omitempty"`
+	Transcript        *transcriptDTO    `json:"transcript,omitempty"`
+	Sticker           *stickerDTO       `json:"sticker,omitempty"`
 }
 
+// userDTO identifies a user to clients. Email is only filled in for the
+// signed-in user's own record.
 type userDTO struct {
-	Email       string `json:"email"`
+	ID          int64  `json:"id"`
+	Email       string `json:"email,omitempty"`
+	Handle      string `json:"handle"`
 	DisplayName string `json:"displayName"`
 }
 
@@ -52,14 +97,24 @@ type channelPayload struct {
 	Name      string    `json:"name"`
 	CreatedAt time.Time `json:"createdAt"`
 	Type      string    `json:"type"`
+	ReadOnly  bool      `json:"readOnly"`
+	PostRoles []string  `json:"postRoles,omitempty"`
+	Topic     string    `json:"topic"`
+	Emoji     string    `json:"emoji,omitempty"`
+	EmojiURL  string    `json:"emojiUrl,omitempty"`
 }
 
 type serverPayload struct {
-	ID        int64            `json:"id"`
-	Slug      string           `json:"slug"`
-	Name      string           `json:"name"`
-	CreatedAt time.Time        `json:"createdAt"`
-	Channels  []channelPayload `json:"channels"`
+	ID                   int64            `json:"id"`
+	Slug                 string           `json:"slug"`
+	Name                 string           `json:"name"`
+	CreatedAt            time.Time        `json:"createdAt"`
+	Description          string           `json:"description"`
+	IconURL              string           `json:"iconUrl,omitempty"`
+	DefaultNotifications string           `json:"defaultNotifications"`
+	SystemChannelID      int64            `json:"systemChannelId,omitempty"`
+	Rules                string           `json:"rules,omitempty"`
+	Channels             []channelPayload `json:"channels,omitempty"`
 }
 
 type bootstrapPayload struct {
@@ -69,95 +124,528 @@ type bootstrapPayload struct {
 	ActiveChannelID int64           `json:"activeChannelId"`
 	Members         []memberInfo    `json:"members"`
 	Messages        []messageDTO    `json:"messages"`
+	SyncSeq         int64           `json:"syncSeq"`
+	Preferences     preferencesDTO  `json:"preferences"`
+	// Conversations orders every channel and DM for the conversation list.
+	Conversations []conversationHint `json:"conversations"`
+	// Locales lists the values preferences.locale accepts.
+	Locales []string `json:"locales"`
+	// Accessibility has positions, counts and unread anchors for the
+	// servers and channels above.
+	Accessibility accessibilityOutline `json:"accessibility"`
+	// MembersComplete is false when Members holds only the first chunk; the
+	// rest comes from members:request over the WebSocket.
+	MembersComplete bool        `json:"membersComplete"`
+	Branding        brandingDTO `json:"branding"`
+	// Announcements are the ones the user has yet to acknowledge.
+	Announcements []announcementDTO `json:"announcements,omitempty"`
+	// WebTransportURL is set when the experimental WebTransport gateway
+	// is enabled; see webtransport.go.
+	WebTransportURL string `json:"webTransportUrl,omitempty"`
 }
 
 type serverState struct {
 	templates *template.Template
-	db        *sql.DB
+	db        *sql.DB // single-connection write pool
+	readDB    *sql.DB
+	stmts     *stmtCache
+	messages  *messageWriter
+	jobs      *jobQueue
+	dataDir   string
 	ws        *wsHub
 	voice     *voiceState
 
-	mu       sync.RWMutex
-	sessions map[string]string // sessionID -> email
+	channelCache  *ttlCache[int64, channelInfo]
+	memberCache   *ttlCache[membershipKey, membershipEntry]
+	overrideCache *ttlCache[int64, []channelOverride]
+	grantCache    *ttlCache[int64, []channelGrant]
+
+	activityCache *ttlCache[activityKey, serverActivity]
+
+	sessionKeys *sessionKeys
+	cookies     cookieSettings
+	jwt         *jwtIssuer
+
+	sessionTTL       time.Duration
+	rememberTTL      time.Duration
+	idempotencyTTL   time.Duration
+	syncRetention    time.Duration
+	ephemeralTTL     time.Duration
+	jobRetention     time.Duration
+	adminEmails      map[string]bool
+	registrationMode string
+	wsIdleTimeout    time.Duration
+	origins          *originPolicy
+	proxies          trustedProxies
+	mail             *mailer
+	bridges          *bridgeHub
+	plugins          *pluginHost
+	automations      *automationRunner
+	graphQL          *graphql.Schema
+	webTransport     *webTransportServer // nil unless WEBTRANSPORT_ADDR is set
+	profanity        *wordMasker
+	iceServers       []iceServerConfig
+	voiceUplinkKbps  int
+	wsLatencyEvery   time.Duration
+	wsLagThreshold   time.Duration
+	wsBatchEvery     time.Duration
+	metrics          *metrics
+	metricsToken     string
+	scimToken        string
+	saml             *samlProvider
+	tenancy          tenancyConfig
+	tenantSlugs      *ttlCache[string, tenant]
+	wsReconnect      wsReconnectPolicy
+	wsEventRate      int
+	maxJSONBody      int64
+	defaultLocale    string
+	defaultTimezone  *time.Location
+
+	longMessageAttachments bool
+	maxTextAttachmentBytes int
+	quotas                 attachmentQuotas
+	blobs                  *blobStores
+	images                 *imagePipeline
+	scanner                uploadScanner
+	scanWake               chan struct{}
+	outboxWake             chan struct{}
+	transcriber            transcriber
+	transcribeWake         chan struct{}
+	maxVoiceMessageBytes   int64
+	maxVoiceRecordingBytes int64
+
+	captcha captchaVerifier
+	// captchaLoginFailures is how many failed logins from an address or for
+	// an account make login ask for a CAPTCHA.
+	captchaLoginFailures int
+	lockouts             loginLockouts
+	passwords            passwordPolicy
+
+	// dmPolicy is DM_POLICY: dmPolicyOpen, dmPolicyMutual or dmPolicyFriends.
+	dmPolicy string
+
+	// emailNotifications emails DMs to recipients who are offline.
+	emailNotifications bool
+	notified           *ttlCache[notifyKey, struct{}]
+
+	setupMu      sync.Mutex
+	setupPending atomic.Bool
+	branding     *ttlCache[int64, instanceBranding]
 
 	defaultServerID  int64
 	defaultChannelID int64
+	directServerID   int64
 }
 
-const sessionCookieName = "echosphere_session"
-
 func main() {
-	tplPattern := filepath.Join("web", "templates", "*.html")
-	templates, err := template.ParseGlob(tplPattern)
-	if err != nil {
-		log.Fatalf("failed to parse templates: %v", err)
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	run, ok := commands[cmd]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", cmd)
+		printUsage()
+		os.Exit(2)
+	}
+	if err := run(args); err != nil {
+		log.Fatalf("%s: %v", cmd, err)
 	}
+}
 
-	dbPath := filepath.Join("data", "echosphere.db")
+// openServerState opens the database, applies the schema and wires up
+// everything the HTTP server and the admin commands share.
+func openServerState(ctx context.Context) (*serverState, error) {
+	dataDir := "data"
+	dbPath := filepath.Join(dataDir, "echosphere.db")
 	if err := os.MkdirAll(filepath.Dir(dbPath), 0o755); err != nil {
-		log.Fatalf("ensure data directory: %v", err)
+		return nil, fmt.Errorf("ensure data directory: %w", err)
 	}
 
-	db, err := sql.Open("sqlite", dbPath)
+	db, readDB, err := openDatabase(ctx, dbPath)
 	if err != nil {
-		log.Fatalf("open database: %v", err)
-	}
-	db.SetMaxOpenConns(1)
-
-	ctx := context.Background()
-	if err := db.PingContext(ctx); err != nil {
-		log.Fatalf("database ping: %v", err)
+		return nil, fmt.Errorf("open database: %w", err)
 	}
 	if err := ensureSchema(ctx, db); err != nil {
-		log.Fatalf("database migration: %v", err)
+		db.Close()
+		readDB.Close()
+		return nil, fmt.Errorf("database migration: %w", err)
+	}
+	if err := configureMessageArchive(ctx, db, boolFromEnv("MESSAGE_ARCHIVE", false)); err != nil {
+		db.Close()
+		readDB.Close()
+		return nil, fmt.Errorf("message archive: %w", err)
+	}
+	blobs, err := blobStoresFromEnv(dataDir)
+	if err != nil {
+		db.Close()
+		readDB.Close()
+		return nil, fmt.Errorf("attachment store: %w", err)
+	}
+	scanner, err := uploadScannerFromEnv()
+	if err != nil {
+		db.Close()
+		readDB.Close()
+		return nil, err
+	}
+	transcriber, err := transcriberFromEnv()
+	if err != nil {
+		db.Close()
+		readDB.Close()
+		return nil, err
+	}
+	captcha, err := captchaFromEnv()
+	if err != nil {
+		db.Close()
+		readDB.Close()
+		return nil, err
+	}
+	sessionKeys, err := sessionKeysFromEnv(dataDir)
+	if err != nil {
+		db.Close()
+		readDB.Close()
+		return nil, err
+	}
+	cookies, err := cookieSettingsFromEnv()
+	if err != nil {
+		db.Close()
+		readDB.Close()
+		return nil, err
+	}
+	jwt, err := jwtIssuerFromEnv(dataDir)
+	if err != nil {
+		db.Close()
+		readDB.Close()
+		return nil, err
+	}
+	saml, err := samlFromEnv()
+	if err != nil {
+		db.Close()
+		readDB.Close()
+		return nil, err
+	}
+	tenancy, err := tenancyFromEnv()
+	if err != nil {
+		db.Close()
+		readDB.Close()
+		return nil, err
 	}
 
 	srv := &serverState{
-		templates: templates,
-		db:        db,
-		ws:        newWSHub(),
-		voice:     newVoiceState(),
-		sessions:  make(map[string]string),
+		db:       db,
+		readDB:   readDB,
+		stmts:    newStmtCache(readDB),
+		messages: newMessageWriter(db),
+		jobs:     newJobQueue(db, readDB, intFromEnv("JOB_WORKERS", defaultJobWorkers)),
+		dataDir:  dataDir,
+		ws:       newWSHub(intFromEnv("WS_MAX_CONNECTIONS_PER_USER", defaultWSMaxPerUser), intFromEnv("WS_MAX_CONNECTIONS", defaultWSMaxTotal)),
+		voice:    newVoiceState(),
+
+		channelCache:  newTTLCache[int64, channelInfo](lookupCacheTTL, lookupCacheSize),
+		memberCache:   newTTLCache[membershipKey, membershipEntry](lookupCacheTTL, lookupCacheSize),
+		overrideCache: newTTLCache[int64, []channelOverride](lookupCacheTTL, lookupCacheSize),
+		grantCache:    newTTLCache[int64, []channelGrant](lookupCacheTTL, lookupCacheSize),
+
+		activityCache: newTTLCache[activityKey, serverActivity](activityCacheTTL, activityCacheSize),
+
+		sessionKeys:    sessionKeys,
+		cookies:        cookies,
+		jwt:            jwt,
+		sessionTTL:     durationFromEnv("SESSION_TTL", defaultSessionTTL),
+		rememberTTL:    durationFromEnv("SESSION_REMEMBER_TTL", defaultRememberTTL),
+		idempotencyTTL: durationFromEnv("IDEMPOTENCY_TTL", defaultIdempotencyTTL),
+		syncRetention:  durationFromEnv("SYNC_RETENTION", defaultSyncRetention),
+		ephemeralTTL:   durationFromEnv("EPHEMERAL_TTL", defaultEphemeralTTL),
+		jobRetention:   durationFromEnv("JOB_RETENTION", defaultJobRetention),
+		adminEmails:    parseAdminEmails(os.Getenv("ADMIN_EMAILS")),
+
+		longMessageAttachments: boolFromEnv("LONG_MESSAGE_ATTACHMENTS", false),
+		maxTextAttachmentBytes: intFromEnv("MAX_TEXT_ATTACHMENT_BYTES", defaultMaxTextAttachmentBytes),
+		quotas:                 attachmentQuotasFromEnv(),
+		blobs:                  blobs,
+		images:                 imagePipelineFromEnv(),
+		scanner:                scanner,
+		scanWake:               make(chan struct{}, 1),
+		outboxWake:             make(chan struct{}, 1),
+		transcriber:            transcriber,
+		transcribeWake:         make(chan struct{}, 1),
+		maxVoiceMessageBytes:   int64(intFromEnv("VOICE_MESSAGE_MAX_BYTES", defaultVoiceMessageMaxBytes)),
+		maxVoiceRecordingBytes: int64(intFromEnv("VOICE_RECORDING_MAX_BYTES", defaultVoiceRecordingMaxBytes)),
+		captcha:                captcha,
+		captchaLoginFailures:   intFromEnv("CAPTCHA_LOGIN_FAILURES", defaultCaptchaLoginFailures),
+		passwords:              passwordPolicyFromEnv(),
+		lockouts:               loginLockoutsFromEnv(),
+
+		registrationMode: registrationModeFromEnv(),
+		dmPolicy:         dmPolicyFromEnv(),
+
+		// On by default once there is somewhere to deliver mail.
+		emailNotifications: boolFromEnv("EMAIL_NOTIFICATIONS", os.Getenv("SMTP_ADDR") != ""),
+		notified:           newTTLCache[notifyKey, struct{}](durationFromEnv("EMAIL_NOTIFICATION_COOLDOWN", defaultNotificationCooldown), lookupCacheSize),
+
+		// Unset means idle connections are kept for as long as they answer pings.
+		wsIdleTimeout: durationFromEnv("WS_IDLE_TIMEOUT", 0),
+		origins:       originPolicyFromEnv(),
+		proxies:       parseTrustedProxies(os.Getenv("TRUSTED_PROXIES")),
+		mail:          mailerFromEnv(),
+		profanity:     profanityFromEnv(),
+		iceServers:    iceServersFromEnv(),
+		// Assumed upload capacity of a participant, split across their peers.
+		voiceUplinkKbps: intFromEnv("VOICE_UPLINK_KBPS", defaultVoiceUplinkKbps),
+		wsLatencyEvery:  durationFromEnv("WS_LATENCY_INTERVAL", defaultWSLatencyInterval),
+		wsLagThreshold:  durationFromEnv("WS_LAG_THRESHOLD", defaultWSLagThreshold),
+		wsBatchEvery:    durationFromEnv("WS_BATCH_INTERVAL", defaultWSBatchInterval),
+		metrics:         newMetrics(),
+		metricsToken:    os.Getenv("METRICS_TOKEN"),
+		scimToken:       os.Getenv("SCIM_TOKEN"),
+		saml:            saml,
+		tenancy:         tenancy,
+		tenantSlugs:     newTTLCache[string, tenant](tenantCacheTTL, lookupCacheSize),
+		branding:        newTTLCache[int64, instanceBranding](tenantCacheTTL, lookupCacheSize),
+		wsReconnect:     wsReconnectPolicyFromEnv(),
+		wsEventRate:     intFromEnv("WS_EVENT_RATE", defaultWSEventRate),
+		maxJSONBody:     int64(intFromEnv("MAX_JSON_BODY_BYTES", defaultMaxJSONBody)),
+		defaultLocale:   localeFromEnv(),
+		defaultTimezone: timezoneFromEnv(),
 	}
 
+	srv.messages.committed = srv.wakeOutbox
+	srv.ws.metrics = srv.metrics
+	srv.registerJobs()
+
 	if err := srv.ensureDefaultWorkspace(ctx); err != nil {
-		log.Fatalf("ensure default workspace: %v", err)
+		srv.close()
+		return nil, fmt.Errorf("ensure default workspace: %w", err)
+	}
+	if err := srv.ensureDirectWorkspace(ctx); err != nil {
+		srv.close()
+		return nil, fmt.Errorf("ensure direct messages: %w", err)
+	}
+	if err := srv.ensureServerChannels(ctx); err != nil {
+		srv.close()
+		return nil, fmt.Errorf("ensure server channels: %w", err)
 	}
+	if err := srv.loadInstanceSettings(ctx); err != nil {
+		srv.close()
+		return nil, fmt.Errorf("load instance settings: %w", err)
+	}
+	if err := srv.closeStaleVoiceSessions(ctx); err != nil {
+		srv.close()
+		return nil, fmt.Errorf("close stale voice sessions: %w", err)
+	}
+	return srv, nil
+}
+
+func (s *serverState) close() {
+	s.stmts.Close()
+	if err := s.readDB.Close(); err != nil {
+		log.Printf("close read pool: %v", err)
+	}
+	if err := s.db.Close(); err != nil {
+		log.Printf("close database: %v", err)
+	}
+}
+
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", ":"+envOrDefault("PORT", "8080"), "listen address")
+	flags.Parse(args)
+
+	web := webAssets()
+	templates, err := template.ParseFS(web, "templates/*.html")
+	if err != nil {
+		return fmt.Errorf("parse templates: %w", err)
+	}
+	static, err := fs.Sub(web, "static")
+	if err != nil {
+		return fmt.Errorf("static assets: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	srv, err := openServerState(ctx)
+	if err != nil {
+		return err
+	}
+	defer srv.close()
+	srv.templates = templates
+	srv.bridges = newBridgeHub(srv, matrixBridgeFromEnv(srv))
+	srv.plugins = newPluginHost(srv, registeredPlugins...)
+	srv.automations = newAutomationRunner(srv)
+	srv.graphQL = newGraphQLSchema()
+	adminAPI, err := adminGRPCFromEnv(srv)
+	if err != nil {
+		return err
+	}
+	if srv.webTransport, err = webTransportFromEnv(srv); err != nil {
+		return err
+	}
+
+	go srv.messages.run(ctx)
+	go srv.runOutboxDispatcher(ctx)
+	go srv.runReminderWorker(ctx)
+	go srv.jobs.run(ctx)
+	go srv.runBlobSweeper(ctx)
+	go srv.runUploadScanner(ctx)
+	go srv.runTranscriber(ctx)
+	go srv.runMessageExpiry(ctx)
+	go srv.runCustomStatusExpiry(ctx)
+	go srv.runGrantExpiry(ctx)
+	go srv.runLagMonitor(ctx)
+	go srv.runStatsAggregator(ctx, durationFromEnv("STATS_INTERVAL", defaultStatsInterval))
+	go srv.bridges.run(ctx)
+	go srv.automations.run(ctx)
+	if adminAPI != nil {
+		go adminAPI.run(ctx)
+	}
+	if srv.webTransport != nil {
+		go srv.webTransport.run(ctx)
+	}
+	go srv.runMaintenanceWorker(ctx, durationFromEnv("DB_MAINTENANCE_INTERVAL", defaultMaintenanceInterval))
 
 	mux := http.NewServeMux()
-	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(filepath.Join("web", "static")))))
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(static))))
 	mux.HandleFunc("/", srv.handleIndex)
+	mux.HandleFunc("/setup", srv.handleSetup)
 	mux.HandleFunc("/login", srv.handleLogin)
 	mux.HandleFunc("/signup", srv.handleSignup)
 	mux.HandleFunc("/logout", srv.handleLogout)
+	mux.HandleFunc("/api/auth/token", srv.handleAuthToken)
+	mux.HandleFunc("/api/auth/revoke", srv.handleAuthRevoke)
+	mux.HandleFunc("/api/auth/scopes", srv.handleAuthScopes)
+	mux.HandleFunc("/.well-known/jwks.json", srv.handleJWKS)
+	mux.HandleFunc(brandLogoPath, srv.handleBrandLogo)
+	mux.HandleFunc("/saml/metadata", srv.handleSAMLMetadata)
+	mux.HandleFunc("/saml/login", srv.handleSAMLLogin)
+	mux.HandleFunc(samlACSPath, srv.handleSAMLACS)
+	mux.HandleFunc("/account/email/confirm", srv.handleEmailChangeConfirm)
 	mux.HandleFunc("/ws", srv.handleWS)
+	mux.HandleFunc("/media/", srv.handleMedia)
 	mux.HandleFunc("/api/bootstrap", srv.handleBootstrap)
+	mux.Handle("/api/bootstrap/", http.StripPrefix("/api/bootstrap", http.HandlerFunc(srv.handleBootstrapResource)))
+	mux.HandleFunc("/api/sync", srv.handleSync)
+	mux.HandleFunc("/api/graphql", srv.handleGraphQL)
 	mux.HandleFunc("/api/servers", srv.handleServersCollection)
 	mux.Handle("/api/servers/", http.StripPrefix("/api/servers/", http.HandlerFunc(srv.handleServerAPI)))
 	mux.Handle("/api/channels/", http.StripPrefix("/api/channels/", http.HandlerFunc(srv.handleChannelAPI)))
+	mux.HandleFunc("/api/dms", srv.handleDirectChannels)
+	mux.Handle("/api/friends", http.StripPrefix("/api/friends", http.HandlerFunc(srv.handleFriends)))
+	mux.Handle("/api/friends/", http.StripPrefix("/api/friends", http.HandlerFunc(srv.handleFriends)))
+	mux.HandleFunc("/api/account/email", srv.handleAccountEmail)
+	mux.HandleFunc("/api/account/preferences", srv.handleAccountPreferences)
+	mux.HandleFunc("/api/me/preferences", srv.handleAccountPreferences)
+	mux.HandleFunc("/api/me/security", srv.handleAccountSecurity)
+	mux.HandleFunc("/api/account/password", srv.handleAccountPassword)
+	mux.HandleFunc("/api/account/profile", srv.handleAccountProfile)
+	mux.HandleFunc("/api/account/status", srv.handleAccountStatus)
+	mux.HandleFunc("/api/account/storage", srv.handleAccountStorage)
+	mux.Handle("/api/account/devices", http.StripPrefix("/api/account/devices", http.HandlerFunc(srv.handleAccountDevices)))
+	mux.Handle("/api/account/devices/", http.StripPrefix("/api/account/devices", http.HandlerFunc(srv.handleAccountDevices)))
+	mux.Handle("/api/voice/", http.StripPrefix("/api/voice/", http.HandlerFunc(srv.handleVoiceAPI)))
+	mux.HandleFunc("/api/stars", srv.handleStars)
+	mux.Handle("/api/reports", http.StripPrefix("/api/reports", http.HandlerFunc(srv.handleReports)))
+	mux.Handle("/api/reports/", http.StripPrefix("/api/reports", http.HandlerFunc(srv.handleReports)))
+	mux.Handle("/api/reminders", http.StripPrefix("/api/reminders", http.HandlerFunc(srv.handleReminders)))
+	mux.Handle("/api/reminders/", http.StripPrefix("/api/reminders/", http.HandlerFunc(srv.handleReminders)))
+	mux.HandleFunc("/api/admin/backup", srv.handleAdminBackup)
+	mux.HandleFunc("/api/admin/voice/rtt", srv.handleAdminVoiceRTT)
+	mux.HandleFunc("/api/admin/connections", srv.handleAdminConnections)
+	mux.HandleFunc("/api/admin/storage", srv.handleAdminStorage)
+	mux.Handle("/api/admin/quarantine", http.StripPrefix("/api/admin/quarantine", http.HandlerFunc(srv.handleAdminQuarantine)))
+	mux.Handle("/api/admin/quarantine/", http.StripPrefix("/api/admin/quarantine", http.HandlerFunc(srv.handleAdminQuarantine)))
+	mux.Handle("/api/admin/messages/", http.StripPrefix("/api/admin/messages", http.HandlerFunc(srv.handleAdminMessageRevisions)))
+	mux.HandleFunc("/api/admin/branding", srv.handleAdminBranding)
+	mux.Handle("/api/admin/jobs", http.StripPrefix("/api/admin/jobs", http.HandlerFunc(srv.handleAdminJobs)))
+	mux.Handle("/api/admin/jobs/", http.StripPrefix("/api/admin/jobs", http.HandlerFunc(srv.handleAdminJobs)))
+	mux.HandleFunc("/metrics", srv.handleMetrics)
+	mux.Handle("/scim/v2/", http.StripPrefix("/scim/v2", http.HandlerFunc(srv.handleSCIM)))
+	mux.Handle("/api/admin/invites", http.StripPrefix("/api/admin/invites", http.HandlerFunc(srv.handleAdminInvites)))
+	mux.Handle("/api/admin/invites/", http.StripPrefix("/api/admin/invites", http.HandlerFunc(srv.handleAdminInvites)))
+	mux.Handle("/api/admin/approvals", http.StripPrefix("/api/admin/approvals", http.HandlerFunc(srv.handleAdminApprovals)))
+	mux.Handle("/api/admin/approvals/", http.StripPrefix("/api/admin/approvals", http.HandlerFunc(srv.handleAdminApprovals)))
+	mux.Handle("/api/admin/announcements", http.StripPrefix("/api/admin/announcements", http.HandlerFunc(srv.handleAdminAnnouncements)))
+	mux.Handle("/api/admin/announcements/", http.StripPrefix("/api/admin/announcements", http.HandlerFunc(srv.handleAdminAnnouncements)))
+	mux.Handle("/api/announcements/", http.StripPrefix("/api/announcements", http.HandlerFunc(srv.handleAnnouncementAck)))
+	srv.bridges.routes(mux)
+	srv.plugins.routes(mux)
+
+	log.Printf("EchoSphere server listening on %s", *addr)
+
+	httpServer := &http.Server{
+		Addr:    *addr,
+		Handler: srv.proxies.middleware(requestIDMiddleware(srv.tenantMiddleware(srv.localeMiddleware(loggingMiddleware(srv.origins.corsMiddleware(csrfMiddleware(srv.setupGate(srv.slidingSessions(srv.enforceScopes(mux)))))))))),
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- httpServer.ListenAndServe() }()
 
-	addr := ":" + envOrDefault("PORT", "8080")
-	defer func() {
-		if err := srv.db.Close(); err != nil {
-			log.Printf("close database: %v", err)
-		}
-	}()
-
-	log.Printf("EchoSphere server listening on %s", addr)
-
-	if err := http.ListenAndServe(addr, loggingMiddleware(mux)); err != nil {
-		log.Fatalf("server stopped: %v", err)
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	// WebSockets are hijacked connections that Shutdown does not track, so
+	// they are told to come back later before in-flight requests drain.
+	log.Printf("shutting down")
+	srv.ws.closeAll(wsCloseShuttingDown, "server shutting down")
+	if srv.webTransport != nil {
+		srv.webTransport.close()
 	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer cancel()
+	return httpServer.Shutdown(shutdownCtx)
 }
 
 func toMessageDTO(msg chatMessage) messageDTO {
-	return messageDTO{
+	dto := messageDTO{
 		ID:                msg.ID,
 		ChannelID:         msg.ChannelID,
-		AuthorEmail:       msg.AuthorEmail,
+		AuthorID:          msg.AuthorID,
+		AuthorHandle:      msg.AuthorHandle,
 		AuthorDisplayName: msg.AuthorDisplayName,
+		AuthorColor:       msg.AuthorColor.String,
 		Content:           msg.Content,
 		CreatedAt:         msg.CreatedAt,
+		Crossposted:       msg.CrosspostedAt.Valid,
+		Nonce:             msg.Nonce,
+		Transcript:        msg.Transcript,
+	}
+	if msg.ExpiresAt.Valid {
+		dto.ExpiresAt = &msg.ExpiresAt.Time
+	}
+	for _, att := range msg.Attachments {
+		dto.Attachments = append(dto.Attachments, att.withURLs(msg.ChannelID, msg.ID))
+	}
+	if msg.Sticker != nil {
+		st := msg.Sticker.withURL()
+		dto.Sticker = &st
+	} else if msg.StickerID.Valid {
+		dto.Sticker = &stickerDTO{ID: msg.StickerID.Int64, Deleted: true}
+	}
+	if msg.OriginMessageID.Valid {
+		dto.ForwardedFrom = &messageOriginDTO{
+			MessageID:         msg.OriginMessageID.Int64,
+			ChannelID:         msg.OriginChannelID.Int64,
+			AuthorID:          msg.OriginAuthorID.Int64,
+			AuthorHandle:      msg.OriginAuthorHandle.String,
+			AuthorDisplayName: msg.OriginAuthorDisplayName.String,
+		}
+	}
+	return dto
+}
+
+func toChannelPayload(ch channelInfo) channelPayload {
+	return channelPayload{
+		ID:        ch.ID,
+		ServerID:  ch.ServerID,
+		Slug:      ch.Slug,
+		Name:      ch.Name,
+		CreatedAt: ch.CreatedAt,
+		Type:      ch.Kind,
+		ReadOnly:  ch.PostRoles != "",
+		PostRoles: splitRoles(ch.PostRoles),
+		Topic:     ch.Topic,
+		Emoji:     ch.Emoji,
+		EmojiURL:  mediaURL(ch.EmojiPath),
 	}
 }
 
@@ -173,53 +661,45 @@ func (s *serverState) handleIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.ensureMembership(r.Context(), currentUser.Email); err != nil {
+	if err := s.ensureMembership(r.Context(), currentUser.Email, currentUser.TenantID); err != nil {
 		log.Printf("ensure membership: %v", err)
 	}
 
-	payload, err := s.buildBootstrapPayload(r.Context(), currentUser)
+	// Everything else comes from /api/bootstrap once the page has loaded;
+	// preferences are here so the theme applies before the first paint.
+	prefs, err := s.preferencesFor(r.Context(), currentUser)
 	if err != nil {
-		log.Printf("bootstrap payload: %v", err)
+		log.Printf("app preferences: %v", err)
 		http.Error(w, "failed to load workspace", http.StatusInternalServerError)
 		return
 	}
 
-	serversJSON := template.JS("[]")
-	if raw, err := json.Marshal(payload.Servers); err == nil {
-		serversJSON = template.JS(raw)
-	}
-
-	membersJSON := template.JS("[]")
-	if raw, err := json.Marshal(payload.Members); err == nil {
-		membersJSON = template.JS(raw)
-	}
-
-	messagesJSON := template.JS("[]")
-	if raw, err := json.Marshal(payload.Messages); err == nil {
-		messagesJSON = template.JS(raw)
-	}
-
 	data := templateData{
-		"Username":        currentUser.Email,
-		"DisplayName":     currentUser.DisplayName,
-		"ServersJSON":     serversJSON,
-		"MembersJSON":     membersJSON,
-		"MessagesJSON":    messagesJSON,
-		"ActiveServerID":  payload.ActiveServerID,
-		"ActiveChannelID": payload.ActiveChannelID,
+		"UserID":      currentUser.ID,
+		"Handle":      currentUser.Handle,
+		"Username":    currentUser.Email,
+		"DisplayName": currentUser.DisplayName,
+		"Preferences": prefs,
 	}
 
-	s.renderTemplate(w, http.StatusOK, "app", data)
+	s.renderTemplate(w, r, http.StatusOK, "app", data)
 }
 
 func (s *serverState) buildBootstrapPayload(ctx context.Context, currentUser user) (bootstrapPayload, error) {
+	// Read the checkpoint before the snapshot: replaying a change the
+	// snapshot already has is harmless, missing one is not.
+	syncSeq, err := s.currentSyncSeq(ctx)
+	if err != nil {
+		return bootstrapPayload{}, err
+	}
+
 	servers, err := s.serversForUser(ctx, currentUser.Email)
 	if err != nil {
 		return bootstrapPayload{}, err
 	}
 
 	if len(servers) == 0 {
-		if err := s.ensureMembership(ctx, currentUser.Email); err != nil {
+		if err := s.ensureMembership(ctx, currentUser.Email, currentUser.TenantID); err != nil {
 			return bootstrapPayload{}, err
 		}
 		servers, err = s.serversForUser(ctx, currentUser.Email)
@@ -228,7 +708,10 @@ func (s *serverState) buildBootstrapPayload(ctx context.Context, currentUser use
 		}
 	}
 
-	activeServerID := s.defaultServerID
+	activeServerID, err := s.homeServerFor(ctx, currentUser.TenantID)
+	if err != nil {
+		return bootstrapPayload{}, err
+	}
 	containsActive := false
 	for _, srv := range servers {
 		if srv.ID == activeServerID {
@@ -240,41 +723,20 @@ func (s *serverState) buildBootstrapPayload(ctx context.Context, currentUser use
 		activeServerID = servers[0].ID
 	}
 
+	channels, err := s.channelsForUser(ctx, currentUser.Email)
+	if err != nil {
+		return bootstrapPayload{}, err
+	}
+	channelsByServer := make(map[int64][]channelPayload, len(servers))
+	for _, ch := range channels {
+		channelsByServer[ch.ServerID] = append(channelsByServer[ch.ServerID], toChannelPayload(ch))
+	}
+
 	var activeChannelID int64
 	serverPayloads := make([]serverPayload, 0, len(servers))
-
 	for _, srv := range servers {
-		channels, err := s.channelsForServer(ctx, srv.ID)
-		if err != nil {
-			return bootstrapPayload{}, err
-		}
-
-		chPayloads := make([]channelPayload, 0, len(channels))
-		for _, ch := range channels {
-			chPayloads = append(chPayloads, channelPayload{
-				ID:        ch.ID,
-				ServerID:  ch.ServerID,
-				Slug:      ch.Slug,
-				Name:      ch.Name,
-				CreatedAt: ch.CreatedAt,
-				Type:      ch.Kind,
-			})
-		}
-
-		if len(chPayloads) == 0 {
-			now := time.Now().UTC()
-			res, err := s.db.ExecContext(ctx, `INSERT INTO channels (server_id, slug, name, created_at) VALUES (?, ?, ?, ?)`, srv.ID, "general", "general", now)
-			if err != nil {
-				return bootstrapPayload{}, err
-			}
-			id, err := res.LastInsertId()
-			if err != nil {
-				return bootstrapPayload{}, err
-			}
-			chPayloads = append(chPayloads, channelPayload{ID: id, ServerID: srv.ID, Slug: "general", Name: "general", CreatedAt: now, Type: "text"})
-		}
-
-		if srv.ID == activeServerID {
+		chPayloads := channelsByServer[srv.ID]
+		if srv.ID == activeServerID && len(chPayloads) > 0 {
 			activeChannelID = chPayloads[0].ID
 			if srv.ID == s.defaultServerID {
 				for _, ch := range chPayloads {
@@ -285,21 +747,19 @@ func (s *serverState) buildBootstrapPayload(ctx context.Context, currentUser use
 				}
 			}
 		}
-
-		serverPayloads = append(serverPayloads, serverPayload{
-			ID:        srv.ID,
-			Slug:      srv.Slug,
-			Name:      srv.Name,
-			CreatedAt: srv.CreatedAt,
-			Channels:  chPayloads,
-		})
+		serverPayloads = append(serverPayloads, toServerPayload(srv, chPayloads))
 	}
 
-	if activeChannelID == 0 && len(serverPayloads) > 0 {
-		activeChannelID = serverPayloads[0].Channels[0].ID
+	if activeChannelID == 0 {
+		for _, srv := range serverPayloads {
+			if len(srv.Channels) > 0 {
+				activeServerID, activeChannelID = srv.ID, srv.Channels[0].ID
+				break
+			}
+		}
 	}
 
-	members, err := s.membersForServer(ctx, activeServerID)
+	members, membersComplete, err := s.memberChunk(ctx, currentUser.ID, activeServerID, memberFilter{Limit: memberChunkSize})
 	if err != nil {
 		return bootstrapPayload{}, err
 	}
@@ -311,61 +771,84 @@ func (s *serverState) buildBootstrapPayload(ctx context.Context, currentUser use
 
 	msgDTOs := make([]messageDTO, 0, len(messages))
 	for _, msg := range messages {
-		msgDTOs = append(msgDTOs, toMessageDTO(msg))
+		msgDTOs = append(msgDTOs, s.messageDTOFor(currentUser, msg))
+	}
+	if err := s.annotateStars(ctx, currentUser, msgDTOs); err != nil {
+		return bootstrapPayload{}, err
+	}
+
+	prefs, err := s.preferencesFor(ctx, currentUser)
+	if err != nil {
+		return bootstrapPayload{}, err
+	}
+	conversations, err := s.conversationOrder(ctx, currentUser)
+	if err != nil {
+		return bootstrapPayload{}, err
+	}
+	outline, err := s.accessibilityOutline(ctx, currentUser, serverPayloads, conversations)
+	if err != nil {
+		return bootstrapPayload{}, err
+	}
+	announcements, err := s.pendingAnnouncements(ctx, currentUser)
+	if err != nil {
+		return bootstrapPayload{}, err
 	}
 
 	return bootstrapPayload{
 		User: userDTO{
+			ID:          currentUser.ID,
 			Email:       currentUser.Email,
+			Handle:      currentUser.Handle,
 			DisplayName: currentUser.DisplayName,
 		},
 		Servers:         serverPayloads,
 		ActiveServerID:  activeServerID,
 		ActiveChannelID: activeChannelID,
 		Members:         members,
+		MembersComplete: membersComplete,
+		Branding:        s.currentBranding(ctx, currentUser.TenantID).dto(),
 		Messages:        msgDTOs,
+		SyncSeq:         syncSeq,
+		Preferences:     prefs,
+		Conversations:   conversations,
+		Locales:         supportedLocales(),
+		Accessibility:   outline,
+		Announcements:   announcements,
 	}, nil
 }
 
 func (s *serverState) handleBootstrap(w http.ResponseWriter, r *http.Request) {
 	currentUser, ok := s.userFromRequest(r)
 	if !ok {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		httpError(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	payload, err := s.buildBootstrapPayload(r.Context(), currentUser)
 	if err != nil {
 		log.Printf("bootstrap handler: %v", err)
-		http.Error(w, "failed to load data", http.StatusInternalServerError)
+		httpError(w, "failed to load data", http.StatusInternalServerError)
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(payload); err != nil {
-		log.Printf("encode bootstrap: %v", err)
+	if s.webTransport != nil {
+		payload.WebTransportURL = s.webTransport.urlFor(r)
 	}
+	writeCacheableJSON(w, r, payload)
 }
 
 func (s *serverState) handleServersCollection(w http.ResponseWriter, r *http.Request) {
 	currentUser, ok := s.userFromRequest(r)
 	if !ok {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		httpError(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	switch r.Method {
 	case http.MethodPost:
 		var body struct {
-			Name string `json:"name"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			http.Error(w, "invalid request body", http.StatusBadRequest)
-			return
+			Name string `json:"name" validate:"trim,required"`
 		}
-		body.Name = strings.TrimSpace(body.Name)
-		if body.Name == "" {
-			http.Error(w, "name is required", http.StatusBadRequest)
+		if !s.decodeJSON(w, r, &body) {
 			return
 		}
 
@@ -385,28 +868,15 @@ func (s *serverState) handleServersCollection(w http.ResponseWriter, r *http.Req
 				continue
 			}
 			log.Printf("create server: %v", err)
-			http.Error(w, "failed to create server", http.StatusInternalServerError)
+			httpError(w, "failed to create server", http.StatusInternalServerError)
 			return
 		}
 		if err != nil {
-			http.Error(w, "failed to create server", http.StatusInternalServerError)
+			httpError(w, "failed to create server", http.StatusInternalServerError)
 			return
 		}
 
-		response := serverPayload{
-			ID:        srvInfo.ID,
-			Slug:      srvInfo.Slug,
-			Name:      srvInfo.Name,
-			CreatedAt: srvInfo.CreatedAt,
-			Channels: []channelPayload{{
-				ID:        chInfo.ID,
-				ServerID:  chInfo.ServerID,
-				Slug:      chInfo.Slug,
-				Name:      chInfo.Name,
-				CreatedAt: chInfo.CreatedAt,
-				Type:      chInfo.Kind,
-			}},
-		}
+		response := toServerPayload(srvInfo, []channelPayload{toChannelPayload(chInfo)})
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
@@ -415,38 +885,43 @@ func (s *serverState) handleServersCollection(w http.ResponseWriter, r *http.Req
 		}
 	default:
 		w.Header().Set("Allow", "POST")
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
 func (s *serverState) handleServerAPI(w http.ResponseWriter, r *http.Request) {
 	currentUser, ok := s.userFromRequest(r)
 	if !ok {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		httpError(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	path := strings.Trim(r.URL.Path, "/")
 	parts := strings.Split(path, "/")
 	if len(parts) == 0 || parts[0] == "" {
-		http.NotFound(w, r)
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if parts[0] == "import" && len(parts) == 1 {
+		s.handleServerImport(w, r, currentUser)
 		return
 	}
 
 	serverID, err := strconv.ParseInt(parts[0], 10, 64)
 	if err != nil {
-		http.Error(w, "invalid server id", http.StatusBadRequest)
+		httpError(w, "invalid server id", http.StatusBadRequest)
 		return
 	}
 
 	hasAccess, err := s.userHasServerAccess(r.Context(), currentUser.Email, serverID)
 	if err != nil {
 		log.Printf("check server access: %v", err)
-		http.Error(w, "failed to check permissions", http.StatusInternalServerError)
+		httpError(w, "failed to check permissions", http.StatusInternalServerError)
 		return
 	}
 	if !hasAccess {
-		http.Error(w, "forbidden", http.StatusForbidden)
+		httpError(w, "forbidden", http.StatusForbidden)
 		return
 	}
 
@@ -454,22 +929,18 @@ func (s *serverState) handleServerAPI(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
 			channels, err := s.channelsForServer(r.Context(), serverID)
+			if err == nil {
+				channels, err = s.visibleChannels(r.Context(), currentUser.Email, channels)
+			}
 			if err != nil {
 				log.Printf("list channels: %v", err)
-				http.Error(w, "failed to list channels", http.StatusInternalServerError)
+				httpError(w, "failed to list channels", http.StatusInternalServerError)
 				return
 			}
 
 			payload := make([]channelPayload, 0, len(channels))
 			for _, ch := range channels {
-				payload = append(payload, channelPayload{
-					ID:        ch.ID,
-					ServerID:  ch.ServerID,
-					Slug:      ch.Slug,
-					Name:      ch.Name,
-					CreatedAt: ch.CreatedAt,
-					Type:      ch.Kind,
-				})
+				payload = append(payload, toChannelPayload(ch))
 			}
 			w.Header().Set("Content-Type", "application/json")
 			if err := json.NewEncoder(w).Encode(payload); err != nil {
@@ -477,26 +948,15 @@ func (s *serverState) handleServerAPI(w http.ResponseWriter, r *http.Request) {
 			}
 		case http.MethodPost:
 			var body struct {
-				Name string `json:"name"`
-				Kind string `json:"kind"`
-			}
-			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-				http.Error(w, "invalid request body", http.StatusBadRequest)
-				return
+				Name string `json:"name" validate:"trim,required"`
+				Kind string `json:"kind" validate:"trim,lower,oneof=text|voice|announcement"`
 			}
-			body.Name = strings.TrimSpace(body.Name)
-			if body.Name == "" {
-				http.Error(w, "name is required", http.StatusBadRequest)
+			if !s.decodeJSON(w, r, &body) {
 				return
 			}
-			body.Kind = strings.ToLower(strings.TrimSpace(body.Kind))
 			if body.Kind == "" {
 				body.Kind = "text"
 			}
-			if body.Kind != "text" && body.Kind != "voice" {
-				http.Error(w, "kind must be 'text' or 'voice'", http.StatusBadRequest)
-				return
-			}
 
 			baseSlug := slugify(body.Name)
 			slug := baseSlug
@@ -512,114 +972,182 @@ func (s *serverState) handleServerAPI(w http.ResponseWriter, r *http.Request) {
 					continue
 				}
 				log.Printf("create channel: %v", err)
-				http.Error(w, "failed to create channel", http.StatusInternalServerError)
+				httpError(w, "failed to create channel", http.StatusInternalServerError)
 				return
 			}
 			if err != nil {
-				http.Error(w, "failed to create channel", http.StatusInternalServerError)
+				httpError(w, "failed to create channel", http.StatusInternalServerError)
 				return
 			}
 
-			response := channelPayload{
-				ID:        chInfo.ID,
-				ServerID:  chInfo.ServerID,
-				Slug:      chInfo.Slug,
-				Name:      chInfo.Name,
-				CreatedAt: chInfo.CreatedAt,
-				Type:      chInfo.Kind,
-			}
+			response := toChannelPayload(chInfo)
 
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusCreated)
 			if err := json.NewEncoder(w).Encode(response); err != nil {
 				log.Printf("encode channel response: %v", err)
 			}
+		case http.MethodPatch:
+			s.handleServerSettings(w, r, serverID, currentUser)
 		default:
-			w.Header().Set("Allow", "GET, POST")
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			w.Header().Set("Allow", "GET, POST, PATCH")
+			httpError(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
 		return
 	}
 
 	if len(parts) < 2 {
-		http.NotFound(w, r)
+		httpError(w, "not found", http.StatusNotFound)
 		return
 	}
 
 	switch parts[1] {
-	case "members":
-		if r.Method != http.MethodGet {
-			w.Header().Set("Allow", "GET")
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case "icon":
+		s.handleServerIcon(w, r, serverID)
+	case "sticker-packs":
+		s.handleServerStickerPacks(w, r, serverID, currentUser, parts[2:])
+	case "roles":
+		s.handleServerRoles(w, r, serverID, currentUser, parts[2:])
+	case "rules":
+		s.handleServerRules(w, r, serverID, currentUser, parts[2:])
+	case "stickers":
+		if len(parts) != 3 {
+			httpError(w, "not found", http.StatusNotFound)
 			return
 		}
-		members, err := s.membersForServer(r.Context(), serverID)
-		if err != nil {
-			log.Printf("list members: %v", err)
-			http.Error(w, "failed to list members", http.StatusInternalServerError)
-			return
+		s.handleServerSticker(w, r, serverID, parts[2])
+	case "reports":
+		s.handleServerReports(w, r, serverID, currentUser)
+	case "audit-log":
+		s.handleServerAuditLog(w, r, serverID, currentUser)
+	case "automations":
+		s.handleServerAutomations(w, r, serverID, currentUser, parts[2:])
+	case "export":
+		s.handleServerExport(w, r, serverID, currentUser, parts[2:])
+	case "activity":
+		s.handleServerActivity(w, r, serverID)
+	case "storage":
+		s.handleServerStorage(w, r, serverID)
+	case "stats":
+		resource := ""
+		if len(parts) > 2 {
+			resource = parts[2]
 		}
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(members); err != nil {
-			log.Printf("encode members: %v", err)
+		s.handleServerStats(w, r, serverID, currentUser, resource)
+	case "members":
+		if len(parts) == 3 && parts[2] == "me" {
+			s.handleLeaveServer(w, r, serverID, currentUser)
+			return
 		}
+		s.handleServerMembers(w, r, serverID, currentUser)
 	default:
-		http.NotFound(w, r)
+		httpError(w, "not found", http.StatusNotFound)
 	}
 }
 
 func (s *serverState) handleChannelAPI(w http.ResponseWriter, r *http.Request) {
 	currentUser, ok := s.userFromRequest(r)
 	if !ok {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		httpError(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	path := strings.Trim(r.URL.Path, "/")
 	parts := strings.Split(path, "/")
 	if len(parts) < 1 || parts[0] == "" {
-		http.NotFound(w, r)
+		httpError(w, "not found", http.StatusNotFound)
 		return
 	}
 
 	channelID, err := strconv.ParseInt(parts[0], 10, 64)
 	if err != nil {
-		http.Error(w, "invalid channel id", http.StatusBadRequest)
+		httpError(w, "invalid channel id", http.StatusBadRequest)
 		return
 	}
 
 	ch, exists, err := s.channelByID(r.Context(), channelID)
 	if err != nil {
 		log.Printf("load channel: %v", err)
-		http.Error(w, "failed to load channel", http.StatusInternalServerError)
+		httpError(w, "failed to load channel", http.StatusInternalServerError)
 		return
 	}
 	if !exists {
-		http.NotFound(w, r)
+		httpError(w, "not found", http.StatusNotFound)
 		return
 	}
 
-	hasAccess, err := s.userHasServerAccess(r.Context(), currentUser.Email, ch.ServerID)
+	hasAccess, err := s.userHasChannelAccess(r.Context(), currentUser.Email, ch)
 	if err != nil {
 		log.Printf("check channel access: %v", err)
-		http.Error(w, "failed to verify access", http.StatusInternalServerError)
+		httpError(w, "failed to verify access", http.StatusInternalServerError)
 		return
 	}
 	if !hasAccess {
-		http.Error(w, "forbidden", http.StatusForbidden)
+		httpError(w, "forbidden", http.StatusForbidden)
 		return
 	}
 
-	if len(parts) < 2 {
-		http.NotFound(w, r)
+	if len(parts) < 2 || parts[1] == "" {
+		s.handleChannelSettings(w, r, ch, currentUser)
 		return
 	}
 
 	switch parts[1] {
 	case "messages":
+		if len(parts) == 4 {
+			switch parts[3] {
+			case "forward":
+				s.handleForwardMessage(w, r, ch, currentUser, parts[2])
+			case "crosspost":
+				s.handleCrosspostMessage(w, r, ch, currentUser, parts[2])
+			case "star":
+				s.handleMessageStar(w, r, ch, currentUser, parts[2])
+			default:
+				httpError(w, "not found", http.StatusNotFound)
+			}
+			return
+		}
+		if len(parts) == 5 && parts[3] == "attachments" {
+			s.handleMessageAttachment(w, r, ch, parts[2], parts[4])
+			return
+		}
 		s.handleChannelMessages(w, r, ch, currentUser)
+	case "followers":
+		targetID := ""
+		if len(parts) > 2 {
+			targetID = parts[2]
+		}
+		s.handleChannelFollowers(w, r, ch, currentUser, targetID)
+	case "bridges":
+		bridgeName := ""
+		if len(parts) > 2 {
+			bridgeName = parts[2]
+		}
+		s.handleChannelBridges(w, r, ch, currentUser, bridgeName)
+	case "audio":
+		s.handleChannelAudio(w, r, ch, currentUser)
+	case "voice-messages":
+		s.handleVoiceMessages(w, r, ch, currentUser)
+	case "recordings":
+		recordingID := ""
+		if len(parts) > 2 {
+			recordingID = parts[2]
+		}
+		s.handleVoiceRecordingUpload(w, r, ch, currentUser, recordingID)
+	case "search":
+		s.handleChannelSearch(w, r, ch, currentUser)
+	case "draft":
+		s.handleChannelDraft(w, r, ch, currentUser)
+	case "read":
+		s.handleChannelRead(w, r, ch, currentUser)
+	case "reading-order":
+		s.handleChannelReadingOrder(w, r, ch, currentUser)
+	case "overrides":
+		s.handleChannelOverrides(w, r, ch, currentUser, parts[2:])
+	case "grants":
+		s.handleChannelGrants(w, r, ch, currentUser, parts[2:])
 	default:
-		http.NotFound(w, r)
+		httpError(w, "not found", http.StatusNotFound)
 	}
 }
 
@@ -636,7 +1164,7 @@ func (s *serverState) handleChannelMessages(w http.ResponseWriter, r *http.Reque
 			}
 		}
 
-		if ch.Kind != "text" {
+		if ch.Kind == "voice" {
 			w.Header().Set("Content-Type", "application/json")
 			if err := json.NewEncoder(w).Encode([]messageDTO{}); err != nil {
 				log.Printf("encode voice messages: %v", err)
@@ -644,16 +1172,39 @@ func (s *serverState) handleChannelMessages(w http.ResponseWriter, r *http.Reque
 			return
 		}
 
-		messages, err := s.recentMessages(r.Context(), ch.ID, limit)
+		var messages []chatMessage
+		var err error
+		if around := strings.TrimSpace(r.URL.Query().Get("around")); around != "" {
+			pivotID, found, err := s.resolveAround(r.Context(), ch, around)
+			if errors.Is(err, errInvalidAround) {
+				httpError(w, "around must be a message ID or an RFC 3339 timestamp", http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				log.Printf("resolve around %q: %v", around, err)
+				httpError(w, "failed to load messages", http.StatusInternalServerError)
+				return
+			}
+			if !found {
+				httpError(w, "message not found", http.StatusNotFound)
+				return
+			}
+			messages, err = s.messagesAround(r.Context(), ch.ID, pivotID, limit)
+		} else {
+			messages, err = s.recentMessages(r.Context(), ch.ID, limit)
+		}
 		if err != nil {
 			log.Printf("load messages: %v", err)
-			http.Error(w, "failed to load messages", http.StatusInternalServerError)
+			httpError(w, "failed to load messages", http.StatusInternalServerError)
 			return
 		}
 
 		payload := make([]messageDTO, 0, len(messages))
 		for _, msg := range messages {
-			payload = append(payload, toMessageDTO(msg))
+			payload = append(payload, s.messageDTOFor(currentUser, msg))
+		}
+		if err := s.annotateStars(r.Context(), currentUser, payload); err != nil {
+			log.Printf("load message stars: %v", err)
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -662,53 +1213,158 @@ func (s *serverState) handleChannelMessages(w http.ResponseWriter, r *http.Reque
 		}
 
 	case http.MethodPost:
-		defer r.Body.Close()
+		s.withIdempotency(w, r, currentUser, func(w http.ResponseWriter, r *http.Request) {
+			s.postChannelMessage(w, r, ch, currentUser)
+		})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
 
-		var body struct {
-			Content string `json:"content"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			http.Error(w, "invalid request body", http.StatusBadRequest)
-			return
-		}
+var errInvalidAround = errors.New("invalid around")
+
+// resolveAround turns the around parameter of a history request into the
+// message to center on: a message ID in ch, or a timestamp, which picks the
+// first message sent at or after it (past the newest message, the window is
+// the newest messages). found is false for an ID not in ch.
+func (s *serverState) resolveAround(ctx context.Context, ch channelInfo, around string) (pivotID int64, found bool, err error) {
+	if _, err := strconv.ParseInt(around, 10, 64); err == nil {
+		msg, found, err := s.loadChannelMessage(ctx, ch, around)
+		return msg.ID, found, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, around)
+	if err != nil {
+		return 0, false, errInvalidAround
+	}
+	pivotID, found, err = s.messageIDAt(ctx, ch.ID, t)
+	if err == nil && !found {
+		return 1<<63 - 1, true, nil
+	}
+	return pivotID, found, err
+}
+
+func (s *serverState) postChannelMessage(w http.ResponseWriter, r *http.Request, ch channelInfo, currentUser user) {
+	defer r.Body.Close()
+
+	var body struct {
+		Content   string `json:"content" validate:"trim"`
+		Nonce     string `json:"nonce"`
+		TTL       int64  `json:"ttl"`
+		StickerID int64  `json:"stickerId"`
+	}
+	// Long pastes may become attachments, so allow for their size once
+	// escaped as JSON.
+	if !decodeJSONLimit(w, r, &body, s.maxJSONBody+2*int64(s.maxTextAttachmentBytes)) {
+		return
+	}
+	// A sticker can be sent on its own.
+	if body.Content == "" && body.StickerID == 0 {
+		writeValidationErrors(w, []fieldError{{Field: "content", Message: "is required"}})
+		return
+	}
+	if len(body.Nonce) > maxNonceLength {
+		httpError(w, "nonce too long", http.StatusBadRequest)
+		return
+	}
+	ttl, err := messageTTL(body.TTL)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		content := strings.TrimSpace(body.Content)
-		if content == "" {
-			http.Error(w, "message cannot be empty", http.StatusBadRequest)
+	content := body.Content
+	if s.messageTooLong(content) {
+		httpError(w, "message too long", http.StatusBadRequest)
+		return
+	}
+
+	if ch.Kind == "voice" {
+		httpError(w, "cannot send messages to a voice channel", http.StatusBadRequest)
+		return
+	}
+
+	canPost, err := s.canPostInChannel(r.Context(), currentUser.Email, ch)
+	if err != nil {
+		log.Printf("check post permission: %v", err)
+		httpError(w, "failed to save message", http.StatusInternalServerError)
+		return
+	}
+	if !canPost {
+		httpError(w, "this channel is read-only", http.StatusForbidden)
+		return
+	}
+	if pending, err := s.rulesPending(r.Context(), currentUser.Email, ch); err != nil {
+		log.Printf("check server rules: %v", err)
+		httpError(w, "failed to save message", http.StatusInternalServerError)
+		return
+	} else if pending {
+		httpError(w, errRulesNotAccepted.Error(), http.StatusForbidden)
+		return
+	}
+	if body.StickerID != 0 {
+		_, _, found, err := s.stickerInServer(r.Context(), ch.ServerID, body.StickerID)
+		if err != nil {
+			log.Printf("load sticker: %v", err)
+			httpError(w, "failed to save message", http.StatusInternalServerError)
 			return
 		}
-		if utf8.RuneCountInString(content) > 2000 {
-			http.Error(w, "message too long", http.StatusBadRequest)
+		if !found {
+			writeValidationErrors(w, []fieldError{{Field: "stickerId", Message: "is not a sticker of this server"}})
 			return
 		}
+	}
 
-		if ch.Kind != "text" {
-			http.Error(w, "cannot send messages to a voice channel", http.StatusBadRequest)
+	if body.StickerID == 0 && isRemindCommand(content) {
+		rem, err := s.remindFromCommand(r.Context(), currentUser, ch.ID, content)
+		if errors.Is(err, errInvalidReminder) {
+			httpError(w, "usage: /remind <30m|2h|1d> <text>", http.StatusBadRequest)
 			return
 		}
-
-		msg, err := s.saveMessage(r.Context(), ch.ID, currentUser.Email, content)
 		if err != nil {
-			log.Printf("save message: %v", err)
-			http.Error(w, "failed to save message", http.StatusInternalServerError)
+			log.Printf("create reminder: %v", err)
+			httpError(w, "failed to create reminder", http.StatusInternalServerError)
 			return
 		}
-		if msg.AuthorDisplayName == "" {
-			msg.AuthorDisplayName = currentUser.DisplayName
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(map[string]reminderDTO{"reminder": toReminderDTO(rem)}); err != nil {
+			log.Printf("encode reminder response: %v", err)
 		}
+		return
+	}
 
-		dto := toMessageDTO(msg)
+	msg, duplicate, err := s.saveClientMessage(r.Context(), ch.ID, currentUser.Email, content, body.Nonce, ttl, body.StickerID)
+	if qe, ok := asQuotaError(err); ok {
+		writeQuotaError(w, qe)
+		return
+	}
+	if rejected, ok := asMessageRejected(err); ok {
+		writeAPIError(w, http.StatusUnprocessableEntity, apiError{Code: "message_rejected", Message: rejected.reason})
+		return
+	}
+	if err != nil {
+		log.Printf("save message: %v", err)
+		httpError(w, "failed to save message", http.StatusInternalServerError)
+		return
+	}
+	if msg.AuthorDisplayName == "" {
+		msg.AuthorDisplayName = currentUser.DisplayName
+	}
 
-		s.broadcastMessage(dto)
+	dto := toMessageDTO(msg)
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		if err := json.NewEncoder(w).Encode(dto); err != nil {
-			log.Printf("encode message response: %v", err)
-		}
-	default:
-		w.Header().Set("Allow", "GET, POST")
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	// A repeated nonce means the message already went out; answer with
+	// it again instead of storing a copy.
+	status := http.StatusOK
+	if !duplicate {
+		status = http.StatusCreated
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(s.maskFor(currentUser.MaskProfanity, dto)); err != nil {
+		log.Printf("encode message response: %v", err)
 	}
 }
 
@@ -719,33 +1375,88 @@ func (s *serverState) handleLogin(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
-		s.renderTemplate(w, http.StatusOK, "login", nil)
+		s.renderTemplate(w, r, http.StatusOK, "login", s.loginPageData(r.Context(), clientIP(r), 0))
 	case http.MethodPost:
+		l := s.responseLocalizer(w)
+		ip := clientIP(r)
 		if err := r.ParseForm(); err != nil {
-			s.renderTemplate(w, http.StatusBadRequest, "login", templateData{"Error": "invalid form submission"})
+			s.renderTemplate(w, r, http.StatusBadRequest, "login", templateData{"Error": l.T("auth.error.invalid_form")})
 			return
 		}
 
-		email := strings.TrimSpace(strings.ToLower(r.FormValue("email")))
+		login := strings.TrimSpace(strings.ToLower(r.FormValue("email")))
 		password := r.FormValue("password")
 
-		u, exists, err := s.getUserByEmail(r.Context(), email)
+		u, exists, err := s.getUserByLogin(r.Context(), requestTenantID(r), login)
+		fail := func(status int, key string, args ...any) {
+			page := s.loginPageData(r.Context(), ip, u.ID)
+			page["Error"] = l.T(key, args...)
+			s.renderTemplate(w, r, status, "login", page)
+		}
 		if err != nil {
-			log.Printf("lookup user %s: %v", email, err)
-			s.renderTemplate(w, http.StatusInternalServerError, "login", templateData{"Error": "something went wrong"})
+			log.Printf("lookup user %s: %v", login, err)
+			fail(http.StatusInternalServerError, "auth.error.internal")
 			return
 		}
 
-		if !exists || bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)) != nil {
-			s.renderTemplate(w, http.StatusUnauthorized, "login", templateData{"Error": "invalid email or password"})
+		lockedUntil, err := s.loginLockedUntil(r.Context(), ip, u.ID)
+		if err != nil {
+			log.Printf("check login lockout: %v", err)
+			fail(http.StatusInternalServerError, "auth.error.internal")
+			return
+		}
+		if wait := time.Until(lockedUntil); wait > 0 {
+			s.recordLoginAttempt(r.Context(), r, login, u.ID, loginLocked)
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			fail(http.StatusTooManyRequests, "login.error.locked", int(wait.Minutes())+1)
 			return
 		}
 
-		if err := s.ensureMembership(r.Context(), u.Email); err != nil {
+		if s.loginNeedsCaptcha(r.Context(), ip, u.ID) {
+			if err := s.checkCaptcha(r); err != nil {
+				if !errors.Is(err, errCaptchaMissing) && !errors.Is(err, errCaptchaRejected) {
+					log.Printf("verify login captcha: %v", err)
+				}
+				s.recordLoginAttempt(r.Context(), r, login, u.ID, loginCaptcha)
+				fail(http.StatusBadRequest, "auth.error.captcha")
+				return
+			}
+		}
+
+		var matched, stale bool
+		if exists {
+			matched, stale = s.passwords.verify(u.PasswordHash, password)
+		}
+		if !matched {
+			s.recordLoginFailure(r.Context(), r, login, u)
+			fail(http.StatusUnauthorized, "login.error.invalid_credentials")
+			return
+		}
+		s.clearLoginFailures(r.Context(), ip, u.ID)
+		if stale {
+			s.upgradePasswordHash(r.Context(), u, password)
+		}
+		if u.Status == userStatusPending {
+			s.recordLoginAttempt(r.Context(), r, login, u.ID, loginPending)
+			fail(http.StatusForbidden, "login.error.pending")
+			return
+		}
+		if u.Status == userStatusDeactivated {
+			s.recordLoginAttempt(r.Context(), r, login, u.ID, loginDeactivated)
+			fail(http.StatusForbidden, "login.error.deactivated")
+			return
+		}
+
+		if err := s.ensureMembership(r.Context(), u.Email, u.TenantID); err != nil {
 			log.Printf("ensure membership: %v", err)
 		}
 
-		s.createSession(w, u.Email)
+		if err := s.createSession(w, r, u.Email, r.FormValue("remember_me") != ""); err != nil {
+			log.Printf("create session %s: %v", u.Email, err)
+			fail(http.StatusInternalServerError, "auth.error.internal")
+			return
+		}
+		s.recordLoginAttempt(r.Context(), r, login, u.ID, loginSuccess)
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -759,65 +1470,161 @@ func (s *serverState) handleSignup(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
-		s.renderTemplate(w, http.StatusOK, "signup", nil)
+		s.renderTemplate(w, r, http.StatusOK, "signup", s.signupPageData(r))
 	case http.MethodPost:
+		page := s.signupPageData(r)
+		fail := func(status int, key string, args ...any) {
+			page["Error"] = s.responseLocalizer(w).T(key, args...)
+			s.renderTemplate(w, r, status, "signup", page)
+		}
 		if err := r.ParseForm(); err != nil {
-			s.renderTemplate(w, http.StatusBadRequest, "signup", templateData{"Error": "invalid form submission"})
+			fail(http.StatusBadRequest, "auth.error.invalid_form")
+			return
+		}
+		if s.registrationMode == registrationClosed {
+			fail(http.StatusForbidden, "signup.error.closed")
+			return
+		}
+		if err := s.checkCaptcha(r); err != nil {
+			if !errors.Is(err, errCaptchaMissing) && !errors.Is(err, errCaptchaRejected) {
+				log.Printf("verify signup captcha: %v", err)
+			}
+			fail(http.StatusBadRequest, "auth.error.captcha")
 			return
 		}
 
 		email := strings.TrimSpace(strings.ToLower(r.FormValue("email")))
+		handle := normalizeHandle(r.FormValue("handle"))
 		displayName := strings.TrimSpace(r.FormValue("display_name"))
 		password := r.FormValue("password")
 		confirm := r.FormValue("confirm_password")
+		inviteCode := strings.TrimSpace(r.FormValue("invite_code"))
+		page["InviteCode"] = inviteCode
+
+		if email == "" || handle == "" || displayName == "" {
+			fail(http.StatusBadRequest, "signup.error.missing_fields")
+			return
+		}
 
-		if email == "" || displayName == "" {
-			s.renderTemplate(w, http.StatusBadRequest, "signup", templateData{"Error": "all fields are required"})
+		if !validHandle(handle) {
+			fail(http.StatusBadRequest, "signup.error.handle_rules")
 			return
 		}
 
 		if password != confirm {
-			s.renderTemplate(w, http.StatusBadRequest, "signup", templateData{"Error": "passwords do not match"})
+			fail(http.StatusBadRequest, "signup.error.password_mismatch")
 			return
 		}
 
-		if len(password) < 8 {
-			s.renderTemplate(w, http.StatusBadRequest, "signup", templateData{"Error": "password must be at least 8 characters"})
+		var policyErr *passwordError
+		if errors.As(s.passwords.check(password, email, handle), &policyErr) {
+			fail(http.StatusBadRequest, policyErr.key, policyErr.args...)
 			return
 		}
 
 		ctx := r.Context()
+		tenantID := requestTenantID(r)
 
-		if _, exists, err := s.getUserByEmail(ctx, email); err != nil {
+		existing, exists, err := s.getUserByEmail(ctx, email)
+		if err != nil {
 			log.Printf("check existing user %s: %v", email, err)
-			s.renderTemplate(w, http.StatusInternalServerError, "signup", templateData{"Error": "failed to create account"})
+			fail(http.StatusInternalServerError, "signup.error.internal")
 			return
-		} else if exists {
-			s.renderTemplate(w, http.StatusConflict, "signup", templateData{"Error": "an account with that email already exists"})
+		}
+		// Placeholder accounts have no password and are claimed by the
+		// first signup with that email. Bridge and import ghosts never are.
+		claimable := exists && len(existing.PasswordHash) == 0 && email != systemUserEmail &&
+			existing.Status != userStatusBridged && existing.Status != userStatusImported && existing.TenantID == tenantID
+		if claimable {
+			// Accounts provisioned by SCIM or SAML belong to the directory.
+			managed, err := s.externallyManaged(ctx, existing.ID)
+			if err != nil {
+				log.Printf("check provisioning of %s: %v", email, err)
+				fail(http.StatusInternalServerError, "signup.error.internal")
+				return
+			}
+			claimable = !managed
+		}
+		if exists && !claimable {
+			fail(http.StatusConflict, "signup.error.email_taken")
 			return
 		}
+		if !claimable || existing.Handle != handle {
+			taken, err := handleTaken(ctx, s.readDB, tenantID, handle)
+			if err != nil {
+				log.Printf("check handle %s: %v", handle, err)
+				fail(http.StatusInternalServerError, "signup.error.internal")
+				return
+			}
+			if taken {
+				fail(http.StatusConflict, "signup.error.handle_taken")
+				return
+			}
+		}
 
-		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		hash, err := s.passwords.hash(password)
 		if err != nil {
 			log.Printf("hash password: %v", err)
-			s.renderTemplate(w, http.StatusInternalServerError, "signup", templateData{"Error": "failed to create account"})
+			fail(http.StatusInternalServerError, "signup.error.internal")
 			return
 		}
 
 		newUser := user{
 			Email:        email,
+			Handle:       handle,
 			DisplayName:  displayName,
 			PasswordHash: hash,
 			CreatedAt:    time.Now().UTC(),
+			TenantID:     tenantID,
 		}
 
-		if err := s.createUser(ctx, newUser); err != nil {
+		// The invite use and the account are stored together, so a failed
+		// signup does not use up the invite.
+		var inviteID int64
+		var change membershipChange
+		err = s.withTx(ctx, func(tx *sql.Tx) error {
+			if s.registrationMode == registrationInvite {
+				var err error
+				if inviteID, err = redeemInvite(ctx, tx, tenantID, inviteCode); err != nil {
+					return err
+				}
+			}
+			var err error
+			switch {
+			case s.registrationMode == registrationApproval:
+				err = s.createPendingUser(ctx, tx, newUser, claimable)
+			case claimable:
+				change, err = s.claimUser(ctx, tx, newUser)
+			default:
+				_, change, err = s.insertUser(ctx, tx, newUser)
+			}
+			return err
+		})
+		if errors.Is(err, errInvalidInvite) {
+			fail(http.StatusForbidden, "signup.error.invalid_invite")
+			return
+		}
+		if err != nil {
 			log.Printf("create user %s: %v", email, err)
-			s.renderTemplate(w, http.StatusInternalServerError, "signup", templateData{"Error": "failed to create account"})
+			fail(http.StatusInternalServerError, "signup.error.internal")
 			return
 		}
+		s.membershipChanged(change)
+		if inviteID != 0 {
+			s.recordAudit(ctx, 0, email, "instance.invite_redeemed", "invite", strconv.FormatInt(inviteID, 10), "")
+		}
 
-		s.createSession(w, newUser.Email)
+		if s.registrationMode == registrationApproval {
+			page["Pending"] = true
+			s.renderTemplate(w, r, http.StatusAccepted, "signup", page)
+			return
+		}
+
+		if err := s.createSession(w, r, newUser.Email, false); err != nil {
+			log.Printf("create session %s: %v", newUser.Email, err)
+			fail(http.StatusInternalServerError, "signup.error.sign_in")
+			return
+		}
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -830,84 +1637,62 @@ func (s *serverState) handleLogout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cookie, err := r.Cookie(sessionCookieName)
-	if err == nil {
-		s.mu.Lock()
-		delete(s.sessions, cookie.Value)
-		s.mu.Unlock()
-
-		http.SetCookie(w, &http.Cookie{
-			Name:     sessionCookieName,
-			Value:    "",
-			Path:     "/",
-			MaxAge:   -1,
-			HttpOnly: true,
-			Secure:   false,
-			SameSite: http.SameSiteLaxMode,
-		})
+	if _, token, ok := s.sessionFromRequest(r); ok {
+		s.deleteSession(r.Context(), token)
+		s.ws.disconnectSession(hashSessionToken(token), wsCloseAuthExpired, "signed out")
 	}
+	s.clearSessionCookie(w, r)
 
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
-func (s *serverState) renderTemplate(w http.ResponseWriter, status int, name string, data templateData) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(status)
+func (s *serverState) renderTemplate(w http.ResponseWriter, r *http.Request, status int, name string, data templateData) {
 	if data == nil {
 		data = templateData{}
 	}
+	data["CSRFToken"] = csrfToken(w, r)
+	scope := tenantScopeFrom(r.Context())
+	b := s.currentBranding(r.Context(), scope.id)
+	data["InstanceName"] = b.Name
+	data["Branding"] = b.dto()
+	data["BasePath"] = scope.basePath
+	data["PasswordMinLength"] = s.passwords.minLength
+	data["L"] = s.responseLocalizer(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
 	if err := s.templates.ExecuteTemplate(w, name, data); err != nil {
 		log.Printf("render template %s: %v", name, err)
 	}
 }
 
 func (s *serverState) userFromRequest(r *http.Request) (user, bool) {
-	cookie, err := r.Cookie(sessionCookieName)
-	if err != nil {
-		return user{}, false
-	}
-
-	s.mu.RLock()
-	email, ok := s.sessions[cookie.Value]
-	s.mu.RUnlock()
+	sess, token, ok := s.sessionFromRequest(r)
 	if !ok {
 		return user{}, false
 	}
 
-	u, exists, err := s.getUserByEmail(r.Context(), email)
+	u, exists, err := s.getUserByID(r.Context(), sess.UserID)
 	if err != nil {
-		log.Printf("userFromRequest lookup %s: %v", email, err)
+		log.Printf("userFromRequest lookup %d: %v", sess.UserID, err)
 		return user{}, false
 	}
 
 	if !exists {
-		s.mu.Lock()
-		delete(s.sessions, cookie.Value)
-		s.mu.Unlock()
+		s.deleteSession(r.Context(), token)
+		return user{}, false
+	}
+	if u.Status != userStatusActive {
+		return user{}, false
+	}
+	// Accounts are only signed in on their own tenant's addresses.
+	if scope := tenantScopeFrom(r.Context()); !scope.shared && u.TenantID != scope.id {
 		return user{}, false
 	}
 
+	applyUserLocale(r, u)
 	return u, true
 }
 
-func (s *serverState) createSession(w http.ResponseWriter, email string) {
-	sessionID := generateSessionID()
-
-	s.mu.Lock()
-	s.sessions[sessionID] = email
-	s.mu.Unlock()
-
-	http.SetCookie(w, &http.Cookie{
-		Name:     sessionCookieName,
-		Value:    sessionID,
-		Path:     "/",
-		Expires:  time.Now().Add(12 * time.Hour),
-		HttpOnly: true,
-		Secure:   false,
-		SameSite: http.SameSiteLaxMode,
-	})
-}
-
 func generateSessionID() string {
 	buf := make([]byte, 32)
 	if _, err := rand.Read(buf); err != nil {
@@ -923,6 +1708,32 @@ func envOrDefault(key, fallback string) string {
 	return fallback
 }
 
+func intFromEnv(key string, fallback int) int {
+	raw := envOrDefault(key, "")
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		log.Printf("ignoring invalid %s=%q, using %d", key, raw, fallback)
+		return fallback
+	}
+	return n
+}
+
+func boolFromEnv(key string, fallback bool) bool {
+	raw := envOrDefault(key, "")
+	if raw == "" {
+		return fallback
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		log.Printf("ignoring invalid %s=%q, using %t", key, raw, fallback)
+		return fallback
+	}
+	return v
+}
+
 func slugify(input string) string {
 	input = strings.ToLower(strings.TrimSpace(input))
 	var b strings.Builder
@@ -950,6 +1761,6 @@ func loggingMiddleware(next http.Handler) http.Handler {
 		start := time.Now()
 		next.ServeHTTP(w, r)
 		duration := time.Since(start)
-		log.Printf("%s %s %s", r.Method, r.URL.Path, duration)
+		log.Printf("%s %s %s %s %s", clientIP(r), r.Method, r.URL.Path, duration, w.Header().Get(requestIDHeader))
 	})
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultMaintenanceInterval = 24 * time.Hour
+
+// backupDatabase writes a consistent snapshot of the live database to dest
+// using VACUUM INTO, which is safe to run while the server keeps writing.
+func backupDatabase(ctx context.Context, db *sql.DB, dest string) error {
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, `VACUUM INTO ?`, dest)
+	return err
+}
+
+func defaultBackupPath(dataDir string) string {
+	return filepath.Join(dataDir, "backups", "echosphere-"+time.Now().UTC().Format("20060102-150405")+".db")
+}
+
+func (s *serverState) runMaintenanceWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.runMaintenance(ctx)
+	}
+}
+
+func (s *serverState) runMaintenance(ctx context.Context) {
+	start := time.Now()
+	for _, stmt := range []string{
+		"PRAGMA wal_checkpoint(TRUNCATE)",
+		"VACUUM",
+		"ANALYZE",
+	} {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			log.Printf("database maintenance %q: %v", stmt, err)
+			return
+		}
+	}
+	log.Printf("database maintenance finished in %s", time.Since(start).Round(time.Millisecond))
+}
+
+func parseAdminEmails(raw string) map[string]bool {
+	admins := make(map[string]bool)
+	for _, email := range strings.Split(raw, ",") {
+		if email = strings.TrimSpace(strings.ToLower(email)); email != "" {
+			admins[email] = true
+		}
+	}
+	return admins
+}
+
+// isInstanceAdmin reports whether email is listed in ADMIN_EMAILS or was
+// promoted with the create-admin command.
+func (s *serverState) isInstanceAdmin(ctx context.Context, email string) bool {
+	if s.adminEmails[email] {
+		return true
+	}
+	var isAdmin bool
+	if err := s.readDB.QueryRowContext(ctx, `SELECT is_admin FROM users WHERE email = ?`, email).Scan(&isAdmin); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("check instance admin: %v", err)
+		}
+		return false
+	}
+	return isAdmin
+}
+
+func (s *serverState) setInstanceAdmin(ctx context.Context, email string, admin bool) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE users SET is_admin = ? WHERE email = ?`, admin, email)
+	return err
+}
+
+func (s *serverState) requireInstanceAdmin(w http.ResponseWriter, r *http.Request) (user, bool) {
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return user{}, false
+	}
+	if !s.isInstanceAdmin(r.Context(), currentUser.Email) {
+		httpError(w, "forbidden", http.StatusForbidden)
+		return user{}, false
+	}
+	return currentUser, true
+}
+
+func (s *serverState) handleAdminBackup(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.requireOperator(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tmp, err := os.MkdirTemp("", "echosphere-backup-")
+	if err != nil {
+		log.Printf("create backup dir: %v", err)
+		httpError(w, "failed to create backup", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tmp)
+
+	dest := filepath.Join(tmp, filepath.Base(defaultBackupPath(s.dataDir)))
+	if err := backupDatabase(r.Context(), s.db, dest); err != nil {
+		log.Printf("backup database: %v", err)
+		httpError(w, "failed to create backup", http.StatusInternalServerError)
+		return
+	}
+	s.recordAudit(r.Context(), 0, currentUser.Email, "instance.backup", "database", "", "")
+
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filepath.Base(dest)+`"`)
+	http.ServeFile(w, r, dest)
+}
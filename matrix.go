@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	matrixAppServicePath = "/_matrix/app/v1/"
+	matrixClientPath     = "/_matrix/client/v3"
+
+	defaultMatrixUserPrefix   = "echosphere_"
+	defaultMatrixBotLocalpart = "echosphere"
+
+	// Homeservers batch many events into one transaction.
+	maxMatrixTransactionBytes = 8 << 20
+)
+
+// matrixBridge relays channels to Matrix rooms as an application service.
+// Local users appear in Matrix as puppets named after their user ID
+// (@echosphere_42:example.org); Matrix users appear locally as ghost
+// accounts. Events sent by the bot or a puppet are ours and are ignored when
+// the homeserver hands them back.
+type matrixBridge struct {
+	s            *serverState
+	homeserver   string
+	serverName   string
+	asToken      string
+	hsToken      string
+	userPrefix   string
+	botLocalpart string
+	client       *http.Client
+
+	mu       sync.Mutex
+	puppets  map[int64]string  // user ID -> display name last set in Matrix
+	joined   map[string]bool   // room ID + " " + Matrix user ID
+	profiles map[string]string // Matrix user ID -> display name
+}
+
+// matrixBridgeFromEnv configures the Matrix bridge from MATRIX_HOMESERVER,
+// MATRIX_SERVER_NAME, MATRIX_AS_TOKEN and MATRIX_HS_TOKEN. It returns nil,
+// leaving the bridge off, unless all four are set.
+func matrixBridgeFromEnv(s *serverState) bridge {
+	homeserver := strings.TrimRight(strings.TrimSpace(os.Getenv("MATRIX_HOMESERVER")), "/")
+	serverName := strings.TrimSpace(os.Getenv("MATRIX_SERVER_NAME"))
+	asToken := os.Getenv("MATRIX_AS_TOKEN")
+	hsToken := os.Getenv("MATRIX_HS_TOKEN")
+	if homeserver == "" && serverName == "" && asToken == "" && hsToken == "" {
+		return nil
+	}
+	if homeserver == "" || serverName == "" || asToken == "" || hsToken == "" {
+		log.Printf("matrix bridge disabled: MATRIX_HOMESERVER, MATRIX_SERVER_NAME, MATRIX_AS_TOKEN and MATRIX_HS_TOKEN must all be set")
+		return nil
+	}
+	return &matrixBridge{
+		s:            s,
+		homeserver:   homeserver,
+		serverName:   serverName,
+		asToken:      asToken,
+		hsToken:      hsToken,
+		userPrefix:   envOrDefault("MATRIX_USER_PREFIX", defaultMatrixUserPrefix),
+		botLocalpart: envOrDefault("MATRIX_BOT_LOCALPART", defaultMatrixBotLocalpart),
+		client:       &http.Client{Timeout: 15 * time.Second},
+		puppets:      make(map[int64]string),
+		joined:       make(map[string]bool),
+		profiles:     make(map[string]string),
+	}
+}
+
+func (m *matrixBridge) name() string { return "matrix" }
+
+func (m *matrixBridge) botID() string {
+	return "@" + m.botLocalpart + ":" + m.serverName
+}
+
+func (m *matrixBridge) puppetID(userID int64) string {
+	return "@" + m.userPrefix + strconv.FormatInt(userID, 10) + ":" + m.serverName
+}
+
+// ours reports whether mxid belongs to the bridge itself.
+func (m *matrixBridge) ours(mxid string) bool {
+	return mxid == m.botID() || (strings.HasPrefix(mxid, "@"+m.userPrefix) && strings.HasSuffix(mxid, ":"+m.serverName))
+}
+
+type matrixError struct {
+	Status  int    `json:"-"`
+	ErrCode string `json:"errcode"`
+	Message string `json:"error"`
+}
+
+func (e *matrixError) Error() string {
+	return fmt.Sprintf("matrix %d %s: %s", e.Status, e.ErrCode, e.Message)
+}
+
+func matrixErrCode(err error) string {
+	var merr *matrixError
+	if errors.As(err, &merr) {
+		return merr.ErrCode
+	}
+	return ""
+}
+
+// call makes a client-server API request with the application service token.
+// asUser, when set, makes the request on behalf of that puppet.
+func (m *matrixBridge) call(ctx context.Context, method, path, asUser string, body, out any) error {
+	u := m.homeserver + matrixClientPath + path
+	if asUser != "" {
+		u += "?user_id=" + url.QueryEscape(asUser)
+	}
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.asToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		merr := &matrixError{Status: resp.StatusCode}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(merr); err != nil {
+			merr.Message = resp.Status
+		}
+		return merr
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (m *matrixBridge) link(ctx context.Context, remoteID string) (string, error) {
+	roomID := remoteID
+	if strings.HasPrefix(remoteID, "#") {
+		var resolved struct {
+			RoomID string `json:"room_id"`
+		}
+		err := m.call(ctx, http.MethodGet, "/directory/room/"+url.PathEscape(remoteID), "", nil, &resolved)
+		if matrixErrCode(err) == "M_NOT_FOUND" {
+			return "", fmt.Errorf("%w: room alias %s does not exist", errInvalidRemote, remoteID)
+		}
+		if err != nil {
+			return "", err
+		}
+		roomID = resolved.RoomID
+	}
+	if !strings.HasPrefix(roomID, "!") || !strings.Contains(roomID, ":") {
+		return "", fmt.Errorf("%w: expected a Matrix room ID (!id:server) or alias (#name:server)", errInvalidRemote)
+	}
+
+	err := m.call(ctx, http.MethodPost, "/join/"+url.PathEscape(roomID), "", struct{}{}, nil)
+	if code := matrixErrCode(err); code == "M_FORBIDDEN" || code == "M_NOT_FOUND" {
+		return "", fmt.Errorf("%w: %s cannot join %s; invite it to the room first", errInvalidRemote, m.botID(), roomID)
+	}
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	m.joined[roomID+" "+m.botID()] = true
+	m.mu.Unlock()
+	return roomID, nil
+}
+
+// ensurePuppet registers author's puppet, keeps its display name in step and
+// joins it to roomID, asking the bot to invite it if the room is invite-only.
+func (m *matrixBridge) ensurePuppet(ctx context.Context, author user, roomID string) (string, error) {
+	puppet := m.puppetID(author.ID)
+
+	m.mu.Lock()
+	name, registered := m.puppets[author.ID]
+	joined := m.joined[roomID+" "+puppet]
+	m.mu.Unlock()
+
+	if !registered {
+		err := m.call(ctx, http.MethodPost, "/register", "", map[string]string{
+			"type":     "m.login.application_service",
+			"username": strings.TrimPrefix(strings.TrimSuffix(puppet, ":"+m.serverName), "@"),
+		}, nil)
+		if err != nil && matrixErrCode(err) != "M_USER_IN_USE" {
+			return "", fmt.Errorf("register puppet: %w", err)
+		}
+	}
+	if name != author.DisplayName {
+		if err := m.call(ctx, http.MethodPut, "/profile/"+url.PathEscape(puppet)+"/displayname", puppet,
+			map[string]string{"displayname": author.DisplayName}, nil); err != nil {
+			return "", fmt.Errorf("set puppet display name: %w", err)
+		}
+		m.mu.Lock()
+		m.puppets[author.ID] = author.DisplayName
+		m.mu.Unlock()
+	}
+	if joined {
+		return puppet, nil
+	}
+
+	join := func() error {
+		return m.call(ctx, http.MethodPost, "/join/"+url.PathEscape(roomID), puppet, struct{}{}, nil)
+	}
+	err := join()
+	if matrixErrCode(err) == "M_FORBIDDEN" {
+		if err := m.call(ctx, http.MethodPost, "/rooms/"+url.PathEscape(roomID)+"/invite", "",
+			map[string]string{"user_id": puppet}, nil); err != nil {
+			return "", fmt.Errorf("invite puppet: %w", err)
+		}
+		err = join()
+	}
+	if err != nil {
+		return "", fmt.Errorf("join puppet: %w", err)
+	}
+	m.mu.Lock()
+	m.joined[roomID+" "+puppet] = true
+	m.mu.Unlock()
+	return puppet, nil
+}
+
+func (m *matrixBridge) relay(ctx context.Context, roomID string, author user, msg messageDTO) error {
+	puppet, err := m.ensurePuppet(ctx, author, roomID)
+	if err != nil {
+		return err
+	}
+	// The transaction ID makes a retried send idempotent on the homeserver.
+	txnID := "echosphere-" + strconv.FormatInt(msg.ID, 10)
+	return m.call(ctx, http.MethodPut, "/rooms/"+url.PathEscape(roomID)+"/send/m.room.message/"+txnID, puppet,
+		map[string]string{"msgtype": "m.text", "body": msg.Content}, nil)
+}
+
+func (m *matrixBridge) routes(mux *http.ServeMux) {
+	mux.HandleFunc(matrixAppServicePath, m.handleAppService)
+}
+
+type matrixEvent struct {
+	Type     string          `json:"type"`
+	EventID  string          `json:"event_id"`
+	RoomID   string          `json:"room_id"`
+	Sender   string          `json:"sender"`
+	StateKey *string         `json:"state_key"`
+	Content  json.RawMessage `json:"content"`
+}
+
+func writeMatrixError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(matrixError{ErrCode: code, Message: message}); err != nil {
+		log.Printf("encode matrix error: %v", err)
+	}
+}
+
+// handleAppService serves the application service API the homeserver pushes
+// room events to. Requests authenticate with MATRIX_HS_TOKEN.
+func (m *matrixBridge) handleAppService(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		// Homeservers older than Matrix 1.4 send the token as a query parameter.
+		token = r.URL.Query().Get("access_token")
+	}
+	if token == "" {
+		writeMatrixError(w, http.StatusUnauthorized, "M_UNAUTHORIZED", "missing token")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(m.hsToken)) != 1 {
+		writeMatrixError(w, http.StatusForbidden, "M_FORBIDDEN", "invalid token")
+		return
+	}
+
+	resource, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, matrixAppServicePath), "/")
+	switch {
+	case resource == "transactions" && r.Method == http.MethodPut:
+		var txn struct {
+			Events []matrixEvent `json:"events"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMatrixTransactionBytes)).Decode(&txn); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeMatrixError(w, http.StatusRequestEntityTooLarge, "M_TOO_LARGE", "transaction too large")
+				return
+			}
+			writeMatrixError(w, http.StatusBadRequest, "M_NOT_JSON", "invalid transaction body")
+			return
+		}
+		for _, ev := range txn.Events {
+			if err := m.handleEvent(r.Context(), ev); err != nil {
+				// Failing the transaction makes the homeserver retry it;
+				// events already stored are recognised by their ID.
+				log.Printf("matrix event %s: %v", ev.EventID, err)
+				writeMatrixError(w, http.StatusInternalServerError, "M_UNKNOWN", "failed to process transaction")
+				return
+			}
+		}
+	case resource == "ping" && r.Method == http.MethodPost:
+	case resource == "users" || resource == "rooms":
+		// Puppets and rooms are created by the bridge, never on demand.
+		writeMatrixError(w, http.StatusNotFound, "M_NOT_FOUND", "not provisioned by this bridge")
+		return
+	default:
+		writeMatrixError(w, http.StatusNotFound, "M_UNRECOGNIZED", "unrecognized request")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, "{}")
+}
+
+func (m *matrixBridge) handleEvent(ctx context.Context, ev matrixEvent) error {
+	if m.ours(ev.Sender) {
+		return nil
+	}
+
+	switch ev.Type {
+	case "m.room.member":
+		var content struct {
+			Membership  string `json:"membership"`
+			DisplayName string `json:"displayname"`
+		}
+		if ev.StateKey == nil || json.Unmarshal(ev.Content, &content) != nil || content.Membership != "join" {
+			return nil
+		}
+		m.mu.Lock()
+		m.profiles[*ev.StateKey] = content.DisplayName
+		m.mu.Unlock()
+		return nil
+	case "m.room.message":
+		var content struct {
+			MsgType   string `json:"msgtype"`
+			Body      string `json:"body"`
+			RelatesTo *struct {
+				RelType string `json:"rel_type"`
+			} `json:"m.relates_to"`
+		}
+		if err := json.Unmarshal(ev.Content, &content); err != nil {
+			return nil
+		}
+		// Edits arrive as new events; there is nothing to apply them to.
+		if content.RelatesTo != nil && content.RelatesTo.RelType == "m.replace" {
+			return nil
+		}
+		body := content.Body
+		switch content.MsgType {
+		case "m.text", "m.notice":
+		case "m.emote":
+			body = "* " + body
+		default:
+			return nil
+		}
+		return m.s.receiveBridged(ctx, m.name(), ev.RoomID, ev.EventID, m.sender(ctx, ev.Sender), body)
+	}
+	return nil
+}
+
+// sender maps a Matrix user to the ghost account details, looking up the
+// display name once if no membership event has told us yet. Without one the
+// ghost is named after the localpart.
+func (m *matrixBridge) sender(ctx context.Context, mxid string) bridgeSender {
+	localpart, _, _ := strings.Cut(strings.TrimPrefix(mxid, "@"), ":")
+
+	m.mu.Lock()
+	name, known := m.profiles[mxid]
+	m.mu.Unlock()
+	if !known {
+		var profile struct {
+			DisplayName string `json:"displayname"`
+		}
+		err := m.call(ctx, http.MethodGet, "/profile/"+url.PathEscape(mxid)+"/displayname", "", nil, &profile)
+		if err == nil || matrixErrCode(err) == "M_NOT_FOUND" {
+			name = profile.DisplayName
+			m.mu.Lock()
+			m.profiles[mxid] = name
+			m.mu.Unlock()
+		} else {
+			log.Printf("load matrix profile %s: %v", mxid, err)
+		}
+	}
+	return bridgeSender{RemoteID: mxid, HandleHint: localpart, DisplayName: name}
+}
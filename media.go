@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxChannelEmojiBytes = 256 << 10
+	maxChannelEmojiRunes = 16
+)
+
+// channelEmojiThumbnailSizes are the sizes uploaded channel emoji are
+// scaled to, on top of the original.
+var channelEmojiThumbnailSizes = []int{32, 64}
+
+// mediaKinds are the directories under data/media that /media serves.
+// Stickers stay behind /api/servers/{id}/stickers, which checks membership.
+var mediaKinds = map[string]bool{
+	"server-icons":  true,
+	"channel-emoji": true,
+}
+
+// mediaURL is where a stored image, as returned by storeMediaImage, is
+// served.
+func mediaURL(stored string) string {
+	if stored == "" {
+		return ""
+	}
+	return "/" + filepath.ToSlash(stored)
+}
+
+// mediaFile picks the file to serve for a stored image. ?size=N serves the
+// smallest thumbnail at least N pixels across, or the image itself when
+// none is that large.
+func (s *serverState) mediaFile(r *http.Request, stored string) string {
+	full := filepath.Join(s.dataDir, stored)
+	if want, err := strconv.Atoi(r.URL.Query().Get("size")); err == nil {
+		best := 0
+		for size, thumb := range s.mediaThumbnails(stored) {
+			if size >= want && (best == 0 || size < best) {
+				best, full = size, thumb
+			}
+		}
+	}
+	return full
+}
+
+// handleMedia serves /media/{kind}/{file} to signed-in users. Stored file
+// names include a hash of their content, so a new upload always gets a new
+// URL and responses can be cached for good.
+func (s *serverState) handleMedia(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.userFromRequest(r); !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	kind, name, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/media/"), "/")
+	if !ok || !mediaKinds[kind] || name == "" || name != path.Base(name) || strings.HasPrefix(name, ".") {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, s.mediaFile(r, filepath.Join("media", kind, name)))
+}
+
+// checkChannelEmoji accepts a short run of emoji, with the joiners and
+// modifiers they are built from, but no ASCII, letters, digits or spaces.
+func checkChannelEmoji(emoji string) error {
+	if utf8.RuneCountInString(emoji) > maxChannelEmojiRunes {
+		return errors.New("emoji must be " + strconv.Itoa(maxChannelEmojiRunes) + " characters or fewer")
+	}
+	for _, r := range emoji {
+		if r < utf8.RuneSelf || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return errors.New("emoji must only contain emoji")
+		}
+	}
+	return nil
+}
+
+func (s *serverState) storeChannelEmoji(ctx context.Context, channelID int64, raw []byte) (string, error) {
+	stored, _, err := s.storeMediaImage(ctx, "channel-emoji", strconv.FormatInt(channelID, 10), raw, channelEmojiThumbnailSizes)
+	return stored, err
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultMemberPage = 1000
+	maxMemberPage     = 1000
+
+	// memberChunkSize is how many members bootstrap embeds and each
+	// members:chunk carries.
+	memberChunkSize = 100
+)
+
+// memberFilter narrows a server's member list. Query matches the start of
+// a handle or display name; After is the ID of the last member of the
+// previous page, in member list order.
+type memberFilter struct {
+	Query string
+	Roles []string
+	After int64
+	Limit int
+}
+
+var errUnknownCursor = errors.New("unknown member cursor")
+
+// findMembers lists the members of serverID matching f: those in hoisted
+// roles first, grouped by role, then everyone else, each by display name.
+// A zero Limit returns every match.
+func (s *serverState) findMembers(ctx context.Context, serverID int64, f memberFilter) ([]memberInfo, error) {
+	where := []string{"sm.server_id = ?"}
+	args := []any{serverID}
+	if f.Query != "" {
+		// Ranges rather than LIKE so the handle and display name indexes apply.
+		handle := normalizeHandle(f.Query)
+		where = append(where, `((u.handle >= ? AND u.handle < ?) OR (u.display_name COLLATE NOCASE >= ? AND u.display_name COLLATE NOCASE < ?))`)
+		args = append(args, handle, handle+"\U0010FFFF", f.Query, f.Query+"\U0010FFFF")
+	}
+	if len(f.Roles) > 0 {
+		where = append(where, "sm.role IN (?"+strings.Repeat(", ?", len(f.Roles)-1)+")")
+		for _, role := range f.Roles {
+			args = append(args, role)
+		}
+	}
+	if f.After > 0 {
+		var group int
+		var name string
+		err := s.readDB.QueryRowContext(ctx, `
+            SELECT `+memberGroup+`, u.display_name
+            FROM server_members sm JOIN users u ON u.id = sm.user_id `+memberRolesJoin+`
+            WHERE sm.server_id = ? AND sm.user_id = ?
+        `, serverID, f.After).Scan(&group, &name)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errUnknownCursor
+		}
+		if err != nil {
+			return nil, err
+		}
+		where = append(where, `(`+memberGroup+`, u.display_name COLLATE NOCASE, u.id) > (?, ?, ?)`)
+		args = append(args, group, name, f.After)
+	}
+	query := `
+        SELECT u.id, u.email, u.handle, u.display_name, sm.joined_at, sm.role, COALESCE(r.color, ''), COALESCE(r.hoist, 0),
+               u.presence, u.custom_status_text, u.custom_status_emoji, u.custom_status_expires_at
+        FROM server_members sm
+        JOIN users u ON u.id = sm.user_id
+        ` + memberRolesJoin + `
+        WHERE ` + strings.Join(where, " AND ") + `
+        ORDER BY ` + memberGroup + `, u.display_name COLLATE NOCASE, u.id`
+	if f.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, f.Limit)
+	}
+
+	rows, err := s.readDB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []memberInfo
+	for rows.Next() {
+		var m memberInfo
+		var status, text, emoji string
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&m.ID, &m.Email, &m.Handle, &m.DisplayName, &m.JoinedAt, &m.Role, &m.Color, &m.Hoisted, &status, &text, &emoji, &expiresAt); err != nil {
+			return nil, err
+		}
+		presence := s.visiblePresence(m.ID, m.Email, scanPresence(status, text, emoji, expiresAt))
+		m.Presence = &presence
+		result = append(result, m)
+	}
+	return result, rows.Err()
+}
+
+// memberChunk loads up to f.Limit members of serverID as viewerID sees
+// them, and reports whether they are the last.
+func (s *serverState) memberChunk(ctx context.Context, viewerID, serverID int64, f memberFilter) ([]memberInfo, bool, error) {
+	limit := f.Limit
+	f.Limit = limit + 1
+	members, err := s.findMembers(ctx, serverID, f)
+	if err != nil {
+		return nil, false, err
+	}
+	done := len(members) <= limit
+	if !done {
+		members = members[:limit]
+	}
+	if err := s.hidePresenceFrom(ctx, viewerID, serverID, members); err != nil {
+		return nil, false, err
+	}
+	if members == nil {
+		members = []memberInfo{}
+	}
+	return members, done, nil
+}
+
+// handleMembersRequest answers members:request with the members:chunk that
+// follows after, so clients can load large member lists as they scroll
+// instead of all at once.
+func (c *wsClient) handleMembersRequest(serverID, after int64, query string) {
+	if serverID <= 0 {
+		c.sendError("invalid_server", "server id required")
+		return
+	}
+	ctx := context.Background()
+	isMember, err := c.state.userHasServerAccess(ctx, c.email, serverID)
+	if err != nil {
+		log.Printf("ws members access: %v", err)
+		c.sendError("internal", "failed to load members")
+		return
+	}
+	if !isMember {
+		c.sendError("forbidden", "no access to server")
+		return
+	}
+
+	query = strings.TrimSpace(query)
+	members, done, err := c.state.memberChunk(ctx, c.currentUser().ID, serverID, memberFilter{Query: query, After: after, Limit: memberChunkSize})
+	if errors.Is(err, errUnknownCursor) {
+		c.sendError("invalid_cursor", "after must be a user ID")
+		return
+	}
+	if err != nil {
+		log.Printf("ws members chunk: %v", err)
+		c.sendError("internal", "failed to load members")
+		return
+	}
+	c.enqueueJSON(wsOutbound{Type: "members:chunk", ServerID: serverID, Query: query, After: after, Members: members, Done: done})
+}
+
+// handleServerMembers serves GET /api/servers/{id}/members. q searches
+// handles and display names by prefix, role takes a comma-separated list,
+// and after and limit page through the result; a page shorter than limit
+// is the last one.
+func (s *serverState) handleServerMembers(w http.ResponseWriter, r *http.Request, serverID int64, currentUser user) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	f := memberFilter{Query: strings.TrimSpace(query.Get("q")), Limit: defaultMemberPage}
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			httpError(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		f.Limit = min(n, maxMemberPage)
+	}
+	if raw := query.Get("after"); raw != "" {
+		id, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || id <= 0 {
+			httpError(w, "after must be a user ID", http.StatusBadRequest)
+			return
+		}
+		f.After = id
+	}
+	for _, role := range splitRoles(strings.ToLower(query.Get("role"))) {
+		valid := false
+		for _, known := range knownRoles {
+			if role == known {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			httpError(w, "unknown role "+role, http.StatusBadRequest)
+			return
+		}
+		f.Roles = append(f.Roles, role)
+	}
+
+	members, err := s.findMembers(r.Context(), serverID, f)
+	if errors.Is(err, errUnknownCursor) {
+		httpError(w, "after must be a user ID", http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		err = s.hidePresenceFrom(r.Context(), currentUser.ID, serverID, members)
+	}
+	if err != nil {
+		log.Printf("list members: %v", err)
+		httpError(w, "failed to list members", http.StatusInternalServerError)
+		return
+	}
+	if members == nil {
+		members = []memberInfo{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(members); err != nil {
+		log.Printf("encode members: %v", err)
+	}
+}
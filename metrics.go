@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds, in seconds, of the histogram buckets.
+var (
+	wsRTTBuckets       = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+	wsFanoutBuckets    = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1}
+	wsSendDelayBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10}
+)
+
+// metrics holds the counters behind /metrics. Gauges such as connection
+// counts are read from live state when scraped instead.
+type metrics struct {
+	mu             sync.Mutex
+	rtt            *histogram
+	fanout         *histogram
+	sendDelay      *histogram
+	lagDisconnects uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		rtt:       newHistogram(wsRTTBuckets),
+		fanout:    newHistogram(wsFanoutBuckets),
+		sendDelay: newHistogram(wsSendDelayBuckets),
+	}
+}
+
+func (m *metrics) observeWSRTT(rtt time.Duration) {
+	m.mu.Lock()
+	m.rtt.observe(rtt.Seconds())
+	m.mu.Unlock()
+}
+
+// observeFanout records how long one broadcast took to queue its frame for
+// every recipient.
+func (m *metrics) observeFanout(d time.Duration) {
+	m.mu.Lock()
+	m.fanout.observe(d.Seconds())
+	m.mu.Unlock()
+}
+
+// observeSendDelay records how long a frame waited between being queued and
+// being written to its connection.
+func (m *metrics) observeSendDelay(d time.Duration) {
+	m.mu.Lock()
+	m.sendDelay.observe(d.Seconds())
+	m.mu.Unlock()
+}
+
+func (m *metrics) countLagDisconnect() {
+	m.mu.Lock()
+	m.lagDisconnects++
+	m.mu.Unlock()
+}
+
+// histogram is a Prometheus histogram, guarded by the owning metrics' mu.
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // per bucket, plus one for +Inf
+	total   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := 0
+	for i < len(h.buckets) && v > h.buckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.total++
+	h.sum += v
+}
+
+func (h *histogram) write(b *strings.Builder, name, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s histogram\n", name)
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(b, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", name, h.total)
+	fmt.Fprintf(b, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(b, "%s_count %d\n", name, h.total)
+}
+
+// handleMetrics serves Prometheus text metrics to scrapers presenting
+// METRICS_TOKEN as a bearer token. Without a token configured the endpoint
+// does not exist.
+func (s *serverState) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if s.metricsToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.metricsToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.ws.mu.RLock()
+	connections := s.ws.clients
+	s.ws.mu.RUnlock()
+	voice := 0
+	s.voice.mu.RLock()
+	for _, room := range s.voice.rooms {
+		voice += len(room.participants)
+	}
+	s.voice.mu.RUnlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP echosphere_ws_connections Open WebSocket connections.\n")
+	fmt.Fprintf(&b, "# TYPE echosphere_ws_connections gauge\n")
+	fmt.Fprintf(&b, "echosphere_ws_connections %d\n", connections)
+	fmt.Fprintf(&b, "# HELP echosphere_voice_participants People in voice channels.\n")
+	fmt.Fprintf(&b, "# TYPE echosphere_voice_participants gauge\n")
+	fmt.Fprintf(&b, "echosphere_voice_participants %d\n", voice)
+
+	lagging, maxDepth := 0, 0
+	for _, c := range s.ws.snapshot() {
+		depth, _ := c.sendLag(time.Now())
+		maxDepth = max(maxDepth, depth)
+		if c.lagStrikes.Load() > 0 {
+			lagging++
+		}
+	}
+	fmt.Fprintf(&b, "# HELP echosphere_ws_send_queue_max Frames waiting for the most backed-up connection.\n")
+	fmt.Fprintf(&b, "# TYPE echosphere_ws_send_queue_max gauge\n")
+	fmt.Fprintf(&b, "echosphere_ws_send_queue_max %d\n", maxDepth)
+	fmt.Fprintf(&b, "# HELP echosphere_ws_lagging_clients Connections the lag monitor last found behind.\n")
+	fmt.Fprintf(&b, "# TYPE echosphere_ws_lagging_clients gauge\n")
+	fmt.Fprintf(&b, "echosphere_ws_lagging_clients %d\n", lagging)
+
+	m := s.metrics
+	m.mu.Lock()
+	m.rtt.write(&b, "echosphere_ws_rtt_seconds", "WebSocket ping/pong round-trip time.")
+	m.fanout.write(&b, "echosphere_ws_broadcast_seconds", "Time to queue a channel broadcast for every subscriber.")
+	m.sendDelay.write(&b, "echosphere_ws_send_delay_seconds", "Time outbound frames waited in a connection's send queue.")
+	fmt.Fprintf(&b, "# HELP echosphere_ws_lag_disconnects_total Connections closed for lagging behind.\n")
+	fmt.Fprintf(&b, "# TYPE echosphere_ws_lag_disconnects_total counter\n")
+	fmt.Fprintf(&b, "echosphere_ws_lag_disconnects_total %d\n", m.lagDisconnects)
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
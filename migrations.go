@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+func hasColumn(ctx context.Context, db *sql.DB, table, column string) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name = ?)`, table, column).Scan(&exists)
+	return exists, err
+}
+
+// rebuildTables runs rebuild in a transaction with foreign keys disabled, as
+// SQLite requires when a table is recreated under its old name, and checks
+// the result for dangling references before committing. The pragma only
+// applies outside a transaction, so the connection is pinned for the duration.
+func rebuildTables(ctx context.Context, db *sql.DB, rebuild func(tx *sql.Tx) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), `PRAGMA foreign_keys = ON`)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := rebuild(tx); err != nil {
+		return err
+	}
+	var violations int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM pragma_foreign_key_check`).Scan(&violations); err != nil {
+		return err
+	}
+	if violations > 0 {
+		return fmt.Errorf("%d foreign key violations after rebuild", violations)
+	}
+	return tx.Commit()
+}
+
+// replaceTable swaps table for the already populated table_new.
+func replaceTable(ctx context.Context, tx *sql.Tx, table string) error {
+	if _, err := tx.ExecContext(ctx, `DROP TABLE `+table); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `ALTER TABLE `+table+`_new RENAME TO `+table)
+	return err
+}
+
+// migrateUserIDs rebuilds a users table keyed by email into one with a
+// numeric id and a unique handle, deriving handles from the email addresses.
+func migrateUserIDs(ctx context.Context, db *sql.DB) error {
+	if done, err := hasColumn(ctx, db, "users", "id"); err != nil || done {
+		return err
+	}
+
+	return rebuildTables(ctx, db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `
+        CREATE TABLE users_new (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            email TEXT NOT NULL UNIQUE,
+            handle TEXT NOT NULL UNIQUE,
+            display_name TEXT NOT NULL,
+            password_hash BLOB NOT NULL,
+            created_at TIMESTAMP NOT NULL,
+            is_admin INTEGER NOT NULL DEFAULT 0,
+            status TEXT NOT NULL DEFAULT 'active'
+        );`); err != nil {
+			return err
+		}
+
+		rows, err := tx.QueryContext(ctx, `SELECT email FROM users ORDER BY created_at, rowid`)
+		if err != nil {
+			return err
+		}
+		var emails []string
+		for rows.Next() {
+			var email string
+			if err := rows.Scan(&email); err != nil {
+				rows.Close()
+				return err
+			}
+			emails = append(emails, email)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, email := range emails {
+			base := handleFromEmail(email)
+			if email == systemUserEmail {
+				base = systemUserHandle
+			}
+			handle := base
+			for n := 2; ; n++ {
+				var taken bool
+				if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM users_new WHERE handle = ?)`, handle).Scan(&taken); err != nil {
+					return err
+				}
+				if !taken && (handle != systemUserHandle || email == systemUserEmail) {
+					break
+				}
+				handle = base + strconv.Itoa(n)
+			}
+			if _, err := tx.ExecContext(ctx, `
+                INSERT INTO users_new (email, handle, display_name, password_hash, created_at, is_admin, status)
+                SELECT email, ?, display_name, password_hash, created_at, is_admin, status FROM users WHERE email = ?
+            `, handle, email); err != nil {
+				return err
+			}
+		}
+		return replaceTable(ctx, tx, "users")
+	})
+}
+
+// migrateUserForeignKeys points server_members, channel_messages and
+// sessions at users(id) instead of users(email), backfilling the ids from
+// the existing rows.
+func migrateUserForeignKeys(ctx context.Context, db *sql.DB) error {
+	if done, err := hasColumn(ctx, db, "server_members", "user_id"); err != nil || done {
+		return err
+	}
+	// Very old databases predate forwarding; give them the columns the copy
+	// below reads from.
+	for _, column := range []string{
+		"origin_message_id INTEGER",
+		"origin_channel_id INTEGER",
+		"origin_author_email TEXT",
+		"crossposted_at TIMESTAMP",
+	} {
+		if err := addColumnIfMissing(ctx, db, "channel_messages", column); err != nil {
+			return err
+		}
+	}
+	// Databases from before sessions were stored get the table created
+	// keyed by id already.
+	sessionsByEmail, err := hasColumn(ctx, db, "sessions", "user_email")
+	if err != nil {
+		return err
+	}
+
+	return rebuildTables(ctx, db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, serverMembersSchema("server_members_new")); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+            INSERT INTO server_members_new (server_id, user_id, role, joined_at)
+            SELECT sm.server_id, u.id, sm.role, sm.joined_at
+            FROM server_members sm JOIN users u ON u.email = sm.user_email
+        `); err != nil {
+			return err
+		}
+		if err := replaceTable(ctx, tx, "server_members"); err != nil {
+			return err
+		}
+
+		// Keep the AUTOINCREMENT high-water mark so ids of deleted messages
+		// are not handed out again.
+		var seq sql.NullInt64
+		if err := tx.QueryRowContext(ctx, `SELECT seq FROM sqlite_sequence WHERE name = 'channel_messages'`).Scan(&seq); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, channelMessagesSchema("channel_messages_new")); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+            INSERT INTO channel_messages_new (id, channel_id, author_id, content, created_at, origin_message_id, origin_channel_id, origin_author_id, crossposted_at)
+            SELECT m.id, m.channel_id, u.id, m.content, m.created_at, m.origin_message_id, m.origin_channel_id, ou.id, m.crossposted_at
+            FROM channel_messages m
+            JOIN users u ON u.email = m.author_email
+            LEFT JOIN users ou ON ou.email = m.origin_author_email
+        `); err != nil {
+			return err
+		}
+		if err := replaceTable(ctx, tx, "channel_messages"); err != nil {
+			return err
+		}
+		if seq.Valid {
+			if _, err := tx.ExecContext(ctx, `UPDATE sqlite_sequence SET seq = MAX(seq, ?) WHERE name = 'channel_messages'`, seq.Int64); err != nil {
+				return err
+			}
+		}
+
+		if !sessionsByEmail {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, sessionsSchema("sessions_new")); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+            INSERT INTO sessions_new (token_hash, user_id, remember, created_at, expires_at, client_ip)
+            SELECT s.token_hash, u.id, s.remember, s.created_at, s.expires_at, s.client_ip
+            FROM sessions s JOIN users u ON u.email = s.user_email
+        `); err != nil {
+			return err
+		}
+		return replaceTable(ctx, tx, "sessions")
+	})
+}
+
+// migrateAttachmentBlobs moves attachment contents out of message_attachments
+// into attachment_blobs, keyed by their SHA-256, so identical files are
+// stored once.
+func migrateAttachmentBlobs(ctx context.Context, db *sql.DB) error {
+	if done, err := hasColumn(ctx, db, "message_attachments", "blob_hash"); err != nil || done {
+		return err
+	}
+
+	return rebuildTables(ctx, db, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT id, data FROM message_attachments`)
+		if err != nil {
+			return err
+		}
+		hashes := make(map[int64]string)
+		for rows.Next() {
+			var id int64
+			var data []byte
+			if err := rows.Scan(&id, &data); err != nil {
+				rows.Close()
+				return err
+			}
+			hashes[id] = attachmentHash(data)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE message_attachments ADD COLUMN blob_hash TEXT`); err != nil {
+			return err
+		}
+		for id, hash := range hashes {
+			if _, err := tx.ExecContext(ctx, `UPDATE message_attachments SET blob_hash = ? WHERE id = ?`, hash, id); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `
+                INSERT INTO attachment_blobs (hash, size, data, created_at)
+                SELECT ?, length(data), data, created_at FROM message_attachments WHERE id = ?
+                ON CONFLICT (hash) DO NOTHING
+            `, hash, id); err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, messageAttachmentsSchema("message_attachments_new")); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+            INSERT INTO message_attachments_new (id, message_id, filename, content_type, size, blob_hash, created_at)
+            SELECT id, message_id, filename, content_type, size, blob_hash, created_at FROM message_attachments
+        `); err != nil {
+			return err
+		}
+		if err := replaceTable(ctx, tx, "message_attachments"); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE attachment_blobs SET refs = (SELECT COUNT(*) FROM message_attachments WHERE blob_hash = attachment_blobs.hash)`)
+		return err
+	})
+}
+
+// creatorIDColumns lists the columns that used to name who created a row by
+// email and now hold their user id.
+var creatorIDColumns = []struct{ table, email, id string }{
+	{"announcements", "created_by", "created_by_id"},
+	{"bridge_links", "created_by", "created_by_id"},
+	{"channel_follows", "created_by", "created_by_id"},
+	{"server_automations", "created_by", "created_by_id"},
+	{"channel_access_grants", "granted_by", "granted_by_id"},
+}
+
+// migrateCreatorIDs replaces each email column in creatorIDColumns with an
+// id column referencing users(id), backfilled from the stored emails. Rows
+// whose creator is gone, or was not a user, are left NULL.
+func migrateCreatorIDs(ctx context.Context, db *sql.DB) error {
+	for _, c := range creatorIDColumns {
+		pending, err := hasColumn(ctx, db, c.table, c.email)
+		if err != nil {
+			return err
+		}
+		if !pending {
+			continue
+		}
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		for _, stmt := range []string{
+			`ALTER TABLE ` + c.table + ` ADD COLUMN ` + c.id + ` INTEGER REFERENCES users(id) ON DELETE SET NULL`,
+			`UPDATE ` + c.table + ` SET ` + c.id + ` = (SELECT u.id FROM users u WHERE u.email = ` + c.table + `.` + c.email + `)`,
+			`ALTER TABLE ` + c.table + ` DROP COLUMN ` + c.email,
+		} {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("%s.%s: %w", c.table, c.email, err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	uniqueHandleColumn = regexp.MustCompile(`(?i)\bhandle\s+TEXT\s+NOT\s+NULL\s+UNIQUE\b`)
+	// usersTableHead also matches the quoted name SQLite writes when a
+	// rebuilt users table is renamed into place.
+	usersTableHead = regexp.MustCompile(`(?i)^CREATE\s+TABLE\s+("users"|users)\s*\(`)
+)
+
+// migrateTenantHandles drops the instance-wide UNIQUE on users.handle so
+// handles only need to be unique within a tenant, as idx_users_tenant_handle
+// enforces. The table is recreated from its own definition so every column
+// added since comes along.
+func migrateTenantHandles(ctx context.Context, db *sql.DB) error {
+	var definition string
+	if err := db.QueryRowContext(ctx, `SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'users'`).Scan(&definition); err != nil {
+		return err
+	}
+	if !uniqueHandleColumn.MatchString(definition) {
+		return nil
+	}
+	head := usersTableHead.FindString(definition)
+	if head == "" {
+		return errors.New("unexpected users table definition")
+	}
+	rebuilt := "CREATE TABLE users_new (" + uniqueHandleColumn.ReplaceAllString(definition[len(head):], "handle TEXT NOT NULL")
+
+	return rebuildTables(ctx, db, func(tx *sql.Tx) error {
+		var seq sql.NullInt64
+		if err := tx.QueryRowContext(ctx, `SELECT seq FROM sqlite_sequence WHERE name = 'users'`).Scan(&seq); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, rebuilt); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO users_new SELECT * FROM users`); err != nil {
+			return err
+		}
+		if err := replaceTable(ctx, tx, "users"); err != nil {
+			return err
+		}
+		if seq.Valid {
+			if _, err := tx.ExecContext(ctx, `UPDATE sqlite_sequence SET seq = MAX(seq, ?) WHERE name = 'users'`, seq.Int64); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// baselineSchema is the database as the first release created it: users
+// keyed by email, no sessions table, messages pointing at author emails.
+const baselineSchema = `
+    CREATE TABLE users (
+        email TEXT PRIMARY KEY,
+        display_name TEXT NOT NULL,
+        password_hash BLOB NOT NULL,
+        created_at TIMESTAMP NOT NULL
+    );
+    CREATE TABLE servers (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        slug TEXT NOT NULL UNIQUE,
+        name TEXT NOT NULL,
+        created_at TIMESTAMP NOT NULL
+    );
+    CREATE TABLE server_members (
+        server_id INTEGER NOT NULL,
+        user_email TEXT NOT NULL,
+        role TEXT NOT NULL DEFAULT 'member',
+        joined_at TIMESTAMP NOT NULL,
+        PRIMARY KEY (server_id, user_email),
+        FOREIGN KEY(server_id) REFERENCES servers(id) ON DELETE CASCADE,
+        FOREIGN KEY(user_email) REFERENCES users(email) ON DELETE CASCADE
+    );
+    CREATE TABLE channels (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        server_id INTEGER NOT NULL,
+        slug TEXT NOT NULL,
+        name TEXT NOT NULL,
+        kind TEXT NOT NULL DEFAULT 'text',
+        created_at TIMESTAMP NOT NULL,
+        UNIQUE(server_id, slug),
+        FOREIGN KEY(server_id) REFERENCES servers(id) ON DELETE CASCADE
+    );
+    CREATE TABLE channel_messages (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        channel_id INTEGER NOT NULL,
+        author_email TEXT NOT NULL,
+        content TEXT NOT NULL,
+        created_at TIMESTAMP NOT NULL,
+        FOREIGN KEY(channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+        FOREIGN KEY(author_email) REFERENCES users(email) ON DELETE CASCADE
+    );
+    CREATE INDEX idx_channel_messages_channel_created
+    ON channel_messages(channel_id, created_at);
+
+    INSERT INTO users VALUES
+        ('ada@example.com', 'Ada', x'00', '2024-01-01 00:00:00'),
+        ('bob@example.com', 'Bob', x'00', '2024-01-02 00:00:00');
+    INSERT INTO servers VALUES (1, 'home', 'Home', '2024-01-01 00:00:00');
+    INSERT INTO server_members VALUES
+        (1, 'ada@example.com', 'owner', '2024-01-01 00:00:00'),
+        (1, 'bob@example.com', 'member', '2024-01-02 00:00:00');
+    INSERT INTO channels VALUES (1, 1, 'general', 'general', 'text', '2024-01-01 00:00:00');
+    INSERT INTO channel_messages VALUES
+        (1, 1, 'ada@example.com', 'hello', '2024-01-03 00:00:00'),
+        (2, 1, 'bob@example.com', 'hi ada', '2024-01-03 00:01:00');
+`
+
+func TestEnsureSchemaUpgradesBaseline(t *testing.T) {
+	ctx := context.Background()
+	db, readDB, err := openDatabase(ctx, filepath.Join(t.TempDir(), "echosphere.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer readDB.Close()
+	if _, err := db.ExecContext(ctx, baselineSchema); err != nil {
+		t.Fatalf("create baseline schema: %v", err)
+	}
+
+	if err := ensureSchema(ctx, db); err != nil {
+		t.Fatalf("upgrade baseline: %v", err)
+	}
+	// A restart runs the migrations again over the upgraded database.
+	if err := ensureSchema(ctx, db); err != nil {
+		t.Fatalf("rerun on upgraded database: %v", err)
+	}
+
+	var definition string
+	if err := db.QueryRowContext(ctx, `SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'users'`).Scan(&definition); err != nil {
+		t.Fatal(err)
+	}
+	if uniqueHandleColumn.MatchString(definition) {
+		t.Errorf("users.handle is still unique across tenants:\n%s", definition)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+        SELECT m.id, u.handle, m.content
+        FROM channel_messages m JOIN users u ON u.id = m.author_id
+        ORDER BY m.id
+    `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	want := []struct {
+		id      int64
+		handle  string
+		content string
+	}{{1, "ada", "hello"}, {2, "bob", "hi ada"}}
+	var n int
+	for rows.Next() {
+		var id int64
+		var handle, content string
+		if err := rows.Scan(&id, &handle, &content); err != nil {
+			t.Fatal(err)
+		}
+		if n >= len(want) || want[n].id != id || want[n].handle != handle || want[n].content != content {
+			t.Errorf("message %d: got (%d, %q, %q)", n, id, handle, content)
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(want) {
+		t.Errorf("got %d messages, want %d", n, len(want))
+	}
+
+	var members int
+	if err := db.QueryRowContext(ctx, `
+        SELECT COUNT(*) FROM server_members sm JOIN users u ON u.id = sm.user_id WHERE sm.server_id = 1
+    `).Scan(&members); err != nil {
+		t.Fatal(err)
+	}
+	if members != 2 {
+		t.Errorf("got %d members of the home server, want 2", members)
+	}
+}
+
+func TestMigrateCreatorIDs(t *testing.T) {
+	ctx := context.Background()
+	db, readDB, err := openDatabase(ctx, filepath.Join(t.TempDir(), "echosphere.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer readDB.Close()
+	if _, err := db.ExecContext(ctx, `
+        CREATE TABLE users (id INTEGER PRIMARY KEY, email TEXT NOT NULL UNIQUE);
+        INSERT INTO users VALUES (7, 'ada@example.com');
+    `); err != nil {
+		t.Fatal(err)
+	}
+	// Each table as it was: a row by a user and one by an actor that is not
+	// a user, such as the admin API.
+	for _, c := range creatorIDColumns {
+		if _, err := db.ExecContext(ctx, `CREATE TABLE `+c.table+` (id INTEGER PRIMARY KEY, `+c.email+` TEXT NOT NULL)`); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.ExecContext(ctx, `INSERT INTO `+c.table+` VALUES (1, 'ada@example.com'), (2, 'grpc')`); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := migrateCreatorIDs(ctx, db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if err := migrateCreatorIDs(ctx, db); err != nil {
+		t.Fatalf("rerun: %v", err)
+	}
+	// The ids outlive a change of address.
+	if _, err := db.ExecContext(ctx, `UPDATE users SET email = 'ada@example.org' WHERE id = 7`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range creatorIDColumns {
+		if stale, err := hasColumn(ctx, db, c.table, c.email); err != nil {
+			t.Fatal(err)
+		} else if stale {
+			t.Errorf("%s.%s is still there", c.table, c.email)
+		}
+		var byUser, byActor sql.NullInt64
+		if err := db.QueryRowContext(ctx, `
+            SELECT (SELECT `+c.id+` FROM `+c.table+` WHERE id = 1), (SELECT `+c.id+` FROM `+c.table+` WHERE id = 2)
+        `).Scan(&byUser, &byActor); err != nil {
+			t.Fatal(err)
+		}
+		if byUser.Int64 != 7 || byActor.Valid {
+			t.Errorf("%s.%s: got %v and %v, want 7 and NULL", c.table, c.id, byUser, byActor)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// The WebSocket protocol is defined in JSON. Clients that negotiate the
+// msgpack subprotocol get the same documents re-encoded as MessagePack, so
+// only the generic JSON value types need to be supported here.
+
+var errMsgpackTruncated = errors.New("msgpack: truncated input")
+
+func jsonToMsgpack(doc []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := msgpackEncode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func msgpackToJSON(data []byte) ([]byte, error) {
+	v, rest, err := msgpackDecode(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("msgpack: trailing data")
+	}
+	return json.Marshal(v)
+}
+
+func msgpackEncode(buf *bytes.Buffer, v any) error {
+	switch val := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if val {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			msgpackEncodeInt(buf, i)
+			return nil
+		}
+		f, err := val.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xcb)
+		_ = binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		n := len(val)
+		switch {
+		case n < 32:
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			buf.Write([]byte{0xd9, byte(n)})
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xda)
+			_ = binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdb)
+			_ = binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		buf.WriteString(val)
+	case []any:
+		msgpackEncodeLen(buf, len(val), 0x90, 0xdc, 0xdd)
+		for _, item := range val {
+			if err := msgpackEncode(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		msgpackEncodeLen(buf, len(val), 0x80, 0xde, 0xdf)
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := msgpackEncode(buf, k); err != nil {
+				return err
+			}
+			if err := msgpackEncode(buf, val[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", v)
+	}
+	return nil
+}
+
+func msgpackEncodeLen(buf *bytes.Buffer, n int, fix, code16, code32 byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		_ = binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(code32)
+		_ = binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func msgpackEncodeInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		_ = binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		_ = binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func msgpackDecode(data []byte) (any, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, errMsgpackTruncated
+	}
+	b, data := data[0], data[1:]
+	switch {
+	case b <= 0x7f:
+		return int64(b), data, nil
+	case b >= 0xe0:
+		return int64(int8(b)), data, nil
+	case b&0xe0 == 0xa0:
+		return msgpackDecodeString(data, int(b&0x1f))
+	case b&0xf0 == 0x90:
+		return msgpackDecodeArray(data, int(b&0x0f))
+	case b&0xf0 == 0x80:
+		return msgpackDecodeMap(data, int(b&0x0f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, data, nil
+	case 0xc2:
+		return false, data, nil
+	case 0xc3:
+		return true, data, nil
+	case 0xcc, 0xcd, 0xce, 0xcf, 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << ((b - 0xcc) % 4)
+		if len(data) < size {
+			return nil, nil, errMsgpackTruncated
+		}
+		raw, rest := data[:size], data[size:]
+		var u uint64
+		for _, c := range raw {
+			u = u<<8 | uint64(c)
+		}
+		if b <= 0xcf {
+			return u, rest, nil
+		}
+		shift := 64 - 8*size
+		return int64(u<<shift) >> shift, rest, nil
+	case 0xca:
+		if len(data) < 4 {
+			return nil, nil, errMsgpackTruncated
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), data[4:], nil
+	case 0xcb:
+		if len(data) < 8 {
+			return nil, nil, errMsgpackTruncated
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], nil
+	case 0xd9, 0xda, 0xdb, 0xdc, 0xdd, 0xde, 0xdf:
+		sizes := map[byte]int{0xd9: 1, 0xda: 2, 0xdb: 4, 0xdc: 2, 0xdd: 4, 0xde: 2, 0xdf: 4}
+		size := sizes[b]
+		if len(data) < size {
+			return nil, nil, errMsgpackTruncated
+		}
+		n := 0
+		for _, c := range data[:size] {
+			n = n<<8 | int(c)
+		}
+		data = data[size:]
+		switch b {
+		case 0xdc, 0xdd:
+			return msgpackDecodeArray(data, n)
+		case 0xde, 0xdf:
+			return msgpackDecodeMap(data, n)
+		}
+		return msgpackDecodeString(data, n)
+	}
+	return nil, nil, fmt.Errorf("msgpack: unsupported type byte 0x%02x", b)
+}
+
+func msgpackDecodeString(data []byte, n int) (any, []byte, error) {
+	if n < 0 || len(data) < n {
+		return nil, nil, errMsgpackTruncated
+	}
+	return string(data[:n]), data[n:], nil
+}
+
+func msgpackDecodeArray(data []byte, n int) (any, []byte, error) {
+	if n > len(data) {
+		return nil, nil, errMsgpackTruncated
+	}
+	items := make([]any, 0, n)
+	for i := 0; i < n; i++ {
+		item, rest, err := msgpackDecode(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		items = append(items, item)
+		data = rest
+	}
+	return items, data, nil
+}
+
+func msgpackDecodeMap(data []byte, n int) (any, []byte, error) {
+	if n > len(data) {
+		return nil, nil, errMsgpackTruncated
+	}
+	m := make(map[string]any, n)
+	for i := 0; i < n; i++ {
+		key, rest, err := msgpackDecode(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		k, ok := key.(string)
+		if !ok {
+			return nil, nil, errors.New("msgpack: map keys must be strings")
+		}
+		val, rest, err := msgpackDecode(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		m[k] = val
+		data = rest
+	}
+	return m, data, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultNotificationCooldown = 15 * time.Minute
+	notificationExcerptRunes    = 200
+)
+
+// notifyKey limits emails to one per conversation per cooldown.
+type notifyKey struct{ userID, channelID int64 }
+
+// notifyJob is the payload of a notify.dm job. It only names the message,
+// so its content is not kept in the job after the message is deleted or
+// expires. The field matches messageDTO's, which older jobs hold.
+type notifyJob struct {
+	MessageID int64 `json:"id"`
+}
+
+// notifyMessage emails the other participants of a DM who are not connected
+// anywhere, unless they are set to do not disturb. During their quiet hours
+// the email waits for a digest instead. It returns at once; the lookups and
+// sending happen in a notify.dm job.
+func (s *serverState) notifyMessage(msg messageDTO) {
+	if !s.emailNotifications {
+		return
+	}
+	ctx := context.Background()
+	ch, exists, err := s.channelByID(ctx, msg.ChannelID)
+	if err != nil {
+		log.Printf("load channel for notification of message %d: %v", msg.ID, err)
+		return
+	}
+	if !exists || ch.Kind != "dm" {
+		return
+	}
+	if _, err := s.jobs.enqueue(ctx, "notify.dm", notifyJob{MessageID: msg.ID}); err != nil {
+		log.Printf("queue notification for message %d: %v", msg.ID, err)
+	}
+}
+
+func (s *serverState) runNotifyJob(ctx context.Context, payload json.RawMessage) error {
+	var job notifyJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	stored, err := s.messageByID(ctx, job.MessageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("load message: %w", err)
+	}
+	if stored.expired(time.Now()) {
+		return nil
+	}
+	msg := toMessageDTO(stored)
+	ch, exists, err := s.channelByID(ctx, msg.ChannelID)
+	if err != nil {
+		return fmt.Errorf("load channel: %w", err)
+	}
+	if !exists || ch.Kind != "dm" {
+		return nil
+	}
+	recipients, err := s.notificationRecipients(ctx, ch.ID, msg.AuthorID)
+	if err != nil {
+		return fmt.Errorf("load recipients: %w", err)
+	}
+	for _, u := range recipients {
+		s.notifyUser(ctx, u, msg)
+	}
+	return nil
+}
+
+// notificationRecipients returns the active accounts in the DM other than
+// its author.
+func (s *serverState) notificationRecipients(ctx context.Context, channelID, authorID int64) ([]user, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT `+userColumns+` FROM users
+        WHERE email IN (SELECT user_email FROM dm_participants WHERE channel_id = ?)
+          AND id != ? AND status = ?
+    `, channelID, authorID, userStatusActive)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []user
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, u)
+	}
+	return result, rows.Err()
+}
+
+// notifyUser emails u about msg, or holds it for a digest during their
+// quiet hours.
+func (s *serverState) notifyUser(ctx context.Context, u user, msg messageDTO) {
+	if s.ws.connections(u.Email) > 0 || u.Email == systemUserEmail {
+		return
+	}
+	quiet, err := s.suppressNotifications(ctx, u.ID)
+	if err != nil {
+		log.Printf("load presence for notification: %v", err)
+		return
+	}
+	if quiet {
+		return
+	}
+
+	l := s.localizerFor(u)
+	excerpt := s.maskFor(u.MaskProfanity, msg).Content
+	if excerpt == "" {
+		excerpt = l.T("email.dm.no_text")
+	} else if utf8.RuneCountInString(excerpt) > notificationExcerptRunes {
+		excerpt = string([]rune(excerpt)[:notificationExcerptRunes]) + "…"
+	}
+	if s.inQuietHours(u, time.Now()) {
+		if err := s.holdNotification(ctx, u, msg, excerpt); err != nil {
+			log.Printf("hold notification for %s: %v", u.Email, err)
+		}
+		return
+	}
+
+	key := notifyKey{userID: u.ID, channelID: msg.ChannelID}
+	if _, recent := s.notified.get(key); recent {
+		return
+	}
+	s.notified.set(key, struct{}{})
+	if err := s.sendEmail(ctx, u.Email, l.T("email.dm.subject", s.currentInstanceName(ctx, u.TenantID), msg.AuthorDisplayName),
+		l.T("email.dm.body", msg.AuthorDisplayName, msg.AuthorHandle, excerpt)); err != nil {
+		log.Printf("queue notification to %s: %v", u.Email, err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCORSMethods = "GET, POST, PATCH, DELETE"
+	corsAllowedHeaders = "Authorization, Content-Type, " + csrfHeaderName + ", " + idempotencyKeyHeader
+	corsMaxAge         = 10 * time.Minute
+)
+
+// originPolicy decides which browser origins may open WebSockets and call the
+// REST API. Same-host origins are always accepted; others must be listed in
+// ALLOWED_ORIGINS ("*" accepts any origin).
+type originPolicy struct {
+	origins     map[string]bool
+	any         bool
+	methods     string
+	credentials bool
+}
+
+func newOriginPolicy(origins, methods string, credentials bool) *originPolicy {
+	p := &originPolicy{origins: make(map[string]bool), methods: methods, credentials: credentials}
+	if p.methods == "" {
+		p.methods = defaultCORSMethods
+	}
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimSpace(origin)
+		switch origin {
+		case "":
+		case "*":
+			p.any = true
+		default:
+			p.origins[normalizeOrigin(origin)] = true
+		}
+	}
+	return p
+}
+
+func originPolicyFromEnv() *originPolicy {
+	credentials, _ := strconv.ParseBool(envOrDefault("CORS_ALLOW_CREDENTIALS", "false"))
+	return newOriginPolicy(envOrDefault("ALLOWED_ORIGINS", ""), envOrDefault("CORS_ALLOWED_METHODS", ""), credentials)
+}
+
+func normalizeOrigin(origin string) string {
+	return strings.TrimSuffix(strings.ToLower(origin), "/")
+}
+
+func sameHostOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// allowed reports whether the request's Origin is acceptable. Requests
+// without an Origin header don't come from a browser page and are allowed.
+func (p *originPolicy) allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || sameHostOrigin(r, origin) {
+		return true
+	}
+	return p.any || p.origins[normalizeOrigin(origin)]
+}
+
+// corsMiddleware answers preflights and adds CORS headers to /api/ responses
+// for allowed cross-origin callers. Disallowed origins get no CORS headers,
+// so the browser withholds the response.
+func (p *originPolicy) corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !strings.HasPrefix(r.URL.Path, "/api/") || sameHostOrigin(r, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		w.Header().Add("Vary", "Origin")
+		if !p.allowed(r) {
+			if preflight {
+				errorFor(w, r, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if p.credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", p.methods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
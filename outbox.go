@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// New messages reach subscribers through the outbox. Whoever stores a
+// message records an event for it in the same transaction, and a single
+// dispatcher publishes the events in order and deletes them once sent. A
+// crash between the two only means the events are published again on the
+// next start, so delivery is at least once; clients drop messages whose id
+// they already have. Notifications, bridges, automations and plugins only
+// hear of a message once its event is deleted, so a redelivery never
+// repeats them; a crash in between skips them instead.
+const (
+	outboxBatch     = 100
+	outboxPollEvery = 5 * time.Second
+)
+
+// queueMessageEvent records that a message was stored. db is the
+// transaction that stored it.
+func queueMessageEvent(ctx context.Context, db sqlExecer, channelID, messageID int64, createdAt time.Time) error {
+	_, err := db.ExecContext(ctx, `
+        INSERT INTO outbox (type, channel_id, message_id, created_at) VALUES ('message', ?, ?, ?)
+    `, channelID, messageID, createdAt.UTC())
+	return err
+}
+
+func (s *serverState) wakeOutbox() {
+	select {
+	case s.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *serverState) runOutboxDispatcher(ctx context.Context) {
+	ticker := time.NewTicker(outboxPollEvery)
+	defer ticker.Stop()
+
+	for {
+		if err := s.dispatchOutbox(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("dispatch outbox: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.outboxWake:
+		}
+	}
+}
+
+// dispatchOutbox publishes pending events until none are left. An event
+// that cannot be loaded ends the pass, leaving it and everything after it
+// for the next one so the order holds.
+func (s *serverState) dispatchOutbox(ctx context.Context) error {
+	for {
+		rows, err := s.readDB.QueryContext(ctx, `SELECT id, message_id FROM outbox ORDER BY id LIMIT ?`, outboxBatch)
+		if err != nil {
+			return err
+		}
+		type event struct{ id, messageID int64 }
+		var batch []event
+		for rows.Next() {
+			var e event
+			if err := rows.Scan(&e.id, &e.messageID); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		sent := int64(0)
+		var published []messageDTO
+		for _, e := range batch {
+			msg, err := s.messageByID(ctx, e.messageID)
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				// Deleted before it went out; nobody needs to hear of it.
+			case err != nil:
+				if sent > 0 {
+					if err := s.ackOutbox(ctx, sent, published); err != nil {
+						log.Printf("acknowledge outbox: %v", err)
+					}
+				}
+				return err
+			case msg.ExpiresAt.Valid && !msg.ExpiresAt.Time.After(time.Now()):
+			default:
+				dto := toMessageDTO(msg)
+				s.broadcastMessage(dto)
+				published = append(published, dto)
+			}
+			sent = e.id
+		}
+		if err := s.ackOutbox(ctx, sent, published); err != nil {
+			return err
+		}
+	}
+}
+
+// ackOutbox deletes the events up to and including id once published, and
+// then passes their messages on to messagePublished. When the delete fails
+// the events go out again on the next pass, and only then do the rest.
+func (s *serverState) ackOutbox(ctx context.Context, id int64, published []messageDTO) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM outbox WHERE id <= ?`, id); err != nil {
+		return err
+	}
+	for _, msg := range published {
+		s.messagePublished(msg)
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Argon2id defaults follow the OWASP recommendation of 19 MiB, two
+	// passes and one thread.
+	defaultArgon2Memory  = 19 * 1024
+	defaultArgon2Time    = 2
+	defaultArgon2Threads = 1
+	argon2SaltLength     = 16
+	argon2KeyLength      = 32
+
+	// maxPasswordLength bounds the work a single login can cause.
+	maxPasswordLength = 256
+)
+
+// commonPasswords are rejected when PASSWORD_BLOCK_COMMON is set. Shorter
+// ones never pass the length check anyway.
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "password12": true, "password123": true, "passw0rd": true,
+	"12345678": true, "123456789": true, "1234567890": true, "0987654321": true, "987654321": true,
+	"11111111": true, "00000000": true, "88888888": true, "12341234": true, "11223344": true,
+	"qwertyui": true, "qwertyuiop": true, "qwerty123": true, "qwerty12": true, "asdfghjk": true,
+	"1q2w3e4r": true, "1qaz2wsx": true, "zaq12wsx": true, "abc12345": true, "abcd1234": true,
+	"iloveyou": true, "sunshine": true, "princess": true, "football": true, "baseball": true,
+	"superman": true, "starwars": true, "whatever": true, "trustno1": true, "letmein1": true,
+	"welcome1": true, "welcome123": true, "changeme": true, "admin123": true, "computer": true,
+	"michelle": true, "jennifer": true, "mercedes": true, "corvette": true, "internet": true,
+	"echosphere": true,
+}
+
+// passwordPolicy is the instance's rules for new passwords and how they
+// are hashed.
+type passwordPolicy struct {
+	minLength   int
+	minClasses  int
+	blockCommon bool
+
+	argon2Memory  uint32
+	argon2Time    uint32
+	argon2Threads uint8
+}
+
+func passwordPolicyFromEnv() passwordPolicy {
+	p := passwordPolicy{
+		minLength:     max(intFromEnv("PASSWORD_MIN_LENGTH", minPasswordLength), minPasswordLength),
+		minClasses:    min(intFromEnv("PASSWORD_MIN_CLASSES", 1), 4),
+		blockCommon:   boolFromEnv("PASSWORD_BLOCK_COMMON", false),
+		argon2Memory:  uint32(intFromEnv("ARGON2_MEMORY_KIB", defaultArgon2Memory)),
+		argon2Time:    uint32(max(intFromEnv("ARGON2_TIME", defaultArgon2Time), 1)),
+		argon2Threads: uint8(min(max(intFromEnv("ARGON2_THREADS", defaultArgon2Threads), 1), 255)),
+	}
+	// Argon2 needs at least 8 KiB per thread.
+	p.argon2Memory = max(p.argon2Memory, 8*uint32(p.argon2Threads))
+	return p
+}
+
+// passwordError explains why a new password was refused. key and args
+// pick the message from the locale catalogs; Error is the English text.
+type passwordError struct {
+	key  string
+	args []any
+}
+
+func (e *passwordError) Error() string {
+	return localizer{locale: fallbackLocale}.T(e.key, e.args...)
+}
+
+// check returns a *passwordError when password breaks the policy. personal
+// is what the account is known by, such as its email and handle, which the
+// password may not contain when common passwords are blocked.
+func (p passwordPolicy) check(password string, personal ...string) error {
+	if len(password) < p.minLength {
+		return &passwordError{key: "password.error.short", args: []any{p.minLength}}
+	}
+	if len(password) > maxPasswordLength {
+		return &passwordError{key: "password.error.long", args: []any{maxPasswordLength}}
+	}
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if lower+upper+digit+other < p.minClasses {
+		return &passwordError{key: "password.error.classes", args: []any{p.minClasses}}
+	}
+	if p.blockCommon {
+		folded := strings.ToLower(password)
+		if commonPasswords[folded] || strings.Count(folded, folded[:1]) == len(folded) {
+			return &passwordError{key: "password.error.common"}
+		}
+		for _, value := range personal {
+			value, _, _ = strings.Cut(strings.ToLower(value), "@")
+			if len(value) >= 3 && strings.Contains(folded, value) {
+				return &passwordError{key: "password.error.personal"}
+			}
+		}
+	}
+	return nil
+}
+
+// hash returns password as an argon2id hash in the PHC string format, which
+// records the parameters it was made with.
+func (p passwordPolicy) hash(password string) ([]byte, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.argon2Time, p.argon2Memory, p.argon2Threads, argon2KeyLength)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.argon2Memory, p.argon2Time, p.argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+// verify reports whether password matches hash, which may be argon2id or
+// a bcrypt hash from before argon2id. stale is set for a match that should
+// be hashed again: bcrypt, or argon2id with other parameters than now.
+func (p passwordPolicy) verify(hash []byte, password string) (ok, stale bool) {
+	if len(password) > maxPasswordLength {
+		return false, false
+	}
+	if !bytes.HasPrefix(hash, []byte("$argon2id$")) {
+		return len(hash) > 0 && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil, true
+	}
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 {
+		return false, false
+	}
+	var version int
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil || threads == 0 {
+		return false, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false, false
+	}
+	got := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return false, false
+	}
+	return true, memory != p.argon2Memory || time != p.argon2Time || threads != p.argon2Threads
+}
+
+// upgradePasswordHash stores password hashed with the current parameters
+// after it was checked against u's stale hash. A password changed in the
+// meantime is left alone.
+func (s *serverState) upgradePasswordHash(ctx context.Context, u user, password string) {
+	hash, err := s.passwords.hash(password)
+	if err != nil {
+		log.Printf("rehash password of user %d: %v", u.ID, err)
+		return
+	}
+	if _, err := s.db.ExecContext(ctx, `UPDATE users SET password_hash = ? WHERE id = ? AND password_hash = ?`, hash, u.ID, u.PasswordHash); err != nil {
+		log.Printf("rehash password of user %d: %v", u.ID, err)
+	}
+}
+
+// changePassword replaces the user's password hash and deletes every session
+// except keepTokenHash, the one the change was made from.
+func (s *serverState) changePassword(ctx context.Context, userID int64, hash []byte, keepTokenHash string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET password_hash = ? WHERE id = ?`, hash, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = ? AND token_hash != ?`, userID, keepTokenHash); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// handleAccountPassword serves POST /api/account/password. Other sessions
+// are signed out and their WebSocket connections closed with
+// wsCloseAuthExpired; the session making the change stays signed in.
+func (s *serverState) handleAccountPassword(w http.ResponseWriter, r *http.Request) {
+	sess, _, ok := s.sessionFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	defer r.Body.Close()
+	var body struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	if !s.decodeJSON(w, r, &body) {
+		return
+	}
+	if ok, _ := s.passwords.verify(currentUser.PasswordHash, body.CurrentPassword); !ok {
+		httpError(w, "incorrect password", http.StatusForbidden)
+		return
+	}
+	if err := s.passwords.check(body.NewPassword, currentUser.Email, currentUser.Handle); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hash, err := s.passwords.hash(body.NewPassword)
+	if err != nil {
+		log.Printf("hash password: %v", err)
+		httpError(w, "failed to change password", http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+	if err := s.changePassword(ctx, currentUser.ID, hash, sess.TokenHash); err != nil {
+		log.Printf("change password for user %d: %v", currentUser.ID, err)
+		httpError(w, "failed to change password", http.StatusInternalServerError)
+		return
+	}
+	s.ws.disconnectOtherSessions(currentUser.Email, sess.TokenHash, wsCloseAuthExpired, "password changed")
+	s.recordAudit(ctx, 0, currentUser.Email, "user.password_changed", "user", strconv.FormatInt(currentUser.ID, 10), "")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// channelPermission is a set of things a member may do in a channel.
+type channelPermission uint8
+
+const (
+	permView channelPermission = 1 << iota
+	permPost
+	permManage
+
+	allPermissions = permView | permPost | permManage
+)
+
+var permissionNames = []struct {
+	perm channelPermission
+	name string
+}{
+	{permView, "view"},
+	{permPost, "post"},
+	{permManage, "manage"},
+}
+
+func (p channelPermission) names() []string {
+	names := []string{}
+	for _, n := range permissionNames {
+		if p&n.perm != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return names
+}
+
+// parsePermissions reads a list of permission names, and reports false if
+// any is unknown.
+func parsePermissions(names []string) (channelPermission, bool) {
+	var p channelPermission
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		found := false
+		for _, n := range permissionNames {
+			if n.name == name {
+				p |= n.perm
+				found = true
+			}
+		}
+		if !found {
+			return 0, false
+		}
+	}
+	return p, true
+}
+
+// channelOverride changes a role's or a member's permissions in one
+// channel: Deny is taken away, then Allow is granted.
+type channelOverride struct {
+	Role        string // set for role overrides
+	UserID      int64  // set for member overrides, with the member's details
+	Email       string
+	Handle      string
+	DisplayName string
+	Allow       channelPermission
+	Deny        channelPermission
+}
+
+func (o channelOverride) apply(p channelPermission) channelPermission {
+	return p&^o.Deny | o.Allow
+}
+
+type overrideDTO struct {
+	Type        string   `json:"type"` // "role" or "member"
+	Role        string   `json:"role,omitempty"`
+	UserID      int64    `json:"userId,omitempty"`
+	Handle      string   `json:"handle,omitempty"`
+	DisplayName string   `json:"displayName,omitempty"`
+	Allow       []string `json:"allow"`
+	Deny        []string `json:"deny"`
+}
+
+func toOverrideDTO(o channelOverride) overrideDTO {
+	dto := overrideDTO{Type: "role", Role: o.Role, Allow: o.Allow.names(), Deny: o.Deny.names()}
+	if o.UserID != 0 {
+		dto.Type, dto.UserID, dto.Handle, dto.DisplayName = "member", o.UserID, o.Handle, o.DisplayName
+	}
+	return dto
+}
+
+// channelOverrides lists a channel's role overrides, then its member
+// overrides.
+func (s *serverState) channelOverrides(ctx context.Context, channelID int64) ([]channelOverride, error) {
+	if overrides, ok := s.overrideCache.get(channelID); ok {
+		return overrides, nil
+	}
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT role, 0, '', '', '', allow, deny FROM channel_role_overrides WHERE channel_id = ?
+        UNION ALL
+        SELECT '', u.id, u.email, u.handle, u.display_name, o.allow, o.deny
+        FROM channel_member_overrides o JOIN users u ON u.id = o.user_id
+        WHERE o.channel_id = ?
+        ORDER BY 2, 1, 5
+    `, channelID, channelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var overrides []channelOverride
+	for rows.Next() {
+		var o channelOverride
+		if err := rows.Scan(&o.Role, &o.UserID, &o.Email, &o.Handle, &o.DisplayName, &o.Allow, &o.Deny); err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	s.overrideCache.set(channelID, overrides)
+	return overrides, nil
+}
+
+// channelPermissions is what email may do in ch. Server channels start from
+// the member's role: everyone can view, post unless the channel limits
+// posting to other roles, and admins can manage. The channel's override for
+// that role applies next, then the member's own override, and finally any
+// unexpired access grants add to what is left; without view nothing else
+// is. Owners can always do everything so no channel can be locked. In DMs participants can view; whether they can post follows
+// canPostInDirect.
+func (s *serverState) channelPermissions(ctx context.Context, email string, ch channelInfo) (channelPermission, error) {
+	if ch.Kind == "dm" {
+		ok, err := s.isDirectParticipant(ctx, ch.ID, email)
+		if err != nil || !ok {
+			return 0, err
+		}
+		return permView, nil
+	}
+	role, ok, err := s.memberRole(ctx, email, ch.ServerID)
+	if err != nil || !ok {
+		return 0, err
+	}
+	if role == "owner" {
+		return allPermissions, nil
+	}
+	perms := permView
+	if ch.PostRoles == "" || slices.Contains(splitRoles(ch.PostRoles), role) {
+		perms |= permPost
+	}
+	if role == "admin" {
+		perms |= permManage
+	}
+
+	overrides, err := s.channelOverrides(ctx, ch.ID)
+	if err != nil {
+		return 0, err
+	}
+	for _, o := range overrides {
+		if o.UserID == 0 && o.Role == role {
+			perms = o.apply(perms)
+		}
+	}
+	for _, o := range overrides {
+		if o.UserID != 0 && o.Email == email {
+			perms = o.apply(perms)
+		}
+	}
+	grants, err := s.channelGrants(ctx, ch.ID)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	for _, g := range grants {
+		if g.Email == email && g.ExpiresAt.After(now) {
+			perms |= g.Allow
+		}
+	}
+	if perms&permView == 0 {
+		return 0, nil
+	}
+	return perms, nil
+}
+
+// channelVisibleTo is the permView rule of channelPermissions as an SQL
+// condition on a server channel c, for the user whose ID the expression
+// userID yields (such as "?").
+func channelVisibleTo(userID string) string {
+	return `NOT EXISTS (
+            SELECT 1 FROM server_members vsm
+            LEFT JOIN channel_role_overrides ro ON ro.channel_id = c.id AND ro.role = vsm.role
+            LEFT JOIN channel_member_overrides mo ON mo.channel_id = c.id AND mo.user_id = vsm.user_id
+            WHERE vsm.server_id = c.server_id AND vsm.user_id = ` + userID + ` AND vsm.role != 'owner'
+              AND NOT ((COALESCE(ro.allow, 0) & 1 OR NOT COALESCE(ro.deny, 0) & 1) AND NOT COALESCE(mo.deny, 0) & 1
+                       OR COALESCE(mo.allow, 0) & 1)
+              AND NOT EXISTS (
+                SELECT 1 FROM channel_access_grants g
+                WHERE g.channel_id = c.id AND g.user_id = vsm.user_id AND g.allow & 1
+                  AND g.expires_at > strftime('%Y-%m-%d %H:%M:%f', 'now')))`
+}
+
+func (s *serverState) canManageChannel(ctx context.Context, email string, ch channelInfo) (bool, error) {
+	perms, err := s.channelPermissions(ctx, email, ch)
+	return perms&permManage != 0, err
+}
+
+// visibleChannels drops the channels email cannot view from channels.
+func (s *serverState) visibleChannels(ctx context.Context, email string, channels []channelInfo) ([]channelInfo, error) {
+	visible := channels[:0]
+	for _, ch := range channels {
+		perms, err := s.channelPermissions(ctx, email, ch)
+		if err != nil {
+			return nil, err
+		}
+		if perms&permView != 0 {
+			visible = append(visible, ch)
+		}
+	}
+	return visible, nil
+}
+
+// notifyChannelPermissions tells every connected member of ch's server what
+// they may now do there. Members who can no longer view it stop receiving
+// its events.
+func (s *serverState) notifyChannelPermissions(ctx context.Context, ch channelInfo) {
+	members, err := s.membersForServer(ctx, ch.ServerID)
+	if err != nil {
+		log.Printf("load members for channel permissions: %v", err)
+		return
+	}
+	for _, m := range members {
+		s.notifyChannelPermissionsTo(ctx, ch, m.Email)
+	}
+}
+
+func (s *serverState) notifyChannelPermissionsTo(ctx context.Context, ch channelInfo, email string) {
+	if s.ws.connections(email) == 0 {
+		return
+	}
+	perms, err := s.channelPermissions(ctx, email, ch)
+	if err != nil {
+		log.Printf("channel permissions for %s: %v", email, err)
+		return
+	}
+	outbound := wsOutbound{Type: "channel:permissions", ServerID: ch.ServerID, ChannelID: ch.ID, Permissions: perms.names()}
+	if perms&permView != 0 {
+		payload := toChannelPayload(ch)
+		outbound.Channel = &payload
+	} else {
+		s.ws.forUser(email, func(c *wsClient) { s.ws.unsubscribe(c, ch.ID) })
+	}
+	s.ws.sendToUser(email, outbound)
+}
+
+// handleChannelOverrides serves /api/channels/{id}/overrides to members who
+// can manage the channel: GET lists the overrides, and PUT or DELETE on
+// /roles/{role} or /members/{userId} sets or removes one.
+func (s *serverState) handleChannelOverrides(w http.ResponseWriter, r *http.Request, ch channelInfo, currentUser user, rest []string) {
+	ctx := r.Context()
+	if ch.Kind == "dm" {
+		httpError(w, "direct messages have no permission overrides", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case len(rest) == 0 && r.Method != http.MethodGet:
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	case len(rest) == 2 && r.Method != http.MethodPut && r.Method != http.MethodDelete:
+		w.Header().Set("Allow", "PUT, DELETE")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	case len(rest) != 0 && len(rest) != 2:
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	canManage, err := s.canManageChannel(ctx, currentUser.Email, ch)
+	if err != nil {
+		log.Printf("check channel manage permission: %v", err)
+		httpError(w, "failed to load overrides", http.StatusInternalServerError)
+		return
+	}
+	if !canManage {
+		httpError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if len(rest) == 0 {
+		overrides, err := s.channelOverrides(ctx, ch.ID)
+		if err != nil {
+			log.Printf("list channel overrides: %v", err)
+			httpError(w, "failed to load overrides", http.StatusInternalServerError)
+			return
+		}
+		result := make([]overrideDTO, 0, len(overrides))
+		for _, o := range overrides {
+			result = append(result, toOverrideDTO(o))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.Printf("encode channel overrides: %v", err)
+		}
+		return
+	}
+
+	var target channelOverride
+	switch rest[0] {
+	case "roles":
+		if !slices.Contains(knownRoles, rest[1]) {
+			httpError(w, "role not found", http.StatusNotFound)
+			return
+		}
+		if rest[1] == "owner" {
+			httpError(w, "owners always have every permission", http.StatusBadRequest)
+			return
+		}
+		target.Role = rest[1]
+	case "members":
+		userID, err := strconv.ParseInt(rest[1], 10, 64)
+		if err != nil || userID <= 0 {
+			httpError(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+		err = s.readDB.QueryRowContext(ctx, `
+            SELECT u.id, u.email, u.handle, u.display_name
+            FROM server_members sm JOIN users u ON u.id = sm.user_id
+            WHERE sm.server_id = ? AND sm.user_id = ?
+        `, ch.ServerID, userID).Scan(&target.UserID, &target.Email, &target.Handle, &target.DisplayName)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				httpError(w, "member not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("load override member: %v", err)
+			httpError(w, "failed to update override", http.StatusInternalServerError)
+			return
+		}
+	default:
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	details := "role=" + target.Role
+	if target.UserID != 0 {
+		details = "member=" + strconv.FormatInt(target.UserID, 10)
+	}
+	if r.Method == http.MethodDelete {
+		if target.UserID != 0 {
+			_, err = s.db.ExecContext(ctx, `DELETE FROM channel_member_overrides WHERE channel_id = ? AND user_id = ?`, ch.ID, target.UserID)
+		} else {
+			_, err = s.db.ExecContext(ctx, `DELETE FROM channel_role_overrides WHERE channel_id = ? AND role = ?`, ch.ID, target.Role)
+		}
+		if err != nil {
+			log.Printf("delete channel override: %v", err)
+			httpError(w, "failed to delete override", http.StatusInternalServerError)
+			return
+		}
+		s.overrideCache.delete(ch.ID)
+		s.recordAudit(ctx, ch.ServerID, currentUser.Email, "channel.override_delete", "channel", strconv.FormatInt(ch.ID, 10), details)
+		s.notifyChannelPermissions(ctx, ch)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var body struct {
+		Allow []string `json:"allow"`
+		Deny  []string `json:"deny"`
+	}
+	if !s.decodeJSON(w, r, &body) {
+		return
+	}
+	var fieldErrs []fieldError
+	var ok bool
+	if target.Allow, ok = parsePermissions(body.Allow); !ok {
+		fieldErrs = append(fieldErrs, fieldError{Field: "allow", Message: "must only contain view, post and manage"})
+	}
+	if target.Deny, ok = parsePermissions(body.Deny); !ok {
+		fieldErrs = append(fieldErrs, fieldError{Field: "deny", Message: "must only contain view, post and manage"})
+	}
+	if len(fieldErrs) == 0 && target.Allow&target.Deny != 0 {
+		fieldErrs = append(fieldErrs, fieldError{Field: "deny", Message: "must not repeat a permission in allow"})
+	}
+	if len(fieldErrs) > 0 {
+		writeValidationErrors(w, fieldErrs)
+		return
+	}
+
+	if target.UserID != 0 {
+		_, err = s.db.ExecContext(ctx, `
+            INSERT INTO channel_member_overrides (channel_id, user_id, allow, deny) VALUES (?, ?, ?, ?)
+            ON CONFLICT (channel_id, user_id) DO UPDATE SET allow = excluded.allow, deny = excluded.deny
+        `, ch.ID, target.UserID, target.Allow, target.Deny)
+	} else {
+		_, err = s.db.ExecContext(ctx, `
+            INSERT INTO channel_role_overrides (channel_id, role, allow, deny) VALUES (?, ?, ?, ?)
+            ON CONFLICT (channel_id, role) DO UPDATE SET allow = excluded.allow, deny = excluded.deny
+        `, ch.ID, target.Role, target.Allow, target.Deny)
+	}
+	if err != nil {
+		log.Printf("update channel override: %v", err)
+		httpError(w, "failed to update override", http.StatusInternalServerError)
+		return
+	}
+	s.overrideCache.delete(ch.ID)
+	details += " allow=" + strings.Join(target.Allow.names(), ",") + " deny=" + strings.Join(target.Deny.names(), ",")
+	s.recordAudit(ctx, ch.ServerID, currentUser.Email, "channel.override", "channel", strconv.FormatInt(ch.ID, 10), details)
+	s.notifyChannelPermissions(ctx, ch)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(toOverrideDTO(target)); err != nil {
+		log.Printf("encode channel override: %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// plugin extends the server without changes to its core, for custom
+// filters, analytics and the like. Plugins are compiled in: each lives in a
+// file of its own in package main and registers itself from an init
+// function with registerPlugin. Besides name, a plugin implements whichever
+// of the hook interfaces below it needs, and each hook runs for every
+// plugin in registration order.
+type plugin interface {
+	// name identifies the plugin in logs, e.g. "linkfilter".
+	name() string
+}
+
+// messageFilter runs before a message a user sends is stored, including
+// messages arriving over a bridge. It may rewrite m.content, and returning
+// an error from rejectMessage refuses the message with that reason. Any
+// other error fails the send.
+type messageFilter interface {
+	filterMessage(ctx context.Context, m *pendingMessage) error
+}
+
+// messageObserver sees each new message after it has gone out to the
+// channel's connections. It runs on the broadcasting goroutine, so slow
+// work belongs on one of its own.
+type messageObserver interface {
+	messageBroadcast(msg messageDTO)
+}
+
+// memberObserver learns about each user who joins a server, once the join
+// has committed.
+type memberObserver interface {
+	memberJoined(ctx context.Context, serverID int64, email string)
+}
+
+// routeProvider registers HTTP handlers next to the built-in ones, behind
+// the same middleware.
+type routeProvider interface {
+	routes(mux *http.ServeMux, s *serverState)
+}
+
+// pendingMessage is a message on its way to being stored.
+type pendingMessage struct {
+	channelID int64
+	author    string // email
+	content   string
+}
+
+// messageRejectedError refuses a message on behalf of a plugin; its reason
+// is shown to the sender.
+type messageRejectedError struct {
+	plugin string
+	reason string
+}
+
+func (e *messageRejectedError) Error() string { return e.reason }
+
+// rejectMessage is what a messageFilter returns to refuse a message.
+func rejectMessage(reason string) error {
+	return &messageRejectedError{reason: reason}
+}
+
+func asMessageRejected(err error) (*messageRejectedError, bool) {
+	var rejected *messageRejectedError
+	ok := errors.As(err, &rejected)
+	return rejected, ok
+}
+
+var registeredPlugins []plugin
+
+// registerPlugin adds p to the plugins the server starts with. It is meant
+// to be called from init.
+func registerPlugin(p plugin) {
+	registeredPlugins = append(registeredPlugins, p)
+}
+
+// pluginHost runs the hooks of the registered plugins. A plugin that panics
+// is logged and, for a message filter, fails the send; it does not take the
+// server down.
+type pluginHost struct {
+	s       *serverState
+	plugins []plugin
+}
+
+func newPluginHost(s *serverState, plugins ...plugin) *pluginHost {
+	h := &pluginHost{s: s}
+	seen := make(map[string]bool)
+	for _, p := range plugins {
+		if seen[p.name()] {
+			log.Printf("plugin %s registered twice, ignoring the second", p.name())
+			continue
+		}
+		seen[p.name()] = true
+		h.plugins = append(h.plugins, p)
+		log.Printf("plugin %s enabled", p.name())
+	}
+	return h
+}
+
+func (h *pluginHost) call(p plugin, hook string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("plugin %s: %s panicked: %v", p.name(), hook, r)
+			err = fmt.Errorf("plugin %s failed", p.name())
+		}
+	}()
+	return fn()
+}
+
+func (h *pluginHost) filterMessage(ctx context.Context, m *pendingMessage) error {
+	if h == nil {
+		return nil
+	}
+	for _, p := range h.plugins {
+		f, ok := p.(messageFilter)
+		if !ok {
+			continue
+		}
+		err := h.call(p, "filterMessage", func() error { return f.filterMessage(ctx, m) })
+		if rejected, ok := asMessageRejected(err); ok {
+			rejected.plugin = p.name()
+			return rejected
+		}
+		if err != nil {
+			return fmt.Errorf("plugin %s: %w", p.name(), err)
+		}
+	}
+	return nil
+}
+
+func (h *pluginHost) messageBroadcast(msg messageDTO) {
+	if h == nil {
+		return
+	}
+	for _, p := range h.plugins {
+		if o, ok := p.(messageObserver); ok {
+			h.call(p, "messageBroadcast", func() error { o.messageBroadcast(msg); return nil })
+		}
+	}
+}
+
+func (h *pluginHost) memberJoined(ctx context.Context, serverID int64, email string) {
+	if h == nil {
+		return
+	}
+	for _, p := range h.plugins {
+		if o, ok := p.(memberObserver); ok {
+			h.call(p, "memberJoined", func() error { o.memberJoined(ctx, serverID, email); return nil })
+		}
+	}
+}
+
+func (h *pluginHost) routes(mux *http.ServeMux) {
+	if h == nil {
+		return
+	}
+	for _, p := range h.plugins {
+		if r, ok := p.(routeProvider); ok {
+			h.call(p, "routes", func() error { r.routes(mux, h.s); return nil })
+		}
+	}
+}
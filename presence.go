@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	presenceOnline    = "online"
+	presenceAway      = "away"
+	presenceDND       = "dnd"
+	presenceInvisible = "invisible"
+	presenceOffline   = "offline"
+
+	customStatusExpiryEvery = time.Minute
+)
+
+// customStatusDTO is the short text and emoji a user shows next to their
+// name, optionally until ExpiresAt.
+type customStatusDTO struct {
+	Text      string     `json:"text" validate:"trim,max=128"`
+	Emoji     string     `json:"emoji,omitempty" validate:"trim,max=64"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// presenceSettings is what a user chose, as stored on their row.
+type presenceSettings struct {
+	Status       string           `json:"status"`
+	CustomStatus *customStatusDTO `json:"customStatus,omitempty"`
+}
+
+// presenceDTO is how a user appears to others: offline while they have no
+// open connection or are invisible, and otherwise the status they picked.
+type presenceDTO struct {
+	UserID       int64            `json:"userId"`
+	Status       string           `json:"status"`
+	CustomStatus *customStatusDTO `json:"customStatus,omitempty"`
+}
+
+// scanPresence reads the presence, custom_status_text, custom_status_emoji
+// and custom_status_expires_at columns, dropping a custom status that has
+// already run out but not yet been cleared by runCustomStatusExpiry.
+func scanPresence(status, text, emoji string, expiresAt sql.NullTime) presenceSettings {
+	settings := presenceSettings{Status: status}
+	if text == "" && emoji == "" {
+		return settings
+	}
+	if expiresAt.Valid && !expiresAt.Time.After(time.Now()) {
+		return settings
+	}
+	custom := &customStatusDTO{Text: text, Emoji: emoji}
+	if expiresAt.Valid {
+		t := expiresAt.Time.UTC()
+		custom.ExpiresAt = &t
+	}
+	settings.CustomStatus = custom
+	return settings
+}
+
+func (s *serverState) presenceSettings(ctx context.Context, userID int64) (presenceSettings, error) {
+	var status, text, emoji string
+	var expiresAt sql.NullTime
+	err := s.stmts.QueryRowContext(ctx, `
+        SELECT presence, custom_status_text, custom_status_emoji, custom_status_expires_at FROM users WHERE id = ?
+    `, userID).Scan(&status, &text, &emoji, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return presenceSettings{Status: presenceOnline}, nil
+	}
+	if err != nil {
+		return presenceSettings{}, err
+	}
+	return scanPresence(status, text, emoji, expiresAt), nil
+}
+
+// visiblePresence applies the hub's view of who is connected to what the
+// user chose.
+func (s *serverState) visiblePresence(userID int64, email string, settings presenceSettings) presenceDTO {
+	if settings.Status == presenceInvisible || s.ws.connections(email) == 0 {
+		return presenceDTO{UserID: userID, Status: presenceOffline}
+	}
+	return presenceDTO{UserID: userID, Status: settings.Status, CustomStatus: settings.CustomStatus}
+}
+
+// presenceViewer is someone who can see a user's presence, unless hidden
+// (see presenceHidden), in which case they see them offline.
+type presenceViewer struct {
+	email  string
+	hidden bool
+}
+
+// presenceAudience lists the users who follow email's presence: members of
+// a server they are in, the other side of their DMs and their friends,
+// themselves included so their other devices follow along.
+func (s *serverState) presenceAudience(ctx context.Context, userID int64, email string) ([]presenceViewer, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT viewer.email, viewer.id != subject.id AND `+presenceHidden+`
+        FROM users viewer JOIN users subject ON subject.id = ?
+        WHERE viewer.id IN (
+            SELECT other.user_id FROM server_members mine
+            JOIN server_members other ON other.server_id = mine.server_id
+            WHERE mine.user_id = subject.id
+        ) OR viewer.email IN (
+            SELECT other.user_email FROM dm_participants mine
+            JOIN dm_participants other ON other.channel_id = mine.channel_id
+            WHERE mine.user_email = ?
+        ) OR viewer.id IN (
+            SELECT friend_id FROM friendships WHERE user_id = subject.id AND status = 'accepted'
+        ) OR viewer.id = subject.id
+    `, userID, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var viewers []presenceViewer
+	for rows.Next() {
+		var v presenceViewer
+		if err := rows.Scan(&v.email, &v.hidden); err != nil {
+			return nil, err
+		}
+		viewers = append(viewers, v)
+	}
+	return viewers, rows.Err()
+}
+
+// presenceSnapshot is the other side of presenceAudience: the presence of
+// everyone u follows, as u sees it, leaving out those who appear offline.
+func (s *serverState) presenceSnapshot(ctx context.Context, u user) ([]presenceDTO, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT subject.id, subject.email, subject.presence, subject.custom_status_text, subject.custom_status_emoji,
+               subject.custom_status_expires_at, subject.id != viewer.id AND `+presenceHidden+`
+        FROM users subject JOIN users viewer ON viewer.id = ?
+        WHERE subject.id IN (
+            SELECT other.user_id FROM server_members mine
+            JOIN server_members other ON other.server_id = mine.server_id
+            WHERE mine.user_id = viewer.id
+        ) OR subject.email IN (
+            SELECT other.user_email FROM dm_participants mine
+            JOIN dm_participants other ON other.channel_id = mine.channel_id
+            WHERE mine.user_email = viewer.email
+        ) OR subject.id IN (
+            SELECT user_id FROM friendships WHERE friend_id = viewer.id AND status = 'accepted'
+        ) OR subject.id = viewer.id
+        ORDER BY subject.id
+    `, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	snapshot := []presenceDTO{}
+	for rows.Next() {
+		var id int64
+		var email, status, text, emoji string
+		var expiresAt sql.NullTime
+		var hidden bool
+		if err := rows.Scan(&id, &email, &status, &text, &emoji, &expiresAt, &hidden); err != nil {
+			return nil, err
+		}
+		if hidden {
+			continue
+		}
+		if p := s.visiblePresence(id, email, scanPresence(status, text, emoji, expiresAt)); p.Status != presenceOffline {
+			snapshot = append(snapshot, p)
+		}
+	}
+	return snapshot, rows.Err()
+}
+
+// announcePresence sends presence:update for the user to everyone who
+// follows it. It runs when their status or who they share it with changes,
+// and when their first connection opens or their last one closes.
+func (s *serverState) announcePresence(ctx context.Context, userID int64, email string) {
+	settings, err := s.presenceSettings(ctx, userID)
+	if err != nil {
+		log.Printf("load presence: %v", err)
+		return
+	}
+	audience, err := s.presenceAudience(ctx, userID, email)
+	if err != nil {
+		log.Printf("load presence audience: %v", err)
+		return
+	}
+	presence := s.visiblePresence(userID, email, settings)
+	offline := presenceDTO{UserID: userID, Status: presenceOffline}
+	for _, v := range audience {
+		if v.hidden {
+			s.ws.sendToUser(v.email, wsOutbound{Type: "presence:update", Presence: &offline})
+		} else {
+			s.ws.sendToUser(v.email, wsOutbound{Type: "presence:update", Presence: &presence})
+		}
+	}
+}
+
+// suppressNotifications reports whether userID has asked not to be
+// disturbed, in which case notifications outside the app are skipped.
+func (s *serverState) suppressNotifications(ctx context.Context, userID int64) (bool, error) {
+	settings, err := s.presenceSettings(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return settings.Status == presenceDND, nil
+}
+
+// handleAccountStatus serves /api/account/status: GET returns the signed-in
+// user's status and custom status, PATCH changes them. An empty custom
+// status clears it.
+func (s *serverState) handleAccountStatus(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		defer r.Body.Close()
+		var body struct {
+			Status       *string          `json:"status" validate:"trim,lower,required,oneof=online|away|dnd|invisible"`
+			CustomStatus *customStatusDTO `json:"customStatus"`
+		}
+		if !s.decodeJSON(w, r, &body) {
+			return
+		}
+		if c := body.CustomStatus; c != nil && c.ExpiresAt != nil && !c.ExpiresAt.After(time.Now()) {
+			writeValidationErrors(w, []fieldError{{Field: "customStatus.expiresAt", Message: "must be in the future"}})
+			return
+		}
+		err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+			if body.Status != nil {
+				if _, err := tx.ExecContext(r.Context(), `UPDATE users SET presence = ? WHERE id = ?`, *body.Status, currentUser.ID); err != nil {
+					return err
+				}
+			}
+			if c := body.CustomStatus; c != nil {
+				var expiresAt any
+				if c.ExpiresAt != nil && (c.Text != "" || c.Emoji != "") {
+					expiresAt = c.ExpiresAt.UTC()
+				}
+				if _, err := tx.ExecContext(r.Context(), `
+                    UPDATE users SET custom_status_text = ?, custom_status_emoji = ?, custom_status_expires_at = ? WHERE id = ?
+                `, c.Text, c.Emoji, expiresAt, currentUser.ID); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("update status: %v", err)
+			httpError(w, "failed to update status", http.StatusInternalServerError)
+			return
+		}
+		if body.Status != nil || body.CustomStatus != nil {
+			s.announcePresence(r.Context(), currentUser.ID, currentUser.Email)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	settings, err := s.presenceSettings(r.Context(), currentUser.ID)
+	if err != nil {
+		log.Printf("load status: %v", err)
+		httpError(w, "failed to load status", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(settings); err != nil {
+		log.Printf("encode status: %v", err)
+	}
+}
+
+// runCustomStatusExpiry clears custom statuses as they run out and tells
+// everyone who could see them. Reads already hide expired ones, so a missed
+// tick only delays the event.
+func (s *serverState) runCustomStatusExpiry(ctx context.Context) {
+	ticker := time.NewTicker(customStatusExpiryEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.clearExpiredCustomStatuses(ctx); err != nil {
+			log.Printf("clear expired custom statuses: %v", err)
+		}
+	}
+}
+
+func (s *serverState) clearExpiredCustomStatuses(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, `
+        UPDATE users SET custom_status_text = '', custom_status_emoji = '', custom_status_expires_at = NULL
+        WHERE custom_status_expires_at IS NOT NULL AND custom_status_expires_at <= ?
+        RETURNING id, email
+    `, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	type expiredStatus struct {
+		id    int64
+		email string
+	}
+	var expired []expiredStatus
+	for rows.Next() {
+		var e expiredStatus
+		if err := rows.Scan(&e.id, &e.email); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, e := range expired {
+		s.announcePresence(ctx, e.id, e.email)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// emailFieldsAllowed are the JSON fields that may carry an email address,
+// because they only reach the account itself, instance admins or a
+// directory, or are only read from old archives.
+var emailFieldsAllowed = map[string]string{
+	"userDTO.Email":                        "the signed-in user's own record",
+	"emailChangeDTO.NewEmail":              "the user's own pending change",
+	"pendingUserDTO.Email":                 "instance admins approving signups",
+	"inviteDTO.CreatedBy":                  "instance admins managing invites",
+	"messageRevisionDTO.AuthorEmail":       "instance admins reading the message archive",
+	"quarantinedAttachmentDTO.AuthorEmail": "instance admins reviewing quarantined uploads",
+	"exportMember.Email":                   "read from version 1 archives only",
+	"exportMessage.AuthorEmail":            "read from version 1 archives only",
+	"scimUser.Emails":                      "the SCIM directory",
+	"scimUserInput.Emails":                 "the SCIM directory",
+}
+
+// TestDTOsNameUsersByID checks every JSON type in the package for fields
+// that could carry another user's email: fields named after an email, and
+// string fields naming who did something ("createdBy"), which should be an
+// id and handle pair instead.
+func TestDTOsNameUsersByID(t *testing.T) {
+	paths, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, path, nil, parser.SkipObjectResolution)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				ts := spec.(*ast.TypeSpec)
+				st, ok := ts.Type.(*ast.StructType)
+				if !ok || !hasJSONTags(st) {
+					continue
+				}
+				for _, field := range st.Fields.List {
+					for _, name := range field.Names {
+						if !name.IsExported() {
+							continue
+						}
+						jsonName := astJSONName(field, name.Name)
+						if jsonName == "-" {
+							continue
+						}
+						lower := strings.ToLower(jsonName)
+						isString := isIdent(field.Type, "string")
+						if !strings.Contains(lower, "email") && !(isString && strings.HasSuffix(lower, "by")) {
+							continue
+						}
+						key := ts.Name.Name + "." + name.Name
+						seen[key] = true
+						if _, ok := emailFieldsAllowed[key]; !ok {
+							t.Errorf("%s (%s): %q may carry an email; name users by id and handle", key, fset.Position(field.Pos()), jsonName)
+						}
+					}
+				}
+			}
+		}
+	}
+	for key := range emailFieldsAllowed {
+		if !seen[key] {
+			t.Errorf("%s is allowed to carry an email but no longer exists", key)
+		}
+	}
+}
+
+func hasJSONTags(st *ast.StructType) bool {
+	for _, field := range st.Fields.List {
+		if field.Tag != nil && strings.Contains(field.Tag.Value, `json:"`) {
+			return true
+		}
+	}
+	return false
+}
+
+// astJSONName is the name encoding/json gives a field declared in source.
+func astJSONName(field *ast.Field, name string) string {
+	sf := reflect.StructField{Name: name}
+	if field.Tag != nil {
+		if tag, err := strconv.Unquote(field.Tag.Value); err == nil {
+			sf.Tag = reflect.StructTag(tag)
+		}
+	}
+	return jsonFieldName(sf)
+}
+
+func isIdent(expr ast.Expr, name string) bool {
+	ident, ok := expr.(*ast.Ident)
+	return ok && ident.Name == name
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultProfanity is used when PROFANITY_WORDS_FILE is not set. Words match
+// whole and case-insensitively, so inflections are listed separately.
+var defaultProfanity = []string{
+	"arse", "arsehole", "ass", "asshole", "assholes", "bastard", "bastards",
+	"bitch", "bitches", "bollocks", "bullshit", "cock", "cocks", "crap",
+	"cunt", "cunts", "dick", "dickhead", "dicks", "fuck", "fucked", "fucker",
+	"fuckers", "fucking", "fucks", "motherfucker", "motherfuckers",
+	"motherfucking", "piss", "pissed", "prick", "pricks", "shit", "shits",
+	"shitty", "twat", "twats", "wanker", "wankers",
+}
+
+// wordMasker hides listed words in message text, keeping their first letter
+// and replacing the rest with asterisks. A nil masker leaves text alone.
+type wordMasker struct {
+	pattern *regexp.Regexp
+}
+
+func newWordMasker(words []string) *wordMasker {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(strings.ToLower(word)))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	// Longest first, so "fucking" wins over "fuck".
+	sort.Slice(quoted, func(i, j int) bool { return len(quoted[i]) > len(quoted[j]) })
+	return &wordMasker{pattern: regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)}
+}
+
+// profanityFromEnv loads the word list from PROFANITY_WORDS_FILE, one word per
+// line with # comments, falling back to defaultProfanity.
+func profanityFromEnv() *wordMasker {
+	path := os.Getenv("PROFANITY_WORDS_FILE")
+	if path == "" {
+		return newWordMasker(defaultProfanity)
+	}
+	words, err := readWordList(path)
+	if err != nil {
+		log.Printf("load PROFANITY_WORDS_FILE: %v; using the built-in list", err)
+		return newWordMasker(defaultProfanity)
+	}
+	return newWordMasker(words)
+}
+
+func readWordList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	return words, scanner.Err()
+}
+
+func (m *wordMasker) mask(text string) string {
+	if m == nil || text == "" {
+		return text
+	}
+	return m.pattern.ReplaceAllStringFunc(text, func(word string) string {
+		first, size := utf8.DecodeRuneInString(word)
+		return string(first) + strings.Repeat("*", utf8.RuneCountInString(word[size:]))
+	})
+}
+
+// messageDTOFor builds the copy of msg that viewer receives: stored content
+// is never changed, only what is delivered to users who asked for masking.
+func (s *serverState) messageDTOFor(viewer user, msg chatMessage) messageDTO {
+	return s.maskFor(viewer.MaskProfanity, toMessageDTO(msg))
+}
+
+func (s *serverState) maskFor(maskProfanity bool, dto messageDTO) messageDTO {
+	if maskProfanity {
+		dto.Content = s.profanity.mask(dto.Content)
+		if dto.Transcript != nil {
+			transcript := *dto.Transcript
+			transcript.Text = s.profanity.mask(transcript.Text)
+			dto.Transcript = &transcript
+		}
+	}
+	return dto
+}
+
+type preferencesDTO struct {
+	MaskProfanity       bool    `json:"maskProfanity"`
+	VoiceMode           string  `json:"voiceMode"`
+	PinnedConversations []int64 `json:"pinnedConversations"`
+	Locale              string  `json:"locale"`
+	Timezone            string  `json:"timezone"`
+	Theme               string  `json:"theme"`
+	CompactMode         bool    `json:"compactMode"`
+	FontSize            string  `json:"fontSize"`
+	// QuietHours is null when the user has none.
+	QuietHours    *quietHoursDTO `json:"quietHours"`
+	SharePresence string         `json:"sharePresence"`
+}
+
+func (s *serverState) preferencesFor(ctx context.Context, u user) (preferencesDTO, error) {
+	pinned, err := s.pinnedConversations(ctx, u.ID)
+	if err != nil {
+		return preferencesDTO{}, err
+	}
+	l := s.localizerFor(u)
+	var quiet *quietHoursDTO
+	if u.QuietHoursStart != "" {
+		quiet = &quietHoursDTO{Start: u.QuietHoursStart, End: u.QuietHoursEnd}
+	}
+	return preferencesDTO{
+		MaskProfanity:       u.MaskProfanity,
+		VoiceMode:           u.VoiceMode,
+		PinnedConversations: pinned,
+		Locale:              l.locale,
+		Timezone:            l.tz.String(),
+		Theme:               u.Theme,
+		CompactMode:         u.CompactMode,
+		FontSize:            u.FontSize,
+		QuietHours:          quiet,
+		SharePresence:       u.SharePresence,
+	}, nil
+}
+
+// announcePreferences sends settings:update to every connection of u, so
+// their other devices follow a change made on one.
+func (s *serverState) announcePreferences(ctx context.Context, u user) {
+	prefs, err := s.preferencesFor(ctx, u)
+	if err != nil {
+		log.Printf("load preferences: %v", err)
+		return
+	}
+	s.ws.sendToUser(u.Email, wsOutbound{Type: "settings:update", Preferences: &prefs})
+}
+
+// handleAccountPreferences serves /api/account/preferences (also mounted at
+// /api/me/preferences): GET returns the signed-in user's preferences and
+// PATCH changes the fields it is given.
+func (s *serverState) handleAccountPreferences(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		defer r.Body.Close()
+		var body struct {
+			MaskProfanity *bool   `json:"maskProfanity"`
+			VoiceMode     *string `json:"voiceMode" validate:"required,oneof=vad|ptt"`
+			// PinnedConversations replaces the pinned channels and DMs.
+			PinnedConversations *[]int64 `json:"pinnedConversations" validate:"max=50"`
+			// An empty locale or timezone goes back to the instance default.
+			Locale   *string `json:"locale" validate:"trim"`
+			Timezone *string `json:"timezone" validate:"trim"`
+			// Appearance, applied by clients.
+			Theme       *string `json:"theme" validate:"required,oneof=system|dark|light"`
+			CompactMode *bool   `json:"compactMode"`
+			FontSize    *string `json:"fontSize" validate:"required,oneof=small|normal|large"`
+			// QuietHours with an empty start and end turns them off.
+			QuietHours *quietHoursDTO `json:"quietHours"`
+			// SharePresence limits who sees the user's presence.
+			SharePresence *string `json:"sharePresence" validate:"trim,lower,required,oneof=everyone|friends"`
+		}
+		if !s.decodeJSON(w, r, &body) {
+			return
+		}
+		errs := checkLocaleAndTimezone(body.Locale, body.Timezone)
+		if body.QuietHours != nil {
+			errs = append(errs, checkQuietHours(*body.QuietHours)...)
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		var pinned []int64
+		if body.PinnedConversations != nil {
+			var errs []fieldError
+			var err error
+			pinned, errs, err = s.checkPinnedConversations(r.Context(), currentUser, *body.PinnedConversations)
+			if err != nil {
+				log.Printf("check pinned conversations: %v", err)
+				httpError(w, "failed to update preferences", http.StatusInternalServerError)
+				return
+			}
+			if len(errs) > 0 {
+				writeValidationErrors(w, errs)
+				return
+			}
+		}
+		// The fields change together or not at all; connections hear of
+		// them once they are saved.
+		before := currentUser
+		if body.MaskProfanity != nil {
+			currentUser.MaskProfanity = *body.MaskProfanity
+		}
+		if body.VoiceMode != nil {
+			currentUser.VoiceMode = *body.VoiceMode
+		}
+		if body.Locale != nil {
+			currentUser.Locale = *body.Locale
+		}
+		if body.Timezone != nil {
+			currentUser.Timezone = *body.Timezone
+		}
+		if body.Theme != nil {
+			currentUser.Theme = *body.Theme
+		}
+		if body.CompactMode != nil {
+			currentUser.CompactMode = *body.CompactMode
+		}
+		if body.FontSize != nil {
+			currentUser.FontSize = *body.FontSize
+		}
+		if q := body.QuietHours; q != nil {
+			currentUser.QuietHoursStart, currentUser.QuietHoursEnd = q.Start, q.End
+		}
+		if body.SharePresence != nil {
+			currentUser.SharePresence = *body.SharePresence
+		}
+		err := s.withTx(r.Context(), func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(r.Context(), `
+                UPDATE users SET mask_profanity = ?, voice_mode = ?, locale = ?, timezone = ?, theme = ?, compact_mode = ?, font_size = ?,
+                    quiet_hours_start = ?, quiet_hours_end = ?, share_presence = ?
+                WHERE id = ?
+            `, currentUser.MaskProfanity, currentUser.VoiceMode, currentUser.Locale, currentUser.Timezone, currentUser.Theme, currentUser.CompactMode, currentUser.FontSize,
+				currentUser.QuietHoursStart, currentUser.QuietHoursEnd, currentUser.SharePresence, currentUser.ID); err != nil {
+				return err
+			}
+			if body.PinnedConversations != nil {
+				return setPinnedConversations(r.Context(), tx, currentUser.ID, pinned)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("update preferences: %v", err)
+			httpError(w, "failed to update preferences", http.StatusInternalServerError)
+			return
+		}
+		if currentUser.MaskProfanity != before.MaskProfanity {
+			s.ws.forUser(currentUser.Email, func(c *wsClient) {
+				c.maskProfanity.Store(currentUser.MaskProfanity)
+			})
+		}
+		if currentUser.VoiceMode != before.VoiceMode {
+			s.applyVoiceMode(currentUser, currentUser.VoiceMode)
+		}
+		if currentUser.Locale != before.Locale || currentUser.Timezone != before.Timezone {
+			s.refreshConnections(currentUser)
+		}
+		if currentUser.SharePresence != before.SharePresence {
+			s.announcePresence(r.Context(), currentUser.ID, currentUser.Email)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	prefs, err := s.preferencesFor(r.Context(), currentUser)
+	if err != nil {
+		log.Printf("load preferences: %v", err)
+		httpError(w, "failed to load preferences", http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodPatch {
+		s.ws.sendToUser(currentUser.Email, wsOutbound{Type: "settings:update", Preferences: &prefs})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(prefs); err != nil {
+		log.Printf("encode preferences: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type profileDTO struct {
+	ID          int64  `json:"id"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"displayName"`
+}
+
+// currentUser returns the connection's account as last loaded. It starts as
+// the user who opened the socket and is replaced by refreshConnections and
+// by the periodic session check, so names picked up from it stay current.
+func (c *wsClient) currentUser() user {
+	return *c.profile.Load()
+}
+
+// setProfile swaps in a freshly loaded u. When the name shown to voice peers
+// changed, it returns the voice:peer-updated to send to the room.
+func (c *wsClient) setProfile(u user) (wsOutbound, bool) {
+	c.state.voice.mu.Lock()
+	defer c.state.voice.mu.Unlock()
+	old := c.profile.Swap(&u)
+	c.maskProfanity.Store(u.MaskProfanity)
+	if !c.voiceJoined || (old.DisplayName == u.DisplayName && old.Handle == u.Handle) {
+		return wsOutbound{}, false
+	}
+	peer := c.voiceParticipant()
+	return wsOutbound{Type: "voice:peer-updated", ChannelID: c.voiceChannelID, Peer: &peer}, true
+}
+
+// refreshConnections hands u's current row to their open connections.
+func (s *serverState) refreshConnections(u user) {
+	var updates []wsOutbound
+	s.ws.forUser(u.Email, func(c *wsClient) {
+		if update, ok := c.setProfile(u); ok {
+			updates = append(updates, update)
+		}
+	})
+	for _, update := range updates {
+		s.voiceBroadcast(update.ChannelID, update, nil)
+	}
+}
+
+// reloadProfile rereads the connection's user, catching changes made by
+// other processes or instances.
+func (c *wsClient) reloadProfile() {
+	u, exists, err := c.state.getUserByID(context.Background(), c.currentUser().ID)
+	if err != nil {
+		log.Printf("ws reload user: %v", err)
+		return
+	}
+	if !exists || u.Email != c.email {
+		return
+	}
+	if update, ok := c.setProfile(u); ok {
+		c.state.voiceBroadcast(update.ChannelID, update, nil)
+	}
+}
+
+// handleAccountProfile serves /api/account/profile: GET returns the current
+// user's display name and PATCH changes it. Open connections pick up the new
+// name right away.
+func (s *serverState) handleAccountProfile(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		defer r.Body.Close()
+		var body struct {
+			DisplayName *string `json:"displayName" validate:"trim,required,max=64"`
+		}
+		if !s.decodeJSON(w, r, &body) {
+			return
+		}
+		if body.DisplayName != nil {
+			name := *body.DisplayName
+			if name != currentUser.DisplayName {
+				if _, err := s.db.ExecContext(r.Context(), `UPDATE users SET display_name = ? WHERE id = ?`, name, currentUser.ID); err != nil {
+					log.Printf("update profile: %v", err)
+					httpError(w, "failed to update profile", http.StatusInternalServerError)
+					return
+				}
+				s.recordAudit(r.Context(), 0, currentUser.Email, "user.display_name", "user", strconv.FormatInt(currentUser.ID, 10), currentUser.DisplayName+" -> "+name)
+				currentUser.DisplayName = name
+				s.refreshConnections(currentUser)
+			}
+		}
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(profileDTO{ID: currentUser.ID, Handle: currentUser.Handle, DisplayName: currentUser.DisplayName}); err != nil {
+		log.Printf("encode profile: %v", err)
+	}
+}
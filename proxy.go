@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientInfoKey struct{}
+
+// clientInfo is the caller as seen past any trusted reverse proxies.
+type clientInfo struct {
+	ip     string
+	scheme string
+}
+
+// trustedProxies holds the networks (TRUSTED_PROXIES) whose X-Forwarded-*
+// headers are believed. Headers from any other peer are ignored.
+type trustedProxies []*net.IPNet
+
+func parseTrustedProxies(raw string) trustedProxies {
+	var nets trustedProxies
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("ignoring invalid trusted proxy %q", entry)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func (t trustedProxies) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range t {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// middleware resolves the client address, scheme and host. When the direct
+// peer is a trusted proxy, X-Forwarded-For is walked right to left past any
+// further trusted hops, and X-Forwarded-Proto and X-Forwarded-Host replace the
+// connection's own scheme and Host header.
+func (t trustedProxies) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(peer); err == nil {
+			peer = host
+		}
+		info := clientInfo{ip: peer, scheme: "http"}
+		if r.TLS != nil {
+			info.scheme = "https"
+		}
+
+		if t.contains(net.ParseIP(peer)) {
+			hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+			for i := len(hops) - 1; i >= 0; i-- {
+				hop := strings.TrimSpace(hops[i])
+				ip := net.ParseIP(hop)
+				if ip == nil {
+					break
+				}
+				info.ip = hop
+				if !t.contains(ip) {
+					break
+				}
+			}
+			if proto := firstForwardedValue(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+				info.scheme = proto
+			}
+			if host := firstForwardedValue(r.Header.Get("X-Forwarded-Host")); host != "" {
+				r.Host = host
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientInfoKey{}, info)))
+	})
+}
+
+func firstForwardedValue(header string) string {
+	value, _, _ := strings.Cut(header, ",")
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+func requestClientInfo(r *http.Request) clientInfo {
+	if info, ok := r.Context().Value(clientInfoKey{}).(clientInfo); ok {
+		return info
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	info := clientInfo{ip: host, scheme: "http"}
+	if r.TLS != nil {
+		info.scheme = "https"
+	}
+	return info
+}
+
+// clientIP returns the caller's address for logging and session records.
+func clientIP(r *http.Request) string {
+	return requestClientInfo(r).ip
+}
+
+// requestIsHTTPS reports whether the browser reached us over HTTPS, which
+// decides whether cookies are marked Secure.
+func requestIsHTTPS(r *http.Request) bool {
+	return requestClientInfo(r).scheme == "https"
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	notificationDigestEvery = time.Minute
+	maxDigestEntries        = 50
+)
+
+// quietHoursDTO is a daily window, as HH:MM in the user's timezone, during
+// which email notifications are held for a digest. End before start spans
+// midnight.
+type quietHoursDTO struct {
+	Start string `json:"start" validate:"trim"`
+	End   string `json:"end" validate:"trim"`
+}
+
+// parseClock reads "HH:MM" as minutes after midnight.
+func parseClock(value string) (int, bool) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
+
+// checkQuietHours accepts both times empty, which turns quiet hours off, or
+// two different valid times.
+func checkQuietHours(q quietHoursDTO) []fieldError {
+	if q.Start == "" && q.End == "" {
+		return nil
+	}
+	var errs []fieldError
+	if _, ok := parseClock(q.Start); !ok {
+		errs = append(errs, fieldError{Field: "quietHours.start", Message: "must be a time such as 22:00"})
+	}
+	if _, ok := parseClock(q.End); !ok {
+		errs = append(errs, fieldError{Field: "quietHours.end", Message: "must be a time such as 07:00"})
+	}
+	if len(errs) == 0 && q.Start == q.End {
+		errs = append(errs, fieldError{Field: "quietHours.end", Message: "must differ from start"})
+	}
+	return errs
+}
+
+// inQuietHours reports whether now falls in u's quiet hours, read in their
+// timezone (or DEFAULT_TIMEZONE).
+func (s *serverState) inQuietHours(u user, now time.Time) bool {
+	start, okStart := parseClock(u.QuietHoursStart)
+	end, okEnd := parseClock(u.QuietHoursEnd)
+	if !okStart || !okEnd || start == end {
+		return false
+	}
+	local := now.In(s.localizerFor(u).tz)
+	minute := local.Hour()*60 + local.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// holdNotification keeps a notification for the digest sent when u's quiet
+// hours end.
+func (s *serverState) holdNotification(ctx context.Context, u user, msg messageDTO, excerpt string) error {
+	_, err := s.db.ExecContext(ctx, `
+        INSERT INTO held_notifications (user_id, channel_id, author_name, author_handle, excerpt, created_at)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `, u.ID, msg.ChannelID, msg.AuthorDisplayName, msg.AuthorHandle, excerpt, msg.CreatedAt.UTC())
+	return err
+}
+
+// sendNotificationDigests mails each user what was held for them once their
+// quiet hours are over. It runs as the notify.digests job.
+func (s *serverState) sendNotificationDigests(ctx context.Context) error {
+	rows, err := s.readDB.QueryContext(ctx, `SELECT DISTINCT user_id FROM held_notifications`)
+	if err != nil {
+		return err
+	}
+	var userIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, id := range userIDs {
+		u, exists, err := s.getUserByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !exists || s.inQuietHours(u, now) {
+			continue
+		}
+		if err := s.sendNotificationDigest(ctx, u); err != nil {
+			log.Printf("send notification digest to %s: %v", u.Email, err)
+		}
+	}
+	return nil
+}
+
+type heldNotification struct {
+	id           int64
+	authorName   string
+	authorHandle string
+	excerpt      string
+	createdAt    time.Time
+}
+
+// sendNotificationDigest mails u one email listing what was held, oldest
+// first, and forgets it once sent. Users who switched to do not disturb in
+// the meantime get nothing, as they would have without quiet hours.
+func (s *serverState) sendNotificationDigest(ctx context.Context, u user) error {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT id, author_name, author_handle, excerpt, created_at FROM held_notifications
+        WHERE user_id = ? ORDER BY id
+    `, u.ID)
+	if err != nil {
+		return err
+	}
+	var held []heldNotification
+	for rows.Next() {
+		var n heldNotification
+		if err := rows.Scan(&n.id, &n.authorName, &n.authorHandle, &n.excerpt, &n.createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+		held = append(held, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(held) == 0 {
+		return nil
+	}
+	lastID := held[len(held)-1].id
+
+	quiet, err := s.suppressNotifications(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	instance := s.currentInstanceName(ctx, u.TenantID)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if !quiet {
+		l := s.localizerFor(u)
+		var body strings.Builder
+		body.WriteString(l.T("email.digest.intro"))
+		body.WriteString("\n\n")
+		for _, n := range held[:min(len(held), maxDigestEntries)] {
+			fmt.Fprintf(&body, "%s\n%s\n\n", l.T("email.digest.entry", l.formatTime(n.createdAt), n.authorName, n.authorHandle), n.excerpt)
+		}
+		if len(held) > maxDigestEntries {
+			body.WriteString(l.T("email.digest.more", len(held)-maxDigestEntries))
+			body.WriteString("\n\n")
+		}
+		body.WriteString(l.T("email.digest.outro"))
+		subject := l.T("email.digest.subject", instance, len(held))
+		// Queued in the same transaction that forgets the held
+		// notifications, so the digest is neither lost nor sent twice.
+		if _, err := s.jobs.enqueueAt(ctx, tx, "email", emailJob{To: u.Email, Subject: subject, Body: body.String()}, time.Now()); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM held_notifications WHERE user_id = ? AND id <= ?`, u.ID, lastID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.jobs.signal()
+	return nil
+}
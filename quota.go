@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Attachment quotas, in bytes, from ATTACHMENT_QUOTA_PER_USER and
+// ATTACHMENT_QUOTA_PER_SERVER; 0 means unlimited. Usage counts the full size
+// of every attachment on a user's messages, or on messages in a server's
+// channels, even when its content is stored only once. Direct messages count
+// toward their authors only.
+type attachmentQuotas struct {
+	perUser   int64
+	perServer int64
+}
+
+func attachmentQuotasFromEnv() attachmentQuotas {
+	return attachmentQuotas{
+		perUser:   int64(intFromEnv("ATTACHMENT_QUOTA_PER_USER", 0)),
+		perServer: int64(intFromEnv("ATTACHMENT_QUOTA_PER_SERVER", 0)),
+	}
+}
+
+// quotaError is returned when storing an attachment would take its author or
+// server over quota.
+type quotaError struct {
+	Scope      string `json:"scope"` // "user" or "server"
+	UsedBytes  int64  `json:"usedBytes"`
+	QuotaBytes int64  `json:"quotaBytes"`
+	NeedBytes  int64  `json:"neededBytes"`
+}
+
+func (e *quotaError) Error() string {
+	if e.Scope == "server" {
+		return "this server's attachment storage is full"
+	}
+	return "your attachment storage is full"
+}
+
+// friendly spells the numbers out for people, as in "1.2 MiB of 5.0 MiB
+// used".
+func (e *quotaError) friendly() string {
+	return fmt.Sprintf("%s (%s of %s used, %s more needed)", e.Error(), formatBytes(e.UsedBytes), formatBytes(e.QuotaBytes), formatBytes(e.NeedBytes))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+type storageUsageDTO struct {
+	Attachments int64 `json:"attachments"`
+	UsedBytes   int64 `json:"usedBytes"`
+	// QuotaBytes is nil when there is no limit.
+	QuotaBytes *int64 `json:"quotaBytes"`
+}
+
+func usageWithQuota(attachments, used, quota int64) storageUsageDTO {
+	usage := storageUsageDTO{Attachments: attachments, UsedBytes: used}
+	if quota > 0 {
+		usage.QuotaBytes = &quota
+	}
+	return usage
+}
+
+func (s *serverState) userAttachmentUsage(ctx context.Context, email string) (storageUsageDTO, error) {
+	var count, used int64
+	err := s.readDB.QueryRowContext(ctx, `
+        SELECT COUNT(a.id), COALESCE(SUM(a.size), 0)
+        FROM message_attachments a JOIN channel_messages m ON m.id = a.message_id
+        WHERE m.author_id = `+userIDForEmail, email).Scan(&count, &used)
+	return usageWithQuota(count, used, s.quotas.perUser), err
+}
+
+func (s *serverState) serverAttachmentUsage(ctx context.Context, serverID int64) (storageUsageDTO, error) {
+	var count, used int64
+	err := s.readDB.QueryRowContext(ctx, `
+        SELECT COUNT(a.id), COALESCE(SUM(a.size), 0)
+        FROM message_attachments a
+        JOIN channel_messages m ON m.id = a.message_id
+        JOIN channels c ON c.id = m.channel_id
+        WHERE c.server_id = ?
+    `, serverID).Scan(&count, &used)
+	quota := s.quotas.perServer
+	if serverID == s.directServerID {
+		quota = 0
+	}
+	return usageWithQuota(count, used, quota), err
+}
+
+// checkAttachmentQuota reports a *quotaError when size more bytes of
+// attachments from the user in the channel would exceed a quota. It runs
+// before the message is queued, so sends racing each other can overshoot
+// by a message.
+func (s *serverState) checkAttachmentQuota(ctx context.Context, authorEmail string, channelID int64, size int64) error {
+	if s.quotas.perUser > 0 {
+		usage, err := s.userAttachmentUsage(ctx, authorEmail)
+		if err != nil {
+			return err
+		}
+		if usage.UsedBytes+size > s.quotas.perUser {
+			return &quotaError{Scope: "user", UsedBytes: usage.UsedBytes, QuotaBytes: s.quotas.perUser, NeedBytes: size}
+		}
+	}
+	if s.quotas.perServer > 0 {
+		ch, found, err := s.channelByID(ctx, channelID)
+		if err != nil {
+			return err
+		}
+		if found && ch.ServerID != s.directServerID {
+			usage, err := s.serverAttachmentUsage(ctx, ch.ServerID)
+			if err != nil {
+				return err
+			}
+			if usage.UsedBytes+size > s.quotas.perServer {
+				return &quotaError{Scope: "server", UsedBytes: usage.UsedBytes, QuotaBytes: s.quotas.perServer, NeedBytes: size}
+			}
+		}
+	}
+	return nil
+}
+
+// writeQuotaError answers a send that ran into a quota with 413, spelling
+// the numbers out in the message and giving them exactly in details.
+func writeQuotaError(w http.ResponseWriter, qe *quotaError) {
+	writeAPIError(w, http.StatusRequestEntityTooLarge, apiError{Code: "quota_exceeded", Message: qe.friendly(), Details: qe})
+}
+
+func asQuotaError(err error) (*quotaError, bool) {
+	var qe *quotaError
+	ok := errors.As(err, &qe)
+	return qe, ok
+}
+
+func writeStorageUsage(w http.ResponseWriter, usage storageUsageDTO) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(usage); err != nil {
+		log.Printf("encode storage usage: %v", err)
+	}
+}
+
+// handleAccountStorage serves GET /api/account/storage: the caller's
+// attachment usage and quota.
+func (s *serverState) handleAccountStorage(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	usage, err := s.userAttachmentUsage(r.Context(), currentUser.Email)
+	if err != nil {
+		log.Printf("attachment usage of user %d: %v", currentUser.ID, err)
+		httpError(w, "failed to load storage usage", http.StatusInternalServerError)
+		return
+	}
+	writeStorageUsage(w, usage)
+}
+
+// handleServerStorage serves GET /api/servers/{id}/storage to the server's
+// members.
+func (s *serverState) handleServerStorage(w http.ResponseWriter, r *http.Request, serverID int64) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	usage, err := s.serverAttachmentUsage(r.Context(), serverID)
+	if err != nil {
+		log.Printf("attachment usage of server %d: %v", serverID, err)
+		httpError(w, "failed to load storage usage", http.StatusInternalServerError)
+		return
+	}
+	writeStorageUsage(w, usage)
+}
+
+type instanceStorageDTO struct {
+	Attachments     int64 `json:"attachments"`
+	AttachmentBytes int64 `json:"attachmentBytes"`
+	Blobs           int64 `json:"blobs"`
+	StoredBytes     int64 `json:"storedBytes"`
+	// SavedBytes is what deduplication saved: attachment bytes that did
+	// not need a copy of their own.
+	SavedBytes int64 `json:"savedBytes"`
+}
+
+// handleAdminStorage serves GET /api/admin/storage to operators.
+func (s *serverState) handleAdminStorage(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireOperator(w, r); !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var stats instanceStorageDTO
+	err := s.readDB.QueryRowContext(r.Context(), `
+        SELECT (SELECT COUNT(*) FROM message_attachments), (SELECT COALESCE(SUM(size), 0) FROM message_attachments),
+               (SELECT COUNT(*) FROM attachment_blobs), (SELECT COALESCE(SUM(size), 0) FROM attachment_blobs)
+    `).Scan(&stats.Attachments, &stats.AttachmentBytes, &stats.Blobs, &stats.StoredBytes)
+	if err != nil {
+		log.Printf("instance storage usage: %v", err)
+		httpError(w, "failed to load storage usage", http.StatusInternalServerError)
+		return
+	}
+	stats.SavedBytes = stats.AttachmentBytes - stats.StoredBytes
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Printf("encode instance storage: %v", err)
+	}
+}
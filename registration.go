@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Registration modes, chosen with REGISTRATION_MODE.
+const (
+	registrationOpen     = "open"
+	registrationInvite   = "invite"
+	registrationApproval = "approval"
+	registrationClosed   = "closed"
+
+	userStatusActive  = "active"
+	userStatusPending = "pending"
+	// userStatusDeactivated accounts were switched off by SCIM provisioning;
+	// they keep their messages but cannot sign in.
+	userStatusDeactivated = "deactivated"
+
+	defaultInviteLifetime = 7 * 24 * time.Hour
+)
+
+func registrationModeFromEnv() string {
+	mode := strings.ToLower(strings.TrimSpace(envOrDefault("REGISTRATION_MODE", registrationOpen)))
+	switch mode {
+	case registrationOpen, registrationInvite, registrationApproval, registrationClosed:
+		return mode
+	}
+	log.Printf("unknown REGISTRATION_MODE=%q, registration is closed", mode)
+	return registrationClosed
+}
+
+type inviteDTO struct {
+	ID        int64      `json:"id"`
+	Token     string     `json:"token,omitempty"`
+	SignupURL string     `json:"signupUrl,omitempty"`
+	CreatedBy string     `json:"createdBy"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	MaxUses   int        `json:"maxUses"`
+	Uses      int        `json:"uses"`
+}
+
+type pendingUserDTO struct {
+	Email       string    `json:"email"`
+	DisplayName string    `json:"displayName"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// signupPageData describes the registration policy to the signup template.
+func (s *serverState) signupPageData(r *http.Request) templateData {
+	return templateData{
+		"Closed":           s.registrationMode == registrationClosed,
+		"InviteRequired":   s.registrationMode == registrationInvite,
+		"ApprovalRequired": s.registrationMode == registrationApproval,
+		"InviteCode":       r.URL.Query().Get("invite"),
+		"Captcha":          s.captchaWidget(true),
+	}
+}
+
+// errInvalidInvite rolls back a signup whose invite token is unknown,
+// expired, revoked or used up.
+var errInvalidInvite = errors.New("invalid invite")
+
+// redeemInvite consumes one use of an invite token to the tenant as part of
+// the signup's transaction, so a failed signup gives it back.
+func redeemInvite(ctx context.Context, tx *sql.Tx, tenantID int64, token string) (int64, error) {
+	if token == "" {
+		return 0, errInvalidInvite
+	}
+	var id int64
+	err := tx.QueryRowContext(ctx, `
+        UPDATE registration_invites SET uses = uses + 1
+        WHERE token_hash = ? AND tenant_id = ? AND revoked_at IS NULL
+          AND (expires_at IS NULL OR expires_at > ?)
+          AND (max_uses = 0 OR uses < max_uses)
+        RETURNING id
+    `, hashSessionToken(token), tenantID, time.Now().UTC()).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errInvalidInvite
+	}
+	return id, err
+}
+
+// createPendingUser stores an account awaiting admin approval as part of
+// tx. Pending users join no servers until they are approved.
+func (s *serverState) createPendingUser(ctx context.Context, tx *sql.Tx, u user, claim bool) error {
+	if claim {
+		_, err := tx.ExecContext(ctx, `UPDATE users SET display_name = ?, password_hash = ?, handle = COALESCE(NULLIF(?, ''), handle), status = ? WHERE email = ? AND length(password_hash) = 0`,
+			u.DisplayName, u.PasswordHash, u.Handle, userStatusPending, u.Email)
+		return err
+	}
+	if u.Handle == "" {
+		handle, err := uniqueHandle(ctx, s.readDB, u.TenantID, handleFromEmail(u.Email))
+		if err != nil {
+			return err
+		}
+		u.Handle = handle
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO users (email, handle, display_name, password_hash, created_at, status, tenant_id) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		u.Email, u.Handle, u.DisplayName, u.PasswordHash, u.CreatedAt, userStatusPending, u.TenantID)
+	return err
+}
+
+// handleAdminInvites serves /api/admin/invites: GET lists live invites, POST
+// creates one and returns its token (shown only once), and DELETE /{id}
+// revokes one. Admins see and make invites to their own tenant only.
+func (s *serverState) handleAdminInvites(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.requireInstanceAdmin(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+
+	if path := strings.Trim(r.URL.Path, "/"); path != "" {
+		inviteID, err := strconv.ParseInt(path, 10, 64)
+		if err != nil {
+			httpError(w, "not found", http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "DELETE")
+			httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		res, err := s.db.ExecContext(ctx, `UPDATE registration_invites SET revoked_at = ? WHERE id = ? AND tenant_id = ? AND revoked_at IS NULL`, time.Now().UTC(), inviteID, currentUser.TenantID)
+		if err != nil {
+			log.Printf("revoke invite: %v", err)
+			httpError(w, "failed to revoke invite", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			httpError(w, "not found", http.StatusNotFound)
+			return
+		}
+		s.recordAudit(ctx, 0, currentUser.Email, "instance.invite_revoked", "invite", path, "")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := s.readDB.QueryContext(ctx, `
+            SELECT id, created_by, created_at, expires_at, max_uses, uses
+            FROM registration_invites
+            WHERE tenant_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?) AND (max_uses = 0 OR uses < max_uses)
+            ORDER BY id
+        `, currentUser.TenantID, time.Now().UTC())
+		if err != nil {
+			log.Printf("list invites: %v", err)
+			httpError(w, "failed to load invites", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		invites := []inviteDTO{}
+		for rows.Next() {
+			var inv inviteDTO
+			var expires sql.NullTime
+			if err := rows.Scan(&inv.ID, &inv.CreatedBy, &inv.CreatedAt, &expires, &inv.MaxUses, &inv.Uses); err != nil {
+				log.Printf("scan invite: %v", err)
+				httpError(w, "failed to load invites", http.StatusInternalServerError)
+				return
+			}
+			if expires.Valid {
+				inv.ExpiresAt = &expires.Time
+			}
+			invites = append(invites, inv)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(invites); err != nil {
+			log.Printf("encode invites: %v", err)
+		}
+	case http.MethodPost:
+		var body struct {
+			MaxUses        *int `json:"maxUses" validate:"min=0"`
+			ExpiresInHours *int `json:"expiresInHours" validate:"min=0"`
+		}
+		if r.ContentLength != 0 {
+			if !s.decodeJSON(w, r, &body) {
+				return
+			}
+		}
+		inv := inviteDTO{
+			Token:     generateSessionID(),
+			CreatedBy: currentUser.Email,
+			CreatedAt: time.Now().UTC(),
+			MaxUses:   1,
+		}
+		if body.MaxUses != nil {
+			inv.MaxUses = *body.MaxUses
+		}
+		lifetime := defaultInviteLifetime
+		if body.ExpiresInHours != nil {
+			lifetime = time.Duration(*body.ExpiresInHours) * time.Hour
+		}
+		var expires sql.NullTime
+		if lifetime > 0 {
+			t := inv.CreatedAt.Add(lifetime)
+			inv.ExpiresAt = &t
+			expires = sql.NullTime{Time: t, Valid: true}
+		}
+
+		res, err := s.db.ExecContext(ctx, `INSERT INTO registration_invites (token_hash, created_by, created_at, expires_at, max_uses, tenant_id) VALUES (?, ?, ?, ?, ?, ?)`,
+			hashSessionToken(inv.Token), inv.CreatedBy, inv.CreatedAt, expires, inv.MaxUses, currentUser.TenantID)
+		if err == nil {
+			inv.ID, err = res.LastInsertId()
+		}
+		if err != nil {
+			log.Printf("create invite: %v", err)
+			httpError(w, "failed to create invite", http.StatusInternalServerError)
+			return
+		}
+		inv.SignupURL = tenantScopeFrom(ctx).basePath + "/signup?invite=" + url.QueryEscape(inv.Token)
+		s.recordAudit(ctx, 0, currentUser.Email, "instance.invite_created", "invite", strconv.FormatInt(inv.ID, 10), "")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(inv); err != nil {
+			log.Printf("encode invite: %v", err)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminApprovals serves /api/admin/approvals: GET lists accounts
+// awaiting approval, and POST /{email}/approve or /{email}/reject decides one.
+// Rejected accounts are deleted so the address can register again. Admins
+// decide on their own tenant's accounts only.
+func (s *serverState) handleAdminApprovals(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.requireInstanceAdmin(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rows, err := s.readDB.QueryContext(ctx, `SELECT email, display_name, created_at FROM users WHERE status = ? AND tenant_id = ? ORDER BY created_at`, userStatusPending, currentUser.TenantID)
+		if err != nil {
+			log.Printf("list pending users: %v", err)
+			httpError(w, "failed to load approvals", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		pending := []pendingUserDTO{}
+		for rows.Next() {
+			var p pendingUserDTO
+			if err := rows.Scan(&p.Email, &p.DisplayName, &p.CreatedAt); err != nil {
+				log.Printf("scan pending user: %v", err)
+				httpError(w, "failed to load approvals", http.StatusInternalServerError)
+				return
+			}
+			pending = append(pending, p)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(pending); err != nil {
+			log.Printf("encode approvals: %v", err)
+		}
+		return
+	}
+
+	email, action, found := strings.Cut(path, "/")
+	if !found || (action != "approve" && action != "reject") {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email = strings.ToLower(email)
+
+	// An approved account joins its home server in the same transaction, so
+	// it is never active without a way in.
+	var pending bool
+	var change membershipChange
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var res sql.Result
+		var err error
+		if action == "approve" {
+			res, err = tx.ExecContext(ctx, `UPDATE users SET status = ? WHERE email = ? AND status = ? AND tenant_id = ?`, userStatusActive, email, userStatusPending, currentUser.TenantID)
+		} else {
+			res, err = tx.ExecContext(ctx, `DELETE FROM users WHERE email = ? AND status = ? AND tenant_id = ?`, email, userStatusPending, currentUser.TenantID)
+		}
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 || action != "approve" {
+			pending = n > 0
+			return nil
+		}
+		pending = true
+		change, err = s.joinHomeServer(ctx, tx, email, currentUser.TenantID)
+		return err
+	})
+	if err != nil {
+		log.Printf("%s user %s: %v", action, email, err)
+		httpError(w, "failed to update account", http.StatusInternalServerError)
+		return
+	}
+	if !pending {
+		httpError(w, "no pending account for that email", http.StatusNotFound)
+		return
+	}
+	s.membershipChanged(change)
+	s.recordAudit(ctx, 0, currentUser.Email, "user."+action+"d", "user", email, "")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	reminderPollInterval = 15 * time.Second
+	reminderMaxDelay     = 365 * 24 * time.Hour
+)
+
+var errInvalidReminder = errors.New("invalid reminder")
+
+type reminderInfo struct {
+	ID          int64
+	UserEmail   string
+	ChannelID   sql.NullInt64
+	MessageID   sql.NullInt64
+	Content     string
+	RemindAt    time.Time
+	CreatedAt   time.Time
+	DeliveredAt sql.NullTime
+}
+
+type reminderDTO struct {
+	ID          int64      `json:"id"`
+	ChannelID   int64      `json:"channelId,omitempty"`
+	MessageID   int64      `json:"messageId,omitempty"`
+	Content     string     `json:"content"`
+	RemindAt    time.Time  `json:"remindAt"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+}
+
+func toReminderDTO(rem reminderInfo) reminderDTO {
+	dto := reminderDTO{
+		ID:        rem.ID,
+		ChannelID: rem.ChannelID.Int64,
+		MessageID: rem.MessageID.Int64,
+		Content:   rem.Content,
+		RemindAt:  rem.RemindAt,
+		CreatedAt: rem.CreatedAt,
+	}
+	if rem.DeliveredAt.Valid {
+		t := rem.DeliveredAt.Time
+		dto.DeliveredAt = &t
+	}
+	return dto
+}
+
+// parseReminderDelay accepts Go durations ("90m", "1h30m") plus a day
+// suffix ("2d") so chat users can type the short forms they expect.
+func parseReminderDelay(raw string) (time.Duration, error) {
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	if raw == "" {
+		return 0, errInvalidReminder
+	}
+	var d time.Duration
+	if idx := strings.Index(raw, "d"); idx > 0 {
+		days, err := strconv.Atoi(raw[:idx])
+		if err != nil {
+			return 0, errInvalidReminder
+		}
+		d = time.Duration(days) * 24 * time.Hour
+		raw = raw[idx+1:]
+	}
+	if raw != "" {
+		rest, err := time.ParseDuration(raw)
+		if err != nil {
+			return 0, errInvalidReminder
+		}
+		d += rest
+	}
+	if d <= 0 || d > reminderMaxDelay {
+		return 0, errInvalidReminder
+	}
+	return d, nil
+}
+
+// parseRemindCommand splits "/remind <when> <text>" into its parts.
+func parseRemindCommand(content string) (time.Duration, string, error) {
+	fields := strings.Fields(strings.TrimPrefix(content, "/remind"))
+	if len(fields) < 2 {
+		return 0, "", errInvalidReminder
+	}
+	delay, err := parseReminderDelay(fields[0])
+	if err != nil {
+		return 0, "", err
+	}
+	return delay, strings.Join(fields[1:], " "), nil
+}
+
+func isRemindCommand(content string) bool {
+	return content == "/remind" || strings.HasPrefix(content, "/remind ")
+}
+
+func (s *serverState) createReminder(ctx context.Context, email string, channelID, messageID int64, content string, remindAt time.Time) (reminderInfo, error) {
+	rem := reminderInfo{
+		UserEmail: email,
+		ChannelID: sql.NullInt64{Int64: channelID, Valid: channelID != 0},
+		MessageID: sql.NullInt64{Int64: messageID, Valid: messageID != 0},
+		Content:   content,
+		RemindAt:  remindAt.UTC(),
+		CreatedAt: time.Now().UTC(),
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO reminders (user_email, channel_id, message_id, content, remind_at, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		rem.UserEmail, rem.ChannelID, rem.MessageID, rem.Content, rem.RemindAt, rem.CreatedAt)
+	if err != nil {
+		return reminderInfo{}, err
+	}
+	if rem.ID, err = res.LastInsertId(); err != nil {
+		return reminderInfo{}, err
+	}
+	return rem, nil
+}
+
+const reminderColumns = `id, user_email, channel_id, message_id, content, remind_at, created_at, delivered_at`
+
+func scanReminder(row interface{ Scan(...any) error }) (reminderInfo, error) {
+	var rem reminderInfo
+	err := row.Scan(&rem.ID, &rem.UserEmail, &rem.ChannelID, &rem.MessageID, &rem.Content, &rem.RemindAt, &rem.CreatedAt, &rem.DeliveredAt)
+	return rem, err
+}
+
+func (s *serverState) remindersForUser(ctx context.Context, email string) ([]reminderInfo, error) {
+	rows, err := s.readDB.QueryContext(ctx, `SELECT `+reminderColumns+` FROM reminders WHERE user_email = ? AND delivered_at IS NULL ORDER BY remind_at`, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []reminderInfo
+	for rows.Next() {
+		rem, err := scanReminder(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rem)
+	}
+	return result, rows.Err()
+}
+
+func (s *serverState) deleteReminder(ctx context.Context, email string, id int64) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM reminders WHERE id = ? AND user_email = ?`, id, email)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *serverState) dueReminders(ctx context.Context, now time.Time) ([]reminderInfo, error) {
+	rows, err := s.readDB.QueryContext(ctx, `SELECT `+reminderColumns+` FROM reminders WHERE delivered_at IS NULL AND remind_at <= ? ORDER BY remind_at LIMIT 100`, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []reminderInfo
+	for rows.Next() {
+		rem, err := scanReminder(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rem)
+	}
+	return result, rows.Err()
+}
+
+// remindFromCommand handles a "/remind" chat command typed into a channel.
+func (s *serverState) remindFromCommand(ctx context.Context, u user, channelID int64, content string) (reminderInfo, error) {
+	delay, text, err := parseRemindCommand(content)
+	if err != nil {
+		return reminderInfo{}, err
+	}
+	rem, err := s.createReminder(ctx, u.Email, channelID, 0, text, time.Now().Add(delay))
+	if err != nil {
+		return reminderInfo{}, err
+	}
+	if _, err := s.saveMessageDraft(ctx, u.ID, channelID, ""); err != nil {
+		log.Printf("clear draft after /remind: %v", err)
+	}
+	l := s.localizerFor(u)
+	if err := s.sendEphemeral(ctx, channelID, u, l.T("reminder.confirmed", strings.Fields(content)[1], l.formatTime(rem.RemindAt), text)); err != nil {
+		log.Printf("send reminder confirmation: %v", err)
+	}
+	return rem, nil
+}
+
+func (s *serverState) runReminderWorker(ctx context.Context) {
+	ticker := time.NewTicker(reminderPollInterval)
+	defer ticker.Stop()
+
+	for {
+		s.deliverDueReminders(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *serverState) deliverDueReminders(ctx context.Context) {
+	due, err := s.dueReminders(ctx, time.Now())
+	if err != nil {
+		log.Printf("load due reminders: %v", err)
+		return
+	}
+	for _, rem := range due {
+		if err := s.deliverReminder(ctx, rem); err != nil {
+			log.Printf("deliver reminder %d: %v", rem.ID, err)
+		}
+	}
+}
+
+func (s *serverState) deliverReminder(ctx context.Context, rem reminderInfo) error {
+	ch, err := s.directChannel(ctx, systemUserEmail, rem.UserEmail)
+	if err != nil {
+		return err
+	}
+
+	l := s.defaultLocalizer()
+	if u, exists, err := s.getUserByEmail(ctx, rem.UserEmail); err != nil {
+		return err
+	} else if exists {
+		l = s.localizerFor(u)
+	}
+	content := l.T("reminder.delivered", rem.Content)
+	if rem.MessageID.Valid && rem.ChannelID.Valid {
+		content += l.T("reminder.source", rem.MessageID.Int64, rem.ChannelID.Int64)
+	}
+	if utf8.RuneCountInString(content) > 2000 {
+		content = string([]rune(content)[:2000])
+	}
+
+	msg, err := s.saveMessage(ctx, ch.ID, systemUserEmail, content)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if _, err := s.db.ExecContext(ctx, `UPDATE reminders SET delivered_at = ? WHERE id = ?`, now, rem.ID); err != nil {
+		return err
+	}
+	rem.DeliveredAt = sql.NullTime{Time: now, Valid: true}
+
+	dto := toMessageDTO(msg)
+
+	remDTO := toReminderDTO(rem)
+	s.ws.sendToUser(rem.UserEmail, wsOutbound{Type: "reminder", ChannelID: ch.ID, Message: &dto, Reminder: &remDTO})
+	return nil
+}
+
+func (s *serverState) handleReminders(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id := strings.Trim(r.URL.Path, "/")
+	if id != "" {
+		reminderID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			httpError(w, "invalid reminder id", http.StatusBadRequest)
+			return
+		}
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "DELETE")
+			httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		removed, err := s.deleteReminder(r.Context(), currentUser.Email, reminderID)
+		if err != nil {
+			log.Printf("delete reminder: %v", err)
+			httpError(w, "failed to delete reminder", http.StatusInternalServerError)
+			return
+		}
+		if !removed {
+			httpError(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		reminders, err := s.remindersForUser(r.Context(), currentUser.Email)
+		if err != nil {
+			log.Printf("list reminders: %v", err)
+			httpError(w, "failed to list reminders", http.StatusInternalServerError)
+			return
+		}
+		payload := make([]reminderDTO, 0, len(reminders))
+		for _, rem := range reminders {
+			payload = append(payload, toReminderDTO(rem))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(payload); err != nil {
+			log.Printf("encode reminders: %v", err)
+		}
+	case http.MethodPost:
+		var body struct {
+			Content   string    `json:"content" validate:"trim"`
+			MessageID int64     `json:"messageId"`
+			In        string    `json:"in"`
+			RemindAt  time.Time `json:"remindAt"`
+		}
+		if !s.decodeJSON(w, r, &body) {
+			return
+		}
+
+		var remindAt time.Time
+		switch {
+		case body.In != "":
+			delay, err := parseReminderDelay(body.In)
+			if err != nil {
+				httpError(w, "in must be a duration like 30m, 2h or 1d", http.StatusBadRequest)
+				return
+			}
+			remindAt = time.Now().Add(delay)
+		case !body.RemindAt.IsZero():
+			remindAt = body.RemindAt
+			if !remindAt.After(time.Now()) || time.Until(remindAt) > reminderMaxDelay {
+				httpError(w, "remindAt must be in the future", http.StatusBadRequest)
+				return
+			}
+		default:
+			httpError(w, "in or remindAt is required", http.StatusBadRequest)
+			return
+		}
+
+		var channelID int64
+		if body.MessageID != 0 {
+			ctx := r.Context()
+			var msgChannelID int64
+			var msgContent string
+			err := s.readDB.QueryRowContext(ctx, `SELECT channel_id, content FROM channel_messages WHERE id = ? AND (expires_at IS NULL OR expires_at > ?)`, body.MessageID, time.Now().UTC()).Scan(&msgChannelID, &msgContent)
+			if errors.Is(err, sql.ErrNoRows) {
+				httpError(w, "message not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Printf("load reminder message: %v", err)
+				httpError(w, "failed to create reminder", http.StatusInternalServerError)
+				return
+			}
+			ch, exists, err := s.channelByID(ctx, msgChannelID)
+			if err != nil {
+				log.Printf("load reminder channel: %v", err)
+				httpError(w, "failed to create reminder", http.StatusInternalServerError)
+				return
+			}
+			hasAccess := false
+			if exists {
+				if hasAccess, err = s.userHasChannelAccess(ctx, currentUser.Email, ch); err != nil {
+					log.Printf("check reminder access: %v", err)
+					httpError(w, "failed to create reminder", http.StatusInternalServerError)
+					return
+				}
+			}
+			if !hasAccess {
+				httpError(w, "message not found", http.StatusNotFound)
+				return
+			}
+			channelID = msgChannelID
+			if body.Content == "" {
+				body.Content = msgContent
+			}
+		}
+
+		if body.Content == "" {
+			httpError(w, "content or messageId is required", http.StatusBadRequest)
+			return
+		}
+		if utf8.RuneCountInString(body.Content) > 2000 {
+			httpError(w, "content too long", http.StatusBadRequest)
+			return
+		}
+
+		rem, err := s.createReminder(r.Context(), currentUser.Email, channelID, body.MessageID, body.Content, remindAt)
+		if err != nil {
+			log.Printf("create reminder: %v", err)
+			httpError(w, "failed to create reminder", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(toReminderDTO(rem)); err != nil {
+			log.Printf("encode reminder: %v", err)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportDTO names the people involved by ID and handle. The reports table
+// still keys them by email, which is never sent to the moderators reading
+// the queue.
+type reportDTO struct {
+	ID               int64      `json:"id"`
+	ServerID         int64      `json:"serverId,omitempty"`
+	ReporterID       int64      `json:"reporterId"`
+	ReporterHandle   string     `json:"reporterHandle"`
+	MessageID        int64      `json:"messageId,omitempty"`
+	MessageContent   string     `json:"messageContent,omitempty"`
+	TargetID         int64      `json:"targetId"`
+	TargetHandle     string     `json:"targetHandle"`
+	Reason           string     `json:"reason"`
+	Status           string     `json:"status"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	ResolvedByID     int64      `json:"resolvedById,omitempty"`
+	ResolvedByHandle string     `json:"resolvedByHandle,omitempty"`
+	ResolvedAt       *time.Time `json:"resolvedAt,omitempty"`
+	ResolutionNote   string     `json:"resolutionNote,omitempty"`
+}
+
+const reportSelect = `
+        SELECT r.id, r.server_id, reporter.id, reporter.handle, r.message_id, r.message_content,
+               target.id, target.handle, r.reason, r.status, r.created_at,
+               resolver.id, resolver.handle, r.resolved_at, r.resolution_note
+        FROM reports r
+        LEFT JOIN users reporter ON reporter.email = r.reporter_email
+        LEFT JOIN users target ON target.email = r.target_email
+        LEFT JOIN users resolver ON resolver.email = r.resolved_by
+`
+
+func scanReport(row interface{ Scan(...any) error }) (reportDTO, error) {
+	var rep reportDTO
+	var serverID, messageID, reporterID, targetID, resolverID sql.NullInt64
+	var reporterHandle, targetHandle, resolverHandle sql.NullString
+	var resolvedAt sql.NullTime
+	err := row.Scan(&rep.ID, &serverID, &reporterID, &reporterHandle, &messageID, &rep.MessageContent,
+		&targetID, &targetHandle, &rep.Reason, &rep.Status, &rep.CreatedAt,
+		&resolverID, &resolverHandle, &resolvedAt, &rep.ResolutionNote)
+	rep.ServerID = serverID.Int64
+	rep.MessageID = messageID.Int64
+	rep.ReporterID, rep.ReporterHandle = reporterID.Int64, reporterHandle.String
+	rep.TargetID, rep.TargetHandle = targetID.Int64, targetHandle.String
+	rep.ResolvedByID, rep.ResolvedByHandle = resolverID.Int64, resolverHandle.String
+	if resolvedAt.Valid {
+		t := resolvedAt.Time
+		rep.ResolvedAt = &t
+	}
+	return rep, err
+}
+
+func (s *serverState) reportsForServer(ctx context.Context, serverID int64, status string) ([]reportDTO, error) {
+	rows, err := s.readDB.QueryContext(ctx, reportSelect+`WHERE r.server_id = ? AND r.status = ? ORDER BY r.id`, serverID, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []reportDTO
+	for rows.Next() {
+		rep, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rep)
+	}
+	return result, rows.Err()
+}
+
+func (s *serverState) handleReports(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	if path != "" {
+		parts := strings.Split(path, "/")
+		reportID, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || len(parts) != 2 {
+			httpError(w, "not found", http.StatusNotFound)
+			return
+		}
+		switch parts[1] {
+		case "resolve":
+			s.handleReportDecision(w, r, currentUser, reportID, "resolved")
+		case "dismiss":
+			s.handleReportDecision(w, r, currentUser, reportID, "dismissed")
+		default:
+			httpError(w, "not found", http.StatusNotFound)
+		}
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		MessageID int64  `json:"messageId"`
+		Handle    string `json:"handle"`
+		UserEmail string `json:"userEmail"`
+		ServerID  int64  `json:"serverId"`
+		Reason    string `json:"reason" validate:"trim,required,max=1000"`
+	}
+	if !s.decodeJSON(w, r, &body) {
+		return
+	}
+
+	ctx := r.Context()
+	rep := reportDTO{
+		ReporterID:     currentUser.ID,
+		ReporterHandle: currentUser.Handle,
+		Reason:         body.Reason,
+		Status:         "open",
+		CreatedAt:      time.Now().UTC(),
+	}
+	var targetEmail string
+
+	switch {
+	case body.MessageID != 0:
+		msg, err := s.messageByID(ctx, body.MessageID)
+		if errors.Is(err, sql.ErrNoRows) {
+			httpError(w, "message not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("load reported message: %v", err)
+			httpError(w, "failed to file report", http.StatusInternalServerError)
+			return
+		}
+		ch, exists, err := s.channelByID(ctx, msg.ChannelID)
+		if err != nil {
+			log.Printf("load reported channel: %v", err)
+			httpError(w, "failed to file report", http.StatusInternalServerError)
+			return
+		}
+		hasAccess := false
+		if exists {
+			if hasAccess, err = s.userHasChannelAccess(ctx, currentUser.Email, ch); err != nil {
+				log.Printf("check report access: %v", err)
+				httpError(w, "failed to file report", http.StatusInternalServerError)
+				return
+			}
+		}
+		if !hasAccess {
+			httpError(w, "message not found", http.StatusNotFound)
+			return
+		}
+		if ch.Kind != "dm" {
+			rep.ServerID = ch.ServerID
+		}
+		rep.MessageID = msg.ID
+		rep.MessageContent = msg.Content
+		rep.TargetID = msg.AuthorID
+		rep.TargetHandle = msg.AuthorHandle
+		targetEmail = msg.AuthorEmail
+	case body.Handle != "" || body.UserEmail != "":
+		if body.ServerID == 0 {
+			httpError(w, "serverId is required when reporting a user", http.StatusBadRequest)
+			return
+		}
+		var target user
+		var exists bool
+		var err error
+		if body.Handle != "" {
+			target, exists, err = s.getUserByHandle(ctx, currentUser.TenantID, body.Handle)
+		} else {
+			target, exists, err = s.getTenantUserByEmail(ctx, currentUser.TenantID, strings.TrimSpace(strings.ToLower(body.UserEmail)))
+		}
+		if err != nil {
+			log.Printf("lookup reported user: %v", err)
+			httpError(w, "failed to file report", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			httpError(w, "user not found", http.StatusNotFound)
+			return
+		}
+		reporterIn, err := s.userHasServerAccess(ctx, currentUser.Email, body.ServerID)
+		if err != nil {
+			log.Printf("check report access: %v", err)
+			httpError(w, "failed to file report", http.StatusInternalServerError)
+			return
+		}
+		targetIn, err := s.userHasServerAccess(ctx, target.Email, body.ServerID)
+		if err != nil {
+			log.Printf("check report target: %v", err)
+			httpError(w, "failed to file report", http.StatusInternalServerError)
+			return
+		}
+		if !reporterIn || !targetIn {
+			httpError(w, "user not found", http.StatusNotFound)
+			return
+		}
+		rep.ServerID = body.ServerID
+		rep.TargetID = target.ID
+		rep.TargetHandle = target.Handle
+		targetEmail = target.Email
+	default:
+		httpError(w, "messageId, handle or userEmail is required", http.StatusBadRequest)
+		return
+	}
+
+	if rep.TargetID == currentUser.ID {
+		httpError(w, "you cannot report yourself", http.StatusBadRequest)
+		return
+	}
+
+	res, err := s.db.ExecContext(ctx, `INSERT INTO reports (server_id, reporter_email, message_id, message_content, target_email, reason, status, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		sql.NullInt64{Int64: rep.ServerID, Valid: rep.ServerID != 0}, currentUser.Email, sql.NullInt64{Int64: rep.MessageID, Valid: rep.MessageID != 0},
+		rep.MessageContent, targetEmail, rep.Reason, rep.Status, rep.CreatedAt)
+	if err != nil {
+		log.Printf("create report: %v", err)
+		httpError(w, "failed to file report", http.StatusInternalServerError)
+		return
+	}
+	if rep.ID, err = res.LastInsertId(); err != nil {
+		log.Printf("create report id: %v", err)
+		httpError(w, "failed to file report", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(rep); err != nil {
+		log.Printf("encode report: %v", err)
+	}
+}
+
+func (s *serverState) handleReportDecision(w http.ResponseWriter, r *http.Request, currentUser user, reportID int64, status string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Note string `json:"note" validate:"trim"`
+	}
+	if r.ContentLength != 0 {
+		if !s.decodeJSON(w, r, &body) {
+			return
+		}
+	}
+
+	ctx := r.Context()
+	rep, err := scanReport(s.readDB.QueryRowContext(ctx, reportSelect+`WHERE r.id = ?`, reportID))
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("load report: %v", err)
+		httpError(w, "failed to update report", http.StatusInternalServerError)
+		return
+	}
+
+	canManage := false
+	if rep.ServerID != 0 {
+		if canManage, err = s.canManageServer(ctx, currentUser.Email, rep.ServerID); err != nil {
+			log.Printf("check report permission: %v", err)
+			httpError(w, "failed to update report", http.StatusInternalServerError)
+			return
+		}
+	}
+	if !canManage {
+		httpError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if rep.Status != "open" {
+		httpError(w, "report already closed", http.StatusConflict)
+		return
+	}
+
+	now := time.Now().UTC()
+	rep.Status = status
+	rep.ResolvedByID = currentUser.ID
+	rep.ResolvedByHandle = currentUser.Handle
+	rep.ResolvedAt = &now
+	rep.ResolutionNote = body.Note
+	if _, err := s.db.ExecContext(ctx, `UPDATE reports SET status = ?, resolved_by = ?, resolved_at = ?, resolution_note = ? WHERE id = ?`,
+		rep.Status, currentUser.Email, now, rep.ResolutionNote, rep.ID); err != nil {
+		log.Printf("update report: %v", err)
+		httpError(w, "failed to update report", http.StatusInternalServerError)
+		return
+	}
+	s.recordAudit(ctx, rep.ServerID, currentUser.Email, "report."+status, "report", strconv.FormatInt(rep.ID, 10),
+		fmt.Sprintf("target=%d note=%q", rep.TargetID, rep.ResolutionNote))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rep); err != nil {
+		log.Printf("encode report: %v", err)
+	}
+}
+
+func (s *serverState) handleServerReports(w http.ResponseWriter, r *http.Request, serverID int64, currentUser user) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	canManage, err := s.canManageServer(r.Context(), currentUser.Email, serverID)
+	if err != nil {
+		log.Printf("check report queue permission: %v", err)
+		httpError(w, "failed to load reports", http.StatusInternalServerError)
+		return
+	}
+	if !canManage {
+		httpError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "open"
+	}
+	if status != "open" && status != "resolved" && status != "dismissed" {
+		httpError(w, "status must be open, resolved or dismissed", http.StatusBadRequest)
+		return
+	}
+
+	reports, err := s.reportsForServer(r.Context(), serverID, status)
+	if err != nil {
+		log.Printf("list reports: %v", err)
+		httpError(w, "failed to load reports", http.StatusInternalServerError)
+		return
+	}
+	if reports == nil {
+		reports = []reportDTO{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reports); err != nil {
+		log.Printf("encode reports: %v", err)
+	}
+}
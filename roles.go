@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// roleDTO is a server's settings for one of the built-in roles. Position
+// ranks them from the top: owner, admin, member.
+type roleDTO struct {
+	Role     string `json:"role"`
+	Position int    `json:"position"`
+	Color    string `json:"color,omitempty"`
+	Hoist    bool   `json:"hoist"`
+}
+
+var roleColorPattern = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+// memberRolesJoin adds r, the settings of each member's role, to a query
+// over server_members sm.
+const memberRolesJoin = `LEFT JOIN server_roles r ON r.server_id = sm.server_id AND r.role = sm.role`
+
+// memberGroup sorts members of hoisted roles first, grouped by role from
+// the top, and everyone else after them.
+const memberGroup = `CASE WHEN COALESCE(r.hoist, 0) THEN CASE sm.role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 ELSE 2 END ELSE 3 END`
+
+func (s *serverState) serverRoles(ctx context.Context, serverID int64) ([]roleDTO, error) {
+	roles := make([]roleDTO, len(knownRoles))
+	byName := make(map[string]*roleDTO, len(knownRoles))
+	for i, name := range knownRoles {
+		roles[i] = roleDTO{Role: name, Position: i}
+		byName[name] = &roles[i]
+	}
+	rows, err := s.readDB.QueryContext(ctx, `SELECT role, color, hoist FROM server_roles WHERE server_id = ?`, serverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, color string
+		var hoist bool
+		if err := rows.Scan(&name, &color, &hoist); err != nil {
+			return nil, err
+		}
+		if role, ok := byName[name]; ok {
+			role.Color, role.Hoist = color, hoist
+		}
+	}
+	return roles, rows.Err()
+}
+
+// handleServerRoles serves /api/servers/{id}/roles. Members can list the
+// roles; owners and admins change their color and hoist with
+// PATCH /roles/{role}.
+func (s *serverState) handleServerRoles(w http.ResponseWriter, r *http.Request, serverID int64, currentUser user, rest []string) {
+	ctx := r.Context()
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+		roles, err := s.serverRoles(ctx, serverID)
+		if err != nil {
+			log.Printf("list roles: %v", err)
+			httpError(w, "failed to list roles", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(roles); err != nil {
+			log.Printf("encode roles: %v", err)
+		}
+		return
+	case len(rest) == 0:
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	case len(rest) == 1 && r.Method == http.MethodPatch:
+	case len(rest) == 1:
+		w.Header().Set("Allow", "PATCH")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	canManage, err := s.canManageServer(ctx, currentUser.Email, serverID)
+	if err != nil {
+		log.Printf("check role permission: %v", err)
+		httpError(w, "failed to update role", http.StatusInternalServerError)
+		return
+	}
+	if !canManage {
+		httpError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	roles, err := s.serverRoles(ctx, serverID)
+	if err != nil {
+		log.Printf("load roles: %v", err)
+		httpError(w, "failed to update role", http.StatusInternalServerError)
+		return
+	}
+	var role *roleDTO
+	for i := range roles {
+		if roles[i].Role == rest[0] {
+			role = &roles[i]
+		}
+	}
+	if role == nil {
+		httpError(w, "role not found", http.StatusNotFound)
+		return
+	}
+
+	var body struct {
+		Color *string `json:"color" validate:"trim,lower"`
+		Hoist *bool   `json:"hoist"`
+	}
+	if !s.decodeJSON(w, r, &body) {
+		return
+	}
+	if body.Color != nil {
+		if *body.Color != "" && !roleColorPattern.MatchString(*body.Color) {
+			writeValidationErrors(w, []fieldError{{Field: "color", Message: "must be a hex color such as #5865f2"}})
+			return
+		}
+		role.Color = *body.Color
+	}
+	if body.Hoist != nil {
+		role.Hoist = *body.Hoist
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+        INSERT INTO server_roles (server_id, role, color, hoist) VALUES (?, ?, ?, ?)
+        ON CONFLICT (server_id, role) DO UPDATE SET color = excluded.color, hoist = excluded.hoist
+    `, serverID, role.Role, role.Color, role.Hoist)
+	if err != nil {
+		log.Printf("update role: %v", err)
+		httpError(w, "failed to update role", http.StatusInternalServerError)
+		return
+	}
+	s.recordAudit(ctx, serverID, currentUser.Email, "role.update", "role", role.Role, "color="+role.Color+" hoist="+strconv.FormatBool(role.Hoist))
+	s.broadcastToServer(ctx, serverID, wsOutbound{Type: "roles:update", ServerID: serverID, Roles: roles})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(role); err != nil {
+		log.Printf("encode role: %v", err)
+	}
+}
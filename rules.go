@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var errRulesNotAccepted = errors.New("accept the server rules before posting")
+
+type rulesDTO struct {
+	Rules string `json:"rules"`
+	// MustAccept is set while the caller cannot post until they accept.
+	MustAccept bool       `json:"mustAccept"`
+	AcceptedAt *time.Time `json:"acceptedAt,omitempty"`
+}
+
+// rulesPending reports whether email has to accept the rules of ch's server
+// before posting there. Only members are asked; owners and admins, and
+// everyone in a server without rules, never are.
+func (s *serverState) rulesPending(ctx context.Context, email string, ch channelInfo) (bool, error) {
+	if ch.Kind == "dm" {
+		return false, nil
+	}
+	var pending bool
+	err := s.stmts.QueryRowContext(ctx, `
+        SELECT srv.rules != '' AND sm.rules_accepted_at IS NULL AND sm.role = 'member'
+        FROM server_members sm JOIN servers srv ON srv.id = sm.server_id
+        WHERE sm.server_id = ? AND sm.user_id = `+userIDForEmail, ch.ServerID, email).Scan(&pending)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return pending, err
+}
+
+func (s *serverState) rulesFor(ctx context.Context, serverID int64, currentUser user) (rulesDTO, error) {
+	var dto rulesDTO
+	var role string
+	var acceptedAt sql.NullTime
+	err := s.readDB.QueryRowContext(ctx, `
+        SELECT srv.rules, sm.role, sm.rules_accepted_at
+        FROM server_members sm JOIN servers srv ON srv.id = sm.server_id
+        WHERE sm.server_id = ? AND sm.user_id = ?
+    `, serverID, currentUser.ID).Scan(&dto.Rules, &role, &acceptedAt)
+	if err != nil {
+		return rulesDTO{}, err
+	}
+	if acceptedAt.Valid {
+		dto.AcceptedAt = &acceptedAt.Time
+	}
+	dto.MustAccept = dto.Rules != "" && !acceptedAt.Valid && role == "member"
+	return dto, nil
+}
+
+// handleServerRules serves /api/servers/{id}/rules. Members read the rules
+// with GET and accept them with POST /rules/accept; owners and admins change
+// them with PUT.
+func (s *serverState) handleServerRules(w http.ResponseWriter, r *http.Request, serverID int64, currentUser user, rest []string) {
+	ctx := r.Context()
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+	case len(rest) == 0 && r.Method == http.MethodPut:
+		s.updateServerRules(w, r, serverID, currentUser)
+		return
+	case len(rest) == 0:
+		w.Header().Set("Allow", "GET, PUT")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	case len(rest) == 1 && rest[0] == "accept" && r.Method == http.MethodPost:
+		_, err := s.db.ExecContext(ctx, `
+            UPDATE server_members SET rules_accepted_at = ?
+            WHERE server_id = ? AND user_id = ? AND rules_accepted_at IS NULL
+        `, time.Now().UTC(), serverID, currentUser.ID)
+		if err != nil {
+			log.Printf("accept server rules: %v", err)
+			httpError(w, "failed to accept rules", http.StatusInternalServerError)
+			return
+		}
+	case len(rest) == 1 && rest[0] == "accept":
+		w.Header().Set("Allow", "POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	rules, err := s.rulesFor(ctx, serverID, currentUser)
+	if err != nil {
+		log.Printf("load server rules: %v", err)
+		httpError(w, "failed to load rules", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rules); err != nil {
+		log.Printf("encode server rules: %v", err)
+	}
+}
+
+// updateServerRules replaces a server's rules; an empty text removes them.
+// Members already in the server when rules are first added count as having
+// accepted them, so only people who join afterwards are asked.
+func (s *serverState) updateServerRules(w http.ResponseWriter, r *http.Request, serverID int64, currentUser user) {
+	ctx := r.Context()
+	canManage, err := s.canManageServer(ctx, currentUser.Email, serverID)
+	if err != nil {
+		log.Printf("check server manage permission: %v", err)
+		httpError(w, "failed to update rules", http.StatusInternalServerError)
+		return
+	}
+	if !canManage {
+		httpError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var body struct {
+		Rules *string `json:"rules" validate:"trim,max=4000"`
+	}
+	if !s.decodeJSON(w, r, &body) {
+		return
+	}
+	if body.Rules == nil {
+		writeValidationErrors(w, []fieldError{{Field: "rules", Message: "is required"}})
+		return
+	}
+
+	srv, exists, err := s.serverByID(ctx, serverID)
+	if err == nil && exists {
+		err = s.writeServerRules(ctx, srv, *body.Rules)
+	}
+	if err != nil {
+		log.Printf("update server rules: %v", err)
+		httpError(w, "failed to update rules", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	srv.Rules = *body.Rules
+
+	s.recordAudit(ctx, serverID, currentUser.Email, "server.rules", "server", strconv.FormatInt(serverID, 10), "")
+	payload := toServerPayload(srv, nil)
+	s.broadcastToServer(ctx, serverID, wsOutbound{Type: "server:update", Server: &payload})
+
+	rules, err := s.rulesFor(ctx, serverID, currentUser)
+	if err != nil {
+		log.Printf("load server rules: %v", err)
+		httpError(w, "failed to load rules", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rules); err != nil {
+		log.Printf("encode server rules: %v", err)
+	}
+}
+
+func (s *serverState) writeServerRules(ctx context.Context, srv serverInfo, rules string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `UPDATE servers SET rules = ? WHERE id = ?`, rules, srv.ID); err != nil {
+		return err
+	}
+	if srv.Rules == "" && rules != "" {
+		if _, err := tx.ExecContext(ctx, `UPDATE server_members SET rules_accepted_at = ? WHERE server_id = ? AND rules_accepted_at IS NULL`, time.Now().UTC(), srv.ID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
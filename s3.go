@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultS3Region     = "us-east-1"
+	defaultS3PresignTTL = 15 * time.Minute
+	maxS3PresignTTL     = 7 * 24 * time.Hour
+
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	s3AmzDateFormat = "20060102T150405Z"
+	s3UnsignedBody  = "UNSIGNED-PAYLOAD"
+)
+
+// s3Store keeps blobs in an S3-compatible bucket (AWS S3, MinIO, Ceph, R2
+// and the like), addressed path-style as {endpoint}/{bucket}/{prefix}{key}
+// so that any endpoint works without wildcard DNS. Requests are signed with
+// AWS Signature Version 4.
+type s3Store struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// s3StoreFromEnv configures the store from S3_ENDPOINT, S3_BUCKET,
+// S3_REGION, S3_PREFIX, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY.
+func s3StoreFromEnv() (*s3Store, error) {
+	rawEndpoint := strings.TrimRight(strings.TrimSpace(os.Getenv("S3_ENDPOINT")), "/")
+	if rawEndpoint == "" {
+		rawEndpoint = "https://s3." + envOrDefault("S3_REGION", defaultS3Region) + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(rawEndpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT=%q is not a URL like https://s3.example.com", rawEndpoint)
+	}
+	accessKey, secretKey := os.Getenv("S3_ACCESS_KEY_ID"), os.Getenv("S3_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY must be set")
+	}
+	prefix := strings.Trim(os.Getenv("S3_PREFIX"), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Store{
+		endpoint:  endpoint,
+		bucket:    os.Getenv("S3_BUCKET"),
+		prefix:    prefix,
+		region:    envOrDefault("S3_REGION", defaultS3Region),
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+func (s *s3Store) location() string { return "s3" }
+
+func (s *s3Store) objectURL(hash string) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + s.bucket + "/" + s.prefix + blobKey(hash)
+	u.RawPath = ""
+	return &u
+}
+
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3 %d", e.Status)
+	}
+	return fmt.Sprintf("s3 %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (s *s3Store) do(ctx context.Context, method, hash string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(hash).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	apiErr := &s3Error{Status: resp.StatusCode}
+	if data, err := io.ReadAll(io.LimitReader(resp.Body, 4096)); err == nil {
+		_ = xml.Unmarshal(data, apiErr)
+	}
+	return nil, apiErr
+}
+
+func (s *s3Store) put(ctx context.Context, hash string, data []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, hash, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) get(ctx context.Context, hash string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, hash, nil)
+	var apiErr *s3Error
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *s3Store) remove(ctx context.Context, hash string) error {
+	resp, err := s.do(ctx, http.MethodDelete, hash, nil)
+	var apiErr *s3Error
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// presignGet returns a link that downloads the object for expires, with the
+// attachment's filename and content type in the response headers.
+func (s *s3Store) presignGet(hash, filename, contentType string, expires time.Duration) (string, error) {
+	if expires <= 0 || expires > maxS3PresignTTL {
+		return "", fmt.Errorf("presign expiry %s is outside (0, %s]", expires, maxS3PresignTTL)
+	}
+	now := time.Now().UTC()
+	u := s.objectURL(hash)
+	query := url.Values{
+		"X-Amz-Algorithm":              {s3Algorithm},
+		"X-Amz-Credential":             {s.accessKey + "/" + s.scope(now)},
+		"X-Amz-Date":                   {now.Format(s3AmzDateFormat)},
+		"X-Amz-Expires":                {strconv.Itoa(int(expires / time.Second))},
+		"X-Amz-SignedHeaders":          {"host"},
+		"response-content-type":        {contentType},
+		"response-content-disposition": {`inline; filename="` + filename + `"`},
+	}
+	signature := s.signature(http.MethodGet, u, query, http.Header{}, []string{"host"}, s3UnsignedBody, now)
+	query.Set("X-Amz-Signature", signature)
+	u.RawQuery = canonicalQuery(query)
+	return u.String(), nil
+}
+
+func (s *s3Store) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+// sign adds an Authorization header covering the host and x-amz-* headers.
+func (s *s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	req.Header.Set("X-Amz-Date", now.Format(s3AmzDateFormat))
+	signed := []string{"host"}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			signed = append(signed, lower)
+		}
+	}
+	sort.Strings(signed)
+	signature := s.signature(req.Method, req.URL, req.URL.Query(), req.Header, signed, payloadHash, now)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.accessKey, s.scope(now), strings.Join(signed, ";"), signature))
+}
+
+// signature computes a Signature Version 4 signature over the request.
+func (s *s3Store) signature(method string, u *url.URL, query url.Values, header http.Header, signed []string, payloadHash string, now time.Time) string {
+	var headers strings.Builder
+	for _, name := range signed {
+		value := u.Host
+		if name != "host" {
+			value = strings.Join(header.Values(name), ",")
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	canonicalRequest := strings.Join([]string{
+		method,
+		s3EscapePath(u.Path),
+		canonicalQuery(query),
+		headers.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		now.Format(s3AmzDateFormat),
+		s.scope(now),
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery sorts and encodes query parameters the way SigV4 expects,
+// which differs from url.Values.Encode in how spaces are written.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3EscapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return s3Escape(path, false)
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and "/"
+// unless encodeSlash is set.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
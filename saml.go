@@ -0,0 +1,688 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	samlProtocolNS  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNS = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlMetadataNS  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	samlStatusOK    = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearer      = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	samlPostBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlRedirect    = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+
+	samlACSPath = "/saml/acs"
+	samlActor   = "saml"
+	// samlRequestTTL is how long the IdP has to send the user back.
+	samlRequestTTL = 10 * time.Minute
+	// samlClockSkew allows for clocks that drift between this server and
+	// the IdP when checking an assertion's validity window.
+	samlClockSkew    = 3 * time.Minute
+	maxSAMLResponse  = 1 << 20
+	maxSAMLNameRunes = 64
+)
+
+var errSAMLNoAccount = errors.New("no account for this identity")
+
+// Attributes the email address and display name are read from when
+// SAML_EMAIL_ATTRIBUTE and SAML_NAME_ATTRIBUTE are not set: the usual
+// names in Okta, Azure AD, Google and ADFS.
+var (
+	samlEmailAttributes = []string{"email", "mail", "emailAddress", "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress", "urn:oid:0.9.2342.19200300.100.1.3"}
+	samlNameAttributes  = []string{"displayName", "name", "http://schemas.microsoft.com/identity/claims/displayname", "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/name", "urn:oid:2.16.840.1.113730.3.1.241"}
+)
+
+// samlProvider is the instance's SAML service provider and the one IdP it
+// trusts.
+type samlProvider struct {
+	entityID    string
+	acsURL      string
+	idpEntityID string
+	idpSSOURL   string
+	idpCerts    []*x509.Certificate
+	emailAttr   string
+	nameAttr    string
+	rolesAttr   string
+	// roleMap maps values of the roles attribute to roles on the home
+	// server.
+	roleMap map[string]string
+	jit     bool
+}
+
+// samlFromEnv configures single sign-on from SAML_IDP_METADATA, a path or
+// URL of the IdP's metadata, and SAML_IDP_ENTITY_ID, SAML_IDP_SSO_URL and
+// SAML_IDP_CERT, which take precedence over it. It returns nil when
+// neither is set.
+func samlFromEnv() (*samlProvider, error) {
+	metadata := strings.TrimSpace(os.Getenv("SAML_IDP_METADATA"))
+	if metadata == "" && os.Getenv("SAML_IDP_SSO_URL") == "" {
+		return nil, nil
+	}
+	base := strings.TrimRight(strings.TrimSpace(os.Getenv("SAML_BASE_URL")), "/")
+	if u, err := url.Parse(base); err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("SAML_BASE_URL=%q is not a URL like https://chat.example.com", base)
+	}
+	p := &samlProvider{
+		entityID:  envOrDefault("SAML_SP_ENTITY_ID", base+"/saml/metadata"),
+		acsURL:    base + samlACSPath,
+		emailAttr: strings.TrimSpace(os.Getenv("SAML_EMAIL_ATTRIBUTE")),
+		nameAttr:  strings.TrimSpace(os.Getenv("SAML_NAME_ATTRIBUTE")),
+		rolesAttr: strings.TrimSpace(os.Getenv("SAML_ROLES_ATTRIBUTE")),
+		jit:       boolFromEnv("SAML_JIT", true),
+	}
+	if metadata != "" {
+		if err := p.loadIdPMetadata(metadata); err != nil {
+			return nil, fmt.Errorf("SAML_IDP_METADATA: %w", err)
+		}
+	}
+	if v := os.Getenv("SAML_IDP_ENTITY_ID"); v != "" {
+		p.idpEntityID = v
+	}
+	if v := os.Getenv("SAML_IDP_SSO_URL"); v != "" {
+		p.idpSSOURL = v
+	}
+	if path := os.Getenv("SAML_IDP_CERT"); path != "" {
+		certs, err := readPEMCertificates(path)
+		if err != nil {
+			return nil, fmt.Errorf("SAML_IDP_CERT: %w", err)
+		}
+		p.idpCerts = certs
+	}
+	switch {
+	case p.idpEntityID == "":
+		return nil, errors.New("SAML_IDP_ENTITY_ID is required without IdP metadata")
+	case len(p.idpCerts) == 0:
+		return nil, errors.New("SAML_IDP_CERT is required without IdP metadata")
+	}
+	if u, err := url.Parse(p.idpSSOURL); err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("SAML_IDP_SSO_URL=%q is not a URL", p.idpSSOURL)
+	}
+	roleMap, err := parseSAMLRoleMap(os.Getenv("SAML_ROLE_MAP"))
+	if err != nil {
+		return nil, err
+	}
+	if len(roleMap) > 0 && p.rolesAttr == "" {
+		return nil, errors.New("SAML_ROLE_MAP needs SAML_ROLES_ATTRIBUTE")
+	}
+	p.roleMap = roleMap
+	return p, nil
+}
+
+// parseSAMLRoleMap reads "value=role" pairs separated by semicolons, since
+// group names such as LDAP DNs contain commas and equals signs; the last
+// equals sign separates the role.
+func parseSAMLRoleMap(raw string) (map[string]string, error) {
+	roles := make(map[string]string)
+	for _, entry := range strings.Split(raw, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("SAML_ROLE_MAP entry %q is not value=role", entry)
+		}
+		value, role := strings.TrimSpace(entry[:i]), strings.ToLower(strings.TrimSpace(entry[i+1:]))
+		if role != "admin" && role != "member" {
+			return nil, fmt.Errorf("SAML_ROLE_MAP entry %q: role must be admin or member", entry)
+		}
+		roles[value] = role
+	}
+	return roles, nil
+}
+
+func (p *samlProvider) loadIdPMetadata(source string) error {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://") {
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Get(source)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("fetch %s: %s", source, resp.Status)
+		}
+		data, err = io.ReadAll(io.LimitReader(resp.Body, maxSAMLResponse))
+		if err != nil {
+			return err
+		}
+	} else if data, err = os.ReadFile(source); err != nil {
+		return err
+	}
+	root, err := parseXMLTree(data)
+	if err != nil {
+		return err
+	}
+	entity := root
+	if root.is(samlMetadataNS, "EntitiesDescriptor") {
+		entity = nil
+		for _, e := range root.childrenNamed(samlMetadataNS, "EntityDescriptor") {
+			if e.child(samlMetadataNS, "IDPSSODescriptor") != nil {
+				entity = e
+				break
+			}
+		}
+	}
+	if entity == nil || !entity.is(samlMetadataNS, "EntityDescriptor") {
+		return errors.New("no IdP EntityDescriptor")
+	}
+	idp := entity.child(samlMetadataNS, "IDPSSODescriptor")
+	if idp == nil {
+		return errors.New("no IDPSSODescriptor")
+	}
+	p.idpEntityID = entity.attr("entityID")
+	for _, sso := range idp.childrenNamed(samlMetadataNS, "SingleSignOnService") {
+		if sso.attr("Binding") == samlRedirect {
+			p.idpSSOURL = sso.attr("Location")
+		}
+	}
+	for _, kd := range idp.childrenNamed(samlMetadataNS, "KeyDescriptor") {
+		if use := kd.attr("use"); use != "" && use != "signing" {
+			continue
+		}
+		keyInfo := kd.child(xmldsigNS, "KeyInfo")
+		if keyInfo == nil {
+			continue
+		}
+		for _, data := range keyInfo.childrenNamed(xmldsigNS, "X509Data") {
+			for _, c := range data.childrenNamed(xmldsigNS, "X509Certificate") {
+				der, err := decodeXMLBase64(c.text())
+				if err != nil {
+					return fmt.Errorf("signing certificate: %w", err)
+				}
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return fmt.Errorf("signing certificate: %w", err)
+				}
+				p.idpCerts = append(p.idpCerts, cert)
+			}
+		}
+	}
+	return nil
+}
+
+func readPEMCertificates(path string) ([]*x509.Certificate, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// handleSAMLMetadata serves GET /saml/metadata, the service provider's
+// metadata to register with the IdP.
+func (s *serverState) handleSAMLMetadata(w http.ResponseWriter, r *http.Request) {
+	if s.saml == nil || requestTenantID(r) != rootTenantID {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<md:EntityDescriptor xmlns:md="%s" entityID="%s">
+  <md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true" protocolSupportEnumeration="%s">
+    <md:NameIDFormat>urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress</md:NameIDFormat>
+    <md:AssertionConsumerService Binding="%s" Location="%s" index="0" isDefault="true"/>
+  </md:SPSSODescriptor>
+</md:EntityDescriptor>
+`, samlMetadataNS, xmlEscape(s.saml.entityID), samlProtocolNS, samlPostBinding, xmlEscape(s.saml.acsURL))
+}
+
+// handleSAMLLogin serves GET /saml/login: it sends the browser to the IdP
+// with an AuthnRequest, whose ID the response has to answer.
+func (s *serverState) handleSAMLLogin(w http.ResponseWriter, r *http.Request) {
+	if s.saml == nil || requestTenantID(r) != rootTenantID {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	raw := make([]byte, 20)
+	rand.Read(raw)
+	// IDs are xs:ID values, which cannot start with a digit.
+	id := "_" + hex.EncodeToString(raw)
+	now := time.Now().UTC()
+	if _, err := s.db.ExecContext(r.Context(), `INSERT INTO saml_requests (id, created_at, expires_at) VALUES (?, ?, ?)`, id, now, now.Add(samlRequestTTL)); err != nil {
+		log.Printf("store saml request: %v", err)
+		httpError(w, "failed to start sign-in", http.StatusInternalServerError)
+		return
+	}
+
+	request := fmt.Sprintf(`<samlp:AuthnRequest xmlns:samlp="%s" xmlns:saml="%s" ID="%s" Version="2.0" IssueInstant="%s" Destination="%s" AssertionConsumerServiceURL="%s" ProtocolBinding="%s"><saml:Issuer>%s</saml:Issuer><samlp:NameIDPolicy AllowCreate="true"/></samlp:AuthnRequest>`,
+		samlProtocolNS, samlAssertionNS, id, now.Format(time.RFC3339), xmlEscape(s.saml.idpSSOURL), xmlEscape(s.saml.acsURL), samlPostBinding, xmlEscape(s.saml.entityID))
+	var deflated bytes.Buffer
+	fw, _ := flate.NewWriter(&deflated, flate.BestCompression)
+	fw.Write([]byte(request))
+	fw.Close()
+
+	target, err := url.Parse(s.saml.idpSSOURL)
+	if err != nil {
+		log.Printf("parse saml sso url: %v", err)
+		httpError(w, "failed to start sign-in", http.StatusInternalServerError)
+		return
+	}
+	q := target.Query()
+	q.Set("SAMLRequest", base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	target.RawQuery = q.Encode()
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, target.String(), http.StatusSeeOther)
+}
+
+// samlAssertion is what a validated response says about the user.
+type samlAssertion struct {
+	inResponseTo string
+	nameID       string
+	attributes   map[string][]string
+}
+
+func (a samlAssertion) first(names ...string) string {
+	for _, name := range names {
+		for _, v := range a.attributes[name] {
+			if v = strings.TrimSpace(v); v != "" {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+// parseResponse validates a SAML Response posted to the ACS: its status,
+// issuer, destination, signature, subject confirmation, validity window and
+// audience. Either the Response or its one Assertion must be signed by the
+// IdP; encrypted assertions are not supported.
+func (p *samlProvider) parseResponse(data []byte, now time.Time) (samlAssertion, error) {
+	root, err := parseXMLTree(data)
+	if err != nil {
+		return samlAssertion{}, err
+	}
+	if !root.is(samlProtocolNS, "Response") {
+		return samlAssertion{}, errors.New("not a SAML Response")
+	}
+	if dest := root.attr("Destination"); dest != "" && dest != p.acsURL {
+		return samlAssertion{}, fmt.Errorf("response is for %s", dest)
+	}
+	if status := root.child(samlProtocolNS, "Status"); status == nil {
+		return samlAssertion{}, errors.New("response has no status")
+	} else if code := status.child(samlProtocolNS, "StatusCode"); code == nil || code.attr("Value") != samlStatusOK {
+		value := ""
+		if code != nil {
+			value = code.attr("Value")
+		}
+		return samlAssertion{}, fmt.Errorf("IdP returned status %q", value)
+	}
+	if issuer := root.child(samlAssertionNS, "Issuer"); issuer != nil && issuer.text() != p.idpEntityID {
+		return samlAssertion{}, fmt.Errorf("response issued by %s", issuer.text())
+	}
+	inResponseTo := root.attr("InResponseTo")
+	if inResponseTo == "" {
+		return samlAssertion{}, errors.New("unsolicited response")
+	}
+	if root.child(samlAssertionNS, "EncryptedAssertion") != nil {
+		return samlAssertion{}, errors.New("encrypted assertions are not supported")
+	}
+	assertions := root.childrenNamed(samlAssertionNS, "Assertion")
+	if len(assertions) != 1 {
+		return samlAssertion{}, fmt.Errorf("response has %d assertions", len(assertions))
+	}
+	assertion := assertions[0]
+
+	signed := false
+	for _, el := range []*xmlElement{root, assertion} {
+		err := verifyEnvelopedSignature(root, el, p.idpCerts)
+		if err == nil {
+			signed = true
+		} else if !errors.Is(err, errXMLUnsigned) {
+			return samlAssertion{}, err
+		}
+	}
+	if !signed {
+		return samlAssertion{}, errors.New("neither the response nor the assertion is signed")
+	}
+
+	if issuer := assertion.child(samlAssertionNS, "Issuer"); issuer == nil || issuer.text() != p.idpEntityID {
+		return samlAssertion{}, errors.New("assertion not issued by the IdP")
+	}
+	subject := assertion.child(samlAssertionNS, "Subject")
+	if subject == nil {
+		return samlAssertion{}, errors.New("assertion has no subject")
+	}
+	nameID := subject.child(samlAssertionNS, "NameID")
+	if nameID == nil || nameID.text() == "" {
+		return samlAssertion{}, errors.New("assertion has no NameID")
+	}
+	confirmed := false
+	for _, sc := range subject.childrenNamed(samlAssertionNS, "SubjectConfirmation") {
+		data := sc.child(samlAssertionNS, "SubjectConfirmationData")
+		if sc.attr("Method") != samlBearer || data == nil {
+			continue
+		}
+		if data.attr("Recipient") != p.acsURL || data.attr("InResponseTo") != inResponseTo {
+			continue
+		}
+		if !samlTimeValid(data.attr("NotBefore"), data.attr("NotOnOrAfter"), now, true) {
+			continue
+		}
+		confirmed = true
+	}
+	if !confirmed {
+		return samlAssertion{}, errors.New("no valid bearer subject confirmation")
+	}
+	conditions := assertion.child(samlAssertionNS, "Conditions")
+	if conditions == nil {
+		return samlAssertion{}, errors.New("assertion has no conditions")
+	}
+	if !samlTimeValid(conditions.attr("NotBefore"), conditions.attr("NotOnOrAfter"), now, false) {
+		return samlAssertion{}, errors.New("assertion is expired or not yet valid")
+	}
+	restrictions := conditions.childrenNamed(samlAssertionNS, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return samlAssertion{}, errors.New("assertion has no audience restriction")
+	}
+	for _, restriction := range restrictions {
+		ok := false
+		for _, audience := range restriction.childrenNamed(samlAssertionNS, "Audience") {
+			ok = ok || audience.text() == p.entityID
+		}
+		if !ok {
+			return samlAssertion{}, errors.New("assertion is meant for another audience")
+		}
+	}
+	if assertion.child(samlAssertionNS, "AuthnStatement") == nil {
+		return samlAssertion{}, errors.New("assertion has no authentication statement")
+	}
+
+	result := samlAssertion{inResponseTo: inResponseTo, nameID: nameID.text(), attributes: make(map[string][]string)}
+	for _, statement := range assertion.childrenNamed(samlAssertionNS, "AttributeStatement") {
+		for _, attr := range statement.childrenNamed(samlAssertionNS, "Attribute") {
+			var values []string
+			for _, v := range attr.childrenNamed(samlAssertionNS, "AttributeValue") {
+				values = append(values, v.text())
+			}
+			for _, name := range []string{attr.attr("Name"), attr.attr("FriendlyName")} {
+				if name != "" {
+					result.attributes[name] = append(result.attributes[name], values...)
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// samlTimeValid checks now against a NotBefore/NotOnOrAfter window, allowing
+// for clock skew. required demands NotOnOrAfter.
+func samlTimeValid(notBefore, notOnOrAfter string, now time.Time, required bool) bool {
+	if notBefore != "" {
+		t, err := time.Parse(time.RFC3339Nano, notBefore)
+		if err != nil || now.Add(samlClockSkew).Before(t) {
+			return false
+		}
+	}
+	if notOnOrAfter == "" {
+		return !required
+	}
+	t, err := time.Parse(time.RFC3339Nano, notOnOrAfter)
+	return err == nil && now.Add(-samlClockSkew).Before(t)
+}
+
+// handleSAMLACS serves POST /saml/acs, where the IdP posts its response.
+// A valid one signs the user in, creating their account on first sign-in
+// unless SAML_JIT is off.
+func (s *serverState) handleSAMLACS(w http.ResponseWriter, r *http.Request) {
+	if s.saml == nil || requestTenantID(r) != rootTenantID {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	fail := func(status int, key string) {
+		page := s.loginPageData(ctx, clientIP(r), 0)
+		page["Error"] = s.responseLocalizer(w).T(key)
+		s.renderTemplate(w, r, status, "login", page)
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSAMLResponse)
+	if err := r.ParseForm(); err != nil {
+		fail(http.StatusBadRequest, "auth.error.invalid_form")
+		return
+	}
+	data, err := decodeXMLBase64(r.PostFormValue("SAMLResponse"))
+	if err != nil || len(data) == 0 {
+		fail(http.StatusBadRequest, "login.error.sso")
+		return
+	}
+	assertion, err := s.saml.parseResponse(data, time.Now())
+	if err != nil {
+		log.Printf("saml response rejected: %v", err)
+		fail(http.StatusForbidden, "login.error.sso")
+		return
+	}
+	// Each request is answered once, which also stops replays.
+	var id string
+	err = s.db.QueryRowContext(ctx, `DELETE FROM saml_requests WHERE id = ? AND expires_at > ? RETURNING id`, assertion.inResponseTo, time.Now().UTC()).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Printf("saml response rejected: unknown or answered request %s", assertion.inResponseTo)
+		fail(http.StatusForbidden, "login.error.sso")
+		return
+	}
+	if err != nil {
+		log.Printf("consume saml request: %v", err)
+		fail(http.StatusInternalServerError, "auth.error.internal")
+		return
+	}
+
+	u, err := s.samlUser(ctx, assertion)
+	if errors.Is(err, errSAMLNoAccount) {
+		fail(http.StatusForbidden, "login.error.sso_no_account")
+		return
+	}
+	if err != nil {
+		log.Printf("saml sign-in %s: %v", assertion.nameID, err)
+		fail(http.StatusInternalServerError, "auth.error.internal")
+		return
+	}
+	switch u.Status {
+	case userStatusPending:
+		s.recordLoginAttempt(ctx, r, u.Email, u.ID, loginPending)
+		fail(http.StatusForbidden, "login.error.pending")
+		return
+	case userStatusDeactivated:
+		s.recordLoginAttempt(ctx, r, u.Email, u.ID, loginDeactivated)
+		fail(http.StatusForbidden, "login.error.deactivated")
+		return
+	}
+	if err := s.ensureMembership(ctx, u.Email, u.TenantID); err != nil {
+		log.Printf("ensure membership: %v", err)
+	}
+	if s.saml.rolesAttr != "" {
+		if err := s.syncSAMLRole(ctx, u, assertion.attributes[s.saml.rolesAttr]); err != nil {
+			log.Printf("sync saml role for %s: %v", u.Email, err)
+		}
+	}
+	if err := s.createSession(w, r, u.Email, false); err != nil {
+		log.Printf("create session %s: %v", u.Email, err)
+		fail(http.StatusInternalServerError, "auth.error.internal")
+		return
+	}
+	s.recordLoginAttempt(ctx, r, u.Email, u.ID, loginSuccess)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// samlUser returns the account an assertion signs in to: the one linked to
+// its NameID, else the one with its email address, which is then linked,
+// else a new one. The display name follows the IdP's.
+func (s *serverState) samlUser(ctx context.Context, a samlAssertion) (user, error) {
+	p := s.saml
+	email := a.first(p.emailAttr)
+	if p.emailAttr == "" {
+		if email = a.first(samlEmailAttributes...); email == "" && strings.Contains(a.nameID, "@") {
+			email = a.nameID
+		}
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	displayName := a.first(p.nameAttr)
+	if p.nameAttr == "" {
+		displayName = a.first(samlNameAttributes...)
+	}
+	if utf8.RuneCountInString(displayName) > maxSAMLNameRunes {
+		displayName = string([]rune(displayName)[:maxSAMLNameRunes])
+	}
+
+	var u user
+	var exists bool
+	var userID int64
+	err := s.readDB.QueryRowContext(ctx, `SELECT user_id FROM saml_identities WHERE issuer = ? AND name_id = ?`, p.idpEntityID, a.nameID).Scan(&userID)
+	switch {
+	case err == nil:
+		if u, exists, err = s.getUserByID(ctx, userID); err != nil {
+			return user{}, err
+		}
+	case !errors.Is(err, sql.ErrNoRows):
+		return user{}, err
+	}
+	if !exists {
+		if email == "" || email == systemUserEmail || !strings.Contains(email, "@") || strings.ContainsAny(email, " \r\n") {
+			return user{}, fmt.Errorf("assertion for %s has no usable email address", a.nameID)
+		}
+		if u, exists, err = s.getUserByEmail(ctx, email); err != nil {
+			return user{}, err
+		}
+		if exists && (u.Status == userStatusBridged || u.Status == userStatusImported || u.TenantID != rootTenantID) {
+			return user{}, errSAMLNoAccount
+		}
+	}
+	if !exists && !p.jit {
+		return user{}, errSAMLNoAccount
+	}
+	handle := ""
+	if !exists {
+		if handle, err = uniqueHandle(ctx, s.readDB, rootTenantID, handleFromEmail(email)); err != nil {
+			return user{}, err
+		}
+	}
+
+	// A new account is linked to its identity in the same transaction.
+	var change membershipChange
+	renamed := false
+	err = s.withTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now().UTC()
+		if !exists {
+			name := displayName
+			if name == "" {
+				name = handle
+			}
+			// Without a password the account signs in only through the IdP
+			// and cannot be claimed by signing up.
+			var err error
+			u.ID, change, err = s.insertUser(ctx, tx, user{Email: email, Handle: handle, DisplayName: name, PasswordHash: []byte{}, CreatedAt: now})
+			if err != nil {
+				return err
+			}
+		} else if displayName != "" && displayName != u.DisplayName {
+			if _, err := tx.ExecContext(ctx, `UPDATE users SET display_name = ? WHERE id = ?`, displayName, u.ID); err != nil {
+				return err
+			}
+			renamed = true
+		}
+		_, err := tx.ExecContext(ctx, `
+            INSERT INTO saml_identities (user_id, issuer, name_id, created_at, last_login_at) VALUES (?, ?, ?, ?, ?)
+            ON CONFLICT(user_id) DO UPDATE SET issuer = excluded.issuer, name_id = excluded.name_id, last_login_at = excluded.last_login_at
+        `, u.ID, p.idpEntityID, a.nameID, now, now)
+		return err
+	})
+	if err != nil {
+		return user{}, err
+	}
+	s.membershipChanged(change)
+	if !exists {
+		if u, _, err = s.getUserByID(ctx, u.ID); err != nil {
+			return user{}, err
+		}
+		s.recordAudit(ctx, 0, samlActor, "user.provisioned", "user", strconv.FormatInt(u.ID, 10), email)
+	}
+	if renamed {
+		u.DisplayName = displayName
+		s.refreshConnections(u)
+	}
+	return u, nil
+}
+
+// syncSAMLRole gives the user the highest home-server role their values of
+// the roles attribute map to, or member when none does. Owners keep their
+// role.
+func (s *serverState) syncSAMLRole(ctx context.Context, u user, values []string) error {
+	role := "member"
+	for _, v := range values {
+		if mapped, ok := s.saml.roleMap[strings.TrimSpace(v)]; ok && slices.Index(knownRoles, mapped) < slices.Index(knownRoles, role) {
+			role = mapped
+		}
+	}
+	res, err := s.db.ExecContext(ctx, `UPDATE server_members SET role = ? WHERE server_id = ? AND user_id = ? AND role NOT IN ('owner', ?)`, role, s.defaultServerID, u.ID, role)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		s.invalidateMembership(s.defaultServerID, u.Email)
+		s.recordAudit(ctx, s.defaultServerID, samlActor, "member.role", "user", strconv.FormatInt(u.ID, 10), role)
+	}
+	return nil
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Attachment contents carry a scan status in attachment_blobs.scan_status.
+// With UPLOAD_SCANNER set, new contents start out scanPending: the message
+// is posted, but the attachment cannot be downloaded until runUploadScanner
+// has had it scanned. Clean contents become available; infected ones are
+// quarantined, kept for instance admins to review and never served. Either
+// way the channel gets attachment:update. Contents that were already
+// scanned are not scanned again when posted a second time.
+const (
+	scanPending  = "pending"
+	scanClean    = "clean"
+	scanRejected = "rejected"
+
+	scanEvery = 30 * time.Second
+	scanBatch = 20
+)
+
+// uploadScanner checks attachment contents for malware.
+type uploadScanner interface {
+	name() string
+	scan(ctx context.Context, data []byte) (scanVerdict, error)
+}
+
+type scanVerdict struct {
+	clean bool
+	// signature names what was found when the content is not clean.
+	signature string
+}
+
+// uploadScannerFromEnv returns the scanner named by UPLOAD_SCANNER, or nil
+// when uploads are not scanned.
+func uploadScannerFromEnv() (uploadScanner, error) {
+	switch name := strings.ToLower(strings.TrimSpace(os.Getenv("UPLOAD_SCANNER"))); name {
+	case "", "none":
+		return nil, nil
+	case "clamd":
+		return clamdScannerFromEnv(), nil
+	default:
+		return nil, fmt.Errorf("UPLOAD_SCANNER=%q is not one of none, clamd", name)
+	}
+}
+
+// newScanStatus is the status new attachment contents are stored with.
+func (s *serverState) newScanStatus() string {
+	if s.scanner == nil {
+		return scanClean
+	}
+	return scanPending
+}
+
+// wakeScanner has runUploadScanner look for pending contents now rather
+// than at its next tick.
+func (s *serverState) wakeScanner() {
+	select {
+	case s.scanWake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *serverState) runUploadScanner(ctx context.Context) {
+	if s.scanner == nil {
+		return
+	}
+	ticker := time.NewTicker(scanEvery)
+	defer ticker.Stop()
+
+	for {
+		if err := s.scanPending(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("scan attachments: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.scanWake:
+		}
+	}
+}
+
+// scanPending scans pending contents until none are left. A scanner error
+// ends the pass; the contents stay pending and are retried on the next one.
+func (s *serverState) scanPending(ctx context.Context) error {
+	for {
+		rows, err := s.readDB.QueryContext(ctx, `
+            SELECT hash, location, data FROM attachment_blobs WHERE scan_status = ? ORDER BY created_at LIMIT ?
+        `, scanPending, scanBatch)
+		if err != nil {
+			return err
+		}
+		type pending struct {
+			hash, location string
+			data           []byte
+		}
+		var batch []pending
+		for rows.Next() {
+			var p pending
+			if err := rows.Scan(&p.hash, &p.location, &p.data); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		for _, p := range batch {
+			data, err := s.blobData(ctx, p.hash, p.location, p.data)
+			if err != nil {
+				return fmt.Errorf("load %s: %w", p.hash, err)
+			}
+			verdict, err := s.scanner.scan(ctx, data)
+			if err != nil {
+				return fmt.Errorf("%s: %w", s.scanner.name(), err)
+			}
+			status := scanClean
+			if !verdict.clean {
+				status = scanRejected
+				log.Printf("quarantined attachment blob %s: %s", p.hash, verdict.signature)
+			}
+			if err := s.setScanStatus(ctx, p.hash, scanPending, status, verdict.signature); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// setScanStatus moves a blob from one scan status to another, logs a sync
+// update for the messages using it and tells their channels. It does
+// nothing if the blob is no longer in status from.
+func (s *serverState) setScanStatus(ctx context.Context, hash, from, to, signature string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `
+        UPDATE attachment_blobs SET scan_status = ?, scan_result = ?, scanned_at = ? WHERE hash = ? AND scan_status = ?
+    `, to, signature, time.Now().UTC(), hash, from)
+	if err != nil {
+		return err
+	}
+	if changed, _ := res.RowsAffected(); changed == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `
+        INSERT INTO sync_events (type, channel_id, message_id)
+        SELECT DISTINCT 'message:update', m.channel_id, m.id
+        FROM message_attachments a JOIN channel_messages m ON m.id = a.message_id
+        WHERE a.blob_hash = ?
+    `, hash); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.notifyAttachments(ctx, hash, "")
+	// Voice messages are transcribed once their audio has been scanned.
+	s.wakeTranscriber()
+	return nil
+}
+
+// notifyAttachments sends attachment:update for every attachment using a
+// blob. status overrides the stored one, for attachments that are about to
+// be deleted.
+func (s *serverState) notifyAttachments(ctx context.Context, hash, status string) {
+	refs, err := s.blobAttachments(ctx, hash)
+	if err != nil {
+		log.Printf("load attachments of blob %s: %v", hash, err)
+		return
+	}
+	ids := make([]int64, 0, len(refs))
+	for _, ref := range refs {
+		ids = append(ids, ref.MessageID)
+	}
+	messages, err := s.messagesByIDs(ctx, ids)
+	if err != nil {
+		log.Printf("load messages of blob %s: %v", hash, err)
+		return
+	}
+	for _, ref := range refs {
+		msg, ok := messages[ref.MessageID]
+		if !ok {
+			continue
+		}
+		for _, att := range msg.Attachments {
+			if att.ID != ref.ID {
+				continue
+			}
+			if status != "" {
+				att.Status = status
+			}
+			dto := att.withURLs(msg.ChannelID, msg.ID)
+			frame, err := outboundFrame(wsOutbound{Type: "attachment:update", ChannelID: msg.ChannelID, MessageID: msg.ID, Attachment: &dto})
+			if err != nil {
+				log.Printf("marshal attachment update: %v", err)
+				return
+			}
+			s.ws.broadcast(msg.ChannelID, frame)
+		}
+	}
+}
+
+type quarantinedAttachmentDTO struct {
+	ID          int64  `json:"id"`
+	MessageID   int64  `json:"messageId"`
+	ChannelID   int64  `json:"channelId"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	AuthorEmail string `json:"authorEmail"`
+}
+
+type quarantineEntryDTO struct {
+	Hash        string                     `json:"hash"`
+	Size        int64                      `json:"size"`
+	Signature   string                     `json:"signature"`
+	ScannedAt   time.Time                  `json:"scannedAt"`
+	Attachments []quarantinedAttachmentDTO `json:"attachments"`
+}
+
+func (s *serverState) blobAttachments(ctx context.Context, hash string) ([]quarantinedAttachmentDTO, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT a.id, a.message_id, m.channel_id, a.filename, a.content_type, u.email
+        FROM message_attachments a
+        JOIN channel_messages m ON m.id = a.message_id
+        JOIN users u ON u.id = m.author_id
+        WHERE a.blob_hash = ?
+        ORDER BY a.id
+    `, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []quarantinedAttachmentDTO{}
+	for rows.Next() {
+		var att quarantinedAttachmentDTO
+		if err := rows.Scan(&att.ID, &att.MessageID, &att.ChannelID, &att.Filename, &att.ContentType, &att.AuthorEmail); err != nil {
+			return nil, err
+		}
+		result = append(result, att)
+	}
+	return result, rows.Err()
+}
+
+// handleAdminQuarantine serves /api/admin/quarantine to instance admins:
+// GET lists quarantined contents and the attachments using them,
+// POST /{hash}/release lets a false positive through, and DELETE /{hash}
+// removes the attachments for good.
+func (s *serverState) handleAdminQuarantine(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.requireOperator(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	hash, action, _ := strings.Cut(strings.Trim(r.URL.Path, "/"), "/")
+
+	if hash == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		entries, err := s.quarantine(ctx)
+		if err != nil {
+			log.Printf("list quarantine: %v", err)
+			httpError(w, "failed to load quarantine", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(entries); err != nil {
+			log.Printf("encode quarantine: %v", err)
+		}
+		return
+	}
+
+	var exists bool
+	if err := s.readDB.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM attachment_blobs WHERE hash = ? AND scan_status = ?)`, hash, scanRejected).Scan(&exists); err != nil {
+		log.Printf("load quarantined blob: %v", err)
+		httpError(w, "failed to update quarantine", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case action == "release" && r.Method == http.MethodPost:
+		if err := s.setScanStatus(ctx, hash, scanRejected, scanClean, ""); err != nil {
+			log.Printf("release quarantined blob: %v", err)
+			httpError(w, "failed to update quarantine", http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit(ctx, 0, admin.Email, "attachment.released", "attachment_blob", hash, "")
+		w.WriteHeader(http.StatusNoContent)
+	case action == "" && r.Method == http.MethodDelete:
+		// Tell the channels first, while the attachments can still be
+		// looked up.
+		s.notifyAttachments(ctx, hash, "deleted")
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			log.Printf("delete quarantined blob: %v", err)
+			httpError(w, "failed to update quarantine", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		if _, err := tx.ExecContext(ctx, `
+            INSERT INTO sync_events (type, channel_id, message_id)
+            SELECT DISTINCT 'message:update', m.channel_id, m.id
+            FROM message_attachments a JOIN channel_messages m ON m.id = a.message_id
+            WHERE a.blob_hash = ?
+        `, hash); err != nil {
+			log.Printf("delete quarantined blob: %v", err)
+			httpError(w, "failed to update quarantine", http.StatusInternalServerError)
+			return
+		}
+		// The blob goes with its last attachment.
+		if _, err := tx.ExecContext(ctx, `DELETE FROM message_attachments WHERE blob_hash = ?`, hash); err != nil {
+			log.Printf("delete quarantined blob: %v", err)
+			httpError(w, "failed to update quarantine", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("delete quarantined blob: %v", err)
+			httpError(w, "failed to update quarantine", http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit(ctx, 0, admin.Email, "attachment.quarantine_deleted", "attachment_blob", hash, "")
+		w.WriteHeader(http.StatusNoContent)
+	case action == "release":
+		w.Header().Set("Allow", "POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+	case action == "":
+		w.Header().Set("Allow", "DELETE")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		httpError(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (s *serverState) quarantine(ctx context.Context) ([]quarantineEntryDTO, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT hash, size, scan_result, scanned_at FROM attachment_blobs WHERE scan_status = ? ORDER BY scanned_at DESC
+    `, scanRejected)
+	if err != nil {
+		return nil, err
+	}
+	entries := []quarantineEntryDTO{}
+	for rows.Next() {
+		var entry quarantineEntryDTO
+		var scannedAt sql.NullTime
+		if err := rows.Scan(&entry.Hash, &entry.Size, &entry.Signature, &scannedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entry.ScannedAt = scannedAt.Time
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if entries[i].Attachments, err = s.blobAttachments(ctx, entries[i].Hash); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// writeAttachmentUnavailable answers a download of contents that are not clean.
+func writeAttachmentUnavailable(w http.ResponseWriter, status string) {
+	if status == scanPending {
+		writeAPIError(w, http.StatusConflict, apiError{Code: "attachment_pending", Message: "attachment is still being scanned"})
+		return
+	}
+	writeAPIError(w, http.StatusForbidden, apiError{Code: "attachment_rejected", Message: "attachment was quarantined by the virus scanner"})
+}
@@ -0,0 +1,820 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	scimUserSchema      = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListSchema      = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema     = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimConfigSchema    = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimResourceSchema  = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	scimContentType     = "application/scim+json"
+	scimActor           = "scim"
+	defaultSCIMPageSize = 100
+	maxSCIMPageSize     = 200
+	maxSCIMBody         = 64 << 10
+)
+
+// scimError is a SCIM error response (RFC 7644 section 3.12).
+type scimError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func (e *scimError) Error() string { return e.detail }
+
+func scimErr(status int, scimType, format string, args ...any) *scimError {
+	return &scimError{status: status, scimType: scimType, detail: fmt.Sprintf(format, args...)}
+}
+
+func writeSCIM(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", scimContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("encode scim response: %v", err)
+	}
+}
+
+func writeSCIMError(w http.ResponseWriter, err error) {
+	var e *scimError
+	if !errors.As(err, &e) {
+		log.Printf("scim: %v", err)
+		e = scimErr(http.StatusInternalServerError, "", "internal error")
+	}
+	body := map[string]any{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(e.status),
+		"detail":  e.detail,
+	}
+	if e.scimType != "" {
+		body["scimType"] = e.scimType
+	}
+	writeSCIM(w, e.status, body)
+}
+
+type scimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+// scimUser is a user as SCIM clients see it. userName is what the
+// directory provisioned the account under, or the email address for
+// accounts it has not touched.
+type scimUser struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	UserName    string      `json:"userName"`
+	Name        scimName    `json:"name"`
+	DisplayName string      `json:"displayName"`
+	Emails      []scimEmail `json:"emails"`
+	Active      bool        `json:"active"`
+	Meta        scimMeta    `json:"meta"`
+}
+
+// scimBool accepts the quoted booleans some directories send ("True").
+type scimBool bool
+
+func (b *scimBool) UnmarshalJSON(raw []byte) error {
+	v, err := strconv.ParseBool(strings.Trim(string(raw), `"`))
+	if err != nil {
+		return fmt.Errorf("%s is not a boolean", raw)
+	}
+	*b = scimBool(v)
+	return nil
+}
+
+// scimUserInput holds the attributes a POST, PUT or PATCH sets. Attributes
+// left out are not changed; unknown ones, such as extension schemas, are
+// ignored.
+type scimUserInput struct {
+	ExternalID  *string     `json:"externalId"`
+	UserName    *string     `json:"userName"`
+	Name        *scimName   `json:"name"`
+	DisplayName *string     `json:"displayName"`
+	Emails      []scimEmail `json:"emails"`
+	Active      *scimBool   `json:"active"`
+	Password    *string     `json:"password"`
+}
+
+// email is the primary address in emails, else the first one, else
+// userName when it is an address.
+func (in scimUserInput) email() string {
+	for _, e := range in.Emails {
+		if e.Primary {
+			return strings.ToLower(strings.TrimSpace(e.Value))
+		}
+	}
+	if len(in.Emails) > 0 {
+		return strings.ToLower(strings.TrimSpace(in.Emails[0].Value))
+	}
+	if in.UserName != nil && strings.Contains(*in.UserName, "@") {
+		return strings.ToLower(strings.TrimSpace(*in.UserName))
+	}
+	return ""
+}
+
+func (in scimUserInput) displayName() string {
+	if in.DisplayName != nil && strings.TrimSpace(*in.DisplayName) != "" {
+		return strings.TrimSpace(*in.DisplayName)
+	}
+	if in.Name == nil {
+		return ""
+	}
+	if in.Name.Formatted != "" {
+		return strings.TrimSpace(in.Name.Formatted)
+	}
+	return strings.TrimSpace(in.Name.GivenName + " " + in.Name.FamilyName)
+}
+
+// scimRecord is a user joined with its provisioning state.
+type scimRecord struct {
+	user
+	userName   string
+	externalID string
+	updatedAt  sql.NullTime
+}
+
+func (rec scimRecord) resource() scimUser {
+	userName := rec.userName
+	if userName == "" {
+		userName = rec.Email
+	}
+	modified := rec.CreatedAt
+	if rec.updatedAt.Valid {
+		modified = rec.updatedAt.Time
+	}
+	id := strconv.FormatInt(rec.ID, 10)
+	return scimUser{
+		Schemas:     []string{scimUserSchema},
+		ID:          id,
+		ExternalID:  rec.externalID,
+		UserName:    userName,
+		Name:        scimName{Formatted: rec.DisplayName},
+		DisplayName: rec.DisplayName,
+		Emails:      []scimEmail{{Value: rec.Email, Type: "work", Primary: true}},
+		Active:      rec.Status == userStatusActive,
+		Meta: scimMeta{
+			ResourceType: "User",
+			Created:      rec.CreatedAt,
+			LastModified: modified,
+			Location:     "/scim/v2/Users/" + id,
+		},
+	}
+}
+
+// scimVisible leaves out the system user, bridge and import ghosts, accounts
+// a DELETE deprovisioned and other tenants' accounts: the directory
+// provisions the root tenant.
+const scimVisible = `u.email != ? AND u.status NOT IN ('bridged', 'imported') AND su.deprovisioned_at IS NULL AND u.tenant_id = 0`
+
+const scimRecordSelect = `
+    SELECT u.id, u.email, u.handle, u.display_name, u.password_hash, u.created_at, u.status,
+           COALESCE(su.user_name, ''), COALESCE(su.external_id, ''), su.updated_at
+    FROM users u LEFT JOIN scim_users su ON su.user_id = u.id`
+
+func scanSCIMRecord(row interface{ Scan(...any) error }) (scimRecord, error) {
+	var rec scimRecord
+	err := row.Scan(&rec.ID, &rec.Email, &rec.Handle, &rec.DisplayName, &rec.PasswordHash, &rec.CreatedAt, &rec.Status,
+		&rec.userName, &rec.externalID, &rec.updatedAt)
+	return rec, err
+}
+
+func (s *serverState) scimRecordByID(ctx context.Context, id int64) (scimRecord, error) {
+	rec, err := scanSCIMRecord(s.db.QueryRowContext(ctx, scimRecordSelect+` WHERE u.id = ? AND `+scimVisible, id, systemUserEmail))
+	if errors.Is(err, sql.ErrNoRows) {
+		return scimRecord{}, scimErr(http.StatusNotFound, "", "user %d not found", id)
+	}
+	return rec, err
+}
+
+// handleSCIM serves the SCIM 2.0 API under /scim/v2 to a directory
+// presenting SCIM_TOKEN as a bearer token. Without a token configured the
+// API does not exist.
+func (s *serverState) handleSCIM(w http.ResponseWriter, r *http.Request) {
+	if s.scimToken == "" || requestTenantID(r) != rootTenantID {
+		http.NotFound(w, r)
+		return
+	}
+	token, _ := bearerToken(r)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.scimToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+		writeSCIMError(w, scimErr(http.StatusUnauthorized, "", "unauthorized"))
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "ServiceProviderConfig" && r.Method == http.MethodGet:
+		writeSCIM(w, http.StatusOK, scimServiceProviderConfig())
+	case path == "ResourceTypes" && r.Method == http.MethodGet:
+		writeSCIM(w, http.StatusOK, map[string]any{
+			"schemas":      []string{scimListSchema},
+			"totalResults": 1,
+			"Resources":    []any{scimUserResourceType()},
+		})
+	case path == "Users" && r.Method == http.MethodGet:
+		s.scimListUsers(w, r)
+	case path == "Users" && r.Method == http.MethodPost:
+		s.scimCreateUser(w, r)
+	case strings.HasPrefix(path, "Users/"):
+		id, err := strconv.ParseInt(strings.TrimPrefix(path, "Users/"), 10, 64)
+		if err != nil {
+			writeSCIMError(w, scimErr(http.StatusNotFound, "", "user not found"))
+			return
+		}
+		s.scimUserResource(w, r, id)
+	default:
+		writeSCIMError(w, scimErr(http.StatusNotFound, "", "no such endpoint"))
+	}
+}
+
+func scimServiceProviderConfig() map[string]any {
+	supported := func(ok bool) map[string]bool { return map[string]bool{"supported": ok} }
+	return map[string]any{
+		"schemas":        []string{scimConfigSchema},
+		"patch":          supported(true),
+		"bulk":           map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]any{"supported": true, "maxResults": maxSCIMPageSize},
+		"changePassword": supported(true),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []map[string]any{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer token",
+			"description": "The SCIM_TOKEN configured on the server",
+			"primary":     true,
+		}},
+		"meta": map[string]string{"resourceType": "ServiceProviderConfig", "location": "/scim/v2/ServiceProviderConfig"},
+	}
+}
+
+func scimUserResourceType() map[string]any {
+	return map[string]any{
+		"schemas":  []string{scimResourceSchema},
+		"id":       "User",
+		"name":     "User",
+		"endpoint": "/Users",
+		"schema":   scimUserSchema,
+		"meta":     map[string]string{"resourceType": "ResourceType", "location": "/scim/v2/ResourceTypes/User"},
+	}
+}
+
+// scimFilterPattern matches the only filters directories need to find a
+// user: attribute eq "value".
+var scimFilterPattern = regexp.MustCompile(`^\s*([A-Za-z.]+)\s+(?i:eq)\s+"((?:[^"\\]|\\.)*)"\s*$`)
+
+func scimFilterClause(filter string) (string, []any, error) {
+	if strings.TrimSpace(filter) == "" {
+		return "", nil, nil
+	}
+	m := scimFilterPattern.FindStringSubmatch(filter)
+	if m == nil {
+		return "", nil, scimErr(http.StatusBadRequest, "invalidFilter", `only attribute eq "value" filters are supported`)
+	}
+	value := strings.ReplaceAll(strings.ReplaceAll(m[2], `\"`, `"`), `\\`, `\`)
+	switch strings.ToLower(m[1]) {
+	case "username":
+		return ` AND COALESCE(su.user_name, u.email) = ? COLLATE NOCASE`, []any{value}, nil
+	case "externalid":
+		return ` AND su.external_id = ?`, []any{value}, nil
+	case "emails", "emails.value":
+		return ` AND u.email = ?`, []any{strings.ToLower(value)}, nil
+	case "id":
+		return ` AND u.id = ?`, []any{value}, nil
+	}
+	return "", nil, scimErr(http.StatusBadRequest, "invalidFilter", "cannot filter on %s", m[1])
+}
+
+// scimListUsers serves GET /Users with an optional filter and 1-based
+// startIndex/count paging.
+func (s *serverState) scimListUsers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	clause, args, err := scimFilterClause(q.Get("filter"))
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	startIndex, _ := strconv.Atoi(q.Get("startIndex"))
+	startIndex = max(startIndex, 1)
+	count := defaultSCIMPageSize
+	if raw := q.Get("count"); raw != "" {
+		count, _ = strconv.Atoi(raw)
+		count = min(max(count, 0), maxSCIMPageSize)
+	}
+
+	ctx := r.Context()
+	where := ` WHERE ` + scimVisible + clause
+	args = append([]any{systemUserEmail}, args...)
+	var total int
+	if err := s.readDB.QueryRowContext(ctx, `SELECT COUNT(*) FROM users u LEFT JOIN scim_users su ON su.user_id = u.id`+where, args...).Scan(&total); err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	rows, err := s.readDB.QueryContext(ctx, scimRecordSelect+where+` ORDER BY u.id LIMIT ? OFFSET ?`, append(args, count, startIndex-1)...)
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	defer rows.Close()
+	resources := []scimUser{}
+	for rows.Next() {
+		rec, err := scanSCIMRecord(rows)
+		if err != nil {
+			writeSCIMError(w, err)
+			return
+		}
+		resources = append(resources, rec.resource())
+	}
+	if err := rows.Err(); err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	writeSCIM(w, http.StatusOK, map[string]any{
+		"schemas":      []string{scimListSchema},
+		"totalResults": total,
+		"startIndex":   startIndex,
+		"itemsPerPage": len(resources),
+		"Resources":    resources,
+	})
+}
+
+func decodeSCIM(r *http.Request, dst any) error {
+	defer r.Body.Close()
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxSCIMBody)).Decode(dst); err != nil {
+		return scimErr(http.StatusBadRequest, "invalidSyntax", "invalid request body: %v", err)
+	}
+	return nil
+}
+
+// scimCreateUser serves POST /Users. An account is created without a
+// password unless one is given, and is not claimable by signing up; a
+// deprovisioned account with the same email is brought back instead.
+func (s *serverState) scimCreateUser(w http.ResponseWriter, r *http.Request) {
+	var in scimUserInput
+	if err := decodeSCIM(r, &in); err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	rec, err := s.scimProvision(r.Context(), in)
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	w.Header().Set("Location", rec.resource().Meta.Location)
+	writeSCIM(w, http.StatusCreated, rec.resource())
+}
+
+func (s *serverState) scimProvision(ctx context.Context, in scimUserInput) (scimRecord, error) {
+	if in.UserName == nil || strings.TrimSpace(*in.UserName) == "" {
+		return scimRecord{}, scimErr(http.StatusBadRequest, "invalidValue", "userName is required")
+	}
+	userName := strings.TrimSpace(*in.UserName)
+	email := in.email()
+	if email == "" || email == systemUserEmail || strings.ContainsAny(email, " \r\n") {
+		return scimRecord{}, scimErr(http.StatusBadRequest, "invalidValue", "an email address is required in emails or userName")
+	}
+	if taken, err := s.scimUserNameTaken(ctx, userName, 0); err != nil || taken {
+		if err == nil {
+			err = scimErr(http.StatusConflict, "uniqueness", "userName %s is already provisioned", userName)
+		}
+		return scimRecord{}, err
+	}
+
+	existing, exists, err := s.getUserByEmail(ctx, email)
+	if err != nil {
+		return scimRecord{}, err
+	}
+	if exists && existing.TenantID != rootTenantID {
+		return scimRecord{}, scimErr(http.StatusConflict, "uniqueness", "%s is already registered", email)
+	}
+	if exists {
+		rec, err := s.scimRecordByID(ctx, existing.ID)
+		var notFound *scimError
+		if errors.As(err, &notFound) {
+			// Only a deprovisioned account is hidden; bring it back.
+			if _, err := s.db.ExecContext(ctx, `UPDATE scim_users SET deprovisioned_at = NULL WHERE user_id = ?`, existing.ID); err != nil {
+				return scimRecord{}, err
+			}
+			if in.Active == nil {
+				active := scimBool(true)
+				in.Active = &active
+			}
+			rec, err = s.scimRecordByID(ctx, existing.ID)
+			if err != nil {
+				return scimRecord{}, err
+			}
+			return s.scimApply(ctx, rec, in)
+		}
+		if err != nil {
+			return scimRecord{}, err
+		}
+		return scimRecord{}, scimErr(http.StatusConflict, "uniqueness", "%s is already registered", email)
+	}
+
+	handle := ""
+	if !strings.Contains(userName, "@") {
+		if candidate := normalizeHandle(userName); validHandle(candidate) {
+			if handle, err = uniqueHandle(ctx, s.readDB, rootTenantID, candidate); err != nil {
+				return scimRecord{}, err
+			}
+		}
+	}
+	if handle == "" {
+		if handle, err = uniqueHandle(ctx, s.readDB, rootTenantID, handleFromEmail(email)); err != nil {
+			return scimRecord{}, err
+		}
+	}
+	displayName := in.displayName()
+	if displayName == "" {
+		displayName = handle
+	}
+	// Without a password the account can only be signed in to once one is
+	// set over SCIM or with reset-password.
+	hash := []byte{}
+	if in.Password != nil {
+		if hash, err = s.scimPasswordHash(*in.Password, email, handle); err != nil {
+			return scimRecord{}, err
+		}
+	}
+	// The account, its home server membership and its SCIM record are
+	// created together, so a failure cannot leave an account the directory
+	// does not know it made.
+	now := time.Now().UTC()
+	externalID := ""
+	if in.ExternalID != nil {
+		externalID = *in.ExternalID
+	}
+	active := in.Active == nil || bool(*in.Active)
+	var id int64
+	var change membershipChange
+	err = s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		id, change, err = s.insertUser(ctx, tx, user{Email: email, Handle: handle, DisplayName: displayName, PasswordHash: hash, CreatedAt: now, TenantID: rootTenantID})
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+            INSERT INTO scim_users (user_id, user_name, external_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?)
+        `, id, userName, externalID, now, now); err != nil {
+			return err
+		}
+		if !active {
+			_, err = tx.ExecContext(ctx, `UPDATE users SET status = ? WHERE id = ?`, userStatusDeactivated, id)
+		}
+		return err
+	})
+	if err != nil {
+		return scimRecord{}, err
+	}
+	s.membershipChanged(change)
+	s.recordAudit(ctx, 0, scimActor, "user.provisioned", "user", strconv.FormatInt(id, 10), email)
+	if !active {
+		s.recordAudit(ctx, 0, scimActor, "user.deactivated", "user", strconv.FormatInt(id, 10), email)
+	}
+	return s.scimRecordByID(ctx, id)
+}
+
+// scimUserResource serves GET, PUT, PATCH and DELETE on /Users/{id}.
+func (s *serverState) scimUserResource(w http.ResponseWriter, r *http.Request, id int64) {
+	ctx := r.Context()
+	rec, err := s.scimRecordByID(ctx, id)
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeSCIM(w, http.StatusOK, rec.resource())
+	case http.MethodPut:
+		var in scimUserInput
+		if err := decodeSCIM(r, &in); err != nil {
+			writeSCIMError(w, err)
+			return
+		}
+		if in.UserName == nil || strings.TrimSpace(*in.UserName) == "" {
+			writeSCIMError(w, scimErr(http.StatusBadRequest, "invalidValue", "userName is required"))
+			return
+		}
+		if rec, err = s.scimApply(ctx, rec, in); err != nil {
+			writeSCIMError(w, err)
+			return
+		}
+		writeSCIM(w, http.StatusOK, rec.resource())
+	case http.MethodPatch:
+		var patch struct {
+			Operations []scimPatchOp `json:"Operations"`
+		}
+		if err := decodeSCIM(r, &patch); err != nil {
+			writeSCIMError(w, err)
+			return
+		}
+		var in scimUserInput
+		for _, op := range patch.Operations {
+			if err := op.applyTo(&in); err != nil {
+				writeSCIMError(w, err)
+				return
+			}
+		}
+		if rec, err = s.scimApply(ctx, rec, in); err != nil {
+			writeSCIMError(w, err)
+			return
+		}
+		writeSCIM(w, http.StatusOK, rec.resource())
+	case http.MethodDelete:
+		if err := s.scimDeprovision(ctx, rec); err != nil {
+			writeSCIMError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
+		writeSCIMError(w, scimErr(http.StatusMethodNotAllowed, "", "method not allowed"))
+	}
+}
+
+// scimPatchOp is one operation of a PATCH request (RFC 7644 section 3.5.2).
+type scimPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyTo folds the operation into in. add and replace set attributes,
+// with a path or as an object of attributes; remove clears externalId.
+func (op scimPatchOp) applyTo(in *scimUserInput) error {
+	kind := strings.ToLower(op.Op)
+	path := strings.ToLower(op.Path)
+	switch {
+	case kind == "remove" && path == "externalid":
+		empty := ""
+		in.ExternalID = &empty
+		return nil
+	case kind == "remove":
+		return scimErr(http.StatusBadRequest, "mutability", "%s cannot be removed", op.Path)
+	case kind != "add" && kind != "replace":
+		return scimErr(http.StatusBadRequest, "invalidSyntax", "unknown op %q", op.Op)
+	}
+
+	var err error
+	switch path {
+	case "":
+		err = json.Unmarshal(op.Value, in)
+	case "active":
+		err = json.Unmarshal(op.Value, &in.Active)
+	case "displayname":
+		err = json.Unmarshal(op.Value, &in.DisplayName)
+	case "username":
+		err = json.Unmarshal(op.Value, &in.UserName)
+	case "externalid":
+		err = json.Unmarshal(op.Value, &in.ExternalID)
+	case "password":
+		err = json.Unmarshal(op.Value, &in.Password)
+	case "name.formatted":
+		var formatted string
+		err = json.Unmarshal(op.Value, &formatted)
+		in.Name = &scimName{Formatted: formatted}
+	case "name.givenname", "name.familyname":
+		// Only the formatted name is kept, as the display name.
+	case "emails":
+		err = json.Unmarshal(op.Value, &in.Emails)
+	case `emails[type eq "work"].value`, `emails[primary eq true].value`:
+		var value string
+		err = json.Unmarshal(op.Value, &value)
+		in.Emails = []scimEmail{{Value: value, Primary: true}}
+	default:
+		return scimErr(http.StatusBadRequest, "invalidPath", "cannot change %s", op.Path)
+	}
+	if err != nil {
+		return scimErr(http.StatusBadRequest, "invalidValue", "%s: %v", op.Path, err)
+	}
+	return nil
+}
+
+// externallyManaged reports whether the directory provisioned or linked the
+// account, or it signs in through SAML. Such accounts cannot be claimed by
+// signing up.
+func (s *serverState) externallyManaged(ctx context.Context, userID int64) (bool, error) {
+	var managed bool
+	err := s.readDB.QueryRowContext(ctx, `
+        SELECT EXISTS(SELECT 1 FROM scim_users WHERE user_id = ?) OR EXISTS(SELECT 1 FROM saml_identities WHERE user_id = ?)
+    `, userID, userID).Scan(&managed)
+	return managed, err
+}
+
+func (s *serverState) scimUserNameTaken(ctx context.Context, userName string, exceptUserID int64) (bool, error) {
+	var taken bool
+	err := s.readDB.QueryRowContext(ctx, `
+        SELECT EXISTS(SELECT 1 FROM scim_users WHERE user_name = ? COLLATE NOCASE AND user_id != ?)
+    `, userName, exceptUserID).Scan(&taken)
+	return taken, err
+}
+
+func (s *serverState) scimPasswordHash(password, email, handle string) ([]byte, error) {
+	if err := s.passwords.check(password, email, handle); err != nil {
+		return nil, scimErr(http.StatusBadRequest, "invalidValue", "password: %v", err)
+	}
+	return s.passwords.hash(password)
+}
+
+// scimApply changes the attributes in sets on an existing account and links
+// it to the directory. A new email address moves the account as a
+// confirmed email change does, signing it out everywhere.
+func (s *serverState) scimApply(ctx context.Context, rec scimRecord, in scimUserInput) (scimRecord, error) {
+	userName := rec.userName
+	if in.UserName != nil && strings.TrimSpace(*in.UserName) != "" {
+		userName = strings.TrimSpace(*in.UserName)
+		if taken, err := s.scimUserNameTaken(ctx, userName, rec.ID); err != nil || taken {
+			if err == nil {
+				err = scimErr(http.StatusConflict, "uniqueness", "userName %s is already provisioned", userName)
+			}
+			return scimRecord{}, err
+		}
+	}
+	if userName == "" {
+		userName = rec.Email
+	}
+	externalID := rec.externalID
+	if in.ExternalID != nil {
+		externalID = *in.ExternalID
+	}
+
+	var hash []byte
+	if in.Password != nil {
+		var err error
+		if hash, err = s.scimPasswordHash(*in.Password, rec.Email, rec.Handle); err != nil {
+			return scimRecord{}, err
+		}
+	}
+
+	// All of the request applies or none of it; the sign-outs and audit
+	// entries follow once it is committed.
+	oldEmail := rec.Email
+	email := in.email()
+	moved := email != "" && email != rec.Email
+	toggled := in.Active != nil && bool(*in.Active) != (rec.Status == userStatusActive)
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		if moved {
+			if err := scimMoveEmail(ctx, tx, rec.user, email); err != nil {
+				return err
+			}
+			rec.Email = email
+		}
+		if name := in.displayName(); name != "" && name != rec.DisplayName {
+			if _, err := tx.ExecContext(ctx, `UPDATE users SET display_name = ? WHERE id = ?`, name, rec.ID); err != nil {
+				return err
+			}
+		}
+		if hash != nil {
+			if err := replacePassword(ctx, tx, rec.Email, hash); err != nil {
+				return err
+			}
+		}
+		now := time.Now().UTC()
+		if _, err := tx.ExecContext(ctx, `
+            INSERT INTO scim_users (user_id, user_name, external_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?)
+            ON CONFLICT(user_id) DO UPDATE SET user_name = excluded.user_name, external_id = excluded.external_id, updated_at = excluded.updated_at
+        `, rec.ID, userName, externalID, now, now); err != nil {
+			return err
+		}
+		if toggled {
+			return updateUserStatus(ctx, tx, rec.ID, bool(*in.Active))
+		}
+		return nil
+	})
+	if err != nil {
+		return scimRecord{}, err
+	}
+	if moved {
+		s.forgetEmail(oldEmail)
+		s.recordAudit(ctx, 0, scimActor, "user.email_changed", "user", strconv.FormatInt(rec.ID, 10), oldEmail+" -> "+email)
+	}
+	if hash != nil {
+		s.ws.disconnectUser(rec.Email, wsCloseAuthExpired, "password changed")
+		s.recordAudit(ctx, 0, scimActor, "user.password_reset", "user", strconv.FormatInt(rec.ID, 10), "scim")
+	}
+	if toggled {
+		s.userActiveChanged(ctx, rec.user, bool(*in.Active))
+	}
+	return s.scimRecordByID(ctx, rec.ID)
+}
+
+// scimMoveEmail moves the account to a new address as part of tx.
+func scimMoveEmail(ctx context.Context, tx *sql.Tx, u user, email string) error {
+	if email == systemUserEmail || !strings.Contains(email, "@") || strings.ContainsAny(email, " \r\n") {
+		return scimErr(http.StatusBadRequest, "invalidValue", "%q is not a valid email address", email)
+	}
+	var taken bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)`, email).Scan(&taken); err != nil {
+		return err
+	}
+	if taken {
+		return scimErr(http.StatusConflict, "uniqueness", "%s is already registered", email)
+	}
+	if err := moveUserEmail(ctx, tx, u.ID, u.Email, email); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM email_changes WHERE user_id = ?`, u.ID)
+	return err
+}
+
+// setUserActive deactivates an account, signing it out everywhere, or
+// activates it again. Activating a pending account approves it.
+func (s *serverState) setUserActive(ctx context.Context, u user, active bool) error {
+	if err := s.withTx(ctx, func(tx *sql.Tx) error {
+		return updateUserStatus(ctx, tx, u.ID, active)
+	}); err != nil {
+		return err
+	}
+	s.userActiveChanged(ctx, u, active)
+	return nil
+}
+
+// updateUserStatus does the writes of setUserActive as part of tx.
+func updateUserStatus(ctx context.Context, tx *sql.Tx, userID int64, active bool) error {
+	status := userStatusDeactivated
+	if active {
+		status = userStatusActive
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET status = ? WHERE id = ?`, status, userID); err != nil {
+		return err
+	}
+	if active {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = ?`, userID)
+	return err
+}
+
+// userActiveChanged follows a committed updateUserStatus.
+func (s *serverState) userActiveChanged(ctx context.Context, u user, active bool) {
+	action := "user.reactivated"
+	if !active {
+		s.ws.disconnectUser(u.Email, wsCloseSignedOut, "account deactivated")
+		action = "user.deactivated"
+	}
+	s.recordAudit(ctx, 0, scimActor, action, "user", strconv.FormatInt(u.ID, 10), u.Email)
+}
+
+// scimDeprovision handles DELETE: the account is deactivated rather than
+// deleted, so its messages keep their author, and disappears from SCIM.
+func (s *serverState) scimDeprovision(ctx context.Context, rec scimRecord) error {
+	deactivate := rec.Status != userStatusDeactivated
+	now := time.Now().UTC()
+	userName := rec.userName
+	if userName == "" {
+		userName = rec.Email
+	}
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		if deactivate {
+			if err := updateUserStatus(ctx, tx, rec.ID, false); err != nil {
+				return err
+			}
+		}
+		// The userName is released so the directory can hand it to someone
+		// else; provisioning the same email again restores the account.
+		_, err := tx.ExecContext(ctx, `
+            INSERT INTO scim_users (user_id, user_name, external_id, created_at, updated_at, deprovisioned_at) VALUES (?, '', '', ?, ?, ?)
+            ON CONFLICT(user_id) DO UPDATE SET user_name = '', external_id = '', updated_at = excluded.updated_at, deprovisioned_at = excluded.deprovisioned_at
+        `, rec.ID, now, now, now)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if deactivate {
+		s.userActiveChanged(ctx, rec.user, false)
+	}
+	s.recordAudit(ctx, 0, scimActor, "user.deprovisioned", "user", strconv.FormatInt(rec.ID, 10), userName)
+	return nil
+}
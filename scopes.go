@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Scopes narrow what an API token may do, for bots and integrations that
+// should not hold the whole account. A token asks for them at the password
+// grant; one that asks for none has full access, like a browser session.
+const (
+	scopeReadMessages   = "read:messages"
+	scopeWriteMessages  = "write:messages"
+	scopeManageChannels = "manage:channels"
+	scopeVoice          = "voice"
+)
+
+type scopeDTO struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// knownScopes lists every scope a token can ask for, in the order the API
+// lists them.
+var knownScopes = []scopeDTO{
+	{scopeReadMessages, "Read servers, channels, members and message history, and subscribe to channels"},
+	{scopeWriteMessages, "Send, edit and delete messages, and update read state and drafts"},
+	{scopeManageChannels, "Create channels and change their settings, overrides, grants, bridges and followers"},
+	{scopeVoice, "Join voice channels and exchange voice signalling"},
+}
+
+// tokenScopes is the set of scopes an API session holds; nil means full
+// access.
+type tokenScopes map[string]bool
+
+// parseScopes reads scopes as stored in sessions.scopes, space separated.
+func parseScopes(raw string) tokenScopes {
+	fields := strings.Fields(raw)
+	if len(fields) == 0 {
+		return nil
+	}
+	scopes := make(tokenScopes, len(fields))
+	for _, f := range fields {
+		scopes[f] = true
+	}
+	return scopes
+}
+
+// validateScopes checks requested against knownScopes and returns them
+// deduplicated and in a stable order.
+func validateScopes(requested []string) ([]string, []fieldError) {
+	var scopes []string
+	var errs []fieldError
+	for i, name := range requested {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if !slices.ContainsFunc(knownScopes, func(k scopeDTO) bool { return k.Name == name }) {
+			errs = append(errs, fieldError{Field: "scopes[" + strconv.Itoa(i) + "]", Message: "must be read:messages, write:messages, manage:channels or voice"})
+			continue
+		}
+		if !slices.Contains(scopes, name) {
+			scopes = append(scopes, name)
+		}
+	}
+	slices.Sort(scopes)
+	return scopes, errs
+}
+
+func (t tokenScopes) full() bool { return t == nil }
+
+// list returns the scopes sorted, or nil for full access.
+func (t tokenScopes) list() []string {
+	if t.full() {
+		return nil
+	}
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// allows reports whether the token may do something needing scope. An
+// empty scope stands for anything no scope covers, which only full access
+// allows.
+func (t tokenScopes) allows(scope string) bool {
+	if t.full() {
+		return true
+	}
+	return scope != "" && t[scope]
+}
+
+// serverAdminResources are the parts of /api/servers/{id}/ only server
+// admins use. Exports hold the whole history of every channel, the audit
+// log and reports name members, and automations carry their source.
+var serverAdminResources = map[string]bool{
+	"export":      true,
+	"reports":     true,
+	"audit-log":   true,
+	"automations": true,
+}
+
+// requiredScope returns the scope a REST request needs, or "" when only a
+// token with full access may make it. Handlers still check membership and
+// permissions as usual; a scope only ever takes access away.
+func requiredScope(method, path string) string {
+	read := method == http.MethodGet || method == http.MethodHead
+	readOr := func(scope string) string {
+		if read {
+			return scopeReadMessages
+		}
+		return scope
+	}
+
+	switch {
+	case path == "/api/bootstrap" || strings.HasPrefix(path, "/api/bootstrap/") || path == "/api/sync":
+		return scopeReadMessages
+	case path == "/api/graphql":
+		// Read-only, whichever method carries the query.
+		return scopeReadMessages
+	case strings.HasPrefix(path, "/media/"):
+		if read {
+			return scopeReadMessages
+		}
+		return ""
+	case strings.HasPrefix(path, "/api/voice/"):
+		return scopeVoice
+	case path == "/api/dms" || path == "/api/stars":
+		return readOr(scopeWriteMessages)
+	case path == "/api/servers":
+		if read {
+			return scopeReadMessages
+		}
+		return ""
+	}
+
+	if rest, ok := strings.CutPrefix(path, "/api/servers/"); ok {
+		parts := strings.Split(strings.Trim(rest, "/"), "/")
+		switch {
+		case len(parts) > 1 && serverAdminResources[parts[1]]:
+			// Server administration, even reading it, needs full access.
+			return ""
+		case read:
+			return scopeReadMessages
+		case len(parts) == 1 && method == http.MethodPost:
+			// Creates a channel.
+			return scopeManageChannels
+		}
+		return ""
+	}
+
+	if rest, ok := strings.CutPrefix(path, "/api/channels/"); ok {
+		parts := strings.Split(strings.Trim(rest, "/"), "/")
+		sub := ""
+		if len(parts) > 1 {
+			sub = parts[1]
+		}
+		switch sub {
+		case "messages", "search", "draft", "read", "reading-order", "voice-messages":
+			return readOr(scopeWriteMessages)
+		case "", "overrides", "grants", "bridges", "followers":
+			return readOr(scopeManageChannels)
+		case "audio":
+			if read {
+				return scopeVoice
+			}
+			return scopeManageChannels
+		case "recordings":
+			return scopeVoice
+		}
+	}
+	return ""
+}
+
+// enforceScopes turns away requests whose API token lacks the scope they
+// need with 403 insufficient_scope. Cookie sessions and tokens with full
+// access pass untouched. WebSocket events are checked one by one instead;
+// see wsEventScope.
+func (s *serverState) enforceScopes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := bearerToken(r); !ok || r.URL.Path == "/ws" || strings.HasPrefix(r.URL.Path, "/api/auth/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sess, _, ok := s.sessionFromRequest(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if scope := requiredScope(r.Method, r.URL.Path); !sess.Scopes.allows(scope) {
+			writeScopeError(w, scope)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeScopeError(w http.ResponseWriter, scope string) {
+	message := "this token has no scope for this request"
+	var details any
+	if scope != "" {
+		message = "this token lacks the " + scope + " scope"
+		details = map[string]string{"scope": scope}
+	}
+	writeAPIError(w, http.StatusForbidden, apiError{Code: "insufficient_scope", Message: message, Details: details})
+}
+
+// wsEventScope returns the scope a WebSocket event needs, with "" again
+// meaning full access only.
+func wsEventScope(eventType string) string {
+	switch eventType {
+	case "subscribe", "subscribe:bulk", "unsubscribe", "members:request":
+		return scopeReadMessages
+	case "message":
+		return scopeWriteMessages
+	case "voice:join", "voice:leave", "voice:signal", "voice:mode", "voice:video", "voice:record", "voice:recording-consent":
+		return scopeVoice
+	}
+	return ""
+}
+
+// handleAuthScopes serves GET /api/auth/scopes: the scopes a token can ask
+// for and, when the request carries a token, the ones it holds.
+func (s *serverState) handleAuthScopes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	response := struct {
+		Scopes  []scopeDTO `json:"scopes"`
+		Granted []string   `json:"granted,omitempty"`
+		Full    bool       `json:"fullAccess,omitempty"`
+	}{Scopes: knownScopes}
+	if sess, _, ok := s.sessionFromRequest(r); ok {
+		response.Granted = sess.Scopes.list()
+		response.Full = sess.Scopes.full()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("encode scopes: %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSearchLimit = 25
+	maxSearchLimit     = 100
+)
+
+// message_search is an FTS5 index over each message's text and, for voice
+// messages, its transcript, keyed by message id. Like the sync log it is
+// kept current by triggers, so every writer is covered.
+var messageSearchTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS search_message_insert AFTER INSERT ON channel_messages BEGIN
+        INSERT INTO message_search (rowid, body) VALUES (NEW.id, NEW.content);
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS search_message_edit AFTER UPDATE OF content ON channel_messages BEGIN
+        DELETE FROM message_search WHERE rowid = OLD.id;
+        INSERT INTO message_search (rowid, body)
+        VALUES (NEW.id, NEW.content || COALESCE(' ' || (SELECT text FROM message_transcripts WHERE message_id = NEW.id AND status = 'done'), ''));
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS search_message_delete AFTER DELETE ON channel_messages BEGIN
+        DELETE FROM message_search WHERE rowid = OLD.id;
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS search_transcript_done AFTER UPDATE OF status ON message_transcripts
+    WHEN NEW.status = 'done' BEGIN
+        DELETE FROM message_search WHERE rowid = NEW.message_id;
+        INSERT INTO message_search (rowid, body)
+        SELECT id, content || ' ' || NEW.text FROM channel_messages WHERE id = NEW.message_id;
+    END`,
+}
+
+// ensureMessageSearch creates the index and its triggers, filling it from
+// the existing messages the first time.
+func ensureMessageSearch(ctx context.Context, db *sql.DB) error {
+	var exists bool
+	if err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE name = 'message_search')`).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := db.ExecContext(ctx, `CREATE VIRTUAL TABLE message_search USING fts5(body, tokenize = 'unicode61 remove_diacritics 2')`); err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, `
+            INSERT INTO message_search (rowid, body)
+            SELECT m.id, m.content || COALESCE(' ' || t.text, '')
+            FROM channel_messages m LEFT JOIN message_transcripts t ON t.message_id = m.id AND t.status = 'done'
+        `); err != nil {
+			return err
+		}
+	}
+	for _, trigger := range messageSearchTriggers {
+		if _, err := db.ExecContext(ctx, trigger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchQuery turns what someone typed into an FTS5 query: every word must
+// appear, the last one possibly unfinished. Words are quoted, so FTS5
+// operators and punctuation are matched literally rather than parsed.
+func searchQuery(input string) string {
+	words := strings.Fields(input)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	if len(words) > 0 {
+		words[len(words)-1] += "*"
+	}
+	return strings.Join(words, " ")
+}
+
+// handleChannelSearch serves GET /api/channels/{id}/search?q=…, the
+// channel's messages matching q by their text or transcript, newest first.
+func (s *serverState) handleChannelSearch(w http.ResponseWriter, r *http.Request, ch channelInfo, currentUser user) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := searchQuery(r.URL.Query().Get("q"))
+	if query == "" {
+		httpError(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	limit := defaultSearchLimit
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = min(n, maxSearchLimit)
+	}
+
+	messages, err := s.queryMessages(r.Context(), messageSelect+`
+        WHERE m.id IN (SELECT rowid FROM message_search WHERE message_search MATCH ?)
+          AND m.channel_id = ? AND (m.expires_at IS NULL OR m.expires_at > ?)
+        ORDER BY m.id DESC
+        LIMIT ?
+    `, query, ch.ID, time.Now().UTC(), limit)
+	if err != nil {
+		log.Printf("search channel %d: %v", ch.ID, err)
+		httpError(w, "failed to search messages", http.StatusInternalServerError)
+		return
+	}
+
+	payload := make([]messageDTO, 0, len(messages))
+	for _, msg := range messages {
+		payload = append(payload, s.messageDTOFor(currentUser, msg))
+	}
+	if err := s.annotateStars(r.Context(), currentUser, payload); err != nil {
+		log.Printf("load message stars: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		log.Printf("encode search results: %v", err)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxServerIconBytes = 1 << 20
+
+var iconExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+func toServerPayload(srv serverInfo, channels []channelPayload) serverPayload {
+	payload := serverPayload{
+		ID:                   srv.ID,
+		Slug:                 srv.Slug,
+		Name:                 srv.Name,
+		CreatedAt:            srv.CreatedAt,
+		Description:          srv.Description,
+		DefaultNotifications: srv.DefaultNotifications,
+		SystemChannelID:      srv.SystemChannelID.Int64,
+		Rules:                srv.Rules,
+		Channels:             channels,
+	}
+	payload.IconURL = mediaURL(srv.IconPath)
+	return payload
+}
+
+func (s *serverState) serverByID(ctx context.Context, serverID int64) (serverInfo, bool, error) {
+	srv, err := scanServer(s.readDB.QueryRowContext(ctx, `SELECT `+serverColumns+` FROM servers srv WHERE srv.id = ?`, serverID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return serverInfo{}, false, nil
+		}
+		return serverInfo{}, false, err
+	}
+	return srv, true, nil
+}
+
+func (s *serverState) serverBySlug(ctx context.Context, slug string) (serverInfo, bool, error) {
+	srv, err := scanServer(s.readDB.QueryRowContext(ctx, `SELECT `+serverColumns+` FROM servers srv WHERE srv.slug = ?`, slug))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return serverInfo{}, false, nil
+		}
+		return serverInfo{}, false, err
+	}
+	return srv, true, nil
+}
+
+// broadcastToServer pushes outbound to every connected member of serverID.
+func (s *serverState) broadcastToServer(ctx context.Context, serverID int64, outbound wsOutbound) {
+	members, err := s.membersForServer(ctx, serverID)
+	if err != nil {
+		log.Printf("load members for broadcast: %v", err)
+		return
+	}
+	for _, m := range members {
+		s.ws.sendToUser(m.Email, outbound)
+	}
+}
+
+// membershipChange records what a transaction did to a membership, so the
+// caches and the outbox can be told once it commits.
+type membershipChange struct {
+	serverID  int64
+	email     string
+	changed   bool
+	joined    bool
+	announced bool
+}
+
+// membershipChanged acts on c after its transaction commits.
+func (s *serverState) membershipChanged(c membershipChange) {
+	if c.changed {
+		s.invalidateMembership(c.serverID, c.email)
+	}
+	if c.announced {
+		s.wakeOutbox()
+	}
+	if c.joined {
+		s.automations.memberJoined(c.serverID, c.email)
+		s.plugins.memberJoined(context.Background(), c.serverID, c.email)
+	}
+}
+
+// announceMembership posts a join/leave notice into the server's system
+// channel, if one is configured, as part of tx. It reports whether it
+// posted one.
+func (s *serverState) announceMembership(ctx context.Context, tx *sql.Tx, serverID int64, email string, joined bool) (bool, error) {
+	var channelID sql.NullInt64
+	var name string
+	err := tx.QueryRowContext(ctx, `SELECT srv.system_channel_id, u.display_name FROM servers srv, users u WHERE srv.id = ? AND u.email = ?`, serverID, email).Scan(&channelID, &name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil || !channelID.Valid {
+		return false, err
+	}
+
+	l := s.defaultLocalizer()
+	content := l.T("system.member_joined", name)
+	if !joined {
+		content = l.T("system.member_left", name)
+	}
+	now := time.Now().UTC()
+	res, err := tx.ExecContext(ctx, `INSERT INTO channel_messages (channel_id, author_id, content, created_at) VALUES (?, `+userIDForEmail+`, ?, ?)`, channelID.Int64, systemUserEmail, content, now)
+	if err != nil {
+		return false, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return false, err
+	}
+	return true, queueMessageEvent(ctx, tx, channelID.Int64, id, now)
+}
+
+func decodeServerIcon(dataURL string) ([]byte, error) {
+	return decodeImageDataURL(dataURL, "icon", maxServerIconBytes)
+}
+
+// decodeImageDataURL decodes an image uploaded as a base64 data URL in a
+// JSON body; field names it in errors.
+func decodeImageDataURL(dataURL, field string, maxBytes int) ([]byte, error) {
+	const marker = ";base64,"
+	idx := strings.Index(dataURL, marker)
+	if !strings.HasPrefix(dataURL, "data:") || idx < 0 {
+		return nil, errors.New(field + " must be a base64 data URL")
+	}
+	raw, err := base64.StdEncoding.DecodeString(dataURL[idx+len(marker):])
+	if err != nil {
+		return nil, errors.New(field + " is not valid base64")
+	}
+	if len(raw) > maxBytes {
+		return nil, fmt.Errorf("%s must be %s or smaller", field, formatBytes(int64(maxBytes)))
+	}
+	if _, ok := iconExtensions[http.DetectContentType(raw)]; !ok {
+		return nil, errors.New(field + " must be a PNG, JPEG, GIF or WebP image")
+	}
+	return raw, nil
+}
+
+func (s *serverState) storeServerIcon(ctx context.Context, serverID int64, raw []byte) (string, error) {
+	path, _, err := s.storeMediaImage(ctx, "server-icons", strconv.FormatInt(serverID, 10), raw, iconThumbnailSizes)
+	return path, err
+}
+
+// storeMediaImage cleans up an uploaded image with the image pipeline and
+// writes it as {prefix}-{hash}.{ext}, with its thumbnails alongside as
+// {name}-{size}.{ext}, under data/media/{kind}. It returns the path
+// relative to the data directory.
+func (s *serverState) storeMediaImage(ctx context.Context, kind, prefix string, raw []byte, sizes []int) (string, *processedImage, error) {
+	img, err := s.images.process(ctx, raw, sizes)
+	if err != nil {
+		return "", nil, err
+	}
+	dir := filepath.Join(s.dataDir, "media", kind)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(img.data)
+	base := fmt.Sprintf("%s-%s", prefix, hex.EncodeToString(sum[:8]))
+	for _, thumb := range img.thumbnails {
+		name := fmt.Sprintf("%s-%d%s", base, thumb.size, iconExtensions[thumb.contentType])
+		if err := os.WriteFile(filepath.Join(dir, name), thumb.data, 0o644); err != nil {
+			return "", nil, err
+		}
+	}
+	name := base + iconExtensions[img.contentType]
+	if err := os.WriteFile(filepath.Join(dir, name), img.data, 0o644); err != nil {
+		return "", nil, err
+	}
+	return filepath.Join("media", kind, name), img, nil
+}
+
+// mediaThumbnails maps the sizes a stored image has thumbnails at to their
+// paths.
+func (s *serverState) mediaThumbnails(path string) map[int]string {
+	full := filepath.Join(s.dataDir, path)
+	matches, _ := filepath.Glob(strings.TrimSuffix(full, filepath.Ext(full)) + "-*")
+	thumbnails := make(map[int]string, len(matches))
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(match[strings.LastIndex(match, "-")+1:], filepath.Ext(match))
+		if size, err := strconv.Atoi(suffix); err == nil {
+			thumbnails[size] = match
+		}
+	}
+	return thumbnails
+}
+
+// removeMediaImage deletes a stored image that is no longer used, with its
+// thumbnails.
+func (s *serverState) removeMediaImage(path string) {
+	paths := []string{filepath.Join(s.dataDir, path)}
+	for _, thumb := range s.mediaThumbnails(path) {
+		paths = append(paths, thumb)
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("remove media image: %v", err)
+		}
+	}
+}
+
+// serveMediaImage serves a stored image, or one of its thumbnails (see
+// mediaFile).
+func (s *serverState) serveMediaImage(w http.ResponseWriter, r *http.Request, path string) {
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeFile(w, r, s.mediaFile(r, path))
+}
+
+func (s *serverState) handleServerIcon(w http.ResponseWriter, r *http.Request, serverID int64) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	srv, exists, err := s.serverByID(r.Context(), serverID)
+	if err != nil {
+		log.Printf("load server icon: %v", err)
+		httpError(w, "failed to load icon", http.StatusInternalServerError)
+		return
+	}
+	if !exists || srv.IconPath == "" {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	s.serveMediaImage(w, r, srv.IconPath)
+}
+
+func (s *serverState) handleServerSettings(w http.ResponseWriter, r *http.Request, serverID int64, currentUser user) {
+	ctx := r.Context()
+	canManage, err := s.canManageServer(ctx, currentUser.Email, serverID)
+	if err != nil {
+		log.Printf("check server manage permission: %v", err)
+		httpError(w, "failed to update server", http.StatusInternalServerError)
+		return
+	}
+	if !canManage {
+		httpError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	srv, exists, err := s.serverByID(ctx, serverID)
+	if err != nil {
+		log.Printf("load server: %v", err)
+		httpError(w, "failed to update server", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	var body struct {
+		Name                 *string `json:"name" validate:"trim,required"`
+		Description          *string `json:"description" validate:"trim,max=500"`
+		Icon                 *string `json:"icon"`
+		DefaultNotifications *string `json:"defaultNotifications" validate:"trim,lower,required,oneof=all|mentions"`
+		SystemChannelID      *int64  `json:"systemChannelId"`
+	}
+	// The icon travels base64 encoded in the body.
+	if !decodeJSONLimit(w, r, &body, 2*maxServerIconBytes) {
+		return
+	}
+
+	if body.Name != nil {
+		srv.Name = *body.Name
+	}
+	if body.Description != nil {
+		srv.Description = *body.Description
+	}
+	if body.DefaultNotifications != nil {
+		srv.DefaultNotifications = *body.DefaultNotifications
+	}
+	if body.SystemChannelID != nil {
+		if *body.SystemChannelID == 0 {
+			srv.SystemChannelID = sql.NullInt64{}
+		} else {
+			ch, exists, err := s.channelByID(ctx, *body.SystemChannelID)
+			if err != nil {
+				log.Printf("load system channel: %v", err)
+				httpError(w, "failed to update server", http.StatusInternalServerError)
+				return
+			}
+			if !exists || ch.ServerID != serverID || ch.Kind == "voice" {
+				httpError(w, "systemChannelId must be a text channel in this server", http.StatusBadRequest)
+				return
+			}
+			srv.SystemChannelID = sql.NullInt64{Int64: ch.ID, Valid: true}
+		}
+	}
+
+	oldIcon := srv.IconPath
+	if body.Icon != nil {
+		if *body.Icon == "" {
+			srv.IconPath = ""
+		} else {
+			raw, err := decodeServerIcon(*body.Icon)
+			if err != nil {
+				httpError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var imgErr *imageError
+			if srv.IconPath, err = s.storeServerIcon(ctx, serverID, raw); errors.As(err, &imgErr) {
+				httpError(w, "icon: "+err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				log.Printf("store server icon: %v", err)
+				httpError(w, "failed to store icon", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	_, err = s.db.ExecContext(ctx, `UPDATE servers SET name = ?, description = ?, icon_path = ?, default_notifications = ?, system_channel_id = ? WHERE id = ?`,
+		srv.Name, srv.Description, srv.IconPath, srv.DefaultNotifications, srv.SystemChannelID, serverID)
+	if err != nil {
+		log.Printf("update server: %v", err)
+		httpError(w, "failed to update server", http.StatusInternalServerError)
+		return
+	}
+	if oldIcon != "" && oldIcon != srv.IconPath {
+		s.removeMediaImage(oldIcon)
+	}
+
+	s.recordAudit(ctx, serverID, currentUser.Email, "server.update", "server", strconv.FormatInt(serverID, 10), "")
+
+	payload := toServerPayload(srv, nil)
+	s.broadcastToServer(ctx, serverID, wsOutbound{Type: "server:update", Server: &payload})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		log.Printf("encode server: %v", err)
+	}
+}
+
+func (s *serverState) handleLeaveServer(w http.ResponseWriter, r *http.Request, serverID int64, currentUser user) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	role, _, err := s.memberRole(ctx, currentUser.Email, serverID)
+	if err != nil {
+		log.Printf("load member role: %v", err)
+		httpError(w, "failed to leave server", http.StatusInternalServerError)
+		return
+	}
+	if role == "owner" {
+		httpError(w, "owners cannot leave their server", http.StatusBadRequest)
+		return
+	}
+	if home, err := s.isHomeServer(ctx, serverID); err != nil {
+		log.Printf("check home server: %v", err)
+		httpError(w, "failed to leave server", http.StatusInternalServerError)
+		return
+	} else if home {
+		httpError(w, "cannot leave the default server", http.StatusBadRequest)
+		return
+	}
+	change := membershipChange{serverID: serverID, email: currentUser.Email, changed: true}
+	err = s.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM server_members WHERE server_id = ? AND user_id = `+userIDForEmail, serverID, currentUser.Email); err != nil {
+			return err
+		}
+		var err error
+		change.announced, err = s.announceMembership(ctx, tx, serverID, currentUser.Email, false)
+		return err
+	})
+	if err != nil {
+		log.Printf("leave server: %v", err)
+		httpError(w, "failed to leave server", http.StatusInternalServerError)
+		return
+	}
+	s.membershipChanged(change)
+	w.WriteHeader(http.StatusNoContent)
+}
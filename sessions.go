@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSessionTTL  = 12 * time.Hour
+	defaultRememberTTL = 30 * 24 * time.Hour
+	sessionPruneEvery  = time.Hour
+)
+
+type sessionInfo struct {
+	TokenHash string
+	UserID    int64
+	DeviceID  string
+	Remember  bool
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	// UnsignedCookie marks a session from before cookies were signed,
+	// until its cookie has been issued again signed.
+	UnsignedCookie bool
+	// API marks a session started with an access token grant rather than
+	// a browser sign-in; its requests carry a bearer token, not a cookie.
+	API bool
+	// Scopes limits what an API session may do; see scopes.go.
+	Scopes tokenScopes
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	raw := envOrDefault(key, "")
+	if raw == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		log.Printf("ignoring invalid %s=%q, using %s", key, raw, fallback)
+		return fallback
+	}
+	return d
+}
+
+func (s *serverState) sessionLifetime(remember bool) time.Duration {
+	if remember {
+		return s.rememberTTL
+	}
+	return s.sessionTTL
+}
+
+func (s *serverState) setSessionCookie(w http.ResponseWriter, r *http.Request, token string, sess sessionInfo) {
+	cookie := s.sessionCookie(r, s.sessionKeys.sign(token))
+	// Without "remember me" the cookie lives only as long as the browser
+	// session; the server-side expiry still applies on top of that.
+	if sess.Remember {
+		cookie.Expires = sess.ExpiresAt
+	}
+	http.SetCookie(w, cookie)
+}
+
+// createSession signs email in on the requesting device. A session the
+// same user still had on that device is replaced, so each device holds at
+// most one session per user.
+func (s *serverState) createSession(w http.ResponseWriter, r *http.Request, email string, remember bool) error {
+	token := generateSessionID()
+	now := time.Now().UTC()
+	sess := sessionInfo{
+		TokenHash: hashSessionToken(token),
+		DeviceID:  s.deviceIDFor(w, r),
+		Remember:  remember,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.sessionLifetime(remember)),
+	}
+	tx, err := s.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.QueryRowContext(r.Context(), `INSERT INTO sessions (token_hash, user_id, remember, created_at, expires_at, client_ip, device_id, user_agent, last_seen_at, unsigned_cookie) VALUES (?, `+userIDForEmail+`, ?, ?, ?, ?, ?, ?, ?, 0) RETURNING user_id`,
+		sess.TokenHash, email, sess.Remember, sess.CreatedAt, sess.ExpiresAt, clientIP(r), sess.DeviceID, truncateUserAgent(r.UserAgent()), now).Scan(&sess.UserID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(r.Context(), `DELETE FROM sessions WHERE user_id = ? AND device_id = ? AND token_hash != ?`, sess.UserID, sess.DeviceID, sess.TokenHash); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.setSessionCookie(w, r, token, sess)
+	return nil
+}
+
+// sessionFromRequest returns the session the request's cookie belongs to
+// and its token. A cookie without a valid signature is only accepted for a
+// session created before cookies were signed. A request with a bearer
+// token is authenticated by that alone and returns its API session with
+// an empty token.
+func (s *serverState) sessionFromRequest(r *http.Request) (sessionInfo, string, bool) {
+	if accessToken, ok := bearerToken(r); ok {
+		sess, ok := s.sessionFromAccessToken(r.Context(), accessToken)
+		return sess, "", ok
+	}
+	token, unsigned, _, ok := s.sessionCookieToken(r)
+	if !ok {
+		return sessionInfo{}, "", false
+	}
+
+	var sess sessionInfo
+	row := s.stmts.QueryRowContext(r.Context(), `SELECT token_hash, user_id, device_id, remember, created_at, expires_at, unsigned_cookie FROM sessions WHERE token_hash = ? AND kind = 'browser'`, hashSessionToken(token))
+	if err := row.Scan(&sess.TokenHash, &sess.UserID, &sess.DeviceID, &sess.Remember, &sess.CreatedAt, &sess.ExpiresAt, &sess.UnsignedCookie); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("load session: %v", err)
+		}
+		return sessionInfo{}, "", false
+	}
+	if unsigned && !sess.UnsignedCookie {
+		return sessionInfo{}, "", false
+	}
+	if time.Now().After(sess.ExpiresAt) {
+		s.deleteSession(r.Context(), token)
+		return sessionInfo{}, "", false
+	}
+	return sess, token, true
+}
+
+func (s *serverState) deleteSession(ctx context.Context, token string) {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE token_hash = ?`, hashSessionToken(token)); err != nil {
+		log.Printf("delete session: %v", err)
+	}
+}
+
+// slidingSessions pushes the expiry of an active session forward. Renewal
+// happens once a quarter of the lifetime has elapsed, so a busy client does
+// not rewrite the session row on every request.
+func (s *serverState) slidingSessions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/static/") || r.URL.Path == "/logout" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if sess, token, ok := s.sessionFromRequest(r); ok && !sess.API {
+			lifetime := s.sessionLifetime(sess.Remember)
+			// Unsigned cookies and ones signed with an older key are issued
+			// again with the current key. A session stops accepting its
+			// unsigned cookie once the browser has sent the signed one.
+			_, unsigned, setCookie, _ := s.sessionCookieToken(r)
+			if sess.UnsignedCookie && !unsigned {
+				if _, err := s.db.ExecContext(r.Context(), `UPDATE sessions SET unsigned_cookie = 0 WHERE token_hash = ?`, sess.TokenHash); err != nil {
+					log.Printf("sign session cookie: %v", err)
+				}
+			}
+			if time.Until(sess.ExpiresAt) < lifetime-lifetime/4 {
+				sess.ExpiresAt = time.Now().UTC().Add(lifetime)
+				if _, err := s.db.ExecContext(r.Context(), `UPDATE sessions SET expires_at = ?, client_ip = ?, last_seen_at = ? WHERE token_hash = ?`, sess.ExpiresAt, clientIP(r), time.Now().UTC(), sess.TokenHash); err != nil {
+					log.Printf("renew session: %v", err)
+				} else {
+					setCookie = true
+				}
+			}
+			if setCookie {
+				s.setSessionCookie(w, r, token, sess)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *serverState) pruneSessions(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE expires_at < ?`, time.Now().UTC()); err != nil {
+		return fmt.Errorf("prune sessions: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM saml_requests WHERE expires_at < ?`, time.Now().UTC()); err != nil {
+		return fmt.Errorf("prune saml requests: %w", err)
+	}
+	return nil
+}
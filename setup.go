@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultInstanceName = "EchoSphere"
+
+	settingInstanceName    = "instance_name"
+	settingDefaultServerID = "default_server_id"
+	settingSetupCompleted  = "setup_completed_at"
+)
+
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func (s *serverState) getSetting(ctx context.Context, key string) (string, bool, error) {
+	var value string
+	if err := s.readDB.QueryRowContext(ctx, `SELECT value FROM instance_settings WHERE key = ?`, key).Scan(&value); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+func setSetting(ctx context.Context, db sqlExecer, key, value string) error {
+	_, err := db.ExecContext(ctx, `
+        INSERT INTO instance_settings (key, value, updated_at) VALUES (?, ?, ?)
+        ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at
+    `, key, value, time.Now().UTC())
+	return err
+}
+
+// loadInstanceSettings primes the cached branding and decides whether the
+// first-run setup flow is needed: an instance with no accounts yet.
+func (s *serverState) loadInstanceSettings(ctx context.Context) error {
+	if _, err := s.loadBranding(ctx, rootTenantID); err != nil {
+		return err
+	}
+
+	var users int
+	if err := s.readDB.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE email != ?`, systemUserEmail).Scan(&users); err != nil {
+		return err
+	}
+	s.setupPending.Store(users == 0)
+	return nil
+}
+
+// needsSetup reports whether first-run setup is still outstanding. Accounts
+// created another way (signup is gated, but create-admin is not) end it too.
+func (s *serverState) needsSetup(ctx context.Context) bool {
+	if !s.setupPending.Load() {
+		return false
+	}
+	var users int
+	if err := s.readDB.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE email != ?`, systemUserEmail).Scan(&users); err != nil {
+		log.Printf("check setup state: %v", err)
+		return true
+	}
+	if users > 0 {
+		s.setupPending.Store(false)
+		return false
+	}
+	return true
+}
+
+// setupGate sends every request to /setup until the instance has an admin.
+// Tenants get their first admin from the create-admin command instead.
+func (s *serverState) setupGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/setup" || strings.HasPrefix(r.URL.Path, "/static/") || requestTenantID(r) != rootTenantID || !s.needsSetup(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/ws" {
+			errorFor(w, r, "instance setup required", http.StatusServiceUnavailable)
+			return
+		}
+		http.Redirect(w, r, "/setup", http.StatusSeeOther)
+	})
+}
+
+func (s *serverState) handleSetup(w http.ResponseWriter, r *http.Request) {
+	if requestTenantID(r) != rootTenantID || !s.needsSetup(r.Context()) {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.renderTemplate(w, r, http.StatusOK, "setup", templateData{"ServerName": "Home"})
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			s.renderTemplate(w, r, http.StatusBadRequest, "setup", templateData{"Error": "invalid form submission"})
+			return
+		}
+
+		instanceName := strings.TrimSpace(r.FormValue("instance_name"))
+		serverName := strings.TrimSpace(r.FormValue("server_name"))
+		email := strings.TrimSpace(strings.ToLower(r.FormValue("email")))
+		handle := normalizeHandle(r.FormValue("handle"))
+		displayName := strings.TrimSpace(r.FormValue("display_name"))
+		password := r.FormValue("password")
+		form := templateData{"InstanceNameValue": instanceName, "ServerName": serverName, "Email": email, "Handle": handle, "DisplayNameValue": displayName}
+
+		fail := func(status int, msg string) {
+			form["Error"] = msg
+			s.renderTemplate(w, r, status, "setup", form)
+		}
+		if instanceName == "" {
+			instanceName = defaultInstanceName
+		}
+		if serverName == "" || email == "" || displayName == "" {
+			fail(http.StatusBadRequest, "all fields are required")
+			return
+		}
+		if utf8.RuneCountInString(serverName) > 100 || utf8.RuneCountInString(instanceName) > 100 {
+			fail(http.StatusBadRequest, "names must be 100 characters or fewer")
+			return
+		}
+		if email == systemUserEmail || !strings.Contains(email, "@") {
+			fail(http.StatusBadRequest, "enter a valid email address")
+			return
+		}
+		if handle == "" {
+			handle = handleFromEmail(email)
+		}
+		if !validHandle(handle) || handle == systemUserHandle {
+			fail(http.StatusBadRequest, handleRules)
+			return
+		}
+		if password != r.FormValue("confirm_password") {
+			fail(http.StatusBadRequest, "passwords do not match")
+			return
+		}
+		if err := s.passwords.check(password, email, handle); err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		hash, err := s.passwords.hash(password)
+		if err != nil {
+			log.Printf("hash password: %v", err)
+			fail(http.StatusInternalServerError, "failed to create account")
+			return
+		}
+
+		s.setupMu.Lock()
+		defer s.setupMu.Unlock()
+		if !s.needsSetup(r.Context()) {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		admin := user{Email: email, Handle: handle, DisplayName: displayName, PasswordHash: hash, CreatedAt: time.Now().UTC()}
+		if err := s.completeSetup(r.Context(), admin, instanceName, serverName); err != nil {
+			log.Printf("complete setup: %v", err)
+			fail(http.StatusInternalServerError, "failed to complete setup")
+			return
+		}
+		s.recordAudit(r.Context(), s.defaultServerID, email, "instance.setup", "instance", "", instanceName)
+
+		if err := s.createSession(w, r, email, false); err != nil {
+			log.Printf("create session %s: %v", email, err)
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// completeSetup creates the instance admin, makes them owner of the default
+// server under its chosen name, and records the initial settings.
+func (s *serverState) completeSetup(ctx context.Context, admin user, instanceName, serverName string) error {
+	slug := slugify(serverName)
+	if slug == "" || slug == directServerSlug {
+		slug = "home"
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, `INSERT INTO users (email, handle, display_name, password_hash, created_at, is_admin) VALUES (?, ?, ?, ?, ?, 1)`,
+		admin.Email, admin.Handle, admin.DisplayName, admin.PasswordHash, admin.CreatedAt); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE servers SET name = ?, slug = ? WHERE id = ?`, serverName, slug, s.defaultServerID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO server_members (server_id, user_id, role, joined_at) VALUES (?, `+userIDForEmail+`, 'owner', ?)`, s.defaultServerID, admin.Email, now); err != nil {
+		return err
+	}
+	for key, value := range map[string]string{
+		settingInstanceName:    instanceName,
+		settingDefaultServerID: strconv.FormatInt(s.defaultServerID, 10),
+		settingSetupCompleted:  now.Format(time.RFC3339),
+	} {
+		if err := setSetting(ctx, tx, key, value); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET display_name = ? WHERE email = ?`, instanceName, systemUserEmail); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	b := s.currentBranding(ctx, rootTenantID)
+	b.Name = instanceName
+	s.branding.set(rootTenantID, b)
+	s.setupPending.Store(false)
+	s.invalidateMembership(s.defaultServerID, admin.Email)
+	return nil
+}
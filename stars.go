@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type starredMessageDTO struct {
+	ID        int64      `json:"id"`
+	StarredAt time.Time  `json:"starredAt"`
+	Message   messageDTO `json:"message"`
+}
+
+// annotateStars fills in Starred for messages the viewer has starred and
+// StarCount for the viewer's own messages. Star counts are only shown to
+// the author.
+func (s *serverState) annotateStars(ctx context.Context, viewer user, msgs []messageDTO) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(msgs)), ",")
+	args := []any{viewer.ID}
+	index := make(map[int64]int, len(msgs))
+	for i, msg := range msgs {
+		args = append(args, msg.ID)
+		index[msg.ID] = i
+	}
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT message_id, COUNT(*), MAX(user_id = ?)
+        FROM message_stars
+        WHERE message_id IN (`+placeholders+`)
+        GROUP BY message_id
+    `, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID int64
+		var count int
+		var starred bool
+		if err := rows.Scan(&messageID, &count, &starred); err != nil {
+			return err
+		}
+		msg := &msgs[index[messageID]]
+		msg.Starred = starred
+		if msg.AuthorID == viewer.ID {
+			msg.StarCount = count
+		}
+	}
+	return rows.Err()
+}
+
+// starredMessages lists the messages currentUser starred, newest star first,
+// leaving out channels the user can no longer read.
+func (s *serverState) starredMessages(ctx context.Context, currentUser user, before int64, limit int) ([]starredMessageDTO, error) {
+	if before <= 0 {
+		before = 1<<63 - 1
+	}
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT st.id, st.created_at, st.message_id
+        FROM message_stars st
+        JOIN channel_messages m ON m.id = st.message_id
+        JOIN channels c ON c.id = m.channel_id
+        WHERE st.user_id = ? AND st.id < ?
+          AND (
+            (c.kind = 'dm' AND EXISTS (SELECT 1 FROM dm_participants p WHERE p.channel_id = c.id AND p.user_email = ?))
+            OR (c.kind != 'dm' AND c.server_id IN (SELECT server_id FROM server_members WHERE user_id = ?)
+                AND `+channelVisibleTo("?")+`)
+          )
+        ORDER BY st.id DESC
+        LIMIT ?
+    `, currentUser.ID, before, currentUser.Email, currentUser.ID, currentUser.ID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []starredMessageDTO
+	var ids []int64
+	for rows.Next() {
+		var star starredMessageDTO
+		if err := rows.Scan(&star.ID, &star.StarredAt, &star.Message.ID); err != nil {
+			return nil, err
+		}
+		result = append(result, star)
+		ids = append(ids, star.Message.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	found, err := s.messagesByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]messageDTO, 0, len(result))
+	kept := result[:0]
+	for _, star := range result {
+		if msg, ok := found[star.Message.ID]; ok {
+			kept = append(kept, star)
+			msgs = append(msgs, s.messageDTOFor(currentUser, msg))
+		}
+	}
+	if err := s.annotateStars(ctx, currentUser, msgs); err != nil {
+		return nil, err
+	}
+	for i := range kept {
+		kept[i].Message = msgs[i]
+	}
+	return kept, nil
+}
+
+// handleMessageStar stars (PUT) or unstars (DELETE) a message for the caller.
+func (s *serverState) handleMessageStar(w http.ResponseWriter, r *http.Request, ch channelInfo, currentUser user, rawMessageID string) {
+	ctx := r.Context()
+	msg, found, err := s.loadChannelMessage(ctx, ch, rawMessageID)
+	if err != nil {
+		log.Printf("load starred message: %v", err)
+		httpError(w, "failed to update star", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		_, err = s.db.ExecContext(ctx, `INSERT OR IGNORE INTO message_stars (user_id, message_id, created_at) VALUES (?, ?, ?)`,
+			currentUser.ID, msg.ID, time.Now().UTC())
+	case http.MethodDelete:
+		_, err = s.db.ExecContext(ctx, `DELETE FROM message_stars WHERE user_id = ? AND message_id = ?`, currentUser.ID, msg.ID)
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		log.Printf("update star: %v", err)
+		httpError(w, "failed to update star", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"messageId": msg.ID, "starred": r.Method == http.MethodPut}); err != nil {
+		log.Printf("encode star: %v", err)
+	}
+}
+
+func (s *serverState) handleStars(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := 50
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 && n <= 200 {
+		limit = n
+	}
+	before, _ := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64)
+
+	stars, err := s.starredMessages(r.Context(), currentUser, before, limit)
+	if err != nil {
+		log.Printf("list starred messages: %v", err)
+		httpError(w, "failed to list saved messages", http.StatusInternalServerError)
+		return
+	}
+	if stars == nil {
+		stars = []starredMessageDTO{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stars); err != nil {
+		log.Printf("encode starred messages: %v", err)
+	}
+}
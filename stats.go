@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	statsDayFormat       = "2006-01-02"
+	defaultStatsInterval = 15 * time.Minute
+	statsBackfillDays    = 90
+	defaultStatsDays     = 30
+	maxStatsDays         = 365
+)
+
+type serverDayStats struct {
+	Day           string `json:"day"`
+	Messages      int    `json:"messages"`
+	ActiveMembers int    `json:"activeMembers"`
+	PeakVoice     int    `json:"peakVoice"`
+}
+
+type serverStatsDTO struct {
+	ServerID     int64            `json:"serverId"`
+	From         string           `json:"from"`
+	To           string           `json:"to"`
+	Members      int              `json:"members"`
+	CurrentVoice int              `json:"currentVoice"`
+	Days         []serverDayStats `json:"days"`
+}
+
+type channelDayStats struct {
+	Day      string `json:"day"`
+	Messages int    `json:"messages"`
+	Authors  int    `json:"authors"`
+}
+
+type channelStatsDTO struct {
+	ChannelID int64             `json:"channelId"`
+	Name      string            `json:"name"`
+	Days      []channelDayStats `json:"days"`
+}
+
+// runStatsAggregator keeps the daily rollup tables current. The first pass
+// backfills statsBackfillDays; later passes recompute yesterday and today,
+// which is enough for messages that arrive around midnight.
+func (s *serverState) runStatsAggregator(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	since := time.Now().UTC().AddDate(0, 0, -statsBackfillDays)
+	for {
+		if err := s.rollupStats(ctx, since); err != nil {
+			log.Printf("roll up server stats: %v", err)
+		} else {
+			since = time.Now().UTC().AddDate(0, 0, -1)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rollupStats recomputes message counts for since's day and every day after it.
+// Timestamps are stored in UTC text form, so the first ten characters are the
+// day. Self-destructing messages are left out so that a day's numbers do not
+// change as they expire.
+func (s *serverState) rollupStats(ctx context.Context, since time.Time) error {
+	day := since.UTC().Format(statsDayFormat)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+        INSERT INTO channel_stats_daily (channel_id, day, server_id, messages, authors)
+        SELECT m.channel_id, substr(m.created_at, 1, 10), c.server_id, COUNT(*), COUNT(DISTINCT m.author_id)
+        FROM channel_messages m
+        JOIN channels c ON c.id = m.channel_id
+        WHERE m.created_at >= ? AND m.expires_at IS NULL AND c.kind != 'dm'
+        GROUP BY m.channel_id, substr(m.created_at, 1, 10)
+        ON CONFLICT(channel_id, day) DO UPDATE SET messages = excluded.messages, authors = excluded.authors
+    `, day); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+        INSERT INTO server_stats_daily (server_id, day, messages, active_members)
+        SELECT c.server_id, substr(m.created_at, 1, 10), COUNT(*), COUNT(DISTINCT m.author_id)
+        FROM channel_messages m
+        JOIN channels c ON c.id = m.channel_id
+        WHERE m.created_at >= ? AND m.expires_at IS NULL AND c.kind != 'dm'
+        GROUP BY c.server_id, substr(m.created_at, 1, 10)
+        ON CONFLICT(server_id, day) DO UPDATE SET messages = excluded.messages, active_members = excluded.active_members
+    `, day); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// recordVoicePeak raises today's peak for serverID to the number of people
+// now in its voice channels.
+func (s *serverState) recordVoicePeak(ctx context.Context, serverID int64) {
+	count := s.voiceCount(serverID)
+	if count == 0 {
+		return
+	}
+	if _, err := s.db.ExecContext(ctx, `
+        INSERT INTO server_stats_daily (server_id, day, peak_voice) VALUES (?, ?, ?)
+        ON CONFLICT(server_id, day) DO UPDATE SET peak_voice = MAX(peak_voice, excluded.peak_voice)
+    `, serverID, time.Now().UTC().Format(statsDayFormat), count); err != nil {
+		log.Printf("record voice peak: %v", err)
+	}
+}
+
+func (s *serverState) serverStats(ctx context.Context, serverID int64, from, to string) (serverStatsDTO, error) {
+	stats := serverStatsDTO{ServerID: serverID, From: from, To: to, CurrentVoice: s.voiceCount(serverID), Days: []serverDayStats{}}
+	if err := s.readDB.QueryRowContext(ctx, `SELECT COUNT(*) FROM server_members WHERE server_id = ?`, serverID).Scan(&stats.Members); err != nil {
+		return serverStatsDTO{}, err
+	}
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT day, messages, active_members, peak_voice
+        FROM server_stats_daily
+        WHERE server_id = ? AND day BETWEEN ? AND ?
+        ORDER BY day
+    `, serverID, from, to)
+	if err != nil {
+		return serverStatsDTO{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day serverDayStats
+		if err := rows.Scan(&day.Day, &day.Messages, &day.ActiveMembers, &day.PeakVoice); err != nil {
+			return serverStatsDTO{}, err
+		}
+		stats.Days = append(stats.Days, day)
+	}
+	return stats, rows.Err()
+}
+
+func (s *serverState) channelStats(ctx context.Context, serverID int64, from, to string) ([]channelStatsDTO, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT cs.channel_id, c.name, cs.day, cs.messages, cs.authors
+        FROM channel_stats_daily cs
+        JOIN channels c ON c.id = cs.channel_id
+        WHERE cs.server_id = ? AND cs.day BETWEEN ? AND ?
+        ORDER BY c.created_at, cs.channel_id, cs.day
+    `, serverID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []channelStatsDTO{}
+	for rows.Next() {
+		var channelID int64
+		var name string
+		var day channelDayStats
+		if err := rows.Scan(&channelID, &name, &day.Day, &day.Messages, &day.Authors); err != nil {
+			return nil, err
+		}
+		if n := len(result); n == 0 || result[n-1].ChannelID != channelID {
+			result = append(result, channelStatsDTO{ChannelID: channelID, Name: name})
+		}
+		last := &result[len(result)-1]
+		last.Days = append(last.Days, day)
+	}
+	return result, rows.Err()
+}
+
+// handleServerStats serves /api/servers/{id}/stats (daily totals),
+// /api/servers/{id}/stats/channels (daily counts per channel) and
+// /api/servers/{id}/stats/voice (voice time per user and channel) to server
+// managers. ?days= picks how many days back from today to include.
+func (s *serverState) handleServerStats(w http.ResponseWriter, r *http.Request, serverID int64, currentUser user, resource string) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	canManage, err := s.canManageServer(ctx, currentUser.Email, serverID)
+	if err != nil {
+		log.Printf("check stats permission: %v", err)
+		httpError(w, "failed to load stats", http.StatusInternalServerError)
+		return
+	}
+	if !canManage {
+		httpError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	days := defaultStatsDays
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxStatsDays {
+			httpError(w, "days must be between 1 and 365", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	now := time.Now().UTC()
+	from, to := now.AddDate(0, 0, 1-days).Format(statsDayFormat), now.Format(statsDayFormat)
+
+	var payload any
+	switch resource {
+	case "":
+		payload, err = s.serverStats(ctx, serverID, from, to)
+	case "channels":
+		payload, err = s.channelStats(ctx, serverID, from, to)
+	case "voice":
+		payload, err = s.voiceUsage(ctx, serverID, from, to)
+	default:
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("load server stats: %v", err)
+		httpError(w, "failed to load stats", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		log.Printf("encode server stats: %v", err)
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stickers are images server admins upload into named packs. Members send
+// one by posting a message with its stickerId; the message refers to the
+// sticker rather than copying it. Every change to a server's packs sends
+// its members stickers:update with the full list.
+const (
+	maxStickerBytes      = 512 << 10
+	maxStickersPerServer = 60
+)
+
+type stickerDTO struct {
+	ID       int64  `json:"id"`
+	PackID   int64  `json:"packId,omitempty"`
+	ServerID int64  `json:"serverId,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Tags     string `json:"tags,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	URL      string `json:"url,omitempty"`
+	// Deleted is set on messages whose sticker was deleted since.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+type stickerPackDTO struct {
+	ID          int64        `json:"id"`
+	ServerID    int64        `json:"serverId"`
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	CreatedAt   time.Time    `json:"createdAt"`
+	Stickers    []stickerDTO `json:"stickers"`
+}
+
+func stickerURL(serverID, stickerID int64) string {
+	return fmt.Sprintf("/api/servers/%d/stickers/%d", serverID, stickerID)
+}
+
+func (st stickerDTO) withURL() stickerDTO {
+	st.URL = stickerURL(st.ServerID, st.ID)
+	return st
+}
+
+func (s *serverState) stickerPacks(ctx context.Context, serverID int64) ([]stickerPackDTO, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT id, server_id, name, description, created_at FROM sticker_packs WHERE server_id = ? ORDER BY id
+    `, serverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	packs := []stickerPackDTO{}
+	index := make(map[int64]int)
+	for rows.Next() {
+		pack := stickerPackDTO{Stickers: []stickerDTO{}}
+		if err := rows.Scan(&pack.ID, &pack.ServerID, &pack.Name, &pack.Description, &pack.CreatedAt); err != nil {
+			return nil, err
+		}
+		index[pack.ID] = len(packs)
+		packs = append(packs, pack)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.readDB.QueryContext(ctx, `
+        SELECT st.id, st.pack_id, p.server_id, st.name, st.tags, st.width, st.height
+        FROM stickers st JOIN sticker_packs p ON p.id = st.pack_id
+        WHERE p.server_id = ? ORDER BY st.id
+    `, serverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var st stickerDTO
+		if err := rows.Scan(&st.ID, &st.PackID, &st.ServerID, &st.Name, &st.Tags, &st.Width, &st.Height); err != nil {
+			return nil, err
+		}
+		if i, ok := index[st.PackID]; ok {
+			packs[i].Stickers = append(packs[i].Stickers, st.withURL())
+		}
+	}
+	return packs, rows.Err()
+}
+
+// stickerInServer returns a sticker from one of serverID's packs, with the
+// path of its image.
+func (s *serverState) stickerInServer(ctx context.Context, serverID, stickerID int64) (st stickerDTO, imagePath string, found bool, err error) {
+	err = s.readDB.QueryRowContext(ctx, `
+        SELECT st.id, st.pack_id, p.server_id, st.name, st.tags, st.width, st.height, st.image_path
+        FROM stickers st JOIN sticker_packs p ON p.id = st.pack_id
+        WHERE st.id = ? AND p.server_id = ?
+    `, stickerID, serverID).Scan(&st.ID, &st.PackID, &st.ServerID, &st.Name, &st.Tags, &st.Width, &st.Height, &imagePath)
+	if errors.Is(err, sql.ErrNoRows) {
+		return stickerDTO{}, "", false, nil
+	}
+	if err != nil {
+		return stickerDTO{}, "", false, err
+	}
+	return st.withURL(), imagePath, true, nil
+}
+
+// removeStickerImages deletes the images of deleted stickers, unless
+// another sticker was uploaded with the same image.
+func (s *serverState) removeStickerImages(ctx context.Context, paths []string) {
+	for _, path := range paths {
+		var used bool
+		if err := s.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM stickers WHERE image_path = ?)`, path).Scan(&used); err != nil {
+			log.Printf("check sticker image %s: %v", path, err)
+			continue
+		}
+		if !used {
+			s.removeMediaImage(path)
+		}
+	}
+}
+
+func (s *serverState) broadcastStickers(ctx context.Context, serverID int64) {
+	packs, err := s.stickerPacks(ctx, serverID)
+	if err != nil {
+		log.Printf("load sticker packs for broadcast: %v", err)
+		return
+	}
+	s.broadcastToServer(ctx, serverID, wsOutbound{Type: "stickers:update", ServerID: serverID, StickerPacks: packs})
+}
+
+// handleServerSticker serves GET /api/servers/{id}/stickers/{stickerId},
+// the sticker's image, to members of the server.
+func (s *serverState) handleServerSticker(w http.ResponseWriter, r *http.Request, serverID int64, rawStickerID string) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stickerID, err := strconv.ParseInt(rawStickerID, 10, 64)
+	if err != nil {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	_, imagePath, found, err := s.stickerInServer(r.Context(), serverID, stickerID)
+	if err != nil {
+		log.Printf("load sticker: %v", err)
+		httpError(w, "failed to load sticker", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	s.serveMediaImage(w, r, imagePath)
+}
+
+// handleServerStickerPacks serves /api/servers/{id}/sticker-packs. Members
+// can list the packs; owners and admins manage them:
+//
+//	GET, POST           /sticker-packs
+//	PATCH, DELETE       /sticker-packs/{packId}
+//	POST                /sticker-packs/{packId}/stickers
+//	PATCH, DELETE       /sticker-packs/{packId}/stickers/{stickerId}
+func (s *serverState) handleServerStickerPacks(w http.ResponseWriter, r *http.Request, serverID int64, currentUser user, rest []string) {
+	ctx := r.Context()
+	if len(rest) == 0 && r.Method == http.MethodGet {
+		packs, err := s.stickerPacks(ctx, serverID)
+		if err != nil {
+			log.Printf("list sticker packs: %v", err)
+			httpError(w, "failed to list sticker packs", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(packs); err != nil {
+			log.Printf("encode sticker packs: %v", err)
+		}
+		return
+	}
+
+	var allow string
+	switch {
+	case len(rest) == 0:
+		allow = "GET, POST"
+	case len(rest) == 1:
+		allow = "PATCH, DELETE"
+	case len(rest) == 2 && rest[1] == "stickers":
+		allow = "POST"
+	case len(rest) == 3 && rest[1] == "stickers":
+		allow = "PATCH, DELETE"
+	default:
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	if !strings.Contains(allow, r.Method) {
+		w.Header().Set("Allow", allow)
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	canManage, err := s.canManageServer(ctx, currentUser.Email, serverID)
+	if err != nil {
+		log.Printf("check sticker permission: %v", err)
+		httpError(w, "failed to update stickers", http.StatusInternalServerError)
+		return
+	}
+	if !canManage {
+		httpError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if len(rest) == 0 {
+		s.createStickerPack(w, r, serverID, currentUser)
+		return
+	}
+	packID, err := strconv.ParseInt(rest[0], 10, 64)
+	if err != nil {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	var exists bool
+	if err := s.readDB.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM sticker_packs WHERE id = ? AND server_id = ?)`, packID, serverID).Scan(&exists); err != nil {
+		log.Printf("load sticker pack: %v", err)
+		httpError(w, "failed to update stickers", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(rest) == 1 && r.Method == http.MethodPatch:
+		s.updateStickerPack(w, r, serverID, packID, currentUser)
+	case len(rest) == 1:
+		s.deleteStickerPack(w, r, serverID, packID, currentUser)
+	case len(rest) == 2:
+		s.addSticker(w, r, serverID, packID, currentUser)
+	default:
+		stickerID, err := strconv.ParseInt(rest[2], 10, 64)
+		if err != nil {
+			httpError(w, "not found", http.StatusNotFound)
+			return
+		}
+		st, imagePath, found, err := s.stickerInServer(ctx, serverID, stickerID)
+		if err != nil {
+			log.Printf("load sticker: %v", err)
+			httpError(w, "failed to update stickers", http.StatusInternalServerError)
+			return
+		}
+		if !found || st.PackID != packID {
+			httpError(w, "not found", http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodPatch {
+			s.updateSticker(w, r, st, currentUser)
+		} else {
+			s.deleteSticker(w, r, st, imagePath, currentUser)
+		}
+	}
+}
+
+func isStickerNameTaken(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+func (s *serverState) createStickerPack(w http.ResponseWriter, r *http.Request, serverID int64, currentUser user) {
+	var body struct {
+		Name        string `json:"name" validate:"trim,required,max=50"`
+		Description string `json:"description" validate:"trim,max=200"`
+	}
+	if !s.decodeJSON(w, r, &body) {
+		return
+	}
+	ctx := r.Context()
+	pack := stickerPackDTO{ServerID: serverID, Name: body.Name, Description: body.Description, CreatedAt: time.Now().UTC(), Stickers: []stickerDTO{}}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO sticker_packs (server_id, name, description, created_at) VALUES (?, ?, ?, ?)`,
+		serverID, pack.Name, pack.Description, pack.CreatedAt)
+	if isStickerNameTaken(err) {
+		httpError(w, "a sticker pack with that name already exists", http.StatusConflict)
+		return
+	}
+	if err == nil {
+		pack.ID, err = res.LastInsertId()
+	}
+	if err != nil {
+		log.Printf("create sticker pack: %v", err)
+		httpError(w, "failed to create sticker pack", http.StatusInternalServerError)
+		return
+	}
+	s.recordAudit(ctx, serverID, currentUser.Email, "sticker_pack.create", "sticker_pack", strconv.FormatInt(pack.ID, 10), pack.Name)
+	s.broadcastStickers(ctx, serverID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(pack); err != nil {
+		log.Printf("encode sticker pack: %v", err)
+	}
+}
+
+func (s *serverState) updateStickerPack(w http.ResponseWriter, r *http.Request, serverID, packID int64, currentUser user) {
+	var body struct {
+		Name        *string `json:"name" validate:"trim,required,max=50"`
+		Description *string `json:"description" validate:"trim,max=200"`
+	}
+	if !s.decodeJSON(w, r, &body) {
+		return
+	}
+	ctx := r.Context()
+	_, err := s.db.ExecContext(ctx, `UPDATE sticker_packs SET name = COALESCE(?, name), description = COALESCE(?, description) WHERE id = ?`,
+		body.Name, body.Description, packID)
+	if isStickerNameTaken(err) {
+		httpError(w, "a sticker pack with that name already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("update sticker pack: %v", err)
+		httpError(w, "failed to update sticker pack", http.StatusInternalServerError)
+		return
+	}
+	s.recordAudit(ctx, serverID, currentUser.Email, "sticker_pack.update", "sticker_pack", strconv.FormatInt(packID, 10), "")
+	s.broadcastStickers(ctx, serverID)
+	s.writeStickerPack(w, r, serverID, packID)
+}
+
+func (s *serverState) writeStickerPack(w http.ResponseWriter, r *http.Request, serverID, packID int64) {
+	packs, err := s.stickerPacks(r.Context(), serverID)
+	if err != nil {
+		log.Printf("load sticker packs: %v", err)
+		httpError(w, "failed to load sticker pack", http.StatusInternalServerError)
+		return
+	}
+	for _, pack := range packs {
+		if pack.ID == packID {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(pack); err != nil {
+				log.Printf("encode sticker pack: %v", err)
+			}
+			return
+		}
+	}
+	httpError(w, "not found", http.StatusNotFound)
+}
+
+func (s *serverState) deleteStickerPack(w http.ResponseWriter, r *http.Request, serverID, packID int64, currentUser user) {
+	ctx := r.Context()
+	rows, err := s.readDB.QueryContext(ctx, `SELECT image_path FROM stickers WHERE pack_id = ?`, packID)
+	if err != nil {
+		log.Printf("load sticker images: %v", err)
+		httpError(w, "failed to delete sticker pack", http.StatusInternalServerError)
+		return
+	}
+	var images []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			log.Printf("load sticker images: %v", err)
+			httpError(w, "failed to delete sticker pack", http.StatusInternalServerError)
+			return
+		}
+		images = append(images, path)
+	}
+	rows.Close()
+
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM sticker_packs WHERE id = ?`, packID); err != nil {
+		log.Printf("delete sticker pack: %v", err)
+		httpError(w, "failed to delete sticker pack", http.StatusInternalServerError)
+		return
+	}
+	s.removeStickerImages(ctx, images)
+	s.recordAudit(ctx, serverID, currentUser.Email, "sticker_pack.delete", "sticker_pack", strconv.FormatInt(packID, 10), "")
+	s.broadcastStickers(ctx, serverID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *serverState) addSticker(w http.ResponseWriter, r *http.Request, serverID, packID int64, currentUser user) {
+	var body struct {
+		Name  string `json:"name" validate:"trim,required,min=2,max=30"`
+		Tags  string `json:"tags" validate:"trim,max=100"`
+		Image string `json:"image" validate:"required"`
+	}
+	// The image travels base64 encoded in the body.
+	if !decodeJSONLimit(w, r, &body, 2*maxStickerBytes) {
+		return
+	}
+	ctx := r.Context()
+
+	var count int
+	if err := s.readDB.QueryRowContext(ctx, `
+        SELECT COUNT(*) FROM stickers st JOIN sticker_packs p ON p.id = st.pack_id WHERE p.server_id = ?
+    `, serverID).Scan(&count); err != nil {
+		log.Printf("count stickers: %v", err)
+		httpError(w, "failed to add sticker", http.StatusInternalServerError)
+		return
+	}
+	if count >= maxStickersPerServer {
+		httpError(w, fmt.Sprintf("a server can have at most %d stickers", maxStickersPerServer), http.StatusConflict)
+		return
+	}
+
+	raw, err := decodeImageDataURL(body.Image, "image", maxStickerBytes)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var imgErr *imageError
+	imagePath, img, err := s.storeMediaImage(ctx, "stickers", strconv.FormatInt(serverID, 10), raw, stickerThumbnailSizes)
+	if errors.As(err, &imgErr) {
+		httpError(w, "image: "+err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("store sticker image: %v", err)
+		httpError(w, "failed to store sticker", http.StatusInternalServerError)
+		return
+	}
+
+	st := stickerDTO{PackID: packID, ServerID: serverID, Name: body.Name, Tags: body.Tags, Width: img.width, Height: img.height}
+	res, err := s.db.ExecContext(ctx, `
+        INSERT INTO stickers (pack_id, name, tags, image_path, width, height, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+    `, packID, st.Name, st.Tags, imagePath, st.Width, st.Height, time.Now().UTC())
+	if err == nil {
+		st.ID, err = res.LastInsertId()
+	}
+	if err != nil {
+		s.removeStickerImages(ctx, []string{imagePath})
+		if isStickerNameTaken(err) {
+			httpError(w, "a sticker with that name is already in the pack", http.StatusConflict)
+			return
+		}
+		log.Printf("add sticker: %v", err)
+		httpError(w, "failed to add sticker", http.StatusInternalServerError)
+		return
+	}
+	s.recordAudit(ctx, serverID, currentUser.Email, "sticker.create", "sticker", strconv.FormatInt(st.ID, 10), st.Name)
+	s.broadcastStickers(ctx, serverID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(st.withURL()); err != nil {
+		log.Printf("encode sticker: %v", err)
+	}
+}
+
+func (s *serverState) updateSticker(w http.ResponseWriter, r *http.Request, st stickerDTO, currentUser user) {
+	var body struct {
+		Name *string `json:"name" validate:"trim,required,min=2,max=30"`
+		Tags *string `json:"tags" validate:"trim,max=100"`
+	}
+	if !s.decodeJSON(w, r, &body) {
+		return
+	}
+	if body.Name != nil {
+		st.Name = *body.Name
+	}
+	if body.Tags != nil {
+		st.Tags = *body.Tags
+	}
+	ctx := r.Context()
+	_, err := s.db.ExecContext(ctx, `UPDATE stickers SET name = ?, tags = ? WHERE id = ?`, st.Name, st.Tags, st.ID)
+	if isStickerNameTaken(err) {
+		httpError(w, "a sticker with that name is already in the pack", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("update sticker: %v", err)
+		httpError(w, "failed to update sticker", http.StatusInternalServerError)
+		return
+	}
+	s.recordAudit(ctx, st.ServerID, currentUser.Email, "sticker.update", "sticker", strconv.FormatInt(st.ID, 10), "")
+	s.broadcastStickers(ctx, st.ServerID)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		log.Printf("encode sticker: %v", err)
+	}
+}
+
+func (s *serverState) deleteSticker(w http.ResponseWriter, r *http.Request, st stickerDTO, imagePath string, currentUser user) {
+	ctx := r.Context()
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM stickers WHERE id = ?`, st.ID); err != nil {
+		log.Printf("delete sticker: %v", err)
+		httpError(w, "failed to delete sticker", http.StatusInternalServerError)
+		return
+	}
+	s.removeStickerImages(ctx, []string{imagePath})
+	s.recordAudit(ctx, st.ServerID, currentUser.Email, "sticker.delete", "sticker", strconv.FormatInt(st.ID, 10), st.Name)
+	s.broadcastStickers(ctx, st.ServerID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -3,17 +3,32 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type serverInfo struct {
-	ID        int64
-	Slug      string
-	Name      string
-	CreatedAt time.Time
+	ID                   int64
+	Slug                 string
+	Name                 string
+	CreatedAt            time.Time
+	Description          string
+	IconPath             string
+	DefaultNotifications string
+	SystemChannelID      sql.NullInt64
+	Rules                string // new members accept these before posting
+}
+
+const serverColumns = `srv.id, srv.slug, srv.name, srv.created_at, srv.description, srv.icon_path, srv.default_notifications, srv.system_channel_id, srv.rules`
+
+func scanServer(row interface{ Scan(...any) error }) (serverInfo, error) {
+	var srv serverInfo
+	err := row.Scan(&srv.ID, &srv.Slug, &srv.Name, &srv.CreatedAt, &srv.Description, &srv.IconPath, &srv.DefaultNotifications, &srv.SystemChannelID, &srv.Rules)
+	return srv, err
 }
 
 type channelInfo struct {
@@ -23,141 +38,1440 @@ type channelInfo struct {
 	Name      string
 	Kind      string
 	CreatedAt time.Time
+	PostRoles string // comma separated; empty means everyone may post
+	Topic     string
+	Emoji     string // shown before the name; EmojiPath is an uploaded one
+	EmojiPath string
+}
+
+const channelColumns = `id, server_id, slug, name, kind, created_at, post_roles, topic, emoji, emoji_path`
+
+func scanChannel(row interface{ Scan(...any) error }) (channelInfo, error) {
+	var ch channelInfo
+	err := row.Scan(&ch.ID, &ch.ServerID, &ch.Slug, &ch.Name, &ch.Kind, &ch.CreatedAt, &ch.PostRoles, &ch.Topic, &ch.Emoji, &ch.EmojiPath)
+	return ch, err
 }
 
 type memberInfo struct {
-	Email       string
-	DisplayName string
-	JoinedAt    time.Time
-	Role        string
+	ID          int64        `json:"id"`
+	Email       string       `json:"-"`
+	Handle      string       `json:"handle"`
+	DisplayName string       `json:"displayName"`
+	JoinedAt    time.Time    `json:"joinedAt"`
+	Role        string       `json:"role"`
+	Presence    *presenceDTO `json:"presence,omitempty"`
+	// Color and Hoisted come from the settings of the member's role.
+	Color   string `json:"color,omitempty"`
+	Hoisted bool   `json:"hoisted,omitempty"`
 }
 
 type chatMessage struct {
 	ID                int64
 	ChannelID         int64
 	AuthorEmail       string
+	AuthorID          int64
+	AuthorHandle      string
 	AuthorDisplayName string
 	Content           string
 	CreatedAt         time.Time
+	// AuthorColor is the color of the author's role in the channel's server.
+	AuthorColor sql.NullString
+
+	OriginMessageID         sql.NullInt64
+	OriginChannelID         sql.NullInt64
+	OriginAuthorEmail       sql.NullString
+	OriginAuthorID          sql.NullInt64
+	OriginAuthorHandle      sql.NullString
+	OriginAuthorDisplayName sql.NullString
+	CrosspostedAt           sql.NullTime
+
+	// Nonce is the client-generated id the author sent the message with.
+	Nonce string
+	// ExpiresAt is set on self-destructing messages.
+	ExpiresAt   sql.NullTime
+	Attachments []attachmentDTO
+	// Transcript is set on voice messages once transcription was queued.
+	Transcript *transcriptDTO
+	// StickerID is set on sticker messages; Sticker is nil once the
+	// sticker has been deleted.
+	StickerID sql.NullInt64
+	Sticker   *stickerDTO
+}
+
+// expired reports whether a self-destructing message's timer has run out,
+// even if the sweeper has not deleted it yet.
+func (m chatMessage) expired(now time.Time) bool {
+	return m.ExpiresAt.Valid && !m.ExpiresAt.Time.After(now)
+}
+
+const messageSelect = `
+        SELECT m.id, m.channel_id, u.email, u.id, u.handle, u.display_name, m.content, m.created_at,
+               m.origin_message_id, m.origin_channel_id, ou.email, ou.id, ou.handle, ou.display_name, m.crossposted_at,
+               COALESCE(m.client_nonce, ''), m.expires_at,
+               (SELECT json_group_array(json_object('id', a.id, 'filename', a.filename, 'contentType', a.content_type, 'size', a.size,
+                        'width', b.width, 'height', b.height, 'status', NULLIF(b.scan_status, 'clean'),
+                        'voice', CASE WHEN a.voice THEN json('true') END, 'durationMs', a.duration_ms,
+                        'thumbnails', json((SELECT json_group_array(json_object('size', t.size, 'width', t.width, 'height', t.height))
+                                            FROM attachment_thumbnails t WHERE t.blob_hash = a.blob_hash))))
+                FROM message_attachments a JOIN attachment_blobs b ON b.hash = a.blob_hash WHERE a.message_id = m.id),
+               (SELECT json_object('status', t.status, 'text', t.text, 'language', t.language)
+                FROM message_transcripts t WHERE t.message_id = m.id),
+               m.sticker_id,
+               (SELECT json_object('id', st.id, 'packId', st.pack_id, 'serverId', p.server_id, 'name', st.name, 'tags', st.tags, 'width', st.width, 'height', st.height)
+                FROM stickers st JOIN sticker_packs p ON p.id = st.pack_id WHERE st.id = m.sticker_id),
+               (SELECT NULLIF(r.color, '') FROM channels c
+                JOIN server_members sm ON sm.server_id = c.server_id AND sm.user_id = m.author_id
+                JOIN server_roles r ON r.server_id = sm.server_id AND r.role = sm.role
+                WHERE c.id = m.channel_id)
+        FROM channel_messages m
+        JOIN users u ON u.id = m.author_id
+        LEFT JOIN users ou ON ou.id = m.origin_author_id
+`
+
+func scanMessage(row interface{ Scan(...any) error }) (chatMessage, error) {
+	var msg chatMessage
+	var attachments string
+	var transcript, sticker sql.NullString
+	err := row.Scan(&msg.ID, &msg.ChannelID, &msg.AuthorEmail, &msg.AuthorID, &msg.AuthorHandle, &msg.AuthorDisplayName, &msg.Content, &msg.CreatedAt,
+		&msg.OriginMessageID, &msg.OriginChannelID, &msg.OriginAuthorEmail, &msg.OriginAuthorID, &msg.OriginAuthorHandle, &msg.OriginAuthorDisplayName, &msg.CrosspostedAt,
+		&msg.Nonce, &msg.ExpiresAt, &attachments, &transcript, &msg.StickerID, &sticker, &msg.AuthorColor)
+	if err == nil && attachments != "[]" {
+		err = json.Unmarshal([]byte(attachments), &msg.Attachments)
+	}
+	if err == nil && transcript.Valid {
+		err = json.Unmarshal([]byte(transcript.String), &msg.Transcript)
+	}
+	if err == nil && sticker.Valid {
+		err = json.Unmarshal([]byte(sticker.String), &msg.Sticker)
+	}
+	return msg, err
+}
+
+func addColumnIfMissing(ctx context.Context, db *sql.DB, table, column string) error {
+	if _, err := db.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN "+column); err != nil {
+		if !strings.Contains(strings.ToLower(err.Error()), "duplicate column name") {
+			return err
+		}
+	}
+	return nil
+}
+
+// The tables below reference users by id. Their schemas are functions so the
+// migration from email references can create them under a temporary name.
+
+func serverMembersSchema(table string) string {
+	return `
+    CREATE TABLE IF NOT EXISTS ` + table + ` (
+        server_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        role TEXT NOT NULL DEFAULT 'member',
+        joined_at TIMESTAMP NOT NULL,
+        PRIMARY KEY (server_id, user_id),
+        FOREIGN KEY(server_id) REFERENCES servers(id) ON DELETE CASCADE,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`
+}
+
+func channelMessagesSchema(table string) string {
+	return `
+    CREATE TABLE IF NOT EXISTS ` + table + ` (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        channel_id INTEGER NOT NULL,
+        author_id INTEGER NOT NULL,
+        content TEXT NOT NULL,
+        created_at TIMESTAMP NOT NULL,
+        origin_message_id INTEGER,
+        origin_channel_id INTEGER,
+        origin_author_id INTEGER,
+        crossposted_at TIMESTAMP,
+        client_nonce TEXT,
+        expires_at TIMESTAMP,
+        sticker_id INTEGER,
+        FOREIGN KEY(channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+        FOREIGN KEY(author_id) REFERENCES users(id) ON DELETE CASCADE,
+        FOREIGN KEY(origin_author_id) REFERENCES users(id) ON DELETE SET NULL
+    );`
+}
+
+func sessionsSchema(table string) string {
+	return `
+    CREATE TABLE IF NOT EXISTS ` + table + ` (
+        token_hash TEXT PRIMARY KEY,
+        user_id INTEGER NOT NULL,
+        remember INTEGER NOT NULL DEFAULT 0,
+        created_at TIMESTAMP NOT NULL,
+        expires_at TIMESTAMP NOT NULL,
+        client_ip TEXT NOT NULL DEFAULT '',
+        device_id TEXT NOT NULL DEFAULT '',
+        device_name TEXT NOT NULL DEFAULT '',
+        user_agent TEXT NOT NULL DEFAULT '',
+        last_seen_at TIMESTAMP,
+        unsigned_cookie INTEGER NOT NULL DEFAULT 1,
+        kind TEXT NOT NULL DEFAULT 'browser',
+        scopes TEXT NOT NULL DEFAULT '',
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`
+}
+
+func messageAttachmentsSchema(table string) string {
+	return `
+    CREATE TABLE IF NOT EXISTS ` + table + ` (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        message_id INTEGER NOT NULL,
+        filename TEXT NOT NULL,
+        content_type TEXT NOT NULL,
+        size INTEGER NOT NULL,
+        blob_hash TEXT NOT NULL,
+        created_at TIMESTAMP NOT NULL,
+        voice INTEGER NOT NULL DEFAULT 0,
+        duration_ms INTEGER,
+        FOREIGN KEY(message_id) REFERENCES channel_messages(id) ON DELETE CASCADE,
+        FOREIGN KEY(blob_hash) REFERENCES attachment_blobs(hash)
+    );`
 }
 
-func ensureSchema(ctx context.Context, db *sql.DB) error {
-	if _, err := db.ExecContext(ctx, "PRAGMA foreign_keys = ON"); err != nil {
+func ensureSchema(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, "PRAGMA foreign_keys = ON"); err != nil {
+		return err
+	}
+
+	const usersTable = `
+    CREATE TABLE IF NOT EXISTS users (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        email TEXT NOT NULL UNIQUE,
+        handle TEXT NOT NULL,
+        display_name TEXT NOT NULL,
+        password_hash BLOB NOT NULL,
+        created_at TIMESTAMP NOT NULL,
+        is_admin INTEGER NOT NULL DEFAULT 0,
+        status TEXT NOT NULL DEFAULT 'active'
+    );`
+	if _, err := db.ExecContext(ctx, usersTable); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "users", "is_admin INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "users", "status TEXT NOT NULL DEFAULT 'active'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "users", "mask_profanity INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "users", "voice_mode TEXT NOT NULL DEFAULT 'vad'"); err != nil {
+		return err
+	}
+	if err := migrateUserIDs(ctx, db); err != nil {
+		return fmt.Errorf("migrate users: %w", err)
+	}
+	// Empty means the instance default (DEFAULT_LOCALE, DEFAULT_TIMEZONE).
+	if err := addColumnIfMissing(ctx, db, "users", "locale TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "users", "timezone TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "users", "theme TEXT NOT NULL DEFAULT 'system'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "users", "compact_mode INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "users", "font_size TEXT NOT NULL DEFAULT 'normal'"); err != nil {
+		return err
+	}
+	// presence is what the user picked (online, away, dnd or invisible);
+	// status above is the account's state.
+	if err := addColumnIfMissing(ctx, db, "users", "presence TEXT NOT NULL DEFAULT 'online'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "users", "custom_status_text TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "users", "custom_status_emoji TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "users", "custom_status_expires_at TIMESTAMP"); err != nil {
+		return err
+	}
+	// Quiet hours are HH:MM in the user's timezone; empty means none.
+	if err := addColumnIfMissing(ctx, db, "users", "quiet_hours_start TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "users", "quiet_hours_end TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "users", "share_presence TEXT NOT NULL DEFAULT 'everyone'"); err != nil {
+		return err
+	}
+	// Handles are unique within a tenant; 0 is the root tenant, which every
+	// account belongs to unless TENANT_MODE is on.
+	if err := addColumnIfMissing(ctx, db, "users", "tenant_id INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := migrateTenantHandles(ctx, db); err != nil {
+		return fmt.Errorf("migrate handles: %w", err)
+	}
+	const usersHandleIndex = `
+    CREATE UNIQUE INDEX IF NOT EXISTS idx_users_tenant_handle ON users(tenant_id, handle);`
+	if _, err := db.ExecContext(ctx, usersHandleIndex); err != nil {
+		return err
+	}
+
+	const serversTable = `
+    CREATE TABLE IF NOT EXISTS servers (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        slug TEXT NOT NULL UNIQUE,
+        name TEXT NOT NULL,
+        created_at TIMESTAMP NOT NULL
+    );`
+	if _, err := db.ExecContext(ctx, serversTable); err != nil {
+		return err
+	}
+
+	for _, column := range []string{
+		"description TEXT NOT NULL DEFAULT ''",
+		"icon_path TEXT NOT NULL DEFAULT ''",
+		"default_notifications TEXT NOT NULL DEFAULT 'all'",
+		"system_channel_id INTEGER REFERENCES channels(id) ON DELETE SET NULL",
+		"rules TEXT NOT NULL DEFAULT ''",
+		"tenant_id INTEGER NOT NULL DEFAULT 0",
+	} {
+		if err := addColumnIfMissing(ctx, db, "servers", column); err != nil {
+			return err
+		}
+	}
+
+	// Tenants other than the root one (id 0, which has no row). Each gets a
+	// home server that its accounts join, like the instance's default server.
+	const tenantsTable = `
+    CREATE TABLE IF NOT EXISTS tenants (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        slug TEXT NOT NULL UNIQUE,
+        name TEXT NOT NULL,
+        home_server_id INTEGER NOT NULL REFERENCES servers(id),
+        created_at TIMESTAMP NOT NULL
+    );`
+	if _, err := db.ExecContext(ctx, tenantsTable); err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, serverMembersSchema("server_members")); err != nil {
+		return err
+	}
+
+	const channelsTable = `
+    CREATE TABLE IF NOT EXISTS channels (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        server_id INTEGER NOT NULL,
+        slug TEXT NOT NULL,
+        name TEXT NOT NULL,
+        kind TEXT NOT NULL DEFAULT 'text',
+        created_at TIMESTAMP NOT NULL,
+        UNIQUE(server_id, slug),
+        FOREIGN KEY(server_id) REFERENCES servers(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, channelsTable); err != nil {
+		return err
+	}
+
+	if err := addColumnIfMissing(ctx, db, "channels", "kind TEXT NOT NULL DEFAULT 'text'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "channels", "post_roles TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "channels", "topic TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "channels", "emoji TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "channels", "emoji_path TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, channelMessagesSchema("channel_messages")); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "channel_messages", "client_nonce TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "channel_messages", "expires_at TIMESTAMP"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "channel_messages", "sticker_id INTEGER"); err != nil {
+		return err
+	}
+
+	const dmParticipantsTable = `
+    CREATE TABLE IF NOT EXISTS dm_participants (
+        channel_id INTEGER NOT NULL,
+        user_email TEXT NOT NULL,
+        PRIMARY KEY (channel_id, user_email),
+        FOREIGN KEY(channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+        FOREIGN KEY(user_email) REFERENCES users(email) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, dmParticipantsTable); err != nil {
+		return err
+	}
+
+	const channelFollowsTable = `
+    CREATE TABLE IF NOT EXISTS channel_follows (
+        source_channel_id INTEGER NOT NULL,
+        target_channel_id INTEGER NOT NULL,
+        created_by_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+        created_at TIMESTAMP NOT NULL,
+        PRIMARY KEY (source_channel_id, target_channel_id),
+        FOREIGN KEY(source_channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+        FOREIGN KEY(target_channel_id) REFERENCES channels(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, channelFollowsTable); err != nil {
+		return err
+	}
+
+	const auditLogTable = `
+    CREATE TABLE IF NOT EXISTS audit_log (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        server_id INTEGER,
+        actor_email TEXT NOT NULL,
+        action TEXT NOT NULL,
+        target_type TEXT NOT NULL,
+        target_id TEXT NOT NULL,
+        details TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMP NOT NULL,
+        FOREIGN KEY(server_id) REFERENCES servers(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, auditLogTable); err != nil {
+		return err
+	}
+
+	const reportsTable = `
+    CREATE TABLE IF NOT EXISTS reports (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        server_id INTEGER,
+        reporter_email TEXT NOT NULL,
+        message_id INTEGER,
+        message_content TEXT NOT NULL DEFAULT '',
+        target_email TEXT NOT NULL,
+        reason TEXT NOT NULL,
+        status TEXT NOT NULL DEFAULT 'open',
+        created_at TIMESTAMP NOT NULL,
+        resolved_by TEXT,
+        resolved_at TIMESTAMP,
+        resolution_note TEXT NOT NULL DEFAULT '',
+        FOREIGN KEY(server_id) REFERENCES servers(id) ON DELETE CASCADE,
+        FOREIGN KEY(reporter_email) REFERENCES users(email) ON DELETE CASCADE,
+        FOREIGN KEY(message_id) REFERENCES channel_messages(id) ON DELETE SET NULL
+    );`
+	if _, err := db.ExecContext(ctx, reportsTable); err != nil {
+		return err
+	}
+
+	const reportsIndex = `
+    CREATE INDEX IF NOT EXISTS idx_reports_server_status
+    ON reports(server_id, status);
+    `
+	if _, err := db.ExecContext(ctx, reportsIndex); err != nil {
+		return err
+	}
+
+	const remindersTable = `
+    CREATE TABLE IF NOT EXISTS reminders (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_email TEXT NOT NULL,
+        channel_id INTEGER,
+        message_id INTEGER,
+        content TEXT NOT NULL,
+        remind_at TIMESTAMP NOT NULL,
+        created_at TIMESTAMP NOT NULL,
+        delivered_at TIMESTAMP,
+        FOREIGN KEY(user_email) REFERENCES users(email) ON DELETE CASCADE,
+        FOREIGN KEY(channel_id) REFERENCES channels(id) ON DELETE SET NULL,
+        FOREIGN KEY(message_id) REFERENCES channel_messages(id) ON DELETE SET NULL
+    );`
+	if _, err := db.ExecContext(ctx, remindersTable); err != nil {
+		return err
+	}
+
+	const remindersIndex = `
+    CREATE INDEX IF NOT EXISTS idx_reminders_due
+    ON reminders(delivered_at, remind_at);
+    `
+	if _, err := db.ExecContext(ctx, remindersIndex); err != nil {
+		return err
+	}
+
+	// Notifications held during a user's quiet hours, mailed as one digest
+	// when they end.
+	const heldNotificationsTable = `
+    CREATE TABLE IF NOT EXISTS held_notifications (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id INTEGER NOT NULL,
+        channel_id INTEGER NOT NULL,
+        author_name TEXT NOT NULL,
+        author_handle TEXT NOT NULL,
+        excerpt TEXT NOT NULL,
+        created_at TIMESTAMP NOT NULL,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+        FOREIGN KEY(channel_id) REFERENCES channels(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, heldNotificationsTable); err != nil {
+		return err
+	}
+
+	const heldNotificationsIndex = `
+    CREATE INDEX IF NOT EXISTS idx_held_notifications_user
+    ON held_notifications(user_id);
+    `
+	if _, err := db.ExecContext(ctx, heldNotificationsIndex); err != nil {
+		return err
+	}
+
+	// One row per direction: a request or block is the sender's row alone,
+	// an accepted friendship has both.
+	const friendshipsTable = `
+    CREATE TABLE IF NOT EXISTS friendships (
+        user_id INTEGER NOT NULL,
+        friend_id INTEGER NOT NULL,
+        status TEXT NOT NULL,
+        created_at TIMESTAMP NOT NULL,
+        PRIMARY KEY (user_id, friend_id),
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+        FOREIGN KEY(friend_id) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, friendshipsTable); err != nil {
+		return err
+	}
+
+	const friendshipsIndex = `
+    CREATE INDEX IF NOT EXISTS idx_friendships_friend
+    ON friendships(friend_id, status);
+    `
+	if _, err := db.ExecContext(ctx, friendshipsIndex); err != nil {
+		return err
+	}
+
+	// Settings for the built-in roles; a role without a row has no color and
+	// is not hoisted.
+	const serverRolesTable = `
+    CREATE TABLE IF NOT EXISTS server_roles (
+        server_id INTEGER NOT NULL,
+        role TEXT NOT NULL,
+        color TEXT NOT NULL DEFAULT '',
+        hoist BOOLEAN NOT NULL DEFAULT 0,
+        PRIMARY KEY (server_id, role),
+        FOREIGN KEY(server_id) REFERENCES servers(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, serverRolesTable); err != nil {
+		return err
+	}
+
+	// Per-channel permission overrides; allow and deny are channelPermission
+	// bit sets applied on top of the role's defaults, roles first.
+	const channelRoleOverridesTable = `
+    CREATE TABLE IF NOT EXISTS channel_role_overrides (
+        channel_id INTEGER NOT NULL,
+        role TEXT NOT NULL,
+        allow INTEGER NOT NULL DEFAULT 0,
+        deny INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY (channel_id, role),
+        FOREIGN KEY(channel_id) REFERENCES channels(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, channelRoleOverridesTable); err != nil {
+		return err
+	}
+
+	const channelMemberOverridesTable = `
+    CREATE TABLE IF NOT EXISTS channel_member_overrides (
+        channel_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        allow INTEGER NOT NULL DEFAULT 0,
+        deny INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY (channel_id, user_id),
+        FOREIGN KEY(channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, channelMemberOverridesTable); err != nil {
+		return err
+	}
+
+	const channelAccessGrantsTable = `
+    CREATE TABLE IF NOT EXISTS channel_access_grants (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        channel_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        allow INTEGER NOT NULL,
+        granted_by_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+        created_at TIMESTAMP NOT NULL,
+        expires_at TIMESTAMP NOT NULL,
+        FOREIGN KEY(channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, channelAccessGrantsTable); err != nil {
+		return err
+	}
+
+	const channelAccessGrantsIndex = `
+    CREATE INDEX IF NOT EXISTS idx_channel_access_grants_channel ON channel_access_grants(channel_id, user_id);`
+	if _, err := db.ExecContext(ctx, channelAccessGrantsIndex); err != nil {
+		return err
+	}
+
+	const channelAccessGrantsExpiryIndex = `
+    CREATE INDEX IF NOT EXISTS idx_channel_access_grants_expires ON channel_access_grants(expires_at);`
+	if _, err := db.ExecContext(ctx, channelAccessGrantsExpiryIndex); err != nil {
+		return err
+	}
+
+	const settingsTable = `
+    CREATE TABLE IF NOT EXISTS instance_settings (
+        key TEXT PRIMARY KEY,
+        value TEXT NOT NULL,
+        updated_at TIMESTAMP NOT NULL
+    );`
+	if _, err := db.ExecContext(ctx, settingsTable); err != nil {
+		return err
+	}
+
+	const invitesTable = `
+    CREATE TABLE IF NOT EXISTS registration_invites (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        token_hash TEXT NOT NULL UNIQUE,
+        created_by TEXT NOT NULL,
+        created_at TIMESTAMP NOT NULL,
+        expires_at TIMESTAMP,
+        max_uses INTEGER NOT NULL DEFAULT 1,
+        uses INTEGER NOT NULL DEFAULT 0,
+        revoked_at TIMESTAMP
+    );`
+	if _, err := db.ExecContext(ctx, invitesTable); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "registration_invites", "tenant_id INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	const loginAttemptsTable = `
+    CREATE TABLE IF NOT EXISTS login_attempts (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id INTEGER,
+        login TEXT NOT NULL,
+        client_ip TEXT NOT NULL,
+        user_agent TEXT NOT NULL DEFAULT '',
+        outcome TEXT NOT NULL,
+        created_at TIMESTAMP NOT NULL,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, loginAttemptsTable); err != nil {
+		return err
+	}
+
+	const loginAttemptsUserIndex = `
+    CREATE INDEX IF NOT EXISTS idx_login_attempts_user ON login_attempts(user_id, created_at);`
+	if _, err := db.ExecContext(ctx, loginAttemptsUserIndex); err != nil {
+		return err
+	}
+
+	const loginAttemptsCreatedIndex = `
+    CREATE INDEX IF NOT EXISTS idx_login_attempts_created ON login_attempts(created_at);`
+	if _, err := db.ExecContext(ctx, loginAttemptsCreatedIndex); err != nil {
+		return err
+	}
+
+	// login_failures counts recent failed logins per subject, "user:<id>" or
+	// "ip:<address>", and how many lockouts in a row it has had.
+	const loginFailuresTable = `
+    CREATE TABLE IF NOT EXISTS login_failures (
+        subject TEXT PRIMARY KEY,
+        failures INTEGER NOT NULL DEFAULT 0,
+        level INTEGER NOT NULL DEFAULT 0,
+        locked_until TIMESTAMP,
+        last_failure_at TIMESTAMP NOT NULL
+    );`
+	if _, err := db.ExecContext(ctx, loginFailuresTable); err != nil {
+		return err
+	}
+
+	// scim_users links accounts to the directory that provisions them over
+	// SCIM. A deprovisioned account keeps its row, with its userName
+	// released, until it is provisioned again.
+	const scimUsersTable = `
+    CREATE TABLE IF NOT EXISTS scim_users (
+        user_id INTEGER PRIMARY KEY,
+        user_name TEXT NOT NULL,
+        external_id TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMP NOT NULL,
+        updated_at TIMESTAMP NOT NULL,
+        deprovisioned_at TIMESTAMP,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, scimUsersTable); err != nil {
+		return err
+	}
+	const scimUsersNameIndex = `
+    CREATE UNIQUE INDEX IF NOT EXISTS idx_scim_users_name
+    ON scim_users(user_name COLLATE NOCASE) WHERE user_name != '';`
+	if _, err := db.ExecContext(ctx, scimUsersNameIndex); err != nil {
+		return err
+	}
+
+	// saml_requests holds the IDs of AuthnRequests awaiting the IdP's
+	// response; saml_identities links accounts to their SAML NameID.
+	const samlRequestsTable = `
+    CREATE TABLE IF NOT EXISTS saml_requests (
+        id TEXT PRIMARY KEY,
+        created_at TIMESTAMP NOT NULL,
+        expires_at TIMESTAMP NOT NULL
+    );`
+	if _, err := db.ExecContext(ctx, samlRequestsTable); err != nil {
+		return err
+	}
+	const samlIdentitiesTable = `
+    CREATE TABLE IF NOT EXISTS saml_identities (
+        user_id INTEGER PRIMARY KEY,
+        issuer TEXT NOT NULL,
+        name_id TEXT NOT NULL,
+        created_at TIMESTAMP NOT NULL,
+        last_login_at TIMESTAMP NOT NULL,
+        UNIQUE (issuer, name_id),
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, samlIdentitiesTable); err != nil {
+		return err
+	}
+
+	// outbox holds message events waiting to be published; see outbox.go.
+	const outboxTable = `
+    CREATE TABLE IF NOT EXISTS outbox (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        type TEXT NOT NULL,
+        channel_id INTEGER NOT NULL,
+        message_id INTEGER NOT NULL,
+        created_at TIMESTAMP NOT NULL
+    );`
+	if _, err := db.ExecContext(ctx, outboxTable); err != nil {
+		return err
+	}
+
+	// jobs is the background job queue; see jobs.go.
+	const jobsTable = `
+    CREATE TABLE IF NOT EXISTS jobs (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        kind TEXT NOT NULL,
+        payload TEXT NOT NULL DEFAULT '{}',
+        status TEXT NOT NULL,
+        attempts INTEGER NOT NULL DEFAULT 0,
+        max_attempts INTEGER NOT NULL,
+        run_at TIMESTAMP NOT NULL,
+        locked_until TIMESTAMP,
+        last_error TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMP NOT NULL,
+        finished_at TIMESTAMP
+    );`
+	if _, err := db.ExecContext(ctx, jobsTable); err != nil {
+		return err
+	}
+	const jobsIndex = `
+    CREATE INDEX IF NOT EXISTS idx_jobs_status_run_at
+    ON jobs(status, run_at);
+    `
+	if _, err := db.ExecContext(ctx, jobsIndex); err != nil {
+		return err
+	}
+
+	const idempotencyKeysTable = `
+    CREATE TABLE IF NOT EXISTS idempotency_keys (
+        user_id INTEGER NOT NULL,
+        key TEXT NOT NULL,
+        fingerprint TEXT NOT NULL,
+        status INTEGER NOT NULL DEFAULT 0,
+        content_type TEXT NOT NULL DEFAULT '',
+        body BLOB,
+        created_at TIMESTAMP NOT NULL,
+        expires_at TIMESTAMP NOT NULL,
+        PRIMARY KEY (user_id, key),
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, idempotencyKeysTable); err != nil {
+		return err
+	}
+
+	const emailChangesTable = `
+    CREATE TABLE IF NOT EXISTS email_changes (
+        user_id INTEGER PRIMARY KEY,
+        new_email TEXT NOT NULL,
+        new_token_hash TEXT NOT NULL UNIQUE,
+        old_token_hash TEXT NOT NULL UNIQUE,
+        created_at TIMESTAMP NOT NULL,
+        expires_at TIMESTAMP NOT NULL,
+        new_confirmed_at TIMESTAMP,
+        old_confirmed_at TIMESTAMP,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, emailChangesTable); err != nil {
+		return err
+	}
+
+	const messageStarsTable = `
+    CREATE TABLE IF NOT EXISTS message_stars (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id INTEGER NOT NULL,
+        message_id INTEGER NOT NULL,
+        created_at TIMESTAMP NOT NULL,
+        UNIQUE (user_id, message_id),
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+        FOREIGN KEY(message_id) REFERENCES channel_messages(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, messageStarsTable); err != nil {
+		return err
+	}
+	const messageStarsIndex = `
+    CREATE INDEX IF NOT EXISTS idx_message_stars_message
+    ON message_stars(message_id);
+    `
+	if _, err := db.ExecContext(ctx, messageStarsIndex); err != nil {
+		return err
+	}
+
+	const messageDraftsTable = `
+    CREATE TABLE IF NOT EXISTS message_drafts (
+        user_id INTEGER NOT NULL,
+        channel_id INTEGER NOT NULL,
+        content TEXT NOT NULL,
+        updated_at TIMESTAMP NOT NULL,
+        PRIMARY KEY (user_id, channel_id),
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+        FOREIGN KEY(channel_id) REFERENCES channels(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, messageDraftsTable); err != nil {
+		return err
+	}
+
+	const conversationPinsTable = `
+    CREATE TABLE IF NOT EXISTS conversation_pins (
+        user_id INTEGER NOT NULL,
+        channel_id INTEGER NOT NULL,
+        position INTEGER NOT NULL,
+        pinned_at TIMESTAMP NOT NULL,
+        PRIMARY KEY (user_id, channel_id),
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+        FOREIGN KEY(channel_id) REFERENCES channels(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, conversationPinsTable); err != nil {
+		return err
+	}
+
+	// last_read_message_id only moves forward; see markChannelRead.
+	const channelReadsTable = `
+    CREATE TABLE IF NOT EXISTS channel_reads (
+        user_id INTEGER NOT NULL,
+        channel_id INTEGER NOT NULL,
+        last_read_message_id INTEGER NOT NULL,
+        updated_at TIMESTAMP NOT NULL,
+        PRIMARY KEY (user_id, channel_id),
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+        FOREIGN KEY(channel_id) REFERENCES channels(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, channelReadsTable); err != nil {
+		return err
+	}
+
+	const ephemeralMessagesTable = `
+    CREATE TABLE IF NOT EXISTS ephemeral_messages (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        channel_id INTEGER NOT NULL,
+        recipient_id INTEGER NOT NULL,
+        author_id INTEGER NOT NULL,
+        content TEXT NOT NULL,
+        created_at TIMESTAMP NOT NULL,
+        expires_at TIMESTAMP NOT NULL,
+        FOREIGN KEY(channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+        FOREIGN KEY(recipient_id) REFERENCES users(id) ON DELETE CASCADE,
+        FOREIGN KEY(author_id) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, ephemeralMessagesTable); err != nil {
+		return err
+	}
+	const ephemeralMessagesIndex = `
+    CREATE INDEX IF NOT EXISTS idx_ephemeral_messages_recipient
+    ON ephemeral_messages(recipient_id, channel_id);
+    `
+	if _, err := db.ExecContext(ctx, ephemeralMessagesIndex); err != nil {
+		return err
+	}
+
+	const attachmentBlobsTable = `
+    CREATE TABLE IF NOT EXISTS attachment_blobs (
+        hash TEXT PRIMARY KEY,
+        size INTEGER NOT NULL,
+        data BLOB NOT NULL,
+        refs INTEGER NOT NULL DEFAULT 0,
+        created_at TIMESTAMP NOT NULL,
+        location TEXT NOT NULL DEFAULT 'database',
+        width INTEGER,
+        height INTEGER,
+        scan_status TEXT NOT NULL DEFAULT 'clean',
+        scan_result TEXT NOT NULL DEFAULT '',
+        scanned_at TIMESTAMP
+    );`
+	if _, err := db.ExecContext(ctx, attachmentBlobsTable); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "attachment_blobs", "location TEXT NOT NULL DEFAULT 'database'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "attachment_blobs", "width INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "attachment_blobs", "height INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "attachment_blobs", "scan_status TEXT NOT NULL DEFAULT 'clean'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "attachment_blobs", "scan_result TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "attachment_blobs", "scanned_at TIMESTAMP"); err != nil {
+		return err
+	}
+	const attachmentScanIndex = `
+    CREATE INDEX IF NOT EXISTS idx_attachment_blobs_scan
+    ON attachment_blobs(scan_status) WHERE scan_status != 'clean';
+    `
+	if _, err := db.ExecContext(ctx, attachmentScanIndex); err != nil {
+		return err
+	}
+	const attachmentThumbnailsTable = `
+    CREATE TABLE IF NOT EXISTS attachment_thumbnails (
+        blob_hash TEXT NOT NULL,
+        size INTEGER NOT NULL,
+        width INTEGER NOT NULL,
+        height INTEGER NOT NULL,
+        content_type TEXT NOT NULL,
+        data BLOB NOT NULL,
+        PRIMARY KEY (blob_hash, size),
+        FOREIGN KEY(blob_hash) REFERENCES attachment_blobs(hash) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, attachmentThumbnailsTable); err != nil {
+		return err
+	}
+	const blobDeletionsTable = `
+    CREATE TABLE IF NOT EXISTS blob_deletions (
+        hash TEXT NOT NULL,
+        location TEXT NOT NULL,
+        queued_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+        PRIMARY KEY (hash, location)
+    );`
+	if _, err := db.ExecContext(ctx, blobDeletionsTable); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, messageAttachmentsSchema("message_attachments")); err != nil {
+		return err
+	}
+	if err := migrateAttachmentBlobs(ctx, db); err != nil {
+		return fmt.Errorf("migrate attachment blobs: %w", err)
+	}
+	if err := addColumnIfMissing(ctx, db, "message_attachments", "voice INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "message_attachments", "duration_ms INTEGER"); err != nil {
+		return err
+	}
+	for _, trigger := range attachmentBlobTriggers {
+		if _, err := db.ExecContext(ctx, trigger); err != nil {
+			return err
+		}
+	}
+	const messageAttachmentsIndex = `
+    CREATE INDEX IF NOT EXISTS idx_message_attachments_message
+    ON message_attachments(message_id);
+    `
+	if _, err := db.ExecContext(ctx, messageAttachmentsIndex); err != nil {
+		return err
+	}
+	const messageAttachmentsBlobIndex = `
+    CREATE INDEX IF NOT EXISTS idx_message_attachments_blob
+    ON message_attachments(blob_hash);
+    `
+	if _, err := db.ExecContext(ctx, messageAttachmentsBlobIndex); err != nil {
+		return err
+	}
+
+	const messageTranscriptsTable = `
+    CREATE TABLE IF NOT EXISTS message_transcripts (
+        message_id INTEGER PRIMARY KEY,
+        attachment_id INTEGER NOT NULL,
+        status TEXT NOT NULL DEFAULT 'pending',
+        text TEXT NOT NULL DEFAULT '',
+        language TEXT NOT NULL DEFAULT '',
+        provider TEXT NOT NULL DEFAULT '',
+        attempts INTEGER NOT NULL DEFAULT 0,
+        last_error TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMP NOT NULL,
+        updated_at TIMESTAMP NOT NULL,
+        FOREIGN KEY(message_id) REFERENCES channel_messages(id) ON DELETE CASCADE,
+        FOREIGN KEY(attachment_id) REFERENCES message_attachments(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, messageTranscriptsTable); err != nil {
+		return err
+	}
+	const messageTranscriptsIndex = `
+    CREATE INDEX IF NOT EXISTS idx_message_transcripts_pending
+    ON message_transcripts(created_at) WHERE status = 'pending';
+    `
+	if _, err := db.ExecContext(ctx, messageTranscriptsIndex); err != nil {
+		return err
+	}
+
+	// See stickers.go. Messages keep their sticker_id when a sticker is
+	// deleted, so clients can tell the sticker is gone.
+	const stickerPacksTable = `
+    CREATE TABLE IF NOT EXISTS sticker_packs (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        server_id INTEGER NOT NULL,
+        name TEXT NOT NULL,
+        description TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMP NOT NULL,
+        UNIQUE (server_id, name),
+        FOREIGN KEY(server_id) REFERENCES servers(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, stickerPacksTable); err != nil {
+		return err
+	}
+	const stickersTable = `
+    CREATE TABLE IF NOT EXISTS stickers (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        pack_id INTEGER NOT NULL,
+        name TEXT NOT NULL,
+        tags TEXT NOT NULL DEFAULT '',
+        image_path TEXT NOT NULL,
+        width INTEGER NOT NULL,
+        height INTEGER NOT NULL,
+        created_at TIMESTAMP NOT NULL,
+        UNIQUE (pack_id, name),
+        FOREIGN KEY(pack_id) REFERENCES sticker_packs(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, stickersTable); err != nil {
+		return err
+	}
+
+	const serverStatsTable = `
+    CREATE TABLE IF NOT EXISTS server_stats_daily (
+        server_id INTEGER NOT NULL,
+        day TEXT NOT NULL,
+        messages INTEGER NOT NULL DEFAULT 0,
+        active_members INTEGER NOT NULL DEFAULT 0,
+        peak_voice INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY (server_id, day),
+        FOREIGN KEY(server_id) REFERENCES servers(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, serverStatsTable); err != nil {
+		return err
+	}
+	const channelStatsTable = `
+    CREATE TABLE IF NOT EXISTS channel_stats_daily (
+        channel_id INTEGER NOT NULL,
+        day TEXT NOT NULL,
+        server_id INTEGER NOT NULL,
+        messages INTEGER NOT NULL DEFAULT 0,
+        authors INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY (channel_id, day),
+        FOREIGN KEY(channel_id) REFERENCES channels(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, channelStatsTable); err != nil {
+		return err
+	}
+	const channelStatsIndex = `
+    CREATE INDEX IF NOT EXISTS idx_channel_stats_server_day
+    ON channel_stats_daily(server_id, day);
+    `
+	if _, err := db.ExecContext(ctx, channelStatsIndex); err != nil {
+		return err
+	}
+	const voiceSessionsTable = `
+    CREATE TABLE IF NOT EXISTS voice_sessions (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        channel_id INTEGER NOT NULL,
+        server_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        joined_at TIMESTAMP NOT NULL,
+        left_at TIMESTAMP,
+        FOREIGN KEY(channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, voiceSessionsTable); err != nil {
+		return err
+	}
+	const voiceSessionsIndex = `
+    CREATE INDEX IF NOT EXISTS idx_voice_sessions_server_joined
+    ON voice_sessions(server_id, joined_at);
+    `
+	if _, err := db.ExecContext(ctx, voiceSessionsIndex); err != nil {
+		return err
+	}
+	const voiceChannelSettingsTable = `
+    CREATE TABLE IF NOT EXISTS voice_channel_settings (
+        channel_id INTEGER PRIMARY KEY,
+        audio_kbps INTEGER NOT NULL,
+        echo_cancellation INTEGER NOT NULL,
+        noise_suppression INTEGER NOT NULL,
+        auto_gain_control INTEGER NOT NULL,
+        updated_at TIMESTAMP NOT NULL,
+        FOREIGN KEY(channel_id) REFERENCES channels(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, voiceChannelSettingsTable); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "voice_channel_settings", "recording_channel_id INTEGER"); err != nil {
+		return err
+	}
+	const voiceRecordingsTable = `
+    CREATE TABLE IF NOT EXISTS voice_recordings (
+        id TEXT PRIMARY KEY,
+        channel_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        started_at TIMESTAMP NOT NULL,
+        ended_at TIMESTAMP,
+        message_id INTEGER,
+        FOREIGN KEY(channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, voiceRecordingsTable); err != nil {
+		return err
+	}
+	const voiceRTTTable = `
+    CREATE TABLE IF NOT EXISTS voice_rtt_reports (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id INTEGER NOT NULL,
+        ice_server TEXT NOT NULL,
+        rtt_ms INTEGER NOT NULL,
+        created_at TIMESTAMP NOT NULL,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, voiceRTTTable); err != nil {
+		return err
+	}
+	const voiceRTTIndex = `
+    CREATE INDEX IF NOT EXISTS idx_voice_rtt_reports_created
+    ON voice_rtt_reports(created_at);
+    `
+	if _, err := db.ExecContext(ctx, voiceRTTIndex); err != nil {
+		return err
+	}
+
+	const bridgeLinksTable = `
+    CREATE TABLE IF NOT EXISTS bridge_links (
+        bridge TEXT NOT NULL,
+        channel_id INTEGER NOT NULL,
+        remote_id TEXT NOT NULL,
+        created_by_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+        created_at TIMESTAMP NOT NULL,
+        PRIMARY KEY (bridge, channel_id),
+        UNIQUE (bridge, remote_id),
+        FOREIGN KEY(channel_id) REFERENCES channels(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, bridgeLinksTable); err != nil {
+		return err
+	}
+
+	const bridgeUsersTable = `
+    CREATE TABLE IF NOT EXISTS bridge_users (
+        bridge TEXT NOT NULL,
+        remote_id TEXT NOT NULL,
+        user_id INTEGER NOT NULL UNIQUE,
+        PRIMARY KEY (bridge, remote_id),
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, bridgeUsersTable); err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, sessionsSchema("sessions")); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "sessions", "client_ip TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "sessions", "device_id TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "sessions", "device_name TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "sessions", "user_agent TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "sessions", "last_seen_at TIMESTAMP"); err != nil {
+		return err
+	}
+	// Sessions from before cookies were signed keep their unsigned cookie
+	// until it is next issued.
+	if err := addColumnIfMissing(ctx, db, "sessions", "unsigned_cookie INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "sessions", "kind TEXT NOT NULL DEFAULT 'browser'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, db, "sessions", "scopes TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	if err := migrateUserForeignKeys(ctx, db); err != nil {
+		return fmt.Errorf("migrate user references: %w", err)
+	}
+
+	// After the rebuild above, which only carries the original columns.
+	if err := addColumnIfMissing(ctx, db, "server_members", "rules_accepted_at TIMESTAMP"); err != nil {
+		return err
+	}
+
+	const messagesIndex = `
+    CREATE INDEX IF NOT EXISTS idx_channel_messages_channel_created
+    ON channel_messages(channel_id, created_at);
+    `
+	if _, err := db.ExecContext(ctx, messagesIndex); err != nil {
+		return err
+	}
+
+	const messageNonceIndex = `
+    CREATE UNIQUE INDEX IF NOT EXISTS idx_channel_messages_nonce
+    ON channel_messages(author_id, client_nonce) WHERE client_nonce IS NOT NULL;
+    `
+	if _, err := db.ExecContext(ctx, messageNonceIndex); err != nil {
+		return err
+	}
+
+	const messageExpiryIndex = `
+    CREATE INDEX IF NOT EXISTS idx_channel_messages_expires
+    ON channel_messages(expires_at) WHERE expires_at IS NOT NULL;
+    `
+	if _, err := db.ExecContext(ctx, messageExpiryIndex); err != nil {
+		return err
+	}
+
+	const serverMembersRoleIndex = `
+    CREATE INDEX IF NOT EXISTS idx_server_members_role
+    ON server_members(server_id, role);
+    `
+	if _, err := db.ExecContext(ctx, serverMembersRoleIndex); err != nil {
+		return err
+	}
+
+	const usersDisplayNameIndex = `
+    CREATE INDEX IF NOT EXISTS idx_users_display_name
+    ON users(display_name COLLATE NOCASE, id);
+    `
+	if _, err := db.ExecContext(ctx, usersDisplayNameIndex); err != nil {
 		return err
 	}
 
-	const usersTable = `
-    CREATE TABLE IF NOT EXISTS users (
-        email TEXT PRIMARY KEY,
-        display_name TEXT NOT NULL,
-        password_hash BLOB NOT NULL,
-        created_at TIMESTAMP NOT NULL
-    );`
-	if _, err := db.ExecContext(ctx, usersTable); err != nil {
+	const sessionsIndex = `
+    CREATE INDEX IF NOT EXISTS idx_sessions_expires
+    ON sessions(expires_at);
+    `
+	if _, err := db.ExecContext(ctx, sessionsIndex); err != nil {
+		return err
+	}
+	// Sessions from before devices were tracked each count as a device.
+	if _, err := db.ExecContext(ctx, `UPDATE sessions SET device_id = lower(hex(randomblob(12))) WHERE device_id = ''`); err != nil {
+		return err
+	}
+	const sessionsDeviceIndex = `
+    CREATE INDEX IF NOT EXISTS idx_sessions_user_device
+    ON sessions(user_id, device_id);
+    `
+	if _, err := db.ExecContext(ctx, sessionsDeviceIndex); err != nil {
 		return err
 	}
 
-	const serversTable = `
-    CREATE TABLE IF NOT EXISTS servers (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        slug TEXT NOT NULL UNIQUE,
-        name TEXT NOT NULL,
-        created_at TIMESTAMP NOT NULL
+	const syncEventsTable = `
+    CREATE TABLE IF NOT EXISTS sync_events (
+        seq INTEGER PRIMARY KEY AUTOINCREMENT,
+        type TEXT NOT NULL,
+        server_id INTEGER,
+        channel_id INTEGER,
+        message_id INTEGER,
+        user_id INTEGER,
+        created_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
     );`
-	if _, err := db.ExecContext(ctx, serversTable); err != nil {
+	if _, err := db.ExecContext(ctx, syncEventsTable); err != nil {
+		return err
+	}
+	const syncEventsIndex = `
+    CREATE INDEX IF NOT EXISTS idx_sync_events_created
+    ON sync_events(created_at);
+    `
+	if _, err := db.ExecContext(ctx, syncEventsIndex); err != nil {
 		return err
 	}
+	for _, trigger := range syncTriggers {
+		if _, err := db.ExecContext(ctx, trigger); err != nil {
+			return err
+		}
+	}
 
-	const serverMembersTable = `
-    CREATE TABLE IF NOT EXISTS server_members (
-        server_id INTEGER NOT NULL,
-        user_email TEXT NOT NULL,
-        role TEXT NOT NULL DEFAULT 'member',
-        joined_at TIMESTAMP NOT NULL,
-        PRIMARY KEY (server_id, user_email),
-        FOREIGN KEY(server_id) REFERENCES servers(id) ON DELETE CASCADE,
-        FOREIGN KEY(user_email) REFERENCES users(email) ON DELETE CASCADE
+	// ws_resumes holds the subscriptions of dropped WebSocket connections;
+	// see wsresume.go.
+	const wsResumesTable = `
+    CREATE TABLE IF NOT EXISTS ws_resumes (
+        token_hash TEXT PRIMARY KEY,
+        session_hash TEXT NOT NULL,
+        channel_ids TEXT NOT NULL,
+        closed_at TIMESTAMP NOT NULL
     );`
-	if _, err := db.ExecContext(ctx, serverMembersTable); err != nil {
+	if _, err := db.ExecContext(ctx, wsResumesTable); err != nil {
 		return err
 	}
 
-	const channelsTable = `
-    CREATE TABLE IF NOT EXISTS channels (
+	// See automations.go.
+	const automationsTable = `
+    CREATE TABLE IF NOT EXISTS server_automations (
         id INTEGER PRIMARY KEY AUTOINCREMENT,
         server_id INTEGER NOT NULL,
-        slug TEXT NOT NULL,
         name TEXT NOT NULL,
-        kind TEXT NOT NULL DEFAULT 'text',
+        trigger TEXT NOT NULL,
+        interval_minutes INTEGER NOT NULL DEFAULT 0,
+        source TEXT NOT NULL,
+        enabled INTEGER NOT NULL DEFAULT 1,
+        created_by_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
         created_at TIMESTAMP NOT NULL,
-        UNIQUE(server_id, slug),
+        updated_at TIMESTAMP NOT NULL,
+        last_run_at TIMESTAMP,
+        last_error TEXT NOT NULL DEFAULT '',
         FOREIGN KEY(server_id) REFERENCES servers(id) ON DELETE CASCADE
     );`
-	if _, err := db.ExecContext(ctx, channelsTable); err != nil {
+	if _, err := db.ExecContext(ctx, automationsTable); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_server_automations_trigger ON server_automations(server_id, trigger)`); err != nil {
+		return err
+	}
+	const automationRunsTable = `
+    CREATE TABLE IF NOT EXISTS automation_runs (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        automation_id INTEGER NOT NULL,
+        trigger TEXT NOT NULL,
+        started_at TIMESTAMP NOT NULL,
+        duration_ms INTEGER NOT NULL,
+        actions TEXT NOT NULL,
+        error TEXT NOT NULL DEFAULT '',
+        FOREIGN KEY(automation_id) REFERENCES server_automations(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, automationRunsTable); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_automation_runs_automation ON automation_runs(automation_id, id)`); err != nil {
 		return err
 	}
 
-	if _, err := db.ExecContext(ctx, "ALTER TABLE channels ADD COLUMN kind TEXT NOT NULL DEFAULT 'text'"); err != nil {
-		if !strings.Contains(strings.ToLower(err.Error()), "duplicate column name") {
-			return err
-		}
+	// See announcements.go.
+	const announcementsTable = `
+    CREATE TABLE IF NOT EXISTS announcements (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        tenant_id INTEGER NOT NULL DEFAULT 0,
+        title TEXT NOT NULL,
+        body TEXT NOT NULL DEFAULT '',
+        level TEXT NOT NULL DEFAULT 'info',
+        created_by_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+        created_at TIMESTAMP NOT NULL,
+        expires_at TIMESTAMP,
+        withdrawn_at TIMESTAMP,
+        delivered INTEGER NOT NULL DEFAULT 0
+    );`
+	if _, err := db.ExecContext(ctx, announcementsTable); err != nil {
+		return err
+	}
+	const announcementAcksTable = `
+    CREATE TABLE IF NOT EXISTS announcement_acks (
+        announcement_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        acked_at TIMESTAMP NOT NULL,
+        PRIMARY KEY(announcement_id, user_id),
+        FOREIGN KEY(announcement_id) REFERENCES announcements(id) ON DELETE CASCADE,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	if _, err := db.ExecContext(ctx, announcementAcksTable); err != nil {
+		return err
+	}
+
+	// Once every table it covers exists.
+	if err := migrateCreatorIDs(ctx, db); err != nil {
+		return fmt.Errorf("migrate creator ids: %w", err)
 	}
 
-	const messagesTable = `
-    CREATE TABLE IF NOT EXISTS channel_messages (
+	if err := ensureMessageSearch(ctx, db); err != nil {
+		return fmt.Errorf("message search index: %w", err)
+	}
+
+	// See archive.go. The table is created even with MESSAGE_ARCHIVE off so
+	// revisions from an earlier archived period stay readable.
+	const messageRevisionsTable = `
+    CREATE TABLE IF NOT EXISTS message_revisions (
         id INTEGER PRIMARY KEY AUTOINCREMENT,
+        message_id INTEGER NOT NULL,
         channel_id INTEGER NOT NULL,
+        author_id INTEGER NOT NULL,
         author_email TEXT NOT NULL,
+        revision INTEGER NOT NULL,
+        kind TEXT NOT NULL,
         content TEXT NOT NULL,
-        created_at TIMESTAMP NOT NULL,
-        FOREIGN KEY(channel_id) REFERENCES channels(id) ON DELETE CASCADE,
-        FOREIGN KEY(author_email) REFERENCES users(email) ON DELETE CASCADE
+        recorded_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+        UNIQUE (message_id, revision)
     );`
-	if _, err := db.ExecContext(ctx, messagesTable); err != nil {
+	if _, err := db.ExecContext(ctx, messageRevisionsTable); err != nil {
 		return err
 	}
-
-	const messagesIndex = `
-    CREATE INDEX IF NOT EXISTS idx_channel_messages_channel_created
-    ON channel_messages(channel_id, created_at);
-    `
-	if _, err := db.ExecContext(ctx, messagesIndex); err != nil {
-		return err
+	for _, trigger := range []string{
+		`CREATE TRIGGER IF NOT EXISTS message_revisions_immutable_update BEFORE UPDATE ON message_revisions BEGIN
+            SELECT RAISE(ABORT, 'message revisions are immutable');
+        END`,
+		`CREATE TRIGGER IF NOT EXISTS message_revisions_immutable_delete BEFORE DELETE ON message_revisions BEGIN
+            SELECT RAISE(ABORT, 'message revisions are immutable');
+        END`,
+	} {
+		if _, err := db.ExecContext(ctx, trigger); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
 func (s *serverState) ensureDefaultWorkspace(ctx context.Context) error {
-	const selectServer = `SELECT id FROM servers WHERE slug = ?`
-	row := s.db.QueryRowContext(ctx, selectServer, "home")
+	// Setup may have renamed the default server, so its id is the reliable
+	// handle once recorded.
+	var row *sql.Row
+	if raw, ok, err := s.getSetting(ctx, settingDefaultServerID); err != nil {
+		return err
+	} else if id, convErr := strconv.ParseInt(raw, 10, 64); ok && convErr == nil {
+		row = s.db.QueryRowContext(ctx, `SELECT id FROM servers WHERE id = ?`, id)
+	} else {
+		row = s.db.QueryRowContext(ctx, `SELECT id FROM servers WHERE slug = ?`, "home")
+	}
 	if err := row.Scan(&s.defaultServerID); err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			return err
 		}
 
-		now := time.Now().UTC()
-		res, err := s.db.ExecContext(ctx, `INSERT INTO servers (slug, name, created_at) VALUES (?, ?, ?)`, "home", "Home", now)
-		if err != nil {
+		var serverID int64
+		err := s.withTx(ctx, func(tx *sql.Tx) error {
+			now := time.Now().UTC()
+			res, err := tx.ExecContext(ctx, `INSERT INTO servers (slug, name, created_at) VALUES (?, ?, ?)`, "home", "Home", now)
+			if err != nil {
+				return err
+			}
+			if serverID, err = res.LastInsertId(); err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `INSERT INTO channels (server_id, slug, name, kind, created_at) VALUES (?, ?, ?, ?, ?)`, serverID, "general", "general", "text", now)
 			return err
-		}
-		serverID, err := res.LastInsertId()
+		})
 		if err != nil {
 			return err
 		}
 		s.defaultServerID = serverID
-
-		_, err = s.db.ExecContext(ctx, `INSERT INTO channels (server_id, slug, name, kind, created_at) VALUES (?, ?, ?, ?, ?)`, serverID, "general", "general", "text", now)
-		if err != nil {
-			return err
-		}
-	}
-
-	if s.defaultServerID == 0 {
-		row := s.db.QueryRowContext(ctx, selectServer, "home")
-		if err := row.Scan(&s.defaultServerID); err != nil {
-			return err
-		}
 	}
 
 	const selectChannel = `SELECT id FROM channels WHERE server_id = ? AND slug = ?`
@@ -181,19 +1495,74 @@ func (s *serverState) ensureDefaultWorkspace(ctx context.Context) error {
 	return nil
 }
 
-func (s *serverState) ensureMembership(ctx context.Context, email string) error {
+// ensureServerChannels gives every server without channels a "general"
+// text channel, so readers never have to create one on the fly.
+func (s *serverState) ensureServerChannels(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `
+        INSERT INTO channels (server_id, slug, name, kind, created_at)
+        SELECT srv.id, 'general', 'general', 'text', ?
+        FROM servers srv
+        WHERE srv.id != ? AND NOT EXISTS (SELECT 1 FROM channels c WHERE c.server_id = srv.id)
+    `, time.Now().UTC(), s.directServerID)
+	return err
+}
+
+// ensureMembership adds the account to its tenant's home server, which for
+// the root tenant is the default server.
+func (s *serverState) ensureMembership(ctx context.Context, email string, tenantID int64) error {
+	var change membershipChange
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		change, err = s.joinHomeServer(ctx, tx, email, tenantID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.membershipChanged(change)
+	return nil
+}
+
+// joinHomeServer does the work of ensureMembership as part of tx, announcing
+// the account if it was not a member yet.
+func (s *serverState) joinHomeServer(ctx context.Context, tx *sql.Tx, email string, tenantID int64) (membershipChange, error) {
 	if s.defaultServerID == 0 {
-		return fmt.Errorf("default server not initialised")
+		return membershipChange{}, fmt.Errorf("default server not initialised")
 	}
-	_, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO server_members (server_id, user_email, role, joined_at) VALUES (?, ?, 'member', ?)`, s.defaultServerID, email, time.Now().UTC())
-	return err
+	serverID, err := s.homeServerFor(ctx, tenantID)
+	if err != nil {
+		return membershipChange{}, err
+	}
+	change := membershipChange{serverID: serverID, email: email}
+	res, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO server_members (server_id, user_id, role, joined_at) VALUES (?, `+userIDForEmail+`, 'member', ?)`, serverID, email, time.Now().UTC())
+	if err != nil {
+		return membershipChange{}, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		change.changed = true
+		change.joined = true
+		if change.announced, err = s.announceMembership(ctx, tx, serverID, email, true); err != nil {
+			return membershipChange{}, err
+		}
+	}
+	return change, nil
 }
 
-func (s *serverState) getUserByEmail(ctx context.Context, email string) (user, bool, error) {
-	row := s.db.QueryRowContext(ctx, `SELECT email, display_name, password_hash, created_at FROM users WHERE email = ?`, email)
+// userIDForEmail is a scalar subquery resolving an email argument to the
+// user's id, for tables that reference users by id.
+const userIDForEmail = `(SELECT id FROM users WHERE email = ?)`
 
+const userColumns = `id, email, handle, display_name, password_hash, created_at, status, mask_profanity, voice_mode, locale, timezone, theme, compact_mode, font_size, quiet_hours_start, quiet_hours_end, share_presence, tenant_id`
+
+func scanUser(row interface{ Scan(...any) error }) (user, error) {
 	var u user
-	if err := row.Scan(&u.Email, &u.DisplayName, &u.PasswordHash, &u.CreatedAt); err != nil {
+	err := row.Scan(&u.ID, &u.Email, &u.Handle, &u.DisplayName, &u.PasswordHash, &u.CreatedAt, &u.Status, &u.MaskProfanity, &u.VoiceMode, &u.Locale, &u.Timezone, &u.Theme, &u.CompactMode, &u.FontSize, &u.QuietHoursStart, &u.QuietHoursEnd, &u.SharePresence, &u.TenantID)
+	return u, err
+}
+
+func (s *serverState) getUserByEmail(ctx context.Context, email string) (user, bool, error) {
+	u, err := scanUser(s.stmts.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE email = ?`, email))
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return user{}, false, nil
 		}
@@ -203,38 +1572,181 @@ func (s *serverState) getUserByEmail(ctx context.Context, email string) (user, b
 	return u, true, nil
 }
 
+func (s *serverState) getUserByID(ctx context.Context, id int64) (user, bool, error) {
+	u, err := scanUser(s.stmts.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return user{}, false, nil
+		}
+		return user{}, false, err
+	}
+	return u, true, nil
+}
+
 func (s *serverState) createUser(ctx context.Context, u user) error {
-	if _, err := s.db.ExecContext(ctx, `INSERT INTO users (email, display_name, password_hash, created_at) VALUES (?, ?, ?, ?)`, u.Email, u.DisplayName, u.PasswordHash, u.CreatedAt); err != nil {
+	var change membershipChange
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		_, change, err = s.insertUser(ctx, tx, u)
+		return err
+	})
+	if err != nil {
 		return err
 	}
-	return s.ensureMembership(ctx, u.Email)
+	s.membershipChanged(change)
+	return nil
 }
 
-func (s *serverState) saveMessage(ctx context.Context, channelID int64, authorEmail, content string) (chatMessage, error) {
-	now := time.Now().UTC()
-	res, err := s.db.ExecContext(ctx, `INSERT INTO channel_messages (channel_id, author_email, content, created_at) VALUES (?, ?, ?, ?)`, channelID, authorEmail, content, now)
+// insertUser adds the account and its home server membership as part of
+// tx, returning the new id. An empty handle is derived from the email.
+func (s *serverState) insertUser(ctx context.Context, tx *sql.Tx, u user) (int64, membershipChange, error) {
+	if u.Handle == "" {
+		handle, err := uniqueHandle(ctx, s.readDB, u.TenantID, handleFromEmail(u.Email))
+		if err != nil {
+			return 0, membershipChange{}, err
+		}
+		u.Handle = handle
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO users (email, handle, display_name, password_hash, created_at, tenant_id) VALUES (?, ?, ?, ?, ?, ?)`, u.Email, u.Handle, u.DisplayName, u.PasswordHash, u.CreatedAt, u.TenantID)
 	if err != nil {
-		return chatMessage{}, err
+		return 0, membershipChange{}, err
 	}
-
 	id, err := res.LastInsertId()
 	if err != nil {
-		return chatMessage{}, err
+		return 0, membershipChange{}, err
 	}
+	change, err := s.joinHomeServer(ctx, tx, u.Email, u.TenantID)
+	return id, change, err
+}
 
-	row := s.db.QueryRowContext(ctx, `
-        SELECT m.id, m.channel_id, m.author_email, u.display_name, m.content, m.created_at
-        FROM channel_messages m
-        JOIN users u ON u.email = m.author_email
-        WHERE m.id = ?
-    `, id)
+// claimUser sets a password on a placeholder account as part of tx,
+// replacing its derived handle when the new owner chose one.
+func (s *serverState) claimUser(ctx context.Context, tx *sql.Tx, u user) (membershipChange, error) {
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET display_name = ?, password_hash = ?, handle = COALESCE(NULLIF(?, ''), handle) WHERE email = ? AND length(password_hash) = 0`, u.DisplayName, u.PasswordHash, u.Handle, u.Email); err != nil {
+		return membershipChange{}, err
+	}
+	return s.joinHomeServer(ctx, tx, u.Email, u.TenantID)
+}
 
-	var msg chatMessage
-	if err := row.Scan(&msg.ID, &msg.ChannelID, &msg.AuthorEmail, &msg.AuthorDisplayName, &msg.Content, &msg.CreatedAt); err != nil {
+// resetPassword replaces the user's password hash, revokes their sessions and
+// closes their WebSocket connections. From the CLI, which runs in its own
+// process, the server notices the missing sessions on its next check instead.
+func (s *serverState) resetPassword(ctx context.Context, email string, hash []byte) error {
+	if err := s.withTx(ctx, func(tx *sql.Tx) error {
+		return replacePassword(ctx, tx, email, hash)
+	}); err != nil {
+		return err
+	}
+	s.ws.disconnectUser(email, wsCloseAuthExpired, "password changed")
+	return nil
+}
+
+// replacePassword does the writes of resetPassword as part of tx.
+func replacePassword(ctx context.Context, tx *sql.Tx, email string, hash []byte) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET password_hash = ? WHERE email = ?`, hash, email); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = `+userIDForEmail, email); err != nil {
+		return err
+	}
+	// A new password lifts any lockout on the account.
+	_, err := tx.ExecContext(ctx, `DELETE FROM login_failures WHERE subject = 'user:' || `+userIDForEmail, email)
+	return err
+}
+
+func (s *serverState) saveMessage(ctx context.Context, channelID int64, authorEmail, content string) (chatMessage, error) {
+	id, err := s.messages.insert(ctx, messageInsert{channelID: channelID, author: authorEmail, content: content, createdAt: time.Now().UTC()})
+	if err != nil {
 		return chatMessage{}, err
 	}
 
-	return msg, nil
+	return s.messageByID(ctx, id)
+}
+
+// saveClientMessage stores a message sent with a client nonce. If the author
+// already sent one with that nonce, the original is returned with duplicate
+// set instead, so a retried send after a reconnect is not stored twice. A
+// positive ttl makes the message self-destruct that long after it is sent,
+// and a non-zero stickerID sends that sticker along with the content.
+// Content over the length limit is stored as a text attachment, subject to
+// the attachment quotas (a *quotaError). Plugins' message filters see the
+// content first and may change or refuse it (a *messageRejectedError).
+func (s *serverState) saveClientMessage(ctx context.Context, channelID int64, authorEmail, content, nonce string, ttl time.Duration, stickerID int64) (msg chatMessage, duplicate bool, err error) {
+	if nonce != "" {
+		if msg, found, err := s.messageByNonce(ctx, authorEmail, nonce); err != nil || found {
+			return msg, found, err
+		}
+	}
+	pending := pendingMessage{channelID: channelID, author: authorEmail, content: content}
+	if err := s.plugins.filterMessage(ctx, &pending); err != nil {
+		return chatMessage{}, false, err
+	}
+	req := messageInsert{channelID: channelID, author: authorEmail, content: pending.content, nonce: nonce, createdAt: time.Now().UTC(), stickerID: stickerID, clearDraft: true}
+	if ttl > 0 {
+		req.expiresAt = sql.NullTime{Time: req.createdAt.Add(ttl), Valid: true}
+	}
+	return s.insertClientMessage(ctx, req.withLongContent())
+}
+
+// saveClientAttachment stores a message with no text and a single
+// attachment, such as a voice message, deduplicated by nonce like
+// saveClientMessage.
+func (s *serverState) saveClientAttachment(ctx context.Context, channelID int64, authorEmail, nonce string, att *newAttachment) (msg chatMessage, duplicate bool, err error) {
+	if nonce != "" {
+		if msg, found, err := s.messageByNonce(ctx, authorEmail, nonce); err != nil || found {
+			return msg, found, err
+		}
+	}
+	return s.insertClientMessage(ctx, messageInsert{channelID: channelID, author: authorEmail, nonce: nonce, createdAt: time.Now().UTC(), attachment: att})
+}
+
+func (s *serverState) insertClientMessage(ctx context.Context, req messageInsert) (msg chatMessage, duplicate bool, err error) {
+	if att := req.attachment; att != nil {
+		if err := s.prepareAttachment(ctx, att); err != nil {
+			return chatMessage{}, false, err
+		}
+		if err := s.checkAttachmentQuota(ctx, req.author, req.channelID, int64(len(att.data))); err != nil {
+			return chatMessage{}, false, err
+		}
+		if att.location, err = s.placeBlob(ctx, att.data); err != nil {
+			return chatMessage{}, false, err
+		}
+	}
+	id, err := s.messages.insert(ctx, req)
+	if err != nil {
+		// Lost a race with a concurrent retry; the unique index kept one.
+		if req.nonce != "" {
+			if msg, found, lookupErr := s.messageByNonce(ctx, req.author, req.nonce); lookupErr == nil && found {
+				return msg, true, nil
+			}
+		}
+		return chatMessage{}, false, err
+	}
+	if att := req.attachment; att != nil {
+		if att.scanStatus == scanPending {
+			s.wakeScanner()
+		}
+		if att.transcribe {
+			s.wakeTranscriber()
+		}
+	}
+	msg, err = s.messageByID(ctx, id)
+	return msg, false, err
+}
+
+func (s *serverState) messageByNonce(ctx context.Context, authorEmail, nonce string) (chatMessage, bool, error) {
+	msg, err := scanMessage(s.stmts.QueryRowContext(ctx, messageSelect+`WHERE m.author_id = `+userIDForEmail+` AND m.client_nonce = ?`, authorEmail, nonce))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return chatMessage{}, false, nil
+		}
+		return chatMessage{}, false, err
+	}
+	return msg, true, nil
+}
+
+func (s *serverState) messageByID(ctx context.Context, id int64) (chatMessage, error) {
+	return scanMessage(s.stmts.QueryRowContext(ctx, messageSelect+`WHERE m.id = ?`, id))
 }
 
 func (s *serverState) recentMessages(ctx context.Context, channelID int64, limit int) ([]chatMessage, error) {
@@ -242,14 +1754,82 @@ func (s *serverState) recentMessages(ctx context.Context, channelID int64, limit
 		limit = 50
 	}
 
-	rows, err := s.db.QueryContext(ctx, `
-        SELECT m.id, m.channel_id, m.author_email, u.display_name, m.content, m.created_at
-        FROM channel_messages m
-        JOIN users u ON u.email = m.author_email
-        WHERE m.channel_id = ?
+	msgs, err := s.queryMessages(ctx, messageSelect+`
+        WHERE m.channel_id = ? AND (m.expires_at IS NULL OR m.expires_at > ?)
+        ORDER BY m.id DESC
+        LIMIT ?
+    `, channelID, time.Now().UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	reverseMessages(msgs)
+	return msgs, nil
+}
+
+// messagesBefore returns up to limit messages older than before, oldest
+// first.
+func (s *serverState) messagesBefore(ctx context.Context, channelID, before int64, limit int) ([]chatMessage, error) {
+	msgs, err := s.queryMessages(ctx, messageSelect+`
+        WHERE m.channel_id = ? AND m.id < ? AND (m.expires_at IS NULL OR m.expires_at > ?)
+        ORDER BY m.id DESC
+        LIMIT ?
+    `, channelID, before, time.Now().UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	reverseMessages(msgs)
+	return msgs, nil
+}
+
+// messagesAround returns up to limit messages centered on pivotID, oldest
+// first: half of them older than the pivot and the rest starting at it.
+// When one side runs short the other fills in.
+func (s *serverState) messagesAround(ctx context.Context, channelID, pivotID int64, limit int) ([]chatMessage, error) {
+	now := time.Now().UTC()
+	const live = ` AND (m.expires_at IS NULL OR m.expires_at > ?)`
+	newer, err := s.queryMessages(ctx, messageSelect+`
+        WHERE m.channel_id = ? AND m.id >= ?`+live+`
+        ORDER BY m.id
+        LIMIT ?
+    `, channelID, pivotID, now, limit-limit/2)
+	if err != nil {
+		return nil, err
+	}
+	older, err := s.queryMessages(ctx, messageSelect+`
+        WHERE m.channel_id = ? AND m.id < ?`+live+`
         ORDER BY m.id DESC
         LIMIT ?
-    `, channelID, limit)
+    `, channelID, pivotID, now, limit-len(newer))
+	if err != nil {
+		return nil, err
+	}
+	if missing := limit - len(older) - len(newer); missing > 0 && len(newer) > 0 {
+		more, err := s.queryMessages(ctx, messageSelect+`
+            WHERE m.channel_id = ? AND m.id > ?`+live+`
+            ORDER BY m.id
+            LIMIT ?
+        `, channelID, newer[len(newer)-1].ID, now, missing)
+		if err != nil {
+			return nil, err
+		}
+		newer = append(newer, more...)
+	}
+	reverseMessages(older)
+	return append(older, newer...), nil
+}
+
+// messageIDAt returns the first message in the channel sent at or after t,
+// or found=false when there is none.
+func (s *serverState) messageIDAt(ctx context.Context, channelID int64, t time.Time) (id int64, found bool, err error) {
+	err = s.readDB.QueryRowContext(ctx, `SELECT id FROM channel_messages WHERE channel_id = ? AND created_at >= ? ORDER BY id LIMIT 1`, channelID, t.UTC()).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	return id, err == nil, err
+}
+
+func (s *serverState) queryMessages(ctx context.Context, query string, args ...any) ([]chatMessage, error) {
+	rows, err := s.readDB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -257,29 +1837,28 @@ func (s *serverState) recentMessages(ctx context.Context, channelID int64, limit
 
 	var msgs []chatMessage
 	for rows.Next() {
-		var msg chatMessage
-		if err := rows.Scan(&msg.ID, &msg.ChannelID, &msg.AuthorEmail, &msg.AuthorDisplayName, &msg.Content, &msg.CreatedAt); err != nil {
+		msg, err := scanMessage(rows)
+		if err != nil {
 			return nil, err
 		}
 		msgs = append(msgs, msg)
 	}
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
+	return msgs, rows.Err()
+}
 
+func reverseMessages(msgs []chatMessage) {
 	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
 		msgs[i], msgs[j] = msgs[j], msgs[i]
 	}
-
-	return msgs, nil
 }
 
 func (s *serverState) serversForUser(ctx context.Context, email string) ([]serverInfo, error) {
-	rows, err := s.db.QueryContext(ctx, `
-        SELECT srv.id, srv.slug, srv.name, srv.created_at
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT `+serverColumns+`
         FROM servers srv
         JOIN server_members sm ON sm.server_id = srv.id
-        WHERE sm.user_email = ?
+        JOIN users u ON u.id = sm.user_id
+        WHERE u.email = ?
         ORDER BY srv.name
     `, email)
 	if err != nil {
@@ -289,8 +1868,8 @@ func (s *serverState) serversForUser(ctx context.Context, email string) ([]serve
 
 	var result []serverInfo
 	for rows.Next() {
-		var srv serverInfo
-		if err := rows.Scan(&srv.ID, &srv.Slug, &srv.Name, &srv.CreatedAt); err != nil {
+		srv, err := scanServer(rows)
+		if err != nil {
 			return nil, err
 		}
 		result = append(result, srv)
@@ -298,13 +1877,16 @@ func (s *serverState) serversForUser(ctx context.Context, email string) ([]serve
 	return result, rows.Err()
 }
 
-func (s *serverState) channelsForServer(ctx context.Context, serverID int64) ([]channelInfo, error) {
-	rows, err := s.db.QueryContext(ctx, `
-        SELECT id, server_id, slug, name, kind, created_at
-        FROM channels
-        WHERE server_id = ?
-        ORDER BY created_at
-    `, serverID)
+// channelsForUser returns the channels email can view in every server they
+// belong to, ordered by server and creation time.
+func (s *serverState) channelsForUser(ctx context.Context, email string) ([]channelInfo, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT `+channelColumns+`
+        FROM channels c
+        WHERE server_id IN (SELECT server_id FROM server_members WHERE user_id = `+userIDForEmail+`)
+          AND `+channelVisibleTo(userIDForEmail)+`
+        ORDER BY server_id, created_at
+    `, email, email)
 	if err != nil {
 		return nil, err
 	}
@@ -312,8 +1894,8 @@ func (s *serverState) channelsForServer(ctx context.Context, serverID int64) ([]
 
 	var result []channelInfo
 	for rows.Next() {
-		var ch channelInfo
-		if err := rows.Scan(&ch.ID, &ch.ServerID, &ch.Slug, &ch.Name, &ch.Kind, &ch.CreatedAt); err != nil {
+		ch, err := scanChannel(rows)
+		if err != nil {
 			return nil, err
 		}
 		result = append(result, ch)
@@ -321,54 +1903,78 @@ func (s *serverState) channelsForServer(ctx context.Context, serverID int64) ([]
 	return result, rows.Err()
 }
 
-func (s *serverState) membersForServer(ctx context.Context, serverID int64) ([]memberInfo, error) {
-	rows, err := s.db.QueryContext(ctx, `
-        SELECT u.email, u.display_name, sm.joined_at, sm.role
-        FROM server_members sm
-        JOIN users u ON u.email = sm.user_email
-        WHERE sm.server_id = ?
-        ORDER BY u.display_name
+func (s *serverState) channelsForServer(ctx context.Context, serverID int64) ([]channelInfo, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT `+channelColumns+`
+        FROM channels
+        WHERE server_id = ?
+        ORDER BY created_at
     `, serverID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var result []memberInfo
+	var result []channelInfo
 	for rows.Next() {
-		var m memberInfo
-		if err := rows.Scan(&m.Email, &m.DisplayName, &m.JoinedAt, &m.Role); err != nil {
+		ch, err := scanChannel(rows)
+		if err != nil {
 			return nil, err
 		}
-		result = append(result, m)
+		result = append(result, ch)
 	}
 	return result, rows.Err()
 }
 
-func (s *serverState) channelByID(ctx context.Context, channelID int64) (channelInfo, bool, error) {
-	row := s.db.QueryRowContext(ctx, `SELECT id, server_id, slug, name, kind, created_at FROM channels WHERE id = ?`, channelID)
+func (s *serverState) membersForServer(ctx context.Context, serverID int64) ([]memberInfo, error) {
+	return s.findMembers(ctx, serverID, memberFilter{})
+}
 
-	var ch channelInfo
-	if err := row.Scan(&ch.ID, &ch.ServerID, &ch.Slug, &ch.Name, &ch.Kind, &ch.CreatedAt); err != nil {
+func (s *serverState) channelByID(ctx context.Context, channelID int64) (channelInfo, bool, error) {
+	if ch, ok := s.channelCache.get(channelID); ok {
+		return ch, true, nil
+	}
+	ch, err := scanChannel(s.stmts.QueryRowContext(ctx, `SELECT `+channelColumns+` FROM channels WHERE id = ?`, channelID))
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return channelInfo{}, false, nil
 		}
 		return channelInfo{}, false, err
 	}
 
+	s.channelCache.set(channelID, ch)
 	return ch, true, nil
 }
 
 func (s *serverState) userHasServerAccess(ctx context.Context, email string, serverID int64) (bool, error) {
-	row := s.db.QueryRowContext(ctx, `SELECT 1 FROM server_members WHERE server_id = ? AND user_email = ?`, serverID, email)
-	var dummy int
-	if err := row.Scan(&dummy); err != nil {
+	_, isMember, err := s.memberRole(ctx, email, serverID)
+	return isMember, err
+}
+
+func (s *serverState) memberRole(ctx context.Context, email string, serverID int64) (string, bool, error) {
+	key := membershipKey{serverID: serverID, email: email}
+	if entry, ok := s.memberCache.get(key); ok {
+		return entry.role, entry.isMember, nil
+	}
+	row := s.stmts.QueryRowContext(ctx, `SELECT role FROM server_members WHERE server_id = ? AND user_id = `+userIDForEmail, serverID, email)
+	var role string
+	if err := row.Scan(&role); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return false, nil
+			s.memberCache.set(key, membershipEntry{})
+			return "", false, nil
 		}
+		return "", false, err
+	}
+	s.memberCache.set(key, membershipEntry{role: role, isMember: true})
+	return role, true, nil
+}
+
+func (s *serverState) canManageServer(ctx context.Context, email string, serverID int64) (bool, error) {
+	role, ok, err := s.memberRole(ctx, email, serverID)
+	if err != nil || !ok {
 		return false, err
 	}
-	return true, nil
+	return role == "owner" || role == "admin", nil
 }
 
 func (s *serverState) createServer(ctx context.Context, name, slug, ownerEmail string) (serverInfo, channelInfo, error) {
@@ -383,7 +1989,8 @@ func (s *serverState) createServer(ctx context.Context, name, slug, ownerEmail s
 	}()
 
 	now := time.Now().UTC()
-	res, err := tx.ExecContext(ctx, `INSERT INTO servers (slug, name, created_at) VALUES (?, ?, ?)`, slug, name, now)
+	// The server belongs to its owner's tenant.
+	res, err := tx.ExecContext(ctx, `INSERT INTO servers (slug, name, created_at, tenant_id) VALUES (?, ?, ?, (SELECT tenant_id FROM users WHERE email = ?))`, slug, name, now, ownerEmail)
 	if err != nil {
 		return serverInfo{}, channelInfo{}, err
 	}
@@ -392,7 +1999,7 @@ func (s *serverState) createServer(ctx context.Context, name, slug, ownerEmail s
 		return serverInfo{}, channelInfo{}, err
 	}
 
-	if _, err = tx.ExecContext(ctx, `INSERT INTO server_members (server_id, user_email, role, joined_at) VALUES (?, ?, 'owner', ?)`, serverID, ownerEmail, now); err != nil {
+	if _, err = tx.ExecContext(ctx, `INSERT INTO server_members (server_id, user_id, role, joined_at) VALUES (?, `+userIDForEmail+`, 'owner', ?)`, serverID, ownerEmail, now); err != nil {
 		return serverInfo{}, channelInfo{}, err
 	}
 
@@ -405,11 +2012,16 @@ func (s *serverState) createServer(ctx context.Context, name, slug, ownerEmail s
 		return serverInfo{}, channelInfo{}, err
 	}
 
+	if _, err = tx.ExecContext(ctx, `UPDATE servers SET system_channel_id = ? WHERE id = ?`, channelID, serverID); err != nil {
+		return serverInfo{}, channelInfo{}, err
+	}
+
 	if err = tx.Commit(); err != nil {
 		return serverInfo{}, channelInfo{}, err
 	}
+	s.invalidateMembership(serverID, ownerEmail)
 
-	server := serverInfo{ID: serverID, Slug: slug, Name: name, CreatedAt: now}
+	server := serverInfo{ID: serverID, Slug: slug, Name: name, CreatedAt: now, DefaultNotifications: "all", SystemChannelID: sql.NullInt64{Int64: channelID, Valid: true}}
 	channel := channelInfo{ID: channelID, ServerID: serverID, Slug: "general", Name: "general", Kind: "text", CreatedAt: now}
 
 	return server, channel, nil
@@ -417,7 +2029,11 @@ func (s *serverState) createServer(ctx context.Context, name, slug, ownerEmail s
 
 func (s *serverState) createChannel(ctx context.Context, serverID int64, name, slug, kind string) (channelInfo, error) {
 	now := time.Now().UTC()
-	res, err := s.db.ExecContext(ctx, `INSERT INTO channels (server_id, slug, name, kind, created_at) VALUES (?, ?, ?, ?, ?)`, serverID, slug, name, kind, now)
+	postRoles := ""
+	if kind == "announcement" {
+		postRoles = "owner,admin"
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO channels (server_id, slug, name, kind, created_at, post_roles) VALUES (?, ?, ?, ?, ?, ?)`, serverID, slug, name, kind, now, postRoles)
 	if err != nil {
 		return channelInfo{}, err
 	}
@@ -425,5 +2041,5 @@ func (s *serverState) createChannel(ctx context.Context, serverID int64, name, s
 	if err != nil {
 		return channelInfo{}, err
 	}
-	return channelInfo{ID: id, ServerID: serverID, Slug: slug, Name: name, Kind: kind, CreatedAt: now}, nil
+	return channelInfo{ID: id, ServerID: serverID, Slug: slug, Name: name, Kind: kind, CreatedAt: now, PostRoles: postRoles}, nil
 }
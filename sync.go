@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSyncLimit     = 500
+	maxSyncLimit         = 1000
+	defaultSyncRetention = 30 * 24 * time.Hour
+	syncPruneEvery       = time.Hour
+
+	// syncTimeFormat matches the created_at default of sync_events so that
+	// timestamps compare correctly as text.
+	syncTimeFormat = "2006-01-02 15:04:05.000"
+)
+
+// syncTriggers record changes in sync_events as they are committed, so every
+// writer (the message queue, forwarding, imports, cascading deletes) feeds the
+// sync log without having to remember to. They are created after any table
+// rebuilds in ensureSchema, since dropping a table drops its triggers.
+var syncTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS sync_message_insert AFTER INSERT ON channel_messages BEGIN
+        INSERT INTO sync_events (type, channel_id, message_id) VALUES ('message', NEW.channel_id, NEW.id);
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS sync_message_update AFTER UPDATE ON channel_messages BEGIN
+        INSERT INTO sync_events (type, channel_id, message_id) VALUES ('message:update', NEW.channel_id, NEW.id);
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS sync_message_delete AFTER DELETE ON channel_messages BEGIN
+        INSERT INTO sync_events (type, channel_id, message_id) VALUES ('message:delete', OLD.channel_id, OLD.id);
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS sync_member_insert AFTER INSERT ON server_members BEGIN
+        INSERT INTO sync_events (type, server_id, user_id) VALUES ('member:join', NEW.server_id, NEW.user_id);
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS sync_member_update AFTER UPDATE ON server_members BEGIN
+        INSERT INTO sync_events (type, server_id, user_id) VALUES ('member:update', NEW.server_id, NEW.user_id);
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS sync_member_delete AFTER DELETE ON server_members BEGIN
+        INSERT INTO sync_events (type, server_id, user_id) VALUES ('member:leave', OLD.server_id, OLD.user_id);
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS sync_channel_insert AFTER INSERT ON channels BEGIN
+        INSERT INTO sync_events (type, server_id, channel_id) VALUES ('channel:update', NEW.server_id, NEW.id);
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS sync_channel_update AFTER UPDATE ON channels BEGIN
+        INSERT INTO sync_events (type, server_id, channel_id) VALUES ('channel:update', NEW.server_id, NEW.id);
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS sync_server_update AFTER UPDATE ON servers BEGIN
+        INSERT INTO sync_events (type, server_id) VALUES ('server:update', NEW.id);
+    END`,
+}
+
+type syncEventDTO struct {
+	Seq       int64           `json:"seq"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"createdAt"`
+	ServerID  int64           `json:"serverId,omitempty"`
+	ChannelID int64           `json:"channelId,omitempty"`
+	MessageID int64           `json:"messageId,omitempty"`
+	Message   *messageDTO     `json:"message,omitempty"`
+	Member    *memberInfo     `json:"member,omitempty"`
+	Channel   *channelPayload `json:"channel,omitempty"`
+	Server    *serverPayload  `json:"server,omitempty"`
+}
+
+type syncPayload struct {
+	Events  []syncEventDTO `json:"events"`
+	Next    int64          `json:"next"`
+	HasMore bool           `json:"hasMore"`
+}
+
+// errSyncExpired means the requested checkpoint is older than the retained
+// log; the client has to bootstrap again.
+var errSyncExpired = errors.New("sync checkpoint expired")
+
+// currentSyncSeq is the checkpoint a client should resume from after loading
+// a snapshot taken now.
+func (s *serverState) currentSyncSeq(ctx context.Context) (int64, error) {
+	var seq int64
+	err := s.readDB.QueryRowContext(ctx, `SELECT COALESCE((SELECT seq FROM sqlite_sequence WHERE name = 'sync_events'), 0)`).Scan(&seq)
+	return seq, err
+}
+
+// syncCheckpoint turns the since parameter, a sequence number or an RFC 3339
+// timestamp, into a sequence number. Times older than the retention window
+// cannot be resolved, since events after them may already be pruned.
+func (s *serverState) syncCheckpoint(ctx context.Context, since string) (int64, error) {
+	if seq, err := strconv.ParseInt(since, 10, 64); err == nil && seq >= 0 {
+		return seq, nil
+	}
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return 0, err
+	}
+	if t.Before(time.Now().Add(-s.syncRetention)) {
+		return 0, errSyncExpired
+	}
+	var seq int64
+	err = s.readDB.QueryRowContext(ctx, `
+        SELECT COALESCE(
+            (SELECT MAX(seq) FROM sync_events WHERE created_at <= ?),
+            (SELECT MIN(seq) - 1 FROM sync_events),
+            (SELECT seq FROM sqlite_sequence WHERE name = 'sync_events'),
+            0)
+    `, t.UTC().Format(syncTimeFormat)).Scan(&seq)
+	return seq, err
+}
+
+// syncEvents returns up to limit events after since that currentUser can
+// see, each resolved to the current state of what it refers to.
+func (s *serverState) syncEvents(ctx context.Context, currentUser user, since int64, limit int) (syncPayload, error) {
+	var oldest, latest int64
+	if err := s.readDB.QueryRowContext(ctx, `
+        SELECT COALESCE((SELECT MIN(seq) FROM sync_events), (SELECT seq FROM sqlite_sequence WHERE name = 'sync_events') + 1, 1),
+               COALESCE((SELECT seq FROM sqlite_sequence WHERE name = 'sync_events'), 0)
+    `).Scan(&oldest, &latest); err != nil {
+		return syncPayload{}, err
+	}
+	if since+1 < oldest {
+		return syncPayload{}, errSyncExpired
+	}
+
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT e.seq, e.type, e.created_at, COALESCE(e.server_id, 0), COALESCE(e.channel_id, 0), COALESCE(e.message_id, 0), COALESCE(e.user_id, 0)
+        FROM sync_events e
+        WHERE e.seq > ? AND e.seq <= ?
+          AND (
+            (e.type LIKE 'member:%' AND e.user_id = ?)
+            OR (e.channel_id IS NOT NULL AND EXISTS (
+                SELECT 1 FROM channels c WHERE c.id = e.channel_id AND (
+                    (c.kind = 'dm' AND EXISTS (SELECT 1 FROM dm_participants p WHERE p.channel_id = c.id AND p.user_email = ?))
+                    OR (c.kind != 'dm' AND c.server_id IN (SELECT server_id FROM server_members WHERE user_id = ?)
+                        AND `+channelVisibleTo("?")+`)
+                )))
+            OR (e.channel_id IS NULL AND e.server_id IN (SELECT server_id FROM server_members WHERE user_id = ?))
+          )
+        ORDER BY e.seq
+        LIMIT ?
+    `, since, latest, currentUser.ID, currentUser.Email, currentUser.ID, currentUser.ID, currentUser.ID, limit+1)
+	if err != nil {
+		return syncPayload{}, err
+	}
+	type rawEvent struct {
+		syncEventDTO
+		userID int64
+	}
+	var raw []rawEvent
+	for rows.Next() {
+		var ev rawEvent
+		if err := rows.Scan(&ev.Seq, &ev.Type, &ev.CreatedAt, &ev.ServerID, &ev.ChannelID, &ev.MessageID, &ev.userID); err != nil {
+			rows.Close()
+			return syncPayload{}, err
+		}
+		raw = append(raw, ev)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return syncPayload{}, err
+	}
+
+	payload := syncPayload{Events: make([]syncEventDTO, 0, len(raw)), Next: latest}
+	if len(raw) > limit {
+		raw = raw[:limit]
+		payload.HasMore = true
+		payload.Next = raw[len(raw)-1].Seq
+	}
+
+	var messageIDs []int64
+	for _, ev := range raw {
+		if ev.Type == "message" || ev.Type == "message:update" {
+			messageIDs = append(messageIDs, ev.MessageID)
+		}
+	}
+	messages, err := s.messagesByIDs(ctx, messageIDs)
+	if err != nil {
+		return syncPayload{}, err
+	}
+
+	for _, ev := range raw {
+		event := ev.syncEventDTO
+		switch {
+		case event.Type == "message" || event.Type == "message:update":
+			msg, ok := messages[event.MessageID]
+			if !ok {
+				event.Type = "message:delete"
+				break
+			}
+			dto := s.messageDTOFor(currentUser, msg)
+			event.Message = &dto
+		case strings.HasPrefix(event.Type, "member:"):
+			member, err := s.syncMember(ctx, event.ServerID, ev.userID)
+			if err != nil {
+				return syncPayload{}, err
+			}
+			event.Member = &member
+			if ev.userID == currentUser.ID && event.Type == "member:join" {
+				server, ok, err := s.syncServer(ctx, currentUser.Email, event.ServerID, true)
+				if err != nil {
+					return syncPayload{}, err
+				}
+				if ok {
+					event.Server = &server
+				}
+			}
+		case event.Type == "channel:update":
+			ch, ok, err := s.channelByID(ctx, event.ChannelID)
+			if err != nil {
+				return syncPayload{}, err
+			}
+			if ok {
+				p := toChannelPayload(ch)
+				event.Channel = &p
+			}
+		case event.Type == "server:update":
+			server, ok, err := s.syncServer(ctx, currentUser.Email, event.ServerID, false)
+			if err != nil {
+				return syncPayload{}, err
+			}
+			if ok {
+				event.Server = &server
+			}
+		}
+		payload.Events = append(payload.Events, event)
+	}
+	return payload, nil
+}
+
+func (s *serverState) messagesByIDs(ctx context.Context, ids []int64) (map[int64]chatMessage, error) {
+	result := make(map[int64]chatMessage, len(ids))
+	if len(ids) == 0 {
+		return result, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]any, 0, len(ids)+1)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	args = append(args, time.Now().UTC())
+	rows, err := s.readDB.QueryContext(ctx, messageSelect+`WHERE m.id IN (`+placeholders+`) AND (m.expires_at IS NULL OR m.expires_at > ?)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		result[msg.ID] = msg
+	}
+	return result, rows.Err()
+}
+
+// syncMember describes userID in serverID, or just the user once they have
+// left it.
+func (s *serverState) syncMember(ctx context.Context, serverID, userID int64) (memberInfo, error) {
+	var m memberInfo
+	var joinedAt sql.NullTime
+	var role sql.NullString
+	err := s.readDB.QueryRowContext(ctx, `
+        SELECT u.id, u.handle, u.display_name, sm.joined_at, sm.role, COALESCE(r.color, ''), COALESCE(r.hoist, 0)
+        FROM users u
+        LEFT JOIN server_members sm ON sm.user_id = u.id AND sm.server_id = ?
+        `+memberRolesJoin+`
+        WHERE u.id = ?
+    `, serverID, userID).Scan(&m.ID, &m.Handle, &m.DisplayName, &joinedAt, &role, &m.Color, &m.Hoisted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return memberInfo{ID: userID}, nil
+	}
+	m.JoinedAt, m.Role = joinedAt.Time, role.String
+	return m, err
+}
+
+// syncServer describes serverID, with the channels email can view when
+// withChannels is set.
+func (s *serverState) syncServer(ctx context.Context, email string, serverID int64, withChannels bool) (serverPayload, bool, error) {
+	srv, ok, err := s.serverByID(ctx, serverID)
+	if err != nil || !ok {
+		return serverPayload{}, false, err
+	}
+	var channels []channelPayload
+	if withChannels {
+		list, err := s.channelsForServer(ctx, serverID)
+		if err == nil {
+			list, err = s.visibleChannels(ctx, email, list)
+		}
+		if err != nil {
+			return serverPayload{}, false, err
+		}
+		for _, ch := range list {
+			channels = append(channels, toChannelPayload(ch))
+		}
+	}
+	return toServerPayload(srv, channels), true, nil
+}
+
+// handleSync serves GET /api/sync?since={seq|RFC 3339 time}&limit=500: the
+// changes in the caller's servers, channels and DMs since a checkpoint.
+// Clients page with next while hasMore is set; 410 means the checkpoint has
+// aged out of the log and the client must bootstrap again.
+func (s *serverState) handleSync(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+
+	raw := strings.TrimSpace(r.URL.Query().Get("since"))
+	if raw == "" {
+		httpError(w, "since is required", http.StatusBadRequest)
+		return
+	}
+	since, err := s.syncCheckpoint(ctx, raw)
+	if errors.Is(err, errSyncExpired) {
+		httpError(w, "sync checkpoint expired; bootstrap again", http.StatusGone)
+		return
+	}
+	if err != nil {
+		httpError(w, "since must be a sequence number or an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	limit := defaultSyncLimit
+	if raw := strings.TrimSpace(r.URL.Query().Get("limit")); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			limit = min(n, maxSyncLimit)
+		}
+	}
+
+	payload, err := s.syncEvents(ctx, currentUser, since, limit)
+	if errors.Is(err, errSyncExpired) {
+		httpError(w, "sync checkpoint expired; bootstrap again", http.StatusGone)
+		return
+	}
+	if err != nil {
+		log.Printf("sync events: %v", err)
+		httpError(w, "failed to load changes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		log.Printf("encode sync: %v", err)
+	}
+}
+
+// pruneSyncEvents drops sync events older than SYNC_RETENTION.
+func (s *serverState) pruneSyncEvents(ctx context.Context) error {
+	cutoff := time.Now().UTC().Add(-s.syncRetention).Format(syncTimeFormat)
+	_, err := s.db.ExecContext(ctx, `DELETE FROM sync_events WHERE created_at < ?`, cutoff)
+	return err
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Tenant modes, chosen with TENANT_MODE. Off, the whole deployment is the
+// root tenant.
+const (
+	tenantModeSubdomain = "subdomain"
+	tenantModePath      = "path"
+
+	// rootTenantID is the tenant of every account and server that predates
+	// tenancy, reached on the bare domain or without a path prefix.
+	rootTenantID = 0
+
+	tenantPathPrefix = "/t/"
+	maxTenantSlug    = 32
+	tenantCacheTTL   = time.Minute
+)
+
+// tenancyConfig says how requests are matched to a tenant: by the first
+// label under domain (acme.chat.example.com) or by a /t/acme/ path prefix.
+type tenancyConfig struct {
+	mode   string
+	domain string
+}
+
+func tenancyFromEnv() (tenancyConfig, error) {
+	cfg := tenancyConfig{
+		mode:   strings.ToLower(strings.TrimSpace(os.Getenv("TENANT_MODE"))),
+		domain: strings.ToLower(strings.Trim(strings.TrimSpace(os.Getenv("TENANT_DOMAIN")), ".")),
+	}
+	switch cfg.mode {
+	case "", "off":
+		cfg.mode = ""
+	case tenantModeSubdomain:
+		if cfg.domain == "" {
+			return tenancyConfig{}, errors.New("TENANT_MODE=subdomain requires TENANT_DOMAIN")
+		}
+	case tenantModePath:
+	default:
+		return tenancyConfig{}, fmt.Errorf("unknown TENANT_MODE %q (want subdomain or path)", cfg.mode)
+	}
+	return cfg, nil
+}
+
+// tenant is an organization hosted on the deployment, with its own accounts,
+// servers and admins.
+type tenant struct {
+	ID           int64
+	Slug         string
+	Name         string
+	HomeServerID int64
+	CreatedAt    time.Time
+}
+
+// validTenantSlug accepts 2-32 lowercase letters, digits and inner hyphens:
+// a slug has to work as a DNS label.
+func validTenantSlug(slug string) bool {
+	if len(slug) < 2 || len(slug) > maxTenantSlug || slug[0] == '-' || slug[len(slug)-1] == '-' {
+		return false
+	}
+	for _, r := range slug {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return slug != "www"
+}
+
+type tenantScopeKey struct{}
+
+// tenantScope is the tenant a request was addressed to.
+type tenantScope struct {
+	id int64
+	// basePath prefixes the tenant's URLs in path mode.
+	basePath string
+	// shared marks paths served alike to every tenant, such as uploaded
+	// media, which path mode leaves unprefixed.
+	shared bool
+}
+
+func tenantScopeFrom(ctx context.Context) tenantScope {
+	scope, _ := ctx.Value(tenantScopeKey{}).(tenantScope)
+	return scope
+}
+
+func requestTenantID(r *http.Request) int64 {
+	return tenantScopeFrom(r.Context()).id
+}
+
+// tenantMiddleware resolves the tenant a request is for. Unknown tenants are
+// not found; requests for the bare domain, or without a prefix, are for the
+// root tenant. In path mode the prefix is stripped before routing and put
+// back on redirects.
+func (s *serverState) tenantMiddleware(next http.Handler) http.Handler {
+	if s.tenancy.mode == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var scope tenantScope
+		slug := ""
+		switch s.tenancy.mode {
+		case tenantModeSubdomain:
+			host := strings.ToLower(r.Host)
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			if label, ok := strings.CutSuffix(host, "."+s.tenancy.domain); ok {
+				if strings.Contains(label, ".") {
+					errorFor(w, r, "not found", http.StatusNotFound)
+					return
+				}
+				slug = label
+			}
+		case tenantModePath:
+			rest, ok := strings.CutPrefix(r.URL.Path, tenantPathPrefix)
+			if !ok {
+				scope.shared = strings.HasPrefix(r.URL.Path, "/media/") || strings.HasPrefix(r.URL.Path, "/static/")
+				break
+			}
+			var found bool
+			if slug, rest, found = strings.Cut(rest, "/"); !found {
+				http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+				return
+			}
+			scope.basePath = tenantPathPrefix + slug
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = "/" + rest
+			r2.URL.RawPath = ""
+			r = r2
+			w = &tenantRedirectWriter{ResponseWriter: w, basePath: scope.basePath}
+		}
+		if slug != "" {
+			t, ok, err := s.tenantBySlug(r.Context(), slug)
+			if err != nil {
+				log.Printf("resolve tenant %s: %v", slug, err)
+				errorFor(w, r, "failed to load organization", http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				errorFor(w, r, "not found", http.StatusNotFound)
+				return
+			}
+			scope.id = t.ID
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantScopeKey{}, scope)))
+	})
+}
+
+// tenantRedirectWriter puts the path-mode prefix back on the site-relative
+// redirects handlers send, so a tenant's visitors stay inside it.
+type tenantRedirectWriter struct {
+	http.ResponseWriter
+	basePath string
+}
+
+func (w *tenantRedirectWriter) WriteHeader(status int) {
+	if loc := w.Header().Get("Location"); strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") && !strings.HasPrefix(loc, "/media/") {
+		w.Header().Set("Location", w.basePath+loc)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *tenantRedirectWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack lets WebSocket upgrades through, which look for it directly.
+func (w *tenantRedirectWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *tenantRedirectWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// tenantBasePath is what the tenant's own URLs start with: its path-mode
+// prefix, or nothing.
+func (s *serverState) tenantBasePath(t tenant) string {
+	if s.tenancy.mode == tenantModePath && t.ID != rootTenantID {
+		return tenantPathPrefix + t.Slug
+	}
+	return ""
+}
+
+const tenantColumns = `id, slug, name, home_server_id, created_at`
+
+func scanTenant(row interface{ Scan(...any) error }) (tenant, error) {
+	var t tenant
+	err := row.Scan(&t.ID, &t.Slug, &t.Name, &t.HomeServerID, &t.CreatedAt)
+	return t, err
+}
+
+func (s *serverState) tenantBySlug(ctx context.Context, slug string) (tenant, bool, error) {
+	if t, ok := s.tenantSlugs.get(slug); ok {
+		return t, true, nil
+	}
+	t, err := scanTenant(s.stmts.QueryRowContext(ctx, `SELECT `+tenantColumns+` FROM tenants WHERE slug = ?`, slug))
+	if errors.Is(err, sql.ErrNoRows) {
+		return tenant{}, false, nil
+	} else if err != nil {
+		return tenant{}, false, err
+	}
+	s.tenantSlugs.set(slug, t)
+	return t, true, nil
+}
+
+// tenantByID returns the tenant with id. The root tenant has no row; it is
+// named after the instance and its home is the default server.
+func (s *serverState) tenantByID(ctx context.Context, id int64) (tenant, bool, error) {
+	if id == rootTenantID {
+		return tenant{ID: rootTenantID, Name: defaultInstanceName, HomeServerID: s.defaultServerID}, true, nil
+	}
+	t, err := scanTenant(s.stmts.QueryRowContext(ctx, `SELECT `+tenantColumns+` FROM tenants WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return tenant{}, false, nil
+	} else if err != nil {
+		return tenant{}, false, err
+	}
+	s.tenantSlugs.set(t.Slug, t)
+	return t, true, nil
+}
+
+// homeServerFor is the server every account of the tenant joins.
+func (s *serverState) homeServerFor(ctx context.Context, tenantID int64) (int64, error) {
+	if tenantID == rootTenantID {
+		return s.defaultServerID, nil
+	}
+	t, ok, err := s.tenantByID(ctx, tenantID)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("tenant %d not found", tenantID)
+	}
+	return t.HomeServerID, nil
+}
+
+// isHomeServer reports whether serverID is the default server or a tenant's
+// home server, which nobody leaves.
+func (s *serverState) isHomeServer(ctx context.Context, serverID int64) (bool, error) {
+	if serverID == s.defaultServerID {
+		return true, nil
+	}
+	var home bool
+	err := s.readDB.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM tenants WHERE home_server_id = ?)`, serverID).Scan(&home)
+	return home, err
+}
+
+// createTenant adds a tenant with a home server named after it.
+func (s *serverState) createTenant(ctx context.Context, slug, name string) (tenant, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return tenant{}, err
+	}
+	defer tx.Rollback()
+
+	t := tenant{Slug: slug, Name: name, CreatedAt: time.Now().UTC()}
+	// Server slugs are unique across the deployment, so the home server
+	// takes a suffix when another tenant's server has the name.
+	serverSlug := slugify(name)
+	if serverSlug == "" || serverSlug == directServerSlug {
+		serverSlug = slug
+	}
+	var taken bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM servers WHERE slug = ?)`, serverSlug).Scan(&taken); err != nil {
+		return tenant{}, err
+	}
+	if taken {
+		serverSlug += "-" + generateSessionID()[:6]
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO servers (slug, name, created_at) VALUES (?, ?, ?)`, serverSlug, name, t.CreatedAt)
+	if err != nil {
+		return tenant{}, err
+	}
+	if t.HomeServerID, err = res.LastInsertId(); err != nil {
+		return tenant{}, err
+	}
+	// Like the default server, the home server has no system channel:
+	// everyone joins it, so join notices would only be noise.
+	if _, err := tx.ExecContext(ctx, `INSERT INTO channels (server_id, slug, name, kind, created_at) VALUES (?, 'general', 'general', 'text', ?)`, t.HomeServerID, t.CreatedAt); err != nil {
+		return tenant{}, err
+	}
+	res, err = tx.ExecContext(ctx, `INSERT INTO tenants (slug, name, home_server_id, created_at) VALUES (?, ?, ?, ?)`, t.Slug, t.Name, t.HomeServerID, t.CreatedAt)
+	if err != nil {
+		return tenant{}, err
+	}
+	if t.ID, err = res.LastInsertId(); err != nil {
+		return tenant{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE servers SET tenant_id = ? WHERE id = ?`, t.ID, t.HomeServerID); err != nil {
+		return tenant{}, err
+	}
+	return t, tx.Commit()
+}
+
+// tenantSettingKey namespaces an instance setting per tenant; the root
+// tenant keeps the plain keys.
+func tenantSettingKey(tenantID int64, key string) string {
+	if tenantID == rootTenantID {
+		return key
+	}
+	return "tenant." + strconv.FormatInt(tenantID, 10) + "." + key
+}
+
+// requireOperator admits admins of the root tenant, for the endpoints that
+// reach across the whole deployment (backups, storage, live connections).
+// Without tenancy that is every instance admin.
+func (s *serverState) requireOperator(w http.ResponseWriter, r *http.Request) (user, bool) {
+	currentUser, ok := s.requireInstanceAdmin(w, r)
+	if !ok {
+		return user{}, false
+	}
+	if currentUser.TenantID != rootTenantID {
+		httpError(w, "forbidden", http.StatusForbidden)
+		return user{}, false
+	}
+	return currentUser, true
+}
+
+func runTenant(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: echosphere tenant create|list [flags]")
+	}
+	switch args[0] {
+	case "create":
+		return runTenantCreate(args[1:])
+	case "list":
+		return runTenantList(args[1:])
+	}
+	return fmt.Errorf("unknown tenant command %q", args[0])
+}
+
+func runTenantCreate(args []string) error {
+	flags := flag.NewFlagSet("tenant create", flag.ExitOnError)
+	slug := flags.String("slug", "", "subdomain or path segment (required)")
+	name := flags.String("name", "", "organization name (defaults to the slug)")
+	flags.Parse(args)
+
+	*slug = strings.ToLower(strings.TrimSpace(*slug))
+	if !validTenantSlug(*slug) {
+		return errors.New("-slug must be 2-32 lowercase letters, digits or hyphens")
+	}
+	*name = strings.TrimSpace(*name)
+	if *name == "" {
+		*name = *slug
+	}
+
+	ctx := context.Background()
+	srv, err := openServerState(ctx)
+	if err != nil {
+		return err
+	}
+	defer srv.close()
+
+	if _, exists, err := srv.tenantBySlug(ctx, *slug); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("tenant %s already exists", *slug)
+	}
+	t, err := srv.createTenant(ctx, *slug, *name)
+	if err != nil {
+		return err
+	}
+	srv.recordAudit(ctx, t.HomeServerID, systemUserEmail, "tenant.created", "tenant", strconv.FormatInt(t.ID, 10), t.Slug)
+	fmt.Printf("created tenant %s; add its first admin with: echosphere create-admin -tenant %s -email ...\n", t.Slug, t.Slug)
+	if srv.tenancy.mode == "" {
+		fmt.Println("note: TENANT_MODE is not set, so the tenant cannot be reached yet")
+	}
+	return nil
+}
+
+func runTenantList(args []string) error {
+	flags := flag.NewFlagSet("tenant list", flag.ExitOnError)
+	flags.Parse(args)
+
+	ctx := context.Background()
+	srv, err := openServerState(ctx)
+	if err != nil {
+		return err
+	}
+	defer srv.close()
+
+	rows, err := srv.readDB.QueryContext(ctx, `
+        SELECT t.slug, t.name, t.created_at, (SELECT COUNT(*) FROM users u WHERE u.tenant_id = t.id)
+        FROM tenants t ORDER BY t.slug
+    `)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SLUG\tNAME\tACCOUNTS\tCREATED")
+	for rows.Next() {
+		var t tenant
+		var accounts int
+		if err := rows.Scan(&t.Slug, &t.Name, &t.CreatedAt, &accounts); err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", t.Slug, t.Name, accounts, t.CreatedAt.Format(time.DateOnly))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultTranscribeURL = "https://api.openai.com/v1/audio/transcriptions"
+
+// whisperCPP runs a local whisper.cpp build. Recordings are converted to
+// the 16 kHz mono WAV it expects with ffmpeg first.
+type whisperCPP struct {
+	binary   string
+	model    string
+	language string
+	ffmpeg   string
+	timeout  time.Duration
+}
+
+func whisperCPPFromEnv() (*whisperCPP, error) {
+	w := &whisperCPP{
+		binary:   envOrDefault("WHISPER_BINARY", "whisper-cli"),
+		model:    os.Getenv("WHISPER_MODEL"),
+		language: envOrDefault("WHISPER_LANGUAGE", "auto"),
+		ffmpeg:   envOrDefault("FFMPEG_BINARY", "ffmpeg"),
+		timeout:  durationFromEnv("TRANSCRIBE_TIMEOUT", defaultTranscribeTimeout),
+	}
+	if w.model == "" {
+		return nil, errors.New("TRANSCRIBE_PROVIDER=whisper-cpp needs WHISPER_MODEL")
+	}
+	return w, nil
+}
+
+func (w *whisperCPP) name() string { return "whisper-cpp" }
+
+func (w *whisperCPP) transcribe(ctx context.Context, audio []byte, contentType string) (transcriptResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	dir, err := os.MkdirTemp("", "echosphere-transcribe-")
+	if err != nil {
+		return transcriptResult{}, err
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "input"+voiceMessageTypes[contentType])
+	if err := os.WriteFile(input, audio, 0o600); err != nil {
+		return transcriptResult{}, err
+	}
+	wav := filepath.Join(dir, "audio.wav")
+	if err := runTool(ctx, w.ffmpeg, "-nostdin", "-loglevel", "error", "-y", "-i", input, "-ar", "16000", "-ac", "1", "-c:a", "pcm_s16le", wav); err != nil {
+		return transcriptResult{}, fmt.Errorf("convert audio: %w", err)
+	}
+	base := filepath.Join(dir, "transcript")
+	if err := runTool(ctx, w.binary, "-m", w.model, "-f", wav, "-l", w.language, "-np", "-oj", "-of", base); err != nil {
+		return transcriptResult{}, err
+	}
+
+	raw, err := os.ReadFile(base + ".json")
+	if err != nil {
+		return transcriptResult{}, err
+	}
+	var out struct {
+		Result struct {
+			Language string `json:"language"`
+		} `json:"result"`
+		Transcription []struct {
+			Text string `json:"text"`
+		} `json:"transcription"`
+	}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return transcriptResult{}, fmt.Errorf("read output: %w", err)
+	}
+	var text strings.Builder
+	for _, segment := range out.Transcription {
+		text.WriteString(segment.Text)
+	}
+	return transcriptResult{text: text.String(), language: out.Result.Language}, nil
+}
+
+// runTool runs an external program, returning what it printed to stderr
+// as the error when it fails.
+func runTool(ctx context.Context, name string, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %w: %s", filepath.Base(name), err, msg)
+		}
+		return fmt.Errorf("%s: %w", filepath.Base(name), err)
+	}
+	return nil
+}
+
+// httpTranscriber posts recordings to an OpenAI-compatible
+// /audio/transcriptions endpoint, which self-hosted servers such as
+// whisper.cpp's server and faster-whisper-server also provide.
+type httpTranscriber struct {
+	url    string
+	apiKey string
+	model  string
+	client *http.Client
+}
+
+func httpTranscriberFromEnv() (*httpTranscriber, error) {
+	t := &httpTranscriber{
+		url:    envOrDefault("TRANSCRIBE_API_URL", defaultTranscribeURL),
+		apiKey: os.Getenv("TRANSCRIBE_API_KEY"),
+		model:  envOrDefault("TRANSCRIBE_MODEL", "whisper-1"),
+		client: &http.Client{Timeout: durationFromEnv("TRANSCRIBE_TIMEOUT", defaultTranscribeTimeout)},
+	}
+	if t.url == defaultTranscribeURL && t.apiKey == "" {
+		return nil, errors.New("TRANSCRIBE_PROVIDER=http needs TRANSCRIBE_API_KEY, or TRANSCRIBE_API_URL for a server without one")
+	}
+	return t, nil
+}
+
+func (t *httpTranscriber) name() string { return "http" }
+
+func (t *httpTranscriber) transcribe(ctx context.Context, audio []byte, contentType string) (transcriptResult, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreatePart(map[string][]string{
+		"Content-Disposition": {fmt.Sprintf(`form-data; name="file"; filename="%s"`, voiceMessageName+voiceMessageTypes[contentType])},
+		"Content-Type":        {contentType},
+	})
+	if err != nil {
+		return transcriptResult{}, err
+	}
+	if _, err := part.Write(audio); err != nil {
+		return transcriptResult{}, err
+	}
+	if err := form.WriteField("model", t.model); err != nil {
+		return transcriptResult{}, err
+	}
+	if err := form.WriteField("response_format", "verbose_json"); err != nil {
+		return transcriptResult{}, err
+	}
+	if err := form.Close(); err != nil {
+		return transcriptResult{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, &body)
+	if err != nil {
+		return transcriptResult{}, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if t.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return transcriptResult{}, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return transcriptResult{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return transcriptResult{}, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(raw)))
+	}
+	var out struct {
+		Text     string `json:"text"`
+		Language string `json:"language"`
+	}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return transcriptResult{}, fmt.Errorf("read response: %w", err)
+	}
+	return transcriptResult{text: out.Text, language: out.Language}, nil
+}
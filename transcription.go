@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Voice messages are audio attachments recorded in the client. With
+// TRANSCRIBE_PROVIDER set, each one gets a message_transcripts row that
+// starts out pending; runTranscriber sends the audio to the provider once
+// the upload scanner has passed it, stores the text, which the search
+// index picks up, and tells the channel with message:transcript. A
+// transcript that keeps failing is given up on after transcribeAttempts.
+const (
+	transcriptPending = "pending"
+	transcriptDone    = "done"
+	transcriptFailed  = "failed"
+
+	transcribeEvery    = time.Minute
+	transcribeBatch    = 5
+	transcribeAttempts = 3
+
+	defaultTranscribeTimeout    = 5 * time.Minute
+	defaultVoiceMessageMaxBytes = 10 << 20
+	voiceMessageName            = "voice-message"
+)
+
+// voiceMessageTypes are the recordings accepted as voice messages, with the
+// extension their attachment is named with.
+var voiceMessageTypes = map[string]string{
+	"audio/ogg":   ".ogg",
+	"audio/webm":  ".webm",
+	"audio/mpeg":  ".mp3",
+	"audio/mp4":   ".m4a",
+	"audio/wav":   ".wav",
+	"audio/x-wav": ".wav",
+}
+
+type transcriptDTO struct {
+	Status   string `json:"status"`
+	Text     string `json:"text,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+// transcriber turns speech into text.
+type transcriber interface {
+	name() string
+	transcribe(ctx context.Context, audio []byte, contentType string) (transcriptResult, error)
+}
+
+type transcriptResult struct {
+	text string
+	// language is the detected language, when the provider reports one.
+	language string
+}
+
+// transcriberFromEnv returns the provider named by TRANSCRIBE_PROVIDER, or
+// nil when voice messages are not transcribed.
+func transcriberFromEnv() (transcriber, error) {
+	switch name := strings.ToLower(strings.TrimSpace(os.Getenv("TRANSCRIBE_PROVIDER"))); name {
+	case "", "none":
+		return nil, nil
+	case "whisper-cpp":
+		return whisperCPPFromEnv()
+	case "http":
+		return httpTranscriberFromEnv()
+	default:
+		return nil, fmt.Errorf("TRANSCRIBE_PROVIDER=%q is not one of none, whisper-cpp, http", name)
+	}
+}
+
+// wakeTranscriber has runTranscriber look for pending transcripts now
+// rather than at its next tick.
+func (s *serverState) wakeTranscriber() {
+	select {
+	case s.transcribeWake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *serverState) runTranscriber(ctx context.Context) {
+	if s.transcriber == nil {
+		return
+	}
+	ticker := time.NewTicker(transcribeEvery)
+	defer ticker.Stop()
+
+	for {
+		if err := s.transcribePending(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("transcribe voice messages: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.transcribeWake:
+		}
+	}
+}
+
+// transcribePending works through the pending transcripts whose audio has
+// been scanned. A provider error counts as an attempt and ends the pass,
+// unless it was the transcript's last.
+func (s *serverState) transcribePending(ctx context.Context) error {
+	for {
+		rows, err := s.readDB.QueryContext(ctx, `
+            SELECT t.message_id, t.attempts, a.content_type, a.blob_hash, b.location, b.data, b.scan_status
+            FROM message_transcripts t
+            JOIN message_attachments a ON a.id = t.attachment_id
+            JOIN attachment_blobs b ON b.hash = a.blob_hash
+            WHERE t.status = ? AND b.scan_status != ?
+            ORDER BY t.created_at
+            LIMIT ?
+        `, transcriptPending, scanPending, transcribeBatch)
+		if err != nil {
+			return err
+		}
+		type pending struct {
+			messageID                   int64
+			attempts                    int
+			contentType, hash, location string
+			data                        []byte
+			scanStatus                  string
+		}
+		var batch []pending
+		for rows.Next() {
+			var p pending
+			if err := rows.Scan(&p.messageID, &p.attempts, &p.contentType, &p.hash, &p.location, &p.data, &p.scanStatus); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		for _, p := range batch {
+			if p.scanStatus == scanRejected {
+				if err := s.finishTranscript(ctx, p.messageID, transcriptFailed, transcriptResult{}, "", "audio was quarantined"); err != nil {
+					return err
+				}
+				continue
+			}
+			result, provider, err := s.transcribeBlob(ctx, p.hash, p.location, p.data, p.contentType)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if p.attempts+1 < transcribeAttempts {
+					if err := s.recordTranscriptAttempt(ctx, p.messageID, err); err != nil {
+						return err
+					}
+					return fmt.Errorf("message %d: %w", p.messageID, err)
+				}
+				log.Printf("giving up on transcript of message %d: %v", p.messageID, err)
+				if err := s.finishTranscript(ctx, p.messageID, transcriptFailed, transcriptResult{}, "", err.Error()); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := s.finishTranscript(ctx, p.messageID, transcriptDone, result, provider, ""); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// transcribeBlob returns the transcript of some audio, reusing the one made
+// for an earlier message with the same content.
+func (s *serverState) transcribeBlob(ctx context.Context, hash, location string, inline []byte, contentType string) (transcriptResult, string, error) {
+	var result transcriptResult
+	var provider string
+	err := s.readDB.QueryRowContext(ctx, `
+        SELECT t.text, t.language, t.provider
+        FROM message_transcripts t JOIN message_attachments a ON a.id = t.attachment_id
+        WHERE a.blob_hash = ? AND t.status = ?
+        LIMIT 1
+    `, hash, transcriptDone).Scan(&result.text, &result.language, &provider)
+	if err == nil {
+		return result, provider, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return transcriptResult{}, "", err
+	}
+	audio, err := s.blobData(ctx, hash, location, inline)
+	if err != nil {
+		return transcriptResult{}, "", fmt.Errorf("load %s: %w", hash, err)
+	}
+	result, err = s.transcriber.transcribe(ctx, audio, contentType)
+	if err != nil {
+		return transcriptResult{}, "", fmt.Errorf("%s: %w", s.transcriber.name(), err)
+	}
+	result.text = strings.TrimSpace(result.text)
+	return result, s.transcriber.name(), nil
+}
+
+// recordTranscriptAttempt notes a failed attempt that will be retried.
+func (s *serverState) recordTranscriptAttempt(ctx context.Context, messageID int64, cause error) error {
+	_, err := s.db.ExecContext(ctx, `
+        UPDATE message_transcripts SET attempts = attempts + 1, last_error = ?, updated_at = ? WHERE message_id = ? AND status = ?
+    `, cause.Error(), time.Now().UTC(), messageID, transcriptPending)
+	return err
+}
+
+// finishTranscript stores the outcome of a pending transcript, logs a sync
+// update for its message and tells the channel.
+func (s *serverState) finishTranscript(ctx context.Context, messageID int64, status string, result transcriptResult, provider, lastError string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `
+        UPDATE message_transcripts SET status = ?, text = ?, language = ?, provider = ?, attempts = attempts + 1, last_error = ?, updated_at = ?
+        WHERE message_id = ? AND status = ?
+    `, status, result.text, result.language, provider, lastError, time.Now().UTC(), messageID, transcriptPending)
+	if err != nil {
+		return err
+	}
+	if changed, _ := res.RowsAffected(); changed == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `
+        INSERT INTO sync_events (type, channel_id, message_id)
+        SELECT 'message:update', channel_id, id FROM channel_messages WHERE id = ?
+    `, messageID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	msg, err := s.messageByID(ctx, messageID)
+	if err != nil {
+		log.Printf("load transcribed message %d: %v", messageID, err)
+		return nil
+	}
+	s.broadcastTranscript(toMessageDTO(msg))
+	return nil
+}
+
+// broadcastTranscript sends message:transcript with msg's transcript to
+// the channel, masked for connections that asked for it.
+func (s *serverState) broadcastTranscript(msg messageDTO) {
+	if msg.Transcript == nil {
+		return
+	}
+	frame, err := outboundFrame(wsOutbound{Type: "message:transcript", ChannelID: msg.ChannelID, MessageID: msg.ID, Transcript: msg.Transcript})
+	if err != nil {
+		log.Printf("marshal message transcript: %v", err)
+		return
+	}
+	masked := s.maskFor(true, msg)
+	if masked.Transcript.Text == msg.Transcript.Text {
+		s.ws.broadcast(msg.ChannelID, frame)
+		return
+	}
+	maskedFrame, err := outboundFrame(wsOutbound{Type: "message:transcript", ChannelID: msg.ChannelID, MessageID: msg.ID, Transcript: masked.Transcript})
+	if err != nil {
+		log.Printf("marshal masked transcript: %v", err)
+		return
+	}
+	s.ws.broadcastTo(msg.ChannelID, frame, func(c *wsClient) bool { return !c.maskProfanity.Load() })
+	s.ws.broadcastTo(msg.ChannelID, maskedFrame, func(c *wsClient) bool { return c.maskProfanity.Load() })
+}
+
+// handleVoiceMessages serves POST /api/channels/{id}/voice-messages: the
+// body is the recording itself, with durationMs and nonce as query
+// parameters.
+func (s *serverState) handleVoiceMessages(w http.ResponseWriter, r *http.Request, ch channelInfo, currentUser user) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	ext, ok := voiceMessageTypes[contentType]
+	if !ok {
+		httpError(w, "unsupported audio type", http.StatusUnsupportedMediaType)
+		return
+	}
+	var durationMS sql.NullInt64
+	if raw := r.URL.Query().Get("durationMs"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n <= 0 {
+			httpError(w, "invalid durationMs", http.StatusBadRequest)
+			return
+		}
+		durationMS = sql.NullInt64{Int64: n, Valid: true}
+	}
+	nonce := r.URL.Query().Get("nonce")
+	if len(nonce) > maxNonceLength {
+		httpError(w, "nonce too long", http.StatusBadRequest)
+		return
+	}
+
+	if ch.Kind == "voice" {
+		httpError(w, "cannot send messages to a voice channel", http.StatusBadRequest)
+		return
+	}
+	canPost, err := s.canPostInChannel(r.Context(), currentUser.Email, ch)
+	if err != nil {
+		log.Printf("check post permission: %v", err)
+		httpError(w, "failed to save message", http.StatusInternalServerError)
+		return
+	}
+	if !canPost {
+		httpError(w, "this channel is read-only", http.StatusForbidden)
+		return
+	}
+	if pending, err := s.rulesPending(r.Context(), currentUser.Email, ch); err != nil {
+		log.Printf("check server rules: %v", err)
+		httpError(w, "failed to save message", http.StatusInternalServerError)
+		return
+	} else if pending {
+		httpError(w, errRulesNotAccepted.Error(), http.StatusForbidden)
+		return
+	}
+
+	audio, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxVoiceMessageBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			httpError(w, "voice message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		httpError(w, "failed to read voice message", http.StatusBadRequest)
+		return
+	}
+	if len(audio) == 0 {
+		httpError(w, "voice message is empty", http.StatusBadRequest)
+		return
+	}
+
+	att := &newAttachment{
+		filename:    voiceMessageName + ext,
+		contentType: contentType,
+		data:        audio,
+		voice:       true,
+		durationMS:  durationMS,
+		transcribe:  s.transcriber != nil,
+	}
+	msg, duplicate, err := s.saveClientAttachment(r.Context(), ch.ID, currentUser.Email, nonce, att)
+	if qe, ok := asQuotaError(err); ok {
+		writeQuotaError(w, qe)
+		return
+	}
+	if err != nil {
+		log.Printf("save voice message: %v", err)
+		httpError(w, "failed to save message", http.StatusInternalServerError)
+		return
+	}
+	if msg.AuthorDisplayName == "" {
+		msg.AuthorDisplayName = currentUser.DisplayName
+	}
+
+	dto := toMessageDTO(msg)
+	status := http.StatusOK
+	if !duplicate {
+		status = http.StatusCreated
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(s.maskFor(currentUser.MaskProfanity, dto)); err != nil {
+		log.Printf("encode voice message response: %v", err)
+	}
+}
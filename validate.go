@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultMaxJSONBody caps API request bodies, overridable with
+// MAX_JSON_BODY_BYTES. Endpoints that take more, such as long messages and
+// server icons, pass their own limit to decodeJSONLimit.
+const defaultMaxJSONBody = 64 << 10
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// decodeJSON reads r's body into dst, capped at MAX_JSON_BODY_BYTES, and
+// validates it. On failure it has already answered: 400 for malformed JSON,
+// 413 for an oversized body and 422 listing each invalid field.
+func (s *serverState) decodeJSON(w http.ResponseWriter, r *http.Request, dst any) bool {
+	limit := s.maxJSONBody
+	if limit <= 0 {
+		limit = defaultMaxJSONBody
+	}
+	return decodeJSONLimit(w, r, dst, limit)
+}
+
+func decodeJSONLimit(w http.ResponseWriter, r *http.Request, dst any, limit int64) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit)).Decode(dst); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			httpError(w, fmt.Sprintf("request body must be %d bytes or smaller", limit), http.StatusRequestEntityTooLarge)
+			return false
+		}
+		httpError(w, "invalid request body", http.StatusBadRequest)
+		return false
+	}
+	if errs := validateStruct(dst); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return false
+	}
+	return true
+}
+
+// writeValidationErrors answers 422 for checks that need more than struct
+// tags, such as looking IDs up.
+func writeValidationErrors(w http.ResponseWriter, errs []fieldError) {
+	locale := w.Header().Get(contentLanguageHeader)
+	for i := range errs {
+		errs[i].Message = translateError(locale, errs[i].Message)
+	}
+	writeAPIError(w, http.StatusUnprocessableEntity, apiError{
+		Code:    "validation_failed",
+		Message: errs[0].Field + " " + errs[0].Message,
+		Details: map[string][]fieldError{"fields": errs},
+	})
+}
+
+// validateStruct applies the `validate` tags of the struct v points to,
+// normalising strings in place. Rules are comma separated:
+//
+//	trim, lower    trim spaces / lowercase a string before checking it
+//	required       non-empty string, non-zero number, non-empty slice
+//	min=N, max=N   bounds on a number, or on the length of a string (in
+//	               characters) or slice
+//	oneof=a|b      a string must be one of the listed values, or empty
+//	               unless required
+//
+// A nil pointer field is left alone, so PATCH bodies only check what they
+// set. Slices of structs are validated element by element.
+func validateStruct(v any) []fieldError {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	var errs []fieldError
+	validateValue(rv.Elem(), "", &errs)
+	return errs
+}
+
+func validateValue(rv reflect.Value, prefix string, errs *[]fieldError) {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		name := jsonFieldName(sf)
+		if name == "-" {
+			continue
+		}
+		field := rv.Field(i)
+		if field.Kind() == reflect.Pointer {
+			if field.IsNil() {
+				continue
+			}
+			field = field.Elem()
+		}
+		path := prefix + name
+		if rules := sf.Tag.Get("validate"); rules != "" {
+			if msg := applyRules(field, rules); msg != "" {
+				*errs = append(*errs, fieldError{Field: path, Message: msg})
+				continue
+			}
+		}
+		switch {
+		case field.Kind() == reflect.Struct && field.Type().PkgPath() != "time":
+			validateValue(field, path+".", errs)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct:
+			for j := 0; j < field.Len(); j++ {
+				validateValue(field.Index(j), path+"["+strconv.Itoa(j)+"].", errs)
+			}
+		}
+	}
+}
+
+func jsonFieldName(sf reflect.StructField) string {
+	name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+	if name == "" {
+		return sf.Name
+	}
+	return name
+}
+
+// applyRules checks field against rules and returns what is wrong with it,
+// or "" when it passes.
+func applyRules(field reflect.Value, rules string) string {
+	required := false
+	for _, rule := range strings.Split(rules, ",") {
+		key, arg, _ := strings.Cut(rule, "=")
+		switch key {
+		case "trim":
+			if field.Kind() == reflect.String && field.CanSet() {
+				field.SetString(strings.TrimSpace(field.String()))
+			}
+		case "lower":
+			if field.Kind() == reflect.String && field.CanSet() {
+				field.SetString(strings.ToLower(field.String()))
+			}
+		case "required":
+			required = true
+			if field.IsZero() || (field.Kind() == reflect.Slice && field.Len() == 0) {
+				return "is required"
+			}
+		case "min", "max":
+			limit, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				panic(fmt.Sprintf("validate: bad %s rule %q", key, rule))
+			}
+			if msg := checkBound(field, key, limit); msg != "" {
+				return msg
+			}
+		case "oneof":
+			options := strings.Split(arg, "|")
+			value := field.String()
+			if value == "" && !required {
+				continue
+			}
+			found := false
+			for _, option := range options {
+				found = found || value == option
+			}
+			if !found {
+				return "must be one of " + strings.Join(options, ", ")
+			}
+		default:
+			panic(fmt.Sprintf("validate: unknown rule %q", rule))
+		}
+	}
+	return ""
+}
+
+func checkBound(field reflect.Value, key string, limit int64) string {
+	var n int64
+	unit := ""
+	switch field.Kind() {
+	case reflect.String:
+		n, unit = int64(utf8.RuneCountInString(field.String())), " characters"
+	case reflect.Slice:
+		n, unit = int64(field.Len()), " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = field.Int()
+	default:
+		return ""
+	}
+	if key == "min" && n < limit {
+		return fmt.Sprintf("must be at least %d%s", limit, unit)
+	}
+	if key == "max" && n > limit {
+		return fmt.Sprintf("must be at most %d%s", limit, unit)
+	}
+	return ""
+}
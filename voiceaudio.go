@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// voiceAudioSettings are a voice channel's audio choices, sent to everyone
+// who joins so all clients capture and encode the same way.
+// RecordingChannelID is where recordings are posted; recording is off while
+// it is 0.
+type voiceAudioSettings struct {
+	AudioKbps          int   `json:"audioKbps"`
+	EchoCancellation   bool  `json:"echoCancellation"`
+	NoiseSuppression   bool  `json:"noiseSuppression"`
+	AutoGainControl    bool  `json:"autoGainControl"`
+	RecordingChannelID int64 `json:"recordingChannelId,omitempty"`
+}
+
+var defaultVoiceAudio = voiceAudioSettings{AudioKbps: voiceAudioKbps, EchoCancellation: true, NoiseSuppression: true, AutoGainControl: true}
+
+func (s *serverState) voiceAudioSettings(ctx context.Context, channelID int64) (voiceAudioSettings, error) {
+	var settings voiceAudioSettings
+	var recordingChannelID sql.NullInt64
+	err := s.readDB.QueryRowContext(ctx, `
+        SELECT audio_kbps, echo_cancellation, noise_suppression, auto_gain_control, recording_channel_id
+        FROM voice_channel_settings WHERE channel_id = ?
+    `, channelID).Scan(&settings.AudioKbps, &settings.EchoCancellation, &settings.NoiseSuppression, &settings.AutoGainControl, &recordingChannelID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return defaultVoiceAudio, nil
+	}
+	settings.RecordingChannelID = recordingChannelID.Int64
+	return settings, err
+}
+
+func (s *serverState) setVoiceRoomAudio(channelID int64, audioKbps int) {
+	s.voice.mu.Lock()
+	defer s.voice.mu.Unlock()
+	if room := s.voice.rooms[channelID]; room != nil {
+		room.audioKbps = audioKbps
+	}
+}
+
+// handleChannelAudio serves /api/channels/{id}/audio for voice channels: GET
+// returns the audio settings and PATCH, for server managers, changes them
+// and pushes voice:audio-settings to everyone in the channel.
+func (s *serverState) handleChannelAudio(w http.ResponseWriter, r *http.Request, ch channelInfo, currentUser user) {
+	if ch.Kind != "voice" {
+		httpError(w, "only voice channels have audio settings", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	settings, err := s.voiceAudioSettings(ctx, ch.ID)
+	if err != nil {
+		log.Printf("load voice audio settings: %v", err)
+		httpError(w, "failed to load audio settings", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		canManage, err := s.canManageChannel(ctx, currentUser.Email, ch)
+		if err != nil {
+			log.Printf("check channel manage permission: %v", err)
+			httpError(w, "failed to update audio settings", http.StatusInternalServerError)
+			return
+		}
+		if !canManage {
+			httpError(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		defer r.Body.Close()
+		var body struct {
+			// Opus accepts 6-510 kbps; below 8 speech is barely intelligible.
+			AudioKbps        *int  `json:"audioKbps" validate:"min=8,max=510"`
+			EchoCancellation *bool `json:"echoCancellation"`
+			NoiseSuppression *bool `json:"noiseSuppression"`
+			AutoGainControl  *bool `json:"autoGainControl"`
+			// 0 turns recording off.
+			RecordingChannelID *int64 `json:"recordingChannelId" validate:"min=0"`
+		}
+		if !s.decodeJSON(w, r, &body) {
+			return
+		}
+		if body.AudioKbps != nil {
+			settings.AudioKbps = *body.AudioKbps
+		}
+		if body.EchoCancellation != nil {
+			settings.EchoCancellation = *body.EchoCancellation
+		}
+		if body.NoiseSuppression != nil {
+			settings.NoiseSuppression = *body.NoiseSuppression
+		}
+		if body.AutoGainControl != nil {
+			settings.AutoGainControl = *body.AutoGainControl
+		}
+		if body.RecordingChannelID != nil && *body.RecordingChannelID != 0 {
+			target, exists, err := s.channelByID(ctx, *body.RecordingChannelID)
+			if err != nil {
+				log.Printf("load recording channel: %v", err)
+				httpError(w, "failed to update audio settings", http.StatusInternalServerError)
+				return
+			}
+			if !exists || target.ServerID != ch.ServerID || target.Kind == "voice" {
+				writeValidationErrors(w, []fieldError{{Field: "recordingChannelId", Message: "must be a text channel of the same server"}})
+				return
+			}
+		}
+		if body.RecordingChannelID != nil {
+			settings.RecordingChannelID = *body.RecordingChannelID
+		}
+
+		if _, err := s.db.ExecContext(ctx, `
+            INSERT INTO voice_channel_settings (channel_id, audio_kbps, echo_cancellation, noise_suppression, auto_gain_control, recording_channel_id, updated_at)
+            VALUES (?, ?, ?, ?, ?, ?, ?)
+            ON CONFLICT(channel_id) DO UPDATE SET
+                audio_kbps = excluded.audio_kbps,
+                echo_cancellation = excluded.echo_cancellation,
+                noise_suppression = excluded.noise_suppression,
+                auto_gain_control = excluded.auto_gain_control,
+                recording_channel_id = excluded.recording_channel_id,
+                updated_at = excluded.updated_at
+        `, ch.ID, settings.AudioKbps, settings.EchoCancellation, settings.NoiseSuppression, settings.AutoGainControl,
+			sql.NullInt64{Int64: settings.RecordingChannelID, Valid: settings.RecordingChannelID != 0}, time.Now().UTC()); err != nil {
+			log.Printf("update voice audio settings: %v", err)
+			httpError(w, "failed to update audio settings", http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit(ctx, ch.ServerID, currentUser.Email, "channel.audio", "channel", strconv.FormatInt(ch.ID, 10),
+			fmt.Sprintf("audioKbps=%d echoCancellation=%t noiseSuppression=%t autoGainControl=%t recordingChannelId=%d",
+				settings.AudioKbps, settings.EchoCancellation, settings.NoiseSuppression, settings.AutoGainControl, settings.RecordingChannelID))
+
+		s.setVoiceRoomAudio(ch.ID, settings.AudioKbps)
+		bandwidth := s.voiceRoomBandwidth(ch.ID)
+		s.voiceBroadcast(ch.ID, wsOutbound{Type: "voice:audio-settings", ChannelID: ch.ID, Audio: &settings, Bandwidth: &bandwidth}, nil)
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(settings); err != nil {
+		log.Printf("encode voice audio settings: %v", err)
+	}
+}
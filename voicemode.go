@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+const (
+	voiceModeVAD = "vad" // voice activity: the microphone is open while joined
+	voiceModePTT = "ptt" // push to talk: the microphone opens only while a key is held
+)
+
+func validVoiceMode(mode string) bool {
+	return mode == voiceModeVAD || mode == voiceModePTT
+}
+
+// setVoiceMode saves u's preferred voice mode and applies it to their open
+// connections. Rooms they are in get a voice:peer-updated so other clients
+// can show the right indicator.
+func (s *serverState) setVoiceMode(ctx context.Context, u user, mode string) error {
+	if _, err := s.db.ExecContext(ctx, `UPDATE users SET voice_mode = ? WHERE id = ?`, mode, u.ID); err != nil {
+		return err
+	}
+	s.applyVoiceMode(u, mode)
+	return nil
+}
+
+// applyVoiceMode does the connection side of setVoiceMode once the mode is
+// saved.
+func (s *serverState) applyVoiceMode(u user, mode string) {
+	var updates []wsOutbound
+	s.ws.forUser(u.Email, func(c *wsClient) {
+		s.voice.mu.Lock()
+		c.voiceMode = mode
+		if c.voiceJoined {
+			peer := c.voiceParticipant()
+			updates = append(updates, wsOutbound{Type: "voice:peer-updated", ChannelID: c.voiceChannelID, Peer: &peer})
+		}
+		s.voice.mu.Unlock()
+	})
+	for _, update := range updates {
+		s.voiceBroadcast(update.ChannelID, update, nil)
+	}
+}
+
+func (c *wsClient) handleVoiceMode(mode string) {
+	if !validVoiceMode(mode) {
+		c.sendError("voice_invalid", "mode must be 'vad' or 'ptt'")
+		return
+	}
+	ctx := context.Background()
+	if err := c.state.setVoiceMode(ctx, c.currentUser(), mode); err != nil {
+		log.Printf("set voice mode: %v", err)
+		c.sendError("internal", "failed to save voice mode")
+		return
+	}
+	u, exists, err := c.state.getUserByID(ctx, c.currentUser().ID)
+	if err != nil || !exists {
+		log.Printf("reload user after voice mode: %v", err)
+		return
+	}
+	c.state.announcePreferences(ctx, u)
+}
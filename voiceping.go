@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// voiceOriginID names this server in RTT reports, alongside ICE server IDs.
+	voiceOriginID         = "origin"
+	voiceRTTHintWindow    = 24 * time.Hour
+	voiceRTTRetention     = 7 * 24 * time.Hour
+	voiceRTTPruneEvery    = time.Hour
+	defaultRTTReportHours = 24
+)
+
+// iceServerConfig is one STUN or TURN entry from VOICE_ICE_SERVERS, in the
+// shape RTCPeerConnection expects plus an ID, a region label and an optional
+// URL clients can time to estimate their distance to the relay.
+type iceServerConfig struct {
+	ID         string   `json:"id"`
+	Region     string   `json:"region,omitempty"`
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+	ProbeURL   string   `json:"probeUrl,omitempty"`
+}
+
+var defaultICEServers = []iceServerConfig{{ID: "default-stun", URLs: []string{"stun:stun.l.google.com:19302"}}}
+
+// iceServersFromEnv reads VOICE_ICE_SERVERS, a JSON array of iceServerConfig.
+func iceServersFromEnv() []iceServerConfig {
+	raw := strings.TrimSpace(os.Getenv("VOICE_ICE_SERVERS"))
+	if raw == "" {
+		return defaultICEServers
+	}
+	servers, err := parseICEServers(raw)
+	if err != nil {
+		log.Printf("VOICE_ICE_SERVERS: %v; using the default STUN server", err)
+		return defaultICEServers
+	}
+	return servers
+}
+
+func parseICEServers(raw string) ([]iceServerConfig, error) {
+	var servers []iceServerConfig
+	if err := json.Unmarshal([]byte(raw), &servers); err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no servers listed")
+	}
+	seen := make(map[string]bool, len(servers))
+	for i := range servers {
+		if len(servers[i].URLs) == 0 {
+			return nil, fmt.Errorf("entry %d has no urls", i)
+		}
+		if servers[i].ID == "" {
+			servers[i].ID = "ice-" + strconv.Itoa(i+1)
+		}
+		if servers[i].ID == voiceOriginID || seen[servers[i].ID] {
+			return nil, fmt.Errorf("duplicate or reserved id %q", servers[i].ID)
+		}
+		seen[servers[i].ID] = true
+	}
+	return servers, nil
+}
+
+type iceServerHint struct {
+	iceServerConfig
+	// MedianRTTMillis is the median round trip other clients reported for
+	// this server over the last day, when there are any reports.
+	MedianRTTMillis *int `json:"medianRttMs,omitempty"`
+	Samples         int  `json:"samples"`
+}
+
+type voicePingDTO struct {
+	ServerTime time.Time       `json:"serverTime"`
+	ICEServers []iceServerHint `json:"iceServers"`
+}
+
+type voiceRTTSummary struct {
+	ICEServer string `json:"iceServer"`
+	Region    string `json:"region,omitempty"`
+	Samples   int    `json:"samples"`
+	Users     int    `json:"users"`
+	MinMillis int    `json:"minMs"`
+	Median    int    `json:"medianMs"`
+	P95       int    `json:"p95Ms"`
+	MaxMillis int    `json:"maxMs"`
+}
+
+func percentile(sorted []int, p float64) int {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p+0.5)]
+}
+
+// voiceRTTSummaries aggregates RTT reports since since, per ICE server ID.
+func (s *serverState) voiceRTTSummaries(ctx context.Context, since time.Time) (map[string]voiceRTTSummary, error) {
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT ice_server, user_id, rtt_ms FROM voice_rtt_reports
+        WHERE created_at >= ?
+        ORDER BY ice_server, rtt_ms
+    `, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := make(map[string][]int)
+	users := make(map[string]map[int64]bool)
+	for rows.Next() {
+		var id string
+		var userID int64
+		var rtt int
+		if err := rows.Scan(&id, &userID, &rtt); err != nil {
+			return nil, err
+		}
+		samples[id] = append(samples[id], rtt)
+		if users[id] == nil {
+			users[id] = make(map[int64]bool)
+		}
+		users[id][userID] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	summaries := make(map[string]voiceRTTSummary, len(samples))
+	for id, rtts := range samples {
+		summaries[id] = voiceRTTSummary{
+			ICEServer: id,
+			Samples:   len(rtts),
+			Users:     len(users[id]),
+			MinMillis: rtts[0],
+			Median:    percentile(rtts, 0.5),
+			P95:       percentile(rtts, 0.95),
+			MaxMillis: rtts[len(rtts)-1],
+		}
+	}
+	return summaries, nil
+}
+
+// handleVoiceAPI serves /api/voice/ping, which returns the configured ICE
+// servers with latency hints and doubles as an RTT probe of this server, and
+// /api/voice/rtt, where clients report what they measured.
+func (s *serverState) handleVoiceAPI(w http.ResponseWriter, r *http.Request) {
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch strings.Trim(r.URL.Path, "/") {
+	case "ping":
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleVoicePing(w, r)
+	case "rtt":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleVoiceRTTReport(w, r, currentUser)
+	default:
+		httpError(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (s *serverState) handleVoicePing(w http.ResponseWriter, r *http.Request) {
+	summaries, err := s.voiceRTTSummaries(r.Context(), time.Now().UTC().Add(-voiceRTTHintWindow))
+	if err != nil {
+		log.Printf("load voice rtt hints: %v", err)
+		httpError(w, "failed to load ice servers", http.StatusInternalServerError)
+		return
+	}
+
+	payload := voicePingDTO{ServerTime: time.Now().UTC(), ICEServers: make([]iceServerHint, 0, len(s.iceServers))}
+	for _, ice := range s.iceServers {
+		hint := iceServerHint{iceServerConfig: ice}
+		if summary, ok := summaries[ice.ID]; ok {
+			median := summary.Median
+			hint.MedianRTTMillis = &median
+			hint.Samples = summary.Samples
+		}
+		payload.ICEServers = append(payload.ICEServers, hint)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		log.Printf("encode voice ping: %v", err)
+	}
+}
+
+func (s *serverState) handleVoiceRTTReport(w http.ResponseWriter, r *http.Request, currentUser user) {
+	defer r.Body.Close()
+	var body struct {
+		Results []struct {
+			ICEServer string `json:"iceServer" validate:"required"`
+			RTTMillis int    `json:"rttMs" validate:"min=0,max=60000"`
+		} `json:"results" validate:"required,max=20"`
+	}
+	if !s.decodeJSON(w, r, &body) {
+		return
+	}
+	known := map[string]bool{voiceOriginID: true}
+	for _, ice := range s.iceServers {
+		known[ice.ID] = true
+	}
+	for _, result := range body.Results {
+		if !known[result.ICEServer] {
+			httpError(w, "unknown iceServer "+strconv.Quote(result.ICEServer), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("begin rtt report: %v", err)
+		httpError(w, "failed to save report", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	for _, result := range body.Results {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO voice_rtt_reports (user_id, ice_server, rtt_ms, created_at) VALUES (?, ?, ?, ?)`,
+			currentUser.ID, result.ICEServer, result.RTTMillis, now); err != nil {
+			log.Printf("save rtt report: %v", err)
+			httpError(w, "failed to save report", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("commit rtt report: %v", err)
+		httpError(w, "failed to save report", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminVoiceRTT serves /api/admin/voice/rtt: reported round trips per
+// ICE server (and "origin" for this server) over the last ?hours= hours.
+func (s *serverState) handleAdminVoiceRTT(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireOperator(w, r); !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hours := defaultRTTReportHours
+	if raw := r.URL.Query().Get("hours"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > int(voiceRTTRetention/time.Hour) {
+			httpError(w, "hours must be between 1 and 168", http.StatusBadRequest)
+			return
+		}
+		hours = n
+	}
+
+	summaries, err := s.voiceRTTSummaries(r.Context(), time.Now().UTC().Add(-time.Duration(hours)*time.Hour))
+	if err != nil {
+		log.Printf("load voice rtt reports: %v", err)
+		httpError(w, "failed to load reports", http.StatusInternalServerError)
+		return
+	}
+	regions := make(map[string]string, len(s.iceServers))
+	for _, ice := range s.iceServers {
+		regions[ice.ID] = ice.Region
+	}
+	result := make([]voiceRTTSummary, 0, len(summaries))
+	for id, summary := range summaries {
+		summary.Region = regions[id]
+		result = append(result, summary)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ICEServer < result[j].ICEServer })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("encode voice rtt reports: %v", err)
+	}
+}
+
+func (s *serverState) pruneVoiceRTTReports(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM voice_rtt_reports WHERE created_at < ?`, time.Now().UTC().Add(-voiceRTTRetention))
+	return err
+}
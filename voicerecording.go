@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Voice is a mesh and audio never reaches the server, so a recording is made
+// in the recorder's browser from their own microphone and the peers who
+// agreed to be recorded. The server decides who may record, shows everyone
+// in the room that a recording is running and posts the upload to the
+// channel the voice channel's settings name.
+const (
+	defaultVoiceRecordingMaxBytes = 100 << 20
+	voiceRecordingName            = "voice-recording"
+)
+
+// voiceRecording is the recording running in a voice room. Everyone in the
+// room gets it in voice:participants and voice:recording, which is what
+// clients show as the recording indicator.
+type voiceRecording struct {
+	ID          string    `json:"id"`
+	RecorderID  string    `json:"recorderId"` // the recorder's voice participant id
+	UserID      int64     `json:"userId"`
+	Handle      string    `json:"handle"`
+	DisplayName string    `json:"displayName"`
+	StartedAt   time.Time `json:"startedAt"`
+}
+
+// voiceRoomRecording returns the recording running in the room, if any.
+func (s *serverState) voiceRoomRecording(channelID int64) *voiceRecording {
+	s.voice.mu.RLock()
+	defer s.voice.mu.RUnlock()
+	if room := s.voice.rooms[channelID]; room != nil && room.recording != nil {
+		rec := *room.recording
+		return &rec
+	}
+	return nil
+}
+
+// stopVoiceRecordingLocked ends the room's recording when stop says so and
+// tells everyone still in the room with a voice:recording that carries no
+// recording. The caller holds s.voice.mu.
+func (s *serverState) stopVoiceRecordingLocked(channelID int64, stop func(*voiceRecording) bool) bool {
+	room := s.voice.rooms[channelID]
+	if room == nil || room.recording == nil || !stop(room.recording) {
+		return false
+	}
+	room.recording = nil
+	frame, err := outboundFrame(wsOutbound{Type: "voice:recording", ChannelID: channelID})
+	if err != nil {
+		log.Printf("marshal voice recording stop: %v", err)
+		return true
+	}
+	for _, client := range room.participants {
+		client.enqueue(frame)
+	}
+	return true
+}
+
+func (s *serverState) stopVoiceRecording(channelID int64, stop func(*voiceRecording) bool) bool {
+	s.voice.mu.Lock()
+	defer s.voice.mu.Unlock()
+	return s.stopVoiceRecordingLocked(channelID, stop)
+}
+
+// handleVoiceRecordingConsent records whether the client agrees to be
+// recorded and tells the room with voice:peer-updated. Withdrawing consent
+// also ends a recording the client is making.
+func (c *wsClient) handleVoiceRecordingConsent(enabled bool) {
+	c.state.voice.mu.Lock()
+	if !c.voiceJoined {
+		c.state.voice.mu.Unlock()
+		c.sendError("voice_not_joined", "join voice before consenting to recording")
+		return
+	}
+	changed := c.voiceRecordingConsent != enabled
+	c.voiceRecordingConsent = enabled
+	channelID := c.voiceChannelID
+	peer := c.voiceParticipant()
+	if !enabled {
+		c.state.stopVoiceRecordingLocked(channelID, func(rec *voiceRecording) bool { return rec.RecorderID == c.voiceID })
+	}
+	c.state.voice.mu.Unlock()
+
+	if changed {
+		c.state.voiceBroadcast(channelID, wsOutbound{Type: "voice:peer-updated", ChannelID: channelID, Peer: &peer}, nil)
+	}
+}
+
+// handleVoiceRecord starts or stops a recording of the client's voice room.
+// Starting needs a recording channel in the voice channel's settings that
+// the client may post in, their own consent, and no other recording running.
+func (c *wsClient) handleVoiceRecord(enabled bool) {
+	c.state.voice.mu.RLock()
+	joined, channelID, voiceID, consent := c.voiceJoined, c.voiceChannelID, c.voiceID, c.voiceRecordingConsent
+	c.state.voice.mu.RUnlock()
+	if !joined {
+		c.sendError("voice_not_joined", "join voice before recording")
+		return
+	}
+	if !enabled {
+		c.state.stopVoiceRecording(channelID, func(rec *voiceRecording) bool { return rec.RecorderID == voiceID })
+		return
+	}
+	if !consent {
+		c.sendError("voice_recording_consent", "agree to be recorded before recording")
+		return
+	}
+
+	ctx := context.Background()
+	settings, err := c.state.voiceAudioSettings(ctx, channelID)
+	if err != nil {
+		log.Printf("load voice audio settings: %v", err)
+		c.sendError("internal", "failed to start recording")
+		return
+	}
+	if settings.RecordingChannelID == 0 {
+		c.sendError("voice_recording_disabled", "recording is not enabled for this channel")
+		return
+	}
+	target, exists, err := c.state.channelByID(ctx, settings.RecordingChannelID)
+	if err != nil {
+		log.Printf("load recording channel: %v", err)
+		c.sendError("internal", "failed to start recording")
+		return
+	}
+	canPost := false
+	if exists {
+		if canPost, err = c.state.canPostInChannel(ctx, c.email, target); err != nil {
+			log.Printf("check recording post permission: %v", err)
+			c.sendError("internal", "failed to start recording")
+			return
+		}
+	}
+	if !canPost {
+		c.sendError("forbidden", "you cannot post recordings of this channel")
+		return
+	}
+
+	u := c.currentUser()
+	rec := voiceRecording{
+		ID:          generateSessionID()[:24],
+		RecorderID:  voiceID,
+		UserID:      u.ID,
+		Handle:      u.Handle,
+		DisplayName: u.DisplayName,
+		StartedAt:   time.Now().UTC(),
+	}
+	if _, err := c.state.db.ExecContext(ctx, `
+        INSERT INTO voice_recordings (id, channel_id, user_id, started_at) VALUES (?, ?, ?, ?)
+    `, rec.ID, channelID, u.ID, rec.StartedAt); err != nil {
+		log.Printf("create voice recording: %v", err)
+		c.sendError("internal", "failed to start recording")
+		return
+	}
+
+	c.state.voice.mu.Lock()
+	room := c.state.voice.rooms[channelID]
+	started := room != nil && room.recording == nil && c.voiceJoined && c.voiceChannelID == channelID && c.voiceRecordingConsent
+	if started {
+		room.recording = &rec
+	}
+	c.state.voice.mu.Unlock()
+	if !started {
+		if _, err := c.state.db.ExecContext(ctx, `DELETE FROM voice_recordings WHERE id = ?`, rec.ID); err != nil {
+			log.Printf("delete unused voice recording: %v", err)
+		}
+		c.sendError("voice_recording_active", "the room is already being recorded")
+		return
+	}
+	c.state.voiceBroadcast(channelID, wsOutbound{Type: "voice:recording", ChannelID: channelID, Recording: &rec}, nil)
+}
+
+// handleVoiceRecordingUpload serves POST
+// /api/channels/{id}/recordings/{recordingId}: the body is the finished
+// recording, with durationMs as a query parameter. Only the recorder can
+// post it, once, to the recording channel in the voice channel's settings.
+// A recording still running ends first.
+func (s *serverState) handleVoiceRecordingUpload(w http.ResponseWriter, r *http.Request, ch channelInfo, currentUser user, recordingID string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	if ch.Kind != "voice" || recordingID == "" {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	ext, ok := voiceMessageTypes[contentType]
+	if !ok {
+		httpError(w, "unsupported audio type", http.StatusUnsupportedMediaType)
+		return
+	}
+	var durationMS sql.NullInt64
+	if raw := r.URL.Query().Get("durationMs"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n <= 0 {
+			httpError(w, "invalid durationMs", http.StatusBadRequest)
+			return
+		}
+		durationMS = sql.NullInt64{Int64: n, Valid: true}
+	}
+
+	ctx := r.Context()
+	var messageID sql.NullInt64
+	err := s.db.QueryRowContext(ctx, `
+        SELECT message_id FROM voice_recordings WHERE id = ? AND channel_id = ? AND user_id = ?
+    `, recordingID, ch.ID, currentUser.ID).Scan(&messageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, "recording not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("load voice recording: %v", err)
+		httpError(w, "failed to save recording", http.StatusInternalServerError)
+		return
+	}
+	if messageID.Valid {
+		httpError(w, "recording already posted", http.StatusConflict)
+		return
+	}
+	s.stopVoiceRecording(ch.ID, func(rec *voiceRecording) bool { return rec.ID == recordingID })
+
+	settings, err := s.voiceAudioSettings(ctx, ch.ID)
+	if err != nil {
+		log.Printf("load voice audio settings: %v", err)
+		httpError(w, "failed to save recording", http.StatusInternalServerError)
+		return
+	}
+	target, exists, err := s.channelByID(ctx, settings.RecordingChannelID)
+	if err != nil {
+		log.Printf("load recording channel: %v", err)
+		httpError(w, "failed to save recording", http.StatusInternalServerError)
+		return
+	}
+	canPost := false
+	if exists {
+		if canPost, err = s.canPostInChannel(ctx, currentUser.Email, target); err != nil {
+			log.Printf("check recording post permission: %v", err)
+			httpError(w, "failed to save recording", http.StatusInternalServerError)
+			return
+		}
+	}
+	if !canPost {
+		httpError(w, "recording is not enabled for this channel", http.StatusForbidden)
+		return
+	}
+	if pending, err := s.rulesPending(ctx, currentUser.Email, target); err != nil {
+		log.Printf("check server rules: %v", err)
+		httpError(w, "failed to save recording", http.StatusInternalServerError)
+		return
+	} else if pending {
+		httpError(w, errRulesNotAccepted.Error(), http.StatusForbidden)
+		return
+	}
+
+	audio, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxVoiceRecordingBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			httpError(w, "recording too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		httpError(w, "failed to read recording", http.StatusBadRequest)
+		return
+	}
+	if len(audio) == 0 {
+		httpError(w, "recording is empty", http.StatusBadRequest)
+		return
+	}
+
+	// The nonce makes a retried upload return the message already posted.
+	nonce := voiceRecordingName + ":" + recordingID
+	msg, duplicate, err := s.messageByNonce(ctx, currentUser.Email, nonce)
+	if err == nil && !duplicate {
+		msg, duplicate, err = s.insertClientMessage(ctx, messageInsert{
+			channelID: target.ID,
+			author:    currentUser.Email,
+			content:   "Recording of #" + ch.Name,
+			nonce:     nonce,
+			createdAt: time.Now().UTC(),
+			attachment: &newAttachment{
+				filename:    voiceRecordingName + ext,
+				contentType: contentType,
+				data:        audio,
+				durationMS:  durationMS,
+			},
+		})
+	}
+	if qe, ok := asQuotaError(err); ok {
+		writeQuotaError(w, qe)
+		return
+	}
+	if err != nil {
+		log.Printf("save voice recording: %v", err)
+		httpError(w, "failed to save recording", http.StatusInternalServerError)
+		return
+	}
+	if _, err := s.db.ExecContext(ctx, `
+        UPDATE voice_recordings SET message_id = ?, ended_at = ? WHERE id = ?
+    `, msg.ID, time.Now().UTC(), recordingID); err != nil {
+		log.Printf("mark voice recording posted: %v", err)
+	}
+	if msg.AuthorDisplayName == "" {
+		msg.AuthorDisplayName = currentUser.DisplayName
+	}
+
+	dto := toMessageDTO(msg)
+	status := http.StatusOK
+	if !duplicate {
+		status = http.StatusCreated
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(s.maskFor(currentUser.MaskProfanity, dto)); err != nil {
+		log.Printf("encode voice recording response: %v", err)
+	}
+}
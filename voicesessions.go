@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sort"
+	"time"
+)
+
+type voiceUserUsage struct {
+	UserID      int64  `json:"userId"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"displayName"`
+	Sessions    int    `json:"sessions"`
+	Seconds     int64  `json:"seconds"`
+}
+
+type voiceChannelUsage struct {
+	ChannelID int64  `json:"channelId"`
+	Name      string `json:"name"`
+	Sessions  int    `json:"sessions"`
+	Seconds   int64  `json:"seconds"`
+}
+
+type voiceUsageDTO struct {
+	ServerID int64               `json:"serverId"`
+	From     string              `json:"from"`
+	To       string              `json:"to"`
+	Users    []voiceUserUsage    `json:"users"`
+	Channels []voiceChannelUsage `json:"channels"`
+}
+
+func (c *wsClient) startVoiceSession(ch channelInfo, joinedAt time.Time) {
+	res, err := c.state.db.ExecContext(context.Background(), `
+        INSERT INTO voice_sessions (channel_id, server_id, user_id, joined_at) VALUES (?, ?, ?, ?)
+    `, ch.ID, ch.ServerID, c.currentUser().ID, joinedAt)
+	if err != nil {
+		log.Printf("start voice session: %v", err)
+		return
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		log.Printf("start voice session: %v", err)
+		return
+	}
+	c.voiceSession.Store(id)
+}
+
+// endVoiceSession closes the client's open session, if any. It is safe to
+// call more than once; only the first call after a join records the leave.
+func (c *wsClient) endVoiceSession() {
+	id := c.voiceSession.Swap(0)
+	if id == 0 {
+		return
+	}
+	if _, err := c.state.db.ExecContext(context.Background(), `UPDATE voice_sessions SET left_at = ? WHERE id = ?`, time.Now().UTC(), id); err != nil {
+		log.Printf("end voice session: %v", err)
+	}
+}
+
+// closeStaleVoiceSessions ends sessions left open by a crash. When they
+// really ended is unknown, so they are closed at zero length rather than
+// guessed at.
+func (s *serverState) closeStaleVoiceSessions(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE voice_sessions SET left_at = joined_at WHERE left_at IS NULL`)
+	return err
+}
+
+// voiceUsage totals the voice time of sessions that started in [from, to],
+// given as UTC days. Sessions still in progress count up to now.
+func (s *serverState) voiceUsage(ctx context.Context, serverID int64, from, to string) (voiceUsageDTO, error) {
+	start, err := time.Parse(statsDayFormat, from)
+	if err != nil {
+		return voiceUsageDTO{}, err
+	}
+	end, err := time.Parse(statsDayFormat, to)
+	if err != nil {
+		return voiceUsageDTO{}, err
+	}
+	rows, err := s.readDB.QueryContext(ctx, `
+        SELECT vs.joined_at, vs.left_at, u.id, u.handle, u.display_name, c.id, c.name
+        FROM voice_sessions vs
+        JOIN users u ON u.id = vs.user_id
+        JOIN channels c ON c.id = vs.channel_id
+        WHERE vs.server_id = ? AND vs.joined_at >= ? AND vs.joined_at < ?
+    `, serverID, start, end.AddDate(0, 0, 1))
+	if err != nil {
+		return voiceUsageDTO{}, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	users := make(map[int64]*voiceUserUsage)
+	channels := make(map[int64]*voiceChannelUsage)
+	for rows.Next() {
+		var joinedAt time.Time
+		var leftAt sql.NullTime
+		var u voiceUserUsage
+		var ch voiceChannelUsage
+		if err := rows.Scan(&joinedAt, &leftAt, &u.UserID, &u.Handle, &u.DisplayName, &ch.ChannelID, &ch.Name); err != nil {
+			return voiceUsageDTO{}, err
+		}
+		ended := now
+		if leftAt.Valid {
+			ended = leftAt.Time
+		}
+		seconds := int64(ended.Sub(joinedAt) / time.Second)
+		if seconds < 0 {
+			seconds = 0
+		}
+
+		if users[u.UserID] == nil {
+			users[u.UserID] = &u
+		}
+		users[u.UserID].Sessions++
+		users[u.UserID].Seconds += seconds
+		if channels[ch.ChannelID] == nil {
+			channels[ch.ChannelID] = &ch
+		}
+		channels[ch.ChannelID].Sessions++
+		channels[ch.ChannelID].Seconds += seconds
+	}
+	if err := rows.Err(); err != nil {
+		return voiceUsageDTO{}, err
+	}
+
+	usage := voiceUsageDTO{
+		ServerID: serverID,
+		From:     from,
+		To:       to,
+		Users:    make([]voiceUserUsage, 0, len(users)),
+		Channels: make([]voiceChannelUsage, 0, len(channels)),
+	}
+	for _, u := range users {
+		usage.Users = append(usage.Users, *u)
+	}
+	for _, ch := range channels {
+		usage.Channels = append(usage.Channels, *ch)
+	}
+	sort.Slice(usage.Users, func(i, j int) bool {
+		if usage.Users[i].Seconds != usage.Users[j].Seconds {
+			return usage.Users[i].Seconds > usage.Users[j].Seconds
+		}
+		return usage.Users[i].UserID < usage.Users[j].UserID
+	})
+	sort.Slice(usage.Channels, func(i, j int) bool {
+		if usage.Channels[i].Seconds != usage.Channels[j].Seconds {
+			return usage.Channels[i].Seconds > usage.Channels[j].Seconds
+		}
+		return usage.Channels[i].ChannelID < usage.Channels[j].ChannelID
+	})
+	return usage, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+const (
+	defaultVoiceUplinkKbps = 2500
+	voiceAudioKbps         = 64
+	minVoiceVideoKbps      = 150
+	maxVoiceVideoKbps      = 1500
+)
+
+// voiceBandwidth suggests per-peer send bitrates. Voice is a mesh, so each
+// participant uploads a separate copy of their camera to every peer and the
+// video budget shrinks as the room grows.
+type voiceBandwidth struct {
+	AudioKbps int `json:"audioKbps"`
+	VideoKbps int `json:"videoKbps"`
+}
+
+func (s *serverState) voiceBandwidthFor(roomSize, audioKbps int) voiceBandwidth {
+	peers := roomSize - 1
+	if peers < 1 {
+		peers = 1
+	}
+	video := (s.voiceUplinkKbps - peers*audioKbps) / peers
+	video = min(max(video, minVoiceVideoKbps), maxVoiceVideoKbps)
+	return voiceBandwidth{AudioKbps: audioKbps, VideoKbps: video}
+}
+
+// voiceRoomBandwidth is voiceBandwidthFor the room's current size and audio
+// bitrate.
+func (s *serverState) voiceRoomBandwidth(channelID int64) voiceBandwidth {
+	s.voice.mu.RLock()
+	defer s.voice.mu.RUnlock()
+	size, audioKbps := 0, voiceAudioKbps
+	if room := s.voice.rooms[channelID]; room != nil {
+		size = len(room.participants)
+		if room.audioKbps > 0 {
+			audioKbps = room.audioKbps
+		}
+	}
+	return s.voiceBandwidthFor(size, audioKbps)
+}
+
+// handleVoiceVideo records whether the client's camera is on and tells the
+// room with voice:peer-updated. The video track itself is negotiated between
+// peers over voice:signal like audio.
+func (c *wsClient) handleVoiceVideo(enabled bool) {
+	c.state.voice.mu.Lock()
+	if !c.voiceJoined {
+		c.state.voice.mu.Unlock()
+		c.sendError("voice_not_joined", "join voice before turning on video")
+		return
+	}
+	changed := c.voiceVideo != enabled
+	c.voiceVideo = enabled
+	channelID := c.voiceChannelID
+	peer := c.voiceParticipant()
+	c.state.voice.mu.Unlock()
+
+	if changed {
+		c.state.voiceBroadcast(channelID, wsOutbound{Type: "voice:peer-updated", ChannelID: channelID, Peer: &peer}, nil)
+	}
+}
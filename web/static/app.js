@@ -1,15 +1,24 @@
 ﻿const appContext = window.APP_CONTEXT || {};
 const state = {
-  user: appContext.user || { email: '', displayName: '' },
-  servers: Array.isArray(appContext.servers)
-    ? appContext.servers.map((server) => ({ ...server, unread: new Map() }))
-    : [],
+  user: appContext.user || { id: 0, handle: '', email: '', displayName: '' },
+  preferences: appContext.preferences || { maskProfanity: false, voiceMode: 'vad' },
+  locales: [],
+  servers: [],
   membersByServer: new Map(),
+  // Per server, whether the member list has been loaded to the end and
+  // whether a members:request is in flight.
+  memberChunks: new Map(),
+  // serverId -> true while the user has to accept that server's rules.
+  rulesPending: new Map(),
   messagesByChannel: new Map(),
   messageIds: new Set(),
-  activeServerId: appContext.activeServerId || null,
-  activeChannelId: appContext.activeChannelId || null,
+  readMarkers: new Map(),
+  activeServerId: null,
+  activeChannelId: null,
+  syncSeq: null,
+  hasConnected: false,
   routes: appContext.routes || {},
+  csrfToken: appContext.csrfToken || '',
   loading: {
     members: false,
     messages: false,
@@ -17,14 +26,39 @@ const state = {
   socket: null,
   socketReady: false,
   pendingEvents: [],
-  wsReconnectDelay: 2000,
+  // Optimistic copies of sent messages, keyed by the nonce they were sent
+  // with, until the server acknowledges or rejects them.
+  pendingMessages: new Map(),
+  // Replaced by the server's policy from the hello frame.
+  wsReconnect: { minMs: 1000, maxMs: 60000, jitter: 0.5, closeCodes: [] },
+  wsAttempts: 0,
+  // From the last hello frame; the next connection asks for its
+  // subscriptions back with it instead of subscribing channel by channel.
+  resumeToken: null,
+  resuming: false,
+  // Instance announcements the user has not dismissed yet, oldest first.
+  announcements: [],
+  // The composer's text is saved as the channel's draft a moment after the
+  // user stops typing, so it follows them to their other devices.
+  draft: { channelId: null, timer: null },
   voice: {
     joined: false,
     channelId: null,
     currentChannelId: null,
     selfId: null,
+    joinedAt: null,
+    talking: false,
+    iceServers: null,
+    video: false,
+    bandwidth: null,
+    audio: null,
     localStream: null,
     peers: new Map(),
+    // recording is the room's running recording, as the server announced it;
+    // recorder is set while this client is the one making it.
+    recording: null,
+    consent: false,
+    recorder: null,
   },
 };
 
@@ -36,26 +70,85 @@ const refs = {
   messageList: null,
   messageWrapper: null,
   composerForm: null,
+  rulesGate: null,
+  rulesText: null,
   composerInput: null,
+  composerTTL: null,
   composerSubmit: null,
   status: null,
   headerTitle: null,
   channelBreadcrumb: null,
   voiceButton: null,
   voiceStatus: null,
+  voiceMode: null,
+  voiceTalk: null,
+  voiceCamera: null,
+  voiceConsent: null,
+  voiceRecord: null,
+  voiceRecording: null,
   voiceContainer: null,
+  maskToggle: null,
+  localeSelect: null,
+  themeSelect: null,
+  compactToggle: null,
+  fontSizeSelect: null,
 };
 
-const timeFormatter = new Intl.DateTimeFormat(undefined, {
-  hour: '2-digit',
-  minute: '2-digit',
-});
+const MAX_MESSAGE_LENGTH = 2000;
+const DRAFT_SAVE_DELAY_MS = 1000;
 
-const dayFormatter = new Intl.DateTimeFormat(undefined, {
-  weekday: 'short',
-  month: 'short',
-  day: 'numeric',
-});
+let timeFormatter;
+let dayFormatter;
+let dayKeyFormatter;
+
+// updateFormatters applies the user's locale and timezone preferences to
+// every timestamp the client shows.
+function updateFormatters() {
+  const locale = state.preferences.locale || undefined;
+  let timeZone = state.preferences.timezone || undefined;
+  try {
+    new Intl.DateTimeFormat(locale, { timeZone });
+  } catch (error) {
+    console.warn('unsupported timezone', timeZone, error);
+    timeZone = undefined;
+  }
+  timeFormatter = new Intl.DateTimeFormat(locale, { hour: '2-digit', minute: '2-digit', timeZone });
+  // Day keys are dates in the user's timezone; the labels format them as UTC
+  // midnights, so they must not be shifted again.
+  dayKeyFormatter = new Intl.DateTimeFormat('en-CA', { year: 'numeric', month: '2-digit', day: '2-digit', timeZone });
+  dayFormatter = new Intl.DateTimeFormat(locale, { weekday: 'short', month: 'short', day: 'numeric', timeZone: 'UTC' });
+}
+
+updateFormatters();
+
+const lightScheme = window.matchMedia('(prefers-color-scheme: light)');
+
+// applyAppearance applies the theme, compact mode and font size preferences.
+// The "system" theme follows the operating system.
+function applyAppearance() {
+  const root = document.documentElement;
+  const theme = state.preferences.theme || 'system';
+  root.dataset.theme = theme === 'system' ? (lightScheme.matches ? 'light' : 'dark') : theme;
+  root.dataset.compact = String(Boolean(state.preferences.compactMode));
+  root.dataset.fontSize = state.preferences.fontSize || 'normal';
+}
+
+applyAppearance();
+lightScheme.addEventListener('change', applyAppearance);
+
+function localeName(code) {
+  try {
+    return new Intl.DisplayNames([code], { type: 'language' }).of(code) || code;
+  } catch (error) {
+    return code;
+  }
+}
+
+function formatSize(bytes) {
+  if (bytes < 1024) return `${bytes} B`;
+  if (bytes < 1024 * 1024) return `${(bytes / 1024).toFixed(1)} KB`;
+  return `${(bytes / (1024 * 1024)).toFixed(1)} MB`;
+}
 
 function initialsFrom(name, fallback) {
   const source = (name || fallback || '').trim();
@@ -69,7 +162,7 @@ function initialsFrom(name, fallback) {
 function dayKey(timestamp) {
   const date = new Date(timestamp);
   if (Number.isNaN(date.getTime())) return '';
-  return `${date.getFullYear()}-${String(date.getMonth() + 1).padStart(2, '0')}-${String(date.getDate()).padStart(2, '0')}`;
+  return dayKeyFormatter.format(date);
 }
 
 function ensureArray(value) {
@@ -87,31 +180,27 @@ function ensureServerMap() {
   });
 }
 
-function initStateFromContext() {
-  ensureServerMap();
-
-  const initialMembers = ensureArray(appContext.members);
-  if (state.activeServerId) {
-    state.membersByServer.set(state.activeServerId, initialMembers);
-  }
-
-  const initialMessages = ensureArray(appContext.messages);
-  if (state.activeChannelId) {
-    const bucket = [];
-    initialMessages.forEach((msg) => {
-      bucket.push(msg);
-      state.messageIds.add(`${msg.channelId}:${msg.id}`);
-    });
-    state.messagesByChannel.set(state.activeChannelId, bucket);
-  }
-}
-
 function setStatus(message, tone = '') {
   if (!refs.status) return;
   refs.status.textContent = message || '';
   refs.status.dataset.tone = tone || '';
 }
 
+// updateConnectionQuality shows the round trip from the server's latest
+// latency frame; null marks the connection as down.
+function updateConnectionQuality(rttMs) {
+  if (!refs.connectionQuality) return;
+  let quality = 'offline';
+  let label = 'Disconnected';
+  if (typeof rttMs === 'number') {
+    quality = rttMs < 100 ? 'good' : rttMs < 300 ? 'fair' : 'poor';
+    label = `Connection ${quality}: ${Math.round(rttMs)} ms round trip`;
+  }
+  refs.connectionQuality.dataset.quality = quality;
+  refs.connectionQuality.title = label;
+  refs.connectionQuality.setAttribute('aria-label', label);
+}
+
 function isNearBottom(element) {
   if (!element) return true;
   const threshold = 120;
@@ -138,6 +227,80 @@ function getChannel(channelId) {
   return null;
 }
 
+function newNonce() {
+  if (window.crypto && typeof window.crypto.randomUUID === 'function') {
+    return window.crypto.randomUUID();
+  }
+  return `${Date.now().toString(36)}-${Math.random().toString(36).slice(2)}`;
+}
+
+function addPendingMessage(channelId, content, nonce, ttl) {
+  const msg = {
+    channelId,
+    nonce,
+    content,
+    ttl,
+    authorId: state.user.id,
+    authorHandle: state.user.handle,
+    authorDisplayName: state.user.displayName,
+    createdAt: new Date().toISOString(),
+    pending: true,
+  };
+  state.pendingMessages.set(nonce, msg);
+  ensureChannelBuffer(channelId).push(msg);
+  if (channelId === state.activeChannelId) {
+    renderMessages();
+  }
+}
+
+// settlePendingMessage drops the optimistic copy for nonce, if any.
+function settlePendingMessage(nonce) {
+  const pending = nonce && state.pendingMessages.get(nonce);
+  if (!pending) return false;
+  state.pendingMessages.delete(nonce);
+  const bucket = state.messagesByChannel.get(pending.channelId);
+  if (bucket) {
+    const index = bucket.indexOf(pending);
+    if (index !== -1) bucket.splice(index, 1);
+  }
+  return true;
+}
+
+function failPendingMessage(nonce) {
+  const pending = state.pendingMessages.get(nonce);
+  if (!pending) return false;
+  pending.pending = false;
+  pending.failed = true;
+  if (pending.channelId === state.activeChannelId) {
+    renderMessages();
+  }
+  return true;
+}
+
+function retryPendingMessage(nonce) {
+  const pending = state.pendingMessages.get(nonce);
+  if (!pending) return;
+  pending.failed = false;
+  pending.pending = true;
+  renderMessages();
+  sendChatMessage(pending.channelId, pending.content, nonce, pending.ttl);
+}
+
+// restorePendingMessages puts unsettled optimistic copies back into freshly
+// loaded buckets, dropping any whose message arrived with the load.
+function restorePendingMessages(channelId) {
+  const bucket = ensureChannelBuffer(channelId);
+  const delivered = new Set(bucket.map((msg) => msg.nonce).filter(Boolean));
+  state.pendingMessages.forEach((msg, nonce) => {
+    if (msg.channelId !== channelId) return;
+    if (delivered.has(nonce)) {
+      state.pendingMessages.delete(nonce);
+    } else if (!bucket.includes(msg)) {
+      bucket.push(msg);
+    }
+  });
+}
+
 function ensureChannelBuffer(channelId) {
   if (!state.messagesByChannel.has(channelId)) {
     state.messagesByChannel.set(channelId, []);
@@ -148,18 +311,24 @@ function ensureChannelBuffer(channelId) {
 async function fetchJSON(url, options = {}) {
   const response = await fetch(url, {
     credentials: 'same-origin',
-    headers: { 'Content-Type': 'application/json' },
+    headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': state.csrfToken },
     ...options,
   });
   if (!response.ok) {
-    const error = new Error(`Request failed: ${response.status}`);
+    // API errors carry { code, message, details, requestId }.
+    const body = await response.json().catch(() => null);
+    const error = new Error((body && body.message) || `Request failed: ${response.status}`);
     error.status = response.status;
+    error.code = body ? body.code : '';
+    error.requestId = body ? body.requestId : '';
     throw error;
   }
+  if (response.status === 204) return null;
   return response.json();
 }
 
 function clearUnread(channelId, serverId) {
+  markRead(channelId);
   const server = findServer(serverId);
   if (!server) return;
   if (server.unread.has(channelId)) {
@@ -168,6 +337,42 @@ function clearUnread(channelId, serverId) {
   }
 }
 
+// markRead moves the server-side read marker to the newest stored message
+// loaded for the channel, so other devices and bootstrap agree on what is
+// unread.
+async function markRead(channelId) {
+  if (!channelId || document.hidden) return;
+  const latest = (state.messagesByChannel.get(channelId) || [])
+    .filter((msg) => !msg.pending && !msg.ephemeral && typeof msg.id === 'number')
+    .reduce((max, msg) => Math.max(max, msg.id), 0);
+  if (latest <= (state.readMarkers.get(channelId) || 0)) return;
+  state.readMarkers.set(channelId, latest);
+  try {
+    await fetchJSON(`${state.routes.channels}/${channelId}/read`, {
+      method: 'PUT',
+      body: JSON.stringify({ messageId: latest }),
+    });
+  } catch (error) {
+    console.error('mark read', error);
+  }
+}
+
+// applyOutline takes unread counts and read markers from bootstrap's
+// accessibility outline.
+function applyOutline(outline) {
+  if (!outline || !Array.isArray(outline.channels)) return;
+  outline.channels.forEach((entry) => {
+    if (entry.lastReadId) state.readMarkers.set(entry.channelId, entry.lastReadId);
+    const server = findServer(entry.serverId);
+    if (!server || entry.channelId === state.activeChannelId) return;
+    if (entry.unreadCount > 0) {
+      server.unread.set(entry.channelId, entry.unreadCount);
+    } else {
+      server.unread.delete(entry.channelId);
+    }
+  });
+}
+
 function addUnread(channelId, serverId) {
   if (channelId === state.activeChannelId) return;
   const server = findServer(serverId);
@@ -241,14 +446,73 @@ function createVoiceControls() {
   status.className = 'voice-status';
   status.textContent = 'Disconnected';
 
+  const mode = document.createElement('select');
+  mode.className = 'voice-mode';
+  mode.setAttribute('aria-label', 'Voice mode');
+  [['vad', 'Voice activity'], ['ptt', 'Push to talk']].forEach(([value, label]) => {
+    const option = document.createElement('option');
+    option.value = value;
+    option.textContent = label;
+    mode.appendChild(option);
+  });
+  mode.value = state.preferences.voiceMode || 'vad';
+  mode.addEventListener('change', () => setVoiceMode(mode.value));
+
+  const talk = document.createElement('button');
+  talk.type = 'button';
+  talk.className = 'voice-talk';
+  talk.textContent = 'Hold to talk';
+  talk.title = 'Hold this button or the ` key to talk';
+  talk.hidden = true;
+  talk.addEventListener('pointerdown', () => setTalking(true));
+  ['pointerup', 'pointerleave', 'pointercancel'].forEach((name) => {
+    talk.addEventListener(name, () => setTalking(false));
+  });
+
+  const camera = document.createElement('button');
+  camera.type = 'button';
+  camera.className = 'voice-camera';
+  camera.textContent = 'Camera';
+  camera.hidden = true;
+  camera.addEventListener('click', () => toggleCamera());
+
+  const consent = document.createElement('button');
+  consent.type = 'button';
+  consent.className = 'voice-consent';
+  consent.title = 'Let recordings of this channel include your voice';
+  consent.hidden = true;
+  consent.addEventListener('click', () => setRecordingConsent(!state.voice.consent));
+
+  const record = document.createElement('button');
+  record.type = 'button';
+  record.className = 'voice-record';
+  record.hidden = true;
+  record.addEventListener('click', () => toggleRecording());
+
+  const recording = document.createElement('span');
+  recording.className = 'voice-recording';
+  recording.hidden = true;
+
   toolbar.appendChild(button);
+  toolbar.appendChild(talk);
+  toolbar.appendChild(camera);
+  toolbar.appendChild(consent);
+  toolbar.appendChild(record);
+  toolbar.appendChild(recording);
   toolbar.appendChild(status);
+  toolbar.appendChild(mode);
 
   const audioContainer = document.createElement('div');
   audioContainer.className = 'voice-audio-container';
 
   refs.voiceButton = button;
   refs.voiceStatus = status;
+  refs.voiceMode = mode;
+  refs.voiceTalk = talk;
+  refs.voiceCamera = camera;
+  refs.voiceConsent = consent;
+  refs.voiceRecord = record;
+  refs.voiceRecording = recording;
   refs.voiceContainer = audioContainer;
 
   return { toolbar, audioContainer };
@@ -261,30 +525,92 @@ function createChatPanel() {
   const header = document.createElement('header');
   header.className = 'chat-header';
 
+  const heading = document.createElement('div');
+  heading.className = 'chat-heading';
+
   refs.channelBreadcrumb = document.createElement('div');
   refs.channelBreadcrumb.className = 'chat-breadcrumb';
-  header.appendChild(refs.channelBreadcrumb);
+  heading.appendChild(refs.channelBreadcrumb);
+
+  refs.channelTopic = document.createElement('div');
+  refs.channelTopic.className = 'chat-topic';
+  heading.appendChild(refs.channelTopic);
+
+  header.appendChild(heading);
 
   const userContainer = document.createElement('div');
   userContainer.className = 'chat-user';
   userContainer.innerHTML = `
-    <div class="chat-user-avatar">${initialsFrom(state.user.displayName, state.user.email)}</div>
+    <div class="chat-user-avatar">${initialsFrom(state.user.displayName, state.user.handle)}</div>
     <div class="chat-user-meta">
-      <span class="chat-user-name">${state.user.displayName || state.user.email}</span>
-      <form method="post" action="/logout">
+      <span class="chat-user-name">${state.user.displayName || state.user.handle}</span>
+      <span class="connection-quality" data-quality="" title="Measuring connection…"></span>
+      <label class="chat-user-pref" title="Hide listed words in messages you receive">
+        <input type="checkbox" class="mask-profanity-toggle" />
+        Mask profanity
+      </label>
+      <label class="chat-user-pref" title="Language for times and messages from the server">
+        <select class="locale-select"></select>
+      </label>
+      <label class="chat-user-pref" title="Color theme">
+        <select class="theme-select">
+          <option value="system">System theme</option>
+          <option value="dark">Dark</option>
+          <option value="light">Light</option>
+        </select>
+      </label>
+      <label class="chat-user-pref" title="Text size">
+        <select class="font-size-select">
+          <option value="small">Small text</option>
+          <option value="normal">Normal text</option>
+          <option value="large">Large text</option>
+        </select>
+      </label>
+      <label class="chat-user-pref" title="Show more messages at once">
+        <input type="checkbox" class="compact-toggle" />
+        Compact
+      </label>
+      <form method="post" action="${state.routes.logout || '/logout'}">
+        <input type="hidden" name="csrf_token" value="${state.csrfToken}" />
         <button type="submit" class="logout-btn">Log out</button>
       </form>
     </div>
   `;
+  refs.connectionQuality = userContainer.querySelector('.connection-quality');
+  const maskToggle = userContainer.querySelector('.mask-profanity-toggle');
+  maskToggle.addEventListener('change', () => updatePreferences({ maskProfanity: maskToggle.checked }));
+  const localeSelect = userContainer.querySelector('.locale-select');
+  state.locales.forEach((code) => {
+    const option = document.createElement('option');
+    option.value = code;
+    option.textContent = localeName(code);
+    localeSelect.appendChild(option);
+  });
+  localeSelect.addEventListener('change', () => updatePreferences({ locale: localeSelect.value }));
+  const themeSelect = userContainer.querySelector('.theme-select');
+  themeSelect.addEventListener('change', () => updateAppearance({ theme: themeSelect.value }));
+  const fontSizeSelect = userContainer.querySelector('.font-size-select');
+  fontSizeSelect.addEventListener('change', () => updateAppearance({ fontSize: fontSizeSelect.value }));
+  const compactToggle = userContainer.querySelector('.compact-toggle');
+  compactToggle.addEventListener('change', () => updateAppearance({ compactMode: compactToggle.checked }));
+  Object.assign(refs, { maskToggle, localeSelect, themeSelect, fontSizeSelect, compactToggle });
+  syncPreferenceControls();
   header.appendChild(userContainer);
 
   main.appendChild(header);
 
+  refs.announcements = document.createElement('section');
+  refs.announcements.className = 'announcements';
+  refs.announcements.setAttribute('aria-live', 'polite');
+  refs.announcements.hidden = true;
+  main.appendChild(refs.announcements);
+
   refs.messageWrapper = document.createElement('section');
   refs.messageWrapper.className = 'message-wrapper';
 
   refs.messageList = document.createElement('div');
   refs.messageList.className = 'message-list';
+  refs.messageList.setAttribute('role', 'feed');
   refs.messageList.dataset.lastDay = '';
 
   refs.messageWrapper.appendChild(refs.messageList);
@@ -300,6 +626,20 @@ function createChatPanel() {
   main.appendChild(toolbar);
   main.appendChild(audioContainer);
 
+  refs.rulesGate = document.createElement('section');
+  refs.rulesGate.className = 'rules-gate';
+  refs.rulesGate.hidden = true;
+  const rulesTitle = document.createElement('h3');
+  rulesTitle.textContent = 'Server rules';
+  refs.rulesText = document.createElement('p');
+  refs.rulesText.className = 'rules-text';
+  const acceptRules = document.createElement('button');
+  acceptRules.type = 'button';
+  acceptRules.textContent = 'Accept rules';
+  acceptRules.addEventListener('click', () => acceptServerRules(state.activeServerId));
+  refs.rulesGate.append(rulesTitle, refs.rulesText, acceptRules);
+  main.appendChild(refs.rulesGate);
+
   const composer = document.createElement('form');
   composer.className = 'composer';
 
@@ -310,17 +650,35 @@ function createChatPanel() {
   textarea.autocomplete = 'off';
   textarea.spellcheck = true;
 
+  const ttl = document.createElement('select');
+  ttl.className = 'composer-ttl';
+  ttl.title = 'Delete the message after';
+  ttl.setAttribute('aria-label', 'Delete the message after');
+  [
+    ['0', 'Keep'],
+    ['60', '1 min'],
+    ['3600', '1 hour'],
+    ['86400', '1 day'],
+    ['604800', '7 days'],
+  ].forEach(([value, label]) => {
+    const option = document.createElement('option');
+    option.value = value;
+    option.textContent = label;
+    ttl.appendChild(option);
+  });
+
   const button = document.createElement('button');
   button.type = 'submit';
   button.className = 'composer-send';
   button.textContent = 'Send';
 
   composer.appendChild(textarea);
+  composer.appendChild(ttl);
   composer.appendChild(button);
 
   textarea.addEventListener('input', () => {
-    textarea.style.height = 'auto';
-    textarea.style.height = `${Math.min(textarea.scrollHeight, 200)}px`;
+    resizeComposer();
+    scheduleDraftSave();
   });
 
   textarea.addEventListener('keydown', (event) => {
@@ -334,6 +692,7 @@ function createChatPanel() {
 
   refs.composerForm = composer;
   refs.composerInput = textarea;
+  refs.composerTTL = ttl;
   refs.composerSubmit = button;
   main.appendChild(composer);
   return main;
@@ -353,6 +712,12 @@ function createMemberPanel() {
 
   refs.memberList = document.createElement('ul');
   refs.memberList.className = 'member-list';
+  refs.memberList.addEventListener('scroll', () => {
+    const list = refs.memberList;
+    if (list.scrollTop + list.clientHeight >= list.scrollHeight - 200) {
+      requestMoreMembers(state.activeServerId);
+    }
+  });
   aside.appendChild(refs.memberList);
   return aside;
 }
@@ -371,7 +736,15 @@ function renderServers() {
     const button = document.createElement('button');
     button.type = 'button';
     button.className = 'server-button';
-    button.textContent = initialsFrom(server.name, server.slug);
+    if (server.iconUrl) {
+      const icon = document.createElement('img');
+      icon.className = 'server-icon';
+      icon.src = server.iconUrl;
+      icon.alt = '';
+      button.appendChild(icon);
+    } else {
+      button.textContent = initialsFrom(server.name, server.slug);
+    }
     button.title = server.name;
     button.addEventListener('click', () => switchServer(server.id));
 
@@ -391,7 +764,7 @@ function renderChannels() {
     refs.headerTitle.textContent = server.name;
   }
 
-  server.channels.forEach((channel) => {
+  server.channels.forEach((channel, index) => {
     const item = document.createElement('li');
     item.className = 'channel-item';
     if (channel.type === 'voice') {
@@ -409,6 +782,19 @@ function renderChannels() {
     } else {
       button.innerHTML = `<span class="hash">#</span><span>${channel.name}</span>`;
     }
+    if (channel.emojiUrl || channel.emoji) {
+      const prefix = button.querySelector('.hash');
+      prefix.textContent = '';
+      if (channel.emojiUrl) {
+        const img = document.createElement('img');
+        img.className = 'channel-emoji';
+        img.src = `${channel.emojiUrl}?size=32`;
+        img.alt = '';
+        prefix.appendChild(img);
+      } else {
+        prefix.textContent = channel.emoji;
+      }
+    }
     button.addEventListener('click', () => switchChannel(channel.id));
 
     const unreadCount = server.unread.get(channel.id) || 0;
@@ -416,8 +802,13 @@ function renderChannels() {
       const badge = document.createElement('span');
       badge.className = 'channel-unread';
       badge.textContent = unreadCount > 9 ? '9+' : unreadCount.toString();
+      badge.setAttribute('aria-hidden', 'true');
       button.appendChild(badge);
     }
+    const kind = channel.type === 'voice' ? 'voice channel' : 'channel';
+    const unreadLabel = unreadCount > 0 ? `, ${unreadCount} unread` : '';
+    button.setAttribute('aria-label', `${channel.name}, ${kind} ${index + 1} of ${server.channels.length}${unreadLabel}`);
+    if (channel.id === state.activeChannelId) button.setAttribute('aria-current', 'page');
 
     item.appendChild(button);
     refs.channelList.appendChild(item);
@@ -429,18 +820,33 @@ function renderMembers() {
   refs.memberList.innerHTML = '';
 
   const members = state.membersByServer.get(state.activeServerId) || [];
+  let group = null;
   members.forEach((member) => {
+    // Hoisted roles come first, each under its own heading.
+    const memberGroup = member.hoisted ? member.role : '';
+    if (memberGroup !== group && (member.hoisted || group)) {
+      const heading = document.createElement('li');
+      heading.className = 'member-group';
+      heading.textContent = member.hoisted ? member.role : 'members';
+      refs.memberList.appendChild(heading);
+    }
+    group = memberGroup;
     const item = document.createElement('li');
     item.className = 'member-item';
     item.innerHTML = `
-      <div class="member-avatar">${initialsFrom(member.displayName, member.email)}</div>
+      <div class="member-avatar">${initialsFrom(member.displayName, member.handle)}</div>
       <div class="member-meta">
-        <span class="member-name">${member.displayName || member.email}</span>
+        <span class="member-name">${member.displayName || member.handle}</span>
         <span class="member-role">${member.role}</span>
       </div>
     `;
+    if (member.color) item.querySelector('.member-name').style.color = member.color;
     refs.memberList.appendChild(item);
   });
+  // Keep loading until the list can scroll, or there is nothing left.
+  if (refs.memberList.scrollHeight <= refs.memberList.clientHeight) {
+    requestMoreMembers(state.activeServerId);
+  }
 }
 
 function appendDayDivider(day) {
@@ -456,13 +862,16 @@ function appendDayDivider(day) {
 function createMessageElement(msg) {
   const wrapper = document.createElement('article');
   wrapper.className = 'message';
-  if ((msg.authorEmail || '').toLowerCase() === (state.user.email || '').toLowerCase()) {
+  if (msg.authorId && msg.authorId === state.user.id) {
     wrapper.classList.add('message--self');
   }
+  if (msg.pending) wrapper.classList.add('message--pending');
+  if (msg.failed) wrapper.classList.add('message--failed');
+  if (msg.ephemeral) wrapper.classList.add('message--ephemeral');
 
   const avatar = document.createElement('div');
   avatar.className = 'message-avatar';
-  avatar.textContent = initialsFrom(msg.authorDisplayName, msg.authorEmail);
+  avatar.textContent = initialsFrom(msg.authorDisplayName, msg.authorHandle);
   wrapper.appendChild(avatar);
 
   const body = document.createElement('div');
@@ -473,7 +882,9 @@ function createMessageElement(msg) {
 
   const author = document.createElement('span');
   author.className = 'message-author';
-  author.textContent = msg.authorDisplayName || msg.authorEmail;
+  author.textContent = msg.authorDisplayName || msg.authorHandle;
+  if (msg.authorHandle) author.title = `@${msg.authorHandle}`;
+  if (msg.authorColor) author.style.color = msg.authorColor;
   header.appendChild(author);
 
   const timeNode = document.createElement('time');
@@ -485,8 +896,42 @@ function createMessageElement(msg) {
   }
   header.appendChild(timeNode);
 
+  if (msg.expiresAt) {
+    const expires = new Date(msg.expiresAt);
+    const timer = document.createElement('span');
+    timer.className = 'message-expiry';
+    timer.textContent = '\u23F1';
+    timer.title = `Disappears ${dayFormatter.format(expires)} ${timeFormatter.format(expires)}`;
+    header.appendChild(timer);
+  }
+
+  if (msg.ephemeral) {
+    const note = document.createElement('span');
+    note.className = 'message-ephemeral';
+    note.textContent = 'Only you can see this';
+    header.appendChild(note);
+  } else if (msg.id && !msg.pending && !msg.failed) {
+    const star = document.createElement('button');
+    star.type = 'button';
+    star.className = 'message-star';
+    if (msg.starred) star.classList.add('message-star--on');
+    if (msg.starCount) star.classList.add('message-star--counted');
+    star.textContent = msg.starCount ? `\u2605 ${msg.starCount}` : msg.starred ? '\u2605' : '\u2606';
+    star.title = msg.starred ? 'Remove from saved messages' : 'Save message';
+    star.setAttribute('aria-pressed', msg.starred ? 'true' : 'false');
+    star.addEventListener('click', () => toggleStar(msg));
+    header.appendChild(star);
+  }
+
   body.appendChild(header);
 
+  if (msg.forwardedFrom) {
+    const origin = document.createElement('p');
+    origin.className = 'message-origin';
+    origin.textContent = `${msg.crossposted ? 'Crossposted' : 'Forwarded'} from ${msg.forwardedFrom.authorDisplayName || msg.forwardedFrom.authorHandle}`;
+    body.appendChild(origin);
+  }
+
   const content = document.createElement('p');
   content.className = 'message-content';
   const safe = (msg.content || '')
@@ -497,12 +942,56 @@ function createMessageElement(msg) {
     .replace(/'/g, '&#39;')
     .replace(/\n/g, '<br />');
   content.innerHTML = safe;
-  body.appendChild(content);
+  if (msg.content || !msg.attachments) body.appendChild(content);
+
+  (msg.attachments || []).forEach((attachment) => {
+    const link = document.createElement('a');
+    link.className = 'message-attachment';
+    link.href = attachment.url;
+    link.target = '_blank';
+    link.rel = 'noopener';
+    const name = document.createElement('span');
+    name.className = 'message-attachment-name';
+    name.textContent = attachment.filename;
+    const size = document.createElement('span');
+    size.className = 'message-attachment-size';
+    size.textContent = formatSize(attachment.size);
+    link.append(name, size);
+    body.appendChild(link);
+  });
+
+  if (msg.failed) {
+    const retry = document.createElement('button');
+    retry.type = 'button';
+    retry.className = 'message-retry';
+    retry.textContent = 'Failed to send. Retry';
+    retry.addEventListener('click', () => retryPendingMessage(msg.nonce));
+    body.appendChild(retry);
+  }
 
   wrapper.appendChild(body);
   return wrapper;
 }
 
+async function toggleStar(msg) {
+  const starred = !msg.starred;
+  try {
+    await fetchJSON(`${state.routes.channels}/${msg.channelId}/messages/${msg.id}/star`, {
+      method: starred ? 'PUT' : 'DELETE',
+    });
+  } catch (error) {
+    console.error('star', error);
+    setStatus('Could not update saved messages.', 'error');
+    return;
+  }
+  // Only the author sees how many people starred a message.
+  if (msg.authorId === state.user.id && msg.starred !== starred) {
+    msg.starCount = Math.max(0, (msg.starCount || 0) + (starred ? 1 : -1));
+  }
+  msg.starred = starred;
+  if (msg.channelId === state.activeChannelId) renderMessages();
+}
+
 function renderMessages() {
   if (!refs.messageList) return;
   refs.messageList.innerHTML = '';
@@ -539,6 +1028,7 @@ async function switchServer(serverId) {
   await Promise.all([
     ensureMembersLoaded(serverId),
     ensureMessagesLoaded(state.activeChannelId),
+    ensureRulesLoaded(serverId),
   ]);
 
   subscribeAllChannels();
@@ -582,9 +1072,22 @@ function updateChannelUI() {
       refs.channelBreadcrumb.textContent = '';
     }
   }
+  if (refs.channelTopic) {
+    const topic = (channel && channel.topic) || '';
+    refs.channelTopic.textContent = topic;
+    refs.channelTopic.title = topic;
+    refs.channelTopic.hidden = !topic;
+  }
+
+  // New members read and accept the server's rules before they can post.
+  const rulesPending = Boolean(server && state.rulesPending.get(server.id));
+  if (refs.rulesGate) {
+    refs.rulesGate.hidden = !rulesPending || !channel || isVoice;
+    refs.rulesText.textContent = rulesPending ? server.rules : '';
+  }
 
   if (refs.composerInput) {
-    refs.composerInput.disabled = !channel || isVoice;
+    refs.composerInput.disabled = !channel || isVoice || rulesPending;
     if (!channel) {
       refs.composerInput.placeholder = 'Message';
     } else if (isVoice) {
@@ -593,8 +1096,11 @@ function updateChannelUI() {
       refs.composerInput.placeholder = `Message #${channel.name}`;
     }
   }
+  if (refs.composerTTL) {
+    refs.composerTTL.disabled = !channel || isVoice;
+  }
   if (refs.composerSubmit) {
-    refs.composerSubmit.disabled = !channel || isVoice;
+    refs.composerSubmit.disabled = !channel || isVoice || rulesPending;
   }
 
   if (!isVoice && state.voice.joined && state.voice.channelId && state.voice.channelId !== channelId) {
@@ -620,6 +1126,125 @@ function updateBreadcrumb() {
 
 function updateComposerPlaceholder() {
   updateChannelUI();
+  loadDraft(state.activeChannelId);
+}
+
+function resizeComposer() {
+  const textarea = refs.composerInput;
+  if (!textarea) return;
+  textarea.style.height = 'auto';
+  textarea.style.height = `${Math.min(textarea.scrollHeight, 200)}px`;
+}
+
+function draftURL(channelId) {
+  return `${state.routes.channels}/${channelId}/draft`;
+}
+
+function scheduleDraftSave() {
+  clearTimeout(state.draft.timer);
+  state.draft.timer = setTimeout(flushDraft, DRAFT_SAVE_DELAY_MS);
+}
+
+// flushDraft saves the composer's text for the channel it was typed in, if a
+// save is pending.
+function flushDraft() {
+  if (!state.draft.timer) return;
+  clearTimeout(state.draft.timer);
+  state.draft.timer = null;
+  const channelId = state.draft.channelId;
+  if (!channelId || !refs.composerInput) return;
+  fetchJSON(draftURL(channelId), {
+    method: 'PUT',
+    body: JSON.stringify({ content: refs.composerInput.value }),
+    keepalive: true,
+  }).catch((error) => console.error('save draft', error));
+}
+
+// loadDraft puts the saved draft for channelId in the composer when the user
+// moves to it, after saving what they left behind in the previous channel.
+async function loadDraft(channelId) {
+  if (!refs.composerInput || state.draft.channelId === channelId) return;
+  flushDraft();
+  state.draft.channelId = channelId;
+  refs.composerInput.value = '';
+  resizeComposer();
+  const channel = getChannel(channelId);
+  if (!channel || channel.type === 'voice') return;
+  try {
+    const draft = await fetchJSON(draftURL(channelId));
+    if (state.draft.channelId !== channelId || refs.composerInput.value) return;
+    refs.composerInput.value = draft.content || '';
+    resizeComposer();
+  } catch (error) {
+    console.error('load draft', error);
+  }
+}
+
+// Large member lists arrive a chunk at a time: the first with bootstrap or
+// the members endpoint, the rest as members:chunk once the list is
+// scrolled near its end.
+const MEMBER_CHUNK_SIZE = 100;
+
+function requestMoreMembers(serverId) {
+  const chunks = state.memberChunks.get(serverId);
+  if (!chunks || chunks.done || chunks.pending) return;
+  const members = state.membersByServer.get(serverId) || [];
+  const last = members[members.length - 1];
+  chunks.pending = true;
+  sendSocketEvent({ type: 'members:request', serverId, after: last ? last.id : 0 });
+}
+
+function applyMemberChunk(data) {
+  const chunks = state.memberChunks.get(data.serverId);
+  if (!chunks || data.query) return;
+  chunks.pending = false;
+  chunks.done = Boolean(data.done);
+  const members = state.membersByServer.get(data.serverId) || [];
+  const known = new Set(members.map((member) => member.id));
+  ensureArray(data.members).forEach((member) => {
+    if (!known.has(member.id)) members.push(member);
+  });
+  state.membersByServer.set(data.serverId, members);
+  if (data.serverId === state.activeServerId) {
+    renderMembers();
+  }
+}
+
+// Role colors and hoisting change the whole list's order, so reload it.
+async function handleRolesUpdate(serverId) {
+  state.membersByServer.delete(serverId);
+  state.memberChunks.delete(serverId);
+  if (serverId !== state.activeServerId) return;
+  await ensureMembersLoaded(serverId);
+  renderMembers();
+}
+
+async function ensureRulesLoaded(serverId, { force = false } = {}) {
+  const server = findServer(serverId);
+  if (!server) return;
+  if (!server.rules) {
+    state.rulesPending.delete(serverId);
+    return;
+  }
+  if (state.rulesPending.has(serverId) && !force) return;
+  try {
+    const rules = await fetchJSON(`${state.routes.servers}/${serverId}/rules`);
+    state.rulesPending.set(serverId, Boolean(rules.mustAccept));
+  } catch (error) {
+    console.error('load rules', error);
+  }
+}
+
+async function acceptServerRules(serverId) {
+  try {
+    const rules = await fetchJSON(`${state.routes.servers}/${serverId}/rules/accept`, { method: 'POST' });
+    state.rulesPending.set(serverId, Boolean(rules.mustAccept));
+    updateChannelUI();
+    if (refs.composerInput) refs.composerInput.focus();
+  } catch (error) {
+    console.error('accept rules', error);
+    setStatus('Could not accept the rules.', 'error');
+  }
 }
 
 async function ensureMembersLoaded(serverId) {
@@ -627,8 +1252,9 @@ async function ensureMembersLoaded(serverId) {
   if (state.membersByServer.has(serverId)) return;
   state.loading.members = true;
   try {
-    const members = await fetchJSON(`${state.routes.servers}/${serverId}/members`);
+    const members = await fetchJSON(`${state.routes.servers}/${serverId}/members?limit=${MEMBER_CHUNK_SIZE}`);
     state.membersByServer.set(serverId, members);
+    state.memberChunks.set(serverId, { done: members.length < MEMBER_CHUNK_SIZE, pending: false });
   } catch (error) {
     console.error('load members', error);
     setStatus('Could not load members.', 'error');
@@ -655,6 +1281,7 @@ async function ensureMessagesLoaded(channelId, { force = false } = {}) {
       }
     });
     state.messagesByChannel.set(channelId, bucket);
+    restorePendingMessages(channelId);
   } catch (error) {
     console.error('load messages', error);
     setStatus('Could not load messages.', 'error');
@@ -684,6 +1311,46 @@ function flushPendingEvents() {
   }
 }
 
+// catchUpAfterReconnect applies whatever happened while we were away. If the
+// sync log cannot help and the server dropped us for falling behind, cached
+// history may have gaps, so reload it.
+function catchUpAfterReconnect() {
+  const resync = state.resyncMessages;
+  state.resyncMessages = false;
+  catchUp().then((ok) => {
+    if (ok || !resync) return;
+    state.messagesByChannel.clear();
+    state.messageIds.clear();
+    ensureMessagesLoaded(state.activeChannelId).then(renderMessages);
+  });
+}
+
+// applyResumed finishes a resumed connection: channels the old one did not
+// know about are subscribed, and the replayed events are applied like a
+// sync page.
+function applyResumed(data) {
+  state.resuming = false;
+  const restored = new Set(ensureArray(data.channelIds));
+  const missing = [];
+  state.servers.forEach((server) => {
+    (server.channels || []).forEach((channel) => {
+      if (!restored.has(channel.id)) missing.push(channel.id);
+    });
+  });
+  if (missing.length > 0) {
+    sendSocketEvent({ type: 'subscribe:bulk', channelIds: missing });
+  }
+  if (!data.sync || data.sync.hasMore || state.syncSeq === null) {
+    catchUpAfterReconnect();
+    return;
+  }
+  state.resyncMessages = false;
+  if (applySyncEvents(data.sync.events)) {
+    bootstrapLatest();
+  }
+  state.syncSeq = Math.max(state.syncSeq, data.sync.next);
+}
+
 function subscribeAllChannels() {
   if (!state.routes.ws) return;
   const allChannels = [];
@@ -692,9 +1359,8 @@ function subscribeAllChannels() {
       allChannels.push(channel.id);
     });
   });
-  allChannels.forEach((channelId) => {
-    sendSocketEvent({ type: 'subscribe', channelId });
-  });
+  if (allChannels.length === 0) return;
+  sendSocketEvent({ type: 'subscribe:bulk', channelIds: allChannels });
 }
 
 function updateVoiceUI(statusText = '') {
@@ -710,17 +1376,262 @@ function updateVoiceUI(statusText = '') {
   }
 
   refs.voiceButton.disabled = false;
+  if (refs.voiceTalk) {
+    refs.voiceTalk.hidden = !(state.voice.joined && state.preferences.voiceMode === 'ptt');
+    refs.voiceTalk.classList.toggle('is-active', state.voice.talking);
+  }
+  if (refs.voiceCamera) {
+    refs.voiceCamera.hidden = !state.voice.joined;
+    refs.voiceCamera.classList.toggle('is-active', state.voice.video);
+    refs.voiceCamera.textContent = state.voice.video ? 'Stop Camera' : 'Camera';
+  }
+  updateRecordingUI();
   if (state.voice.joined && state.voice.channelId === channelId) {
     refs.voiceButton.textContent = 'Leave Voice';
     refs.voiceButton.classList.add('is-active');
-    refs.voiceStatus.textContent = statusText || 'Live';
+    refs.voiceStatus.textContent = statusText || voiceLiveText();
+    refs.voiceStatus.title = voicePeersTitle();
   } else {
     refs.voiceButton.textContent = 'Join Voice';
     refs.voiceButton.className = 'voice-button';
     refs.voiceStatus.textContent = statusText || 'Disconnected';
+    refs.voiceStatus.title = '';
   }
 }
 
+function voiceLiveText() {
+  if (!state.voice.joinedAt) return 'Live';
+  return `Live since ${timeFormatter.format(new Date(state.voice.joinedAt))}`;
+}
+
+function voicePeersTitle() {
+  const lines = [];
+  state.voice.peers.forEach(({ participant }) => {
+    let line = participant.displayName || participant.handle || 'Someone';
+    if (participant.mode === 'ptt') line += ' (push to talk)';
+    if (participant.joinedAt) line += `, in voice since ${timeFormatter.format(new Date(participant.joinedAt))}`;
+    lines.push(line);
+  });
+  return lines.join('\n');
+}
+
+// applyMicrophone keeps the microphone muted in push-to-talk mode unless the
+// talk button or key is held.
+function applyMicrophone() {
+  if (!state.voice.localStream) return;
+  const open = state.preferences.voiceMode !== 'ptt' || state.voice.talking;
+  state.voice.localStream.getAudioTracks().forEach((track) => {
+    track.enabled = open;
+  });
+}
+
+function setTalking(talking) {
+  if (state.voice.talking === talking) return;
+  state.voice.talking = talking;
+  applyMicrophone();
+  updateVoiceUI();
+}
+
+async function setVoiceMode(mode) {
+  state.preferences.voiceMode = mode;
+  state.voice.talking = false;
+  applyMicrophone();
+  updateVoiceUI();
+  try {
+    state.preferences = await fetchJSON(state.routes.preferences, {
+      method: 'PATCH',
+      body: JSON.stringify({ voiceMode: mode }),
+    });
+  } catch (error) {
+    console.error('update voice mode', error);
+    setStatus('Failed to save voice mode.', 'error');
+  }
+}
+
+function handleVoicePeerUpdated(channelId, participant) {
+  if (!participant || channelId !== state.voice.channelId) return;
+  if (participant.id === state.voice.selfId) {
+    // Changed from another tab or device.
+    if (participant.mode && participant.mode !== state.preferences.voiceMode) {
+      state.preferences.voiceMode = participant.mode;
+      if (refs.voiceMode) refs.voiceMode.value = participant.mode;
+      state.voice.talking = false;
+      applyMicrophone();
+    }
+  } else if (state.voice.peers.has(participant.id)) {
+    const peer = state.voice.peers.get(participant.id);
+    peer.participant = participant;
+    if (peer.videoTile) peer.videoTile.hidden = !participant.video;
+    syncRecorderSources();
+  }
+  updateVoiceUI();
+}
+
+function updateRecordingUI() {
+  const enabled = state.voice.joined && Boolean(state.voice.audio && state.voice.audio.recordingChannelId);
+  if (refs.voiceConsent) {
+    refs.voiceConsent.hidden = !enabled;
+    refs.voiceConsent.classList.toggle('is-active', state.voice.consent);
+    refs.voiceConsent.textContent = state.voice.consent ? 'Recording allowed' : 'Allow recording';
+  }
+  const recording = state.voice.joined ? state.voice.recording : null;
+  if (refs.voiceRecord) {
+    refs.voiceRecord.hidden = !enabled || Boolean(recording && !state.voice.recorder);
+    refs.voiceRecord.classList.toggle('is-active', Boolean(state.voice.recorder));
+    refs.voiceRecord.textContent = state.voice.recorder ? 'Stop Recording' : 'Record';
+  }
+  if (refs.voiceRecording) {
+    refs.voiceRecording.hidden = !recording;
+    if (recording) {
+      const by = recording.displayName || recording.handle || 'Someone';
+      refs.voiceRecording.textContent = `Recording by ${by}`;
+      refs.voiceRecording.title = `Since ${timeFormatter.format(new Date(recording.startedAt))}. `
+        + 'Only people who allowed recording are included.';
+    }
+  }
+}
+
+function setRecordingConsent(enabled) {
+  if (!state.voice.joined) return;
+  state.voice.consent = enabled;
+  sendSocketEvent({ type: 'voice:recording-consent', enabled });
+  if (!enabled) finishRecording();
+  updateVoiceUI();
+}
+
+// toggleRecording asks the server to start or stop a recording. Recording
+// includes the recorder's own voice, so starting one also gives consent.
+function toggleRecording() {
+  if (!state.voice.joined) return;
+  if (state.voice.recorder) {
+    sendSocketEvent({ type: 'voice:record', enabled: false });
+    finishRecording();
+    updateVoiceUI();
+    return;
+  }
+  if (typeof MediaRecorder === 'undefined' || typeof AudioContext === 'undefined') {
+    setStatus('Recording is not supported in this browser.', 'error');
+    return;
+  }
+  if (!state.voice.consent) setRecordingConsent(true);
+  sendSocketEvent({ type: 'voice:record', enabled: true });
+}
+
+function handleVoiceRecording(channelId, recording) {
+  if (channelId !== state.voice.channelId || !state.voice.joined) return;
+  state.voice.recording = recording || null;
+  const mine = recording && recording.recorderId === state.voice.selfId;
+  if (mine && !state.voice.recorder) {
+    startRecorder(recording);
+  } else if (!mine && state.voice.recorder) {
+    finishRecording();
+  }
+  updateVoiceUI();
+}
+
+const RECORDING_TYPES = ['audio/webm;codecs=opus', 'audio/ogg;codecs=opus', 'audio/webm', 'audio/mp4'];
+
+// startRecorder mixes the microphone and the audio of every peer who allowed
+// recording into one track and records it. syncRecorderSources keeps the mix
+// in step as peers come, go and change their mind.
+function startRecorder(recording) {
+  const mimeType = RECORDING_TYPES.find((type) => MediaRecorder.isTypeSupported(type));
+  if (!mimeType || !state.voice.localStream) {
+    sendSocketEvent({ type: 'voice:record', enabled: false });
+    setStatus('Recording is not supported in this browser.', 'error');
+    return;
+  }
+  const context = new AudioContext();
+  const destination = context.createMediaStreamDestination();
+  const media = new MediaRecorder(destination.stream, { mimeType });
+  const recorder = {
+    id: recording.id,
+    channelId: state.voice.channelId,
+    context,
+    destination,
+    media,
+    mimeType,
+    chunks: [],
+    sources: new Map(),
+    startedAt: Date.now(),
+  };
+  media.addEventListener('dataavailable', (event) => {
+    if (event.data.size > 0) recorder.chunks.push(event.data);
+  });
+  recorder.stopped = new Promise((resolve) => media.addEventListener('stop', resolve, { once: true }));
+  state.voice.recorder = recorder;
+  syncRecorderSources();
+  media.start(1000);
+}
+
+function syncRecorderSources() {
+  const recorder = state.voice.recorder;
+  if (!recorder) return;
+  const wanted = new Map();
+  if (state.voice.consent && state.voice.localStream) wanted.set('self', state.voice.localStream);
+  state.voice.peers.forEach((peer) => {
+    if (peer.participant.recordingConsent && peer.audio && peer.audio.srcObject) {
+      wanted.set(peer.id, peer.audio.srcObject);
+    }
+  });
+  recorder.sources.forEach((source, id) => {
+    if (wanted.get(id) !== source.mediaStream) {
+      source.disconnect();
+      recorder.sources.delete(id);
+    }
+  });
+  wanted.forEach((stream, id) => {
+    if (recorder.sources.has(id) || stream.getAudioTracks().length === 0) return;
+    const source = recorder.context.createMediaStreamSource(stream);
+    source.connect(recorder.destination);
+    recorder.sources.set(id, source);
+  });
+}
+
+// finishRecording stops this client's recorder, if any, and posts what it
+// recorded to the voice channel's recording channel.
+async function finishRecording() {
+  const recorder = state.voice.recorder;
+  if (!recorder) return;
+  state.voice.recorder = null;
+  if (recorder.media.state !== 'inactive') recorder.media.stop();
+  await recorder.stopped;
+  recorder.context.close().catch(() => {});
+  if (recorder.chunks.length === 0) return;
+  const type = recorder.mimeType.split(';')[0];
+  const body = new Blob(recorder.chunks, { type });
+  const durationMs = Date.now() - recorder.startedAt;
+  try {
+    await fetchJSON(`${state.routes.channels}/${recorder.channelId}/recordings/${recorder.id}?durationMs=${durationMs}`, {
+      method: 'POST',
+      headers: { 'Content-Type': type, 'X-CSRF-Token': state.csrfToken },
+      body,
+    });
+    setStatus('Recording posted.');
+  } catch (error) {
+    console.error('upload recording', error);
+    setStatus(`Failed to post the recording: ${error.message}`, 'error');
+  }
+}
+
+function isTalkKey(event) {
+  if (event.key !== '`' || event.ctrlKey || event.metaKey || event.altKey) return false;
+  const target = event.target;
+  return !(target && (target.isContentEditable || ['INPUT', 'TEXTAREA', 'SELECT'].includes(target.tagName)));
+}
+
+window.addEventListener('keydown', (event) => {
+  if (!state.voice.joined || state.preferences.voiceMode !== 'ptt' || !isTalkKey(event)) return;
+  event.preventDefault();
+  setTalking(true);
+});
+
+window.addEventListener('keyup', (event) => {
+  if (isTalkKey(event)) setTalking(false);
+});
+
+window.addEventListener('blur', () => setTalking(false));
+
 function attachLocalStream(stream) {
   if (!refs.voiceContainer) return;
   const existing = refs.voiceContainer.querySelector('audio[data-local="true"]');
@@ -738,6 +1649,121 @@ function attachLocalStream(stream) {
   return audio;
 }
 
+function stopLocalStream() {
+  if (state.voice.localStream) {
+    state.voice.localStream.getTracks().forEach((track) => track.stop());
+    state.voice.localStream = null;
+  }
+  state.voice.video = false;
+  if (refs.voiceContainer) {
+    refs.voiceContainer.querySelectorAll('audio[data-local="true"], .voice-video[data-local="true"]').forEach(removeAudioElement);
+  }
+}
+
+// createVideoTile adds a labelled video element to the voice area.
+function createVideoTile(name, local = false) {
+  const tile = document.createElement('figure');
+  tile.className = 'voice-video';
+  if (local) tile.dataset.local = 'true';
+  const video = document.createElement('video');
+  video.autoplay = true;
+  video.playsInline = true;
+  video.muted = true; // audio plays through the peer's audio element
+  const caption = document.createElement('figcaption');
+  caption.textContent = name;
+  tile.appendChild(video);
+  tile.appendChild(caption);
+  refs.voiceContainer.appendChild(tile);
+  return tile;
+}
+
+// applyVideoBitrate caps what we send to one peer at the server's hint,
+// which shrinks as the room grows since every peer gets its own copy.
+function applyVideoBitrate(peer) {
+  if (!peer.videoSender || !state.voice.bandwidth) return;
+  const params = peer.videoSender.getParameters();
+  if (!params.encodings || params.encodings.length === 0) params.encodings = [{}];
+  params.encodings[0].maxBitrate = state.voice.bandwidth.videoKbps * 1000;
+  peer.videoSender.setParameters(params).catch((error) => console.error('video bitrate', error));
+}
+
+function applyVoiceBandwidth(bandwidth) {
+  if (!bandwidth) return;
+  state.voice.bandwidth = bandwidth;
+  state.voice.peers.forEach(applyVideoBitrate);
+}
+
+function applyAudioBitrate(peer) {
+  if (!peer.audioSender || !state.voice.audio) return;
+  const params = peer.audioSender.getParameters();
+  if (!params.encodings || params.encodings.length === 0) params.encodings = [{}];
+  params.encodings[0].maxBitrate = state.voice.audio.audioKbps * 1000;
+  peer.audioSender.setParameters(params).catch((error) => console.error('audio bitrate', error));
+}
+
+// applyVoiceAudio configures the microphone and encoders with the channel's
+// audio settings, so everyone in it captures and sends audio the same way.
+function applyVoiceAudio(audio) {
+  if (!audio) return;
+  state.voice.audio = audio;
+  if (state.voice.localStream) {
+    state.voice.localStream.getAudioTracks().forEach((track) => {
+      track.applyConstraints({
+        echoCancellation: audio.echoCancellation,
+        noiseSuppression: audio.noiseSuppression,
+        autoGainControl: audio.autoGainControl,
+      }).catch((error) => console.error('audio constraints', error));
+    });
+  }
+  state.voice.peers.forEach(applyAudioBitrate);
+}
+
+async function toggleCamera() {
+  if (!state.voice.joined || !state.voice.localStream) return;
+  const stream = state.voice.localStream;
+  if (state.voice.video) {
+    stream.getVideoTracks().forEach((track) => {
+      track.stop();
+      stream.removeTrack(track);
+    });
+    state.voice.peers.forEach((peer) => {
+      if (peer.videoSender) {
+        peer.pc.removeTrack(peer.videoSender);
+        peer.videoSender = null;
+        createOffer(peer).catch((error) => console.error('voice renegotiate', error));
+      }
+    });
+    refs.voiceContainer.querySelectorAll('.voice-video[data-local="true"]').forEach(removeAudioElement);
+    state.voice.video = false;
+  } else {
+    let track;
+    try {
+      const camera = await navigator.mediaDevices.getUserMedia({ video: true });
+      [track] = camera.getVideoTracks();
+    } catch (error) {
+      console.error('camera', error);
+      setStatus('Camera permission denied.', 'error');
+      return;
+    }
+    // The call may have ended while the permission prompt was open.
+    if (state.voice.localStream !== stream) {
+      track.stop();
+      return;
+    }
+    stream.addTrack(track);
+    state.voice.peers.forEach((peer) => {
+      peer.videoSender = peer.pc.addTrack(track, stream);
+      applyVideoBitrate(peer);
+      createOffer(peer).catch((error) => console.error('voice renegotiate', error));
+    });
+    const tile = createVideoTile('You', true);
+    tile.querySelector('video').srcObject = new MediaStream([track]);
+    state.voice.video = true;
+  }
+  sendSocketEvent({ type: 'voice:video', enabled: state.voice.video });
+  updateVoiceUI();
+}
+
 function removeAudioElement(el) {
   if (!el) return;
   try {
@@ -764,11 +1790,16 @@ async function joinVoice() {
     return;
   }
   try {
-    const stream = await navigator.mediaDevices.getUserMedia({ audio: true });
+    const [stream, iceServers] = await Promise.all([
+      navigator.mediaDevices.getUserMedia({ audio: true }),
+      probeVoiceServers(),
+    ]);
+    state.voice.iceServers = iceServers;
     state.voice.localStream = stream;
     state.voice.peers = new Map();
     state.voice.joined = true;
     state.voice.channelId = targetChannelId;
+    applyMicrophone();
     attachLocalStream(stream);
     updateVoiceUI('Connecting...');
     sendSocketEvent({ type: 'voice:join', channelId: targetChannelId });
@@ -778,6 +1809,55 @@ async function joinVoice() {
   }
 }
 
+const VOICE_PROBE_TIMEOUT = 2000;
+
+async function timeProbe(url) {
+  const controller = new AbortController();
+  const timer = setTimeout(() => controller.abort(), VOICE_PROBE_TIMEOUT);
+  const started = performance.now();
+  try {
+    await fetch(url, { mode: 'no-cors', cache: 'no-store', signal: controller.signal });
+    return Math.round(performance.now() - started);
+  } catch (error) {
+    return null;
+  } finally {
+    clearTimeout(timer);
+  }
+}
+
+// probeVoiceServers times the app server and each ICE server that has a
+// probe URL, reports the results for admin diagnostics and returns the ICE
+// servers to use: every STUN server plus the nearest TURN relay. Relays
+// without a probe fall back to the median other clients reported.
+async function probeVoiceServers() {
+  const started = performance.now();
+  let ping;
+  try {
+    ping = await fetchJSON(`${state.routes.voice}/ping`);
+  } catch (error) {
+    console.error('voice ping', error);
+    return null;
+  }
+  const results = [{ iceServer: 'origin', rttMs: Math.round(performance.now() - started) }];
+  const servers = ping.iceServers || [];
+  await Promise.all(servers.map(async (server) => {
+    if (!server.probeUrl) return;
+    const rtt = await timeProbe(server.probeUrl);
+    if (rtt === null) return;
+    server.measuredRttMs = rtt;
+    results.push({ iceServer: server.id, rttMs: rtt });
+  }));
+  fetchJSON(`${state.routes.voice}/rtt`, { method: 'POST', body: JSON.stringify({ results }) })
+    .catch((error) => console.error('voice rtt report', error));
+
+  const isRelay = (server) => server.urls.some((url) => /^turns?:/.test(url));
+  const latency = (server) => server.measuredRttMs ?? server.medianRttMs ?? Infinity;
+  const relays = servers.filter(isRelay).sort((a, b) => latency(a) - latency(b));
+  const chosen = servers.filter((server) => !isRelay(server));
+  if (relays.length > 0) chosen.push(relays[0]);
+  return chosen.map(({ urls, username, credential }) => ({ urls, username, credential }));
+}
+
 function cleanupVoicePeers() {
   state.voice.peers.forEach((peer) => {
     if (peer.pc) {
@@ -792,6 +1872,9 @@ function cleanupVoicePeers() {
     if (peer.audio) {
       removeAudioElement(peer.audio);
     }
+    if (peer.videoTile) {
+      removeAudioElement(peer.videoTile);
+    }
   });
   state.voice.peers.clear();
 }
@@ -802,11 +1885,17 @@ function leaveVoice() {
   if (channelId) {
     sendSocketEvent({ type: 'voice:leave', channelId });
   }
+  // Leaving ends the recording on the server too.
+  finishRecording();
+  state.voice.recording = null;
+  state.voice.consent = false;
   cleanupVoicePeers();
   stopLocalStream();
   state.voice.joined = false;
   state.voice.channelId = null;
   state.voice.selfId = null;
+  state.voice.joinedAt = null;
+  state.voice.talking = false;
   updateVoiceUI();
 }
 function ensureVoicePeer(participant, initiator = false) {
@@ -827,7 +1916,7 @@ function ensureVoicePeer(participant, initiator = false) {
   }
 
   const config = {
-    iceServers: [{ urls: 'stun:stun.l.google.com:19302' }],
+    iceServers: state.voice.iceServers || [{ urls: 'stun:stun.l.google.com:19302' }],
   };
   const pc = new RTCPeerConnection(config);
   const peer = {
@@ -835,11 +1924,18 @@ function ensureVoicePeer(participant, initiator = false) {
     participant,
     pc,
     audio: null,
+    videoTile: null,
+    videoSender: null,
+    audioSender: null,
   };
 
   state.voice.localStream.getTracks().forEach((track) => {
-    pc.addTrack(track, state.voice.localStream);
+    const sender = pc.addTrack(track, state.voice.localStream);
+    if (track.kind === 'video') peer.videoSender = sender;
+    if (track.kind === 'audio') peer.audioSender = sender;
   });
+  applyVideoBitrate(peer);
+  applyAudioBitrate(peer);
 
   pc.onicecandidate = (event) => {
     if (event.candidate) {
@@ -857,6 +1953,14 @@ function ensureVoicePeer(participant, initiator = false) {
 
   pc.ontrack = (event) => {
     if (!refs.voiceContainer) return;
+    if (event.track.kind === 'video') {
+      if (!peer.videoTile) {
+        peer.videoTile = createVideoTile(peer.participant.displayName || peer.participant.handle || 'Guest');
+      }
+      peer.videoTile.querySelector('video').srcObject = new MediaStream([event.track]);
+      peer.videoTile.hidden = peer.participant.video === false;
+      return;
+    }
     if (!peer.audio) {
       const audio = document.createElement('audio');
       audio.autoplay = true;
@@ -866,6 +1970,7 @@ function ensureVoicePeer(participant, initiator = false) {
     }
     const [stream] = event.streams;
     peer.audio.srcObject = stream;
+    syncRecorderSources();
   };
 
   pc.onconnectionstatechange = () => {
@@ -913,7 +2018,11 @@ function removeVoicePeer(peerId) {
   if (peer.audio) {
     removeAudioElement(peer.audio);
   }
+  if (peer.videoTile) {
+    removeAudioElement(peer.videoTile);
+  }
   state.voice.peers.delete(peerId);
+  syncRecorderSources();
 }
 
 function handleVoiceParticipants(data) {
@@ -924,30 +2033,42 @@ function handleVoiceParticipants(data) {
   state.voice.channelId = data.channelId;
   state.voice.joined = true;
   state.voice.selfId = self ? self.id : null;
+  state.voice.joinedAt = self ? self.joinedAt : null;
+  state.voice.bandwidth = data.bandwidth || null;
+  // A new join starts without consent, and any recording this client was
+  // making ended when it left.
+  finishRecording();
+  state.voice.consent = false;
+  state.voice.recording = data.recording || null;
   participants.forEach((participant) => {
     ensureVoicePeer(participant, true);
   });
-  updateVoiceUI('Live');
+  applyVoiceAudio(data.audio);
+  updateVoiceUI();
 }
 
-function handleVoicePeerJoined(channelId, participant) {
+function handleVoicePeerJoined(channelId, participant, bandwidth) {
   if (!participant || channelId !== state.voice.channelId || !state.voice.joined) return;
   ensureVoicePeer(participant, false);
+  applyVoiceBandwidth(bandwidth);
+  updateVoiceUI();
 }
 
-function handleVoicePeerLeft(channelId, participant) {
+function handleVoicePeerLeft(channelId, participant, bandwidth) {
   if (!participant || channelId !== state.voice.channelId) return;
   removeVoicePeer(participant.id);
+  applyVoiceBandwidth(bandwidth);
+  updateVoiceUI();
 }
 
 async function handleVoiceSignal(channelId, signal) {
   if (!signal || !state.voice.joined || channelId !== state.voice.channelId) return;
-  const { from, payload, displayName, email } = signal;
+  const { from, payload, displayName, userId, handle } = signal;
   if (!from || !payload) return;
 
   let peer = state.voice.peers.get(from);
   if (!peer) {
-    peer = ensureVoicePeer({ id: from, displayName, email }, false);
+    peer = ensureVoicePeer({ id: from, displayName, userId, handle }, false);
   }
   if (!peer || !peer.pc) return;
 
@@ -976,55 +2097,225 @@ async function handleVoiceSignal(channelId, signal) {
   }
 }
 
+function applyChannelUpdate(channel) {
+  const server = findServer(channel.serverId);
+  if (!server) return;
+  server.channels = (server.channels || []).map((existing) => (existing.id === channel.id ? { ...existing, ...channel } : existing));
+  renderChannels();
+  updateChannelUI();
+}
+
+// Permission overrides can hide a channel or reveal one; permissions is
+// empty once the channel can no longer be viewed.
+function applyChannelPermissions(data) {
+  const server = findServer(data.serverId);
+  if (!server) return;
+  const channels = server.channels || [];
+  if (!ensureArray(data.permissions).includes('view')) {
+    server.channels = channels.filter((ch) => ch.id !== data.channelId);
+    state.messagesByChannel.delete(data.channelId);
+    if (state.activeChannelId === data.channelId) {
+      state.activeChannelId = null;
+      const first = server.channels[0];
+      if (first && server.id === state.activeServerId) {
+        switchChannel(first.id);
+        return;
+      }
+    }
+    renderChannels();
+    updateChannelUI();
+    return;
+  }
+  if (!data.channel) return;
+  if (channels.some((ch) => ch.id === data.channel.id)) {
+    applyChannelUpdate(data.channel);
+    return;
+  }
+  server.channels = [...channels, data.channel];
+  sendSocketEvent({ type: 'subscribe', channelId: data.channel.id });
+  renderChannels();
+}
+
 function handleSocketMessage(event) {
   try {
-    const data = JSON.parse(event.data);
-    switch (data.type) {
-      case 'message':
-        if (data.message) {
-          pushMessage(data.message);
-        }
-        break;
-      case 'error':
-        if (data.error) {
-          setStatus(data.error, 'error');
-        }
-        break;
-      case 'voice:participants':
-        handleVoiceParticipants(data);
-        break;
-      case 'voice:peer-joined':
-        handleVoicePeerJoined(data.channelId, data.peer);
-        break;
-      case 'voice:peer-left':
-        handleVoicePeerLeft(data.channelId, data.peer);
-        break;
-      case 'voice:signal':
-        handleVoiceSignal(data.channelId, data.signal);
-        break;
-      default:
-        break;
-    }
+    handleSocketEvent(JSON.parse(event.data));
   } catch (error) {
     console.error('parse websocket payload', error);
   }
 }
 
-function scheduleReconnect(delay) {
-  const timeout = Math.max(delay, state.wsReconnectDelay);
+function handleSocketEvent(data) {
+  switch (data.type) {
+    case 'batch':
+      ensureArray(data.events).forEach(handleSocketEvent);
+      break;
+    case 'message':
+    case 'message:ack':
+      if (data.message) {
+        pushMessage(data.message);
+      }
+      break;
+    case 'message:delete':
+      removeMessage(data.channelId, data.messageId);
+      break;
+    case 'error':
+      if (data.code === 'resume_expired') {
+        state.resuming = false;
+        subscribeAllChannels();
+        catchUpAfterReconnect();
+        break;
+      }
+      if (data.nonce) {
+        failPendingMessage(data.nonce);
+      }
+      if (data.error) {
+        setStatus(data.error, 'error');
+      }
+      if (data.code === 'rules_not_accepted') {
+        state.rulesPending.set(state.activeServerId, true);
+        updateChannelUI();
+      }
+      break;
+    case 'server:update':
+      if (data.server) {
+        const server = findServer(data.server.id);
+        if (server) {
+          const rulesChanged = (server.rules || '') !== (data.server.rules || '');
+          Object.assign(server, { ...data.server, channels: server.channels });
+          renderServers();
+          renderChannels();
+          if (rulesChanged) {
+            ensureRulesLoaded(server.id, { force: true }).then(updateChannelUI);
+          }
+        }
+      }
+      break;
+    case 'channel:update':
+      if (data.channel) {
+        applyChannelUpdate(data.channel);
+      }
+      break;
+    case 'channel:permissions':
+      applyChannelPermissions(data);
+      break;
+    case 'channel:topic':
+      if (data.channel) {
+        applyChannelUpdate(data.channel);
+        if (data.channel.id === state.activeChannelId) {
+          setStatus(data.channel.topic ? `Topic changed: ${data.channel.topic}` : 'Topic cleared.');
+        }
+      }
+      break;
+    case 'reminder:created':
+      if (settlePendingMessage(data.nonce)) {
+        renderMessages();
+      }
+      if (data.reminder) {
+        setStatus(`Reminder set for ${timeFormatter.format(new Date(data.reminder.remindAt))}.`);
+      }
+      break;
+    case 'reminder':
+      if (data.reminder) {
+        setStatus(`Reminder: ${data.reminder.content}`);
+      }
+      break;
+    case 'voice:participants':
+      handleVoiceParticipants(data);
+      break;
+    case 'voice:peer-joined':
+      handleVoicePeerJoined(data.channelId, data.peer, data.bandwidth);
+      break;
+    case 'voice:peer-left':
+      handleVoicePeerLeft(data.channelId, data.peer, data.bandwidth);
+      break;
+    case 'voice:peer-updated':
+      handleVoicePeerUpdated(data.channelId, data.peer);
+      break;
+    case 'voice:recording':
+      handleVoiceRecording(data.channelId, data.recording);
+      break;
+    case 'voice:audio-settings':
+      if (data.channelId === state.voice.channelId) {
+        applyVoiceAudio(data.audio);
+        applyVoiceBandwidth(data.bandwidth);
+        updateVoiceUI();
+      }
+      break;
+    case 'voice:signal':
+      handleVoiceSignal(data.channelId, data.signal);
+      break;
+    case 'members:chunk':
+      applyMemberChunk(data);
+      break;
+    case 'roles:update':
+      handleRolesUpdate(data.serverId);
+      break;
+    case 'announcement':
+      if (data.announcement && !state.announcements.some((a) => a.id === data.announcement.id)) {
+        state.announcements.push(data.announcement);
+        renderAnnouncements();
+      }
+      break;
+    case 'announcement:withdrawn':
+    case 'announcement:acked':
+      dropAnnouncement(data.announcementId);
+      break;
+    case 'settings:update':
+      if (data.preferences) {
+        applySettings(data.preferences);
+      }
+      break;
+    case 'resumed':
+      applyResumed(data);
+      break;
+    case 'hello':
+      state.resumeToken = data.resumeToken || null;
+      if (data.reconnect) {
+        state.wsReconnect = { ...data.reconnect, closeCodes: ensureArray(data.reconnect.closeCodes) };
+      }
+      break;
+    case 'latency':
+      updateConnectionQuality(data.rttMs);
+      break;
+    default:
+      break;
+  }
+}
+
+// scheduleReconnect backs off exponentially within the server's bounds,
+// shortened by a random jitter, and never sooner than retryAfterMs.
+function scheduleReconnect(retryAfterMs = 0) {
   if (state.socket && (state.socket.readyState === WebSocket.OPEN || state.socket.readyState === WebSocket.CONNECTING)) {
     return;
   }
-  setTimeout(() => {
+  const { minMs, maxMs, jitter } = state.wsReconnect;
+  const backoff = Math.min(maxMs, minMs * 2 ** state.wsAttempts);
+  const timeout = Math.max(backoff * (1 - jitter * Math.random()), retryAfterMs);
+  state.wsAttempts += 1;
+  setTimeout(connectSocket, timeout);
+}
+
+function closeGuidance(code) {
+  return state.wsReconnect.closeCodes.find((entry) => entry.code === code) || { code, action: 'reconnect' };
+}
+
+function reconnectAfterIdle() {
+  window.removeEventListener('focus', reconnectAfterIdle);
+  window.removeEventListener('keydown', reconnectAfterIdle);
+  if (!state.socket || state.socket.readyState === WebSocket.CLOSED) {
     connectSocket();
-    state.wsReconnectDelay = Math.min(state.wsReconnectDelay * 2, 30000);
-  }, timeout);
+  }
 }
 
 function connectSocket() {
   if (!state.routes.ws) return;
   const protocol = window.location.protocol === 'https:' ? 'wss' : 'ws';
-  const target = `${protocol}://${window.location.host}${state.routes.ws}`;
+  // batch=1 lets the server combine presence and similar updates into one frame.
+  let target = `${protocol}://${window.location.host}${state.routes.ws}?batch=1`;
+  state.resuming = Boolean(state.resumeToken && state.hasConnected);
+  if (state.resuming) {
+    target += `&resume=${encodeURIComponent(state.resumeToken)}`;
+  }
 
   try {
     if (state.socket) {
@@ -1041,10 +2332,21 @@ function connectSocket() {
 
   socket.addEventListener('open', () => {
     state.socketReady = true;
-    state.wsReconnectDelay = 2000;
+    state.wsAttempts = 0;
     setStatus('');
-    subscribeAllChannels();
+    // A members:request sent just before the connection dropped gets no answer.
+    state.memberChunks.forEach((chunks) => {
+      chunks.pending = false;
+    });
     flushPendingEvents();
+    // A resumed connection waits for the resumed frame instead.
+    if (!state.resuming) {
+      subscribeAllChannels();
+      if (state.hasConnected || state.resyncMessages) {
+        catchUpAfterReconnect();
+      }
+    }
+    state.hasConnected = true;
     if (state.voice.channelId) {
       const channelId = state.voice.channelId;
       state.voice.joined = false;
@@ -1055,10 +2357,31 @@ function connectSocket() {
 
   socket.addEventListener('message', handleSocketMessage);
 
-  socket.addEventListener('close', () => {
+  socket.addEventListener('close', (event) => {
     state.socketReady = false;
-    setStatus('Connection lost. Reconnecting…', 'error');
-    scheduleReconnect(state.wsReconnectDelay);
+    updateConnectionQuality(null);
+    const guidance = closeGuidance(event.code);
+    switch (guidance.action) {
+      case 'login':
+        // Signed out elsewhere or the session ran out.
+        window.location.href = state.routes.login || '/login';
+        return;
+      case 'wait':
+        // Replaced by a newer tab or dropped for inactivity: stay offline
+        // until the user comes back, then catch up on anything missed.
+        state.resyncMessages = true;
+        setStatus(event.code === 4009 ? 'Connected in another window.' : 'Disconnected while idle.', 'pending');
+        window.addEventListener('focus', reconnectAfterIdle, { once: true });
+        window.addEventListener('keydown', reconnectAfterIdle, { once: true });
+        return;
+      case 'resync':
+        state.resyncMessages = true;
+        break;
+      default:
+        break;
+    }
+    setStatus(guidance.action === 'retry' ? `Disconnected (${guidance.reason}). Reconnecting shortly…` : 'Connection lost. Reconnecting…', 'error');
+    scheduleReconnect(guidance.retryAfterMs || 0);
   });
 
   socket.addEventListener('error', () => {
@@ -1072,38 +2395,57 @@ async function handleSubmit(event) {
   const content = refs.composerInput.value.trim();
   if (!content) return;
 
-  const sent = sendSocketEvent({
-    type: 'message',
-    channelId: state.activeChannelId,
-    content,
-  });
+  const channelId = state.activeChannelId;
+  const nonce = newNonce();
+  const ttl = Number(refs.composerTTL && refs.composerTTL.value) || 0;
+  addPendingMessage(channelId, content, nonce, ttl);
+  scrollToBottom(true);
+  // Sending clears the draft on the server.
+  clearTimeout(state.draft.timer);
+  state.draft.timer = null;
+  refs.composerInput.value = '';
+  refs.composerInput.style.height = 'auto';
+  sendChatMessage(channelId, content, nonce, ttl);
+}
 
-  if (sent) {
-    refs.composerInput.value = '';
-    refs.composerInput.style.height = 'auto';
+// sendChatMessage sends over the socket when it is open and falls back to
+// REST otherwise. The socket event also stays queued for the reconnect; the
+// shared nonce lets the server store the message only once. Long pastes go
+// straight to REST, since they may not fit in a WebSocket frame.
+async function sendChatMessage(channelId, content, nonce, ttl = 0) {
+  if (content.length <= MAX_MESSAGE_LENGTH && sendSocketEvent({ type: 'message', channelId, content, nonce, ttl: ttl || undefined })) {
     setStatus('');
-  } else {
-    setStatus('Sending…', 'pending');
-    try {
-      const payload = await fetchJSON(`${state.routes.channels}/${state.activeChannelId}/messages`, {
-        method: 'POST',
-        body: JSON.stringify({ content }),
-      });
+    return;
+  }
+  setStatus('Sending…', 'pending');
+  try {
+    const payload = await fetchJSON(`${state.routes.channels}/${channelId}/messages`, {
+      method: 'POST',
+      body: JSON.stringify({ content, nonce, ttl: ttl || undefined }),
+    });
+    if (payload.reminder) {
+      settlePendingMessage(nonce);
+      renderMessages();
+    } else {
       pushMessage(payload, { scroll: true });
-      refs.composerInput.value = '';
-      refs.composerInput.style.height = 'auto';
-      setStatus('');
-    } catch (error) {
-      console.error('send message fallback', error);
-      setStatus('Failed to send message.', 'error');
     }
+    setStatus(payload.reminder ? `Reminder set for ${timeFormatter.format(new Date(payload.reminder.remindAt))}.` : '');
+  } catch (error) {
+    console.error('send message fallback', error);
+    failPendingMessage(nonce);
+    setStatus('Failed to send message.', 'error');
   }
 }
 
 function pushMessage(msg, { scroll = false } = {}) {
   if (!msg || typeof msg.id === 'undefined') return;
-  const key = `${msg.channelId}:${msg.id}`;
-  if (state.messageIds.has(key)) return;
+  const settled = settlePendingMessage(msg.nonce);
+  // Ephemeral messages are numbered separately from stored ones.
+  const key = `${msg.channelId}:${msg.ephemeral ? 'e' : ''}${msg.id}`;
+  if (state.messageIds.has(key)) {
+    if (settled && msg.channelId === state.activeChannelId) renderMessages();
+    return;
+  }
   state.messageIds.add(key);
 
   const bucket = ensureChannelBuffer(msg.channelId);
@@ -1123,18 +2465,197 @@ function pushMessage(msg, { scroll = false } = {}) {
   if (msg.channelId === state.activeChannelId) {
     renderMessages();
     if (scroll) scrollToBottom(true);
+    markRead(msg.channelId);
   } else if (owningServer) {
     addUnread(msg.channelId, owningServer.id);
   }
 }
 
+function removeMessage(channelId, messageId) {
+  const bucket = state.messagesByChannel.get(channelId);
+  if (!bucket) return;
+  const index = bucket.findIndex((msg) => msg.id === messageId && !msg.ephemeral);
+  if (index === -1) return;
+  bucket.splice(index, 1);
+  state.messageIds.delete(`${channelId}:${messageId}`);
+  if (channelId === state.activeChannelId) renderMessages();
+}
+
+// applySyncEvents applies messages from sync events in place and reports
+// whether any were structural (servers, channels, members).
+function applySyncEvents(events) {
+  let structural = false;
+  ensureArray(events).forEach((event) => {
+    if (event.type === 'message' || event.type === 'message:update') {
+      if (event.message) pushMessage(event.message);
+    } else if (event.type === 'message:delete') {
+      removeMessage(event.channelId, event.messageId);
+    } else {
+      structural = true;
+    }
+  });
+  return structural;
+}
+
+// catchUp replays /api/sync from the last checkpoint. Messages are applied in
+// place; anything structural (servers, channels, members) triggers a full
+// bootstrap. Resolves to false when the caller should fall back to reloading.
+async function catchUp() {
+  if (!state.routes.sync || state.syncSeq === null) return false;
+  let structural = false;
+  try {
+    for (;;) {
+      const payload = await fetchJSON(`${state.routes.sync}?since=${state.syncSeq}`);
+      if (applySyncEvents(payload.events)) structural = true;
+      state.syncSeq = payload.next;
+      if (!payload.hasMore) break;
+    }
+  } catch (error) {
+    if (error.status !== 410) {
+      console.error('sync', error);
+      return false;
+    }
+    structural = true;
+  }
+  if (structural) await bootstrapLatest();
+  return true;
+}
+
+// updatePreferences saves changed preferences and reloads, since masking
+// applies to messages as they are delivered.
+async function updatePreferences(changes) {
+  try {
+    state.preferences = await fetchJSON(state.routes.preferences, {
+      method: 'PATCH',
+      body: JSON.stringify(changes),
+    });
+    updateFormatters();
+    await bootstrapLatest();
+  } catch (error) {
+    console.error('update preferences', error);
+    setStatus('Failed to save preferences.', 'error');
+  }
+}
+
+// updateAppearance saves theme, compact mode or font size changes, applying
+// them straight away.
+async function updateAppearance(changes) {
+  Object.assign(state.preferences, changes);
+  applyAppearance();
+  try {
+    state.preferences = await fetchJSON(state.routes.preferences, {
+      method: 'PATCH',
+      body: JSON.stringify(changes),
+    });
+  } catch (error) {
+    console.error('update appearance', error);
+    setStatus('Failed to save preferences.', 'error');
+  }
+}
+
+function syncPreferenceControls() {
+  if (!refs.maskToggle) return;
+  refs.maskToggle.checked = Boolean(state.preferences.maskProfanity);
+  refs.localeSelect.value = state.preferences.locale || '';
+  refs.themeSelect.value = state.preferences.theme || 'system';
+  refs.fontSizeSelect.value = state.preferences.fontSize || 'normal';
+  refs.compactToggle.checked = Boolean(state.preferences.compactMode);
+  if (refs.voiceMode) refs.voiceMode.value = state.preferences.voiceMode || 'vad';
+}
+
+// applySettings takes preferences changed in another tab or on another
+// device, announced with settings:update.
+function applySettings(preferences) {
+  const previous = state.preferences;
+  state.preferences = preferences;
+  updateFormatters();
+  applyAppearance();
+  syncPreferenceControls();
+  if (preferences.voiceMode !== previous.voiceMode) {
+    state.voice.talking = false;
+    applyMicrophone();
+    updateVoiceUI();
+  }
+  if (preferences.maskProfanity !== previous.maskProfanity) {
+    bootstrapLatest();
+  } else if (preferences.locale !== previous.locale || preferences.timezone !== previous.timezone) {
+    renderMessages();
+  }
+}
+
+// applyBranding picks up an instance rename or new accent color without a
+// reload.
+function applyBranding(branding) {
+  document.title = branding.name;
+  const root = document.documentElement.style;
+  if (branding.accentColor) {
+    root.setProperty('--accent', branding.accentColor);
+    root.setProperty('--accent-strong', branding.accentColor);
+  } else {
+    root.removeProperty('--accent');
+    root.removeProperty('--accent-strong');
+  }
+}
+
+function renderAnnouncements() {
+  if (!refs.announcements) return;
+  refs.announcements.replaceChildren();
+  state.announcements.forEach((announcement) => {
+    const banner = document.createElement('div');
+    banner.className = `announcement announcement-${announcement.level}`;
+    banner.setAttribute('role', announcement.level === 'critical' ? 'alert' : 'status');
+    const text = document.createElement('div');
+    const title = document.createElement('strong');
+    title.textContent = announcement.title;
+    text.appendChild(title);
+    if (announcement.body) {
+      const body = document.createElement('p');
+      body.textContent = announcement.body;
+      text.appendChild(body);
+    }
+    const dismiss = document.createElement('button');
+    dismiss.type = 'button';
+    dismiss.textContent = 'Dismiss';
+    dismiss.addEventListener('click', () => ackAnnouncement(announcement.id));
+    banner.append(text, dismiss);
+    refs.announcements.appendChild(banner);
+  });
+  refs.announcements.hidden = state.announcements.length === 0;
+}
+
+function dropAnnouncement(id) {
+  state.announcements = state.announcements.filter((a) => a.id !== id);
+  renderAnnouncements();
+}
+
+async function ackAnnouncement(id) {
+  try {
+    await fetchJSON(`${state.routes.announcements}/${id}/ack`, { method: 'POST' });
+    dropAnnouncement(id);
+  } catch (error) {
+    console.error('ack announcement', error);
+    setStatus('Could not dismiss the announcement.', 'error');
+  }
+}
+
 async function bootstrapLatest() {
   try {
     const payload = await fetchJSON(state.routes.bootstrap);
     state.servers = payload.servers.map((server) => ({ ...server, unread: new Map() }));
     state.activeServerId = payload.activeServerId;
     state.activeChannelId = payload.activeChannelId;
+    state.syncSeq = payload.syncSeq;
+    if (payload.preferences) state.preferences = payload.preferences;
+    if (payload.locales) state.locales = payload.locales;
+    if (payload.branding) applyBranding(payload.branding);
+    state.announcements = payload.announcements || [];
+    renderAnnouncements();
+    updateFormatters();
+    applyAppearance();
+    syncPreferenceControls();
+    applyOutline(payload.accessibility);
     state.membersByServer = new Map([[payload.activeServerId, payload.members || []]]);
+    state.memberChunks = new Map([[payload.activeServerId, { done: payload.membersComplete !== false, pending: false }]]);
     state.messagesByChannel = new Map();
     state.messageIds = new Set();
     ensureServerMap();
@@ -1144,6 +2665,9 @@ async function bootstrapLatest() {
       state.messageIds.add(key);
       ensureChannelBuffer(msg.channelId).push(msg);
     });
+    if (state.activeChannelId) restorePendingMessages(state.activeChannelId);
+    markRead(state.activeChannelId);
+    await ensureRulesLoaded(state.activeServerId, { force: true });
 
     renderServers();
     renderChannels();
@@ -1157,6 +2681,7 @@ async function bootstrapLatest() {
     }
   } catch (error) {
     console.error('bootstrap refresh', error);
+    setStatus('Could not load the workspace.', 'error');
   }
 }
 
@@ -1197,9 +2722,9 @@ async function promptCreateChannel() {
   if (!name) {
     return;
   }
-  let kindInput = window.prompt('Channel type (text/voice)', 'text');
+  let kindInput = window.prompt('Channel type (text/voice/announcement)', 'text');
   let kind = (kindInput || 'text').trim().toLowerCase();
-  if (kind !== 'voice') {
+  if (kind !== 'voice' && kind !== 'announcement') {
     kind = 'text';
   }
   try {
@@ -1211,7 +2736,7 @@ async function promptCreateChannel() {
     server.channels.push(payload);
     renderChannels();
     sendSocketEvent({ type: 'subscribe', channelId: payload.id });
-    if (payload.type === 'text') {
+    if (payload.type !== 'voice') {
       state.messagesByChannel.set(payload.id, []);
       await switchChannel(payload.id);
     } else {
@@ -1242,7 +2767,6 @@ function renderApp() {
 }
 
 async function init() {
-  initStateFromContext();
   renderApp();
   renderServers();
   renderChannels();
@@ -1253,10 +2777,14 @@ async function init() {
   updateVoiceUI();
   connectSocket();
   setStatus('');
-
-  setTimeout(() => {
-    bootstrapLatest();
-  }, 2000);
+  bootstrapLatest();
+  document.addEventListener('visibilitychange', () => {
+    if (document.hidden) {
+      flushDraft();
+    } else {
+      markRead(state.activeChannelId);
+    }
+  });
 }
 
 window.addEventListener('beforeunload', () => {
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// WebTransport is an experimental second transport for the gateway, to
+// compare delivery over HTTP/3 with /ws on lossy networks. A client opens a
+// session at /wt on WEBTRANSPORT_ADDR (UDP), then one bidirectional stream,
+// and from there exchanges the same events as on /ws: hello, subscribe,
+// message and the rest, with the same close codes and ?batch and ?resume.
+// It picks JSON or msgpack by offering echosphere.json or echosphere.msgpack
+// as the session's application protocol, as it would the WebSocket
+// subprotocol.
+//
+// Each event on the stream is a frame of a one-byte kind, a four-byte
+// big-endian length and the payload. The kinds are the WebSocket opcodes:
+// 1 text, 2 binary, 8 close, 9 ping and 10 pong. The server pings like it
+// does on /ws and expects pongs echoing the payload; when it closes the
+// session, the session's error code and message carry the close code and
+// reason.
+const (
+	wtPath       = "/wt"
+	wtFrameHead  = 5
+	wtStreamWait = 10 * time.Second
+)
+
+type webTransportServer struct {
+	s      *serverState
+	server *webtransport.Server
+	conn   net.PacketConn
+	url    string // WEBTRANSPORT_URL; see urlFor
+}
+
+// webTransportFromEnv returns nil when WEBTRANSPORT_ADDR is unset. HTTP/3
+// always runs over TLS, so WEBTRANSPORT_CERT_FILE and WEBTRANSPORT_KEY_FILE
+// are required with it.
+func webTransportFromEnv(s *serverState) (*webTransportServer, error) {
+	addr := strings.TrimSpace(os.Getenv("WEBTRANSPORT_ADDR"))
+	if addr == "" {
+		return nil, nil
+	}
+	certFile := os.Getenv("WEBTRANSPORT_CERT_FILE")
+	keyFile := os.Getenv("WEBTRANSPORT_KEY_FILE")
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("WEBTRANSPORT_ADDR needs WEBTRANSPORT_CERT_FILE and WEBTRANSPORT_KEY_FILE")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load webtransport certificate: %w", err)
+	}
+	publicURL := strings.TrimSpace(os.Getenv("WEBTRANSPORT_URL"))
+	if publicURL != "" {
+		if u, err := url.Parse(publicURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("WEBTRANSPORT_URL=%q is not a URL like https://chat.example.com:4433/wt", publicURL)
+		}
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve webtransport address: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("listen for webtransport: %w", err)
+	}
+
+	t := &webTransportServer{s: s, conn: conn, url: publicURL}
+	mux := http.NewServeMux()
+	mux.HandleFunc(wtPath, t.handleConnect)
+	h3 := &http3.Server{
+		Handler:   s.proxies.middleware(requestIDMiddleware(s.tenantMiddleware(s.localeMiddleware(loggingMiddleware(mux))))),
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	}
+	webtransport.ConfigureHTTP3Server(h3)
+	t.server = &webtransport.Server{
+		H3:                   h3,
+		ApplicationProtocols: []string{wsProtocolMsgpack, wsProtocolJSON},
+		// Origins are checked against the configured policy in handleConnect.
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+	return t, nil
+}
+
+// run serves sessions until close; ctx only tells it that an error then is
+// expected.
+func (t *webTransportServer) run(ctx context.Context) {
+	log.Printf("WebTransport gateway listening on %s (udp)", t.conn.LocalAddr())
+	if err := t.server.Serve(t.conn); err != nil && ctx.Err() == nil {
+		log.Printf("webtransport: %v", err)
+	}
+}
+
+// close ends every QUIC connection. The gateway's clients should already
+// have been closed with their close codes, as they go with the connections.
+func (t *webTransportServer) close() {
+	if err := t.server.Close(); err != nil {
+		log.Printf("close webtransport: %v", err)
+	}
+}
+
+// urlFor is where clients of r should open WebTransport sessions:
+// WEBTRANSPORT_URL, or else r's host on the WebTransport port.
+func (t *webTransportServer) urlFor(r *http.Request) string {
+	if t.url != "" {
+		return t.url
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	_, port, _ := net.SplitHostPort(t.conn.LocalAddr().String())
+	return "https://" + net.JoinHostPort(host, port) + tenantScopeFrom(r.Context()).basePath + wtPath
+}
+
+// handleConnect accepts a session and serves its event stream the way
+// handleWS serves a WebSocket. Browsers cannot set headers or send cookies
+// on a WebTransport session, so an access token may also come as
+// ?access_token=.
+func (t *webTransportServer) handleConnect(w http.ResponseWriter, r *http.Request) {
+	s := t.s
+	if _, ok := bearerToken(r); !ok {
+		if token := r.URL.Query().Get("access_token"); token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	sess, _, ok := s.sessionFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	currentUser, ok := s.userFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !t.originAllowed(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if s.ws.atCapacity() {
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return
+	}
+
+	// The upgrade needs http3's own writer, not a middleware's wrapper.
+	for {
+		inner, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		w = inner.Unwrap()
+	}
+	session, err := t.server.Upgrade(w, r)
+	if err != nil {
+		log.Printf("upgrade webtransport: %v", err)
+		http.Error(w, "webtransport upgrade failed", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(session.Context(), wtStreamWait)
+	stream, err := session.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		_ = session.CloseWithError(websocket.ClosePolicyViolation, "no event stream opened")
+		return
+	}
+
+	conn := &wtConn{session: session, stream: stream, reader: bufio.NewReader(stream)}
+	client := s.newWSClient(conn, sess, currentUser)
+	client.binary = session.SessionState().ApplicationProtocol == wsProtocolMsgpack
+	client.webTransport = true
+	s.runWSClient(r, client)
+}
+
+// originAllowed is the origin policy, plus pages on the gateway's own
+// host: the web client is served from there, but on another port.
+func (t *webTransportServer) originAllowed(r *http.Request) bool {
+	if origin, err := url.Parse(r.Header.Get("Origin")); err == nil && origin.Hostname() != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.EqualFold(origin.Hostname(), host) {
+			return true
+		}
+	}
+	return t.s.origins.allowed(r)
+}
+
+// wtConn carries a wsClient over one WebTransport stream, framed as
+// described at the top of this file.
+type wtConn struct {
+	session *webtransport.Session
+	stream  *webtransport.Stream
+	reader  *bufio.Reader
+
+	readLimit int64
+	onPong    func(string) error
+
+	writeMu       sync.Mutex
+	writeDeadline time.Time
+
+	// Kept apart from writeMu so closing never waits on a stalled write.
+	closeMu     sync.Mutex
+	closeCode   int
+	closeReason string
+}
+
+func (c *wtConn) ReadMessage() (int, []byte, error) {
+	for {
+		var head [wtFrameHead]byte
+		if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+			return 0, nil, wtReadError(err)
+		}
+		kind, size := int(head[0]), binary.BigEndian.Uint32(head[1:])
+		if c.readLimit > 0 && int64(size) > c.readLimit {
+			return 0, nil, &websocket.CloseError{Code: websocket.CloseMessageTooBig, Text: "frame too large"}
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return 0, nil, wtReadError(err)
+		}
+
+		switch kind {
+		case websocket.TextMessage, websocket.BinaryMessage:
+			return kind, payload, nil
+		case websocket.PingMessage:
+			if err := c.writeFrame(websocket.PongMessage, payload, time.Now().Add(wsWriteWait)); err != nil {
+				return 0, nil, err
+			}
+		case websocket.PongMessage:
+			if c.onPong != nil {
+				if err := c.onPong(string(payload)); err != nil {
+					return 0, nil, err
+				}
+			}
+		case websocket.CloseMessage:
+			closeErr := &websocket.CloseError{Code: websocket.CloseNoStatusReceived}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Text = string(payload[2:])
+			}
+			return 0, nil, closeErr
+		default:
+			return 0, nil, &websocket.CloseError{Code: websocket.CloseProtocolError, Text: fmt.Sprintf("unknown frame kind %d", kind)}
+		}
+	}
+}
+
+// wtReadError reports a stream that ended or failed as the peer going
+// away, which readLoop does not log.
+func wtReadError(err error) error {
+	return &websocket.CloseError{Code: websocket.CloseGoingAway, Text: err.Error()}
+}
+
+func (c *wtConn) writeFrame(kind int, data []byte, deadline time.Time) error {
+	frame := make([]byte, wtFrameHead+len(data))
+	frame[0] = byte(kind)
+	binary.BigEndian.PutUint32(frame[1:wtFrameHead], uint32(len(data)))
+	copy(frame[wtFrameHead:], data)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.stream.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	_, err := c.stream.Write(frame)
+	return err
+}
+
+func (c *wtConn) WriteMessage(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	deadline := c.writeDeadline
+	c.writeMu.Unlock()
+	return c.writeFrame(messageType, data, deadline)
+}
+
+// WriteControl sends pings as frames. A close is held for Close, which
+// ends the whole session with its code and reason.
+func (c *wtConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType == websocket.CloseMessage {
+		c.closeMu.Lock()
+		if len(data) >= 2 {
+			c.closeCode = int(binary.BigEndian.Uint16(data))
+			c.closeReason = string(data[2:])
+		}
+		c.closeMu.Unlock()
+		return nil
+	}
+	return c.writeFrame(messageType, data, deadline)
+}
+
+func (c *wtConn) SetReadLimit(limit int64) { c.readLimit = limit }
+
+func (c *wtConn) SetReadDeadline(t time.Time) error { return c.stream.SetReadDeadline(t) }
+
+func (c *wtConn) SetWriteDeadline(t time.Time) error {
+	c.writeMu.Lock()
+	c.writeDeadline = t
+	c.writeMu.Unlock()
+	return nil
+}
+
+func (c *wtConn) SetPongHandler(h func(appData string) error) { c.onPong = h }
+
+// EnableWriteCompression does nothing: WebTransport has no per-message
+// compression.
+func (c *wtConn) EnableWriteCompression(bool) {}
+
+func (c *wtConn) Close() error {
+	c.closeMu.Lock()
+	code, reason := c.closeCode, c.closeReason
+	c.closeMu.Unlock()
+	return c.session.CloseWithError(webtransport.SessionErrorCode(code), reason)
+}
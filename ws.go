@@ -6,10 +6,12 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
@@ -19,19 +21,94 @@ const (
 	wsPongWait   = 60 * time.Second
 	wsPingPeriod = 45 * time.Second
 	wsMaxMessage = 64 * 1024
+
+	// wsSendQueueLimit bounds the frames waiting for a client. A client that
+	// falls this far behind is disconnected with wsCloseSlowConsumer instead
+	// of silently losing chat messages.
+	wsSendQueueLimit    = 256
+	wsCloseSlowConsumer = 4008
+
+	// Connection limits, overridable with WS_MAX_CONNECTIONS_PER_USER and
+	// WS_MAX_CONNECTIONS (0 disables a limit). A user over their limit loses
+	// their oldest connection with wsCloseReplaced; an instance at its limit
+	// turns new upgrades away.
+	defaultWSMaxPerUser = 10
+	defaultWSMaxTotal   = 10000
+	wsCloseReplaced     = 4009
+	wsCloseIdle         = 4010
+
+	// wsCloseSignedOut ends connections whose sessions were revoked, such as
+	// after an email change; the client goes back to the login page.
+	wsCloseSignedOut = 4011
+
+	// Frames smaller than this are sent uncompressed; deflating a short
+	// typing or presence event costs more than it saves.
+	wsCompressMinBytes = 512
+
+	// wsMaxBulkSubscribe caps the channel list of one subscribe:bulk event.
+	wsMaxBulkSubscribe = 500
+
+	// maxNonceLength bounds the client-generated id of a sent message.
+	maxNonceLength = 64
+
+	wsProtocolJSON    = "echosphere.json"
+	wsProtocolMsgpack = "echosphere.msgpack"
 )
 
 var wsUpgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+	ReadBufferSize:    1024,
+	WriteBufferSize:   1024,
+	EnableCompression: true,
+	Subprotocols:      []string{wsProtocolMsgpack, wsProtocolJSON},
+	// Origins are checked against the configured policy in handleWS.
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
 }
 
+// wsHubShards splits channel subscriptions across this many locks, so
+// broadcasts and subscribes on different channels rarely wait on each other.
+const wsHubShards = 64
+
+// wsHub tracks connections by user under mu and subscriptions by channel in
+// shards, each with its own lock. Nothing holds mu and a shard lock at once.
 type wsHub struct {
 	mu          sync.RWMutex
-	channelSubs map[int64]map[*wsClient]struct{}
+	userClients map[string]map[*wsClient]struct{}
+	selfClients map[int64]map[*wsClient]struct{} // by user ID, for selfEvent
+	clients     int
+	maxPerUser  int
+	maxTotal    int
+	metrics     *metrics
+
+	shards []channelShard
+}
+
+type channelShard struct {
+	mu   sync.RWMutex
+	subs map[int64]map[*wsClient]struct{}
+}
+
+func (h *wsHub) shard(channelID int64) *channelShard {
+	return &h.shards[uint64(channelID)%uint64(len(h.shards))]
+}
+
+func (sh *channelShard) add(client *wsClient, channelID int64) {
+	subs := sh.subs[channelID]
+	if subs == nil {
+		subs = make(map[*wsClient]struct{})
+		sh.subs[channelID] = subs
+	}
+	subs[client] = struct{}{}
+}
+
+func (sh *channelShard) remove(client *wsClient, channelID int64) {
+	if subs, ok := sh.subs[channelID]; ok {
+		delete(subs, client)
+		if len(subs) == 0 {
+			delete(sh.subs, channelID)
+		}
+	}
 }
 
 type voiceState struct {
@@ -40,18 +117,28 @@ type voiceState struct {
 }
 
 type voiceRoom struct {
+	serverID     int64
+	audioKbps    int // from the channel's audio settings
 	participants map[string]*wsClient
+	recording    *voiceRecording // see voicerecording.go
 }
 
 type voiceParticipant struct {
-	ID          string `json:"id"`
-	Email       string `json:"email"`
-	DisplayName string `json:"displayName"`
+	ID          string    `json:"id"`
+	UserID      int64     `json:"userId"`
+	Handle      string    `json:"handle"`
+	DisplayName string    `json:"displayName"`
+	JoinedAt    time.Time `json:"joinedAt"`
+	Mode        string    `json:"mode"`
+	Video       bool      `json:"video"`
+	// RecordingConsent is set while the participant agrees to be recorded.
+	RecordingConsent bool `json:"recordingConsent"`
 }
 
 type voiceSignal struct {
 	From        string          `json:"from"`
-	Email       string          `json:"email"`
+	UserID      int64           `json:"userId"`
+	Handle      string          `json:"handle"`
 	DisplayName string          `json:"displayName"`
 	Payload     json.RawMessage `json:"payload"`
 }
@@ -60,96 +147,446 @@ type wsClient struct {
 	id            string
 	state         *serverState
 	hub           *wsHub
-	conn          *websocket.Conn
-	send          chan []byte
-	user          user
+	conn          wsConn
+	email         string // fixed for the connection; an email change disconnects it
+	userID        int64
+	profile       atomic.Pointer[user] // see currentUser
 	subscriptions map[int64]struct{}
+	binary        bool // negotiated wsProtocolMsgpack
+	webTransport  bool // connected through webtransport.go rather than /ws
+	connectedAt   time.Time
+	lastActive    atomic.Int64 // unix nanos of the last inbound event
+	maskProfanity atomic.Bool  // follows user.MaskProfanity when it changes
+	rtt           atomic.Int64 // last ping round trip in nanoseconds, 0 until measured
+	sessionHash   string
+	resumeHash    string // of the token in hello; see wsresume.go
+	deviceID      string
+	scopes        tokenScopes // of an API session; see wsEventScope
+	eventTokens   float64     // see allowEvent
+	eventsAt      time.Time
 	mu            sync.Mutex
 	closeOnce     sync.Once
 
+	sendMu       sync.Mutex
+	sendQueue    []wsFrame
+	sendClosed   bool
+	batchEvery   time.Duration // see wsbatch.go; 0 sends every frame on its own
+	flushPending bool          // a batch window is open
+	wake         chan struct{}
+	done         chan struct{}
+
+	writingSince atomic.Int64 // queuedAt of the oldest frame being written, 0 when idle
+	lagStrikes   atomic.Int32 // consecutive lag monitor checks that found the client behind
+
 	voiceJoined    bool
 	voiceID        string
 	voiceChannelID int64
+	voiceJoinedAt  time.Time
+	voiceMode      string
+	voiceVideo     bool
+	voiceSession   atomic.Int64 // open voice_sessions row, 0 when none
+
+	voiceRecordingConsent bool
+}
+
+// wsConn is the transport under a wsClient. *websocket.Conn is one; so is
+// wtConn, which frames the same events on a WebTransport stream.
+type wsConn interface {
+	ReadMessage() (messageType int, data []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetReadLimit(limit int64)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	EnableWriteCompression(enable bool)
+	Close() error
 }
 
 type wsInbound struct {
-	Type      string          `json:"type"`
-	ChannelID int64           `json:"channelId,omitempty"`
-	Content   string          `json:"content,omitempty"`
-	Target    string          `json:"target,omitempty"`
-	Payload   json.RawMessage `json:"payload,omitempty"`
+	Type       string          `json:"type"`
+	ChannelID  int64           `json:"channelId,omitempty"`
+	ChannelIDs []int64         `json:"channelIds,omitempty"`
+	Content    string          `json:"content,omitempty"`
+	Target     string          `json:"target,omitempty"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	Nonce      string          `json:"nonce,omitempty"`
+	TTL        int64           `json:"ttl,omitempty"`
+	StickerID  int64           `json:"stickerId,omitempty"`
+	Mode       string          `json:"mode,omitempty"`
+	Enabled    bool            `json:"enabled,omitempty"`
+	ServerID   int64           `json:"serverId,omitempty"`
+	After      int64           `json:"after,omitempty"`
+	Query      string          `json:"query,omitempty"`
 }
 
 type wsOutbound struct {
-	Type         string             `json:"type"`
-	ChannelID    int64              `json:"channelId,omitempty"`
-	Message      *messageDTO        `json:"message,omitempty"`
-	Error        string             `json:"error,omitempty"`
-	Code         string             `json:"code,omitempty"`
-	Participants []voiceParticipant `json:"participants,omitempty"`
-	Self         *voiceParticipant  `json:"self,omitempty"`
-	Peer         *voiceParticipant  `json:"peer,omitempty"`
-	Signal       *voiceSignal       `json:"signal,omitempty"`
+	Type         string              `json:"type"`
+	ChannelID    int64               `json:"channelId,omitempty"`
+	Message      *messageDTO         `json:"message,omitempty"`
+	Error        string              `json:"error,omitempty"`
+	Code         string              `json:"code,omitempty"`
+	Participants []voiceParticipant  `json:"participants,omitempty"`
+	Self         *voiceParticipant   `json:"self,omitempty"`
+	Peer         *voiceParticipant   `json:"peer,omitempty"`
+	Signal       *voiceSignal        `json:"signal,omitempty"`
+	Bandwidth    *voiceBandwidth     `json:"bandwidth,omitempty"`
+	Audio        *voiceAudioSettings `json:"audio,omitempty"`
+	Recording    *voiceRecording     `json:"recording,omitempty"`
+	RTTMillis    *float64            `json:"rttMs,omitempty"`
+	ConnectionID string              `json:"connectionId,omitempty"`
+	Reconnect    *wsReconnectPolicy  `json:"reconnect,omitempty"`
+	ResumeToken  string              `json:"resumeToken,omitempty"`
+	Sync         *syncPayload        `json:"sync,omitempty"`
+	Reminder     *reminderDTO        `json:"reminder,omitempty"`
+	Channel      *channelPayload     `json:"channel,omitempty"`
+	Server       *serverPayload      `json:"server,omitempty"`
+	ServerID     int64               `json:"serverId,omitempty"`
+	ChannelIDs   []int64             `json:"channelIds,omitempty"`
+	Rejected     []int64             `json:"rejected,omitempty"`
+	Nonce        string              `json:"nonce,omitempty"`
+	Duplicate    bool                `json:"duplicate,omitempty"`
+	MessageID    int64               `json:"messageId,omitempty"`
+	Attachment   *attachmentDTO      `json:"attachment,omitempty"`
+	Transcript   *transcriptDTO      `json:"transcript,omitempty"`
+	Preferences  *preferencesDTO     `json:"preferences,omitempty"`
+	DeviceID     string              `json:"deviceId,omitempty"`
+	Payload      json.RawMessage     `json:"payload,omitempty"`
+	Presence     *presenceDTO        `json:"presence,omitempty"`
+	Relationship *relationshipDTO    `json:"relationship,omitempty"`
+	Query        string              `json:"query,omitempty"`
+	After        int64               `json:"after,omitempty"`
+	Done         bool                `json:"done,omitempty"`
+	Roles        []roleDTO           `json:"roles,omitempty"`
+	Permissions  []string            `json:"permissions,omitempty"`
+	// Members is sent even when empty, for a search with no matches.
+	Members []memberInfo `json:"members,omitzero"`
+	// StickerPacks is sent even when empty, after the last pack is deleted.
+	StickerPacks   []stickerPackDTO `json:"stickerPacks,omitzero"`
+	Announcement   *announcementDTO `json:"announcement,omitempty"`
+	AnnouncementID int64            `json:"announcementId,omitempty"`
+}
+
+// wsFrame is a marshaled outbound event plus its delivery policy.
+type wsFrame struct {
+	payload  []byte
+	packed   *packedPayload
+	critical bool   // errors are queued even when the client is over its limit
+	key      string // a newer frame with the same key replaces a queued one
+	queuedAt int64  // unix nanos, set by enqueue
+
+	// batchable frames may wait for the client's batch window and be sent
+	// to it as part of a "batch" frame.
+	batchable bool
+}
+
+// packedPayload holds the MessagePack form of a frame. It is encoded at most
+// once, on first use, and shared by every binary client the frame fans out to.
+type packedPayload struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+func (f wsFrame) msgpack() ([]byte, error) {
+	if f.packed == nil {
+		return jsonToMsgpack(f.payload)
+	}
+	f.packed.once.Do(func() {
+		f.packed.data, f.packed.err = jsonToMsgpack(f.payload)
+	})
+	return f.packed.data, f.packed.err
+}
+
+func outboundFrame(outbound wsOutbound) (wsFrame, error) {
+	payload, err := json.Marshal(outbound)
+	if err != nil {
+		return wsFrame{}, err
+	}
+	frame := wsFrame{payload: payload, packed: &packedPayload{}}
+	switch outbound.Type {
+	case "error", "message:ack":
+		frame.critical = true
+	case "channel:update":
+		frame.key = "channel:" + strconv.FormatInt(outbound.ChannelID, 10)
+	case "server:update":
+		if outbound.Server != nil {
+			frame.key = "server:" + strconv.FormatInt(outbound.Server.ID, 10)
+		}
+	case "stickers:update":
+		frame.key = "stickers:" + strconv.FormatInt(outbound.ServerID, 10)
+	case "roles:update":
+		frame.key = "roles:" + strconv.FormatInt(outbound.ServerID, 10)
+	case "settings:update":
+		frame.key = "settings"
+	case "channel:topic", "voice:peer-updated":
+		frame.batchable = true
+	case "presence:update":
+		frame.batchable = true
+		if outbound.Presence != nil {
+			frame.key = "presence:" + strconv.FormatInt(outbound.Presence.UserID, 10)
+		}
+	}
+	return frame, nil
+}
+
+func newWSHub(maxPerUser, maxTotal int) *wsHub {
+	return newShardedWSHub(maxPerUser, maxTotal, wsHubShards)
 }
 
-func newWSHub() *wsHub {
-	return &wsHub{channelSubs: make(map[int64]map[*wsClient]struct{})}
+// newShardedWSHub is newWSHub with the given number of shards. With one,
+// every channel shares a lock as they did before the hub was sharded, which
+// the benchmarks in ws_test.go compare against.
+func newShardedWSHub(maxPerUser, maxTotal, shards int) *wsHub {
+	h := &wsHub{
+		userClients: make(map[string]map[*wsClient]struct{}),
+		selfClients: make(map[int64]map[*wsClient]struct{}),
+		maxPerUser:  maxPerUser,
+		maxTotal:    maxTotal,
+		shards:      make([]channelShard, shards),
+	}
+	for i := range h.shards {
+		h.shards[i].subs = make(map[int64]map[*wsClient]struct{})
+	}
+	return h
 }
 
 func newVoiceState() *voiceState {
 	return &voiceState{rooms: make(map[int64]*voiceRoom)}
 }
 
-func (h *wsHub) subscribe(client *wsClient, channelID int64) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	subs := h.channelSubs[channelID]
-	if subs == nil {
-		subs = make(map[*wsClient]struct{})
-		h.channelSubs[channelID] = subs
-	}
-	subs[client] = struct{}{}
+func (h *wsHub) atCapacity() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.maxTotal > 0 && h.clients >= h.maxTotal
 }
 
-func (h *wsHub) unsubscribe(client *wsClient, channelID int64) {
+// register adds client to the hub. It reports false when the instance is
+// full, and otherwise returns the user's connections that now exceed the
+// per-user limit, oldest first, for the caller to close.
+func (h *wsHub) register(client *wsClient) ([]*wsClient, bool) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	if subs, ok := h.channelSubs[channelID]; ok {
-		delete(subs, client)
-		if len(subs) == 0 {
-			delete(h.channelSubs, channelID)
+	if h.maxTotal > 0 && h.clients >= h.maxTotal {
+		return nil, false
+	}
+	clients := h.userClients[client.email]
+	if clients == nil {
+		clients = make(map[*wsClient]struct{})
+		h.userClients[client.email] = clients
+	}
+	clients[client] = struct{}{}
+	h.clients++
+	own := h.selfClients[client.userID]
+	if own == nil {
+		own = make(map[*wsClient]struct{})
+		h.selfClients[client.userID] = own
+	}
+	own[client] = struct{}{}
+
+	if h.maxPerUser <= 0 || len(clients) <= h.maxPerUser {
+		return nil, true
+	}
+	others := make([]*wsClient, 0, len(clients)-1)
+	for other := range clients {
+		if other != client {
+			others = append(others, other)
 		}
 	}
+	sort.Slice(others, func(i, j int) bool { return others[i].connectedAt.Before(others[j].connectedAt) })
+	return others[:len(clients)-h.maxPerUser], true
+}
+
+func (h *wsHub) subscribe(client *wsClient, channelID int64) {
+	sh := h.shard(channelID)
+	sh.mu.Lock()
+	sh.add(client, channelID)
+	sh.mu.Unlock()
+}
+
+func (h *wsHub) subscribeMany(client *wsClient, channelIDs []int64) {
+	for _, channelID := range channelIDs {
+		h.subscribe(client, channelID)
+	}
 }
 
+func (h *wsHub) unsubscribe(client *wsClient, channelID int64) {
+	sh := h.shard(channelID)
+	sh.mu.Lock()
+	sh.remove(client, channelID)
+	sh.mu.Unlock()
+}
+
+// removeClient drops client from the hub. Its subscriptions set covers every
+// channel it subscribed to, so only those shards are touched.
 func (h *wsHub) removeClient(client *wsClient) {
+	client.mu.Lock()
+	channelIDs := make([]int64, 0, len(client.subscriptions))
+	for channelID := range client.subscriptions {
+		channelIDs = append(channelIDs, channelID)
+	}
+	client.mu.Unlock()
+	for _, channelID := range channelIDs {
+		h.unsubscribe(client, channelID)
+	}
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	for channelID, subs := range h.channelSubs {
-		if _, ok := subs[client]; ok {
-			delete(subs, client)
-			if len(subs) == 0 {
-				delete(h.channelSubs, channelID)
-			}
+	if clients, ok := h.userClients[client.email]; ok {
+		if _, registered := clients[client]; registered {
+			delete(clients, client)
+			h.clients--
+		}
+		if len(clients) == 0 {
+			delete(h.userClients, client.email)
+		}
+	}
+	if own, ok := h.selfClients[client.userID]; ok {
+		delete(own, client)
+		if len(own) == 0 {
+			delete(h.selfClients, client.userID)
 		}
 	}
 }
 
-func (h *wsHub) broadcast(channelID int64, payload []byte) {
-	h.mu.RLock()
-	subs := h.channelSubs[channelID]
+func (h *wsHub) broadcast(channelID int64, frame wsFrame) {
+	h.broadcastTo(channelID, frame, nil)
+}
+
+// broadcastTo sends frame to the channel's subscribers that match filter (all
+// of them when filter is nil) and returns how many it was queued for.
+func (h *wsHub) broadcastTo(channelID int64, frame wsFrame, filter func(*wsClient) bool) int {
+	start := time.Now()
+	sh := h.shard(channelID)
+	sh.mu.RLock()
+	subs := sh.subs[channelID]
 	clients := make([]*wsClient, 0, len(subs))
 	for client := range subs {
+		if filter == nil || filter(client) {
+			clients = append(clients, client)
+		}
+	}
+	sh.mu.RUnlock()
+
+	for _, client := range clients {
+		client.enqueue(frame)
+	}
+	h.metrics.observeFanout(time.Since(start))
+	return len(clients)
+}
+
+// subscribed reports whether client receives the channel's broadcasts.
+func (h *wsHub) subscribed(client *wsClient, channelID int64) bool {
+	sh := h.shard(channelID)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	_, ok := sh.subs[channelID][client]
+	return ok
+}
+
+// selfEvent sends frame to the user's own connections that match filter (all
+// of them when filter is nil), whatever they are subscribed to, and returns
+// how many it was queued for. It is how a user's other devices hear about
+// what they did on this one.
+func (h *wsHub) selfEvent(userID int64, frame wsFrame, filter func(*wsClient) bool) int {
+	h.mu.RLock()
+	clients := make([]*wsClient, 0, len(h.selfClients[userID]))
+	for client := range h.selfClients[userID] {
+		clients = append(clients, client)
+	}
+	h.mu.RUnlock()
+
+	n := 0
+	for _, client := range clients {
+		if filter == nil || filter(client) {
+			client.enqueue(frame)
+			n++
+		}
+	}
+	return n
+}
+
+func (h *wsHub) sendToUser(email string, outbound wsOutbound) {
+	frame, err := outboundFrame(outbound)
+	if err != nil {
+		log.Printf("marshal user event: %v", err)
+		return
+	}
+
+	h.mu.RLock()
+	clients := make([]*wsClient, 0, len(h.userClients[email]))
+	for client := range h.userClients[email] {
+		clients = append(clients, client)
+	}
+	h.mu.RUnlock()
+
+	for _, client := range clients {
+		client.enqueue(frame)
+	}
+}
+
+// connections counts email's open connections on this instance.
+func (h *wsHub) connections(email string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.userClients[email])
+}
+
+// forUser calls fn for every connection belonging to email.
+func (h *wsHub) forUser(email string, fn func(*wsClient)) {
+	h.mu.RLock()
+	clients := make([]*wsClient, 0, len(h.userClients[email]))
+	for client := range h.userClients[email] {
 		clients = append(clients, client)
 	}
 	h.mu.RUnlock()
 
 	for _, client := range clients {
-		client.enqueue(payload)
+		fn(client)
 	}
 }
 
-func (s *serverState) voiceJoin(channelID int64, client *wsClient) ([]voiceParticipant, voiceParticipant, error) {
+// disconnectUser closes every connection belonging to email.
+func (h *wsHub) disconnectUser(email string, code int, reason string) {
+	h.mu.RLock()
+	clients := make([]*wsClient, 0, len(h.userClients[email]))
+	for client := range h.userClients[email] {
+		clients = append(clients, client)
+	}
+	h.mu.RUnlock()
+
+	for _, client := range clients {
+		client.closeWith(code, reason)
+	}
+}
+
+// disconnectOtherSessions closes email's connections opened under any
+// session other than keepTokenHash; "" closes them all.
+func (h *wsHub) disconnectOtherSessions(email, keepTokenHash string, code int, reason string) {
+	h.mu.RLock()
+	clients := make([]*wsClient, 0, len(h.userClients[email]))
+	for client := range h.userClients[email] {
+		if keepTokenHash == "" || client.sessionHash != keepTokenHash {
+			clients = append(clients, client)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, client := range clients {
+		client.closeWith(code, reason)
+	}
+}
+
+// disconnectSession closes the connections opened under one session.
+func (h *wsHub) disconnectSession(tokenHash string, code int, reason string) {
+	for _, client := range h.snapshot() {
+		if client.sessionHash == tokenHash {
+			client.closeWith(code, reason)
+		}
+	}
+}
+
+func (s *serverState) voiceJoin(channelID, serverID int64, client *wsClient) ([]voiceParticipant, voiceParticipant, error) {
 	s.voice.mu.Lock()
 	defer s.voice.mu.Unlock()
 
@@ -159,36 +596,42 @@ func (s *serverState) voiceJoin(channelID int64, client *wsClient) ([]voiceParti
 
 	room := s.voice.rooms[channelID]
 	if room == nil {
-		room = &voiceRoom{participants: make(map[string]*wsClient)}
+		room = &voiceRoom{serverID: serverID, participants: make(map[string]*wsClient)}
 		s.voice.rooms[channelID] = room
 	}
 
 	if client.voiceID == "" {
 		client.voiceID = generateSessionID()
 	}
+	if client.voiceChannelID != channelID || client.voiceJoinedAt.IsZero() {
+		client.voiceJoinedAt = time.Now().UTC()
+	}
 	client.voiceJoined = true
 	client.voiceChannelID = channelID
 	room.participants[client.voiceID] = client
 
 	participants := make([]voiceParticipant, 0, len(room.participants)-1)
-	for id, other := range room.participants {
+	for _, other := range room.participants {
 		if other == client {
 			continue
 		}
-		participants = append(participants, voiceParticipant{
-			ID:          id,
-			Email:       other.user.Email,
-			DisplayName: other.user.DisplayName,
-		})
+		participants = append(participants, other.voiceParticipant())
 	}
 
-	self := voiceParticipant{
-		ID:          client.voiceID,
-		Email:       client.user.Email,
-		DisplayName: client.user.DisplayName,
-	}
+	return participants, client.voiceParticipant(), nil
+}
 
-	return participants, self, nil
+// voiceCount returns how many people are in serverID's voice channels.
+func (s *serverState) voiceCount(serverID int64) int {
+	s.voice.mu.RLock()
+	defer s.voice.mu.RUnlock()
+	n := 0
+	for _, room := range s.voice.rooms {
+		if room.serverID == serverID {
+			n += len(room.participants)
+		}
+	}
+	return n
 }
 
 func (s *serverState) voiceLeave(channelID int64, client *wsClient) (voiceParticipant, bool) {
@@ -203,6 +646,9 @@ func (s *serverState) voiceLeaveLocked(channelID int64, client *wsClient) (voice
 		client.voiceJoined = false
 		client.voiceChannelID = 0
 		client.voiceID = ""
+		client.voiceJoinedAt = time.Time{}
+		client.voiceVideo = false
+		client.voiceRecordingConsent = false
 		return voiceParticipant{}, false
 	}
 
@@ -219,11 +665,16 @@ func (s *serverState) voiceLeaveLocked(channelID int64, client *wsClient) (voice
 		return voiceParticipant{}, false
 	}
 
-	part := voiceParticipant{ID: id, Email: client.user.Email, DisplayName: client.user.DisplayName}
+	part := client.voiceParticipant()
+	part.ID = id
 	delete(room.participants, id)
 	client.voiceJoined = false
 	client.voiceChannelID = 0
 	client.voiceID = ""
+	client.voiceJoinedAt = time.Time{}
+	client.voiceVideo = false
+	client.voiceRecordingConsent = false
+	s.stopVoiceRecordingLocked(channelID, func(rec *voiceRecording) bool { return rec.RecorderID == id })
 
 	if len(room.participants) == 0 {
 		delete(s.voice.rooms, channelID)
@@ -239,21 +690,17 @@ func (s *serverState) voiceParticipants(channelID int64, exclude *wsClient) []vo
 		return nil
 	}
 	participants := make([]voiceParticipant, 0, len(room.participants))
-	for id, client := range room.participants {
+	for _, client := range room.participants {
 		if exclude != nil && client == exclude {
 			continue
 		}
-		participants = append(participants, voiceParticipant{
-			ID:          id,
-			Email:       client.user.Email,
-			DisplayName: client.user.DisplayName,
-		})
+		participants = append(participants, client.voiceParticipant())
 	}
 	return participants
 }
 
 func (s *serverState) voiceBroadcast(channelID int64, outbound wsOutbound, exclude *wsClient) {
-	payload, err := json.Marshal(outbound)
+	frame, err := outboundFrame(outbound)
 	if err != nil {
 		log.Printf("marshal voice broadcast: %v", err)
 		return
@@ -266,7 +713,7 @@ func (s *serverState) voiceBroadcast(channelID int64, outbound wsOutbound, exclu
 			if exclude != nil && client == exclude {
 				continue
 			}
-			client.enqueue(append([]byte(nil), payload...))
+			client.enqueue(frame)
 		}
 	}
 	s.voice.mu.RUnlock()
@@ -289,13 +736,15 @@ func (s *serverState) voiceSignal(channelID int64, sender *wsClient, targetID st
 	}
 	s.voice.mu.RUnlock()
 
+	from := sender.currentUser()
 	signal := wsOutbound{
 		Type:      "voice:signal",
 		ChannelID: channelID,
 		Signal: &voiceSignal{
 			From:        sender.voiceID,
-			Email:       sender.user.Email,
-			DisplayName: sender.user.DisplayName,
+			UserID:      from.ID,
+			Handle:      from.Handle,
+			DisplayName: from.DisplayName,
 			Payload:     payload,
 		},
 	}
@@ -308,24 +757,73 @@ func (c *wsClient) readLoop() {
 
 	c.conn.SetReadLimit(wsMaxMessage)
 	_ = c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
-	c.conn.SetPongHandler(func(string) error {
-		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
-	})
+	c.conn.SetPongHandler(c.handlePong)
 
 	for {
-		var evt wsInbound
-		if err := c.conn.ReadJSON(&evt); err != nil {
+		messageType, data, err := c.conn.ReadMessage()
+		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("ws read error: %v", err)
 			}
 			break
 		}
+		c.lastActive.Store(time.Now().UnixNano())
+		if !c.allowEvent() {
+			c.closeWith(wsCloseRateLimited, "rate limited")
+			return
+		}
+		if messageType == websocket.BinaryMessage {
+			if data, err = msgpackToJSON(data); err != nil {
+				c.sendError("invalid_frame", "malformed msgpack frame")
+				continue
+			}
+		}
+		var evt wsInbound
+		if err := json.Unmarshal(data, &evt); err != nil {
+			c.sendError("invalid_frame", "malformed event")
+			continue
+		}
 		c.handleEvent(evt)
 	}
 }
 
+// idle reports whether the client has sent no events for longer than the
+// configured idle timeout. Pongs keep a connection alive but don't count as
+// activity.
+func (c *wsClient) idle() bool {
+	timeout := c.state.wsIdleTimeout
+	if timeout <= 0 {
+		return false
+	}
+	return time.Since(time.Unix(0, c.lastActive.Load())) > timeout
+}
+
+func (c *wsClient) writeFrame(frame wsFrame) error {
+	messageType, data := websocket.TextMessage, frame.payload
+	if c.binary {
+		packed, err := frame.msgpack()
+		if err != nil {
+			log.Printf("encode msgpack frame: %v", err)
+			return nil
+		}
+		messageType, data = websocket.BinaryMessage, packed
+	}
+	c.conn.EnableWriteCompression(len(data) >= wsCompressMinBytes)
+	_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.conn.WriteMessage(messageType, data)
+}
+
 func (c *wsClient) writeLoop() {
 	ticker := time.NewTicker(wsPingPeriod)
+	var latency <-chan time.Time
+	if every := c.state.wsLatencyEvery; every > 0 {
+		latencyTicker := time.NewTicker(every)
+		defer latencyTicker.Stop()
+		latency = latencyTicker.C
+		if err := c.sendPing(); err != nil {
+			return
+		}
+	}
 	defer func() {
 		ticker.Stop()
 		c.close()
@@ -333,18 +831,42 @@ func (c *wsClient) writeLoop() {
 
 	for {
 		select {
-		case payload, ok := <-c.send:
-			_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
-			if !ok {
-				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+		case <-c.done:
+			return
+		case <-c.wake:
+			c.sendMu.Lock()
+			frames := c.sendQueue
+			c.sendQueue = nil
+			c.sendMu.Unlock()
+			if len(frames) == 0 {
+				continue
+			}
+			c.writingSince.Store(frames[0].queuedAt)
+			c.state.metrics.observeSendDelay(time.Since(time.Unix(0, frames[0].queuedAt)))
+			if c.batchEvery > 0 {
+				frames = coalesceFrames(frames)
+			}
+			for _, frame := range frames {
+				if err := c.writeFrame(frame); err != nil {
+					return
+				}
+			}
+			c.writingSince.Store(0)
+		case <-ticker.C:
+			if c.idle() {
+				c.closeWith(wsCloseIdle, "idle timeout")
 				return
 			}
-			if err := c.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+			if code := c.sessionCloseCode(); code != 0 {
+				c.closeWith(code, "session ended")
 				return
 			}
-		case <-ticker.C:
-			_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			c.reloadProfile()
+			if err := c.sendPing(); err != nil {
+				return
+			}
+		case <-latency:
+			if err := c.sendPing(); err != nil {
 				return
 			}
 		}
@@ -352,19 +874,37 @@ func (c *wsClient) writeLoop() {
 }
 
 func (c *wsClient) handleEvent(evt wsInbound) {
+	if scope := wsEventScope(evt.Type); !c.scopes.allows(scope) {
+		c.enqueueJSON(wsOutbound{Type: "error", ChannelID: evt.ChannelID, Code: "insufficient_scope", Error: "this token lacks the scope for " + evt.Type, Nonce: evt.Nonce})
+		return
+	}
 	switch evt.Type {
 	case "subscribe":
 		c.handleSubscribe(evt.ChannelID)
+	case "subscribe:bulk":
+		c.handleBulkSubscribe(evt.ChannelIDs)
 	case "unsubscribe":
 		c.handleUnsubscribe(evt.ChannelID)
 	case "message":
-		c.handleMessage(evt.ChannelID, evt.Content)
+		c.handleMessage(evt.ChannelID, evt.Content, evt.Nonce, evt.TTL, evt.StickerID)
 	case "voice:join":
 		c.handleVoiceJoin(evt.ChannelID)
 	case "voice:leave":
 		c.handleVoiceLeave(evt.ChannelID)
 	case "voice:signal":
 		c.handleVoiceSignal(evt.ChannelID, evt.Target, evt.Payload)
+	case "voice:mode":
+		c.handleVoiceMode(evt.Mode)
+	case "voice:video":
+		c.handleVoiceVideo(evt.Enabled)
+	case "voice:record":
+		c.handleVoiceRecord(evt.Enabled)
+	case "voice:recording-consent":
+		c.handleVoiceRecordingConsent(evt.Enabled)
+	case "device:signal":
+		c.handleDeviceSignal(evt.Target, evt.Payload)
+	case "members:request":
+		c.handleMembersRequest(evt.ServerID, evt.After, evt.Query)
 	default:
 		c.sendError("unsupported_event", "unsupported event type")
 	}
@@ -386,7 +926,7 @@ func (c *wsClient) handleSubscribe(channelID int64) {
 		return
 	}
 
-	hasAccess, err := c.state.userHasServerAccess(context.Background(), c.user.Email, ch.ServerID)
+	hasAccess, err := c.state.userHasChannelAccess(context.Background(), c.email, ch)
 	if err != nil {
 		log.Printf("ws subscribe access: %v", err)
 		c.sendError("internal", "failed to subscribe")
@@ -405,6 +945,56 @@ func (c *wsClient) handleSubscribe(channelID int64) {
 	c.mu.Unlock()
 
 	c.hub.subscribe(c, channelID)
+	c.state.deliverPendingEphemeral(context.Background(), c, []int64{channelID})
+}
+
+// handleBulkSubscribe subscribes to many channels after a single access
+// query and replies with the accepted and rejected IDs.
+func (c *wsClient) handleBulkSubscribe(channelIDs []int64) {
+	if len(channelIDs) == 0 {
+		c.sendError("invalid_channel", "channel ids required")
+		return
+	}
+	if len(channelIDs) > wsMaxBulkSubscribe {
+		c.sendError("invalid_channel", "too many channels")
+		return
+	}
+
+	seen := make(map[int64]struct{}, len(channelIDs))
+	ids := make([]int64, 0, len(channelIDs))
+	for _, id := range channelIDs {
+		if _, dup := seen[id]; dup || id <= 0 {
+			continue
+		}
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+	}
+
+	allowed, err := c.state.accessibleChannelIDs(context.Background(), c.email, ids)
+	if err != nil {
+		log.Printf("ws bulk subscribe access: %v", err)
+		c.sendError("internal", "failed to subscribe")
+		return
+	}
+
+	ack := wsOutbound{Type: "subscribed", ChannelIDs: []int64{}}
+	c.mu.Lock()
+	if c.subscriptions == nil {
+		c.subscriptions = make(map[int64]struct{})
+	}
+	for _, id := range ids {
+		if !allowed[id] {
+			ack.Rejected = append(ack.Rejected, id)
+			continue
+		}
+		c.subscriptions[id] = struct{}{}
+		ack.ChannelIDs = append(ack.ChannelIDs, id)
+	}
+	c.mu.Unlock()
+
+	c.hub.subscribeMany(c, ack.ChannelIDs)
+	c.enqueueJSON(ack)
+	c.state.deliverPendingEphemeral(context.Background(), c, ack.ChannelIDs)
 }
 
 func (c *wsClient) handleUnsubscribe(channelID int64) {
@@ -416,10 +1006,23 @@ func (c *wsClient) handleUnsubscribe(channelID int64) {
 	c.hub.unsubscribe(c, channelID)
 }
 
-func (c *wsClient) handleMessage(channelID int64, content string) {
+// handleMessage saves and broadcasts a chat message. A client nonce, when
+// given, is echoed on the broadcast, on the message:ack sent back to this
+// connection and on any error, so the client can settle its optimistic copy.
+// Resending a nonce after a reconnect acks the original instead of posting
+// again.
+func (c *wsClient) handleMessage(channelID int64, content, nonce string, ttlSeconds, stickerID int64) {
+	fail := func(code, message string) {
+		c.enqueueJSON(wsOutbound{Type: "error", ChannelID: channelID, Code: code, Error: message, Nonce: nonce})
+	}
+
 	content = strings.TrimSpace(content)
-	if channelID <= 0 || content == "" {
-		c.sendError("invalid_message", "channel and content required")
+	if channelID <= 0 || (content == "" && stickerID == 0) {
+		fail("invalid_message", "channel and content required")
+		return
+	}
+	if len(nonce) > maxNonceLength {
+		fail("invalid_nonce", "nonce too long")
 		return
 	}
 
@@ -427,27 +1030,100 @@ func (c *wsClient) handleMessage(channelID int64, content string) {
 	_, subscribed := c.subscriptions[channelID]
 	c.mu.Unlock()
 	if !subscribed {
-		c.sendError("not_subscribed", "subscribe before sending")
+		fail("not_subscribed", "subscribe before sending")
+		return
+	}
+
+	if c.state.messageTooLong(content) {
+		fail("too_long", "message too long")
+		return
+	}
+	ttl, err := messageTTL(ttlSeconds)
+	if err != nil {
+		fail("invalid_ttl", err.Error())
+		return
+	}
+
+	ch, exists, err := c.state.channelByID(context.Background(), channelID)
+	if err != nil {
+		log.Printf("ws message channel lookup: %v", err)
+		fail("internal", "failed to save message")
+		return
+	}
+	if !exists {
+		fail("not_found", "channel not found")
 		return
 	}
+	canPost, err := c.state.canPostInChannel(context.Background(), c.email, ch)
+	if err != nil {
+		log.Printf("ws post permission: %v", err)
+		fail("internal", "failed to save message")
+		return
+	}
+	if !canPost {
+		fail("read_only", "this channel is read-only")
+		return
+	}
+	if pending, err := c.state.rulesPending(context.Background(), c.email, ch); err != nil {
+		log.Printf("ws server rules: %v", err)
+		fail("internal", "failed to save message")
+		return
+	} else if pending {
+		fail("rules_not_accepted", errRulesNotAccepted.Error())
+		return
+	}
+	if stickerID != 0 {
+		_, _, found, err := c.state.stickerInServer(context.Background(), ch.ServerID, stickerID)
+		if err != nil {
+			log.Printf("ws load sticker: %v", err)
+			fail("internal", "failed to save message")
+			return
+		}
+		if !found {
+			fail("invalid_sticker", "not a sticker of this server")
+			return
+		}
+	}
 
-	if utf8.RuneCountInString(content) > 2000 {
-		c.sendError("too_long", "message too long")
+	if stickerID == 0 && isRemindCommand(content) {
+		rem, err := c.state.remindFromCommand(context.Background(), c.currentUser(), channelID, content)
+		if errors.Is(err, errInvalidReminder) {
+			fail("invalid_command", "usage: /remind <30m|2h|1d> <text>")
+			return
+		}
+		if err != nil {
+			log.Printf("ws create reminder: %v", err)
+			fail("internal", "failed to create reminder")
+			return
+		}
+		dto := toReminderDTO(rem)
+		c.enqueueJSON(wsOutbound{Type: "reminder:created", ChannelID: channelID, Reminder: &dto, Nonce: nonce})
 		return
 	}
 
-	msg, err := c.state.saveMessage(context.Background(), channelID, c.user.Email, content)
+	msg, duplicate, err := c.state.saveClientMessage(context.Background(), channelID, c.email, content, nonce, ttl, stickerID)
+	if qe, ok := asQuotaError(err); ok {
+		fail("quota_exceeded", qe.friendly())
+		return
+	}
+	if rejected, ok := asMessageRejected(err); ok {
+		fail("message_rejected", rejected.reason)
+		return
+	}
 	if err != nil {
 		log.Printf("ws save message: %v", err)
-		c.sendError("internal", "failed to save message")
+		fail("internal", "failed to save message")
 		return
 	}
 	if msg.AuthorDisplayName == "" {
-		msg.AuthorDisplayName = c.user.DisplayName
+		msg.AuthorDisplayName = c.currentUser().DisplayName
 	}
 
 	dto := toMessageDTO(msg)
-	c.state.broadcastMessage(dto)
+	if nonce != "" {
+		ack := c.state.maskFor(c.maskProfanity.Load(), dto)
+		c.enqueueJSON(wsOutbound{Type: "message:ack", ChannelID: dto.ChannelID, Message: &ack, Nonce: nonce, Duplicate: duplicate})
+	}
 }
 
 func (c *wsClient) handleVoiceJoin(channelID int64) {
@@ -466,7 +1142,7 @@ func (c *wsClient) handleVoiceJoin(channelID int64) {
 		return
 	}
 
-	hasAccess, err := c.state.userHasServerAccess(context.Background(), c.user.Email, ch.ServerID)
+	hasAccess, err := c.state.userHasServerAccess(context.Background(), c.email, ch.ServerID)
 	if err != nil {
 		c.sendError("internal", "permission check failed")
 		return
@@ -476,16 +1152,31 @@ func (c *wsClient) handleVoiceJoin(channelID int64) {
 		return
 	}
 
-	participants, self, err := c.state.voiceJoin(channelID, c)
+	audio, err := c.state.voiceAudioSettings(context.Background(), channelID)
+	if err != nil {
+		log.Printf("load voice audio settings: %v", err)
+		audio = defaultVoiceAudio
+	}
+
+	previousChannelID := c.voiceChannelID
+	participants, self, err := c.state.voiceJoin(channelID, ch.ServerID, c)
 	if err != nil {
 		log.Printf("voice join: %v", err)
 		c.sendError("internal", "failed to join voice")
 		return
 	}
+	if previousChannelID != channelID || c.voiceSession.Load() == 0 {
+		c.endVoiceSession()
+		c.startVoiceSession(ch, self.JoinedAt)
+	}
 
-	outbound := wsOutbound{Type: "voice:participants", ChannelID: channelID, Participants: participants, Self: &self}
+	c.state.setVoiceRoomAudio(channelID, audio.AudioKbps)
+	bandwidth := c.state.voiceRoomBandwidth(channelID)
+	outbound := wsOutbound{Type: "voice:participants", ChannelID: channelID, Participants: participants, Self: &self, Bandwidth: &bandwidth, Audio: &audio,
+		Recording: c.state.voiceRoomRecording(channelID)}
 	c.enqueueJSON(outbound)
-	c.state.voiceBroadcast(channelID, wsOutbound{Type: "voice:peer-joined", ChannelID: channelID, Peer: &self}, c)
+	c.state.voiceBroadcast(channelID, wsOutbound{Type: "voice:peer-joined", ChannelID: channelID, Peer: &self, Bandwidth: &bandwidth}, c)
+	c.state.recordVoicePeak(context.Background(), ch.ServerID)
 }
 
 func (c *wsClient) handleVoiceLeave(channelID int64) {
@@ -497,7 +1188,9 @@ func (c *wsClient) handleVoiceLeave(channelID int64) {
 	}
 	participant, removed := c.state.voiceLeave(channelID, c)
 	if removed {
-		c.state.voiceBroadcast(channelID, wsOutbound{Type: "voice:peer-left", ChannelID: channelID, Peer: &participant}, c)
+		c.endVoiceSession()
+		bandwidth := c.state.voiceRoomBandwidth(channelID)
+		c.state.voiceBroadcast(channelID, wsOutbound{Type: "voice:peer-left", ChannelID: channelID, Peer: &participant, Bandwidth: &bandwidth}, c)
 	}
 }
 
@@ -527,63 +1220,121 @@ func (c *wsClient) sendError(code, message string) {
 	c.enqueueJSON(wsOutbound{Type: "error", Code: code, Error: message})
 }
 
-func (c *wsClient) enqueue(payload []byte) {
-	select {
-	case c.send <- payload:
-	default:
-		select {
-		case <-c.send:
-		default:
+func (c *wsClient) enqueue(frame wsFrame) {
+	c.sendMu.Lock()
+	if c.sendClosed {
+		c.sendMu.Unlock()
+		return
+	}
+	frame.queuedAt = time.Now().UnixNano()
+	if frame.key != "" {
+		for i := range c.sendQueue {
+			if c.sendQueue[i].key == frame.key {
+				// The slot keeps its place in line, so it keeps its age.
+				frame.queuedAt = c.sendQueue[i].queuedAt
+				c.sendQueue[i] = frame
+				c.sendMu.Unlock()
+				return
+			}
 		}
-		select {
-		case c.send <- payload:
-		default:
+	}
+	if len(c.sendQueue) >= wsSendQueueLimit && !frame.critical {
+		if frame.key != "" {
+			// Snapshot events are superseded by the next one anyway.
+			c.sendMu.Unlock()
+			return
 		}
+		c.sendClosed = true
+		c.sendMu.Unlock()
+		log.Printf("ws client %s too slow, disconnecting", c.email)
+		// Callers may hold hub or voice locks that closing needs.
+		go c.closeWith(wsCloseSlowConsumer, "client too slow")
+		return
+	}
+	c.sendQueue = append(c.sendQueue, frame)
+	if frame.batchable && c.batchEvery > 0 {
+		c.holdForBatch()
+		c.sendMu.Unlock()
+		return
+	}
+	c.sendMu.Unlock()
+	c.wakeWriter()
+}
+
+func (c *wsClient) wakeWriter() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
 	}
 }
 
-func (c *wsClient) enqueueJSON(v any) {
-	payload, err := json.Marshal(v)
+func (c *wsClient) enqueueJSON(outbound wsOutbound) {
+	frame, err := outboundFrame(outbound)
 	if err != nil {
 		log.Printf("ws marshal outbound: %v", err)
 		return
 	}
-	c.enqueue(payload)
+	c.enqueue(frame)
 }
 
 func (c *wsClient) close() {
+	c.closeWith(0, "")
+}
+
+// closeWith tears the connection down, first telling the peer why when code
+// is non-zero.
+func (c *wsClient) closeWith(code int, reason string) {
 	c.closeOnce.Do(func() {
-		if c.voiceChannelID != 0 {
-			participant, removed := c.state.voiceLeave(c.voiceChannelID, c)
+		if channelID := c.voiceChannelID; channelID != 0 {
+			participant, removed := c.state.voiceLeave(channelID, c)
 			if removed {
-				c.state.voiceBroadcast(c.voiceChannelID, wsOutbound{Type: "voice:peer-left", ChannelID: c.voiceChannelID, Peer: &participant}, c)
+				c.endVoiceSession()
+				bandwidth := c.state.voiceRoomBandwidth(channelID)
+				c.state.voiceBroadcast(channelID, wsOutbound{Type: "voice:peer-left", ChannelID: channelID, Peer: &participant, Bandwidth: &bandwidth}, c)
 			}
 		}
 
+		// Saved before the socket closes, so a client that reconnects at
+		// once finds its subscriptions.
+		c.state.saveResume(context.Background(), c, time.Now())
 		c.hub.removeClient(c)
+		if c.hub.connections(c.email) == 0 {
+			go c.state.announcePresence(context.Background(), c.currentUser().ID, c.email)
+		}
 
-		c.mu.Lock()
-		conn := c.conn
-		send := c.send
-		c.conn = nil
-		c.send = nil
-		c.mu.Unlock()
+		c.sendMu.Lock()
+		c.sendClosed = true
+		c.sendQueue = nil
+		c.sendMu.Unlock()
+		close(c.done)
 
-		if send != nil {
-			close(send)
-		}
-		if conn != nil {
-			_ = conn.Close()
+		if code != 0 {
+			msg := websocket.FormatCloseMessage(code, reason)
+			_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
 		}
+		_ = c.conn.Close()
 	})
 }
 
 func (s *serverState) handleWS(w http.ResponseWriter, r *http.Request) {
+	sess, _, ok := s.sessionFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
 	currentUser, ok := s.userFromRequest(r)
 	if !ok {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
+	if !s.origins.allowed(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if s.ws.atCapacity() {
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return
+	}
 
 	conn, err := wsUpgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -593,33 +1344,154 @@ func (s *serverState) handleWS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	client := s.newWSClient(conn, sess, currentUser)
+	client.binary = conn.Subprotocol() == wsProtocolMsgpack
+	s.runWSClient(r, client)
+}
+
+func (s *serverState) newWSClient(conn wsConn, sess sessionInfo, currentUser user) *wsClient {
 	client := &wsClient{
-		id:    generateSessionID(),
-		state: s,
-		hub:   s.ws,
-		conn:  conn,
-		send:  make(chan []byte, 64),
-		user:  currentUser,
+		id:          generateSessionID(),
+		state:       s,
+		hub:         s.ws,
+		conn:        conn,
+		email:       currentUser.Email,
+		userID:      currentUser.ID,
+		connectedAt: time.Now(),
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		voiceMode:   currentUser.VoiceMode,
+		sessionHash: sess.TokenHash,
+		deviceID:    sess.DeviceID,
+		scopes:      sess.Scopes,
+	}
+	client.lastActive.Store(client.connectedAt.UnixNano())
+	client.profile.Store(&currentUser)
+	client.maskProfanity.Store(currentUser.MaskProfanity)
+	return client
+}
+
+// runWSClient registers a connected client, greets it and serves it until
+// it disconnects. r is the request that opened the connection.
+func (s *serverState) runWSClient(r *http.Request, client *wsClient) {
+	if r.URL.Query().Get("batch") == "1" {
+		client.batchEvery = s.wsBatchEvery
 	}
+	resumeToken := generateSessionID()
+	client.resumeHash = hashSessionToken(resumeToken)
+	replaced, ok := s.ws.register(client)
+	if !ok {
+		client.closeWith(websocket.CloseTryAgainLater, "too many connections")
+		return
+	}
+	for _, old := range replaced {
+		old.closeWith(wsCloseReplaced, "connection replaced")
+	}
+	s.touchDevice(r.Context(), client.sessionHash)
 
+	client.sendHello(resumeToken)
+	if token := r.URL.Query().Get("resume"); token != "" {
+		client.resume(token)
+	}
+	if s.ws.connections(client.email) == 1 {
+		s.announcePresence(r.Context(), client.userID, client.email)
+	}
 	go client.writeLoop()
 	client.readLoop()
 }
 
+// broadcastMessage sends a new message to the channel's WebSocket
+// subscribers and its author's other connections. When masking changes the
+// content, connections that asked for it get a masked copy. The outbox
+// delivers at least once, so it may call this more than once for the same
+// message; side effects that must run once belong in messagePublished.
 func (s *serverState) broadcastMessage(msg messageDTO) {
 	outbound := wsOutbound{Type: "message", ChannelID: msg.ChannelID, Message: &msg}
-	payload, err := json.Marshal(outbound)
+	frame, err := outboundFrame(outbound)
 	if err != nil {
 		log.Printf("marshal broadcast message: %v", err)
 		return
 	}
-	s.ws.broadcast(msg.ChannelID, payload)
+	masked := s.maskFor(true, msg)
+	if masked.Content == msg.Content {
+		s.ws.broadcast(msg.ChannelID, frame)
+		s.deliverToAuthor(msg, frame, frame)
+		return
+	}
+	maskedFrame, err := outboundFrame(wsOutbound{Type: "message", ChannelID: msg.ChannelID, Message: &masked})
+	if err != nil {
+		log.Printf("marshal masked message: %v", err)
+		return
+	}
+	s.ws.broadcastTo(msg.ChannelID, frame, func(c *wsClient) bool { return !c.maskProfanity.Load() })
+	s.ws.broadcastTo(msg.ChannelID, maskedFrame, func(c *wsClient) bool { return c.maskProfanity.Load() })
+	s.deliverToAuthor(msg, frame, maskedFrame)
+}
+
+// messagePublished hands a message the outbox has acknowledged to email
+// notifications, bridges, automations and plugins. Unlike broadcastMessage
+// it runs once per message, so none of them act on a redelivery.
+func (s *serverState) messagePublished(msg messageDTO) {
+	s.notifyMessage(msg)
+	s.bridges.enqueue(msg)
+	s.automations.messagePosted(msg)
+	s.plugins.messageBroadcast(msg)
+}
+
+// deliverToAuthor sends a new message to its author's connections that are
+// not subscribed to its channel, such as their other devices after they post
+// over REST or in a DM those devices have not opened.
+func (s *serverState) deliverToAuthor(msg messageDTO, frame, maskedFrame wsFrame) {
+	s.ws.selfEvent(msg.AuthorID, frame, func(c *wsClient) bool {
+		return !c.maskProfanity.Load() && !s.ws.subscribed(c, msg.ChannelID)
+	})
+	s.ws.selfEvent(msg.AuthorID, maskedFrame, func(c *wsClient) bool {
+		return c.maskProfanity.Load() && !s.ws.subscribed(c, msg.ChannelID)
+	})
+}
+
+func (s *serverState) broadcastChannelUpdate(ch channelPayload) {
+	outbound := wsOutbound{Type: "channel:update", ChannelID: ch.ID, Channel: &ch}
+	frame, err := outboundFrame(outbound)
+	if err != nil {
+		log.Printf("marshal channel update: %v", err)
+		return
+	}
+	s.ws.broadcast(ch.ID, frame)
+}
+
+// broadcastChannelTopic tells subscribers that the topic changed, on top of
+// the channel:update carrying the new settings.
+func (s *serverState) broadcastChannelTopic(ch channelPayload) {
+	outbound := wsOutbound{Type: "channel:topic", ChannelID: ch.ID, Channel: &ch}
+	frame, err := outboundFrame(outbound)
+	if err != nil {
+		log.Printf("marshal channel topic: %v", err)
+		return
+	}
+	s.ws.broadcast(ch.ID, frame)
+}
+
+func (s *serverState) broadcastMessageDelete(channelID, messageID int64) {
+	frame, err := outboundFrame(wsOutbound{Type: "message:delete", ChannelID: channelID, MessageID: messageID})
+	if err != nil {
+		log.Printf("marshal message delete: %v", err)
+		return
+	}
+	s.ws.broadcast(channelID, frame)
 }
 
 func (c *wsClient) voiceParticipant() voiceParticipant {
+	u := c.currentUser()
 	return voiceParticipant{
 		ID:          c.voiceID,
-		Email:       c.user.Email,
-		DisplayName: c.user.DisplayName,
+		UserID:      u.ID,
+		Handle:      u.Handle,
+		DisplayName: u.DisplayName,
+		JoinedAt:    c.voiceJoinedAt,
+		Mode:        c.voiceMode,
+		Video:       c.voiceVideo,
+
+		RecordingConsent: c.voiceRecordingConsent,
 	}
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// The hub benchmarks run each case against a single shard, which is how
+// the hub held subscriptions before it was sharded, and against
+// wsHubShards. "contended" sends every goroutine to the same channel and
+// "spread" gives each goroutine channels of its own.
+const (
+	benchHubChannels    = 256
+	benchHubSubscribers = 50 // per channel
+)
+
+var benchHubShardCounts = []int{1, wsHubShards}
+
+func newBenchClient(id int) *wsClient {
+	return &wsClient{
+		id:            strconv.Itoa(id),
+		email:         "bench" + strconv.Itoa(id) + "@example.com",
+		userID:        int64(id),
+		subscriptions: make(map[int64]struct{}),
+		wake:          make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+}
+
+// newBenchHub returns a hub whose channels 1 to benchHubChannels each have
+// benchHubSubscribers clients.
+func newBenchHub(shards int) *wsHub {
+	h := newShardedWSHub(0, 0, shards)
+	h.metrics = newMetrics()
+	id := 0
+	for channelID := int64(1); channelID <= benchHubChannels; channelID++ {
+		for range benchHubSubscribers {
+			id++
+			client := newBenchClient(id)
+			h.register(client)
+			h.subscribe(client, channelID)
+		}
+	}
+	return h
+}
+
+// benchHubChannel picks the channel for a goroutine's next operation.
+type benchHubChannel func() int64
+
+func benchHubModes(b *testing.B, run func(b *testing.B, h *wsHub, channel func() benchHubChannel)) {
+	for _, shards := range benchHubShardCounts {
+		b.Run("contended/shards="+strconv.Itoa(shards), func(b *testing.B) {
+			run(b, newBenchHub(shards), func() benchHubChannel {
+				return func() int64 { return 1 }
+			})
+		})
+		b.Run("spread/shards="+strconv.Itoa(shards), func(b *testing.B) {
+			var goroutines atomic.Int64
+			run(b, newBenchHub(shards), func() benchHubChannel {
+				next := goroutines.Add(1)
+				return func() int64 {
+					next = next%benchHubChannels + 1
+					return next
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkHubBroadcast(b *testing.B) {
+	// A keyed frame replaces the one already queued, so queues stay short
+	// without a writer draining them.
+	frame := wsFrame{payload: []byte(`{"type":"typing"}`), key: "bench"}
+	benchHubModes(b, func(b *testing.B, h *wsHub, channel func() benchHubChannel) {
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			next := channel()
+			for pb.Next() {
+				h.broadcast(next(), frame)
+			}
+		})
+	})
+}
+
+func BenchmarkHubSubscribe(b *testing.B) {
+	var clients atomic.Int64
+	benchHubModes(b, func(b *testing.B, h *wsHub, channel func() benchHubChannel) {
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			next := channel()
+			client := newBenchClient(-int(clients.Add(1)))
+			for pb.Next() {
+				channelID := next()
+				h.subscribe(client, channelID)
+				h.unsubscribe(client, channelID)
+			}
+		})
+	})
+}
+
+// BenchmarkHubMixed broadcasts while one operation in ten subscribes and
+// unsubscribes, as happens when people join channels during busy traffic.
+func BenchmarkHubMixed(b *testing.B) {
+	frame := wsFrame{payload: []byte(`{"type":"typing"}`), key: "bench"}
+	var clients atomic.Int64
+	benchHubModes(b, func(b *testing.B, h *wsHub, channel func() benchHubChannel) {
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			next := channel()
+			client := newBenchClient(-int(clients.Add(1)))
+			for i := 0; pb.Next(); i++ {
+				channelID := next()
+				if i%10 == 0 {
+					h.subscribe(client, channelID)
+					h.unsubscribe(client, channelID)
+				} else {
+					h.broadcast(channelID, frame)
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"time"
+)
+
+// defaultWSBatchInterval is how long batchable frames wait for company on
+// connections that opt into batching with ?batch=1, overridable with
+// WS_BATCH_INTERVAL (0 turns batching off for everyone).
+const defaultWSBatchInterval = 50 * time.Millisecond
+
+// holdForBatch opens a batch window for a batchable frame just queued, so
+// the writer wakes once for everything that arrives before it ends. The
+// caller holds sendMu. Any other frame wakes the writer early and takes the
+// held ones along.
+func (c *wsClient) holdForBatch() {
+	if c.flushPending {
+		return
+	}
+	c.flushPending = true
+	time.AfterFunc(c.batchEvery, func() {
+		c.sendMu.Lock()
+		c.flushPending = false
+		c.sendMu.Unlock()
+		c.wakeWriter()
+	})
+}
+
+// coalesceFrames replaces each run of two or more batchable frames with one
+// "batch" frame carrying their events in order.
+func coalesceFrames(frames []wsFrame) []wsFrame {
+	out := frames[:0]
+	for i := 0; i < len(frames); {
+		j := i
+		for j < len(frames) && frames[j].batchable {
+			j++
+		}
+		if j-i < 2 {
+			out = append(out, frames[i])
+			i++
+			continue
+		}
+		out = append(out, batchFrame(frames[i:j]))
+		i = j
+	}
+	return out
+}
+
+func batchFrame(frames []wsFrame) wsFrame {
+	var b bytes.Buffer
+	b.WriteString(`{"type":"batch","events":[`)
+	for i, frame := range frames {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.Write(frame.payload)
+	}
+	b.WriteString(`]}`)
+	return wsFrame{payload: b.Bytes(), queuedAt: frames[0].queuedAt}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	// defaultWSLagThreshold is how old the oldest unsent frame of a
+	// connection may get before the lag monitor counts it as behind,
+	// overridable with WS_LAG_THRESHOLD (0 turns the monitor off).
+	defaultWSLagThreshold = 5 * time.Second
+	wsLagCheckEvery       = 5 * time.Second
+
+	// wsLagStrikes consecutive checks behind, half a minute, close the
+	// connection with wsCloseSlowConsumer. A client that drains its queue in
+	// between starts over.
+	wsLagStrikes = 6
+)
+
+// sendLag reports how many frames are waiting for the client and how long
+// the oldest of them, or of the batch being written, has waited.
+func (c *wsClient) sendLag(now time.Time) (depth int, lag time.Duration) {
+	c.sendMu.Lock()
+	depth = len(c.sendQueue)
+	var oldest int64
+	if depth > 0 {
+		oldest = c.sendQueue[0].queuedAt
+	}
+	c.sendMu.Unlock()
+	if writing := c.writingSince.Load(); writing != 0 && (oldest == 0 || writing < oldest) {
+		oldest = writing
+	}
+	if oldest == 0 {
+		return depth, 0
+	}
+	return depth, now.Sub(time.Unix(0, oldest))
+}
+
+// runLagMonitor checks every connection's send queue, warning about clients
+// that fall behind and closing those that stay behind. The queue limit in
+// enqueue catches bursts; this catches a reader that keeps up too slowly to
+// ever hit it.
+func (s *serverState) runLagMonitor(ctx context.Context) {
+	if s.wsLagThreshold <= 0 {
+		return
+	}
+	ticker := time.NewTicker(wsLagCheckEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.checkLag(time.Now())
+	}
+}
+
+func (s *serverState) checkLag(now time.Time) {
+	for _, c := range s.ws.snapshot() {
+		depth, lag := c.sendLag(now)
+		if lag < s.wsLagThreshold {
+			c.lagStrikes.Store(0)
+			continue
+		}
+		switch strikes := c.lagStrikes.Add(1); {
+		case strikes == 1:
+			log.Printf("ws client %s lagging: %d frames queued, oldest %s", c.email, depth, lag.Round(time.Millisecond))
+		case strikes >= wsLagStrikes:
+			log.Printf("ws client %s lagged for %s, disconnecting", c.email, time.Duration(strikes)*wsLagCheckEvery)
+			s.metrics.countLagDisconnect()
+			c.closeWith(wsCloseSlowConsumer, "client too slow")
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultWSLatencyInterval is how often connections are pinged to measure
+// round-trip time, overridable with WS_LATENCY_INTERVAL (0 leaves only the
+// keepalive ping every wsPingPeriod).
+const defaultWSLatencyInterval = 15 * time.Second
+
+// sendPing writes a ping carrying the send time, which the pong echoes back.
+func (c *wsClient) sendPing() error {
+	payload := strconv.FormatInt(time.Now().UnixNano(), 10)
+	return c.conn.WriteControl(websocket.PingMessage, []byte(payload), time.Now().Add(wsWriteWait))
+}
+
+// handlePong records the round trip of one of our pings and tells the client
+// with a latency frame. Pongs without a timestamp, such as unsolicited ones,
+// only extend the read deadline.
+func (c *wsClient) handlePong(payload string) error {
+	if err := c.conn.SetReadDeadline(time.Now().Add(wsPongWait)); err != nil {
+		return err
+	}
+	sent, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil {
+		return nil
+	}
+	rtt := time.Since(time.Unix(0, sent))
+	if rtt < 0 || rtt > wsPongWait {
+		return nil
+	}
+	c.rtt.Store(int64(rtt))
+	c.state.metrics.observeWSRTT(rtt)
+	ms := roundMillis(rtt)
+	c.enqueueJSON(wsOutbound{Type: "latency", RTTMillis: &ms})
+	return nil
+}
+
+func roundMillis(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*10) / 10
+}
+
+type wsConnectionDTO struct {
+	ID             string    `json:"id"`
+	UserID         int64     `json:"userId"`
+	Handle         string    `json:"handle"`
+	DeviceID       string    `json:"deviceId"`
+	ConnectedAt    time.Time `json:"connectedAt"`
+	LastActiveAt   time.Time `json:"lastActiveAt"`
+	RTTMillis      *float64  `json:"rttMs"`
+	Protocol       string    `json:"protocol"`
+	Transport      string    `json:"transport"`
+	Subscriptions  int       `json:"subscriptions"`
+	QueueDepth     int       `json:"queueDepth"`
+	LagMillis      float64   `json:"lagMs"`
+	Lagging        bool      `json:"lagging"`
+	VoiceChannelID int64     `json:"voiceChannelId,omitempty"`
+}
+
+func (h *wsHub) snapshot() []*wsClient {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	clients := make([]*wsClient, 0, h.clients)
+	for _, set := range h.userClients {
+		for client := range set {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// handleAdminConnections serves /api/admin/connections: every open WebSocket
+// on this instance with its last measured round-trip time and send backlog.
+// ?lagging=true keeps only the connections the lag monitor found behind.
+func (s *serverState) handleAdminConnections(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireOperator(w, r); !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	onlyLagging := r.URL.Query().Get("lagging") == "true"
+	now := time.Now()
+	clients := s.ws.snapshot()
+	result := make([]wsConnectionDTO, 0, len(clients))
+	s.voice.mu.RLock()
+	for _, c := range clients {
+		lagging := c.lagStrikes.Load() > 0
+		if onlyLagging && !lagging {
+			continue
+		}
+		u := c.currentUser()
+		conn := wsConnectionDTO{
+			ID:             c.id,
+			UserID:         u.ID,
+			Handle:         u.Handle,
+			DeviceID:       c.deviceID,
+			ConnectedAt:    c.connectedAt.UTC(),
+			LastActiveAt:   time.Unix(0, c.lastActive.Load()).UTC(),
+			Protocol:       "json",
+			Transport:      "websocket",
+			VoiceChannelID: c.voiceChannelID,
+		}
+		if c.binary {
+			conn.Protocol = wsProtocolMsgpack
+		}
+		if c.webTransport {
+			conn.Transport = "webtransport"
+		}
+		if rtt := c.rtt.Load(); rtt > 0 {
+			ms := roundMillis(time.Duration(rtt))
+			conn.RTTMillis = &ms
+		}
+		depth, lag := c.sendLag(now)
+		conn.QueueDepth, conn.LagMillis, conn.Lagging = depth, roundMillis(lag), lagging
+		c.mu.Lock()
+		conn.Subscriptions = len(c.subscriptions)
+		c.mu.Unlock()
+		result = append(result, conn)
+	}
+	s.voice.mu.RUnlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].ConnectedAt.Before(result[j].ConnectedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("encode connections: %v", err)
+	}
+}
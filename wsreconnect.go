@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Reconnect backoff advertised in the hello frame, overridable with
+	// WS_RECONNECT_MIN and WS_RECONNECT_MAX. Clients double the delay after
+	// each failed attempt and subtract up to wsReconnectJitter of it at
+	// random, so a restart does not bring every client back at once.
+	defaultWSReconnectMin = time.Second
+	defaultWSReconnectMax = time.Minute
+	wsReconnectJitter     = 0.5
+
+	// wsCloseAuthExpired ends connections whose session ran out, was signed
+	// out or was revoked by a password change; the client has to sign in
+	// again.
+	wsCloseAuthExpired = 4012
+	// wsCloseShuttingDown is sent to every connection when the server stops.
+	wsCloseShuttingDown = 4013
+	wsShutdownRetry     = 5 * time.Second
+	// wsCloseRateLimited drops clients that send events faster than
+	// WS_EVENT_RATE per second (with bursts of twice that; 0 disables it).
+	wsCloseRateLimited = 4014
+	defaultWSEventRate = 20
+	wsRateLimitRetry   = 30 * time.Second
+
+	// shutdownGracePeriod bounds how long in-flight HTTP requests may take
+	// to finish once the server has been told to stop.
+	shutdownGracePeriod = 10 * time.Second
+)
+
+// What a client should do after each close code, as listed in the hello
+// frame.
+const (
+	wsActionReconnect = "reconnect" // back off from minMs and reconnect
+	wsActionResync    = "resync"    // reconnect, then refetch history
+	wsActionWait      = "wait"      // stay offline until the user is back
+	wsActionLogin     = "login"     // the session is gone; sign in again
+	wsActionRetry     = "retry"     // reconnect no sooner than retryAfterMs
+)
+
+type wsCloseGuidance struct {
+	Code             int    `json:"code"`
+	Reason           string `json:"reason"`
+	Action           string `json:"action"`
+	RetryAfterMillis int64  `json:"retryAfterMs,omitempty"`
+}
+
+type wsReconnectPolicy struct {
+	MinMillis  int64             `json:"minMs"`
+	MaxMillis  int64             `json:"maxMs"`
+	Jitter     float64           `json:"jitter"`
+	CloseCodes []wsCloseGuidance `json:"closeCodes"`
+}
+
+func wsReconnectPolicyFromEnv() wsReconnectPolicy {
+	min := durationFromEnv("WS_RECONNECT_MIN", defaultWSReconnectMin)
+	max := durationFromEnv("WS_RECONNECT_MAX", defaultWSReconnectMax)
+	if max < min {
+		log.Printf("WS_RECONNECT_MAX %s is below WS_RECONNECT_MIN %s; using %s for both", max, min, min)
+		max = min
+	}
+	return wsReconnectPolicy{
+		MinMillis: min.Milliseconds(),
+		MaxMillis: max.Milliseconds(),
+		Jitter:    wsReconnectJitter,
+		CloseCodes: []wsCloseGuidance{
+			{Code: wsCloseSlowConsumer, Reason: "client too slow", Action: wsActionResync},
+			{Code: wsCloseReplaced, Reason: "connection replaced", Action: wsActionWait},
+			{Code: wsCloseIdle, Reason: "idle timeout", Action: wsActionWait},
+			{Code: wsCloseSignedOut, Reason: "signed out", Action: wsActionLogin},
+			{Code: wsCloseAuthExpired, Reason: "session ended", Action: wsActionLogin},
+			{Code: wsCloseShuttingDown, Reason: "server shutting down", Action: wsActionRetry, RetryAfterMillis: wsShutdownRetry.Milliseconds()},
+			{Code: wsCloseRateLimited, Reason: "rate limited", Action: wsActionRetry, RetryAfterMillis: wsRateLimitRetry.Milliseconds()},
+			{Code: wsCloseKicked, Reason: "kicked", Action: wsActionWait},
+			{Code: websocket.CloseTryAgainLater, Reason: "too many connections", Action: wsActionRetry, RetryAfterMillis: wsRateLimitRetry.Milliseconds()},
+		},
+	}
+}
+
+// sendHello is the first frame on every connection. resumeToken lets the
+// next connection pick up this one's subscriptions; see wsresume.go.
+func (c *wsClient) sendHello(resumeToken string) {
+	policy := c.state.wsReconnect
+	c.enqueueJSON(wsOutbound{Type: "hello", ConnectionID: c.id, DeviceID: c.deviceID, Reconnect: &policy, ResumeToken: resumeToken})
+}
+
+// allowEvent takes a token from the client's event bucket. It is only called
+// from readLoop, so the bucket needs no lock.
+func (c *wsClient) allowEvent() bool {
+	rate := float64(c.state.wsEventRate)
+	if rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	if c.eventsAt.IsZero() {
+		c.eventTokens = 2 * rate
+	} else {
+		c.eventTokens += now.Sub(c.eventsAt).Seconds() * rate
+		if c.eventTokens > 2*rate {
+			c.eventTokens = 2 * rate
+		}
+	}
+	c.eventsAt = now
+	if c.eventTokens < 1 {
+		return false
+	}
+	c.eventTokens--
+	return true
+}
+
+// sessionCloseCode reports wsCloseAuthExpired once the connection's session
+// has expired or been deleted, or 0 while it is still valid. Sessions are
+// renewed by HTTP requests and may be revoked by another process such as
+// "echosphere reset-password", so an open socket only learns about it by
+// looking.
+func (c *wsClient) sessionCloseCode() int {
+	var expiresAt time.Time
+	err := c.state.readDB.QueryRowContext(context.Background(), `SELECT expires_at FROM sessions WHERE token_hash = ?`, c.sessionHash).Scan(&expiresAt)
+	switch {
+	case err == nil && time.Now().After(expiresAt):
+		return wsCloseAuthExpired
+	case err == nil:
+		return 0
+	case errors.Is(err, sql.ErrNoRows):
+		return wsCloseAuthExpired
+	default:
+		log.Printf("ws session check: %v", err)
+		return 0
+	}
+}
+
+// closeAll disconnects every client with code, as on shutdown.
+func (h *wsHub) closeAll(code int, reason string) {
+	for _, client := range h.snapshot() {
+		client.closeWith(code, reason)
+	}
+}
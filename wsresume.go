@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	// wsResumeTTL is how long after a connection drops its resume token
+	// still restores its subscriptions.
+	wsResumeTTL        = 5 * time.Minute
+	wsResumePruneEvery = 10 * time.Minute
+
+	// wsResumeOverlap is replayed from before the drop as well, for events
+	// the outbox had not published to the old connection yet. Clients already
+	// ignore message ids they have.
+	wsResumeOverlap = 5 * time.Second
+)
+
+// saveResume records the connection's subscriptions under its resume token
+// as it closes, for the next connection of the same session to pick
+// up with ?resume=.
+func (s *serverState) saveResume(ctx context.Context, c *wsClient, closedAt time.Time) {
+	c.mu.Lock()
+	channelIDs := make([]int64, 0, len(c.subscriptions))
+	for channelID := range c.subscriptions {
+		channelIDs = append(channelIDs, channelID)
+	}
+	c.mu.Unlock()
+	if len(channelIDs) == 0 {
+		return
+	}
+	encoded, err := json.Marshal(channelIDs)
+	if err != nil {
+		log.Printf("encode resume subscriptions: %v", err)
+		return
+	}
+	if _, err := s.db.ExecContext(ctx, `
+        INSERT OR REPLACE INTO ws_resumes (token_hash, session_hash, channel_ids, closed_at) VALUES (?, ?, ?, ?)
+    `, c.resumeHash, c.sessionHash, string(encoded), closedAt.UTC()); err != nil {
+		log.Printf("save ws resume: %v", err)
+	}
+}
+
+// takeResume returns, and forgets, the subscriptions and close time saved
+// under token for the session. It reports false when there are none or they
+// have expired.
+func (s *serverState) takeResume(ctx context.Context, token, sessionHash string) ([]int64, time.Time, bool, error) {
+	var encoded string
+	var closedAt time.Time
+	err := s.db.QueryRowContext(ctx, `
+        DELETE FROM ws_resumes WHERE token_hash = ? AND session_hash = ?
+        RETURNING channel_ids, closed_at
+    `, hashSessionToken(token), sessionHash).Scan(&encoded, &closedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, time.Time{}, false, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+	if time.Since(closedAt) > wsResumeTTL {
+		return nil, time.Time{}, false, nil
+	}
+	var channelIDs []int64
+	if err := json.Unmarshal([]byte(encoded), &channelIDs); err != nil {
+		return nil, time.Time{}, false, err
+	}
+	return channelIDs, closedAt, true, nil
+}
+
+// resume restores the subscriptions saved under token and sends them in a
+// resumed frame, along with the sync events since the old connection dropped.
+// Channels the user can no longer see come back as rejected. Without a
+// usable token the client gets a resume_expired error and subscribes itself.
+func (c *wsClient) resume(token string) {
+	ctx := context.Background()
+	channelIDs, closedAt, ok, err := c.state.takeResume(ctx, token, c.sessionHash)
+	if err != nil {
+		log.Printf("take ws resume: %v", err)
+	}
+	if !ok {
+		c.sendError("resume_expired", "nothing to resume; subscribe again")
+		return
+	}
+	allowed, err := c.state.accessibleChannelIDs(ctx, c.email, channelIDs)
+	if err != nil {
+		log.Printf("ws resume access: %v", err)
+		c.sendError("resume_expired", "nothing to resume; subscribe again")
+		return
+	}
+
+	resumed := wsOutbound{Type: "resumed", ChannelIDs: []int64{}}
+	c.mu.Lock()
+	if c.subscriptions == nil {
+		c.subscriptions = make(map[int64]struct{})
+	}
+	for _, id := range channelIDs {
+		if !allowed[id] {
+			resumed.Rejected = append(resumed.Rejected, id)
+			continue
+		}
+		c.subscriptions[id] = struct{}{}
+		resumed.ChannelIDs = append(resumed.ChannelIDs, id)
+	}
+	c.mu.Unlock()
+	c.hub.subscribeMany(c, resumed.ChannelIDs)
+
+	// Subscribed first, so nothing falls between the replay and live events.
+	// Without a replay the client catches up over /api/sync instead.
+	since, err := c.state.syncCheckpoint(ctx, closedAt.Add(-wsResumeOverlap).Format(time.RFC3339))
+	if err == nil {
+		var payload syncPayload
+		if payload, err = c.state.syncEvents(ctx, c.currentUser(), since, defaultSyncLimit); err == nil {
+			resumed.Sync = &payload
+		}
+	}
+	if err != nil && !errors.Is(err, errSyncExpired) {
+		log.Printf("ws resume replay: %v", err)
+	}
+	c.enqueueJSON(resumed)
+	c.state.deliverPendingEphemeral(ctx, c, resumed.ChannelIDs)
+}
+
+// pruneResumes drops resume records too old to be used.
+func (s *serverState) pruneResumes(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM ws_resumes WHERE closed_at < ?`, time.Now().UTC().Add(-wsResumeTTL))
+	return err
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/big"
+	"slices"
+	"strings"
+)
+
+const (
+	xmlNamespace    = "http://www.w3.org/XML/1998/namespace"
+	xmldsigNS       = "http://www.w3.org/2000/09/xmldsig#"
+	excC14N         = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	envelopedSigAlg = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+)
+
+var (
+	errXMLUnsigned  = errors.New("element is not signed")
+	errXMLSignature = errors.New("invalid XML signature")
+)
+
+// Signature and digest algorithms accepted in signed SAML messages. SHA-1
+// is not among them.
+var (
+	xmlDigestAlgorithms = map[string]crypto.Hash{
+		"http://www.w3.org/2001/04/xmlenc#sha256": crypto.SHA256,
+		"http://www.w3.org/2001/04/xmlenc#sha512": crypto.SHA512,
+	}
+	xmlSignatureAlgorithms = map[string]crypto.Hash{
+		"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256":   crypto.SHA256,
+		"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512":   crypto.SHA512,
+		"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256": crypto.SHA256,
+		"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha512": crypto.SHA512,
+	}
+)
+
+// xmlElement is an element of a parsed XML document. Unlike encoding/xml's
+// unmarshalling it keeps what canonicalization needs: the prefixes as
+// written, the namespace declarations and the text between elements.
+type xmlElement struct {
+	prefix   string
+	local    string
+	space    string
+	attrs    []xmlAttr
+	ns       map[string]string
+	parent   *xmlElement
+	children []xmlNode
+}
+
+type xmlAttr struct {
+	prefix string
+	local  string
+	space  string
+	value  string
+}
+
+// xmlNode is one of an element's children: an element, text or a
+// processing instruction.
+type xmlNode struct {
+	el   *xmlElement
+	text string
+	pi   *xml.ProcInst
+}
+
+// parseXMLTree parses a document, rejecting DTDs so entity declarations
+// cannot expand or smuggle content.
+func parseXMLTree(data []byte) (*xmlElement, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var root, cur *xmlElement
+	for {
+		tok, err := d.RawToken()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if root != nil && cur == nil {
+				return nil, errors.New("content after the document element")
+			}
+			el, err := newXMLElement(t, cur)
+			if err != nil {
+				return nil, err
+			}
+			if cur == nil {
+				root = el
+			} else {
+				cur.children = append(cur.children, xmlNode{el: el})
+			}
+			cur = el
+		case xml.EndElement:
+			if cur == nil || t.Name.Space != cur.prefix || t.Name.Local != cur.local {
+				return nil, fmt.Errorf("unexpected end element %s", t.Name.Local)
+			}
+			cur = cur.parent
+		case xml.CharData:
+			if cur == nil {
+				if len(bytes.TrimSpace(t)) > 0 {
+					return nil, errors.New("text outside the document element")
+				}
+				continue
+			}
+			cur.children = append(cur.children, xmlNode{text: string(t)})
+		case xml.ProcInst:
+			if cur != nil {
+				cur.children = append(cur.children, xmlNode{pi: &xml.ProcInst{Target: t.Target, Inst: bytes.Clone(t.Inst)}})
+			}
+		case xml.Directive:
+			return nil, errors.New("DTDs are not allowed")
+		}
+	}
+	if root == nil || cur != nil {
+		return nil, errors.New("incomplete document")
+	}
+	return root, nil
+}
+
+func newXMLElement(t xml.StartElement, parent *xmlElement) (*xmlElement, error) {
+	el := &xmlElement{prefix: t.Name.Space, local: t.Name.Local, parent: parent}
+	for _, a := range t.Attr {
+		switch {
+		case a.Name.Space == "" && a.Name.Local == "xmlns":
+			el.declare("", a.Value)
+		case a.Name.Space == "xmlns":
+			el.declare(a.Name.Local, a.Value)
+		default:
+			el.attrs = append(el.attrs, xmlAttr{prefix: a.Name.Space, local: a.Name.Local, value: a.Value})
+		}
+	}
+	var ok bool
+	if el.space, ok = el.lookup(el.prefix); !ok {
+		return nil, fmt.Errorf("undeclared namespace prefix %s", el.prefix)
+	}
+	seen := make(map[[2]string]bool, len(el.attrs))
+	for i := range el.attrs {
+		a := &el.attrs[i]
+		if a.prefix != "" {
+			if a.space, ok = el.lookup(a.prefix); !ok {
+				return nil, fmt.Errorf("undeclared namespace prefix %s", a.prefix)
+			}
+		}
+		// A repeated attribute could show the signature one value and the
+		// reader another.
+		key := [2]string{a.space, a.local}
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate attribute %s", a.local)
+		}
+		seen[key] = true
+	}
+	return el, nil
+}
+
+func (e *xmlElement) declare(prefix, uri string) {
+	if e.ns == nil {
+		e.ns = make(map[string]string)
+	}
+	e.ns[prefix] = uri
+}
+
+// lookup resolves a prefix to the namespace in scope at e. Without a
+// declaration the default namespace is empty.
+func (e *xmlElement) lookup(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return xmlNamespace, true
+	}
+	for n := e; n != nil; n = n.parent {
+		if uri, ok := n.ns[prefix]; ok {
+			return uri, true
+		}
+	}
+	return "", prefix == ""
+}
+
+func (e *xmlElement) is(space, local string) bool {
+	return e.space == space && e.local == local
+}
+
+// attr returns the value of an attribute without a namespace.
+func (e *xmlElement) attr(local string) string {
+	for _, a := range e.attrs {
+		if a.space == "" && a.local == local {
+			return a.value
+		}
+	}
+	return ""
+}
+
+func (e *xmlElement) child(space, local string) *xmlElement {
+	for _, c := range e.children {
+		if c.el != nil && c.el.is(space, local) {
+			return c.el
+		}
+	}
+	return nil
+}
+
+func (e *xmlElement) childrenNamed(space, local string) []*xmlElement {
+	var found []*xmlElement
+	for _, c := range e.children {
+		if c.el != nil && c.el.is(space, local) {
+			found = append(found, c.el)
+		}
+	}
+	return found
+}
+
+// text returns the element's own text, without that of child elements.
+func (e *xmlElement) text() string {
+	var b strings.Builder
+	for _, c := range e.children {
+		if c.el == nil && c.pi == nil {
+			b.WriteString(c.text)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// countID counts the elements under e, e included, with the ID attribute
+// id.
+func (e *xmlElement) countID(id string) int {
+	n := 0
+	if e.attr("ID") == id {
+		n++
+	}
+	for _, c := range e.children {
+		if c.el != nil {
+			n += c.el.countID(id)
+		}
+	}
+	return n
+}
+
+// canonicalXML serializes e by Exclusive XML Canonicalization without
+// comments, leaving out the element skip. inclusive lists the prefixes of
+// an InclusiveNamespaces PrefixList, "#default" standing for the default
+// namespace.
+func canonicalXML(e, skip *xmlElement, inclusive []string) []byte {
+	var b bytes.Buffer
+	writeCanonical(&b, e, skip, inclusive, map[string]string{})
+	return b.Bytes()
+}
+
+func writeCanonical(b *bytes.Buffer, e, skip *xmlElement, inclusive []string, rendered map[string]string) {
+	// Only the namespaces the element and its attributes use are rendered,
+	// and only where the output ancestors have not already done so.
+	used := []string{e.prefix}
+	for _, a := range e.attrs {
+		if a.prefix != "" {
+			used = append(used, a.prefix)
+		}
+	}
+	for _, p := range inclusive {
+		if p == "#default" {
+			p = ""
+		}
+		used = append(used, p)
+	}
+	slices.Sort(used)
+	used = slices.Compact(used)
+
+	scope, copied := rendered, false
+	var decls strings.Builder
+	for _, p := range used {
+		if p == "xml" {
+			continue
+		}
+		uri, ok := e.lookup(p)
+		if !ok {
+			continue
+		}
+		prev, had := scope[p]
+		if had && prev == uri || !had && uri == "" {
+			continue
+		}
+		if !copied {
+			scope, copied = maps.Clone(rendered), true
+		}
+		scope[p] = uri
+		if p == "" {
+			decls.WriteString(` xmlns="`)
+		} else {
+			decls.WriteString(` xmlns:` + p + `="`)
+		}
+		writeCanonicalAttr(&decls, uri)
+		decls.WriteString(`"`)
+	}
+
+	name := e.local
+	if e.prefix != "" {
+		name = e.prefix + ":" + e.local
+	}
+	b.WriteString("<" + name + decls.String())
+	attrs := slices.Clone(e.attrs)
+	slices.SortFunc(attrs, func(x, y xmlAttr) int {
+		if c := strings.Compare(x.space, y.space); c != 0 {
+			return c
+		}
+		return strings.Compare(x.local, y.local)
+	})
+	for _, a := range attrs {
+		var v strings.Builder
+		writeCanonicalAttr(&v, a.value)
+		if a.prefix != "" {
+			b.WriteString(" " + a.prefix + ":" + a.local + `="` + v.String() + `"`)
+		} else {
+			b.WriteString(" " + a.local + `="` + v.String() + `"`)
+		}
+	}
+	b.WriteString(">")
+	for _, c := range e.children {
+		switch {
+		case c.el != nil:
+			if c.el != skip {
+				writeCanonical(b, c.el, skip, inclusive, scope)
+			}
+		case c.pi != nil:
+			b.WriteString("<?" + c.pi.Target)
+			if len(c.pi.Inst) > 0 {
+				b.WriteString(" ")
+				b.Write(c.pi.Inst)
+			}
+			b.WriteString("?>")
+		default:
+			b.WriteString(strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;").Replace(c.text))
+		}
+	}
+	b.WriteString("</" + name + ">")
+}
+
+func writeCanonicalAttr(b *strings.Builder, v string) {
+	b.WriteString(strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;").Replace(v))
+}
+
+// verifyEnvelopedSignature checks the Signature that is a child of e and
+// signs e, referenced by its ID, with one of certs. root is the whole
+// document: the ID has to be unique in it, so the signature cannot be
+// moved to vouch for a different element than the one being read.
+func verifyEnvelopedSignature(root, e *xmlElement, certs []*x509.Certificate) error {
+	sigs := e.childrenNamed(xmldsigNS, "Signature")
+	if len(sigs) == 0 {
+		return errXMLUnsigned
+	}
+	if len(sigs) > 1 {
+		return fmt.Errorf("%w: more than one signature", errXMLSignature)
+	}
+	sig := sigs[0]
+	signedInfo := sig.child(xmldsigNS, "SignedInfo")
+	if signedInfo == nil {
+		return fmt.Errorf("%w: no SignedInfo", errXMLSignature)
+	}
+	c14nMethod := signedInfo.child(xmldsigNS, "CanonicalizationMethod")
+	if c14nMethod == nil || c14nMethod.attr("Algorithm") != excC14N {
+		return fmt.Errorf("%w: unsupported canonicalization", errXMLSignature)
+	}
+	sigMethod := signedInfo.child(xmldsigNS, "SignatureMethod")
+	if sigMethod == nil {
+		return fmt.Errorf("%w: no SignatureMethod", errXMLSignature)
+	}
+	sigAlg := sigMethod.attr("Algorithm")
+	sigHash, ok := xmlSignatureAlgorithms[sigAlg]
+	if !ok {
+		return fmt.Errorf("%w: unsupported signature algorithm %s", errXMLSignature, sigAlg)
+	}
+
+	refs := signedInfo.childrenNamed(xmldsigNS, "Reference")
+	id := e.attr("ID")
+	if len(refs) != 1 || id == "" || refs[0].attr("URI") != "#"+id {
+		return fmt.Errorf("%w: signature does not reference the signed element", errXMLSignature)
+	}
+	if root.countID(id) != 1 {
+		return fmt.Errorf("%w: ID %s is not unique", errXMLSignature, id)
+	}
+	ref := refs[0]
+	var inclusive []string
+	if transforms := ref.child(xmldsigNS, "Transforms"); transforms != nil {
+		for _, t := range transforms.childrenNamed(xmldsigNS, "Transform") {
+			switch t.attr("Algorithm") {
+			case envelopedSigAlg:
+			case excC14N:
+				inclusive = inclusivePrefixes(t)
+			default:
+				return fmt.Errorf("%w: unsupported transform %s", errXMLSignature, t.attr("Algorithm"))
+			}
+		}
+	}
+	digestMethod := ref.child(xmldsigNS, "DigestMethod")
+	if digestMethod == nil {
+		return fmt.Errorf("%w: no DigestMethod", errXMLSignature)
+	}
+	digestHash, ok := xmlDigestAlgorithms[digestMethod.attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("%w: unsupported digest algorithm %s", errXMLSignature, digestMethod.attr("Algorithm"))
+	}
+	digestValue := ref.child(xmldsigNS, "DigestValue")
+	if digestValue == nil {
+		return fmt.Errorf("%w: no DigestValue", errXMLSignature)
+	}
+	want, err := decodeXMLBase64(digestValue.text())
+	if err != nil {
+		return fmt.Errorf("%w: digest: %v", errXMLSignature, err)
+	}
+	if !hmac.Equal(xmlHash(digestHash, canonicalXML(e, sig, inclusive)), want) {
+		return fmt.Errorf("%w: digest mismatch", errXMLSignature)
+	}
+
+	sigValue := sig.child(xmldsigNS, "SignatureValue")
+	if sigValue == nil {
+		return fmt.Errorf("%w: no SignatureValue", errXMLSignature)
+	}
+	signature, err := decodeXMLBase64(sigValue.text())
+	if err != nil {
+		return fmt.Errorf("%w: signature value: %v", errXMLSignature, err)
+	}
+	digest := xmlHash(sigHash, canonicalXML(signedInfo, nil, inclusivePrefixes(c14nMethod)))
+	for _, cert := range certs {
+		if verifyXMLSignatureValue(cert.PublicKey, sigHash, digest, signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: not signed by a trusted key", errXMLSignature)
+}
+
+func inclusivePrefixes(transform *xmlElement) []string {
+	if in := transform.child(excC14N, "InclusiveNamespaces"); in != nil {
+		return strings.Fields(in.attr("PrefixList"))
+	}
+	return nil
+}
+
+func xmlHash(h crypto.Hash, data []byte) []byte {
+	switch h {
+	case crypto.SHA512:
+		sum := sha512.Sum512(data)
+		return sum[:]
+	default:
+		sum := sha256.Sum256(data)
+		return sum[:]
+	}
+}
+
+func decodeXMLBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+func verifyXMLSignatureValue(pub crypto.PublicKey, h crypto.Hash, digest, signature []byte) bool {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, h, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// XML Signature encodes ECDSA signatures as r and s side by side
+		// (RFC 4051), not in ASN.1.
+		if len(signature)%2 != 0 {
+			return false
+		}
+		half := len(signature) / 2
+		return ecdsa.Verify(key, digest, new(big.Int).SetBytes(signature[:half]), new(big.Int).SetBytes(signature[half:]))
+	}
+	return false
+}